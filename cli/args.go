@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// splitArgs splits a command line into words. Words are separated by runs
+// of whitespace; single or double quotes group words, keeping the spaces
+// inside them, and a backslash escapes the next character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// parseIDs parses a comma separated list of node ids.
+func parseIDs(list string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(list, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid node id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseConsistency takes a "--consistency=<level>" or "--consistency
+// <level>" option out of the words of a get command, returning the
+// remaining words and the level, "" if there is none.
+func parseConsistency(words []string) ([]string, string, error) {
+	rest, level, err := parseOption(words, "consistency", "a level: one, quorum or all")
+	if err != nil || level == "" {
+		return rest, level, err
+	}
+	if _, err := node.ParseConsistency(level); err != nil {
+		return nil, "", err
+	}
+	return rest, level, nil
+}
+
+// parseOption removes a --name=value or --name value option from words and
+// returns the remaining words and its value, or "" if it is not given. what
+// describes the value for the error when it is missing.
+func parseOption(words []string, name, what string) ([]string, string, error) {
+	var rest []string
+	value := ""
+	for i := 0; i < len(words); i++ {
+		switch {
+		case strings.HasPrefix(words[i], "--"+name+"="):
+			value = strings.TrimPrefix(words[i], "--"+name+"=")
+		case words[i] == "--"+name && i+1 < len(words):
+			i++
+			value = words[i]
+		case words[i] == "--"+name:
+			return nil, "", fmt.Errorf("--%s needs %s", name, what)
+		default:
+			rest = append(rest, words[i])
+		}
+	}
+	return rest, value, nil
+}
+
+// parseFlag removes a --name flag from words and reports whether it was
+// given.
+func parseFlag(words []string, name string) ([]string, bool) {
+	var rest []string
+	given := false
+	for _, word := range words {
+		if word == "--"+name {
+			given = true
+		} else {
+			rest = append(rest, word)
+		}
+	}
+	return rest, given
+}
+
+// parseTarget parses the node a scheduled task is sent to: a node id, or
+// "any" for the least loaded node.
+func parseTarget(word string) (int, error) {
+	if strings.EqualFold(word, "any") {
+		return node.AnyNode, nil
+	}
+	id, err := strconv.Atoi(word)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid node id %q", word)
+	}
+	return id, nil
+}
+
+// parseAt parses the time a task is scheduled for: a delay from now such as
+// "+90s", a time of day such as "14:30" or "14:30:05" (the next one to
+// come), or an RFC 3339 timestamp.
+func parseAt(word string, now time.Time) (time.Time, error) {
+	if delay, ok := strings.CutPrefix(word, "+"); ok {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("invalid delay %q", word)
+		}
+		return now.Add(d), nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if clock, err := time.ParseInLocation(layout, word, now.Location()); err == nil {
+			at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+			if !at.After(now) {
+				at = at.AddDate(0, 0, 1)
+			}
+			return at, nil
+		}
+	}
+	at, err := time.Parse(time.RFC3339, word)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected +<duration>, HH:MM[:SS] or RFC 3339", word)
+	}
+	return at, nil
+}
+
+// parseTTL splits a trailing "EX <seconds>" off the words of a set command,
+// returning the remaining words and the time to live, zero if there is none.
+func parseTTL(words []string) ([]string, time.Duration, error) {
+	if len(words) < 2 || !strings.EqualFold(words[len(words)-2], "EX") {
+		return words, 0, nil
+	}
+	seconds, err := strconv.Atoi(words[len(words)-1])
+	if err != nil || seconds <= 0 {
+		return nil, 0, fmt.Errorf("invalid expiry %q: expected a positive number of seconds", words[len(words)-1])
+	}
+	return words[:len(words)-2], time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// defaultBatchTimeout is how long send-batch waits for a batch's summary.
+const defaultBatchTimeout = time.Minute
+
+// sendBatch runs the tasks in a file on a node as a single batch and prints
+// the summary of their results.
+func (s *Shell) sendBatch(args []string) {
+	words, timeoutText, err := parseOption(args, "timeout", "a duration, e.g. 5m")
+	timeout := defaultBatchTimeout
+	if err == nil && timeoutText != "" {
+		if timeout, err = time.ParseDuration(timeoutText); err == nil && timeout <= 0 {
+			err = fmt.Errorf("invalid timeout %q", timeoutText)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	if len(words) != 2 {
+		fmt.Fprintln(s.out, "Usage: send-batch <node_id> <file> [--timeout=d]")
+		return
+	}
+	targetID, err := strconv.Atoi(words[0])
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: invalid node id %q\n", words[0])
+		return
+	}
+	tasks, err := readBatch(words[1])
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	summary, err := s.node.SendBatch(targetID, tasks, timeout)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Batch of %d tasks ran on Node %d in %v: %d succeeded, %d failed\n",
+		summary.Tasks, targetID, summary.Duration.Round(time.Microsecond), summary.Succeeded, summary.Failed)
+	for _, result := range summary.Results {
+		if result.Error != "" {
+			fmt.Fprintf(s.out, "  #%d %s (%s): failed: %s\n", result.Index+1, result.TaskID, tasks[result.Index].Type, result.Error)
+		}
+	}
+}
+
+// readBatch reads the tasks of a batch from a file, one per line: either a
+// JSON object with a type and optionally content, key and priority, or a
+// task type followed by its content. Blank lines and lines starting with #
+// are skipped.
+func readBatch(path string) ([]node.BatchTask, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tasks []node.BatchTask
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var task node.BatchTask
+		if strings.HasPrefix(text, "{") {
+			if err := json.Unmarshal([]byte(text), &task); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		} else {
+			task.Type, task.Content, _ = strings.Cut(text, " ")
+			task.Content = strings.TrimSpace(task.Content)
+		}
+		if task.Type == "" {
+			return nil, fmt.Errorf("%s:%d: task has no type", path, line)
+		}
+		tasks = append(tasks, task)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("%s has no tasks", path)
+	}
+	return tasks, nil
+}
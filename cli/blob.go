@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+// putBlob stores a file in the cluster as a blob.
+func (s *Shell) putBlob(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(s.out, "Usage: put-blob <file>")
+		return
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	hash, manifest, err := s.node.PutBlob(f)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Stored %s (%d bytes in %d chunks) as blob %s\n", args[0], manifest.Size, len(manifest.Chunks), hash)
+}
+
+// getBlob writes a blob to a file, named after its hash unless given.
+func (s *Shell) getBlob(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(s.out, "Usage: get-blob <hash> [file]")
+		return
+	}
+	hash, path := args[0], args[0]
+	if len(args) == 2 {
+		path = args[1]
+	}
+	if _, err := s.node.BlobInfo(hash); err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	manifest, err := s.node.GetBlob(hash, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Wrote blob %s (%d bytes in %d chunks) to %s\n", hash, manifest.Size, len(manifest.Chunks), path)
+}
@@ -0,0 +1,196 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// An import or export in progress keeps how far it got in a sidecar file
+// next to the file it reads or writes, so it can be resumed with --resume
+// after being interrupted. The sidecar is removed once it completes.
+
+// bulkProgress is how far an import or export of a file got.
+type bulkProgress struct {
+	// Line is how many lines (or CSV rows) of an imported file are
+	// written.
+	Line int `json:"line,omitempty"`
+	// After is the last key exported, and Offset the size of the exported
+	// file up to and including it.
+	After  string `json:"after,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	// Count is how many keys were imported or exported.
+	Count int `json:"count"`
+}
+
+func progressPath(path string) string {
+	return path + ".progress"
+}
+
+// loadProgress reads the progress of an interrupted import or export of
+// path.
+func loadProgress(path string) (bulkProgress, error) {
+	var p bulkProgress
+	data, err := os.ReadFile(progressPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return p, fmt.Errorf("no interrupted import or export of %s to resume", path)
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("invalid progress file %s: %v", progressPath(path), err)
+	}
+	return p, nil
+}
+
+func saveProgress(path string, p bulkProgress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := progressPath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, progressPath(path))
+}
+
+// bulkArgs parses the words of an import or export command: a file, an
+// optional --format and --resume.
+func bulkArgs(words []string) (path, format string, resume bool, err error) {
+	words, format, err = parseOption(words, "format", "a format: jsonl or csv")
+	if err != nil {
+		return "", "", false, err
+	}
+	words, resume = parseFlag(words, "resume")
+	if len(words) != 1 {
+		return "", "", false, errors.New("expected one file")
+	}
+	path = words[0]
+	switch format {
+	case "":
+		format, err = node.FormatOf(path)
+	case node.FormatJSONL, node.FormatCSV:
+	default:
+		err = fmt.Errorf("unknown format %q: use jsonl or csv", format)
+	}
+	return path, format, resume, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportFile exports the cluster's keys to a file.
+func (s *Shell) exportFile(args []string) {
+	path, format, resume, err := bulkArgs(args)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		fmt.Fprintln(s.out, "Usage: export <file.jsonl|file.csv> [--format=jsonl|csv] [--resume]")
+		return
+	}
+
+	var start bulkProgress
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		if start, err = loadProgress(path); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		flags = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err == nil && resume {
+		// Drop whatever was written after the last checkpoint
+		if err = f.Truncate(start.Offset); err == nil {
+			_, err = f.Seek(start.Offset, io.SeekStart)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	out := &countingWriter{w: f, n: start.Offset}
+	progress := start
+	var saveErr error
+	err = s.node.Export(out, format, start.After, func(last string, count int) {
+		progress = bulkProgress{After: last, Offset: out.n, Count: start.Count + count}
+		if saveErr == nil {
+			saveErr = saveProgress(path, progress)
+		}
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		if progress.Count > 0 && saveErr == nil {
+			fmt.Fprintf(s.out, "Exported %d keys; run export %s --resume to continue\n", progress.Count, path)
+		}
+		return
+	}
+	os.Remove(progressPath(path))
+	fmt.Fprintf(s.out, "Exported %d keys to %s\n", progress.Count, path)
+}
+
+// importFile imports the keys in a file into the cluster.
+func (s *Shell) importFile(args []string) {
+	path, format, resume, err := bulkArgs(args)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		fmt.Fprintln(s.out, "Usage: import <file.jsonl|file.csv> [--format=jsonl|csv] [--resume]")
+		return
+	}
+
+	var start bulkProgress
+	if resume {
+		if start, err = loadProgress(path); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	// The progress is saved at most once a second, and whenever the import
+	// stops
+	progress := start
+	var saved time.Time
+	imported, err := s.node.Import(f, format, start.Line, func(line int) {
+		progress.Line = line
+		if time.Since(saved) >= time.Second {
+			saved = time.Now()
+			saveProgress(path, progress)
+		}
+	})
+	progress.Count = start.Count + imported
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		if saveProgress(path, progress) == nil {
+			fmt.Fprintf(s.out, "Imported %d keys; run import %s --resume to continue\n", progress.Count, path)
+		}
+		return
+	}
+	os.Remove(progressPath(path))
+	fmt.Fprintf(s.out, "Imported %d keys from %s\n", progress.Count, path)
+}
@@ -0,0 +1,1787 @@
+// Package cli is the interactive command line front end of a node.
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// Main parses the command line, starts a node and runs its CLI on stdin
+// until the node is shut down, either with the exit command, end of input
+// or SIGINT/SIGTERM. "dbs devcluster ..." runs a local cluster instead; see
+// DevCluster.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "devcluster" {
+		if err := DevCluster(os.Args[2:]); err != nil {
+			if err != flag.ErrHelp {
+				fmt.Println(err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	n, err := node.NewNode(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Transports and other package-level code log through the default logger
+	slog.SetDefault(n.Logger())
+
+	if cfg.HTTP != "" {
+		n.StartAdmin(cfg.HTTP)
+	}
+
+	history := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		history = filepath.Join(home, ".dbs_history")
+	}
+	shell, err := New(n, os.Stdin, os.Stdout, history)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := n.Start(); err != nil {
+		n.Logger().Error("failed to start node", "err", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Node %d started on %s (Master: %v, Role: %s)\n", n.ID, n.BindAddress(), n.IsMaster, cfg.Role)
+	if cfg.Advertise != "" {
+		fmt.Printf("Peers reach it at %s\n", n.Address)
+	}
+
+	go handleSignals(n)
+	go func() {
+		shell.Run()
+		n.Shutdown()
+	}()
+
+	n.Wait()
+}
+
+// handleSignals shuts the node down gracefully on SIGINT or SIGTERM.
+func handleSignals(n *node.Node) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		n.Logger().Info("received signal, shutting down", "signal", sig.String())
+		n.Shutdown()
+	case <-n.Done():
+	}
+}
+
+// Shell reads commands for a node from in and writes their output, and the
+// results the node receives, to out. On a terminal it supports line editing,
+// history and tab completion of commands, peer ids and task types.
+type Shell struct {
+	node *node.Node
+	rl   *readline.Instance
+	out  io.Writer
+	// watches holds the cancel function of each watched pattern; it is only
+	// used by Run
+	watches map[string]func()
+	// tx holds the writes queued since multi, nil outside a transaction;
+	// it is only used by Run
+	tx []node.TxOp
+	// stopEvents cancels the subscription to membership events, nil while
+	// they are not printed; it is only used by Run
+	stopEvents func()
+	// stopConfigWatch cancels the watch on the cluster config, nil while
+	// its changes are not printed; it is only used by Run
+	stopConfigWatch func()
+	// leases holds the locks taken with lock, by name; it is only used by
+	// Run
+	leases map[string]node.Lease
+	// namespace is the namespace picked with use, "" for the default one;
+	// it is only used by Run
+	namespace string
+}
+
+// New creates a shell for n, keeping command history in historyFile unless
+// it is empty. It subscribes to the node's messages, so it should be created
+// before the node is started.
+func New(n *node.Node, in io.Reader, out io.Writer, historyFile string) (*Shell, error) {
+	s := &Shell{node: n, watches: make(map[string]func()), leases: make(map[string]node.Lease)}
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          fmt.Sprintf("Node %d > ", n.ID),
+		HistoryFile:     historyFile,
+		AutoComplete:    s.completer(),
+		Stdin:           io.NopCloser(in),
+		Stdout:          out,
+		InterruptPrompt: "^C",
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.rl = rl
+	// Writing through readline redraws the prompt after async output
+	s.out = rl.Stdout()
+
+	n.OnMessage(s.printMessage)
+	return s, nil
+}
+
+// Run reads and executes commands until exit, end of input, or Ctrl-C on
+// an empty line.
+func (s *Shell) Run() {
+	defer s.rl.Close()
+
+	n := s.node
+	for {
+		line, err := s.rl.Readline()
+		if err == readline.ErrInterrupt {
+			if line == "" {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// End of input behaves like exit
+			return
+		}
+
+		parts, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			continue
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if s.tx != nil && (parts[0] == "set" || parts[0] == "del") {
+			s.queueTx(parts)
+			continue
+		}
+		// Inside a transaction, exec without arguments commits it rather
+		// than running a task
+		if s.tx != nil && parts[0] == "exec" && len(parts) == 1 {
+			ops := s.tx
+			s.tx = nil
+			if err := n.Transaction(ops); err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+			} else {
+				fmt.Fprintf(s.out, "Committed %d writes\n", len(ops))
+			}
+			continue
+		}
+
+		switch parts[0] {
+		case "connect":
+			if len(parts) != 3 {
+				fmt.Fprintln(s.out, "Usage: connect <node_id> <address>")
+				continue
+			}
+			id, _ := strconv.Atoi(parts[1])
+			err := n.Connect(id, parts[2])
+			if err != nil {
+				fmt.Fprintf(s.out, "Failed to connect: %v\n", err)
+			} else {
+				fmt.Fprintf(s.out, "Connected to Node %d\n", id)
+			}
+
+		case "join":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: join <seed_address>")
+				continue
+			}
+			members, err := n.Join(parts[1])
+			if members == nil {
+				fmt.Fprintf(s.out, "Failed to join: %v\n", err)
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(s.out, "Some members could not be reached:\n%v\n", err)
+			}
+			fmt.Fprintf(s.out, "Joined cluster of %d nodes: %v\n", len(members), members)
+
+		case "send":
+			if len(parts) < 3 {
+				fmt.Fprintln(s.out, "Usage: send <node_id> <message>")
+				continue
+			}
+			targetID, _ := strconv.Atoi(parts[1])
+			content := strings.Join(parts[2:], " ")
+			id, err := n.SendTask(targetID, node.DefaultTaskType, content)
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Task %s sent to Node %d\n", id, targetID)
+
+		case "exec":
+			words, key, err := parseOption(parts[1:], "key", "an idempotency key")
+			var priority, timeoutText string
+			if err == nil {
+				words, priority, err = parseOption(words, "priority", "a priority: high, normal or low")
+			}
+			if err == nil {
+				words, timeoutText, err = parseOption(words, "timeout", "a duration, e.g. 30s")
+			}
+			var timeout time.Duration
+			if err == nil && timeoutText != "" {
+				if timeout, err = time.ParseDuration(timeoutText); err == nil && timeout <= 0 {
+					err = fmt.Errorf("invalid timeout %q", timeoutText)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			if len(words) < 2 {
+				fmt.Fprintf(s.out, "Usage: exec <node_id> <task_type> [content] [--key=k] [--priority=p] [--timeout=d] (types: %s)\n", strings.Join(n.TaskTypes(), ", "))
+				continue
+			}
+			targetID, _ := strconv.Atoi(words[0])
+			content := strings.Join(words[2:], " ")
+			id, err := n.SendTaskWithOptions(targetID, words[1], content, node.TaskOptions{Key: key, Priority: priority, Timeout: timeout})
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Task %s (%s) sent to Node %d\n", id, words[1], targetID)
+
+		case "send-batch":
+			s.sendBatch(parts[1:])
+
+		case "exec-all":
+			s.execAll(parts[1:])
+
+		case "preempt":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: preempt <task_id>")
+				continue
+			}
+			runner, err := n.Preempt(parts[1])
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Task %s on Node %d marked preemptible\n", parts[1], runner)
+
+		case "submit":
+			if len(parts) < 2 {
+				fmt.Fprintln(s.out, "Usage: submit <message>")
+				continue
+			}
+			id, target, err := n.Submit(node.DefaultTaskType, strings.Join(parts[1:], " "))
+			if err != nil {
+				fmt.Fprintf(s.out, "Submit failed: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Task %s scheduled on Node %d\n", id, target)
+
+		case "broadcast":
+			if len(parts) < 2 {
+				fmt.Fprintln(s.out, "Usage: broadcast <message>")
+				continue
+			}
+			s.printSent(n.Broadcast(node.DefaultTaskType, strings.Join(parts[1:], " ")))
+
+		case "multicast":
+			if len(parts) < 3 {
+				fmt.Fprintln(s.out, "Usage: multicast <group> <message>")
+				continue
+			}
+			sent, err := n.Multicast(parts[1], node.DefaultTaskType, strings.Join(parts[2:], " "))
+			if sent == nil {
+				fmt.Fprintf(s.out, "Multicast failed: %v\n", err)
+				continue
+			}
+			s.printSent(sent, err)
+
+		case "group":
+			s.group(parts[1:])
+
+		case "dlq":
+			s.deadLetters(parts[1:])
+
+		case "tasks":
+			s.printTasks()
+
+		case "progress":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: progress <task_id>")
+				continue
+			}
+			s.printProgress(parts[1])
+
+		case "send-at":
+			if len(parts) < 4 {
+				fmt.Fprintln(s.out, "Usage: send-at <node_id|any> <+delay|HH:MM|RFC3339> <message>")
+				continue
+			}
+			target, err := parseTarget(parts[1])
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			at, err := parseAt(parts[2], time.Now())
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			sched, err := n.AddSchedule(node.Schedule{Target: target, Content: strings.Join(parts[3:], " "), Next: at})
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Schedule %s: task at %s\n", sched.ID, sched.Next.Format(time.RFC3339))
+
+		case "schedule":
+			s.schedule(parts[1:])
+
+		case "set":
+			words, ttl, err := parseTTL(parts)
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			if len(words) < 3 {
+				fmt.Fprintln(s.out, "Usage: set <key> <value> [EX <seconds>]")
+				continue
+			}
+			reply, served := n.KV(node.Message{Type: "set", Key: s.key(words[1]), Value: strings.Join(words[2:], " "), TTL: ttl})
+			if served != n.ID {
+				fmt.Fprintf(s.out, "Forwarded to Node %d\n", served)
+			} else if reply.Error != "" {
+				fmt.Fprintf(s.out, "Error: %s\n", reply.Error)
+			} else {
+				fmt.Fprintln(s.out, "OK")
+			}
+
+		case "get":
+			words, level, err := parseConsistency(parts)
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			if len(words) != 2 {
+				fmt.Fprintln(s.out, "Usage: get <key> [--consistency=one|quorum|all]")
+				continue
+			}
+			reply, served := n.KV(node.Message{Type: "get", Key: s.key(words[1]), Consistency: level})
+			if served != n.ID {
+				fmt.Fprintf(s.out, "Forwarded to Node %d\n", served)
+			} else if reply.Error != "" {
+				fmt.Fprintf(s.out, "Error: %s\n", reply.Error)
+			} else if len(reply.Siblings) > 0 {
+				fmt.Fprintln(s.out, reply.Content)
+			} else if reply.Found {
+				fmt.Fprintln(s.out, reply.Value)
+			} else {
+				fmt.Fprintln(s.out, "(nil)")
+			}
+
+		case "resolve":
+			if len(parts) < 3 {
+				fmt.Fprintln(s.out, "Usage: resolve <key> <value>")
+				continue
+			}
+			versions, err := n.GetVersions(s.key(parts[1]))
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			if err := n.Resolve(s.key(parts[1]), strings.Join(parts[2:], " "), versions.Context); err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Resolved %d versions of %s\n", max(len(versions.Values), 1), parts[1])
+
+		case "incr", "decr", "sadd", "srem", "rset", "crdt":
+			s.crdt(parts)
+
+		case "del":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: del <key>")
+				continue
+			}
+			reply, served := n.KV(node.Message{Type: "del", Key: s.key(parts[1])})
+			if served != n.ID {
+				fmt.Fprintf(s.out, "Forwarded to Node %d\n", served)
+			} else if reply.Error != "" {
+				fmt.Fprintf(s.out, "Error: %s\n", reply.Error)
+			} else if reply.Found {
+				fmt.Fprintln(s.out, "1")
+			} else {
+				fmt.Fprintln(s.out, "0")
+			}
+
+		case "list":
+			status := n.Status()
+			fmt.Fprintln(s.out, "Connected peers:")
+			for _, id := range sortedIDs(status.Peers) {
+				about := status.Roles[id]
+				if v, ok := status.Versions[id]; ok {
+					about += fmt.Sprintf(", protocol v%d", v)
+				}
+				if rtt, ok := status.RTT[id]; ok {
+					about += fmt.Sprintf(", rtt %.1fms", rtt)
+				}
+				if circuit, ok := status.Circuits[id]; ok {
+					about += ", circuit " + strings.ReplaceAll(circuit, "_", " ")
+				}
+				fmt.Fprintf(s.out, "Node %d: %s (%s)\n", id, status.Peers[id], about)
+			}
+
+		case "health":
+			s.printHealth()
+
+		case "cluster":
+			switch {
+			case len(parts) == 2 && parts[1] == "status":
+				s.printClusterStatus()
+			case len(parts) >= 2 && parts[1] == "snapshot":
+				s.snapshotCluster(parts[2:])
+			default:
+				fmt.Fprintln(s.out, "Usage: cluster status | cluster snapshot <dir> [--timeout=d]")
+			}
+
+		case "snapshot":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: snapshot <file>")
+				continue
+			}
+			snap, err := n.WriteSnapshot(parts[1])
+			if err != nil {
+				fmt.Fprintf(s.out, "Snapshot failed: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Saved %d keys, %d peers and %d tasks to %s\n", len(snap.Data), len(snap.Peers), len(snap.Tasks), parts[1])
+
+		case "restore":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: restore <file>")
+				continue
+			}
+			snap, err := n.RestoreSnapshot(parts[1])
+			if err != nil {
+				fmt.Fprintf(s.out, "Restore failed: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Restored %d keys, %d peers and %d tasks from %s (taken by Node %d at %s)\n",
+				len(snap.Data), len(snap.Peers), len(snap.Tasks), parts[1], snap.NodeID, snap.TakenAt.Format(time.RFC3339))
+
+		case "import":
+			s.importFile(parts[1:])
+
+		case "export":
+			s.exportFile(parts[1:])
+
+		case "put-blob":
+			s.putBlob(parts[1:])
+
+		case "get-blob":
+			s.getBlob(parts[1:])
+
+		case "drain":
+			s.drain()
+
+		case "rebalance":
+			if len(parts) != 2 || parts[1] != "status" {
+				fmt.Fprintln(s.out, "Usage: rebalance status")
+				continue
+			}
+			s.rebalanceStatus()
+
+		case "compact":
+			before, after, err := n.Compact()
+			if err != nil {
+				fmt.Fprintf(s.out, "Error: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(s.out, "Compacted data log from %d to %d bytes\n", before, after)
+
+		case "query":
+			// Quotes are part of the query language, so it is taken from
+			// the raw line
+			s.query(strings.TrimSpace(strings.TrimSpace(line)[len("query"):]))
+
+		case "scan":
+			s.scan(parts[1:])
+
+		case "use":
+			s.use(parts[1:])
+
+		case "namespaces":
+			s.namespaces(parts[1:])
+
+		case "index":
+			s.index(parts[1:])
+
+		case "hotkeys":
+			s.hotKeys(parts[1:])
+
+		case "ring":
+			key := ""
+			if len(parts) > 1 {
+				key = parts[1]
+			}
+			s.printRing(key)
+
+		case "chaos":
+			s.chaos(parts[1:])
+
+		case "auth":
+			s.auth(parts[1:])
+
+		case "acl":
+			s.acl(parts[1:])
+
+		case "schema":
+			s.schema(parts[1:])
+
+		case "evict", "unban":
+			s.evict(parts)
+
+		case "bans":
+			s.listBans()
+
+		case "config":
+			if len(parts) > 1 && parts[1] == "cluster" {
+				s.clusterConfig(parts[2:])
+			} else {
+				s.setOption(parts[1:])
+			}
+
+		case "watch":
+			s.watch(parts[1:])
+
+		case "unwatch":
+			if len(parts) != 2 {
+				fmt.Fprintln(s.out, "Usage: unwatch <key|prefix*>")
+				continue
+			}
+			cancel, ok := s.watches[parts[1]]
+			if !ok {
+				fmt.Fprintf(s.out, "Not watching %s\n", parts[1])
+				continue
+			}
+			cancel()
+			delete(s.watches, parts[1])
+			fmt.Fprintf(s.out, "Stopped watching %s\n", parts[1])
+
+		case "id":
+			s.nextID(parts[1:])
+
+		case "events":
+			s.events(parts[1:])
+
+		case "multi":
+			if s.tx != nil {
+				fmt.Fprintln(s.out, "Error: already in a transaction")
+				continue
+			}
+			s.tx = []node.TxOp{}
+			fmt.Fprintln(s.out, "OK, queueing set and del until exec or discard")
+
+		case "discard":
+			if s.tx == nil {
+				fmt.Fprintln(s.out, "Error: discard without multi")
+				continue
+			}
+			s.tx = nil
+			fmt.Fprintln(s.out, "OK")
+
+		case "lock":
+			s.lock(parts[1:])
+
+		case "unlock":
+			s.unlock(parts[1:])
+
+		case "locks":
+			s.listLocks()
+
+		case "leader":
+			status := n.Status()
+			if status.LeaderID < 0 {
+				fmt.Fprintf(s.out, "No known leader (term %d, state %s)\n", status.Term, status.State)
+			} else if status.LeaderID == n.ID && !status.Lease {
+				fmt.Fprintf(s.out, "Leader: Node %d (term %d, state %s, no quorum)\n", status.LeaderID, status.Term, status.State)
+			} else {
+				fmt.Fprintf(s.out, "Leader: Node %d (term %d, state %s)\n", status.LeaderID, status.Term, status.State)
+			}
+			if log := status.Log; log != nil {
+				fmt.Fprintf(s.out, "Log: last %d (term %d), committed %d, applied %d\n", log.Last, log.Term, log.Commit, log.Applied)
+			}
+
+		case "exit":
+			return
+
+		case "help":
+			fmt.Fprintln(s.out, "Available commands:")
+			fmt.Fprintln(s.out, "  connect <node_id> <address> - Connect to another node")
+			fmt.Fprintln(s.out, "  join <seed_address>         - Join the cluster of the node at an address")
+			fmt.Fprintln(s.out, "  send <node_id> <message>    - Send a message to a node")
+			fmt.Fprintln(s.out, "  set <key> <value> [EX <s>]  - Store a value on the node owning the key, expiring after s seconds")
+			fmt.Fprintln(s.out, "  get <key> [--consistency=l] - Read a value from the node owning the key, at level one (default), quorum or all")
+			fmt.Fprintln(s.out, "  del <key>                   - Delete a key on the node owning it")
+			fmt.Fprintln(s.out, "  resolve <key> <value>       - Replace the conflicting versions of a key by one value")
+			fmt.Fprintln(s.out, "  incr|decr <key> [n]         - Add n (default 1) to or subtract it from a replicated counter")
+			fmt.Fprintln(s.out, "  sadd|srem <key> <member>... - Add members to or remove them from a replicated set")
+			fmt.Fprintln(s.out, "  rset <key> <value>          - Write a last-writer-wins register")
+			fmt.Fprintln(s.out, "  crdt <key>                  - Read a replicated counter, set or register")
+			fmt.Fprintln(s.out, "  query <select ...>          - Query keys cluster-wide, e.g. query select * limit 10")
+			fmt.Fprintln(s.out, "  scan <start> <end> [limit]  - List the keys from start up to end in order, 100 unless limit says otherwise (0 for all)")
+			fmt.Fprintln(s.out, "  use [namespace]             - Show or switch the namespace of get, set, del, scan and the like")
+			fmt.Fprintln(s.out, "  namespaces                  - List the namespaces with keys here, and their replication")
+			fmt.Fprintln(s.out, "  namespaces replication ...  - Set a namespace's replication cluster-wide: <ns> <n|default>")
+			fmt.Fprintln(s.out, "  index [list]                - Show the secondary indexes")
+			fmt.Fprintln(s.out, "  index create <c> by <field> - Index a JSON field of the values of keys <c>:*")
+			fmt.Fprintln(s.out, "  index drop <c>.<field>      - Drop an index and its entries")
+			fmt.Fprintln(s.out, "  index lookup <c>.<f> <val>  - Show the keys whose indexed field has a value")
+			fmt.Fprintln(s.out, "  ring [key]                  - Show ring ownership, or the owner of a key")
+			fmt.Fprintln(s.out, "  hotkeys [n]                 - Show the n (default 10) most accessed keys and their estimated rate")
+			fmt.Fprintln(s.out, "  exec <node_id> <type> [msg] - Send a task of a given type to a node")
+			fmt.Fprintln(s.out, "  exec ... --key=<key>        - Run a task only once per idempotency key")
+			fmt.Fprintln(s.out, "  exec ... --priority=<p>     - Queue a task at priority high, normal (default) or low")
+			fmt.Fprintln(s.out, "  exec ... --timeout=<d>      - Cancel a task still running d after it was queued")
+			fmt.Fprintln(s.out, "  send-batch <id> <file>      - Run the tasks in a file, one per line, on a node as one batch and print a summary")
+			fmt.Fprintln(s.out, "  exec-all <type> [msg]       - Run a task on every node and print each one's result, e.g. exec-all disk")
+			fmt.Fprintln(s.out, "  preempt <task_id>           - Have the leader let high priority tasks take a running low priority task's worker")
+			fmt.Fprintln(s.out, "  submit <message>            - Send a task to the least-loaded node")
+			fmt.Fprintln(s.out, "  broadcast <message>         - Send a task to every connected node")
+			fmt.Fprintln(s.out, "  multicast <group> <message> - Send a task to every node in a group")
+			fmt.Fprintln(s.out, "  group set <name> <ids>      - Define a group from comma separated node ids")
+			fmt.Fprintln(s.out, "  group del <name>            - Delete a group")
+			fmt.Fprintln(s.out, "  group list                  - List groups")
+			fmt.Fprintln(s.out, "  tasks                       - Show pending and completed tasks")
+			fmt.Fprintln(s.out, "  progress <task_id>          - Show the progress a running task reported")
+			fmt.Fprintln(s.out, "  dlq [list]                  - Show the tasks this node sent that failed")
+			fmt.Fprintln(s.out, "  dlq retry <task_id>         - Send a failed task again")
+			fmt.Fprintln(s.out, "  send-at <id> <time> <msg>   - Have the master send a task to a node (or any) at +delay, HH:MM or an RFC 3339 time")
+			fmt.Fprintln(s.out, "  schedule every <d> <id> <t> - Have the master send a task of type t [with content] every interval d")
+			fmt.Fprintln(s.out, "  schedule cron <s> <id> <t>  - Have the master send a task of type t [with content] whenever the quoted cron spec s matches")
+			fmt.Fprintln(s.out, "  schedule list               - List scheduled tasks")
+			fmt.Fprintln(s.out, "  schedule del <id>           - Cancel a scheduled task")
+			fmt.Fprintln(s.out, "  list                        - List connected peers")
+			fmt.Fprintln(s.out, "  health                      - Show failure detector status of peers")
+			fmt.Fprintln(s.out, "  cluster status              - Show health and load of every node")
+			fmt.Fprintln(s.out, "  snapshot <file>             - Save KV data, peers and tasks to a file")
+			fmt.Fprintln(s.out, "  cluster snapshot <dir>      - Save a consistent snapshot of every node and the messages in flight between them to a directory")
+			fmt.Fprintln(s.out, "  restore <file>              - Load a snapshot written by snapshot")
+			fmt.Fprintln(s.out, "  import <file> [--resume]    - Write the keys in a .jsonl or .csv file to the cluster")
+			fmt.Fprintln(s.out, "  export <file> [--resume]    - Write every key in the cluster to a .jsonl or .csv file")
+			fmt.Fprintln(s.out, "  put-blob <file>             - Store a file in the cluster in chunks and print its hash")
+			fmt.Fprintln(s.out, "  get-blob <hash> [file]      - Reassemble a stored file, into a file named after its hash by default")
+			fmt.Fprintln(s.out, "  drain                       - Stop taking tasks, move keys to other nodes and wait for running tasks before a shutdown")
+			fmt.Fprintln(s.out, "  rebalance status            - Show how far each member got copying keys to new replicas after nodes joined or left")
+			fmt.Fprintln(s.out, "  compact                     - Rewrite the data log without overwritten values")
+			fmt.Fprintln(s.out, "  chaos                       - Show injected faults")
+			fmt.Fprintln(s.out, "  chaos drop <percent>        - Lose a share of sent messages, e.g. chaos drop 10%")
+			fmt.Fprintln(s.out, "  chaos delay <duration>      - Delay every sent message, e.g. chaos delay 200ms")
+			fmt.Fprintln(s.out, "  chaos partition <ids>       - Cut this node off from comma separated node ids")
+			fmt.Fprintln(s.out, "  chaos heal | chaos off      - Lift the partition, or turn every fault off")
+			fmt.Fprintln(s.out, "  auth                        - Show the auth tokens in use, by fingerprint")
+			fmt.Fprintln(s.out, "  auth accept <token>         - Also accept messages signed with a token")
+			fmt.Fprintln(s.out, "  auth rotate <token>         - Sign with a token, still accepting the old ones")
+			fmt.Fprintln(s.out, "  auth retire                 - Stop accepting every token but the current one")
+			fmt.Fprintln(s.out, "  acl                         - Show the access control list")
+			fmt.Fprintln(s.out, "  acl set <subject> <level>   - Grant node:<id> or client:<name> (or node:*, client:*, any @<namespace>) none, read, write or admin")
+			fmt.Fprintln(s.out, "  acl del <subject>           - Remove a subject's rule")
+			fmt.Fprintln(s.out, "  schema [list]               - Show the JSON schemas task payloads must match, by task type")
+			fmt.Fprintln(s.out, "  schema set <type> <file>    - Reject tasks of a type whose content does not match the JSON schema in a file")
+			fmt.Fprintln(s.out, "  schema del <type>           - Stop checking the payloads of a task type")
+			fmt.Fprintln(s.out, "  evict <node_id>             - Remove a node from the cluster and refuse it on every node")
+			fmt.Fprintln(s.out, "  unban <node_id>             - Let an evicted node rejoin")
+			fmt.Fprintln(s.out, "  bans                        - List evicted nodes")
+			fmt.Fprintln(s.out, "  config                      - Show the options that can be changed at runtime")
+			fmt.Fprintln(s.out, "  config set <option> <value> - Change an option, e.g. heartbeat.interval 2s")
+			fmt.Fprintln(s.out, "  config cluster              - Show the cluster config, as confirmed by the leader")
+			fmt.Fprintln(s.out, "  config cluster set <n> <v>  - Set a cluster-wide setting, e.g. replication 3, on every node")
+			fmt.Fprintln(s.out, "  config cluster del <name>   - Delete a cluster-wide setting, restoring options as configured")
+			fmt.Fprintln(s.out, "  config cluster watch on|off - Print changes to the cluster config")
+			fmt.Fprintln(s.out, "  watch [key|prefix*]         - Print changes to a key or prefix, or list watches")
+			fmt.Fprintln(s.out, "  unwatch <key|prefix*>       - Stop watching a key or prefix")
+			fmt.Fprintln(s.out, "  id [node_id]                - Generate a cluster-wide unique id, here or on a node")
+			fmt.Fprintln(s.out, "  leader                      - Show the current leader and term")
+			fmt.Fprintln(s.out, "  lock <name> <ttl>           - Take or renew a cluster-wide lock for a time, e.g. lock jobs 30s")
+			fmt.Fprintln(s.out, "  unlock <name>               - Release a lock taken with lock")
+			fmt.Fprintln(s.out, "  locks                       - Show the locks held in the cluster")
+			fmt.Fprintln(s.out, "  events [on|off]             - Print membership changes as they happen")
+			fmt.Fprintln(s.out, "  multi                       - Queue the following set and del commands")
+			fmt.Fprintln(s.out, "  exec                        - After multi, apply the queued writes atomically")
+			fmt.Fprintln(s.out, "  discard                     - Drop the queued writes")
+			fmt.Fprintln(s.out, "  help                        - Show this help")
+			fmt.Fprintln(s.out, "  exit                        - Exit the program")
+
+		default:
+			fmt.Fprintln(s.out, "Unknown command. Type 'help' for available commands")
+		}
+	}
+}
+
+// nextID prints a new unique id, made by this node or the one named in
+// args, and what it is made of.
+func (s *Shell) nextID(args []string) {
+	if len(args) > 1 {
+		fmt.Fprintln(s.out, "Usage: id [node_id]")
+		return
+	}
+
+	var id int64
+	if len(args) == 0 {
+		id = s.node.NextID()
+	} else {
+		target, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: invalid node id %q\n", args[0])
+			return
+		}
+		if id, err = s.node.RemoteID(target, 5*time.Second); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+	}
+	at, from, seq := node.ParseID(id)
+	fmt.Fprintf(s.out, "%d (node %d, sequence %d, %s)\n", id, from, seq, at.Format(time.RFC3339Nano))
+}
+
+func (s *Shell) group(args []string) {
+	groups := s.node.Groups()
+
+	switch {
+	case len(args) == 3 && args[0] == "set":
+		ids, err := parseIDs(args[2])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		groups.Set(args[1], ids)
+		fmt.Fprintf(s.out, "Group %s: %v\n", args[1], ids)
+
+	case len(args) == 2 && args[0] == "del":
+		if !groups.Delete(args[1]) {
+			fmt.Fprintf(s.out, "No group %s\n", args[1])
+		}
+
+	case len(args) == 1 && args[0] == "list":
+		all := groups.All()
+		if len(all) == 0 {
+			fmt.Fprintln(s.out, "No groups")
+			return
+		}
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(s.out, "%s: %v\n", name, all[name])
+		}
+
+	default:
+		fmt.Fprintln(s.out, "Usage: group set <name> <id,id,...> | group del <name> | group list")
+	}
+}
+
+// schedule lists, adds or cancels the cluster's scheduled tasks.
+func (s *Shell) schedule(args []string) {
+	usage := "Usage: schedule list | schedule every <duration> <node_id|any> <type> [content] | " +
+		"schedule cron \"<min hour dom month dow>\" <node_id|any> <type> [content] | schedule del <id>"
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		schedules := s.node.Schedules()
+		if len(schedules) == 0 {
+			fmt.Fprintln(s.out, "No schedules")
+			return
+		}
+		fmt.Fprintf(s.out, "%-9s %-7s %-10s %-20s %-26s %s\n", "ID", "TARGET", "TYPE", "REPEAT", "NEXT", "RUNS")
+		for _, sched := range schedules {
+			target := strconv.Itoa(sched.Target)
+			if sched.Target == node.AnyNode {
+				target = "any"
+			}
+			repeat := "once"
+			if sched.Every > 0 {
+				repeat = "every " + sched.Every.String()
+			} else if sched.Cron != "" {
+				repeat = "cron " + sched.Cron
+			}
+			fmt.Fprintf(s.out, "%-9s %-7s %-10s %-20s %-26s %d\n", sched.ID, target, sched.TaskType, repeat, sched.Next.Format(time.RFC3339), sched.Runs)
+		}
+
+	case len(args) >= 4 && (args[0] == "every" || args[0] == "cron"):
+		target, err := parseTarget(args[2])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		sched := node.Schedule{Target: target, TaskType: args[3], Content: strings.Join(args[4:], " ")}
+		if args[0] == "every" {
+			if sched.Every, err = time.ParseDuration(args[1]); err != nil || sched.Every <= 0 {
+				fmt.Fprintf(s.out, "Error: invalid interval %q\n", args[1])
+				return
+			}
+		} else {
+			sched.Cron = args[1]
+		}
+		if sched, err = s.node.AddSchedule(sched); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Schedule %s: next task at %s\n", sched.ID, sched.Next.Format(time.RFC3339))
+
+	case len(args) == 2 && args[0] == "del":
+		if err := s.node.RemoveSchedule(args[1]); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Removed schedule %s\n", args[1])
+
+	default:
+		fmt.Fprintln(s.out, usage)
+	}
+}
+
+// chaos shows or changes the faults injected into the node's transport.
+func (s *Shell) chaos(args []string) {
+	chaos := s.node.Chaos()
+
+	var err error
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "drop":
+		percent, perr := strconv.ParseFloat(strings.TrimSuffix(args[1], "%"), 64)
+		if perr != nil {
+			err = fmt.Errorf("invalid percentage %q", args[1])
+		} else {
+			err = chaos.SetDrop(percent / 100)
+		}
+	case len(args) == 2 && args[0] == "delay":
+		var delay time.Duration
+		if delay, err = time.ParseDuration(args[1]); err == nil {
+			err = chaos.SetDelay(delay)
+		}
+	case len(args) == 2 && args[0] == "partition":
+		var ids []int
+		if ids, err = parseIDs(args[1]); err == nil {
+			chaos.Partition(ids...)
+		}
+	case len(args) == 1 && args[0] == "heal":
+		chaos.Partition()
+	case len(args) == 1 && args[0] == "off":
+		chaos.Reset()
+	default:
+		fmt.Fprintln(s.out, "Usage: chaos [drop <percent> | delay <duration> | partition <id,id,...> | heal | off]")
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Chaos: %v\n", chaos.Faults())
+}
+
+// auth shows or rotates the tokens messages are signed with.
+func (s *Shell) auth(args []string) {
+	auth := s.node.Auth()
+
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "accept":
+		auth.Accept(args[1])
+	case len(args) == 2 && args[0] == "rotate":
+		auth.Rotate(args[1])
+	case len(args) == 1 && args[0] == "retire":
+		auth.Retire()
+	default:
+		fmt.Fprintln(s.out, "Usage: auth [accept <token> | rotate <token> | retire]")
+		return
+	}
+
+	current, accepted := auth.Tokens()
+	sort.Strings(accepted)
+	switch {
+	case len(accepted) == 0:
+		fmt.Fprintln(s.out, "Authentication disabled")
+	case current == "":
+		fmt.Fprintf(s.out, "Not signing; accepting %s\n", strings.Join(accepted, ", "))
+	default:
+		fmt.Fprintf(s.out, "Signing with %s; accepting %s\n", current, strings.Join(accepted, ", "))
+	}
+}
+
+// acl shows the access control list or changes a rule, on every node.
+func (s *Shell) acl(args []string) {
+	var err error
+	switch {
+	case len(args) == 0:
+	case len(args) == 3 && args[0] == "set":
+		err = s.node.SetACL(args[1], args[2])
+	case len(args) == 2 && args[0] == "del":
+		err = s.node.DeleteACL(args[1])
+	default:
+		fmt.Fprintln(s.out, "Usage: acl [set <subject> <none|read|write|admin> | del <subject>]")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	rules := s.node.ACL().Rules
+	if len(rules) == 0 {
+		fmt.Fprintln(s.out, "No access rules: every peer and client is an admin")
+		return
+	}
+	subjects := make([]string, 0, len(rules))
+	for subject := range rules {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	for _, subject := range subjects {
+		fmt.Fprintf(s.out, "%-20s %s\n", subject, rules[subject])
+	}
+}
+
+// hotKeys shows the most accessed keys this node served or routed.
+func (s *Shell) hotKeys(args []string) {
+	count := 10
+	if len(args) > 1 {
+		fmt.Fprintln(s.out, "Usage: hotkeys [n]")
+		return
+	}
+	if len(args) == 1 {
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count < 1 {
+			fmt.Fprintf(s.out, "Error: invalid count %q\n", args[0])
+			return
+		}
+	}
+
+	keys := s.node.HotKeys(count)
+	if len(keys) == 0 {
+		fmt.Fprintln(s.out, "No keys accessed recently")
+		return
+	}
+	w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tRATE/S\tCACHED")
+	for _, key := range keys {
+		cached := ""
+		if key.Cached {
+			cached = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%.1f\t%s\n", key.Key, key.Rate, cached)
+	}
+	w.Flush()
+}
+
+// schema shows the payload schemas of task types, after setting or
+// removing one.
+func (s *Shell) schema(args []string) {
+	switch {
+	case len(args) == 0 || len(args) == 1 && args[0] == "list":
+	case len(args) == 3 && args[0] == "set":
+		data, err := os.ReadFile(args[2])
+		if err == nil {
+			err = s.node.RegisterSchema(args[1], data)
+		}
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+	case len(args) == 2 && args[0] == "del":
+		s.node.RemoveSchema(args[1])
+	default:
+		fmt.Fprintln(s.out, "Usage: schema [list | set <task_type> <file> | del <task_type>]")
+		return
+	}
+
+	schemas := s.node.TaskSchemas()
+	if len(schemas) == 0 {
+		fmt.Fprintln(s.out, "No task schemas: every payload is accepted")
+		return
+	}
+	types := make([]string, 0, len(schemas))
+	for taskType := range schemas {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	for _, taskType := range types {
+		var compact bytes.Buffer
+		data, _ := json.Marshal(schemas[taskType])
+		json.Compact(&compact, data)
+		fmt.Fprintf(s.out, "%-20s %s\n", taskType, compact.String())
+	}
+}
+
+// evict bans the node named in parts from the cluster, or lifts its ban.
+func (s *Shell) evict(parts []string) {
+	if len(parts) != 2 {
+		fmt.Fprintf(s.out, "Usage: %s <node_id>\n", parts[0])
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: invalid node id %q\n", parts[1])
+		return
+	}
+	if parts[0] == "unban" {
+		if err := s.node.Unban(id); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Node %d may rejoin the cluster\n", id)
+		return
+	}
+	if err := s.node.Evict(id); err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Evicted Node %d\n", id)
+}
+
+// listBans shows the nodes evicted from the cluster.
+func (s *Shell) listBans() {
+	bans := s.node.Bans()
+	if len(bans) == 0 {
+		fmt.Fprintln(s.out, "No evicted nodes")
+		return
+	}
+	for _, ban := range bans {
+		fmt.Fprintf(s.out, "Node %-4d evicted %s\n", ban.Node, ban.Changed.Format(time.RFC3339))
+	}
+}
+
+// setOption shows the runtime options or changes one.
+func (s *Shell) setOption(args []string) {
+	switch {
+	case len(args) == 0:
+	case len(args) == 3 && args[0] == "set":
+		if err := s.node.SetOption(args[1], args[2]); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+	default:
+		fmt.Fprintln(s.out, "Usage: config [set <option> <value> | cluster ...]")
+		return
+	}
+
+	options := s.node.Options()
+	for _, name := range node.OptionNames() {
+		fmt.Fprintf(s.out, "%s = %s\n", name, options[name])
+	}
+}
+
+// crdt runs an update of a replicated data type, or reads one, and shows
+// its value.
+func (s *Shell) crdt(parts []string) {
+	var err error
+	switch {
+	case (parts[0] == "incr" || parts[0] == "decr") && (len(parts) == 2 || len(parts) == 3):
+		delta := int64(1)
+		if len(parts) == 3 {
+			if delta, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+				fmt.Fprintf(s.out, "Error: invalid amount %q\n", parts[2])
+				return
+			}
+		}
+		if parts[0] == "decr" {
+			delta = -delta
+		}
+		_, err = s.node.Incr(s.key(parts[1]), delta)
+	case parts[0] == "sadd" && len(parts) >= 3:
+		err = s.node.SAdd(s.key(parts[1]), parts[2:]...)
+	case parts[0] == "srem" && len(parts) >= 3:
+		err = s.node.SRem(s.key(parts[1]), parts[2:]...)
+	case parts[0] == "rset" && len(parts) >= 3:
+		err = s.node.SetRegister(s.key(parts[1]), strings.Join(parts[2:], " "))
+	case parts[0] == "crdt" && len(parts) == 2:
+	default:
+		fmt.Fprintf(s.out, "Usage: %s\n", map[string]string{
+			"incr": "incr <key> [n]",
+			"decr": "decr <key> [n]",
+			"sadd": "sadd <key> <member>...",
+			"srem": "srem <key> <member>...",
+			"rset": "rset <key> <value>",
+			"crdt": "crdt <key>",
+		}[parts[0]])
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	v, found, err := s.node.ReadCRDT(s.key(parts[1]))
+	switch {
+	case err != nil:
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+	case !found:
+		fmt.Fprintf(s.out, "%s not found\n", parts[1])
+	default:
+		v.Key = parts[1]
+		fmt.Fprintln(s.out, v)
+	}
+}
+
+// lock takes or renews a lock for this node and remembers its lease for
+// unlock.
+func (s *Shell) lock(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(s.out, "Usage: lock <name> <ttl>")
+		return
+	}
+	ttl, err := time.ParseDuration(args[1])
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: invalid ttl %q\n", args[1])
+		return
+	}
+	lease, err := s.node.AcquireLock(args[0], ttl)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	s.leases[lease.Name] = lease
+	fmt.Fprintf(s.out, "Locked %s with fencing token %d until %s\n", lease.Name, lease.Token, lease.Expires.Format(time.RFC3339))
+}
+
+// unlock releases a lock taken with lock.
+func (s *Shell) unlock(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(s.out, "Usage: unlock <name>")
+		return
+	}
+	lease, ok := s.leases[args[0]]
+	if !ok {
+		fmt.Fprintf(s.out, "Error: lock %s was not taken from this shell\n", args[0])
+		return
+	}
+	delete(s.leases, lease.Name)
+	if err := s.node.ReleaseLock(lease); err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Unlocked %s\n", lease.Name)
+}
+
+// listLocks shows the locks held in the cluster, as this node knows them.
+func (s *Shell) listLocks() {
+	leases := s.node.Locks()
+	if len(leases) == 0 {
+		fmt.Fprintln(s.out, "No locks held")
+		return
+	}
+	for _, lease := range leases {
+		fmt.Fprintf(s.out, "%-20s %-16s token %-12d until %s\n", lease.Name, lease.Owner, lease.Token, lease.Expires.Format(time.RFC3339))
+	}
+}
+
+// clusterConfig shows the cluster config, changes a setting, or starts or
+// stops printing its changes.
+func (s *Shell) clusterConfig(args []string) {
+	var (
+		settings node.ClusterSettings
+		err      error
+	)
+	switch {
+	case len(args) == 0:
+		settings, err = s.node.ReadClusterConfig()
+	case len(args) >= 3 && args[0] == "set":
+		settings, err = s.node.SetClusterConfig(args[1], strings.Join(args[2:], " "))
+	case len(args) == 2 && args[0] == "del":
+		settings, err = s.node.DeleteClusterConfig(args[1])
+	case len(args) == 2 && args[0] == "watch" && args[1] == "on":
+		if s.stopConfigWatch == nil {
+			s.stopConfigWatch = s.node.WatchClusterConfig(s.printConfigChange)
+		}
+		fmt.Fprintln(s.out, "Printing cluster config changes")
+		return
+	case len(args) == 2 && args[0] == "watch" && args[1] == "off":
+		if s.stopConfigWatch != nil {
+			s.stopConfigWatch()
+			s.stopConfigWatch = nil
+		}
+		fmt.Fprintln(s.out, "Stopped printing cluster config changes")
+		return
+	default:
+		fmt.Fprintln(s.out, "Usage: config cluster [set <name> <value> | del <name> | watch on|off]")
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(s.out, "Cluster config at revision %d:\n", settings.Revision)
+	names := make([]string, 0, len(settings.Values))
+	for name := range settings.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(s.out, "%s = %s\n", name, settings.Values[name])
+	}
+}
+
+func (s *Shell) printConfigChange(change node.ClusterConfigChange) {
+	if change.Deleted {
+		fmt.Fprintf(s.out, "Config: %s deleted (revision %d)\n", change.Name, change.Revision)
+		return
+	}
+	fmt.Fprintf(s.out, "Config: %s = %s (revision %d)\n", change.Name, change.Value, change.Revision)
+}
+
+// watch starts printing the changes to keys matching a pattern made anywhere
+// in the cluster, or lists the watched patterns.
+func (s *Shell) watch(args []string) {
+	switch len(args) {
+	case 0:
+		if len(s.watches) == 0 {
+			fmt.Fprintln(s.out, "Not watching any keys")
+			return
+		}
+		patterns := make([]string, 0, len(s.watches))
+		for pattern := range s.watches {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		fmt.Fprintf(s.out, "Watching %s\n", strings.Join(patterns, ", "))
+	case 1:
+		pattern := args[0]
+		if _, ok := s.watches[pattern]; ok {
+			fmt.Fprintf(s.out, "Already watching %s\n", pattern)
+			return
+		}
+		s.watches[pattern] = s.node.Watch(pattern, s.printChange)
+		fmt.Fprintf(s.out, "Watching %s\n", pattern)
+	default:
+		fmt.Fprintln(s.out, "Usage: watch [key|prefix*]")
+	}
+}
+
+// queueTx adds a set or del to the transaction started by multi.
+func (s *Shell) queueTx(parts []string) {
+	switch parts[0] {
+	case "set":
+		words, ttl, err := parseTTL(parts)
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		if len(words) < 3 {
+			fmt.Fprintln(s.out, "Usage: set <key> <value> [EX <seconds>]")
+			return
+		}
+		s.tx = append(s.tx, node.TxOp{Op: "set", Key: s.key(words[1]), Value: strings.Join(words[2:], " "), TTL: ttl})
+	case "del":
+		if len(parts) != 2 {
+			fmt.Fprintln(s.out, "Usage: del <key>")
+			return
+		}
+		s.tx = append(s.tx, node.TxOp{Op: "del", Key: s.key(parts[1])})
+	}
+	fmt.Fprintln(s.out, "QUEUED")
+}
+
+// events turns printing of membership events on or off, or shows whether
+// they are printed.
+func (s *Shell) events(args []string) {
+	switch {
+	case len(args) == 0:
+		if s.stopEvents == nil {
+			fmt.Fprintln(s.out, "Not printing membership events")
+		} else {
+			fmt.Fprintln(s.out, "Printing membership events")
+		}
+	case len(args) == 1 && args[0] == "on":
+		if s.stopEvents == nil {
+			s.stopEvents = s.node.Subscribe(s.printEvent)
+		}
+		fmt.Fprintln(s.out, "Printing membership events")
+	case len(args) == 1 && args[0] == "off":
+		if s.stopEvents != nil {
+			s.stopEvents()
+			s.stopEvents = nil
+		}
+		fmt.Fprintln(s.out, "Stopped printing membership events")
+	default:
+		fmt.Fprintln(s.out, "Usage: events [on|off]")
+	}
+}
+
+func (s *Shell) printEvent(event node.Event) {
+	switch event.Type {
+	case node.EventJoin:
+		fmt.Fprintf(s.out, "Event: Node %d joined\n", event.Node)
+	case node.EventLeave:
+		fmt.Fprintf(s.out, "Event: Node %d left\n", event.Node)
+	case node.EventSuspect:
+		fmt.Fprintf(s.out, "Event: Node %d is %s\n", event.Node, event.Health)
+	case node.EventRecover:
+		fmt.Fprintf(s.out, "Event: Node %d recovered\n", event.Node)
+	case node.EventMasterChanged:
+		if event.Node < 0 {
+			fmt.Fprintf(s.out, "Event: no master in term %d\n", event.Term)
+		} else {
+			fmt.Fprintf(s.out, "Event: Node %d is master in term %d\n", event.Node, event.Term)
+		}
+	}
+}
+
+func (s *Shell) printChange(change node.KeyChange) {
+	if change.Deleted {
+		fmt.Fprintf(s.out, "Watch: %s deleted on Node %d\n", change.Key, change.Node)
+		return
+	}
+	fmt.Fprintf(s.out, "Watch: %s = %s on Node %d\n", change.Key, change.Value, change.Node)
+}
+
+// printSent reports the tasks sent to each node and the sends that failed.
+func (s *Shell) printSent(sent map[int]string, err error) {
+	if len(sent) == 0 && err == nil {
+		fmt.Fprintln(s.out, "No nodes to send to")
+		return
+	}
+	for _, id := range sortedIDs(sent) {
+		fmt.Fprintf(s.out, "Task %s sent to Node %d\n", sent[id], id)
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+	}
+}
+
+// printMessage reports task results and KV replies as they arrive.
+func (s *Shell) printMessage(msg node.Message) {
+	switch msg.Type {
+	case "result":
+		task, ok := s.node.Task(msg.TaskID)
+		if !ok {
+			fmt.Fprintf(s.out, "Result received from Node %d: %s\n", msg.From, msg.Content)
+			return
+		}
+		latency := task.Latency().Round(time.Millisecond)
+		if msg.Error != "" {
+			fmt.Fprintf(s.out, "Task %s failed on Node %d after %v: %s\n", task.ID, msg.From, latency, msg.Error)
+			return
+		}
+		fmt.Fprintf(s.out, "Result for task %s from Node %d after %v: %s\n", task.ID, msg.From, latency, msg.Content)
+
+	case "progress":
+		if msg.Content == "" {
+			fmt.Fprintf(s.out, "Progress of task %s on Node %d: %d%%\n", msg.TaskID, msg.From, msg.Progress)
+			return
+		}
+		fmt.Fprintf(s.out, "Progress of task %s on Node %d: %d%% %s\n", msg.TaskID, msg.From, msg.Progress, msg.Content)
+
+	case "kv_result":
+		if msg.Error != "" {
+			fmt.Fprintf(s.out, "KV error from Node %d: %s\n", msg.From, msg.Error)
+			return
+		}
+		fmt.Fprintf(s.out, "KV result from Node %d: %s\n", msg.From, msg.Content)
+
+	default:
+		// Types the node does not handle, e.g. sent by a newer build
+		fmt.Fprintf(s.out, "Message of type %q from Node %d: %s\n", msg.Type, msg.From, msg.Content)
+	}
+}
+
+func (s *Shell) printTasks() {
+	tasks := s.node.Tasks()
+	if len(tasks) == 0 {
+		fmt.Fprintln(s.out, "No tasks")
+		return
+	}
+
+	for _, task := range tasks {
+		status := task.Status
+		if task.Status == node.TaskPending && task.Progress > 0 {
+			status = fmt.Sprintf("%d%%", task.Progress)
+		}
+		fmt.Fprintf(s.out, "%s  node %d  %-9s  %-10s  %8v  %s\n", task.ID, task.Target, status, task.TaskType, task.Latency().Round(time.Millisecond), task.Content)
+	}
+}
+
+// drain takes the node out of service and reports whether it can be shut
+// down.
+func (s *Shell) drain() {
+	fmt.Fprintln(s.out, "Draining: refusing new tasks, leaving the ring and migrating keys...")
+	report, err := s.node.Drain()
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Migrated %d of %d keys to other replicas\n", report.Migrated, report.Keys)
+	if report.Failed > 0 {
+		fmt.Fprintf(s.out, "Warning: %d keys were not acknowledged by their new replicas\n", report.Failed)
+	}
+	if report.Unfinished > 0 {
+		fmt.Fprintf(s.out, "Warning: %d tasks are still queued or running\n", report.Unfinished)
+	}
+	if report.Hints > 0 {
+		fmt.Fprintf(s.out, "Warning: %d writes are held for replicas that are down\n", report.Hints)
+	}
+	if report.Safe {
+		fmt.Fprintf(s.out, "Node %d is drained and safe to shut down\n", s.node.ID)
+	} else {
+		fmt.Fprintf(s.out, "Node %d is drained but not safe to shut down yet; run drain again to retry\n", s.node.ID)
+	}
+}
+
+// rebalanceStatus shows the progress of every member's last rebalance.
+func (s *Shell) rebalanceStatus() {
+	statuses := s.node.ClusterRebalanceStatus()
+	ids := make([]int, 0, len(statuses))
+	for id := range statuses {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		status := statuses[id]
+		if status.Started.IsZero() {
+			fmt.Fprintf(s.out, "Node %d: no rebalance yet\n", id)
+			continue
+		}
+		state := fmt.Sprintf("done in %v", status.Finished.Sub(status.Started).Round(time.Millisecond))
+		if status.Running {
+			state = fmt.Sprintf("running for %v", time.Since(status.Started).Round(time.Second))
+		}
+		fmt.Fprintf(s.out, "Node %d: copied %d of %d keys", id, status.Copied, status.Keys)
+		if status.Failed > 0 {
+			fmt.Fprintf(s.out, ", %d failed", status.Failed)
+		}
+		fmt.Fprintf(s.out, " (%s", state)
+		if len(status.Joined) > 0 {
+			fmt.Fprintf(s.out, "; joined %v", status.Joined)
+		}
+		if len(status.Left) > 0 {
+			fmt.Fprintf(s.out, "; left %v", status.Left)
+		}
+		fmt.Fprintln(s.out, ")")
+	}
+}
+
+// deadLetters lists the dead-letter queue or retries a task in it.
+func (s *Shell) deadLetters(args []string) {
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		letters := s.node.DeadLetters()
+		if len(letters) == 0 {
+			fmt.Fprintln(s.out, "No dead letters")
+			return
+		}
+		for _, letter := range letters {
+			retries := ""
+			if letter.Retries > 0 {
+				retries = fmt.Sprintf("  (retry %d)", letter.Retries)
+			}
+			fmt.Fprintf(s.out, "%s  node %d  %-10s  %s  %q  %s%s\n", letter.ID, letter.Target, letter.TaskType,
+				letter.FailedAt.Format(time.TimeOnly), letter.Content, letter.Error, retries)
+		}
+	case len(args) == 2 && args[0] == "retry":
+		id, err := s.node.RetryDeadLetter(args[1])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Task %s sent again as %s\n", args[1], id)
+	default:
+		fmt.Fprintln(s.out, "Usage: dlq [list | retry <task_id>]")
+	}
+}
+
+// printProgress shows how far a task has come, with the last partial
+// output its handler reported.
+func (s *Shell) printProgress(id string) {
+	task, ok := s.node.Task(id)
+	if !ok {
+		fmt.Fprintf(s.out, "No task %s\n", id)
+		return
+	}
+	percent := task.Progress
+	if task.Status != node.TaskPending {
+		percent = 100
+	}
+	const width = 20
+	bar := strings.Repeat("#", percent*width/100) + strings.Repeat(".", width-percent*width/100)
+	fmt.Fprintf(s.out, "Task %s (%s) on Node %d: %s [%s] %d%% after %v\n", task.ID, task.TaskType, task.Target,
+		task.Status, bar, percent, task.Latency().Round(time.Millisecond))
+	switch {
+	case task.Status != node.TaskPending:
+		fmt.Fprintf(s.out, "Result: %s\n", task.Result)
+	case task.Partial != "":
+		fmt.Fprintf(s.out, "Partial output: %s\n", task.Partial)
+	}
+}
+
+func (s *Shell) printHealth() {
+	health := s.node.Health()
+
+	fmt.Fprintln(s.out, "Peer health:")
+	for _, id := range sortedIDs(health) {
+		h := health[id]
+		fmt.Fprintf(s.out, "Node %d: %s (last seen %v ago)\n", id, h.Status, time.Since(h.LastSeen).Round(time.Second))
+	}
+}
+
+func (s *Shell) printClusterStatus() {
+	w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tHEALTH\tQUEUE\tIDLE\tGOROUTINES\tHEAP\tREPORTED")
+	for _, load := range s.node.ClusterLoad() {
+		if load.ReportedAt.IsZero() {
+			fmt.Fprintf(w, "%d\t%s\t-\t-\t-\t-\tnever\n", load.ID, load.Health)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d/%d\t%d\t%d\t%.1f MB\t%v ago\n", load.ID, load.Health,
+			load.QueueDepth, load.QueueCapacity, load.IdleWorkers, load.Goroutines, float64(load.HeapBytes)/(1<<20),
+			time.Since(load.ReportedAt).Round(time.Second))
+	}
+	w.Flush()
+}
+
+// snapshotCluster takes a consistent snapshot of the cluster into a
+// directory.
+func (s *Shell) snapshotCluster(args []string) {
+	words, timeoutText, err := parseOption(args, "timeout", "a duration, e.g. 1m")
+	timeout := node.DefaultCutTimeout
+	if err == nil && timeoutText != "" {
+		if timeout, err = time.ParseDuration(timeoutText); err == nil && timeout <= 0 {
+			err = fmt.Errorf("invalid timeout %q", timeoutText)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	if len(words) != 1 {
+		fmt.Fprintln(s.out, "Usage: cluster snapshot <dir> [--timeout=d]")
+		return
+	}
+	snap, err := s.node.SnapshotCluster(words[0], timeout)
+	if err != nil {
+		fmt.Fprintf(s.out, "Snapshot failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(s.out, "Saved snapshot %s of nodes %v (%d keys, %d messages in flight) to %s in %v\n",
+		snap.ID, snap.Nodes, snap.Keys, snap.InFlight, words[0], snap.Completed.Sub(snap.Started).Round(time.Millisecond))
+}
+
+// query runs a query over the cluster's keys and prints the rows.
+func (s *Shell) query(text string) {
+	if text == "" {
+		fmt.Fprintln(s.out, `Usage: query select <*|key|value|count(*)> [where prefix = "p" and value contains "v"] [order by key|value [desc]] [limit n]`)
+		return
+	}
+	q, err := node.ParseQuery(text)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	result, err := s.node.Query(text)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	for _, row := range result.Rows {
+		switch q.Select {
+		case "key":
+			fmt.Fprintln(s.out, row.Key)
+		case "value":
+			fmt.Fprintln(s.out, row.Value)
+		default:
+			fmt.Fprintf(s.out, "%s = %s\n", row.Key, row.Value)
+		}
+	}
+	if q.Select == "count" {
+		fmt.Fprintf(s.out, "Count: %d\n", result.Count)
+	} else {
+		fmt.Fprintf(s.out, "(%d of %d matching keys)\n", len(result.Rows), result.Count)
+	}
+	if len(result.Missing) > 0 {
+		fmt.Fprintf(s.out, "Warning: nodes %v did not answer; keys only they hold are missing\n", result.Missing)
+	}
+}
+
+// key returns the key a command names, in the namespace picked with use.
+func (s *Shell) key(key string) string {
+	return node.NamespacedKey(s.namespace, key)
+}
+
+// use shows the namespace the shell's keys are in, or switches to another.
+func (s *Shell) use(args []string) {
+	switch len(args) {
+	case 0:
+		fmt.Fprintf(s.out, "Using namespace %s\n", node.NamespaceLabel(s.namespace))
+	case 1:
+		namespace, err := node.ParseNamespace(args[0])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		s.namespace = namespace
+		prompt := fmt.Sprintf("Node %d > ", s.node.ID)
+		if namespace != "" {
+			prompt = fmt.Sprintf("Node %d (%s) > ", s.node.ID, namespace)
+		}
+		s.rl.SetPrompt(prompt)
+		fmt.Fprintf(s.out, "Using namespace %s\n", node.NamespaceLabel(namespace))
+	default:
+		fmt.Fprintln(s.out, "Usage: use [namespace]")
+	}
+}
+
+// namespaces lists the namespaces, or sets the replication of one.
+func (s *Shell) namespaces(args []string) {
+	switch {
+	case len(args) == 0:
+		for _, ns := range s.node.Namespaces() {
+			replication := fmt.Sprintf("replication %d", ns.Replication)
+			if ns.Configured {
+				replication += " (set)"
+			}
+			fmt.Fprintf(s.out, "%s: %d keys here, %s\n", ns.Name, ns.Keys, replication)
+		}
+	case len(args) == 3 && args[0] == "replication":
+		replication := 0
+		if args[2] != "default" {
+			var err error
+			if replication, err = strconv.Atoi(args[2]); err != nil || replication < 1 {
+				fmt.Fprintln(s.out, "Error: replication must be at least 1, or default")
+				return
+			}
+		}
+		if err := s.node.SetNamespaceReplication(args[1], replication); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		if replication == 0 {
+			fmt.Fprintf(s.out, "Namespace %s uses the replication option\n", args[1])
+		} else {
+			fmt.Fprintf(s.out, "Namespace %s has %d replicas\n", args[1], replication)
+		}
+	default:
+		fmt.Fprintln(s.out, "Usage: namespaces [replication <namespace> <n|default>]")
+	}
+}
+
+// scan lists the keys in a range across the cluster, in order.
+func (s *Shell) scan(args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Fprintln(s.out, "Usage: scan <start> <end> [limit]")
+		return
+	}
+	limit := 100
+	if len(args) == 3 {
+		var err error
+		if limit, err = strconv.Atoi(args[2]); err != nil || limit < 0 {
+			fmt.Fprintln(s.out, "Error: limit must be a number, 0 for no limit")
+			return
+		}
+	}
+	result, err := s.node.ScanNamespace(s.namespace, args[0], args[1], limit)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+
+	for _, row := range result.Rows {
+		fmt.Fprintf(s.out, "%s = %s\n", row.Key, row.Value)
+	}
+	if result.More {
+		fmt.Fprintf(s.out, "(%d keys; more follow %s)\n", len(result.Rows), result.Rows[len(result.Rows)-1].Key)
+	} else {
+		fmt.Fprintf(s.out, "(%d keys)\n", len(result.Rows))
+	}
+	if len(result.Missing) > 0 {
+		fmt.Fprintf(s.out, "Warning: nodes %v did not answer; keys only they hold are missing\n", result.Missing)
+	}
+}
+
+// index shows, creates, drops or looks up secondary indexes.
+func (s *Shell) index(args []string) {
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		indexes := s.node.Indexes()
+		if len(indexes) == 0 {
+			fmt.Fprintln(s.out, "No indexes")
+		}
+		for _, idx := range indexes {
+			fmt.Fprintf(s.out, "%s: field %s of %s:* (since %s)\n", idx.Name(), idx.Field, idx.Collection, idx.Updated.Format(time.RFC3339))
+		}
+	case len(args) == 4 && args[0] == "create" && args[2] == "by":
+		idx, err := s.node.CreateIndex(args[1], args[3])
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Index %s created\n", idx.Name())
+	case len(args) == 2 && args[0] == "drop":
+		if err := s.node.DropIndex(args[1]); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(s.out, "Index %s dropped\n", args[1])
+	case len(args) >= 3 && args[0] == "lookup":
+		rows, err := s.node.LookupIndex(args[1], strings.Join(args[2:], " "))
+		if err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+			return
+		}
+		for _, row := range rows {
+			fmt.Fprintf(s.out, "%s = %s\n", row.Key, row.Value)
+		}
+		fmt.Fprintf(s.out, "(%d keys)\n", len(rows))
+	default:
+		fmt.Fprintln(s.out, "Usage: index [list | create <collection> by <field> | drop <collection>.<field> | lookup <collection>.<field> <value>]")
+	}
+}
+
+func (s *Shell) printRing(key string) {
+	ring := s.node.Ring()
+	if key != "" {
+		stored := s.key(key)
+		fmt.Fprintf(s.out, "%s is owned by Node %d, replicas %v\n", key, ring.Owner(stored), ring.Replicas(stored, s.node.ReplicationFor(stored)))
+		return
+	}
+
+	shares := ring.Shares()
+	fmt.Fprintln(s.out, "Ring members:")
+	for _, id := range ring.Nodes() {
+		marker := ""
+		if id == s.node.ID {
+			marker = " (self)"
+		}
+		fmt.Fprintf(s.out, "Node %d%s: %.1f%% of keys\n", id, marker, shares[id]*100)
+	}
+}
+
+// sortedIDs returns the node ids keying m in ascending order.
+func sortedIDs[V any](m map[int]V) []int {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/chzyer/readline"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// completer completes command names, peer ids and task types.
+func (s *Shell) completer() readline.AutoCompleter {
+	peer := readline.PcItemDynamic(s.peerIDs)
+	peerWithType := readline.PcItemDynamic(s.peerIDs, readline.PcItemDynamic(s.taskTypes))
+
+	return readline.NewPrefixCompleter(
+		readline.PcItem("connect"),
+		readline.PcItem("join"),
+		readline.PcItem("send", peer),
+		readline.PcItem("exec", peerWithType),
+		readline.PcItem("send-batch", peer),
+		readline.PcItem("exec-all", readline.PcItemDynamic(s.taskTypes)),
+		readline.PcItem("preempt"),
+		readline.PcItem("submit"),
+		readline.PcItem("broadcast"),
+		readline.PcItem("multicast", readline.PcItemDynamic(s.groupNames)),
+		readline.PcItem("group",
+			readline.PcItem("set"),
+			readline.PcItem("del", readline.PcItemDynamic(s.groupNames)),
+			readline.PcItem("list"),
+		),
+		readline.PcItem("tasks"),
+		readline.PcItem("dlq",
+			readline.PcItem("list"),
+			readline.PcItem("retry", readline.PcItemDynamic(s.deadLetterIDs)),
+		),
+		readline.PcItem("progress"),
+		readline.PcItem("send-at"),
+		readline.PcItem("schedule",
+			readline.PcItem("every"),
+			readline.PcItem("cron"),
+			readline.PcItem("list"),
+			readline.PcItem("del"),
+		),
+		readline.PcItem("set"),
+		readline.PcItem("get"),
+		readline.PcItem("del"),
+		readline.PcItem("resolve"),
+		readline.PcItem("incr"),
+		readline.PcItem("decr"),
+		readline.PcItem("sadd"),
+		readline.PcItem("srem"),
+		readline.PcItem("rset"),
+		readline.PcItem("crdt"),
+		readline.PcItem("query", readline.PcItem("select")),
+		readline.PcItem("scan"),
+		readline.PcItem("use"),
+		readline.PcItem("namespaces", readline.PcItem("replication")),
+		readline.PcItem("index",
+			readline.PcItem("list"),
+			readline.PcItem("create"),
+			readline.PcItem("drop", readline.PcItemDynamic(s.indexNames)),
+			readline.PcItem("lookup", readline.PcItemDynamic(s.indexNames)),
+		),
+		readline.PcItem("ring"),
+		readline.PcItem("hotkeys"),
+		readline.PcItem("list"),
+		readline.PcItem("health"),
+		readline.PcItem("cluster", readline.PcItem("status"), readline.PcItem("snapshot")),
+		readline.PcItem("snapshot"),
+		readline.PcItem("restore"),
+		readline.PcItem("import"),
+		readline.PcItem("export"),
+		readline.PcItem("put-blob"),
+		readline.PcItem("get-blob"),
+		readline.PcItem("drain"),
+		readline.PcItem("rebalance", readline.PcItem("status")),
+		readline.PcItem("compact"),
+		readline.PcItem("chaos",
+			readline.PcItem("drop"),
+			readline.PcItem("delay"),
+			readline.PcItem("partition"),
+			readline.PcItem("heal"),
+			readline.PcItem("off"),
+		),
+		readline.PcItem("auth",
+			readline.PcItem("accept"),
+			readline.PcItem("rotate"),
+			readline.PcItem("retire"),
+		),
+		readline.PcItem("acl",
+			readline.PcItem("set"),
+			readline.PcItem("del", readline.PcItemDynamic(s.aclSubjects)),
+		),
+		readline.PcItem("schema",
+			readline.PcItem("list"),
+			readline.PcItem("set", readline.PcItemDynamic(s.taskTypes)),
+			readline.PcItem("del", readline.PcItemDynamic(s.schemaTypes)),
+		),
+		readline.PcItem("evict", peer),
+		readline.PcItem("unban", readline.PcItemDynamic(s.bannedIDs)),
+		readline.PcItem("bans"),
+		readline.PcItem("config",
+			readline.PcItem("set", readline.PcItemDynamic(optionNames)),
+			readline.PcItem("cluster",
+				readline.PcItem("set", readline.PcItemDynamic(optionNames)),
+				readline.PcItem("del", readline.PcItemDynamic(s.clusterSettingNames)),
+				readline.PcItem("watch", readline.PcItem("on"), readline.PcItem("off")),
+			),
+		),
+		readline.PcItem("watch"),
+		readline.PcItem("unwatch"),
+		readline.PcItem("id", peer),
+		readline.PcItem("leader"),
+		readline.PcItem("lock"),
+		readline.PcItem("unlock", readline.PcItemDynamic(s.leaseNames)),
+		readline.PcItem("locks"),
+		readline.PcItem("events", readline.PcItem("on"), readline.PcItem("off")),
+		readline.PcItem("multi"),
+		readline.PcItem("discard"),
+		readline.PcItem("help"),
+		readline.PcItem("exit"),
+	)
+}
+
+func (s *Shell) indexNames(string) []string {
+	var names []string
+	for _, idx := range s.node.Indexes() {
+		names = append(names, idx.Name())
+	}
+	return names
+}
+
+func optionNames(string) []string {
+	return node.OptionNames()
+}
+
+func (s *Shell) leaseNames(string) []string {
+	names := make([]string, 0, len(s.leases))
+	for name := range s.leases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Shell) clusterSettingNames(string) []string {
+	var names []string
+	for name := range s.node.ClusterConfig().Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Shell) peerIDs(string) []string {
+	var ids []string
+	for _, id := range sortedIDs(s.node.Status().Peers) {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return ids
+}
+
+func (s *Shell) groupNames(string) []string {
+	var names []string
+	for name := range s.node.Groups().All() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Shell) taskTypes(string) []string {
+	return s.node.TaskTypes()
+}
+
+func (s *Shell) aclSubjects(string) []string {
+	var subjects []string
+	for subject := range s.node.ACL().Rules {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+func (s *Shell) schemaTypes(string) []string {
+	var types []string
+	for taskType := range s.node.TaskSchemas() {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (s *Shell) bannedIDs(string) []string {
+	var ids []string
+	for _, ban := range s.node.Bans() {
+		ids = append(ids, strconv.Itoa(ban.Node))
+	}
+	return ids
+}
+
+func (s *Shell) deadLetterIDs(string) []string {
+	var ids []string
+	for _, letter := range s.node.DeadLetters() {
+		ids = append(ids, letter.ID)
+	}
+	return ids
+}
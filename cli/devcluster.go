@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// The devcluster subcommand runs a whole cluster in one process for local
+// development:
+//
+//	dbs devcluster --nodes=5 -- --replication=3 --heartbeat=1s
+//
+// Node i listens on 127.0.0.1 at base-port + i - 1 (or on dbs-node<i>.sock
+// with --transport=unix, \\.\pipe\dbs-node<i> with --transport=pipe), is
+// given every node before it as a seed, and logs to stdout behind an
+// "n<i> | " prefix. Node 1 is the master. The shell runs commands on one
+// node; exiting it stops them all.
+
+// logMux serializes the log lines of several nodes onto one writer.
+type logMux struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (m *logMux) setOutput(out io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.out = out
+}
+
+// prefixWriter writes each line written to it to a logMux behind a prefix.
+type prefixWriter struct {
+	mux    *logMux
+	prefix string
+}
+
+func (w prefixWriter) Write(p []byte) (int, error) {
+	w.mux.mutex.Lock()
+	defer w.mux.mutex.Unlock()
+
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line != "" {
+			b.WriteString(w.prefix)
+			b.WriteString(line)
+		}
+	}
+	if _, err := io.WriteString(w.mux.out, b.String()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// DevCluster runs the devcluster subcommand with args, the arguments after
+// its name, until the shell exits or the process is signalled.
+func DevCluster(args []string) error {
+	fs := flag.NewFlagSet("dbs devcluster", flag.ContinueOnError)
+	count := fs.Int("nodes", 3, "number of nodes")
+	basePort := fs.Int("base-port", 8001, "port of node 1; node i listens on base-port + i - 1")
+	httpPort := fs.Int("http-port", 0, "admin API port of node 1, numbered like the node ports (disabled if 0)")
+	attach := fs.Int("attach", 1, "node the shell runs commands on")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: dbs devcluster [flags] [-- node flags]")
+		fmt.Fprintln(fs.Output(), "Runs a local cluster in one process. Node flags after -- apply to every node (see dbs -help).")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *count < 1:
+		return errors.New("--nodes must be at least 1")
+	case *attach < 1 || *attach > *count:
+		return fmt.Errorf("--attach must be a node from 1 to %d", *count)
+	case *basePort < 1 || *basePort+*count-1 > 65535:
+		return fmt.Errorf("--base-port leaves no room for %d nodes", *count)
+	case *httpPort < 0 || *httpPort+*count-1 > 65535:
+		return fmt.Errorf("--http-port leaves no room for %d nodes", *count)
+	}
+	template, err := parseFlags(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	logs := &logMux{out: os.Stdout}
+	width := len(fmt.Sprint(*count))
+	var (
+		nodes []*node.Node
+		seeds []node.Seed
+		shell *Shell
+	)
+	stop := func() {
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n.Shutdown()
+			}()
+		}
+		wg.Wait()
+	}
+
+	for id := 1; id <= *count; id++ {
+		cfg := template
+		cfg.NodeID = id
+		cfg.Master = id == 1
+		cfg.Bind = fmt.Sprintf("127.0.0.1:%d", *basePort+id-1)
+		switch cfg.Transport {
+		case node.TransportUnix:
+			cfg.Bind = fmt.Sprintf("dbs-node%d.sock", id)
+		case node.TransportPipe:
+			cfg.Bind = fmt.Sprintf(`\\.\pipe\dbs-node%d`, id)
+		}
+		if *httpPort > 0 {
+			cfg.HTTP = fmt.Sprintf("127.0.0.1:%d", *httpPort+id-1)
+		}
+		if template.DataDir != "" {
+			cfg.DataDir = filepath.Join(template.DataDir, fmt.Sprintf("node%d", id))
+		}
+		cfg.Seeds = append(append([]node.Seed(nil), template.Seeds...), seeds...)
+		cfg.LogFile = ""
+		cfg.LogOutput = prefixWriter{mux: logs, prefix: fmt.Sprintf("n%-*d | ", width, id)}
+		if err := cfg.Validate(); err != nil {
+			stop()
+			return fmt.Errorf("node %d: invalid config:\n%v", id, err)
+		}
+
+		n, err := node.NewNode(cfg)
+		if err != nil {
+			stop()
+			return fmt.Errorf("node %d: %v", id, err)
+		}
+		if id == *attach {
+			slog.SetDefault(n.Logger())
+			history := ""
+			if home, err := os.UserHomeDir(); err == nil {
+				history = filepath.Join(home, ".dbs_history")
+			}
+			if shell, err = New(n, os.Stdin, os.Stdout, history); err != nil {
+				stop()
+				return err
+			}
+			// Log lines go through the shell so its prompt is redrawn
+			logs.setOutput(shell.out)
+		}
+		if cfg.HTTP != "" {
+			n.StartAdmin(cfg.HTTP)
+		}
+		if err := n.Start(); err != nil {
+			stop()
+			return fmt.Errorf("node %d: %v", id, err)
+		}
+		nodes = append(nodes, n)
+		seeds = append(seeds, node.Seed{ID: id, Address: n.Address})
+	}
+
+	for _, n := range nodes {
+		line := fmt.Sprintf("Node %d on %s", n.ID, n.Address)
+		if *httpPort > 0 {
+			line += fmt.Sprintf(", admin API on 127.0.0.1:%d", *httpPort+n.ID-1)
+		}
+		fmt.Fprintln(shell.out, line)
+	}
+	fmt.Fprintf(shell.out, "Started %d nodes; the shell runs commands on Node %d, exit stops the cluster\n", len(nodes), *attach)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		stop()
+	}()
+	go func() {
+		shell.Run()
+		stop()
+	}()
+	for _, n := range nodes {
+		n.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultExecAllTimeout is how long exec-all waits for each node.
+const defaultExecAllTimeout = 10 * time.Second
+
+// execAll runs a task on every node and prints a table of how it went on
+// each.
+func (s *Shell) execAll(args []string) {
+	words, timeoutText, err := parseOption(args, "timeout", "a duration, e.g. 30s")
+	timeout := defaultExecAllTimeout
+	if err == nil && timeoutText != "" {
+		if timeout, err = time.ParseDuration(timeoutText); err == nil && timeout <= 0 {
+			err = fmt.Errorf("invalid timeout %q", timeoutText)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	if len(words) < 1 {
+		fmt.Fprintf(s.out, "Usage: exec-all <task_type> [content] [--timeout=d] (types: %s)\n", strings.Join(s.node.TaskTypes(), ", "))
+		return
+	}
+
+	results, err := s.node.ExecAll(words[0], strings.Join(words[1:], " "), timeout)
+	if err != nil {
+		fmt.Fprintf(s.out, "Error: %v\n", err)
+		return
+	}
+	failed := 0
+	w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATUS\tTIME\tRESULT")
+	for _, result := range results {
+		status, output := "ok", result.Result
+		if result.Error != "" {
+			status, output = "failed", result.Error
+			failed++
+		}
+		fmt.Fprintf(w, "%d\t%s\t%v\t%s\n", result.Node, status, result.Duration.Round(time.Millisecond), output)
+	}
+	w.Flush()
+	fmt.Fprintf(s.out, "%s on %d nodes: %d succeeded, %d failed\n", words[0], len(results), len(results)-failed, failed)
+}
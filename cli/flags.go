@@ -0,0 +1,296 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// parseFlags builds the node config from an optional --config file, with
+// any flags given on the command line taking precedence over the file.
+func parseFlags(args []string) (node.Config, error) {
+	fs := flag.NewFlagSet("dbs", flag.ContinueOnError)
+	defaults := node.DefaultConfig()
+
+	configPath := fs.String("config", "", "path to a YAML config file")
+	nodeID := fs.Int("id", defaults.NodeID, "node id")
+	bind := fs.String("bind", defaults.Bind, "address to listen on for peers (a socket path with --transport=unix, a pipe name with --transport=pipe)")
+	port := fs.Int("port", 0, "port to listen on for peers, replacing the one in --bind (0 picks a free port)")
+	advertise := fs.String("advertise", defaults.Advertise, "address peers dial to reach this node, when it is not the bind address, e.g. behind NAT or in a container (a host alone keeps the bound port)")
+	master := fs.Bool("master", defaults.Master, "lead the first election term")
+	role := fs.String("role", defaults.Role, "node role: member, observer (read-only replica), arbiter (votes, holds no data) or client (routes requests only)")
+	var seeds seedList
+	fs.Var(&seeds, "seed", "peer to connect to on startup as <node_id>@<host:port> (repeatable)")
+	var join addressList
+	fs.Var(&join, "join", "address of a cluster member to join through on startup; the first reachable one is used (repeatable)")
+	discovery := fs.String("discovery", "", "find members to join through on startup and every 30s: static:<host:port,...>, dns:<SRV name> or kubernetes:<pod label selector>")
+	transport := fs.String("transport", defaults.Transport, "node-to-node transport: tcp, grpc, unix (--bind is then a socket path) or pipe (Windows named pipes, --bind is then a pipe name)")
+	protocol := fs.String("protocol", defaults.Protocol, "wire protocol for dialed TCP connections: json or binary")
+	codec := fs.String("codec", defaults.Codec, "codec of binary frames on dialed connections: json or msgpack; peers that lack it get json")
+	adminAddr := fs.String("http", defaults.HTTP, "address for the HTTP admin API, e.g. :8080 (disabled if empty)")
+	workers := fs.Int("workers", defaults.Workers, "number of task worker goroutines")
+	queueSize := fs.Int("queue", defaults.QueueSize, "maximum number of queued tasks")
+	stealThreshold := fs.Int("steal-threshold", defaults.StealThreshold, "queue depth at which the leader moves queued tasks to idle nodes (no work stealing if 0)")
+	outboxSize := fs.Int("outbox", defaults.OutboxSize, "maximum number of messages queued for each peer")
+	sendTimeout := fs.Duration("send-timeout", defaults.SendTimeout, "how long sends and tasks wait for room when a peer's queue is full (fail at once if 0)")
+	writeTimeout := fs.Duration("write-timeout", defaults.WriteTimeout, "drop and redial a peer whose connection takes longer than this to write one message (no limit if 0)")
+	slowPeerTimeout := fs.Duration("slow-peer-timeout", defaults.SlowPeerTimeout, "open the circuit breaker of a peer whose outbound queue or writes stay slow this long (never if 0)")
+	keepAlive := fs.Duration("keepalive", defaults.KeepAlive, "probe TCP connections idle this long, every this often, and close them after 3 unanswered probes (OS default if 0)")
+	keepAliveTimeout := fs.Duration("keepalive-timeout", defaults.KeepAliveTimeout, "drop and redial a peer that has answered no ping for this long (never if 0)")
+	batchSize := fs.Int("batch-size", defaults.BatchSize, "most messages to a peer written with a single flush (no batching if 1)")
+	batchWindow := fs.Duration("batch-window", defaults.BatchWindow, "how long a batch of messages to a peer waits for more before it is flushed (flush once the queue is empty if 0)")
+	compression := fs.String("compression", defaults.Compression, "compress large message contents between nodes: none or gzip")
+	maxMessageSize := fs.Int("max-message-size", defaults.MaxMessageSize, "largest message in bytes accepted from a peer or client; larger ones close the connection")
+	compressThreshold := fs.Int("compress-threshold", defaults.CompressThreshold, "smallest message content in bytes that is compressed")
+	rateLimit := fs.Float64("rate-limit", defaults.RateLimit, "tasks and requests accepted per second on each connection (unlimited if 0)")
+	rateBurst := fs.Int("rate-burst", defaults.RateBurst, "tasks and requests accepted in a burst on each connection (the rate limit if 0)")
+	heartbeat := fs.Duration("heartbeat", defaults.HeartbeatInterval, "heartbeat interval")
+	suspectTimeout := fs.Duration("suspect-timeout", defaults.SuspectTimeout, "how long a silent peer goes before it is suspected (3 heartbeat intervals if 0)")
+	udpHeartbeats := fs.Bool("udp-heartbeats", defaults.UDPHeartbeats, "send heartbeats over UDP on the bind port instead of the peer connections")
+	logLevel := fs.String("log-level", defaults.LogLevel, "log level: debug, info, warn or error")
+	logFile := fs.String("log-file", defaults.LogFile, "write logs to this file instead of stderr")
+	logFormat := fs.String("log-format", defaults.LogFormat, "log format: text or json")
+	trace := fs.Bool("trace", defaults.Trace, "log a span for every step of a request on this node at info level instead of debug")
+	tlsCert := fs.String("tls-cert", "", "PEM certificate for mutual TLS")
+	tlsKey := fs.String("tls-key", "", "PEM private key for mutual TLS")
+	tlsCA := fs.String("tls-ca", "", "PEM CA bundle used to verify peers")
+	authToken := fs.String("auth-token", defaults.AuthToken, "shared secret every message is signed with (unauthenticated if empty)")
+	gatewayToken := fs.String("gateway-token", defaults.GatewayToken, "token browsers pass to the WebSocket gateway at /ws on the --http address (gateway off if empty)")
+	ackTimeout := fs.Duration("ack-timeout", defaults.AckTimeout, "how long to wait for an ack before resending a task or result")
+	retryLimit := fs.Int("retries", defaults.RetryLimit, "how many times to resend an unacknowledged task or result")
+	replication := fs.Int("replication", defaults.Replication, "number of nodes each key is stored on")
+	conflicts := fs.String("conflicts", defaults.Conflicts, "how concurrent writes to a key are resolved: lww (the last writer wins) or siblings (kept until the application resolves them)")
+	linearizable := fs.Bool("linearizable", defaults.Linearizable, "serve gets, sets and dels on the leader and commit writes through its replicated log before acknowledging them (set on every node)")
+	rebalanceRate := fs.Float64("rebalance-rate", defaults.RebalanceRate, "keys per second copied to new replicas when nodes join or leave (unlimited if 0)")
+	hotKeyThreshold := fs.Float64("hot-key-threshold", defaults.HotKeyThreshold, "accesses per second at which a key is hot")
+	hotKeyCache := fs.Duration("hot-key-cache", defaults.HotKeyCache, "how long clients' reads of hot keys coordinated elsewhere are answered from this node's cache (no caching if 0)")
+	dataDir := fs.String("data-dir", defaults.DataDir, "directory for the write-ahead log and data log (in-memory only if empty)")
+	storage := fs.String("storage", defaults.Storage, "KV storage engine: memory, or disk to keep values in a data log under --data-dir")
+	var taskSchemas schemaFiles
+	fs.Var(&taskSchemas, "task-schema", "reject tasks of a type whose content does not match a JSON schema, as <task_type>=<file> (repeatable)")
+	fsync := fs.String("fsync", defaults.Fsync, "when writes to the WAL and data log are synced to disk: always (before they are acknowledged), group (every --fsync-interval) or none (left to the OS)")
+	fsyncInterval := fs.Duration("fsync-interval", defaults.FsyncInterval, "how often writes are synced to disk with --fsync=group")
+	interrupted := fs.String("interrupted-tasks", defaults.InterruptedTasks, "what to do on restart with tasks a crash interrupted, journaled under --data-dir: rerun them or report them as failed (fail)")
+
+	if err := fs.Parse(args); err != nil {
+		return node.Config{}, err
+	}
+	if fs.NArg() != 0 {
+		return node.Config{}, fmt.Errorf("unexpected arguments %v; see -help", fs.Args())
+	}
+
+	cfg := defaults
+	if *configPath != "" {
+		var err error
+		if cfg, err = node.LoadConfig(*configPath); err != nil {
+			return node.Config{}, err
+		}
+	}
+
+	portSet := false
+	var discoveryErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			cfg.NodeID = *nodeID
+		case "bind":
+			cfg.Bind = *bind
+		case "port":
+			portSet = true
+		case "advertise":
+			cfg.Advertise = *advertise
+		case "master":
+			cfg.Master = *master
+		case "role":
+			cfg.Role = *role
+		case "seed":
+			cfg.Seeds = seeds
+		case "join":
+			cfg.Join = join
+		case "discovery":
+			cfg.Discovery, discoveryErr = node.ParseDiscovery(*discovery)
+		case "transport":
+			cfg.Transport = *transport
+		case "protocol":
+			cfg.Protocol = *protocol
+		case "codec":
+			cfg.Codec = *codec
+		case "http":
+			cfg.HTTP = *adminAddr
+		case "workers":
+			cfg.Workers = *workers
+		case "queue":
+			cfg.QueueSize = *queueSize
+		case "steal-threshold":
+			cfg.StealThreshold = *stealThreshold
+		case "outbox":
+			cfg.OutboxSize = *outboxSize
+		case "send-timeout":
+			cfg.SendTimeout = *sendTimeout
+		case "write-timeout":
+			cfg.WriteTimeout = *writeTimeout
+		case "slow-peer-timeout":
+			cfg.SlowPeerTimeout = *slowPeerTimeout
+		case "keepalive":
+			cfg.KeepAlive = *keepAlive
+		case "keepalive-timeout":
+			cfg.KeepAliveTimeout = *keepAliveTimeout
+		case "batch-size":
+			cfg.BatchSize = *batchSize
+		case "batch-window":
+			cfg.BatchWindow = *batchWindow
+		case "compression":
+			cfg.Compression = *compression
+		case "compress-threshold":
+			cfg.CompressThreshold = *compressThreshold
+		case "max-message-size":
+			cfg.MaxMessageSize = *maxMessageSize
+		case "rate-limit":
+			cfg.RateLimit = *rateLimit
+		case "rate-burst":
+			cfg.RateBurst = *rateBurst
+		case "heartbeat":
+			cfg.HeartbeatInterval = *heartbeat
+		case "suspect-timeout":
+			cfg.SuspectTimeout = *suspectTimeout
+		case "udp-heartbeats":
+			cfg.UDPHeartbeats = *udpHeartbeats
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "log-file":
+			cfg.LogFile = *logFile
+		case "log-format":
+			cfg.LogFormat = *logFormat
+		case "trace":
+			cfg.Trace = *trace
+		case "tls-cert":
+			cfg.TLS.Cert = *tlsCert
+		case "tls-key":
+			cfg.TLS.Key = *tlsKey
+		case "tls-ca":
+			cfg.TLS.CA = *tlsCA
+		case "auth-token":
+			cfg.AuthToken = *authToken
+		case "gateway-token":
+			cfg.GatewayToken = *gatewayToken
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "storage":
+			cfg.Storage = *storage
+		case "fsync":
+			cfg.Fsync = *fsync
+		case "fsync-interval":
+			cfg.FsyncInterval = *fsyncInterval
+		case "interrupted-tasks":
+			cfg.InterruptedTasks = *interrupted
+		case "task-schema":
+			if cfg.TaskSchemas == nil {
+				cfg.TaskSchemas = make(map[string]string)
+			}
+			for taskType, path := range taskSchemas {
+				cfg.TaskSchemas[taskType] = path
+			}
+		case "replication":
+			cfg.Replication = *replication
+		case "conflicts":
+			cfg.Conflicts = *conflicts
+		case "linearizable":
+			cfg.Linearizable = *linearizable
+		case "rebalance-rate":
+			cfg.RebalanceRate = *rebalanceRate
+		case "hot-key-threshold":
+			cfg.HotKeyThreshold = *hotKeyThreshold
+		case "hot-key-cache":
+			cfg.HotKeyCache = *hotKeyCache
+		case "ack-timeout":
+			cfg.AckTimeout = *ackTimeout
+		case "retries":
+			cfg.RetryLimit = *retryLimit
+		}
+	})
+
+	if discoveryErr != nil {
+		return node.Config{}, discoveryErr
+	}
+	if portSet {
+		host, _, err := net.SplitHostPort(cfg.Bind)
+		if err != nil {
+			return node.Config{}, fmt.Errorf("--port needs a host:port bind address, not %q", cfg.Bind)
+		}
+		cfg.Bind = net.JoinHostPort(host, strconv.Itoa(*port))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return node.Config{}, fmt.Errorf("invalid config:\n%v", err)
+	}
+	return cfg, nil
+}
+
+// seedList implements flag.Value for repeated or comma separated --seed flags.
+type seedList []node.Seed
+
+func (s *seedList) String() string {
+	parts := make([]string, len(*s))
+	for i, seed := range *s {
+		parts[i] = seed.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *seedList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		seed, err := node.ParseSeed(part)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, seed)
+	}
+	return nil
+}
+
+// schemaFiles implements flag.Value for repeated --task-schema flags, by
+// task type.
+type schemaFiles map[string]string
+
+func (s *schemaFiles) String() string {
+	parts := make([]string, 0, len(*s))
+	for taskType, path := range *s {
+		parts = append(parts, taskType+"="+path)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (s *schemaFiles) Set(value string) error {
+	taskType, path, ok := strings.Cut(value, "=")
+	if !ok || taskType == "" || path == "" {
+		return fmt.Errorf("expected <task_type>=<file>, got %q", value)
+	}
+	if *s == nil {
+		*s = make(schemaFiles)
+	}
+	(*s)[taskType] = path
+	return nil
+}
+
+// addressList implements flag.Value for repeated or comma separated address
+// flags.
+type addressList []string
+
+func (a *addressList) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addressList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*a = append(*a, part)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,589 @@
+// Package client talks to a cluster node on behalf of an application. A
+// Client is not a cluster member: it sends requests over a single connection
+// to one node, which routes them and replies on the same connection.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// ErrClosed is returned for requests on a closed client or connection.
+var ErrClosed = errors.New("client: connection closed")
+
+// ErrThrottled is returned for requests the node rejected because the
+// client exceeded its rate limit. They can be retried later.
+var ErrThrottled = errors.New("client: request throttled by node")
+
+// ErrLockHeld is returned by TryLock for a lock someone else holds.
+var ErrLockHeld = errors.New("client: lock held")
+
+// ErrPermissionDenied is returned for requests the node's access control
+// list does not allow the client's user; see SetUser.
+var ErrPermissionDenied = errors.New("client: permission denied")
+
+// Client is a connection to a single node. It is safe for concurrent use.
+type Client struct {
+	conn      transport.Conn
+	nextID    atomic.Uint64
+	pending   map[string]chan transport.Message
+	watches   map[string]chan transport.Message
+	user      string
+	namespace string
+	owner     string
+	mutex     sync.Mutex
+	err       error
+	done      chan struct{}
+}
+
+// Connect dials the node at address over plain TCP.
+func Connect(address string) (*Client, error) {
+	return ConnectTransport(transport.TCP{}, address)
+}
+
+// ConnectUnix dials a node on this host listening on the Unix domain
+// socket at path (see transport.Unix).
+func ConnectUnix(path string) (*Client, error) {
+	return ConnectTransport(transport.Unix{}, path)
+}
+
+// ConnectPipe dials a node on this Windows host listening on the named
+// pipe name (see transport.Pipe).
+func ConnectPipe(name string) (*Client, error) {
+	return ConnectTransport(transport.Pipe{}, name)
+}
+
+// ConnectTransport dials the node at address with t, for nodes using TLS
+// or the gRPC transport.
+func ConnectTransport(t transport.Transport, address string) (*Client, error) {
+	conn, err := t.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    transport.NewChunkConn(conn),
+		pending: make(map[string]chan transport.Message),
+		watches: make(map[string]chan transport.Message),
+		done:    make(chan struct{}),
+		owner:   "client-" + rand.Text(),
+	}
+	go c.readReplies()
+	return c, nil
+}
+
+// readReplies hands every reply to the request waiting for it and every
+// change to the watch it belongs to, failing all pending requests once the
+// connection breaks.
+func (c *Client) readReplies() {
+	for {
+		msg, err := c.conn.Recv()
+		if err != nil {
+			c.fail(ErrClosed)
+			return
+		}
+
+		if msg.Type == "watch_event" {
+			c.mutex.Lock()
+			events, ok := c.watches[msg.RequestID]
+			c.mutex.Unlock()
+			if ok {
+				select {
+				case events <- msg:
+				case <-c.done:
+				}
+			}
+			continue
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.pending[msg.RequestID]
+		delete(c.pending, msg.RequestID)
+		c.mutex.Unlock()
+
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.pending = nil
+}
+
+// SetUser names the user the client's requests are made as, which the
+// node's access control list decides what they may do. Requests of a
+// client without a user fall under the list's client:* rule.
+func (c *Client) SetUser(user string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.user = user
+}
+
+// Use makes the client's keys those of namespace, so applications sharing
+// a cluster do not collide; "" or "default" is the default namespace. Gets,
+// sets, deletes and replicated data types name keys within it, and ACL
+// rules for <subject>@<namespace> apply to its requests. Watches and tasks
+// are not namespaced. Names are letters, digits, - and _; requests in a
+// namespace with another name fail.
+func (c *Client) Use(namespace string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.namespace = namespace
+}
+
+func (c *Client) requestID() string {
+	return strconv.FormatUint(c.nextID.Add(1), 10)
+}
+
+// call sends msg and waits for its reply or for ctx to end. msg gets a new
+// request id unless it already has one.
+func (c *Client) call(ctx context.Context, msg transport.Message) (transport.Message, error) {
+	msg.Client = true
+	if msg.RequestID == "" {
+		msg.RequestID = c.requestID()
+	}
+	// The node gives up on the request, cancelling a task's handler, once
+	// the caller stops waiting
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Timeout = max(time.Until(deadline), time.Millisecond)
+	}
+	reply := make(chan transport.Message, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return transport.Message{}, c.err
+	}
+	msg.User = c.user
+	msg.Namespace = c.namespace
+	c.pending[msg.RequestID] = reply
+	c.mutex.Unlock()
+
+	forget := func() {
+		c.mutex.Lock()
+		delete(c.pending, msg.RequestID)
+		c.mutex.Unlock()
+	}
+
+	if err := c.conn.Send(msg); err != nil {
+		forget()
+		return transport.Message{}, err
+	}
+
+	select {
+	case r := <-reply:
+		if r.Error == "throttled" {
+			return r, ErrThrottled
+		}
+		if strings.HasPrefix(r.Error, "permission denied") {
+			return r, fmt.Errorf("%w: %s", ErrPermissionDenied, strings.TrimPrefix(r.Error, "permission denied: "))
+		}
+		if r.Error != "" {
+			return r, errors.New(r.Error)
+		}
+		return r, nil
+	case <-c.done:
+		return transport.Message{}, c.err
+	case <-ctx.Done():
+		forget()
+		return transport.Message{}, ctx.Err()
+	}
+}
+
+// Consistency is how many of a key's replicas a read consults.
+type Consistency string
+
+const (
+	// One reads the copy of the node coordinating the key. It is the
+	// fastest, but may miss a write that has not reached that node yet.
+	One Consistency = "one"
+	// Quorum reads a majority of the key's replicas and returns the newest
+	// value among them, so it sees every write that has been acknowledged.
+	Quorum Consistency = "quorum"
+	// All reads every replica of the key and fails if any is unreachable.
+	All Consistency = "all"
+)
+
+// Get returns the value of key and whether it exists, read at consistency
+// One.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	return c.GetConsistency(ctx, key, One)
+}
+
+// GetConsistency returns the value of key and whether it exists, read at
+// the given consistency level. It fails if not enough replicas answer.
+func (c *Client) GetConsistency(ctx context.Context, key string, level Consistency) (string, bool, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "get", Key: key, Consistency: string(level)})
+	if err != nil {
+		return "", false, err
+	}
+	return reply.Value, reply.Found, nil
+}
+
+// Set stores value under key. It returns once the write has been
+// acknowledged by a quorum of the key's replicas.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	_, err := c.call(ctx, transport.Message{Type: "set", Key: key, Value: value})
+	return err
+}
+
+// SetTTL stores value under key for ttl, after which the key expires on
+// every replica.
+func (c *Client) SetTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := c.call(ctx, transport.Message{Type: "set", Key: key, Value: value, TTL: ttl})
+	return err
+}
+
+// Versions returns the values key holds, newest first, with the context to
+// resolve them with. A key written concurrently on a cluster that keeps
+// siblings holds several; a deleted version is left out.
+func (c *Client) Versions(ctx context.Context, key string) ([]string, transport.VectorClock, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "get", Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	var values []string
+	if reply.Found {
+		values = append(values, reply.Value)
+	}
+	for i := len(reply.Siblings) - 1; i >= 0; i-- {
+		if !reply.Siblings[i].Deleted {
+			values = append(values, reply.Siblings[i].Value)
+		}
+	}
+	return values, reply.Context, nil
+}
+
+// Resolve replaces the versions of key that Versions returned with
+// context by value. Versions written since are kept.
+func (c *Client) Resolve(ctx context.Context, key, value string, context transport.VectorClock) error {
+	_, err := c.call(ctx, transport.Message{Type: "set", Key: key, Value: value, Context: context})
+	return err
+}
+
+// Del deletes key and reports whether it existed.
+func (c *Client) Del(ctx context.Context, key string) (bool, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "del", Key: key})
+	if err != nil {
+		return false, err
+	}
+	return reply.Found, nil
+}
+
+// crdtValue is the value of a replicated data type a node replies with.
+type crdtValue struct {
+	Type    string   `json:"type"`
+	Count   int64    `json:"count"`
+	Members []string `json:"members"`
+	Value   string   `json:"value"`
+}
+
+// crdt sends an update of, or a read of, the replicated data type under key
+// and returns its value afterwards.
+func (c *Client) crdt(ctx context.Context, msg transport.Message) (crdtValue, bool, error) {
+	reply, err := c.call(ctx, msg)
+	if err != nil || !reply.Found {
+		return crdtValue{}, false, err
+	}
+	var v crdtValue
+	return v, true, json.Unmarshal([]byte(reply.Content), &v)
+}
+
+// Incr adds delta, which may be negative, to the counter under key and
+// returns its value afterwards. Increments made through different nodes
+// while the cluster is partitioned all count once it heals.
+func (c *Client) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	v, _, err := c.crdt(ctx, transport.Message{Type: "update", Key: key, Content: "incr", Value: strconv.FormatInt(delta, 10)})
+	return v.Count, err
+}
+
+// Counter returns the value of the counter under key, zero if it is
+// missing.
+func (c *Client) Counter(ctx context.Context, key string) (int64, error) {
+	v, _, err := c.crdt(ctx, transport.Message{Type: "crdt_get", Key: key})
+	return v.Count, err
+}
+
+// SAdd adds members to the set under key.
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) error {
+	data, _ := json.Marshal(members)
+	_, _, err := c.crdt(ctx, transport.Message{Type: "update", Key: key, Content: "sadd", Value: string(data)})
+	return err
+}
+
+// SRem removes members from the set under key. An add made concurrently
+// elsewhere wins over the remove.
+func (c *Client) SRem(ctx context.Context, key string, members ...string) error {
+	data, _ := json.Marshal(members)
+	_, _, err := c.crdt(ctx, transport.Message{Type: "update", Key: key, Content: "srem", Value: string(data)})
+	return err
+}
+
+// Members returns the members of the set under key, sorted.
+func (c *Client) Members(ctx context.Context, key string) ([]string, error) {
+	v, _, err := c.crdt(ctx, transport.Message{Type: "crdt_get", Key: key})
+	return v.Members, err
+}
+
+// SetRegister writes value to the last-writer-wins register under key.
+func (c *Client) SetRegister(ctx context.Context, key, value string) error {
+	_, _, err := c.crdt(ctx, transport.Message{Type: "update", Key: key, Content: "rset", Value: value})
+	return err
+}
+
+// Register returns the value of the register under key and whether it
+// exists.
+func (c *Client) Register(ctx context.Context, key string) (string, bool, error) {
+	v, found, err := c.crdt(ctx, transport.Message{Type: "crdt_get", Key: key})
+	return v.Value, found, err
+}
+
+// SubmitTask runs a task of taskType on the connected node and returns its
+// result. A handler error is returned as the error.
+func (c *Client) SubmitTask(ctx context.Context, taskType, content string) (string, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "task", TaskType: taskType, Content: content})
+	if err != nil {
+		return "", err
+	}
+	return reply.Content, nil
+}
+
+// SubmitIdempotentTask is SubmitTask with an idempotency key. If the
+// connected node has already run a task with the same key, it returns that
+// task's result instead of running it again, so a task can be resubmitted
+// safely after a timeout or a lost connection. Keys are remembered for the
+// last 10000 tasks per node.
+func (c *Client) SubmitIdempotentTask(ctx context.Context, key, taskType, content string) (string, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "task", TaskType: taskType, Content: content, IdempotencyKey: key})
+	if err != nil {
+		return "", err
+	}
+	return reply.Content, nil
+}
+
+// Priority is where a task is placed in the queue of the node running it.
+type Priority string
+
+const (
+	// High priority tasks run before any other queued task, and may take
+	// the worker of a low priority task the leader marked preemptible.
+	High   Priority = "high"
+	Normal Priority = "normal"
+	// Low priority tasks run once no other task is queued.
+	Low Priority = "low"
+)
+
+// SubmitPriorityTask is SubmitTask at a priority.
+func (c *Client) SubmitPriorityTask(ctx context.Context, priority Priority, taskType, content string) (string, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "task", TaskType: taskType, Content: content, Priority: string(priority)})
+	if err != nil {
+		return "", err
+	}
+	return reply.Content, nil
+}
+
+// BatchTask is a task of a batch; Key and Priority are optional.
+type BatchTask struct {
+	Type     string `json:"type"`
+	Content  string `json:"content,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+// BatchResult is the outcome of the task at Index of a batch.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	TaskID string `json:"task_id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchSummary is the outcome of a batch, with the results in the batch's
+// order.
+type BatchSummary struct {
+	Tasks     int           `json:"tasks"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// SubmitBatch runs tasks on the connected node's workers in a single
+// request and returns the summary of their results. Tasks that fail are
+// counted in the summary, not returned as the error. The node gives the
+// batch at most 10 seconds, so large batches of slow tasks should be split.
+func (c *Client) SubmitBatch(ctx context.Context, tasks []BatchTask) (BatchSummary, error) {
+	data, err := json.Marshal(tasks)
+	if err != nil {
+		return BatchSummary{}, err
+	}
+	reply, err := c.call(ctx, transport.Message{Type: "batch", Content: string(data)})
+	if err != nil {
+		return BatchSummary{}, err
+	}
+	var summary BatchSummary
+	return summary, json.Unmarshal([]byte(reply.Content), &summary)
+}
+
+// NextID returns a new cluster-wide unique id from the connected node. Ids
+// are roughly ordered by the time they were made; see node.ParseID.
+func (c *Client) NextID(ctx context.Context) (int64, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "next_id"})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(reply.Content, 10, 64)
+}
+
+// Lease is a lock the cluster's leader granted to Owner until Expires. Token
+// is its fencing token, larger than that of every lease granted before it:
+// pass it to what the lock guards, so writes from a holder whose lease ran
+// out can be rejected.
+type Lease struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// lockRetryInterval is how often Lock tries again to take a held lock.
+const lockRetryInterval = 100 * time.Millisecond
+
+// TryLock takes lock name for ttl, failing with ErrLockHeld if someone else
+// holds it. Taking a lock the client holds renews it. Locks are held by the
+// client, so other clients of the same user cannot release them.
+func (c *Client) TryLock(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "lock", Key: name, Value: c.owner, TTL: ttl})
+	if err != nil {
+		if _, holder, ok := strings.Cut(err.Error(), "lock held: "); ok {
+			return Lease{}, fmt.Errorf("%w: %s", ErrLockHeld, holder)
+		}
+		return Lease{}, err
+	}
+	var lease Lease
+	return lease, json.Unmarshal([]byte(reply.Content), &lease)
+}
+
+// Lock takes lock name for ttl, waiting until it is free or ctx ends.
+func (c *Client) Lock(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	for {
+		lease, err := c.TryLock(ctx, name, ttl)
+		if !errors.Is(err, ErrLockHeld) {
+			return lease, err
+		}
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-ctx.Done():
+			return Lease{}, ctx.Err()
+		}
+	}
+}
+
+// Renew extends lease by ttl from now. It fails if the lease ran out or was
+// released.
+func (c *Client) Renew(ctx context.Context, lease Lease, ttl time.Duration) (Lease, error) {
+	reply, err := c.call(ctx, transport.Message{Type: "lock_renew", Key: lease.Name, Content: strconv.FormatUint(lease.Token, 10), TTL: ttl})
+	if err != nil {
+		return Lease{}, err
+	}
+	var renewed Lease
+	return renewed, json.Unmarshal([]byte(reply.Content), &renewed)
+}
+
+// Unlock releases lease. It fails if the lease ran out or was released.
+func (c *Client) Unlock(ctx context.Context, lease Lease) error {
+	_, err := c.call(ctx, transport.Message{Type: "unlock", Key: lease.Name, Content: strconv.FormatUint(lease.Token, 10)})
+	return err
+}
+
+// Change is a write to a watched key.
+type Change struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// Watch subscribes to changes of the keys matching pattern, made on any node
+// of the cluster: a pattern ending in * matches every key with the prefix
+// before it, anything else only that key. Changes are delivered on the
+// returned channel until ctx ends or the connection breaks, when it is
+// closed. Changes must be received promptly, as replies to other requests
+// on the client wait behind them.
+func (c *Client) Watch(ctx context.Context, pattern string) (<-chan Change, error) {
+	id := c.requestID()
+	events := make(chan transport.Message, 64)
+
+	c.mutex.Lock()
+	c.watches[id] = events
+	c.mutex.Unlock()
+
+	if _, err := c.call(ctx, transport.Message{Type: "watch", Key: pattern, RequestID: id}); err != nil {
+		c.mutex.Lock()
+		delete(c.watches, id)
+		c.mutex.Unlock()
+		return nil, err
+	}
+
+	changes := make(chan Change)
+	go func() {
+		defer close(changes)
+		defer func() {
+			c.mutex.Lock()
+			delete(c.watches, id)
+			c.mutex.Unlock()
+		}()
+
+		for {
+			select {
+			case msg := <-events:
+				change := Change{Key: msg.Key, Value: msg.Value, Deleted: msg.Content == "del"}
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					c.unwatch(id)
+					return
+				case <-c.done:
+					return
+				}
+			case <-ctx.Done():
+				c.unwatch(id)
+				return
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// unwatch ends watch id on the node. The reply is not waited for.
+func (c *Client) unwatch(id string) {
+	c.conn.Send(transport.Message{Type: "unwatch", Content: id, RequestID: c.requestID(), Client: true})
+}
+
+// Close closes the connection. Pending requests fail with ErrClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return c.conn.Close()
+}
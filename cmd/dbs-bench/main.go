@@ -0,0 +1,166 @@
+// Command dbs-bench measures message throughput of the node transports over
+// a loopback connection, sending each message with its own write and in
+// batches flushed together, and how fast and compactly each codec encodes
+// and decodes messages.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+func main() {
+	count := flag.Int("n", 100000, "messages to send per run")
+	size := flag.Int("size", 256, "content size of each message in bytes")
+	batch := flag.Int("batch", 64, "messages per flush in batched runs")
+	flag.Parse()
+
+	msg := transport.Message{
+		Type:    "task",
+		From:    1,
+		TaskID:  "3f1c2d9e-8b7a-4c6d-9e5f-1a2b3c4d5e6f",
+		Content: strings.Repeat("x", *size),
+	}
+
+	fmt.Printf("%-16s %6s %12s %12s\n", "protocol", "batch", "msgs/s", "MB/s")
+	for _, t := range []transport.TCP{
+		{Protocol: transport.ProtocolJSON},
+		{Protocol: transport.ProtocolBinary, Codec: transport.CodecJSON},
+		{Protocol: transport.ProtocolBinary, Codec: transport.CodecMsgpack},
+	} {
+		name := t.Protocol
+		if t.Codec != "" {
+			name += "/" + t.Codec
+		}
+		for _, batchSize := range []int{1, *batch} {
+			elapsed, err := run(t, msg, *count, batchSize)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+			rate := float64(*count) / elapsed.Seconds()
+			fmt.Printf("%-16s %6d %12.0f %12.1f\n", name, batchSize, rate, rate*float64(*size)/(1<<20))
+		}
+	}
+
+	fmt.Printf("\n%-8s %-12s %8s %12s %12s\n", "codec", "message", "bytes", "encode ns", "decode ns")
+	for _, name := range transport.CodecNames() {
+		codec, _ := transport.LookupCodec(name)
+		for _, sample := range []struct {
+			name string
+			msg  transport.Message
+		}{{"task", msg}, {"replicate", replicateMessage()}} {
+			bytes, encode, decode, err := measure(codec, sample.msg, *count/10)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%-8s %-12s %8d %12.0f %12.0f\n", name, sample.name, bytes, encode, decode)
+		}
+	}
+}
+
+// replicateMessage returns a message shaped like anti-entropy repairs,
+// with many small entries and version vectors.
+func replicateMessage() transport.Message {
+	entries := make(map[string]transport.Entry)
+	for i := range 50 {
+		entries[fmt.Sprintf("user:%04d", i)] = transport.Entry{
+			Value:     fmt.Sprintf(`{"name":"user %d","age":%d}`, i, 20+i%50),
+			Timestamp: transport.Timestamp{Time: 1700000000000 + uint64(i), Node: i % 3},
+			Version:   transport.VectorClock{1: uint64(i), 2: 7, 3: 12},
+		}
+	}
+	return transport.Message{
+		Type:    "sync_repair",
+		From:    2,
+		Clock:   transport.VectorClock{1: 1042, 2: 998, 3: 1010},
+		Entries: entries,
+	}
+}
+
+// measure encodes and decodes msg count times with codec, and returns the
+// size of its encoding and the average time each took, in nanoseconds.
+func measure(codec transport.Codec, msg transport.Message, count int) (int, float64, float64, error) {
+	count = max(count, 1)
+	var buf []byte
+	var err error
+	start := time.Now()
+	for range count {
+		if buf, err = codec.Append(buf[:0], msg); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	encode := float64(time.Since(start).Nanoseconds()) / float64(count)
+
+	start = time.Now()
+	for range count {
+		var decoded transport.Message
+		if err := codec.Unmarshal(buf, &decoded); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	decode := float64(time.Since(start).Nanoseconds()) / float64(count)
+	return len(buf), encode, decode, nil
+}
+
+// run sends count copies of msg over a loopback connection, flushing every
+// batch messages, and returns how long it took until the last one was
+// received.
+func run(t transport.Transport, msg transport.Message, count, batch int) (time.Duration, error) {
+	received := make(chan error, 1)
+	listener, err := t.Listen("127.0.0.1:0", func(conn transport.Conn) {
+		for i := 0; i < count; i++ {
+			if _, err := conn.Recv(); err != nil {
+				received <- err
+				return
+			}
+		}
+		received <- nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	// The TCP transport's closer is the net.Listener itself
+	addr := listener.(net.Listener).Addr().String()
+	conn, err := t.Dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	batcher, ok := conn.(transport.BatchConn)
+	if !ok && batch > 1 {
+		return 0, fmt.Errorf("connection does not support batching")
+	}
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if batch <= 1 {
+			err = conn.Send(msg)
+		} else if err = batcher.Write(msg); err == nil && (i+1)%batch == 0 {
+			err = batcher.Flush()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if batcher != nil {
+		if err := batcher.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := <-received; err != nil && err != io.EOF {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/mrinalxdev/dbs-pt-1/cli"
+
+func main() {
+	cli.Main()
+}
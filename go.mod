@@ -1,3 +1,17 @@
 module github.com/mrinalxdev/dbs-pt-1
 
-go 1.21.5
+go 1.24.0
+
+require (
+	github.com/chzyer/readline v1.5.1
+	golang.org/x/sys v0.40.0
+	google.golang.org/grpc v1.80.0
+	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/text v0.33.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260120221211-b8f7ae30c516 // indirect
+)
@@ -0,0 +1,303 @@
+// Package harness runs a cluster of nodes inside one process, so
+// multi-node behaviour can be driven and checked from Go code instead of
+// separate terminals:
+//
+//	c, err := harness.New(3, harness.Options{})
+//	if err != nil { ... }
+//	defer c.Close()
+//
+//	id, err := c.Node(1).SendTask(2, "echo", "hello")
+//	msg, err := c.WaitFor(ctx, 1, func(m transport.Message) bool {
+//		return m.Type == "result" && m.TaskID == id
+//	})
+//
+// Nodes are numbered from 1 and talk over an in-memory network unless
+// Options.Loopback asks for real TCP ports, or Options.Unix for Unix domain
+// sockets.
+package harness
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/node"
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// Options configures a cluster.
+type Options struct {
+	// Loopback runs the nodes over TCP on free 127.0.0.1 ports instead of
+	// the in-memory network.
+	Loopback bool
+	// Unix runs the nodes over Unix domain sockets in a temporary
+	// directory, for real connections and wire protocols without opening
+	// network ports.
+	Unix bool
+	// Configure, if set, adjusts each node's config before it is created.
+	Configure func(cfg *node.Config)
+}
+
+// Cluster is a set of connected nodes running in this process.
+type Cluster struct {
+	nodes     map[int]*node.Node
+	recorders map[int]*recorder
+	// dir holds the sockets of a cluster over Unix domain sockets
+	dir string
+}
+
+// New creates n nodes, starts them and connects each pair, returning once
+// every node knows every other one. Node 1 leads the first term. Nodes log
+// errors only and heartbeat every 100ms unless Configure says otherwise.
+func New(n int, opts Options) (*Cluster, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("cluster needs at least one node, got %d", n)
+	}
+
+	memory := transport.NewMemory()
+	c := &Cluster{
+		nodes:     make(map[int]*node.Node, n),
+		recorders: make(map[int]*recorder, n),
+	}
+	if opts.Unix {
+		dir, err := os.MkdirTemp("", "dbs-harness-")
+		if err != nil {
+			return nil, err
+		}
+		c.dir = dir
+	}
+
+	for id := 1; id <= n; id++ {
+		cfg := node.DefaultConfig()
+		cfg.NodeID = id
+		cfg.Master = id == 1
+		cfg.LogLevel = "error"
+		cfg.HeartbeatInterval = 100 * time.Millisecond
+		switch {
+		case opts.Unix:
+			cfg.Transport = node.TransportUnix
+			cfg.Bind = filepath.Join(c.dir, fmt.Sprintf("node-%d.sock", id))
+		case opts.Loopback:
+			cfg.Bind = "127.0.0.1:0"
+		default:
+			cfg.Bind = fmt.Sprintf("node-%d:8000", id)
+			cfg.Network = memory
+		}
+		if opts.Configure != nil {
+			opts.Configure(&cfg)
+		}
+
+		if err := c.start(cfg); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("node %d: %v", id, err)
+		}
+	}
+
+	for id := 2; id <= n; id++ {
+		for peer := 1; peer < id; peer++ {
+			if err := c.nodes[id].Connect(peer, c.nodes[peer].Address); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("connect node %d to node %d: %v", id, peer, err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.WaitConnected(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cluster) start(cfg node.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	n, err := node.NewNode(cfg)
+	if err != nil {
+		return err
+	}
+
+	r := newRecorder()
+	n.OnMessage(r.record)
+	if err := n.Start(); err != nil {
+		return err
+	}
+	c.nodes[cfg.NodeID] = n
+	c.recorders[cfg.NodeID] = r
+	return nil
+}
+
+// Node returns node id, or nil if the cluster has no such node.
+func (c *Cluster) Node(id int) *node.Node {
+	return c.nodes[id]
+}
+
+// Size returns the number of nodes in the cluster.
+func (c *Cluster) Size() int {
+	return len(c.nodes)
+}
+
+// Messages returns the messages delivered to node id's OnMessage handlers
+// so far, oldest first.
+func (c *Cluster) Messages(id int) []transport.Message {
+	r, ok := c.recorders[id]
+	if !ok {
+		return nil
+	}
+	return r.messages()
+}
+
+// WaitFor blocks until a message matching match has been delivered to node
+// id, checking those already delivered first, and returns it.
+func (c *Cluster) WaitFor(ctx context.Context, id int, match func(transport.Message) bool) (transport.Message, error) {
+	r, ok := c.recorders[id]
+	if !ok {
+		return transport.Message{}, fmt.Errorf("no node %d", id)
+	}
+	return r.waitFor(ctx, match)
+}
+
+// WaitConnected blocks until every running node has a connection to every
+// other running node.
+func (c *Cluster) WaitConnected(ctx context.Context) error {
+	return c.Until(ctx, func() bool {
+		for id, n := range c.nodes {
+			peers := n.Status().Peers
+			for other := range c.nodes {
+				if other == id || running(c.nodes[other]) != running(n) {
+					continue
+				}
+				if _, ok := peers[other]; !ok {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// Leader waits until every running node follows the same running leader,
+// and that leader holds its lease, and returns its id.
+func (c *Cluster) Leader(ctx context.Context) (int, error) {
+	leader := -1
+	err := c.Until(ctx, func() bool {
+		leader = -1
+		for id, n := range c.nodes {
+			if !running(n) {
+				continue
+			}
+			status := n.Status()
+			if status.LeaderID < 0 || (leader >= 0 && status.LeaderID != leader) {
+				return false
+			}
+			leader = status.LeaderID
+			if id == leader && !status.Lease {
+				return false
+			}
+		}
+		n, ok := c.nodes[leader]
+		return ok && running(n)
+	})
+	return leader, err
+}
+
+// Until polls cond every 10ms until it holds or ctx ends.
+func (c *Cluster) Until(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Stop shuts node id down, leaving the rest of the cluster running.
+func (c *Cluster) Stop(id int) {
+	if n, ok := c.nodes[id]; ok {
+		n.Shutdown()
+	}
+}
+
+// Close shuts every node down.
+func (c *Cluster) Close() {
+	var wg sync.WaitGroup
+	for _, n := range c.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.Shutdown()
+		}()
+	}
+	wg.Wait()
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
+
+func running(n *node.Node) bool {
+	select {
+	case <-n.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// recorder keeps the messages delivered to one node.
+type recorder struct {
+	mutex   sync.Mutex
+	log     []transport.Message
+	changed chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{changed: make(chan struct{})}
+}
+
+func (r *recorder) record(msg transport.Message) {
+	r.mutex.Lock()
+	r.log = append(r.log, msg)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mutex.Unlock()
+}
+
+func (r *recorder) messages() []transport.Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]transport.Message(nil), r.log...)
+}
+
+func (r *recorder) waitFor(ctx context.Context, match func(transport.Message) bool) (transport.Message, error) {
+	seen := 0
+	for {
+		r.mutex.Lock()
+		pending := r.log[seen:]
+		seen = len(r.log)
+		changed := r.changed
+		r.mutex.Unlock()
+
+		for _, msg := range pending {
+			if match(msg) {
+				return msg, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return transport.Message{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
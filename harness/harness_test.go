@@ -0,0 +1,97 @@
+package harness_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/client"
+	"github.com/mrinalxdev/dbs-pt-1/harness"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+func TestMessagesAreRecorded(t *testing.T) {
+	c, err := harness.New(3, harness.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.Node(1).Send(3, transport.Message{Type: "greeting", Content: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.WaitFor(ctx, 3, func(msg transport.Message) bool {
+		return msg.Type == "greeting"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != 1 || msg.Content != "hello" {
+		t.Errorf("node 3 got %+v, want hello from node 1", msg)
+	}
+	for _, msg := range c.Messages(2) {
+		if msg.Type == "greeting" {
+			t.Errorf("node 2 got the greeting meant for node 3")
+		}
+	}
+}
+
+// TestCodecs runs a cluster whose nodes frame messages with each codec,
+// and one over Unix sockets, and checks a write made through one node
+// reads back through another.
+func TestCodecs(t *testing.T) {
+	cases := map[string]harness.Options{
+		"json lines": {Loopback: true},
+		"unix":       {Unix: true},
+	}
+	for _, name := range transport.CodecNames() {
+		cases["binary "+name] = harness.Options{
+			Loopback: true,
+			Configure: func(cfg *node.Config) {
+				cfg.Protocol = transport.ProtocolBinary
+				cfg.Codec = name
+			},
+		}
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			configure := opts.Configure
+			opts.Configure = func(cfg *node.Config) {
+				cfg.Replication = 3
+				if configure != nil {
+					configure(cfg)
+				}
+			}
+			c, err := harness.New(3, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			dial := func(id int) *client.Client {
+				connect := client.Connect
+				if opts.Unix {
+					connect = client.ConnectUnix
+				}
+				cl, err := connect(c.Node(id).Address)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { cl.Close() })
+				return cl
+			}
+			if err := dial(1).Set(ctx, "greeting", "héllo\nworld"); err != nil {
+				t.Fatal(err)
+			}
+			value, found, err := dial(3).GetConsistency(ctx, "greeting", client.All)
+			if err != nil || !found || value != "héllo\nworld" {
+				t.Errorf("get greeting = %q, %v, %v", value, found, err)
+			}
+		})
+	}
+}
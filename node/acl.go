@@ -0,0 +1,371 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// An access control list limits what peers and clients may ask of a node. A
+// rule grants a subject, a peer written node:<id> or a client written
+// client:<name> (clients name themselves with client.Client.SetUser), one
+// of three levels: read, to read keys and run queries; write, to also write
+// keys and send tasks; and admin, to also define indexes and schedules,
+// preempt tasks and change the list itself. A fourth level, none, denies
+// everything that needs a level. node:* and client:* cover the subjects
+// without a rule of their own, and subjects no rule covers are admins, so a
+// node without rules is open. A rule for <subject>@<namespace> applies to
+// the client requests in that namespace only (see namespace.go), before
+// the subject's own rule. The messages a member needs to
+// stay in the cluster, such as heartbeats, votes, gossip, acks and replies,
+// are always allowed.
+//
+// Rules changed on one node are sent to its peers, which take them only
+// from admins, and to peers that connect later; the newest list wins. A node
+// with a data directory saves its list to acl.json. Subjects are the ids
+// and names messages carry, so the list guards against a worker doing more
+// than it should, not against one posing as another.
+
+const (
+	AccessNone  = "none"
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessAdmin = "admin"
+
+	aclFile = "acl.json"
+	// deniedError prefixes the error of a request the ACL rejects.
+	deniedError = "permission denied"
+)
+
+var errNoRule = errors.New("no rule")
+
+// accessRank orders the access levels.
+var accessRank = map[string]int{AccessNone: 0, AccessRead: 1, AccessWrite: 2, AccessAdmin: 3}
+
+// requiredAccess is the level each message type needs, from peers and
+// clients alike. Types not listed are always allowed.
+var requiredAccess = map[string]string{
+	"get":                AccessRead,
+	"crdt_get":           AccessRead,
+	"read":               AccessRead,
+	"query":              AccessRead,
+	"scan":               AccessRead,
+	"export":             AccessRead,
+	"snapshot_mark":      AccessRead,
+	"watch":              AccessRead,
+	"unwatch":            AccessRead,
+	"events":             AccessRead,
+	"sync_digest":        AccessRead,
+	"sync_keys":          AccessRead,
+	"rebalance_status":   AccessRead,
+	"cluster_config_get": AccessRead,
+	"set":                AccessWrite,
+	"del":                AccessWrite,
+	"update":             AccessWrite,
+	"task":               AccessWrite,
+	"batch":              AccessWrite,
+	"steal_handoff":      AccessWrite,
+	"steal_abort":        AccessWrite,
+	"steal_result":       AccessWrite,
+	"next_id":            AccessWrite,
+	"replicate":          AccessWrite,
+	"hint":               AccessWrite,
+	"sync_repair":        AccessWrite,
+	"tx_prepare":         AccessWrite,
+	"tx_commit":          AccessWrite,
+	"tx_abort":           AccessWrite,
+	"tx_status":          AccessWrite,
+	"schedule_sync":      AccessWrite,
+	"lock":               AccessWrite,
+	"lock_renew":         AccessWrite,
+	"unlock":             AccessWrite,
+	"lock_sync":          AccessWrite,
+	"log_append":         AccessWrite,
+	"log_snapshot":       AccessWrite,
+	"schedule_add":       AccessAdmin,
+	"schedule_del":       AccessAdmin,
+	"index_sync":         AccessAdmin,
+	"preempt":            AccessAdmin,
+	"steal":              AccessAdmin,
+	"acl":                AccessAdmin,
+	"bans":               AccessAdmin,
+	"cluster_config":     AccessAdmin,
+	"cluster_config_set": AccessAdmin,
+	"cluster_config_del": AccessAdmin,
+}
+
+// ParseAccess checks an access level, case-insensitively, and returns it in
+// canonical form.
+func ParseAccess(level string) (string, error) {
+	level = strings.ToLower(level)
+	if _, ok := accessRank[level]; !ok {
+		return "", fmt.Errorf("unknown access level %q: expected none, read, write or admin", level)
+	}
+	return level, nil
+}
+
+// ParseSubject checks an ACL subject: node:<id>, client:<name>, node:* or
+// client:*, optionally followed by @<namespace>.
+func ParseSubject(subject string) (string, error) {
+	base, namespace, scoped := strings.Cut(subject, "@")
+	if scoped {
+		ns, err := ParseNamespace(namespace)
+		if err != nil {
+			return "", err
+		}
+		if ns == "" {
+			// Rules without a namespace are the default namespace's
+			return ParseSubject(base)
+		}
+	}
+	kind, name, _ := strings.Cut(base, ":")
+	switch {
+	case name == "":
+	case kind == "client":
+		return subject, nil
+	case kind == "node":
+		if _, err := strconv.Atoi(name); err == nil || name == "*" {
+			return subject, nil
+		}
+	}
+	return "", fmt.Errorf("invalid subject %q: expected node:<id>, client:<name>, node:* or client:*, optionally followed by @<namespace>", subject)
+}
+
+func peerSubject(id int) string {
+	return "node:" + strconv.Itoa(id)
+}
+
+func clientSubject(user string) string {
+	return "client:" + user
+}
+
+// ACLRules are the rules of an access control list, by subject. Version
+// orders lists changed on different nodes.
+type ACLRules struct {
+	Rules   map[string]string `json:"rules"`
+	Version int64             `json:"version"`
+}
+
+// access returns the level rules grant subject in namespace, "" for the
+// default one.
+func (r ACLRules) access(subject, namespace string) string {
+	kind, _, _ := strings.Cut(subject, ":")
+	candidates := []string{subject, kind + ":*"}
+	if namespace != "" {
+		candidates = append([]string{subject + "@" + namespace, kind + ":*@" + namespace}, candidates...)
+	}
+	for _, candidate := range candidates {
+		if level, ok := r.Rules[candidate]; ok {
+			return level
+		}
+	}
+	return AccessAdmin
+}
+
+// ACL is a node's access control list.
+type ACL struct {
+	mutex sync.RWMutex
+	rules ACLRules
+	path  string
+}
+
+func NewACL() *ACL {
+	return &ACL{rules: ACLRules{Rules: make(map[string]string)}}
+}
+
+// load reads the list saved in dir, if any, and saves it there from now on.
+func (a *ACL) load(dir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.path = filepath.Join(dir, aclFile)
+	data, err := os.ReadFile(a.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rules ACLRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("invalid %s: %v", a.path, err)
+	}
+	if rules.Rules == nil {
+		rules.Rules = make(map[string]string)
+	}
+	a.rules = rules
+	return nil
+}
+
+// save writes the list to its file, if it has one. The caller must hold the
+// mutex.
+func (a *ACL) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// Rules returns a copy of the list.
+func (a *ACL) Rules() ACLRules {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	rules := ACLRules{Rules: make(map[string]string, len(a.rules.Rules)), Version: a.rules.Version}
+	for subject, level := range a.rules.Rules {
+		rules.Rules[subject] = level
+	}
+	return rules
+}
+
+// Access returns the level the list grants subject in namespace, "" for
+// the default one.
+func (a *ACL) Access(subject, namespace string) string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return a.rules.access(subject, namespace)
+}
+
+// replace adopts rules if they are newer than the list and reports whether
+// it did.
+func (a *ACL) replace(rules ACLRules) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if rules.Version <= a.rules.Version {
+		return false, nil
+	}
+	a.rules = rules
+	return true, a.save()
+}
+
+// ACL returns the node's access control list.
+func (n *Node) ACL() ACLRules {
+	return n.acl.Rules()
+}
+
+// SetACL grants subject level on this node and its peers.
+func (n *Node) SetACL(subject, level string) error {
+	subject, err := ParseSubject(subject)
+	if err != nil {
+		return err
+	}
+	if level, err = ParseAccess(level); err != nil {
+		return err
+	}
+	return n.changeACL(func(rules map[string]string) { rules[subject] = level })
+}
+
+// DeleteACL removes the rule for subject on this node and its peers.
+func (n *Node) DeleteACL(subject string) error {
+	rules := n.acl.Rules()
+	if _, ok := rules.Rules[subject]; !ok {
+		return fmt.Errorf("%w for %s", errNoRule, subject)
+	}
+	return n.changeACL(func(rules map[string]string) { delete(rules, subject) })
+}
+
+// changeACL applies change to a copy of the list, adopts it as the newest
+// version and sends it to the peers. Changes that would leave this node
+// unable to change the list on its peers again are refused.
+func (n *Node) changeACL(change func(rules map[string]string)) error {
+	rules := n.acl.Rules()
+	change(rules.Rules)
+	if rules.access(peerSubject(n.ID), "") != AccessAdmin {
+		return fmt.Errorf("node %d would lose admin access and could not change the ACL again; grant %s admin first", n.ID, peerSubject(n.ID))
+	}
+	rules.Version = max(time.Now().UnixNano(), rules.Version+1)
+	if _, err := n.acl.replace(rules); err != nil {
+		return err
+	}
+	n.logger.Info("access control list changed", "rules", len(rules.Rules))
+	data, _ := json.Marshal(rules)
+	n.sendToPeers(CapACL, Message{Type: "acl", From: n.ID, Content: string(data)})
+	return nil
+}
+
+// announceACL sends a newly connected peer the access control list, if it
+// was ever changed.
+func (n *Node) announceACL(peer int) {
+	rules := n.acl.Rules()
+	if rules.Version == 0 || !n.PeerSupports(peer, CapACL) {
+		return
+	}
+	data, _ := json.Marshal(rules)
+	n.sendMessage(peer, Message{Type: "acl", From: n.ID, Content: string(data)})
+}
+
+// handleACL adopts a peer's access control list if it is newer. The peer
+// passed the ACL check for admins already.
+func (n *Node) handleACL(msg Message) {
+	var rules ACLRules
+	if err := json.Unmarshal([]byte(msg.Content), &rules); err != nil || rules.Rules == nil {
+		n.peerLogger(msg.From, msg.Type).Warn("invalid access control list")
+		return
+	}
+	adopted, err := n.acl.replace(rules)
+	if err != nil {
+		n.logger.Error("failed to save the access control list", "err", err)
+	}
+	if adopted {
+		n.peerLogger(msg.From, msg.Type).Info("access control list updated", "rules", len(rules.Rules))
+	}
+}
+
+// permitted checks msg against the access control list, answering it with
+// an error if it is denied.
+func (n *Node) permitted(conn transport.Conn, msg Message) bool {
+	required := requiredAccess[msg.Type]
+	if required == "" {
+		return true
+	}
+	subject, namespace := peerSubject(msg.From), ""
+	if msg.Client {
+		// An invalid namespace is refused by serveClient
+		namespace, _ = ParseNamespace(msg.Namespace)
+		subject = clientSubject(msg.User)
+	}
+	level := n.acl.Access(subject, namespace)
+	if accessRank[level] >= accessRank[required] {
+		return true
+	}
+	if namespace != "" {
+		subject += "@" + namespace
+	}
+
+	n.metrics.MessageDenied(msg.Type)
+	n.peerLogger(msg.From, msg.Type).Warn("access denied", "subject", subject, "access", level, "required", required)
+	reason := fmt.Sprintf("%s: %s has %s access, %s needs %s", deniedError, subject, level, msg.Type, required)
+	reply := Message{Type: "denied", Key: msg.Key, TaskID: msg.TaskID, Error: reason}
+	switch msg.Type {
+	case "get", "set", "del", "update":
+		reply.Type = "kv_result"
+	case "task":
+		reply.Type = "result"
+	}
+	switch {
+	case msg.Client:
+		reply.From, reply.RequestID, reply.Client = n.ID, msg.RequestID, true
+		conn.Send(reply)
+	case reply.Type != "denied" || msg.RequestID != "":
+		n.Reply(msg, reply)
+	}
+	return false
+}
@@ -0,0 +1,563 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// NodeStatus is the /status payload of the admin API.
+type NodeStatus struct {
+	ID       int            `json:"id"`
+	Role     string         `json:"role"`
+	IsMaster bool           `json:"is_master"`
+	State    string         `json:"state"`
+	Term     int            `json:"term"`
+	LeaderID int            `json:"leader_id"`
+	Lease    bool           `json:"lease"`
+	Peers    map[int]string `json:"peers"`
+	Roles    map[int]string `json:"roles"`
+	Versions map[int]int    `json:"versions"`
+	Health   map[int]string `json:"health"`
+	// RTT is the smoothed round-trip time to each peer, in milliseconds.
+	RTT map[int]float64 `json:"rtt_ms"`
+	// Circuits are the peers whose circuit breaker is open or half open.
+	Circuits map[int]string `json:"circuits,omitempty"`
+	Keys     int            `json:"keys"`
+	Queue    int            `json:"queue_depth"`
+	// Parked is how many queued tasks were handed over to an idle node
+	// that has not answered yet; see steal.go.
+	Parked   int            `json:"parked_tasks,omitempty"`
+	Draining bool           `json:"draining,omitempty"`
+	Clock    map[int]uint64 `json:"clock"`
+	// Fsync is the fsync policy of the WAL and data log, and
+	// FsyncInterval how often they are synced under the group policy, in
+	// milliseconds. Both are empty without a data directory.
+	Fsync         string  `json:"fsync,omitempty"`
+	FsyncInterval float64 `json:"fsync_interval_ms,omitempty"`
+	// Log is this node's copy of the log in linearizable mode.
+	Log *LogStatus `json:"log,omitempty"`
+}
+
+type connectRequest struct {
+	ID      int    `json:"id"`
+	Address string `json:"address"`
+}
+
+type sendRequest struct {
+	To      int    `json:"to"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+// StartAdmin serves the HTTP admin API on addr so the node can be driven
+// programmatically instead of through the stdin CLI.
+func (n *Node) StartAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", n.handleStatus)
+	mux.HandleFunc("GET /metrics", n.handleMetrics)
+	mux.HandleFunc("GET /peers", n.handlePeers)
+	mux.HandleFunc("GET /cluster", n.handleCluster)
+	mux.HandleFunc("POST /connect", n.handleConnect)
+	mux.HandleFunc("POST /send", n.handleSend)
+	mux.HandleFunc("POST /submit", n.handleSubmit)
+	mux.HandleFunc("GET /tasks", n.handleTasks)
+	mux.HandleFunc("GET /dlq", n.handleDeadLetters)
+	mux.HandleFunc("POST /dlq/{id}/retry", n.handleRetryDeadLetter)
+	mux.HandleFunc("GET /kv/{key}", n.handleKVGet)
+	mux.HandleFunc("PUT /kv/{key}", n.handleKVSet)
+	mux.HandleFunc("DELETE /kv/{key}", n.handleKVDelete)
+	mux.HandleFunc("GET /hotkeys", n.handleHotKeys)
+	mux.HandleFunc("POST /tx", n.handleTxRequest)
+	mux.HandleFunc("GET /query", n.handleQueryRequest)
+	mux.HandleFunc("GET /scan", n.handleScanRequest)
+	mux.HandleFunc("GET /namespaces", n.handleNamespaces)
+	mux.HandleFunc("POST /blobs", n.handleBlobPut)
+	mux.HandleFunc("GET /blobs/{hash}", n.handleBlobGet)
+	mux.HandleFunc("POST /drain", n.handleDrain)
+	mux.HandleFunc("GET /rebalance", n.handleRebalance)
+	mux.HandleFunc("GET /acl", n.handleACLList)
+	mux.HandleFunc("PUT /acl/{subject}", n.handleACLSet)
+	mux.HandleFunc("DELETE /acl/{subject}", n.handleACLDelete)
+	mux.HandleFunc("GET /config", n.handleOptions)
+	mux.HandleFunc("PUT /config/{option}", n.handleSetOption)
+	mux.HandleFunc("GET /cluster-config", n.handleClusterConfigGet)
+	mux.HandleFunc("PUT /cluster-config/{name}", n.handleClusterConfigSet)
+	mux.HandleFunc("DELETE /cluster-config/{name}", n.handleClusterConfigDelete)
+	mux.HandleFunc("GET /dashboard", n.handleDashboard)
+	mux.HandleFunc("GET /dashboard/data", n.handleDashboardData)
+	mux.HandleFunc("GET /ws", n.handleGateway)
+
+	go func() {
+		n.logger.Info("admin API listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			n.logger.Error("admin API stopped", "err", err)
+		}
+	}()
+}
+
+func (n *Node) Status() NodeStatus {
+	state, term, leaderID := n.electionStatus()
+
+	n.mutex.RLock()
+	peers := make(map[int]string, len(n.Peers))
+	roles := make(map[int]string, len(n.Peers))
+	versions := make(map[int]int, len(n.Peers))
+	for id, addr := range n.Peers {
+		peers[id] = addr
+		roles[id] = n.roleOf(id)
+		if info, ok := n.peerInfo[id]; ok {
+			versions[id] = info.version
+		}
+	}
+	isMaster := n.IsMaster
+	lease := n.hasQuorum()
+	n.mutex.RUnlock()
+
+	health := make(map[int]string)
+	for id, h := range n.detector.Status() {
+		health[id] = h.Status
+	}
+	rtts := make(map[int]float64)
+	for id, rtt := range n.latencies.All() {
+		rtts[id] = float64(rtt.Microseconds()) / 1000
+	}
+	var fsync string
+	var fsyncInterval float64
+	if n.config.DataDir != "" {
+		fsync = n.config.Fsync
+		if fsync == FsyncGroup {
+			fsyncInterval = float64(n.config.FsyncInterval.Microseconds()) / 1000
+		}
+	}
+
+	return NodeStatus{
+		ID:       n.ID,
+		Role:     n.config.Role,
+		IsMaster: isMaster,
+		State:    state,
+		Term:     term,
+		LeaderID: leaderID,
+		Lease:    lease,
+		Peers:    peers,
+		Roles:    roles,
+		Versions: versions,
+		Health:   health,
+		RTT:      rtts,
+		Circuits: n.breakers.States(),
+		Keys:     n.store.Len(),
+		Queue:    n.tasks.Depth(),
+		Parked:   n.steals.Parked(),
+		Draining: n.Draining(),
+		Clock:    n.Clock(),
+
+		Fsync:         fsync,
+		FsyncInterval: fsyncInterval,
+		Log:           n.LogStatus(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+func (n *Node) handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Status().Peers)
+}
+
+func (n *Node) handleCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.ClusterLoad())
+}
+
+func (n *Node) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var req connectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Address == "" {
+		writeError(w, http.StatusBadRequest, "expected {\"id\": <node_id>, \"address\": \"host:port\"}")
+		return
+	}
+	if err := n.Connect(req.ID, req.Address); err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "connected"})
+}
+
+func (n *Node) handleSend(w http.ResponseWriter, r *http.Request) {
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"to\": <node_id>, \"content\": \"...\"}")
+		return
+	}
+
+	n.mutex.RLock()
+	_, connected := n.conn[req.To]
+	n.mutex.RUnlock()
+	if !connected {
+		writeError(w, http.StatusNotFound, "not connected to that node")
+		return
+	}
+
+	if req.Type == "" {
+		req.Type = DefaultTaskType
+	}
+	id, err := n.SendTask(req.To, req.Type, req.Content)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "sent", "task_id": id})
+}
+
+func (n *Node) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"type\": \"...\", \"content\": \"...\"}")
+		return
+	}
+	if req.Type == "" {
+		req.Type = DefaultTaskType
+	}
+
+	id, target, err := n.Submit(req.Type, req.Content)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"status": "sent", "task_id": id, "target": target})
+}
+
+func (n *Node) handleTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.tracker.List())
+}
+
+func (n *Node) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.DeadLetters())
+}
+
+func (n *Node) handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := n.RetryDeadLetter(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errNoDeadLetter):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, map[string]any{"status": "sent", "task_id": id})
+	}
+}
+
+func (n *Node) handleKVGet(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	value, ok := n.store.Get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"key": r.PathValue("key"), "value": value})
+}
+
+func (n *Node) handleKVSet(w http.ResponseWriter, r *http.Request) {
+	if reason := n.refuseKV(Message{Type: "set"}); reason != "" {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+	var body struct {
+		Value string `json:"value"`
+		TTL   string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"value\": \"...\", \"ttl\": \"30s\"} with an optional ttl")
+		return
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", body.TTL))
+			return
+		}
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expires := transport.ExpiresAt(ttl)
+	ts, err := n.store.SetExpiring(key, body.Value, expires)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	n.publishChange(key, Entry{Value: body.Value, Timestamp: ts, Expires: expires})
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (n *Node) handleQueryRequest(w http.ResponseWriter, r *http.Request) {
+	text := r.URL.Query().Get("q")
+	if text == "" {
+		writeError(w, http.StatusBadRequest, "expected a query in the q parameter, e.g. ?q=select * limit 10")
+		return
+	}
+	q, err := ParseQuery(text)
+	if err == nil {
+		err = q.checkRequestKeys()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := n.Query(text)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (n *Node) handleBlobPut(w http.ResponseWriter, r *http.Request) {
+	hash, manifest, err := n.PutBlob(r.Body)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"hash": hash, "size": manifest.Size, "chunks": len(manifest.Chunks)})
+}
+
+// handleBlobGet streams a blob. A chunk that fails once the body has started
+// cuts it short of its Content-Length.
+func (n *Node) handleBlobGet(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	manifest, err := n.BlobInfo(hash)
+	switch {
+	case errors.Is(err, errBlobNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(manifest.Size, 10))
+	if _, err := n.GetBlob(hash, w); err != nil {
+		n.logger.Warn("failed to send blob", "hash", hash, "err", err)
+	}
+}
+
+func (n *Node) handleDrain(w http.ResponseWriter, r *http.Request) {
+	report, err := n.Drain()
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (n *Node) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.RebalanceStatus())
+}
+
+func (n *Node) handleACLList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.ACL())
+}
+
+func (n *Node) handleACLSet(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"level\": \"none|read|write|admin\"}")
+		return
+	}
+	if err := n.SetACL(r.PathValue("subject"), body.Level); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, n.ACL())
+}
+
+func (n *Node) handleACLDelete(w http.ResponseWriter, r *http.Request) {
+	err := n.DeleteACL(r.PathValue("subject"))
+	switch {
+	case errors.Is(err, errNoRule):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, n.ACL())
+	}
+}
+
+func (n *Node) handleOptions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Options())
+}
+
+func (n *Node) handleSetOption(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"value\": \"...\"}")
+		return
+	}
+	if err := n.SetOption(r.PathValue("option"), body.Value); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, n.Options())
+}
+
+// handleClusterConfigGet returns the cluster config as the leader confirms it.
+// With ?after=<revision> it is a watch: it answers with this node's copy
+// once that is newer than revision, or after clusterConfigPoll with
+// whatever it holds.
+func (n *Node) handleClusterConfigGet(w http.ResponseWriter, r *http.Request) {
+	if after := r.URL.Query().Get("after"); after != "" {
+		revision, err := strconv.Atoi(after)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid revision %q", after))
+			return
+		}
+		changed := make(chan struct{}, 1)
+		cancel := n.WatchClusterConfig(func(ClusterConfigChange) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		defer cancel()
+		timeout := time.After(clusterConfigPoll)
+		for n.ClusterConfig().Revision <= revision {
+			select {
+			case <-changed:
+			case <-timeout:
+				writeJSON(w, http.StatusOK, n.ClusterConfig())
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, n.ClusterConfig())
+		return
+	}
+	settings, err := n.ReadClusterConfig()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (n *Node) handleClusterConfigSet(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "expected {\"value\": \"...\"}")
+		return
+	}
+	settings, err := n.SetClusterConfig(r.PathValue("name"), body.Value)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (n *Node) handleClusterConfigDelete(w http.ResponseWriter, r *http.Request) {
+	settings, err := n.DeleteClusterConfig(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (n *Node) handleKVDelete(w http.ResponseWriter, r *http.Request) {
+	if reason := n.refuseKV(Message{Type: "del"}); reason != "" {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ts, ok, err := n.store.Delete(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	n.publishChange(key, Entry{Deleted: true, Timestamp: ts})
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (n *Node) handleTxRequest(w http.ResponseWriter, r *http.Request) {
+	if reason := n.refuseKV(Message{Type: "set"}); reason != "" {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+	var body struct {
+		Ops []struct {
+			Op    string `json:"op"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+			TTL   string `json:"ttl"`
+		} `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Ops) == 0 {
+		writeError(w, http.StatusBadRequest, "expected {\"ops\": [{\"op\": \"set\", \"key\": \"...\", \"value\": \"...\"}, {\"op\": \"del\", \"key\": \"...\"}]}")
+		return
+	}
+	ops := make([]TxOp, 0, len(body.Ops))
+	for _, op := range body.Ops {
+		if op.Op != "set" && op.Op != "del" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported op %q: expected set or del", op.Op))
+			return
+		}
+		if err := checkRequestKey(op.Key); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var ttl time.Duration
+		if op.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(op.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", op.TTL))
+				return
+			}
+		}
+		ops = append(ops, TxOp{Op: op.Op, Key: op.Key, Value: op.Value, TTL: ttl})
+	}
+
+	switch err := n.Transaction(ops); {
+	case errors.Is(err, ErrTxAborted):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "committed"})
+	}
+}
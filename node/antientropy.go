@@ -0,0 +1,140 @@
+package node
+
+import (
+	"slices"
+	"time"
+)
+
+const antiEntropyInterval = time.Second * 10
+
+// runAntiEntropy periodically compares this node's data with every peer it
+// shares replicas with, so replicas converge even after missed writes.
+//
+// The exchange takes three messages: sync_digest carries the Merkle tree of
+// the keys both nodes replicate, sync_keys answers with the peer's entries
+// in the buckets that differ, and sync_repair sends back the entries the
+// peer is missing or holds stale.
+func (n *Node) runAntiEntropy() {
+	if !holdsData(n.config.Role) {
+		return
+	}
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		if n.maxReplication() < 2 && len(n.observers()) == 0 {
+			continue
+		}
+
+		n.mutex.RLock()
+		ids := make([]int, 0, len(n.conn))
+		for id := range n.conn {
+			ids = append(ids, id)
+		}
+		n.mutex.RUnlock()
+
+		for _, id := range ids {
+			if n.available(id) && holdsData(n.PeerRole(id)) {
+				n.sendMessage(id, Message{
+					Type:   "sync_digest",
+					From:   n.ID,
+					Hashes: BuildMerkleTree(n.sharedData(id, nil)),
+				})
+			}
+		}
+	}
+}
+
+// sharedData returns the entries held here, tombstones included, that peer
+// also keeps a copy of (see replicates), limited to the given Merkle buckets
+// unless buckets is nil.
+func (n *Node) sharedData(peer int, buckets []int) map[string]Entry {
+	shared := make(map[string]Entry)
+	for key, e := range n.store.Entries() {
+		if buckets != nil && !slices.Contains(buckets, merkleBucket(key)) {
+			continue
+		}
+		if n.replicates(n.ID, key) && n.replicates(peer, key) {
+			shared[key] = e
+		}
+	}
+	return shared
+}
+
+func (n *Node) handleSyncDigest(msg Message) {
+	buckets := BuildMerkleTree(n.sharedData(msg.From, nil)).Diff(msg.Hashes)
+	if len(buckets) == 0 {
+		return
+	}
+
+	n.sendMessage(msg.From, Message{
+		Type:    "sync_keys",
+		From:    n.ID,
+		Buckets: buckets,
+		Entries: n.sharedData(msg.From, buckets),
+	})
+}
+
+// handleSyncKeys reconciles a peer's entries with ours. For every key the
+// entry with the later timestamp wins, wherever it is, or versioned entries
+// are merged: ours are sent back to the peer when they hold a write it lacks
+// or are missing there, and theirs are merged here otherwise.
+func (n *Node) handleSyncKeys(msg Message) {
+	local := n.sharedData(msg.From, msg.Buckets)
+	repair := make(map[string]Entry)
+	repaired := 0
+
+	for key, ours := range local {
+		theirs, ok := msg.Entries[key]
+		if !ok || supersedes(ours, theirs) {
+			repair[key] = ours
+		}
+	}
+	for key, theirs := range msg.Entries {
+		if n.merge(msg.From, key, theirs) {
+			repaired++
+		}
+	}
+
+	n.recordRepairs(msg.From, repaired)
+	if len(repair) > 0 {
+		n.sendMessage(msg.From, Message{
+			Type:    "sync_repair",
+			From:    n.ID,
+			Entries: repair,
+		})
+	}
+}
+
+func (n *Node) handleSyncRepair(msg Message) {
+	repaired := 0
+	for key, e := range msg.Entries {
+		if n.merge(msg.From, key, e) {
+			repaired++
+		}
+	}
+	n.recordRepairs(msg.From, repaired)
+}
+
+// merge merges an entry peer sent into the store and reports whether it was
+// applied, logging a write that failed.
+func (n *Node) merge(peer int, key string, e Entry) bool {
+	applied, err := n.store.Merge(key, e)
+	if err != nil {
+		n.peerLogger(peer, "").Error("failed to store repaired key", "key", key, "err", err)
+	}
+	return applied
+}
+
+func (n *Node) recordRepairs(peer, count int) {
+	if count == 0 {
+		return
+	}
+	n.metrics.KeysRepaired(count)
+	n.peerLogger(peer, "").Info("repaired divergent keys", "keys", count)
+}
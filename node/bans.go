@@ -0,0 +1,242 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Evicting a node removes it from the cluster by hand, e.g. one that keeps
+// flapping or was decommissioned without leaving. Every member drops its
+// connection to the node and forgets it as if it had left, and refuses its
+// handshakes, and does not dial it, until it is unbanned; messages it still
+// gets through, e.g. over UDP, are dropped.
+//
+// The ban list is sent to the peers when it changes and to peers that
+// connect later. Each node's entry is kept even once it is unbanned, so
+// lists changed on different nodes merge entry by entry, the latest change
+// winning. A node with a data directory saves its list to bans.json.
+
+const bansFile = "bans.json"
+
+var (
+	errBanned    = errors.New("banned from the cluster")
+	errNotBanned = errors.New("not banned")
+)
+
+// Ban is the latest eviction or unban of Node.
+type Ban struct {
+	Node    int       `json:"node"`
+	Banned  bool      `json:"banned"`
+	Changed time.Time `json:"changed"`
+}
+
+// BanList is a node's copy of the cluster's ban list.
+type BanList struct {
+	mutex sync.RWMutex
+	bans  map[int]Ban
+	path  string
+}
+
+func NewBanList() *BanList {
+	return &BanList{bans: make(map[int]Ban)}
+}
+
+// load reads the list saved in dir, if any, and saves it there from now on.
+func (b *BanList) load(dir string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.path = filepath.Join(dir, bansFile)
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("invalid %s: %v", b.path, err)
+	}
+	for _, ban := range bans {
+		b.bans[ban.Node] = ban
+	}
+	return nil
+}
+
+// save writes the list to its file, if it has one. The caller must hold the
+// mutex.
+func (b *BanList) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// entries returns every entry, unbans included, sorted by node. The caller
+// must hold the mutex.
+func (b *BanList) entries() []Ban {
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Node < bans[j].Node })
+	return bans
+}
+
+// marshal returns every entry encoded for a bans message.
+func (b *BanList) marshal() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	data, _ := json.Marshal(b.entries())
+	return string(data)
+}
+
+// Banned reports whether node id is banned.
+func (b *BanList) Banned(id int) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.bans[id].Banned
+}
+
+// List returns the banned nodes, sorted.
+func (b *BanList) List() []Ban {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var bans []Ban
+	for _, ban := range b.entries() {
+		if ban.Banned {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// change bans or unbans node id, returning an error if that changes
+// nothing.
+func (b *BanList) change(id int, banned bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	old := b.bans[id]
+	if old.Banned == banned {
+		if banned {
+			return fmt.Errorf("node %d is already %w", id, errBanned)
+		}
+		return fmt.Errorf("node %d is %w", id, errNotBanned)
+	}
+	changed := time.Now()
+	if !changed.After(old.Changed) {
+		changed = old.Changed.Add(time.Nanosecond)
+	}
+	b.bans[id] = Ban{Node: id, Banned: banned, Changed: changed}
+	return b.save()
+}
+
+// merge adopts the entries of bans newer than the list's and returns the
+// nodes they ban.
+func (b *BanList) merge(bans []Ban) ([]int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var banned []int
+	changed := false
+	for _, ban := range bans {
+		if !ban.Changed.After(b.bans[ban.Node].Changed) {
+			continue
+		}
+		b.bans[ban.Node] = ban
+		changed = true
+		if ban.Banned {
+			banned = append(banned, ban.Node)
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return banned, b.save()
+}
+
+// Bans returns the nodes banned from the cluster, sorted.
+func (n *Node) Bans() []Ban {
+	return n.bans.List()
+}
+
+// Evict removes node id from the cluster: this node and its peers drop
+// their connections to it, forget it, and refuse it until it is unbanned.
+func (n *Node) Evict(id int) error {
+	if id == n.ID {
+		return fmt.Errorf("node %d cannot evict itself; use shutdown", n.ID)
+	}
+	if err := n.bans.change(id, true); err != nil {
+		return err
+	}
+	n.evictPeer(id)
+	n.sendToPeers(CapBans, Message{Type: "bans", From: n.ID, Content: n.bans.marshal()})
+	return nil
+}
+
+// Unban lets node id rejoin the cluster, on this node and its peers. It is
+// not dialed again until it, or a peer, connects.
+func (n *Node) Unban(id int) error {
+	if err := n.bans.change(id, false); err != nil {
+		return err
+	}
+	n.peerLogger(id, "").Info("node unbanned")
+	n.sendToPeers(CapBans, Message{Type: "bans", From: n.ID, Content: n.bans.marshal()})
+	return nil
+}
+
+// evictPeer forgets a banned peer and closes the connection to it.
+func (n *Node) evictPeer(id int) {
+	if id == n.ID {
+		return
+	}
+	n.removePeer(id)
+	n.peerLogger(id, "").Warn("node evicted")
+}
+
+// announceBans sends a newly connected peer the ban list, if it has
+// entries.
+func (n *Node) announceBans(peer int) {
+	if !n.PeerSupports(peer, CapBans) {
+		return
+	}
+	if content := n.bans.marshal(); content != "[]" {
+		n.sendMessage(peer, Message{Type: "bans", From: n.ID, Content: content})
+	}
+}
+
+// handleBans merges a peer's ban list and evicts the nodes it newly bans.
+// The peer passed the ACL check for admins already.
+func (n *Node) handleBans(msg Message) {
+	var bans []Ban
+	if err := json.Unmarshal([]byte(msg.Content), &bans); err != nil {
+		n.peerLogger(msg.From, msg.Type).Warn("invalid ban list", "err", err)
+		return
+	}
+	banned, err := n.bans.merge(bans)
+	if err != nil {
+		n.logger.Error("failed to save the ban list", "err", err)
+	}
+	for _, id := range banned {
+		n.evictPeer(id)
+	}
+}
@@ -0,0 +1,173 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A batch carries many tasks to a node in a single message, which runs them
+// on its workers and answers with a single summary of their results, so
+// bulk workloads do not pay for a message, an ack and a result per task.
+// The tasks of a batch run concurrently, at most as many at a time as the
+// node has workers, so a batch larger than the task queue does not
+// overflow it, and each is queued at its own priority. A batch is not sent
+// reliably: if the node does not answer in time, the tasks it already ran
+// are not known, so tasks that must not run twice should carry an
+// idempotency key.
+
+// maxBatchTasks bounds the tasks of a batch.
+const maxBatchTasks = 10000
+
+// BatchTask is a task of a batch.
+type BatchTask struct {
+	Type    string `json:"type"`
+	Content string `json:"content,omitempty"`
+	// Key is the task's idempotency key; see SendIdempotentTask.
+	Key      string `json:"key,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+// BatchResult is the outcome of the task at Index of a batch.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	TaskID string `json:"task_id"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchSummary is the outcome of a batch: how many of its tasks succeeded
+// and failed, each one's result, in the batch's order, and how long the
+// batch took on the node that ran it.
+type BatchSummary struct {
+	Tasks     int           `json:"tasks"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// validBatch checks the size of a batch and the types of its tasks.
+func validBatch(tasks []BatchTask) error {
+	if len(tasks) == 0 {
+		return errors.New("empty batch")
+	}
+	if len(tasks) > maxBatchTasks {
+		return fmt.Errorf("batch of %d tasks is over the limit of %d", len(tasks), maxBatchTasks)
+	}
+	for i, task := range tasks {
+		if task.Type == "" {
+			return fmt.Errorf("task %d of the batch has no type", i+1)
+		}
+	}
+	return nil
+}
+
+// SendBatch runs tasks on node targetID, this node included, and returns
+// the summary of their results once all of them finished, or an error if
+// the batch was not run or did not finish within timeout.
+func (n *Node) SendBatch(targetID int, tasks []BatchTask, timeout time.Duration) (BatchSummary, error) {
+	if err := validBatch(tasks); err != nil {
+		return BatchSummary{}, err
+	}
+	if targetID == n.ID {
+		ctx, cancel := context.WithTimeout(n.ctx, timeout)
+		defer cancel()
+		return n.runBatch(ctx, tasks, Message{From: n.ID}), nil
+	}
+	if !n.PeerSupports(targetID, CapBatch) {
+		return BatchSummary{}, fmt.Errorf("node %d does not support batches", targetID)
+	}
+
+	data, _ := json.Marshal(tasks)
+	reply, err := n.Call(targetID, Message{Type: "batch", Content: string(data)}, timeout)
+	if err != nil {
+		return BatchSummary{}, err
+	}
+	var summary BatchSummary
+	if err := json.Unmarshal([]byte(reply.Content), &summary); err != nil {
+		return BatchSummary{}, fmt.Errorf("invalid batch summary from node %d: %v", targetID, err)
+	}
+	return summary, nil
+}
+
+// handleBatch runs the tasks of a batch a peer sent and answers with their
+// summary.
+func (n *Node) handleBatch(ctx context.Context, msg Message) {
+	var tasks []BatchTask
+	if err := json.Unmarshal([]byte(msg.Content), &tasks); err != nil {
+		n.Reply(msg, Message{Type: "batch_result", Error: fmt.Sprintf("invalid batch: %v", err)})
+		return
+	}
+	if err := validBatch(tasks); err != nil {
+		n.Reply(msg, Message{Type: "batch_result", Error: err.Error()})
+		return
+	}
+	ctx, cancel := requestContext(ctx, msg)
+	defer cancel()
+
+	data, _ := json.Marshal(n.runBatch(ctx, tasks, msg))
+	n.Reply(msg, Message{Type: "batch_result", Content: string(data)})
+}
+
+// clientBatch serves a batch from a client.
+func (n *Node) clientBatch(ctx context.Context, msg Message) Message {
+	var tasks []BatchTask
+	if err := json.Unmarshal([]byte(msg.Content), &tasks); err != nil {
+		return Message{Type: "batch_result", Error: fmt.Sprintf("invalid batch: %v", err)}
+	}
+	if err := validBatch(tasks); err != nil {
+		return Message{Type: "batch_result", Error: err.Error()}
+	}
+	data, _ := json.Marshal(n.runBatch(ctx, tasks, msg))
+	return Message{Type: "batch_result", Content: string(data)}
+}
+
+// runBatch queues the tasks of a batch, received in msg, on this node's
+// workers, no more at a time than there are workers, and waits for their
+// results. Tasks not yet queued when ctx ends fail without running.
+func (n *Node) runBatch(ctx context.Context, tasks []BatchTask, msg Message) BatchSummary {
+	start := time.Now()
+	n.logger.Info("running batch", "from", msg.From, "tasks", len(tasks))
+	summary := BatchSummary{Tasks: len(tasks), Results: make([]BatchResult, len(tasks))}
+
+	slots := make(chan struct{}, n.config.Workers)
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			summary.Results[i] = BatchResult{Index: i, Error: "task timed out"}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			reply := n.clientTask(ctx, Message{
+				Content:        task.Content,
+				TaskType:       task.Type,
+				IdempotencyKey: task.Key,
+				Priority:       task.Priority,
+				TraceID:        msg.TraceID,
+				SpanID:         msg.SpanID,
+			})
+			summary.Results[i] = BatchResult{Index: i, TaskID: reply.TaskID, Result: reply.Content, Error: reply.Error}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range summary.Results {
+		if result.Error != "" {
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+	}
+	summary.Duration = time.Since(start)
+	n.logger.Info("batch finished", "from", msg.From, "tasks", summary.Tasks, "failed", summary.Failed, "took", summary.Duration)
+	return summary
+}
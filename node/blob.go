@@ -0,0 +1,122 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Blobs are files stored in the key-value store in chunks. Each chunk is
+// stored under its SHA-256 hash, blob:chunk:<hash>, so the ring spreads a
+// blob's chunks over the cluster by hash and replicates them like any key,
+// and a chunk shared by several blobs is stored once. A blob's manifest, the
+// list of its chunks, is stored under the hash of the whole file,
+// blob:<hash>, which is the name the blob is fetched by. Chunks and blobs are
+// checked against their hashes when read back.
+
+const (
+	blobChunkSize = 256 << 10
+	blobPrefix    = "blob:"
+	chunkPrefix   = "blob:chunk:"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobManifest describes a stored blob: its size and the hashes of its
+// chunks, in order.
+type BlobManifest struct {
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// PutBlob stores what r yields as a blob and returns its hash and manifest.
+func (n *Node) PutBlob(r io.Reader) (string, BlobManifest, error) {
+	var manifest BlobManifest
+	whole := sha256.New()
+	buf := make([]byte, blobChunkSize)
+	for {
+		size, err := io.ReadFull(r, buf)
+		if size > 0 {
+			chunk := buf[:size]
+			whole.Write(chunk)
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			value := base64.StdEncoding.EncodeToString(chunk)
+			if _, err := n.kvCall(Message{Type: "set", Key: chunkPrefix + hash, Value: value}); err != nil {
+				return "", BlobManifest{}, fmt.Errorf("chunk %d: %v", len(manifest.Chunks), err)
+			}
+			manifest.Chunks = append(manifest.Chunks, hash)
+			manifest.Size += int64(size)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", BlobManifest{}, err
+		}
+	}
+
+	hash := hex.EncodeToString(whole.Sum(nil))
+	data, _ := json.Marshal(manifest)
+	if _, err := n.kvCall(Message{Type: "set", Key: blobPrefix + hash, Value: string(data)}); err != nil {
+		return "", BlobManifest{}, fmt.Errorf("manifest: %v", err)
+	}
+	n.logger.Info("blob stored", "hash", hash, "size", manifest.Size, "chunks", len(manifest.Chunks))
+	return hash, manifest, nil
+}
+
+// BlobInfo returns the manifest of the blob with hash.
+func (n *Node) BlobInfo(hash string) (BlobManifest, error) {
+	reply, err := n.kvCall(Message{Type: "get", Key: blobPrefix + hash})
+	if err != nil {
+		return BlobManifest{}, err
+	}
+	if !reply.Found {
+		return BlobManifest{}, fmt.Errorf("%w: %s", errBlobNotFound, hash)
+	}
+	var manifest BlobManifest
+	if err := json.Unmarshal([]byte(reply.Value), &manifest); err != nil {
+		return BlobManifest{}, fmt.Errorf("invalid manifest for blob %s: %v", hash, err)
+	}
+	return manifest, nil
+}
+
+// GetBlob writes the blob with hash to w, fetching its chunks in order, and
+// returns its manifest. A chunk that is missing or does not match its hash
+// fails the read, as does a blob that does not match its own.
+func (n *Node) GetBlob(hash string, w io.Writer) (BlobManifest, error) {
+	manifest, err := n.BlobInfo(hash)
+	if err != nil {
+		return BlobManifest{}, err
+	}
+
+	whole := sha256.New()
+	for i, chunkHash := range manifest.Chunks {
+		reply, err := n.kvCall(Message{Type: "get", Key: chunkPrefix + chunkHash})
+		if err != nil {
+			return manifest, fmt.Errorf("chunk %d: %v", i, err)
+		}
+		if !reply.Found {
+			return manifest, fmt.Errorf("chunk %d (%s) is missing", i, chunkHash)
+		}
+		chunk, err := base64.StdEncoding.DecodeString(reply.Value)
+		if err != nil {
+			return manifest, fmt.Errorf("chunk %d (%s) is corrupt: %v", i, chunkHash, err)
+		}
+		if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != chunkHash {
+			return manifest, fmt.Errorf("chunk %d (%s) does not match its hash", i, chunkHash)
+		}
+		whole.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return manifest, err
+		}
+	}
+	if hex.EncodeToString(whole.Sum(nil)) != hash {
+		return manifest, fmt.Errorf("blob %s does not match its hash", hash)
+	}
+	return manifest, nil
+}
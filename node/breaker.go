@@ -0,0 +1,208 @@
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A peer that cannot keep up, because its link is congested or it is
+// overloaded, fills the queue of messages to it, and every request waiting
+// on it slows down with it. Each node samples the outbound queue and write
+// latency of every peer: a peer whose queue stays at least half full, or
+// whose writes take slowWriteLatency or longer, for slow_peer_timeout is a
+// slow consumer, and its circuit breaker opens. While the breaker is open,
+// messages to the peer fail fast with ErrCircuitOpen instead of queueing,
+// except those that keep it in the cluster, such as heartbeats, votes and
+// acks, and the peer counts as unavailable: writes leave a hint for it
+// with a fallback (see hints.go), and reads and tasks go to other nodes.
+// After breakerCooldown the breaker is half open and lets messages through
+// again; if the peer keeps up for a sample it closes, otherwise it opens
+// again.
+
+const (
+	// breakerInterval is how often peers are sampled.
+	breakerInterval = 500 * time.Millisecond
+	// slowWriteLatency is the write latency at which a peer is slow.
+	slowWriteLatency = 200 * time.Millisecond
+	// breakerCooldown is how long a breaker stays open before it lets
+	// messages through again.
+	breakerCooldown = 10 * time.Second
+	// defaultSlowPeerTimeout is how long a peer must stay slow for its
+	// breaker to open.
+	defaultSlowPeerTimeout = 5 * time.Second
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// breakerExempt are the message types sent whatever a peer's breaker says.
+var breakerExempt = map[string]bool{
+	"heartbeat":     true,
+	"heartbeat_ack": true,
+	"alive":         true,
+	"ack":           true,
+	"ping":          true,
+	"pong":          true,
+	"request_vote":  true,
+	"vote":          true,
+	"gossip":        true,
+	"leaving":       true,
+	"node_down":     true,
+	"draining":      true,
+}
+
+// breaker is the circuit breaker of one peer.
+type breaker struct {
+	state string
+	// slowSince is when the peer's current run of slow samples started, or
+	// zero if the last sample was not slow.
+	slowSince time.Time
+	// changed is when the breaker last changed state.
+	changed time.Time
+}
+
+// Breakers are the circuit breakers of a node's peers.
+type Breakers struct {
+	mutex sync.Mutex
+	peers map[int]*breaker
+}
+
+func NewBreakers() *Breakers {
+	return &Breakers{peers: make(map[int]*breaker)}
+}
+
+// open reports whether peer id's breaker is open.
+func (b *Breakers) open(id int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	br, ok := b.peers[id]
+	return ok && br.state == CircuitOpen
+}
+
+// sample records whether peer id was slow at now, a peer slow for timeout
+// opening its breaker, and returns the breaker's state before and after.
+func (b *Breakers) sample(id int, slow bool, now time.Time, timeout time.Duration) (before, after string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	br, ok := b.peers[id]
+	if !ok {
+		br = &breaker{state: CircuitClosed, changed: now}
+		b.peers[id] = br
+	}
+	before = br.state
+	switch {
+	case !slow:
+		br.slowSince = time.Time{}
+	case br.slowSince.IsZero():
+		br.slowSince = now
+	}
+
+	switch br.state {
+	case CircuitClosed:
+		if slow && now.Sub(br.slowSince) >= timeout {
+			br.state = CircuitOpen
+		}
+	case CircuitOpen:
+		if now.Sub(br.changed) >= breakerCooldown {
+			br.state = CircuitHalfOpen
+		}
+	case CircuitHalfOpen:
+		if slow {
+			br.state = CircuitOpen
+		} else {
+			br.state = CircuitClosed
+		}
+	}
+	if br.state != before {
+		br.changed = now
+	}
+	return before, br.state
+}
+
+// forget drops the breakers of peers not in known.
+func (b *Breakers) forget(known map[int]string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for id := range b.peers {
+		if _, ok := known[id]; !ok {
+			delete(b.peers, id)
+		}
+	}
+}
+
+// States returns the state of every breaker that is not closed.
+func (b *Breakers) States() map[int]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	states := make(map[int]string)
+	for id, br := range b.peers {
+		if br.state != CircuitClosed {
+			states[id] = br.state
+		}
+	}
+	return states
+}
+
+// runBreakers samples every peer each breakerInterval and trips or resets
+// its breaker.
+func (n *Node) runBreakers() {
+	ticker := time.NewTicker(breakerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		if n.config.SlowPeerTimeout <= 0 {
+			continue
+		}
+
+		// A breaker outlives the peer's connection, as a slow peer is no
+		// faster for reconnecting, until the peer leaves
+		n.mutex.RLock()
+		outboxes := make(map[int]*outbox, len(n.conn))
+		for id, conn := range n.conn {
+			if o, ok := conn.(*outbox); ok {
+				outboxes[id] = o
+			}
+		}
+		n.breakers.forget(n.Peers)
+		n.mutex.RUnlock()
+
+		ids := make([]int, 0, len(outboxes))
+		for id := range outboxes {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		now := time.Now()
+		for _, id := range ids {
+			o := outboxes[id]
+			queued, latency := o.Len(), o.writeLatency()
+			slow := queued >= max(cap(o.queue)/2, 1) || latency >= slowWriteLatency
+			before, after := n.breakers.sample(id, slow, now, n.config.SlowPeerTimeout)
+			if before == after {
+				continue
+			}
+			logger := n.peerLogger(id, "").With("queued", queued, "write_latency", latency.Round(time.Millisecond))
+			switch after {
+			case CircuitOpen:
+				n.metrics.CircuitOpened()
+				logger.Warn("peer is a slow consumer, opened its circuit breaker")
+			case CircuitHalfOpen:
+				logger.Info("circuit breaker half open, trying peer again")
+			case CircuitClosed:
+				logger.Info("peer keeps up again, closed its circuit breaker")
+			}
+		}
+	}
+}
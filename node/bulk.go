@@ -0,0 +1,424 @@
+package node
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bulk export streams every key in the cluster in key order. Each node on
+// the ring is asked, a page at a time, for the keys it coordinates, and the
+// pages are merged, so every key is read once, from the node that serves
+// it. An export can be resumed after the last key written. Bulk import
+// writes each record through its key's coordinator, several at a time.
+// Index entries are left out of exports; imports recreate them.
+
+const (
+	// FormatJSONL is one {"key": ..., "value": ...} object per line, with
+	// "expires" in Unix milliseconds for keys that expire.
+	FormatJSONL = "jsonl"
+	// FormatCSV is key,value[,expires] rows under a key,value,expires
+	// header.
+	FormatCSV = "csv"
+
+	// exportPageSize is how many keys a node returns per export page.
+	exportPageSize = 1000
+	// importWorkers is how many records an import writes at once.
+	importWorkers = 16
+	// maxRecordLine bounds a JSONL line.
+	maxRecordLine = 64 << 20
+)
+
+// Record is a key and value in a bulk import or export.
+type Record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Expires, if not zero, is when the key expires, in Unix milliseconds.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// FormatOf returns the bulk format of a file by its extension.
+func FormatOf(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"):
+		return FormatJSONL, nil
+	case strings.HasSuffix(path, ".csv"):
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("unknown format of %s: use a .jsonl or .csv file", path)
+}
+
+// exportRequest asks a node for a page of the keys it serves.
+type exportRequest struct {
+	After string `json:"after"`
+	Limit int    `json:"limit"`
+	// Down are the nodes the exporting node considers unavailable; their
+	// keys are served by the next replica.
+	Down []int `json:"down,omitempty"`
+}
+
+// exportPage returns up to req.Limit of the live keys after req.After that
+// this node serves, in key order, and whether there are more.
+func (n *Node) exportPage(req exportRequest) (map[string]Entry, bool) {
+	now := time.Now()
+	serves := func(key string) bool {
+		if key <= req.After || strings.HasPrefix(key, indexKeyPrefix) {
+			return false
+		}
+		for _, id := range n.replicas(key) {
+			if !slices.Contains(req.Down, id) {
+				return id == n.ID
+			}
+		}
+		return false
+	}
+	entries := n.store.Matching(serves)
+	keys := make([]string, 0, len(entries))
+	for key, e := range entries {
+		if e.Deleted || e.Expired(now) {
+			delete(entries, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) <= req.Limit {
+		return entries, false
+	}
+	for _, key := range keys[req.Limit:] {
+		delete(entries, key)
+	}
+	return entries, true
+}
+
+func (n *Node) handleExport(msg Message) {
+	var req exportRequest
+	if err := json.Unmarshal([]byte(msg.Content), &req); err != nil || req.Limit <= 0 {
+		n.Reply(msg, Message{Type: "export_page", Error: "invalid export request"})
+		return
+	}
+	entries, more := n.exportPage(req)
+	n.Reply(msg, Message{Type: "export_page", Entries: entries, Found: more})
+}
+
+// partitionCursor walks the keys one node serves, a page at a time.
+type partitionCursor struct {
+	node    int
+	after   string
+	buffer  []Record
+	more    bool
+	fetched bool
+}
+
+// fill fetches the cursor's next page if its buffer is empty.
+func (n *Node) fill(c *partitionCursor, down []int) error {
+	if len(c.buffer) > 0 || (c.fetched && !c.more) {
+		return nil
+	}
+	req := exportRequest{After: c.after, Limit: exportPageSize, Down: down}
+	var entries map[string]Entry
+	if c.node == n.ID {
+		entries, c.more = n.exportPage(req)
+	} else {
+		data, _ := json.Marshal(req)
+		reply, err := n.Call(c.node, Message{Type: "export", Content: string(data)}, queryTimeout)
+		if err != nil {
+			return err
+		}
+		entries, c.more = reply.Entries, reply.Found
+	}
+	c.fetched = true
+	for key, e := range entries {
+		c.buffer = append(c.buffer, Record{Key: key, Value: e.Value, Expires: e.Expires})
+	}
+	sort.Slice(c.buffer, func(i, j int) bool { return c.buffer[i].Key < c.buffer[j].Key })
+	if len(c.buffer) > 0 {
+		c.after = c.buffer[len(c.buffer)-1].Key
+	}
+	return nil
+}
+
+// Export writes every key after the key after ("" for all of them) to w in
+// format, in key order. After every page of keys, once they are all written
+// to w, it calls checkpoint with the last key written and how many keys it
+// wrote so far, so an interrupted export can be resumed from there. It
+// fails if a node serving some keys cannot be reached.
+func (n *Node) Export(w io.Writer, format, after string, checkpoint func(last string, count int)) error {
+	var down []int
+	var cursors []*partitionCursor
+	for _, id := range n.ring.Nodes() {
+		if !n.available(id) {
+			down = append(down, id)
+			continue
+		}
+		if !n.PeerSupports(id, CapBulk) {
+			return fmt.Errorf("node %d does not support exports", id)
+		}
+		cursors = append(cursors, &partitionCursor{node: id, after: after})
+	}
+
+	out := newRecordWriter(w, format)
+	if after == "" {
+		if err := out.header(); err != nil {
+			return err
+		}
+	}
+	count := 0
+	save := func() error {
+		if err := out.flush(); err != nil {
+			return err
+		}
+		if checkpoint != nil && count > 0 {
+			checkpoint(after, count)
+		}
+		return nil
+	}
+	for {
+		var next *partitionCursor
+		for _, c := range cursors {
+			if err := n.fill(c, down); err != nil {
+				return fmt.Errorf("export from node %d: %v", c.node, err)
+			}
+			if len(c.buffer) > 0 && (next == nil || c.buffer[0].Key < next.buffer[0].Key) {
+				next = c
+			}
+		}
+		if next == nil {
+			return save()
+		}
+		record := next.buffer[0]
+		next.buffer = next.buffer[1:]
+		if err := out.write(record); err != nil {
+			return err
+		}
+		after = record.Key
+		if count++; count%exportPageSize == 0 {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recordWriter writes records in a bulk format.
+type recordWriter struct {
+	buf *bufio.Writer
+	csv *csv.Writer
+}
+
+func newRecordWriter(w io.Writer, format string) *recordWriter {
+	out := &recordWriter{buf: bufio.NewWriter(w)}
+	if format == FormatCSV {
+		out.csv = csv.NewWriter(out.buf)
+	}
+	return out
+}
+
+func (w *recordWriter) header() error {
+	if w.csv != nil {
+		return w.csv.Write([]string{"key", "value", "expires"})
+	}
+	return nil
+}
+
+func (w *recordWriter) write(r Record) error {
+	if w.csv != nil {
+		expires := ""
+		if r.Expires != 0 {
+			expires = strconv.FormatInt(r.Expires, 10)
+		}
+		return w.csv.Write([]string{r.Key, r.Value, expires})
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.buf.Write(data)
+	return w.buf.WriteByte('\n')
+}
+
+func (w *recordWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// recordReader reads records in a bulk format.
+type recordReader struct {
+	lines *bufio.Scanner
+	csv   *csv.Reader
+	line  int
+}
+
+func newRecordReader(r io.Reader, format string) *recordReader {
+	in := &recordReader{}
+	if format == FormatCSV {
+		in.csv = csv.NewReader(r)
+		in.csv.FieldsPerRecord = -1
+	} else {
+		in.lines = bufio.NewScanner(r)
+		in.lines.Buffer(nil, maxRecordLine)
+	}
+	return in
+}
+
+// next returns the next record and its line (or CSV row) number, skipping
+// blank lines and a CSV header. It returns io.EOF at the end.
+func (r *recordReader) next() (Record, int, error) {
+	for {
+		r.line++
+		if r.csv != nil {
+			row, err := r.csv.Read()
+			if err != nil {
+				return Record{}, r.line, err
+			}
+			if r.line == 1 && len(row) >= 2 && row[0] == "key" && row[1] == "value" {
+				continue
+			}
+			if len(row) < 2 || len(row) > 3 {
+				return Record{}, r.line, fmt.Errorf("row %d: expected key,value[,expires]", r.line)
+			}
+			record := Record{Key: row[0], Value: row[1]}
+			if len(row) == 3 && row[2] != "" {
+				if record.Expires, err = strconv.ParseInt(row[2], 10, 64); err != nil {
+					return Record{}, r.line, fmt.Errorf("row %d: invalid expires %q", r.line, row[2])
+				}
+			}
+			return record, r.line, nil
+		}
+
+		if !r.lines.Scan() {
+			if err := r.lines.Err(); err != nil {
+				return Record{}, r.line, err
+			}
+			return Record{}, r.line, io.EOF
+		}
+		text := strings.TrimSpace(r.lines.Text())
+		if text == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return Record{}, r.line, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		return record, r.line, nil
+	}
+}
+
+// Import writes the records read from r in format to the cluster, each
+// through its key's coordinator, skipping the first skip lines (or CSV
+// rows). Records that expired already are skipped. done is called with the
+// number of lines before which every record has been written, as it grows,
+// so an interrupted import can be resumed from there. Import stops at the
+// first record that cannot be written and returns how many were.
+func (n *Node) Import(r io.Reader, format string, skip int, done func(line int)) (int, error) {
+	type job struct {
+		record Record
+		line   int
+	}
+	var (
+		jobs     = make(chan job)
+		mutex    sync.Mutex
+		finished = make(map[int]bool)
+		complete = skip
+		imported int
+		failure  error
+		wg       sync.WaitGroup
+	)
+	// finish records that line has been handled and advances complete past
+	// every line handled so far
+	finish := func(line int, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if failure == nil {
+				failure = err
+			}
+			return
+		}
+		finished[line] = true
+		advanced := false
+		for finished[complete+1] {
+			delete(finished, complete+1)
+			complete++
+			advanced = true
+		}
+		if advanced && done != nil {
+			done(complete)
+		}
+	}
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return failure != nil
+	}
+
+	for i := 0; i < importWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if j.record.Key == "" {
+					finish(j.line, nil)
+					continue
+				}
+				msg := Message{Type: "set", Key: j.record.Key, Value: j.record.Value}
+				if j.record.Expires != 0 {
+					msg.TTL = time.Until(time.UnixMilli(j.record.Expires))
+				}
+				_, err := n.kvCall(msg)
+				if err != nil {
+					err = fmt.Errorf("line %d: set %s: %v", j.line, j.record.Key, err)
+				} else {
+					mutex.Lock()
+					imported++
+					mutex.Unlock()
+				}
+				finish(j.line, err)
+			}
+		}()
+	}
+
+	in := newRecordReader(r, format)
+	var readErr error
+	for !failed() {
+		record, line, err := in.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		if line <= skip {
+			continue
+		}
+		if record.Expires != 0 && time.Now().UnixMilli() >= record.Expires {
+			// Already expired: nothing to write, but the line is done
+			record.Key = ""
+		}
+		jobs <- job{record: record, line: line}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failure != nil {
+		return imported, failure
+	}
+	if readErr != nil {
+		return imported, readErr
+	}
+	return imported, nil
+}
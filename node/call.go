@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrCallTimeout is returned by Call when no reply arrives in time.
+	ErrCallTimeout = errors.New("call timed out")
+	// ErrPeerLost is returned by Call when the connection to the target
+	// breaks or the target leaves before it replies.
+	ErrPeerLost = errors.New("connection to peer lost")
+)
+
+// Call sends msg to the peer targetID and waits up to timeout for the reply
+// correlated with it by request id. Built-in requests are answered by the
+// node: a get, set or del with its kv_result and a task with its result.
+// Messages of other types are answered by an OnMessage handler on the
+// target calling Reply. A reply carrying an error is returned along with
+// that error.
+func (n *Node) Call(targetID int, msg Message, timeout time.Duration) (Message, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, timeout)
+	defer cancel()
+
+	reply, err := n.CallContext(ctx, targetID, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reply, fmt.Errorf("%w: no reply from node %d within %v", ErrCallTimeout, targetID, timeout)
+	}
+	return reply, err
+}
+
+// CallContext is Call, waiting for the reply until ctx ends. If ctx has a
+// deadline, the time left is sent along as msg's Timeout, so the target
+// cancels what it does for the call once the caller stops waiting.
+func (n *Node) CallContext(ctx context.Context, targetID int, msg Message) (_ Message, err error) {
+	span := n.startSpan("call", msg)
+	msg = span.stamp(msg)
+	msg.From = n.ID
+	msg.RequestID = newTaskID()
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Timeout = max(time.Until(deadline), time.Millisecond)
+	}
+
+	reply := n.expect(msg.RequestID, 1)
+	defer n.cancelExpect(msg.RequestID)
+	defer func() { span.end("type", msg.Type, "target", targetID, "error", errString(err)) }()
+	lost, unwatch := n.watchLoss(targetID)
+	defer unwatch()
+
+	if err := n.sendMessage(targetID, msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case r := <-reply:
+		if r.Error != "" {
+			return r, fmt.Errorf("node %d: %s", targetID, r.Error)
+		}
+		return r, nil
+	case <-lost:
+		return Message{}, fmt.Errorf("%w: node %d", ErrPeerLost, targetID)
+	case <-n.done:
+		return Message{}, errors.New("node is shutting down")
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("call to node %d: %w", targetID, ctx.Err())
+	}
+}
+
+// requestContext returns the context of serving msg: parent, ended once
+// msg's Timeout has passed if it has one.
+func requestContext(parent context.Context, msg Message) (context.Context, context.CancelFunc) {
+	if msg.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, msg.Timeout)
+}
+
+// Reply answers req, a message received from a peer's Call. A reply without
+// a type is sent as "reply".
+func (n *Node) Reply(req Message, reply Message) error {
+	if reply.Type == "" {
+		reply.Type = "reply"
+	}
+	reply.RequestID = req.RequestID
+	reply.TraceID = req.TraceID
+	return n.Send(req.From, reply)
+}
+
+// errString returns err's message, or "" if it is nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// watchLoss returns a channel closed when the connection to peer id breaks
+// or the peer is removed, and a function to stop watching.
+func (n *Node) watchLoss(id int) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	n.lossMutex.Lock()
+	if n.lossWatchers[id] == nil {
+		n.lossWatchers[id] = make(map[chan struct{}]bool)
+	}
+	n.lossWatchers[id][ch] = true
+	n.lossMutex.Unlock()
+
+	return ch, func() {
+		n.lossMutex.Lock()
+		delete(n.lossWatchers[id], ch)
+		if len(n.lossWatchers[id]) == 0 {
+			delete(n.lossWatchers, id)
+		}
+		n.lossMutex.Unlock()
+	}
+}
+
+// peerLost wakes everyone watching for the loss of peer id.
+func (n *Node) peerLost(id int) {
+	n.lossMutex.Lock()
+	for ch := range n.lossWatchers[id] {
+		close(ch)
+	}
+	delete(n.lossWatchers, id)
+	n.lossMutex.Unlock()
+}
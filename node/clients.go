@@ -0,0 +1,194 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// clientTimeout bounds how long a node works on a client request before
+// replying with an error.
+const clientTimeout = time.Second * 10
+
+// serveClient answers a request from a client connection (see the client
+// package). Unlike peers, clients are not members of the cluster, so the
+// reply goes back on the connection the request arrived on. The request is
+// given up after clientTimeout, the client's own timeout if it is shorter,
+// or when the connection closes.
+func (n *Node) serveClient(ctx context.Context, conn transport.Conn, msg Message) {
+	span := n.startSpan("client."+msg.Type, msg)
+	msg = span.stamp(msg)
+	ctx, cancel := context.WithTimeout(ctx, clientTimeout)
+	defer cancel()
+	ctx, cancelRequest := requestContext(ctx, msg)
+	defer cancelRequest()
+
+	namespace, err := ParseNamespace(msg.Namespace)
+	if err != nil {
+		n.replyClient(conn, msg, Message{Type: "error", Error: err.Error()})
+		span.end("error", err.Error())
+		return
+	}
+	n.metrics.NamespaceRequest(NamespaceLabel(namespace))
+	key := msg.Key
+	if namespacedRequest(msg.Type) {
+		if err := checkRequestKey(key); err != nil {
+			n.replyClient(conn, msg, Message{Type: "kv_result", Key: key, Error: err.Error()})
+			span.end("error", err.Error())
+			return
+		}
+		msg.Key = NamespacedKey(namespace, key)
+	}
+
+	var reply Message
+	switch msg.Type {
+	case "get", "set", "del":
+		reply = n.clientKV(ctx, msg)
+	case "update", "crdt_get":
+		reply = n.clientCRDT(msg)
+	case "task":
+		reply = n.clientTask(ctx, msg)
+	case "batch":
+		reply = n.clientBatch(ctx, msg)
+	case "next_id":
+		reply = Message{Type: "id", Content: strconv.FormatInt(n.NextID(), 10)}
+	case "lock", "lock_renew", "unlock":
+		reply = n.clientLock(msg)
+	case "watch":
+		reply = n.clientWatch(conn, msg)
+	case "events":
+		reply = n.clientEvents(conn, msg)
+	case "unwatch":
+		n.endClientWatch(clientWatchKey{conn: conn, requestID: msg.Content})
+		reply = Message{Type: "unwatch"}
+	default:
+		reply = Message{Type: "error", Error: fmt.Sprintf("unsupported client request %q", msg.Type)}
+	}
+
+	if reply.Key == msg.Key {
+		reply.Key = key
+	}
+	n.replyClient(conn, msg, reply)
+	span.end("error", reply.Error)
+}
+
+// replyClient sends the reply to a client's request msg.
+func (n *Node) replyClient(conn transport.Conn, msg, reply Message) {
+	reply.From = n.ID
+	reply.RequestID = msg.RequestID
+	reply.Client = true
+	reply.TraceID = msg.TraceID
+	if err := conn.Send(reply); err != nil {
+		n.logger.Warn("failed to reply to client", "type", msg.Type, "err", err)
+	}
+}
+
+// namespacedRequest reports whether the key of a client request of type
+// msgType is in the request's namespace.
+func namespacedRequest(msgType string) bool {
+	switch msgType {
+	case "get", "set", "del", "update", "crdt_get":
+		return true
+	}
+	return false
+}
+
+// clientKV serves a get/set/del, waiting for the coordinator's reply if the
+// key is coordinated elsewhere.
+func (n *Node) clientKV(ctx context.Context, msg Message) Message {
+	req := Message{
+		Type:        msg.Type,
+		From:        n.ID,
+		Key:         msg.Key,
+		Value:       msg.Value,
+		Content:     msg.Content,
+		TTL:         msg.TTL,
+		RequestID:   newTaskID(),
+		Consistency: msg.Consistency,
+		Context:     msg.Context,
+		Forwarded:   true,
+		TraceID:     msg.TraceID,
+		SpanID:      msg.SpanID,
+	}
+
+	target := n.kvTarget(req)
+	if target == n.ID {
+		return n.serveKV(req)
+	}
+	n.touchKey(req.Key)
+	if req.Type != "get" {
+		n.hotKeys.invalidate(req.Key)
+	} else if cached, ok := n.cachedGet(req); ok {
+		return cached
+	}
+
+	reply := n.expect(req.RequestID, 1)
+	defer n.cancelExpect(req.RequestID)
+
+	if err := n.sendMessage(target, req); err != nil {
+		return Message{Type: "kv_result", Key: msg.Key, Error: err.Error()}
+	}
+	select {
+	case r := <-reply:
+		if req.Type == "get" {
+			n.cacheGet(req, r)
+		}
+		return r
+	case <-ctx.Done():
+		return Message{Type: "kv_result", Key: msg.Key, Error: fmt.Sprintf("no reply from node %d", target)}
+	}
+}
+
+// clientTask runs a task on this node's worker pool and waits for its
+// result. A task with an idempotency key this node has seen is not run
+// again; the first run's result is returned instead. The handler's context
+// is ctx, so it is cancelled once the request is given up.
+func (n *Node) clientTask(ctx context.Context, msg Message) Message {
+	id := newTaskID()
+	task := Message{
+		Type:           "task",
+		From:           n.ID,
+		Content:        msg.Content,
+		TaskID:         id,
+		TaskType:       msg.TaskType,
+		RequestID:      id,
+		Client:         true,
+		IdempotencyKey: msg.IdempotencyKey,
+		Priority:       msg.Priority,
+		TraceID:        msg.TraceID,
+		SpanID:         msg.SpanID,
+	}
+	if err := n.checkPayload(task); err != nil {
+		result := invalidPayload(err)
+		result.TaskID = id
+		return result
+	}
+	if task.IdempotencyKey != "" {
+		if entry, fresh := n.dedup.begin(task.IdempotencyKey, id); !fresh {
+			n.metrics.TaskDeduplicated()
+			n.logger.Info("skipping duplicate client task", "key", task.IdempotencyKey, "first", entry.taskID)
+			return cachedClientResult(ctx, entry, task)
+		}
+	}
+
+	result := n.expect(id, 1)
+	defer n.cancelExpect(id)
+
+	if err := n.tasks.Enqueue(ctx, task); err != nil {
+		n.dedup.reject(task.IdempotencyKey)
+		reason := err.Error()
+		if err == errQueueFull {
+			reason = fmt.Sprintf("task queue full (%d tasks)", n.tasks.Capacity())
+		}
+		return Message{Type: "result", TaskID: id, Error: reason}
+	}
+	select {
+	case r := <-result:
+		return r
+	case <-ctx.Done():
+		return Message{Type: "result", TaskID: id, Error: "task timed out"}
+	}
+}
@@ -0,0 +1,50 @@
+package node_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/client"
+	"github.com/mrinalxdev/dbs-pt-1/harness"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+// newCluster starts size nodes over loopback TCP, so clients can dial
+// them, adjusted by configure if it is not nil. The cluster is closed when
+// the test ends.
+func newCluster(t *testing.T, size int, configure func(cfg *node.Config)) *harness.Cluster {
+	t.Helper()
+	c, err := harness.New(size, harness.Options{Loopback: true, Configure: configure})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// replicated configures every node to keep replicas copies of each key.
+func replicated(replicas int) func(cfg *node.Config) {
+	return func(cfg *node.Config) {
+		cfg.Replication = replicas
+	}
+}
+
+// connect returns a client of node id, closed when the test ends.
+func connect(t *testing.T, c *harness.Cluster, id int) *client.Client {
+	t.Helper()
+	cl, err := client.Connect(c.Node(id).Address)
+	if err != nil {
+		t.Fatalf("connect to node %d: %v", id, err)
+	}
+	t.Cleanup(func() { cl.Close() })
+	return cl
+}
+
+// testContext returns a context that ends with the test, or after timeout.
+func testContext(t *testing.T, timeout time.Duration) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
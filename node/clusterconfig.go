@@ -0,0 +1,483 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The cluster config is a set of named settings shared by the whole
+// cluster and kept consistent by the leader. A change made on any node is
+// forwarded to the leader, which gives the settings a new revision and
+// reports success only once a majority of the voting nodes hold it, so a
+// later leader, which needs a majority too, cannot have missed it: a peer
+// already holding a newer revision than a leader proposes fails the change
+// and hands the leader its copy. Reads through the leader
+// (ReadClusterConfig) are confirmed by a majority the same way. Every node
+// keeps a copy, which ClusterConfig returns without asking anyone, saves it
+// to cluster_config.json with a data directory, and sends it to peers that
+// connect.
+//
+// Settings named like a runtime option, heartbeat.interval,
+// heartbeat.suspect_timeout or replication, are applied on every node as
+// they arrive, overriding what the node was started with; deleting one
+// restores that. So are namespace.<name>.replication settings, which set
+// the replication of a namespace's keys (see namespace.go). Other names are
+// free for applications to use, and WatchClusterConfig tells them about
+// changes.
+
+const (
+	clusterConfigFile = "cluster_config.json"
+	// clusterConfigTimeout bounds the round in which the leader confirms a
+	// revision with a majority.
+	clusterConfigTimeout = 2 * time.Second
+	// clusterConfigPoll is how long the admin API holds a watch on the
+	// cluster config open.
+	clusterConfigPoll = 30 * time.Second
+)
+
+// errStaleClusterConfig fails a change the leader proposed on an outdated
+// copy of the settings. The leader has caught up by then, so a retry
+// succeeds.
+var errStaleClusterConfig = errors.New("the leader's cluster config was out of date; retry")
+
+// ClusterSettings are the cluster config at a revision, which every change
+// increments.
+type ClusterSettings struct {
+	Revision int               `json:"revision"`
+	Values   map[string]string `json:"values"`
+}
+
+// ClusterConfigChange is a setting changed by a new revision of the cluster
+// config.
+type ClusterConfigChange struct {
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Revision int    `json:"revision"`
+}
+
+// clusterConfigOp is a change forwarded to the leader.
+type clusterConfigOp struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// ClusterConfig is a node's copy of the cluster config.
+type ClusterConfig struct {
+	mutex     sync.Mutex
+	settings  ClusterSettings
+	path      string
+	watchers  map[int]func(ClusterConfigChange)
+	nextWatch int
+	// proposing serializes the changes this node makes as the leader.
+	proposing sync.Mutex
+}
+
+func NewClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		settings: ClusterSettings{Values: make(map[string]string)},
+		watchers: make(map[int]func(ClusterConfigChange)),
+	}
+}
+
+// load reads the copy saved in dir, if any, and saves it there from now on.
+func (c *ClusterConfig) load(dir string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.path = filepath.Join(dir, clusterConfigFile)
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var settings ClusterSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("parse %s: %v", c.path, err)
+	}
+	if settings.Values == nil {
+		settings.Values = make(map[string]string)
+	}
+	c.settings = settings
+	return nil
+}
+
+// save writes the copy to its file, if it has one. The caller must hold
+// c.mutex.
+func (c *ClusterConfig) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Settings returns a copy of the settings.
+func (c *ClusterConfig) Settings() ClusterSettings {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return ClusterSettings{Revision: c.settings.Revision, Values: maps.Clone(c.settings.Values)}
+}
+
+// adopt replaces the settings with newer ones, saves them and returns the
+// changes, sorted by name. Settings of the same or an older revision are
+// ignored.
+func (c *ClusterConfig) adopt(settings ClusterSettings) ([]ClusterConfigChange, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if settings.Revision <= c.settings.Revision {
+		return nil, nil
+	}
+	var changes []ClusterConfigChange
+	for name, value := range settings.Values {
+		if old, ok := c.settings.Values[name]; !ok || old != value {
+			changes = append(changes, ClusterConfigChange{Name: name, Value: value, Revision: settings.Revision})
+		}
+	}
+	for name := range c.settings.Values {
+		if _, ok := settings.Values[name]; !ok {
+			changes = append(changes, ClusterConfigChange{Name: name, Deleted: true, Revision: settings.Revision})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	c.settings = ClusterSettings{Revision: settings.Revision, Values: maps.Clone(settings.Values)}
+	if c.settings.Values == nil {
+		c.settings.Values = make(map[string]string)
+	}
+	return changes, c.save()
+}
+
+// watch calls fn with every change adopted from now on, until cancel is
+// called.
+func (c *ClusterConfig) watch(fn func(ClusterConfigChange)) (cancel func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	id := c.nextWatch
+	c.nextWatch++
+	c.watchers[id] = fn
+	return func() {
+		c.mutex.Lock()
+		delete(c.watchers, id)
+		c.mutex.Unlock()
+	}
+}
+
+// notify calls the watchers with changes.
+func (c *ClusterConfig) notify(changes []ClusterConfigChange) {
+	c.mutex.Lock()
+	watchers := make([]func(ClusterConfigChange), 0, len(c.watchers))
+	for _, fn := range c.watchers {
+		watchers = append(watchers, fn)
+	}
+	c.mutex.Unlock()
+
+	for _, change := range changes {
+		for _, fn := range watchers {
+			fn(change)
+		}
+	}
+}
+
+// ClusterConfig returns this node's copy of the cluster config, which may
+// lag behind the leader's.
+func (n *Node) ClusterConfig() ClusterSettings {
+	return n.clusterConfig.Settings()
+}
+
+// ReadClusterConfig returns the cluster config as the leader confirms it
+// with a majority of the cluster.
+func (n *Node) ReadClusterConfig() (ClusterSettings, error) {
+	return n.clusterConfigRequest(Message{Type: "cluster_config_get"})
+}
+
+// SetClusterConfig sets a cluster-wide setting through the leader and
+// returns the settings it committed.
+func (n *Node) SetClusterConfig(name, value string) (ClusterSettings, error) {
+	if name == "" {
+		return ClusterSettings{}, errors.New("a setting needs a name")
+	}
+	if isOption(name) {
+		cfg := n.config
+		if err := cfg.setOption(name, value); err != nil {
+			return ClusterSettings{}, err
+		}
+	} else if _, ok := namespaceSetting(name); ok {
+		if err := checkNamespaceSetting(name, value); err != nil {
+			return ClusterSettings{}, err
+		}
+	}
+	data, _ := json.Marshal(clusterConfigOp{Name: name, Value: value})
+	return n.clusterConfigRequest(Message{Type: "cluster_config_set", Content: string(data)})
+}
+
+// DeleteClusterConfig deletes a cluster-wide setting through the leader and
+// returns the settings it committed.
+func (n *Node) DeleteClusterConfig(name string) (ClusterSettings, error) {
+	data, _ := json.Marshal(clusterConfigOp{Name: name})
+	return n.clusterConfigRequest(Message{Type: "cluster_config_del", Content: string(data)})
+}
+
+// WatchClusterConfig calls fn with every change to the cluster config this
+// node adopts, until cancel is called. fn runs on the goroutine adopting
+// the change and must not block.
+func (n *Node) WatchClusterConfig(fn func(ClusterConfigChange)) (cancel func()) {
+	return n.clusterConfig.watch(fn)
+}
+
+// clusterConfigRequest serves a cluster_config_get, _set or _del on this
+// node if it leads, or else on the leader.
+func (n *Node) clusterConfigRequest(msg Message) (ClusterSettings, error) {
+	n.mutex.RLock()
+	leader, leading := n.election.leaderID, n.election.state == Leader
+	n.mutex.RUnlock()
+
+	var reply Message
+	switch {
+	case leading:
+		if reply = n.applyClusterConfig(msg); reply.Error != "" {
+			return ClusterSettings{}, errors.New(reply.Error)
+		}
+	case leader < 0:
+		return ClusterSettings{}, errors.New("no known leader to ask for the cluster config")
+	case !n.PeerSupports(leader, CapClusterConfig):
+		return ClusterSettings{}, fmt.Errorf("leader %d does not support the cluster config", leader)
+	default:
+		var err error
+		if reply, err = n.Call(leader, msg, 2*clusterConfigTimeout); err != nil {
+			return ClusterSettings{}, err
+		}
+	}
+	var settings ClusterSettings
+	if err := json.Unmarshal([]byte(reply.Content), &settings); err != nil {
+		return ClusterSettings{}, fmt.Errorf("invalid cluster config: %v", err)
+	}
+	return settings, nil
+}
+
+// applyClusterConfig serves a request as the leader: it proposes the
+// settings the request leaves, confirms them with a majority, and replies
+// with them.
+func (n *Node) applyClusterConfig(msg Message) Message {
+	reply := Message{Type: "cluster_config_result"}
+	n.clusterConfig.proposing.Lock()
+	defer n.clusterConfig.proposing.Unlock()
+
+	settings := n.clusterConfig.Settings()
+	if msg.Type != "cluster_config_get" {
+		var op clusterConfigOp
+		if err := json.Unmarshal([]byte(msg.Content), &op); err != nil {
+			reply.Error = fmt.Sprintf("invalid cluster config change: %v", err)
+			return reply
+		}
+		if msg.Type == "cluster_config_set" {
+			settings.Values[op.Name] = op.Value
+		} else if _, ok := settings.Values[op.Name]; ok {
+			delete(settings.Values, op.Name)
+		} else {
+			reply.Error = fmt.Sprintf("no cluster setting %s", op.Name)
+			return reply
+		}
+		if err := n.checkClusterSettings(settings.Values); err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+		settings.Revision++
+	}
+
+	if err := n.confirmClusterConfig(settings); err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+	n.adoptClusterConfig(settings)
+	data, _ := json.Marshal(settings)
+	reply.Content = string(data)
+	return reply
+}
+
+// checkClusterSettings checks that the options among values are valid
+// together, on top of the config this node was started with.
+func (n *Node) checkClusterSettings(values map[string]string) error {
+	cfg := n.config
+	for name, value := range values {
+		if _, ok := namespaceSetting(name); ok {
+			if err := checkNamespaceSetting(name, value); err != nil {
+				return err
+			}
+			continue
+		}
+		if !isOption(name) {
+			continue
+		}
+		if err := cfg.setOption(name, value); err != nil {
+			return err
+		}
+	}
+	return cfg.validateTiming()
+}
+
+// confirmClusterConfig sends settings to every peer and waits until a
+// majority of the voting nodes, this one included, hold them. It fails if a
+// peer holds a newer revision, which this node adopts.
+func (n *Node) confirmClusterConfig(settings ClusterSettings) error {
+	n.mutex.RLock()
+	voting := make(map[int]bool, len(n.Peers))
+	for id := range n.Peers {
+		voting[id] = votes(n.roleOf(id))
+	}
+	quorum := n.voters()/2 + 1
+	n.mutex.RUnlock()
+
+	var peers []int
+	for id := range voting {
+		if n.PeerSupports(id, CapClusterConfig) {
+			peers = append(peers, id)
+		}
+	}
+
+	acked := 0
+	if votes(n.config.Role) {
+		acked++
+	}
+	if acked >= quorum {
+		return nil
+	}
+
+	requestID := newTaskID()
+	replies := n.expect(requestID, len(peers))
+	defer n.cancelExpect(requestID)
+
+	data, _ := json.Marshal(settings)
+	for _, id := range peers {
+		n.sendMessage(id, Message{Type: "cluster_config", From: n.ID, RequestID: requestID, Content: string(data)})
+	}
+
+	timeout := time.After(clusterConfigTimeout)
+	for acked < quorum {
+		select {
+		case r := <-replies:
+			var theirs ClusterSettings
+			if err := json.Unmarshal([]byte(r.Content), &theirs); err != nil {
+				continue
+			}
+			switch {
+			case theirs.Revision > settings.Revision:
+				n.peerLogger(r.From, r.Type).Warn("peer holds a newer cluster config", "revision", theirs.Revision)
+				n.adoptClusterConfig(theirs)
+				return errStaleClusterConfig
+			case theirs.Revision == settings.Revision && !maps.Equal(theirs.Values, settings.Values):
+				return errStaleClusterConfig
+			case theirs.Revision == settings.Revision && voting[r.From]:
+				acked++
+			}
+		case <-timeout:
+			return fmt.Errorf("cluster config not confirmed: %d/%d nodes acknowledged", acked, quorum)
+		}
+	}
+	return nil
+}
+
+// adoptClusterConfig takes settings if they are newer than this node's
+// copy, applying the options among the changes and telling the watchers.
+func (n *Node) adoptClusterConfig(settings ClusterSettings) {
+	changes, err := n.clusterConfig.adopt(settings)
+	if err != nil {
+		n.logger.Error("failed to save the cluster config", "err", err)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	n.logger.Info("cluster config changed", "revision", settings.Revision, "changes", len(changes))
+	n.applyNamespaceSettings(n.clusterConfig.Settings().Values)
+	for _, change := range changes {
+		if !isOption(change.Name) {
+			continue
+		}
+		value := change.Value
+		if change.Deleted {
+			value = n.configuredOption(change.Name)
+		}
+		if err := n.SetOption(change.Name, value); err != nil {
+			n.logger.Warn("failed to apply cluster setting", "option", change.Name, "value", value, "err", err)
+		}
+	}
+	n.clusterConfig.notify(changes)
+}
+
+// applyClusterOptions applies the options in this node's copy of the
+// cluster config, as loaded on startup.
+func (n *Node) applyClusterOptions() {
+	values := n.clusterConfig.Settings().Values
+	n.applyNamespaceSettings(values)
+	for name, value := range values {
+		if !isOption(name) {
+			continue
+		}
+		if err := n.SetOption(name, value); err != nil {
+			n.logger.Warn("failed to apply cluster setting", "option", name, "value", value, "err", err)
+		}
+	}
+}
+
+// announceClusterConfig sends a newly connected peer the cluster config, if
+// it was ever set.
+func (n *Node) announceClusterConfig(peer int) {
+	settings := n.clusterConfig.Settings()
+	if settings.Revision == 0 || !n.PeerSupports(peer, CapClusterConfig) {
+		return
+	}
+	data, _ := json.Marshal(settings)
+	n.sendMessage(peer, Message{Type: "cluster_config", From: n.ID, Content: string(data)})
+}
+
+// handleClusterConfig adopts settings a peer sends, answering the leader's
+// proposals with this node's copy, or serves a request as the leader.
+func (n *Node) handleClusterConfig(msg Message) {
+	switch msg.Type {
+	case "cluster_config":
+		var settings ClusterSettings
+		if err := json.Unmarshal([]byte(msg.Content), &settings); err != nil {
+			n.peerLogger(msg.From, msg.Type).Warn("invalid cluster config", "err", err)
+			return
+		}
+		n.adoptClusterConfig(settings)
+		if msg.RequestID == "" {
+			return
+		}
+		data, _ := json.Marshal(n.clusterConfig.Settings())
+		n.Reply(msg, Message{Type: "cluster_config_ack", Content: string(data)})
+
+	case "cluster_config_get", "cluster_config_set", "cluster_config_del":
+		n.mutex.RLock()
+		leading := n.election.state == Leader
+		n.mutex.RUnlock()
+		if !leading {
+			n.Reply(msg, Message{Type: "cluster_config_result", Error: fmt.Sprintf("node %d is not the leader", n.ID)})
+			return
+		}
+		// Confirming waits for the peers, which must not stall the
+		// connection's read loop
+		go func() {
+			n.Reply(msg, n.applyClusterConfig(msg))
+		}()
+	}
+}
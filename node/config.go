@@ -0,0 +1,390 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything needed to start a node. It can be loaded from a
+// YAML file and overridden by command line flags.
+type Config struct {
+	NodeID            int               `yaml:"node_id"`
+	Bind              string            `yaml:"bind"`
+	Advertise         string            `yaml:"advertise"`
+	Master            bool              `yaml:"master"`
+	Role              string            `yaml:"role"`
+	Seeds             []Seed            `yaml:"seeds"`
+	Join              []string          `yaml:"join"`
+	Discovery         DiscoveryConfig   `yaml:"discovery"`
+	Transport         string            `yaml:"transport"`
+	Protocol          string            `yaml:"protocol"`
+	Codec             string            `yaml:"codec"`
+	HTTP              string            `yaml:"http"`
+	Workers           int               `yaml:"workers"`
+	QueueSize         int               `yaml:"queue_size"`
+	StealThreshold    int               `yaml:"steal_threshold"`
+	OutboxSize        int               `yaml:"outbox_size"`
+	SendTimeout       time.Duration     `yaml:"send_timeout"`
+	WriteTimeout      time.Duration     `yaml:"write_timeout"`
+	SlowPeerTimeout   time.Duration     `yaml:"slow_peer_timeout"`
+	KeepAlive         time.Duration     `yaml:"keepalive"`
+	KeepAliveTimeout  time.Duration     `yaml:"keepalive_timeout"`
+	BatchSize         int               `yaml:"batch_size"`
+	BatchWindow       time.Duration     `yaml:"batch_window"`
+	Compression       string            `yaml:"compression"`
+	CompressThreshold int               `yaml:"compress_threshold"`
+	MaxMessageSize    int               `yaml:"max_message_size"`
+	AuthToken         string            `yaml:"auth_token"`
+	GatewayToken      string            `yaml:"gateway_token"`
+	RateLimit         float64           `yaml:"rate_limit"`
+	RateBurst         int               `yaml:"rate_burst"`
+	HeartbeatInterval time.Duration     `yaml:"heartbeat_interval"`
+	SuspectTimeout    time.Duration     `yaml:"suspect_timeout"`
+	UDPHeartbeats     bool              `yaml:"udp_heartbeats"`
+	LogLevel          string            `yaml:"log_level"`
+	LogFile           string            `yaml:"log_file"`
+	LogFormat         string            `yaml:"log_format"`
+	Trace             bool              `yaml:"trace"`
+	TLS               TLSConfig         `yaml:"tls"`
+	DataDir           string            `yaml:"data_dir"`
+	EncryptionKeys    []string          `yaml:"encryption_keys"`
+	Storage           string            `yaml:"storage"`
+	Fsync             string            `yaml:"fsync"`
+	FsyncInterval     time.Duration     `yaml:"fsync_interval"`
+	Replication       int               `yaml:"replication"`
+	Conflicts         string            `yaml:"conflicts"`
+	Linearizable      bool              `yaml:"linearizable"`
+	RebalanceRate     float64           `yaml:"rebalance_rate"`
+	HotKeyThreshold   float64           `yaml:"hot_key_threshold"`
+	HotKeyCache       time.Duration     `yaml:"hot_key_cache"`
+	AckTimeout        time.Duration     `yaml:"ack_timeout"`
+	RetryLimit        int               `yaml:"retry_limit"`
+	InterruptedTasks  string            `yaml:"interrupted_tasks"`
+	TaskSchemas       map[string]string `yaml:"task_schemas"`
+
+	// Network, when set, is used instead of the transport named by
+	// Transport, e.g. a transport.Memory shared by in-process nodes.
+	Network transport.Transport `yaml:"-"`
+	// Discoverer, when set, is used instead of the discovery named by
+	// Discovery.
+	Discoverer Discovery `yaml:"-"`
+	// LogOutput, when set, receives the node's logs instead of stderr or
+	// LogFile, e.g. to multiplex the logs of in-process nodes.
+	LogOutput io.Writer `yaml:"-"`
+}
+
+// Storage engines for the KV store.
+const (
+	// StorageMemory keeps every key in memory, made durable by the WAL
+	// when there is a data directory.
+	StorageMemory = "memory"
+	// StorageDisk keeps values in a data log in the data directory and
+	// only keys in memory.
+	StorageDisk = "disk"
+)
+
+const (
+	// TransportUnix is the transport over Unix domain sockets, whose
+	// addresses are socket paths; see transport.Unix.
+	TransportUnix = "unix"
+	// TransportPipe is the transport over Windows named pipes, whose
+	// addresses are pipe names; see transport.Pipe.
+	TransportPipe = "pipe"
+)
+
+// localTransport reports whether the node talks over a transport for
+// nodes on one host, whose addresses are names rather than host:port.
+func (c Config) localTransport() bool {
+	return c.Transport == TransportUnix || c.Transport == TransportPipe
+}
+
+// Seed is a peer the node connects to on startup.
+type Seed struct {
+	ID      int    `yaml:"id"`
+	Address string `yaml:"address"`
+}
+
+func (s Seed) String() string {
+	return fmt.Sprintf("%d@%s", s.ID, s.Address)
+}
+
+// ParseSeed parses a seed written as <node_id>@<host:port>.
+func ParseSeed(s string) (Seed, error) {
+	idPart, address, ok := strings.Cut(strings.TrimSpace(s), "@")
+	if !ok || address == "" {
+		return Seed{}, fmt.Errorf("seed %q: expected <node_id>@<host:port>", s)
+	}
+	id, err := strconv.Atoi(idPart)
+	if err != nil {
+		return Seed{}, fmt.Errorf("seed %q: invalid node id: %v", s, err)
+	}
+	return Seed{ID: id, Address: address}, nil
+}
+
+// validAdvertise checks an advertise address: a host, dialed on the port
+// the node listens on, or a host and a port other than 0.
+func validAdvertise(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Contains(address, ":") && net.ParseIP(address) == nil {
+			return err
+		}
+		return nil
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return errors.New("invalid port")
+	}
+	return nil
+}
+
+// minMessageSize is the smallest max_message_size, which still fits every
+// control message.
+const minMessageSize = 64 << 10
+
+// DefaultConfig returns the config used for anything a file or flag does
+// not set.
+func DefaultConfig() Config {
+	return Config{
+		Bind:              ":8000",
+		Role:              RoleMember,
+		Transport:         "tcp",
+		Protocol:          transport.ProtocolJSON,
+		Codec:             transport.CodecJSON,
+		Workers:           defaultWorkers,
+		QueueSize:         defaultQueueSize,
+		OutboxSize:        defaultOutboxSize,
+		WriteTimeout:      defaultWriteTimeout,
+		SlowPeerTimeout:   defaultSlowPeerTimeout,
+		KeepAlive:         defaultKeepAlive,
+		KeepAliveTimeout:  defaultKeepAliveTimeout,
+		BatchSize:         defaultBatchSize,
+		Compression:       transport.CompressionNone,
+		CompressThreshold: transport.DefaultCompressThreshold,
+		MaxMessageSize:    transport.MaxFrameSize,
+		HeartbeatInterval: defaultHeartbeatInterval,
+		LogLevel:          "info",
+		LogFormat:         "text",
+		Replication:       1,
+		Conflicts:         ConflictsLWW,
+		RebalanceRate:     defaultRebalanceRate,
+		HotKeyThreshold:   defaultHotKeyThreshold,
+		Storage:           StorageMemory,
+		Fsync:             FsyncAlways,
+		FsyncInterval:     defaultFsyncInterval,
+		AckTimeout:        defaultAckTimeout,
+		RetryLimit:        defaultRetryLimit,
+		InterruptedTasks:  InterruptedRerun,
+	}
+}
+
+// LoadConfig reads a YAML config file on top of the defaults.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports every problem with the config at once.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.NodeID < 0 || c.NodeID > MaxIDNode {
+		errs = append(errs, fmt.Errorf("node_id must be between 0 and %d", MaxIDNode))
+	}
+	if !validRole(c.Role) {
+		errs = append(errs, fmt.Errorf("role must be member, observer, arbiter or client"))
+	} else if c.Master && c.Role != RoleMember {
+		errs = append(errs, fmt.Errorf("master needs role member, not %s", c.Role))
+	}
+	if c.localTransport() {
+		// Socket paths and pipe names are no host:port
+		if c.Bind == "" {
+			errs = append(errs, fmt.Errorf("bind must be a socket path or pipe name with the %s transport", c.Transport))
+		}
+		if c.TLS.Enabled() {
+			errs = append(errs, fmt.Errorf("tls is not supported by the %s transport", c.Transport))
+		}
+		if c.UDPHeartbeats {
+			errs = append(errs, fmt.Errorf("udp_heartbeats need a network transport, not %s", c.Transport))
+		}
+	} else if _, port, err := net.SplitHostPort(c.Bind); err != nil {
+		errs = append(errs, fmt.Errorf("bind %q: %v", c.Bind, err))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("bind %q: invalid port", c.Bind))
+	}
+	if c.Advertise != "" && !c.localTransport() {
+		if err := validAdvertise(c.Advertise); err != nil {
+			errs = append(errs, fmt.Errorf("advertise %q: %v", c.Advertise, err))
+		}
+	}
+	if _, err := transport.New(c.Transport, transport.Options{Protocol: c.Protocol, Codec: c.Codec}); err != nil {
+		errs = append(errs, err)
+	}
+	if c.TLS.Enabled() {
+		if err := c.TLS.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.MaxMessageSize != 0 && (c.MaxMessageSize < minMessageSize || c.MaxMessageSize > transport.MaxFrameSize) {
+		errs = append(errs, fmt.Errorf("max_message_size must be between %d and %d bytes", minMessageSize, transport.MaxFrameSize))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1"))
+	}
+	if c.QueueSize < 1 {
+		errs = append(errs, fmt.Errorf("queue_size must be at least 1"))
+	}
+	if c.OutboxSize < 1 {
+		errs = append(errs, fmt.Errorf("outbox_size must be at least 1"))
+	}
+	if c.SendTimeout < 0 {
+		errs = append(errs, fmt.Errorf("send_timeout must not be negative"))
+	}
+	if c.WriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("write_timeout must not be negative"))
+	}
+	if c.SlowPeerTimeout < 0 {
+		errs = append(errs, fmt.Errorf("slow_peer_timeout must not be negative"))
+	}
+	if c.KeepAlive < 0 {
+		errs = append(errs, fmt.Errorf("keepalive must not be negative"))
+	}
+	if c.KeepAliveTimeout < 0 || (c.KeepAliveTimeout > 0 && c.KeepAliveTimeout <= pingInterval) {
+		errs = append(errs, fmt.Errorf("keepalive_timeout must be 0 or longer than the ping interval (%v)", pingInterval))
+	}
+	if c.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("batch_size must be at least 1"))
+	}
+	if c.BatchWindow < 0 {
+		errs = append(errs, fmt.Errorf("batch_window must not be negative"))
+	}
+	if !transport.ValidCompression(c.Compression) {
+		errs = append(errs, fmt.Errorf("compression must be none or gzip"))
+	}
+	if c.CompressThreshold < 0 {
+		errs = append(errs, fmt.Errorf("compress_threshold must not be negative"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit must not be negative"))
+	}
+	if c.RateBurst < 0 {
+		errs = append(errs, fmt.Errorf("rate_burst must not be negative"))
+	}
+	switch c.Storage {
+	case StorageMemory:
+	case StorageDisk:
+		if c.DataDir == "" {
+			errs = append(errs, fmt.Errorf("storage disk needs a data_dir"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage must be memory or disk"))
+	}
+	if _, err := ParseKeyring(c.encryptionKeys()); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Replication < 1 {
+		errs = append(errs, fmt.Errorf("replication must be at least 1"))
+	}
+	if c.Conflicts != ConflictsLWW && c.Conflicts != ConflictsSiblings {
+		errs = append(errs, fmt.Errorf("conflicts must be lww or siblings"))
+	}
+	if c.Linearizable && c.Conflicts != ConflictsLWW {
+		errs = append(errs, fmt.Errorf("linearizable needs conflicts: lww"))
+	}
+	if c.StealThreshold < 0 {
+		errs = append(errs, fmt.Errorf("steal_threshold must not be negative"))
+	}
+	if c.HotKeyThreshold <= 0 {
+		errs = append(errs, fmt.Errorf("hot_key_threshold must be positive"))
+	}
+	if c.HotKeyCache < 0 {
+		errs = append(errs, fmt.Errorf("hot_key_cache must not be negative"))
+	}
+	if c.RebalanceRate < 0 {
+		errs = append(errs, fmt.Errorf("rebalance_rate must not be negative"))
+	}
+	if c.AckTimeout < 10*time.Millisecond {
+		errs = append(errs, fmt.Errorf("ack_timeout must be at least 10ms"))
+	}
+	if c.RetryLimit < 0 {
+		errs = append(errs, fmt.Errorf("retry_limit must not be negative"))
+	}
+	if c.Fsync != FsyncAlways && c.Fsync != FsyncGroup && c.Fsync != FsyncNone {
+		errs = append(errs, fmt.Errorf("fsync must be always, group or none"))
+	}
+	if c.Fsync == FsyncGroup && c.FsyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("fsync_interval must be positive with fsync: group"))
+	}
+	if c.InterruptedTasks != InterruptedRerun && c.InterruptedTasks != InterruptedFail {
+		errs = append(errs, fmt.Errorf("interrupted_tasks must be rerun or fail"))
+	}
+	for taskType, path := range c.TaskSchemas {
+		if taskType == "" || path == "" {
+			errs = append(errs, fmt.Errorf("task_schemas needs a task type and a schema file for each entry"))
+		}
+	}
+	if err := c.validateTiming(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.UDPHeartbeats && c.TLS.Enabled() && c.AuthToken == "" {
+		errs = append(errs, fmt.Errorf("udp_heartbeats are not encrypted by TLS; set an auth_token to sign them"))
+	}
+	if _, ok := slogLevels[c.LogLevel]; !ok {
+		errs = append(errs, fmt.Errorf("log_level must be one of debug, info, warn, error"))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format must be text or json"))
+	}
+	for _, seed := range c.Seeds {
+		if seed.ID == c.NodeID {
+			errs = append(errs, fmt.Errorf("seed %s has this node's own id", seed))
+		}
+		if seed.Address == "" {
+			errs = append(errs, fmt.Errorf("seed %d has no address", seed.ID))
+		}
+	}
+	if err := c.Discovery.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, address := range c.Join {
+		if c.localTransport() {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Errorf("join address %q: %v", address, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTiming checks the heartbeat settings, which SetOption also
+// changes at runtime.
+func (c Config) validateTiming() error {
+	if c.HeartbeatInterval < 10*time.Millisecond {
+		return fmt.Errorf("heartbeat_interval must be at least 10ms")
+	}
+	if c.SuspectTimeout != 0 && c.SuspectTimeout <= c.HeartbeatInterval {
+		return fmt.Errorf("suspect_timeout must be longer than heartbeat_interval (%v), or 0 for three intervals", c.HeartbeatInterval)
+	}
+	return nil
+}
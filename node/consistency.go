@@ -0,0 +1,151 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Read consistency levels. A get at ConsistencyOne is answered from the
+// coordinator's copy alone. At ConsistencyQuorum the coordinator gathers the
+// entries of a majority of the key's replicas, itself included, and returns
+// the newest, or with conflicts kept as siblings, all their versions; at
+// ConsistencyAll it needs every replica. Replicas found holding an older
+// entry are sent the newest one (read repair).
+const (
+	ConsistencyOne    = "one"
+	ConsistencyQuorum = "quorum"
+	ConsistencyAll    = "all"
+)
+
+// ParseConsistency checks a consistency level, case-insensitively, and
+// returns it in canonical form. The empty string means ConsistencyOne.
+func ParseConsistency(level string) (string, error) {
+	switch level = strings.ToLower(level); level {
+	case "":
+		return ConsistencyOne, nil
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q: expected one, quorum or all", level)
+}
+
+// readReplica is one replica's answer to a consistent read.
+type readReplica struct {
+	id    int
+	entry Entry
+	found bool
+}
+
+// consistentRead serves a get at msg.Consistency: it asks the key's
+// replicas for their entries, waits until enough have answered, and replies
+// with the newest.
+func (n *Node) consistentRead(span *span, msg Message) Message {
+	reply := Message{Type: "kv_result", From: n.ID, Key: msg.Key, RequestID: msg.RequestID}
+	level, err := ParseConsistency(msg.Consistency)
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	replicas := n.replicas(msg.Key)
+	required := len(replicas)
+	if level == ConsistencyQuorum {
+		required = len(replicas)/2 + 1
+	}
+
+	var answers []readReplica
+	var peers []int
+	for _, id := range replicas {
+		if id == n.ID {
+			e, found := n.store.Lookup(msg.Key)
+			answers = append(answers, readReplica{id: n.ID, entry: e, found: found})
+		} else if n.PeerSupports(id, CapRead) {
+			peers = append(peers, id)
+		}
+	}
+
+	if len(answers) < required && len(peers) > 0 {
+		requestID := newTaskID()
+		replies := n.expect(requestID, len(peers))
+		defer n.cancelExpect(requestID)
+
+		for _, id := range peers {
+			n.sendMessage(id, span.stamp(Message{Type: "read", From: n.ID, Key: msg.Key, RequestID: requestID}))
+		}
+
+		timeout := time.After(replicationTimeout)
+	wait:
+		for len(answers) < required {
+			select {
+			case r := <-replies:
+				if r.Type != "read_result" || r.Error != "" {
+					continue
+				}
+				e, found := r.Entries[msg.Key]
+				answers = append(answers, readReplica{id: r.From, entry: e, found: found})
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	if len(answers) < required {
+		reply.Error = fmt.Sprintf("read consistency %s not reached: %d/%d replicas answered", level, len(answers), required)
+		return reply
+	}
+
+	// Versioned answers are merged, keeping the siblings any replica holds
+	var newest readReplica
+	for _, a := range answers {
+		if !a.found {
+			continue
+		}
+		if newest.found {
+			a.entry = mergeEntries(newest.entry, a.entry)
+		}
+		newest = a
+	}
+	if newest.found {
+		n.repairReplicas(span, msg.Key, newest.entry, answers)
+	}
+
+	e := newest.entry
+	if newest.found && !e.Deleted && !e.Expired(time.Now()) {
+		reply.Value, reply.Found = e.Value, true
+	}
+	if newest.found && len(e.Version) > 0 {
+		reply.Context, reply.Siblings = entryContext(e), e.Siblings
+	}
+	reply.Content = versionsContent(keyVersions(reply))
+	return reply
+}
+
+// repairReplicas sends newest to every replica in answers that holds an
+// older entry for key, or none. The writes are not waited for.
+func (n *Node) repairReplicas(span *span, key string, newest Entry, answers []readReplica) {
+	for _, a := range answers {
+		if a.found && !supersedes(newest, a.entry) {
+			continue
+		}
+		if a.id == n.ID {
+			if _, err := n.store.Merge(key, newest); err != nil {
+				n.logger.Error("failed to repair key", "key", key, "err", err)
+			}
+			continue
+		}
+		n.peerLogger(a.id, "read").Debug("repairing stale replica", "key", key)
+		write := replicateMessage(key, newest)
+		write.From = n.ID
+		n.sendMessage(a.id, span.stamp(write))
+	}
+}
+
+// handleRead answers a consistent read's coordinator with this replica's
+// entry for the key, if any.
+func (n *Node) handleRead(msg Message) {
+	reply := Message{Type: "read_result"}
+	if e, ok := n.store.Lookup(msg.Key); ok {
+		reply.Entries = map[string]Entry{msg.Key: e}
+	}
+	n.Reply(msg, reply)
+}
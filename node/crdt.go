@@ -0,0 +1,396 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Besides plain strings, a key can hold a replicated data type (a CRDT)
+// whose copies merge deterministically instead of the last writer winning,
+// so updates made concurrently, e.g. through different coordinators while
+// the cluster was partitioned, all survive:
+//
+//   - a counter (a PN-counter: a G-counter of increments and one of
+//     decrements, each counting per coordinating node), changed with incr
+//     and decr;
+//   - a set (an observed-remove set), changed with sadd and srem: an add
+//     concurrent with a remove of the same member wins;
+//   - a register (a last-writer-wins register), set with rset.
+//
+// An update is applied by the key's coordinator to the state it holds and
+// the whole state is replicated like a set. Wherever two states of a key
+// meet, in replication, anti-entropy, hints or quorum reads, they are merged
+// rather than one replacing the other. The state is kept in the key's value,
+// behind crdtPrefix, so it is stored, logged and encrypted like any value.
+// Deleting a key, or setting a plain value, replaces its state by the usual
+// timestamp order; an update to a key holding a plain value fails.
+
+// crdtPrefix marks a value holding the state of a replicated data type.
+const crdtPrefix = "crdt:"
+
+// The replicated data types.
+const (
+	CRDTCounter  = "counter"
+	CRDTSet      = "set"
+	CRDTRegister = "register"
+)
+
+// crdtOps maps each update to the type it applies to.
+var crdtOps = map[string]string{
+	"incr": CRDTCounter,
+	"sadd": CRDTSet,
+	"srem": CRDTSet,
+	"rset": CRDTRegister,
+}
+
+var errNotCRDT = errors.New("wrong type")
+
+// crdtState is the state of a replicated data type. Only the fields of its
+// Type are set.
+type crdtState struct {
+	Type string `json:"type"`
+	// Inc and Dec are a counter's increments and decrements, by the node
+	// that coordinated them.
+	Inc map[int]uint64 `json:"inc,omitempty"`
+	Dec map[int]uint64 `json:"dec,omitempty"`
+	// Adds maps each member of a set to the timestamps of the adds that put
+	// it there and no remove has seen; Removed to those of its adds removes
+	// saw.
+	Adds    map[string][]Timestamp `json:"adds,omitempty"`
+	Removed map[string][]Timestamp `json:"removed,omitempty"`
+	// Value is a register's value, written at Written.
+	Value   string    `json:"value,omitempty"`
+	Written Timestamp `json:"written,omitzero"`
+}
+
+// isCRDT reports whether e holds the state of a replicated data type.
+func isCRDT(e Entry) bool {
+	return !e.Deleted && strings.HasPrefix(e.Value, crdtPrefix)
+}
+
+// parseCRDT decodes the state a value holds.
+func parseCRDT(value string) (crdtState, error) {
+	var state crdtState
+	if !strings.HasPrefix(value, crdtPrefix) {
+		return state, errNotCRDT
+	}
+	if err := json.Unmarshal([]byte(value[len(crdtPrefix):]), &state); err != nil {
+		return state, fmt.Errorf("invalid %s state: %v", crdtPrefix, err)
+	}
+	return state, nil
+}
+
+// encode returns the value holding state. Maps are encoded in key order and
+// timestamps are kept sorted, so equal states have equal values.
+func (s crdtState) encode() string {
+	data, _ := json.Marshal(s)
+	return crdtPrefix + string(data)
+}
+
+// merge returns the state holding every update a and b hold, which are of
+// the same type.
+func (a crdtState) merge(b crdtState) crdtState {
+	merged := crdtState{Type: a.Type}
+	switch a.Type {
+	case CRDTCounter:
+		merged.Inc, merged.Dec = maxCounts(a.Inc, b.Inc), maxCounts(a.Dec, b.Dec)
+	case CRDTSet:
+		for _, state := range []crdtState{a, b} {
+			for member, stamps := range state.Adds {
+				merged.Adds = addStamps(merged.Adds, member, stamps)
+			}
+			for member, stamps := range state.Removed {
+				merged.Removed = addStamps(merged.Removed, member, stamps)
+			}
+		}
+		merged.dropRemoved()
+	case CRDTRegister:
+		merged.Value, merged.Written = a.Value, a.Written
+		if a.Written.Less(b.Written) {
+			merged.Value, merged.Written = b.Value, b.Written
+		}
+	}
+	return merged
+}
+
+// maxCounts returns the larger count of each node in a and b.
+func maxCounts(a, b map[int]uint64) map[int]uint64 {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	counts := make(map[int]uint64, len(a))
+	for node, count := range a {
+		counts[node] = count
+	}
+	for node, count := range b {
+		counts[node] = max(counts[node], count)
+	}
+	return counts
+}
+
+// sortedStamps sorts stamps and drops duplicates.
+func sortedStamps(stamps []Timestamp) []Timestamp {
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].Less(stamps[j]) })
+	return slices.Compact(stamps)
+}
+
+// addStamps adds stamps to those of member in set, which it returns.
+func addStamps(set map[string][]Timestamp, member string, stamps []Timestamp) map[string][]Timestamp {
+	if set == nil {
+		set = make(map[string][]Timestamp)
+	}
+	set[member] = sortedStamps(append(slices.Clone(set[member]), stamps...))
+	return set
+}
+
+// dropRemoved forgets the adds a remove saw, and the members left without
+// adds.
+func (s *crdtState) dropRemoved() {
+	for member, stamps := range s.Adds {
+		stamps = slices.DeleteFunc(stamps, func(ts Timestamp) bool {
+			_, removed := slices.BinarySearchFunc(s.Removed[member], ts, compareStamps)
+			return removed
+		})
+		if len(stamps) == 0 {
+			delete(s.Adds, member)
+		} else {
+			s.Adds[member] = stamps
+		}
+	}
+	if len(s.Adds) == 0 {
+		s.Adds = nil
+	}
+}
+
+func compareStamps(a, b Timestamp) int {
+	switch {
+	case a.Less(b):
+		return -1
+	case b.Less(a):
+		return 1
+	}
+	return 0
+}
+
+// apply applies update op with argument arg, made by node at ts, to s.
+func (s *crdtState) apply(node int, ts Timestamp, op, arg string) error {
+	switch op {
+	case "incr":
+		delta, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid increment %q", arg)
+		}
+		counts := &s.Inc
+		if delta < 0 {
+			counts, delta = &s.Dec, -delta
+		}
+		if *counts == nil {
+			*counts = make(map[int]uint64)
+		}
+		(*counts)[node] += uint64(delta)
+	case "sadd", "srem":
+		var members []string
+		if err := json.Unmarshal([]byte(arg), &members); err != nil {
+			return fmt.Errorf("invalid members %q", arg)
+		}
+		for _, member := range members {
+			if op == "sadd" {
+				s.Adds = addStamps(s.Adds, member, []Timestamp{ts})
+			} else if len(s.Adds[member]) > 0 {
+				s.Removed = addStamps(s.Removed, member, s.Adds[member])
+			}
+		}
+		s.dropRemoved()
+	case "rset":
+		s.Value, s.Written = arg, ts
+	}
+	return nil
+}
+
+// mergeCRDT merges two entries for a key, at least one of which holds a
+// replicated data type. States of the same type are merged, stamped with
+// the later timestamp; otherwise the last writer wins.
+func mergeCRDT(a, b Entry) Entry {
+	newer, older := a, b
+	if a.Timestamp.Less(b.Timestamp) {
+		newer, older = b, a
+	}
+	if !isCRDT(a) || !isCRDT(b) {
+		return newer
+	}
+	sa, errA := parseCRDT(a.Value)
+	sb, errB := parseCRDT(b.Value)
+	if errA != nil || errB != nil || sa.Type != sb.Type {
+		return newer
+	}
+	merged := sa.merge(sb).encode()
+	switch merged {
+	case newer.Value:
+		return newer
+	case older.Value:
+		older.Timestamp = newer.Timestamp
+		return older
+	}
+	return Entry{Value: merged, Timestamp: newer.Timestamp}
+}
+
+// updateCRDT applies update op with argument arg to the state old holds, as
+// a write by node at ts, and returns the new state's value. A key without a
+// live value starts from an empty state.
+func updateCRDT(node int, old Entry, found bool, ts Timestamp, op, arg string) (string, error) {
+	kind, ok := crdtOps[op]
+	if !ok {
+		return "", fmt.Errorf("unknown update %q", op)
+	}
+	state := crdtState{Type: kind}
+	if found && !old.Deleted && !old.Expired(time.Now()) {
+		current, err := parseCRDT(old.Value)
+		if err != nil {
+			return "", fmt.Errorf("%w: key holds a plain value, not a %s", err, kind)
+		}
+		if current.Type != kind {
+			return "", fmt.Errorf("%w: key holds a %s, not a %s", errNotCRDT, current.Type, kind)
+		}
+		state = current
+	}
+	if err := state.apply(node, ts, op, arg); err != nil {
+		return "", err
+	}
+	return state.encode(), nil
+}
+
+// CRDTValue is the value of a key holding a replicated data type.
+type CRDTValue struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Count is a counter's value.
+	Count int64 `json:"count,omitempty"`
+	// Members are a set's members, sorted.
+	Members []string `json:"members,omitempty"`
+	// Value is a register's value.
+	Value string `json:"value,omitempty"`
+}
+
+// crdtValue returns the value of the state held under key.
+func crdtValue(key string, state crdtState) CRDTValue {
+	v := CRDTValue{Key: key, Type: state.Type}
+	switch state.Type {
+	case CRDTCounter:
+		for _, count := range state.Inc {
+			v.Count += int64(count)
+		}
+		for _, count := range state.Dec {
+			v.Count -= int64(count)
+		}
+	case CRDTSet:
+		v.Members = make([]string, 0, len(state.Adds))
+		for member := range state.Adds {
+			v.Members = append(v.Members, member)
+		}
+		sort.Strings(v.Members)
+	case CRDTRegister:
+		v.Value = state.Value
+	}
+	return v
+}
+
+// String describes v for a reply.
+func (v CRDTValue) String() string {
+	switch v.Type {
+	case CRDTCounter:
+		return fmt.Sprintf("%s = %d", v.Key, v.Count)
+	case CRDTSet:
+		quoted := make([]string, len(v.Members))
+		for i, member := range v.Members {
+			quoted[i] = strconv.Quote(member)
+		}
+		return fmt.Sprintf("%s = {%s}", v.Key, strings.Join(quoted, ", "))
+	}
+	return fmt.Sprintf("%s = %s", v.Key, v.Value)
+}
+
+// Incr adds delta, which may be negative, to the counter under key and
+// returns its value afterwards. A missing key counts from zero.
+func (n *Node) Incr(key string, delta int64) (int64, error) {
+	v, err := n.updateCall(key, "incr", strconv.FormatInt(delta, 10))
+	return v.Count, err
+}
+
+// SAdd adds members to the set under key.
+func (n *Node) SAdd(key string, members ...string) error {
+	data, _ := json.Marshal(members)
+	_, err := n.updateCall(key, "sadd", string(data))
+	return err
+}
+
+// SRem removes members from the set under key. Adds this node's
+// coordinator has not seen yet are kept.
+func (n *Node) SRem(key string, members ...string) error {
+	data, _ := json.Marshal(members)
+	_, err := n.updateCall(key, "srem", string(data))
+	return err
+}
+
+// SetRegister writes value to the register under key.
+func (n *Node) SetRegister(key, value string) error {
+	_, err := n.updateCall(key, "rset", value)
+	return err
+}
+
+// ReadCRDT reads the replicated data type under key through its
+// coordinator. found is false if the key is missing.
+func (n *Node) ReadCRDT(key string) (v CRDTValue, found bool, err error) {
+	reply, err := n.kvCall(Message{Type: "get", Key: key})
+	if err != nil || !reply.Found {
+		return CRDTValue{}, false, err
+	}
+	state, err := parseCRDT(reply.Value)
+	if err != nil {
+		return CRDTValue{}, true, fmt.Errorf("%w: %s holds a plain value", err, key)
+	}
+	return crdtValue(key, state), true, nil
+}
+
+// clientCRDT serves a client's update or read of a replicated data type,
+// replying with its value.
+func (n *Node) clientCRDT(msg Message) Message {
+	var (
+		v     CRDTValue
+		found = true
+		err   error
+	)
+	if msg.Type == "update" {
+		v, err = n.updateCall(msg.Key, msg.Content, msg.Value)
+	} else {
+		v, found, err = n.ReadCRDT(msg.Key)
+	}
+	if err != nil {
+		return Message{Type: "kv_result", Key: msg.Key, Error: err.Error()}
+	}
+	data, _ := json.Marshal(v)
+	return Message{Type: "kv_result", Key: msg.Key, Found: found, Content: string(data)}
+}
+
+// updateCall applies an update to key on its coordinator and returns the
+// value afterwards.
+func (n *Node) updateCall(key, op, arg string) (CRDTValue, error) {
+	msg := Message{Type: "update", Key: key, Content: op, Value: arg}
+	if target := n.kvTarget(msg); target != n.ID && !n.PeerSupports(target, CapCRDT) {
+		return CRDTValue{}, fmt.Errorf("node %d coordinating %s does not support replicated data types", target, key)
+	}
+	reply, err := n.kvCall(msg)
+	if err != nil {
+		return CRDTValue{}, err
+	}
+	state, err := parseCRDT(reply.Value)
+	if err != nil {
+		return CRDTValue{}, err
+	}
+	return crdtValue(key, state), nil
+}
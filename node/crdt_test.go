@@ -0,0 +1,155 @@
+package node
+
+import (
+	"slices"
+	"testing"
+)
+
+// crdtUpdate is an update to a replicated data type, made by node at time.
+type crdtUpdate struct {
+	node int
+	time uint64
+	op   string
+	arg  string
+}
+
+// crdtAfter returns the state updates leave, applied in order to an empty
+// state.
+func crdtAfter(t *testing.T, updates ...crdtUpdate) crdtState {
+	t.Helper()
+	state := crdtState{Type: crdtOps[updates[0].op]}
+	for _, u := range updates {
+		if err := state.apply(u.node, Timestamp{Time: u.time, Node: u.node}, u.op, u.arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state
+}
+
+func TestCRDTMergeLaws(t *testing.T) {
+	cases := []struct {
+		name    string
+		a, b, c []crdtUpdate
+	}{
+		{
+			name: "counter",
+			a:    []crdtUpdate{{1, 1, "incr", "3"}, {1, 2, "incr", "-1"}},
+			b:    []crdtUpdate{{2, 1, "incr", "5"}, {2, 3, "incr", "-2"}},
+			c:    []crdtUpdate{{1, 1, "incr", "1"}, {3, 4, "incr", "4"}},
+		},
+		{
+			name: "set",
+			a:    []crdtUpdate{{1, 1, "sadd", `["x","y"]`}},
+			b:    []crdtUpdate{{1, 1, "sadd", `["x","y"]`}, {2, 2, "srem", `["x"]`}},
+			c:    []crdtUpdate{{2, 2, "sadd", `["x"]`}, {3, 3, "sadd", `["z"]`}, {3, 4, "srem", `["z"]`}},
+		},
+		{
+			name: "register",
+			a:    []crdtUpdate{{1, 1, "rset", "one"}},
+			b:    []crdtUpdate{{2, 2, "rset", "two"}},
+			c:    []crdtUpdate{{3, 2, "rset", "three"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b, c := crdtAfter(t, tc.a...), crdtAfter(t, tc.b...), crdtAfter(t, tc.c...)
+			if ab, ba := a.merge(b).encode(), b.merge(a).encode(); ab != ba {
+				t.Errorf("merge is not commutative: %s != %s", ab, ba)
+			}
+			if left, right := a.merge(b).merge(c).encode(), a.merge(b.merge(c)).encode(); left != right {
+				t.Errorf("merge is not associative: %s != %s", left, right)
+			}
+			for _, s := range []crdtState{a, b, c, a.merge(b)} {
+				if merged := s.merge(s).encode(); merged != s.encode() {
+					t.Errorf("merge is not idempotent: %s merged with itself is %s", s.encode(), merged)
+				}
+			}
+
+			// Entries merge the same way wherever replicas meet
+			ea := Entry{Value: a.encode(), Timestamp: Timestamp{Time: 10, Node: 1}}
+			eb := Entry{Value: b.encode(), Timestamp: Timestamp{Time: 11, Node: 2}}
+			ec := Entry{Value: c.encode(), Timestamp: Timestamp{Time: 10, Node: 3}}
+			if ab, ba := mergeCRDT(ea, eb), mergeCRDT(eb, ea); ab.Value != ba.Value || ab.Timestamp != ba.Timestamp {
+				t.Errorf("mergeCRDT is not commutative: %+v != %+v", ab, ba)
+			}
+			left, right := mergeCRDT(mergeCRDT(ea, eb), ec), mergeCRDT(ea, mergeCRDT(eb, ec))
+			if left.Value != right.Value || left.Timestamp != right.Timestamp {
+				t.Errorf("mergeCRDT is not associative: %+v != %+v", left, right)
+			}
+			for _, e := range []Entry{ea, eb, ec} {
+				if merged := mergeCRDT(e, e); merged.Value != e.Value || merged.Timestamp != e.Timestamp {
+					t.Errorf("mergeCRDT is not idempotent: %+v merged with itself is %+v", e, merged)
+				}
+			}
+		})
+	}
+}
+
+func TestORSetAddWinsOverConcurrentRemove(t *testing.T) {
+	base := []crdtUpdate{{1, 1, "sadd", `["x","y"]`}}
+	cases := []struct {
+		name        string
+		left, right []crdtUpdate
+		want        []string
+	}{
+		{
+			name:  "concurrent add and remove",
+			left:  append(slices.Clone(base), crdtUpdate{2, 2, "srem", `["x"]`}),
+			right: append(slices.Clone(base), crdtUpdate{3, 2, "sadd", `["x"]`}),
+			want:  []string{"x", "y"},
+		},
+		{
+			name:  "remove after the add",
+			left:  append(slices.Clone(base), crdtUpdate{3, 2, "sadd", `["x"]`}, crdtUpdate{2, 3, "srem", `["x"]`}),
+			right: append(slices.Clone(base), crdtUpdate{3, 2, "sadd", `["x"]`}),
+			want:  []string{"y"},
+		},
+		{
+			name:  "concurrent removes",
+			left:  append(slices.Clone(base), crdtUpdate{2, 2, "srem", `["x"]`}),
+			right: append(slices.Clone(base), crdtUpdate{3, 2, "srem", `["x","y"]`}),
+			want:  []string{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			left, right := crdtAfter(t, tc.left...), crdtAfter(t, tc.right...)
+			for _, merged := range []crdtState{left.merge(right), right.merge(left)} {
+				if members := crdtValue("s", merged).Members; !slices.Equal(members, tc.want) {
+					t.Errorf("members = %q, want %q", members, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPNCounterDecrements(t *testing.T) {
+	cases := []struct {
+		name     string
+		replicas [][]crdtUpdate
+		want     int64
+	}{
+		{"decrement", [][]crdtUpdate{{{1, 1, "incr", "5"}, {1, 2, "incr", "-3"}}}, 2},
+		{"below zero", [][]crdtUpdate{{{1, 1, "incr", "-4"}}}, -4},
+		{"decrements on different nodes", [][]crdtUpdate{
+			{{1, 1, "incr", "5"}},
+			{{2, 1, "incr", "-7"}},
+			{{3, 1, "incr", "-1"}, {3, 2, "incr", "2"}},
+		}, -1},
+		{"replicas of one node's decrements", [][]crdtUpdate{
+			{{1, 1, "incr", "-2"}},
+			{{1, 1, "incr", "-2"}, {1, 2, "incr", "-3"}},
+		}, -5},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged := crdtAfter(t, tc.replicas[0]...)
+			for _, updates := range tc.replicas[1:] {
+				merged = merged.merge(crdtAfter(t, updates...))
+			}
+			if count := crdtValue("c", merged).Count; count != tc.want {
+				t.Errorf("count = %d, want %d", count, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronFieldBounds are the allowed values of the five fields of a cron
+// spec: minute, hour, day of month, month and day of week (0 is Sunday).
+var cronFieldBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Cron is a parsed five-field cron spec, "minute hour day-of-month month
+// day-of-week". Each field is *, a value, a range a-b, a step */n or a-b/n,
+// or a comma separated list of those. As in cron, if both day fields are
+// restricted a time matches when either does.
+type Cron struct {
+	spec   string
+	fields [5]map[int]bool
+	any    [5]bool
+}
+
+// ParseCron parses a five-field cron spec.
+func ParseCron(spec string) (*Cron, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("invalid cron spec %q: expected 5 fields, got %d", spec, len(parts))
+	}
+	c := &Cron{spec: strings.Join(parts, " ")}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronFieldBounds[i][0], cronFieldBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron spec %q: %v", spec, err)
+		}
+		c.fields[i] = values
+		c.any[i] = part == "*"
+	}
+	return c, nil
+}
+
+// parseCronField returns the values a cron field allows, between lo and hi.
+func parseCronField(field string, lo, hi int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("bad step in %q", item)
+			}
+			rng, step = item[:i], s
+		}
+
+		from, to := lo, hi
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad value %q", item)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad value %q", item)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", item, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// String returns the spec c was parsed from.
+func (c *Cron) String() string {
+	return c.spec
+}
+
+// Next returns the first minute after t that c matches, or the zero time if
+// there is none within five years (e.g. February 30th).
+func (c *Cron) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	end := t.AddDate(5, 0, 0)
+	for ; t.Before(end); t = t.Add(time.Minute) {
+		if !c.fields[3][int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.fields[1][t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.fields[0][t.Minute()] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether the day of t matches c's day fields.
+func (c *Cron) matchesDay(t time.Time) bool {
+	dom := c.fields[2][t.Day()]
+	dow := c.fields[4][int(t.Weekday())]
+	switch {
+	case c.any[2] && c.any[4]:
+		return true
+	case c.any[2]:
+		return dow
+	case c.any[4]:
+		return dom
+	}
+	return dom || dow
+}
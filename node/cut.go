@@ -0,0 +1,334 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A cluster snapshot is a consistent cut of the whole cluster, taken with
+// the Chandy-Lamport algorithm without stopping it: the state of every
+// node, and the messages that were in flight between them, as if all had
+// been recorded at one instant. The initiator records its state and sends
+// a marker to every peer; a node records its state on the first marker it
+// gets and passes the marker on to its own peers. From then on it records
+// the messages each peer sends it, until that peer's marker arrives: they
+// were sent before the peer recorded its state and received after this
+// node did, so they were in flight. Once every peer's marker arrived, the
+// node sends what it recorded to the initiator, which writes a file per
+// node to a directory.
+//
+// The algorithm needs each channel to be FIFO, which a node's connection
+// to a peer is; messages resent after a reconnection, over UDP, or delayed
+// by chaos can land on the wrong side of the cut. It also needs a node to
+// send its markers before anything it sends after recording its state, so
+// sends to peers wait while it does. Liveness messages, such as heartbeats
+// and acks, are not recorded.
+
+const (
+	// DefaultCutTimeout bounds a cluster snapshot unless the caller says
+	// otherwise.
+	DefaultCutTimeout = 30 * time.Second
+
+	cutManifestFile = "manifest.json"
+)
+
+// unrecordedTypes are the message types left out of the channel states.
+var unrecordedTypes = map[string]bool{
+	"heartbeat":      true,
+	"heartbeat_ack":  true,
+	"alive":          true,
+	"ack":            true,
+	"ping":           true,
+	"pong":           true,
+	"snapshot_mark":  true,
+	"snapshot_state": true,
+}
+
+// NodeCut is one node's part of a cluster snapshot: its state when it
+// recorded it and the messages in flight to it from each peer.
+type NodeCut struct {
+	Snapshot
+	SnapshotID string            `json:"snapshot_id"`
+	InFlight   map[int][]Message `json:"in_flight"`
+}
+
+// ClusterSnapshot describes a cluster snapshot: its manifest.
+type ClusterSnapshot struct {
+	ID        string    `json:"id"`
+	Initiator int       `json:"initiator"`
+	Started   time.Time `json:"started"`
+	Completed time.Time `json:"completed"`
+	Nodes     []int     `json:"nodes"`
+	Keys      int       `json:"keys"`
+	InFlight  int       `json:"in_flight"`
+}
+
+// cutMarker is the content of a marker.
+type cutMarker struct {
+	ID        string `json:"id"`
+	Initiator int    `json:"initiator"`
+}
+
+// cut is a snapshot this node takes part in and has not finished.
+type cut struct {
+	initiator int
+	state     NodeCut
+	// recording are the peers whose marker has not arrived yet.
+	recording map[int]bool
+	timer     *time.Timer
+}
+
+// Cuts are the cluster snapshots a node takes part in.
+type Cuts struct {
+	mutex sync.Mutex
+	cuts  map[string]*cut
+	// finished are snapshots done or given up here, so late markers do
+	// not start them over.
+	finished map[string]bool
+}
+
+func NewCuts() *Cuts {
+	return &Cuts{cuts: make(map[string]*cut), finished: make(map[string]bool)}
+}
+
+// observe records msg, from a peer, in the channel state of every
+// snapshot still waiting for that peer's marker.
+func (c *Cuts) observe(msg Message) {
+	if msg.Client || unrecordedTypes[msg.Type] {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, cut := range c.cuts {
+		if cut.recording[msg.From] {
+			cut.state.InFlight[msg.From] = append(cut.state.InFlight[msg.From], msg)
+		}
+	}
+}
+
+// snapshotPeers returns the connected peers that take part in cluster
+// snapshots.
+func (n *Node) snapshotPeers() []int {
+	n.mutex.RLock()
+	ids := make([]int, 0, len(n.conn))
+	for id := range n.conn {
+		ids = append(ids, id)
+	}
+	n.mutex.RUnlock()
+
+	peers := ids[:0]
+	for _, id := range ids {
+		if n.PeerSupports(id, CapSnapshot) {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// mark handles a marker of snapshot marker.ID from peer from, or starts the
+// snapshot on its initiator if from is -1. The first marker records this
+// node's state and passes the marker on; the rest end the recording of
+// their channel. The snapshot is given up after timeout.
+func (n *Node) mark(marker cutMarker, from int, timeout time.Duration) {
+	// No other message may get between the state and the markers
+	n.cutGate.Lock()
+	n.cuts.mutex.Lock()
+	if n.cuts.finished[marker.ID] {
+		n.cuts.mutex.Unlock()
+		n.cutGate.Unlock()
+		return
+	}
+	c, ok := n.cuts.cuts[marker.ID]
+	var peers []int
+	if !ok {
+		peers = n.snapshotPeers()
+		c = &cut{
+			initiator: marker.Initiator,
+			state:     NodeCut{Snapshot: n.Snapshot(), SnapshotID: marker.ID, InFlight: make(map[int][]Message)},
+			recording: make(map[int]bool, len(peers)),
+		}
+		for _, id := range peers {
+			if id != from {
+				c.recording[id] = true
+			}
+		}
+		c.timer = time.AfterFunc(timeout, func() { n.abandonCut(marker.ID) })
+		n.cuts.cuts[marker.ID] = c
+		n.logger.Debug("recorded state for cluster snapshot", "snapshot", marker.ID, "initiator", marker.Initiator, "keys", len(c.state.Data))
+	} else {
+		delete(c.recording, from)
+	}
+	done := len(c.recording) == 0
+	if done {
+		c.timer.Stop()
+		delete(n.cuts.cuts, marker.ID)
+		n.cuts.finished[marker.ID] = true
+	}
+	n.cuts.mutex.Unlock()
+
+	if !ok {
+		content, _ := json.Marshal(marker)
+		for _, id := range peers {
+			n.enqueue(noWait, id, Message{Type: "snapshot_mark", From: n.ID, Content: string(content), Timeout: timeout}, true)
+		}
+	}
+	n.cutGate.Unlock()
+
+	if done {
+		n.sendCut(c)
+	}
+}
+
+// sendCut sends this node's part of a finished snapshot to its initiator.
+func (n *Node) sendCut(c *cut) {
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		n.logger.Error("failed to encode cluster snapshot", "snapshot", c.state.SnapshotID, "err", err)
+		return
+	}
+	msg := Message{Type: "snapshot_state", From: n.ID, RequestID: c.state.SnapshotID, Content: string(data)}
+	if c.initiator == n.ID {
+		n.deliver(msg)
+		return
+	}
+	if err := n.sendMessage(c.initiator, msg); err != nil {
+		n.peerLogger(c.initiator, msg.Type).Warn("failed to send cluster snapshot", "snapshot", c.state.SnapshotID, "err", err)
+	}
+}
+
+// abandonCut gives up a snapshot whose markers did not all arrive in time.
+func (n *Node) abandonCut(id string) {
+	n.cuts.mutex.Lock()
+	defer n.cuts.mutex.Unlock()
+
+	c, ok := n.cuts.cuts[id]
+	if !ok {
+		return
+	}
+	delete(n.cuts.cuts, id)
+	n.cuts.finished[id] = true
+	waiting := make([]int, 0, len(c.recording))
+	for peer := range c.recording {
+		waiting = append(waiting, peer)
+	}
+	sort.Ints(waiting)
+	n.logger.Warn("gave up cluster snapshot", "snapshot", id, "waiting_for", waiting)
+}
+
+// handleMark handles a marker a peer sent.
+func (n *Node) handleMark(msg Message) {
+	var marker cutMarker
+	if err := json.Unmarshal([]byte(msg.Content), &marker); err != nil || marker.ID == "" {
+		n.peerLogger(msg.From, msg.Type).Warn("invalid snapshot marker", "err", err)
+		return
+	}
+	timeout := msg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCutTimeout
+	}
+	n.mark(marker, msg.From, timeout)
+}
+
+// SnapshotCluster takes a consistent snapshot of the cluster and writes
+// each node's part to <dir>/node-<id>.json and a manifest listing them to
+// <dir>/manifest.json. It fails if a node connected to this one did not
+// send its part within timeout.
+func (n *Node) SnapshotCluster(dir string, timeout time.Duration) (ClusterSnapshot, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return ClusterSnapshot{}, err
+	}
+	snap := ClusterSnapshot{ID: newTaskID(), Initiator: n.ID, Started: time.Now()}
+	expected := map[int]bool{n.ID: true}
+	for _, id := range n.snapshotPeers() {
+		expected[id] = true
+	}
+	// Nodes this one is not connected to may take part too
+	states := n.expect(snap.ID, 2*len(expected))
+	defer n.cancelExpect(snap.ID)
+
+	n.logger.Info("starting cluster snapshot", "snapshot", snap.ID, "nodes", len(expected))
+	n.mark(cutMarker{ID: snap.ID, Initiator: n.ID}, -1, timeout)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var cuts []NodeCut
+	for received := 0; received < len(expected); {
+		select {
+		case msg := <-states:
+			var c NodeCut
+			if err := json.Unmarshal([]byte(msg.Content), &c); err != nil {
+				return snap, fmt.Errorf("invalid snapshot from node %d: %v", msg.From, err)
+			}
+			cuts = append(cuts, c)
+			if expected[c.NodeID] {
+				received++
+			}
+		case <-deadline.C:
+			var missing []int
+			for id := range expected {
+				if !hasCut(cuts, id) {
+					missing = append(missing, id)
+				}
+			}
+			sort.Ints(missing)
+			return snap, fmt.Errorf("cluster snapshot timed out after %v waiting for nodes %v", timeout, missing)
+		case <-n.done:
+			return snap, fmt.Errorf("node is shutting down")
+		}
+	}
+	// Parts that arrived along with the last expected one
+	for len(states) > 0 {
+		var c NodeCut
+		if json.Unmarshal([]byte((<-states).Content), &c) == nil {
+			cuts = append(cuts, c)
+		}
+	}
+	snap.Completed = time.Now()
+
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].NodeID < cuts[j].NodeID })
+	for _, c := range cuts {
+		snap.Nodes = append(snap.Nodes, c.NodeID)
+		snap.Keys += len(c.Data)
+		for _, msgs := range c.InFlight {
+			snap.InFlight += len(msgs)
+		}
+		if err := writeJSONFile(filepath.Join(dir, "node-"+strconv.Itoa(c.NodeID)+".json"), c); err != nil {
+			return snap, err
+		}
+	}
+	if err := writeJSONFile(filepath.Join(dir, cutManifestFile), snap); err != nil {
+		return snap, err
+	}
+	n.logger.Info("cluster snapshot complete", "snapshot", snap.ID, "nodes", snap.Nodes, "in_flight", snap.InFlight, "took", snap.Completed.Sub(snap.Started))
+	return snap, nil
+}
+
+// hasCut reports whether cuts has node id's part.
+func hasCut(cuts []NodeCut, id int) bool {
+	for _, c := range cuts {
+		if c.NodeID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONFile writes v, indented, to path atomically.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
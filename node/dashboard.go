@@ -0,0 +1,138 @@
+package node
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentMessageCount is how many received messages the dashboard shows.
+const recentMessageCount = 100
+
+// dashboardPage is the dashboard served at /dashboard. It polls
+// /dashboard/data once a second and draws everything client side.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// MessageSummary describes a received message for the dashboard.
+type MessageSummary struct {
+	Time    time.Time `json:"time"`
+	From    int       `json:"from"`
+	Type    string    `json:"type"`
+	TaskID  string    `json:"task_id,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Content string    `json:"content,omitempty"`
+}
+
+// summaryContentLimit truncates the content kept of each recent message.
+const summaryContentLimit = 120
+
+// RecentMessages keeps the last few messages a node received, oldest
+// first, overwriting the oldest once full.
+type RecentMessages struct {
+	mutex    sync.Mutex
+	messages []MessageSummary
+	next     int
+}
+
+func NewRecentMessages(size int) *RecentMessages {
+	return &RecentMessages{messages: make([]MessageSummary, 0, size)}
+}
+
+// Record adds msg, received now.
+func (r *RecentMessages) Record(msg Message) {
+	summary := MessageSummary{
+		Time:    time.Now(),
+		From:    msg.From,
+		Type:    msg.Type,
+		TaskID:  msg.TaskID,
+		Key:     msg.Key,
+		Content: msg.Content,
+	}
+	if len(summary.Content) > summaryContentLimit {
+		summary.Content = summary.Content[:summaryContentLimit] + "..."
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.messages) < cap(r.messages) {
+		r.messages = append(r.messages, summary)
+		return
+	}
+	r.messages[r.next] = summary
+	r.next = (r.next + 1) % len(r.messages)
+}
+
+// List returns the recorded messages, oldest first.
+func (r *RecentMessages) List() []MessageSummary {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]MessageSummary, 0, len(r.messages))
+	list = append(list, r.messages[r.next:]...)
+	return append(list, r.messages[:r.next]...)
+}
+
+// DashboardPeer is a peer as the dashboard shows it.
+type DashboardPeer struct {
+	ID       int       `json:"id"`
+	Address  string    `json:"address"`
+	Role     string    `json:"role"`
+	Version  int       `json:"version,omitempty"`
+	Health   string    `json:"health"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+}
+
+// DashboardData is what the dashboard polls for: the node's status, its
+// peers and how recently each was heard from, running totals the page
+// turns into throughput graphs, and the last messages received.
+type DashboardData struct {
+	Time     time.Time        `json:"time"`
+	Status   NodeStatus       `json:"status"`
+	Peers    []DashboardPeer  `json:"peers"`
+	Totals   MetricTotals     `json:"totals"`
+	Messages []MessageSummary `json:"messages"`
+}
+
+func (n *Node) dashboardData() DashboardData {
+	status := n.Status()
+	health := n.detector.Status()
+
+	peers := make([]DashboardPeer, 0, len(status.Peers))
+	for id, addr := range status.Peers {
+		peer := DashboardPeer{
+			ID:      id,
+			Address: addr,
+			Role:    status.Roles[id],
+			Version: status.Versions[id],
+			Health:  "unknown",
+		}
+		if h, ok := health[id]; ok {
+			peer.Health = h.Status
+			peer.LastSeen = h.LastSeen
+		}
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+
+	return DashboardData{
+		Time:     time.Now(),
+		Status:   status,
+		Peers:    peers,
+		Totals:   n.metrics.Totals(),
+		Messages: n.recent.List(),
+	}
+}
+
+func (n *Node) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+func (n *Node) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.dashboardData())
+}
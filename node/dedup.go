@@ -0,0 +1,156 @@
+package node
+
+import (
+	"context"
+	"sync"
+)
+
+// Tasks are delivered at least once, so a task whose ack was lost arrives
+// again, and a client or peer retrying after a timeout sends it again. A
+// node remembers the idempotency keys of the last dedupCacheSize tasks it
+// ran: a task with a key it has seen is not run again, but answered with
+// the first run's result once there is one. Tasks sent by SendTask are
+// keyed by their task id, which covers retransmissions; SendIdempotentTask
+// and the client's SubmitIdempotentTask take a key from the caller, which
+// covers retries with a new task id too. Client tasks without a key are not
+// deduplicated.
+
+// dedupCacheSize bounds how many idempotency keys a node remembers.
+const dedupCacheSize = 10000
+
+// dedupEntry is a task run under an idempotency key. done is closed once
+// result is set.
+type dedupEntry struct {
+	taskID   string
+	result   Message
+	done     chan struct{}
+	rejected bool
+}
+
+// Dedup remembers recently run tasks by idempotency key, evicting the
+// oldest key once it holds size of them.
+type Dedup struct {
+	mutex   sync.Mutex
+	entries map[string]*dedupEntry
+	keys    []string
+	next    int
+}
+
+func NewDedup(size int) *Dedup {
+	return &Dedup{entries: make(map[string]*dedupEntry), keys: make([]string, size)}
+}
+
+// begin records that task taskID runs under key. It reports false, with
+// the entry of the first run, if the key has been seen before and that run
+// was not rejected.
+func (d *Dedup) begin(key, taskID string) (*dedupEntry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if entry, ok := d.entries[key]; ok {
+		if !entry.rejected {
+			return entry, false
+		}
+		// The first run never happened; this one takes over its slot
+		*entry = dedupEntry{taskID: taskID, done: make(chan struct{})}
+		return entry, true
+	}
+
+	if old := d.keys[d.next]; old != "" {
+		delete(d.entries, old)
+	}
+	d.keys[d.next] = key
+	d.next = (d.next + 1) % len(d.keys)
+	entry := &dedupEntry{taskID: taskID, done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, true
+}
+
+// finish records the result of the task run under key.
+func (d *Dedup) finish(key string, result Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if entry, ok := d.entries[key]; ok && entry.result.Type == "" {
+		entry.result = result
+		close(entry.done)
+	}
+}
+
+// reject records that the task under key was turned away without running,
+// so the next copy of it runs.
+func (d *Dedup) reject(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if entry, ok := d.entries[key]; ok && entry.result.Type == "" {
+		entry.rejected = true
+	}
+}
+
+// taskKey returns the idempotency key of task msg: its own key if it has
+// one, else its task id for tasks from peers. Client tasks without a key
+// are not deduplicated.
+func taskKey(msg Message) string {
+	if msg.IdempotencyKey != "" {
+		return msg.IdempotencyKey
+	}
+	if msg.Client {
+		return ""
+	}
+	return msg.TaskID
+}
+
+// duplicateTask reports whether task msg from a peer is a copy of one this
+// node ran or is running. A copy of a finished task is answered with its
+// result; one of a running task under a new task id is answered once it
+// finishes. Copies of a running task under the same id are dropped, as the
+// result is on its way.
+func (n *Node) duplicateTask(msg Message) bool {
+	key := taskKey(msg)
+	entry, fresh := n.dedup.begin(key, msg.TaskID)
+	if fresh {
+		return false
+	}
+	n.metrics.TaskDeduplicated()
+	n.peerLogger(msg.From, msg.Type).Info("skipping duplicate task", "task", msg.TaskID, "key", key, "first", entry.taskID)
+
+	select {
+	case <-entry.done:
+	default:
+		if msg.TaskID == entry.taskID {
+			return true
+		}
+	}
+	go func() {
+		select {
+		case <-entry.done:
+		case <-n.done:
+			return
+		}
+		n.sendReliable(msg.From, cachedResult(entry.result, msg), 0)
+	}()
+	return true
+}
+
+// cachedResult returns result, the reply to an earlier run of task msg,
+// addressed as the reply to msg.
+func cachedResult(result Message, msg Message) Message {
+	result.TaskID = msg.TaskID
+	result.RequestID = msg.RequestID
+	result.TraceID = msg.TraceID
+	result.SpanID = ""
+	result.Seq = 0
+	return result
+}
+
+// cachedClientResult waits until ctx ends for the first run of a client
+// task under the same key and returns its result, addressed to msg.
+func cachedClientResult(ctx context.Context, entry *dedupEntry, msg Message) Message {
+	select {
+	case <-entry.done:
+		return cachedResult(entry.result, msg)
+	case <-ctx.Done():
+		return Message{Type: "result", TaskID: msg.TaskID, Error: "task timed out"}
+	}
+}
@@ -0,0 +1,356 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With discovery configured, a node finds cluster members to join through
+// on startup itself, instead of, or besides, its join list: from a static
+// list, the SRV records of a DNS name, such as a Kubernetes headless
+// service, or the pods the Kubernetes API lists for a label selector, so
+// the nodes of a StatefulSet find each other without knowing their
+// addresses beforehand. The node joins through the first member it reaches
+// and starts a cluster of its own if it reaches none. It then runs
+// discovery again every interval and joins members it is not connected to,
+// so nodes started at the same time, each on a cluster of its own, merge
+// once they see each other.
+
+const (
+	DiscoveryStatic     = "static"
+	DiscoveryDNS        = "dns"
+	DiscoveryKubernetes = "kubernetes"
+
+	defaultDiscoveryInterval = 30 * time.Second
+	// discoveryTimeout bounds a single discovery.
+	discoveryTimeout = 10 * time.Second
+
+	// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// Discovery finds the addresses of cluster members.
+type Discovery interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// DiscoveryConfig configures discovery; see Config.Discoverer for other
+// implementations.
+type DiscoveryConfig struct {
+	// Type is static, dns or kubernetes; discovery is off if it is empty.
+	Type string `yaml:"type"`
+	// Addresses are the members static discovery returns.
+	Addresses []string `yaml:"addresses"`
+	// Name is the DNS name whose SRV records dns discovery looks up, e.g.
+	// _dbs._tcp.dbs.default.svc.cluster.local.
+	Name string `yaml:"name"`
+	// Selector is the label selector of the pods kubernetes discovery
+	// lists, e.g. app=dbs, in Namespace, the node's own by default.
+	Selector  string `yaml:"selector"`
+	Namespace string `yaml:"namespace"`
+	// Port is the port pods listen on for peers, the node's own by
+	// default.
+	Port int `yaml:"port"`
+	// Interval is how often discovery runs again after startup, 30s by
+	// default.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ParseDiscovery parses a --discovery flag: static:<address,...>,
+// dns:<name> or kubernetes:<selector>.
+func ParseDiscovery(spec string) (DiscoveryConfig, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	cfg := DiscoveryConfig{Type: kind}
+	switch kind {
+	case DiscoveryStatic:
+		for _, address := range strings.Split(arg, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				cfg.Addresses = append(cfg.Addresses, address)
+			}
+		}
+	case DiscoveryDNS:
+		cfg.Name = arg
+	case DiscoveryKubernetes:
+		cfg.Selector = arg
+	default:
+		return DiscoveryConfig{}, fmt.Errorf("invalid discovery %q: expected static:<address,...>, dns:<name> or kubernetes:<selector>", spec)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c DiscoveryConfig) validate() error {
+	switch c.Type {
+	case "":
+	case DiscoveryStatic:
+		if len(c.Addresses) == 0 {
+			return errors.New("static discovery needs addresses")
+		}
+	case DiscoveryDNS:
+		if c.Name == "" {
+			return errors.New("dns discovery needs a name")
+		}
+	case DiscoveryKubernetes:
+		if c.Selector == "" {
+			return errors.New("kubernetes discovery needs a label selector")
+		}
+	default:
+		return fmt.Errorf("discovery type must be static, dns or kubernetes, not %q", c.Type)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid discovery port %d", c.Port)
+	}
+	if c.Interval < 0 {
+		return errors.New("discovery interval must not be negative")
+	}
+	return nil
+}
+
+// discoverer returns the discovery the config names, or nil. bound is the
+// address the node listens on.
+func (c Config) discoverer(bound string) Discovery {
+	if c.Discoverer != nil {
+		return c.Discoverer
+	}
+	switch c.Discovery.Type {
+	case DiscoveryStatic:
+		return StaticDiscovery(c.Discovery.Addresses)
+	case DiscoveryDNS:
+		return DNSDiscovery{Name: c.Discovery.Name}
+	case DiscoveryKubernetes:
+		port := c.Discovery.Port
+		if port == 0 {
+			_, bound, _ := net.SplitHostPort(bound)
+			port, _ = strconv.Atoi(bound)
+		}
+		return &KubernetesDiscovery{Selector: c.Discovery.Selector, Namespace: c.Discovery.Namespace, Port: port}
+	}
+	return nil
+}
+
+// StaticDiscovery returns a fixed list of addresses.
+type StaticDiscovery []string
+
+func (s StaticDiscovery) Discover(context.Context) ([]string, error) {
+	return s, nil
+}
+
+// DNSDiscovery returns the targets of the SRV records of Name.
+type DNSDiscovery struct {
+	Name string
+	// Resolver looks the records up, net.DefaultResolver if nil.
+	Resolver *net.Resolver
+}
+
+func (d DNSDiscovery) Discover(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
+
+// KubernetesDiscovery returns the IPs of the running pods matching
+// Selector in Namespace, with Port, from the Kubernetes API. Run in a pod,
+// it uses the pod's service account, which needs permission to list pods.
+type KubernetesDiscovery struct {
+	Selector string
+	// Namespace is the pod's own if empty.
+	Namespace string
+	Port      int
+	// APIServer, Token and Client default to the in-cluster API server,
+	// the service account token and a client trusting the cluster's CA.
+	APIServer string
+	Token     string
+	Client    *http.Client
+}
+
+// podList is the part of a Kubernetes pod list discovery reads.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name              string  `json:"name"`
+			DeletionTimestamp *string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func (k *KubernetesDiscovery) Discover(ctx context.Context) ([]string, error) {
+	if err := k.inCluster(); err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/api/v1/namespaces/%s/pods?labelSelector=%s",
+		strings.TrimSuffix(k.APIServer, "/"), url.PathEscape(k.Namespace), url.QueryEscape(k.Selector))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.Token)
+	}
+	resp, err := k.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("list pods: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("list pods: %v", err)
+	}
+	var addresses []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" || pod.Metadata.DeletionTimestamp != nil {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(k.Port)))
+	}
+	return addresses, nil
+}
+
+// inCluster fills in what is not set from the pod's environment and
+// service account.
+func (k *KubernetesDiscovery) inCluster() error {
+	if k.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return errors.New("kubernetes discovery: not running in a pod (KUBERNETES_SERVICE_HOST is not set)")
+		}
+		k.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if k.Namespace == "" {
+		namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return fmt.Errorf("kubernetes discovery: no namespace set: %v", err)
+		}
+		k.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if k.Token == "" {
+		// A missing token leaves requests anonymous
+		if token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token")); err == nil {
+			k.Token = strings.TrimSpace(string(token))
+		}
+	}
+	if k.Client == nil {
+		client := &http.Client{Timeout: discoveryTimeout}
+		if caPEM, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt")); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(caPEM)
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+		k.Client = client
+	}
+	return nil
+}
+
+// joinAddresses returns the join list followed by the members discovery
+// finds, without this node's own address.
+func (n *Node) joinAddresses() []string {
+	addresses := append([]string(nil), n.config.Join...)
+	if n.discovery != nil {
+		ctx, cancel := context.WithTimeout(n.ctx, discoveryTimeout)
+		discovered, err := n.discovery.Discover(ctx)
+		cancel()
+		if err != nil {
+			n.logger.Warn("discovery failed", "err", err)
+		}
+		n.logger.Debug("discovered members", "addrs", discovered)
+		addresses = append(addresses, discovered...)
+	}
+
+	seen := map[string]bool{n.Address: true, n.bound: true}
+	var unique []string
+	for _, address := range addresses {
+		if !seen[address] {
+			seen[address] = true
+			unique = append(unique, address)
+		}
+	}
+	return unique
+}
+
+// runDiscovery joins the members discovery finds that this node is not
+// connected to, every interval, until the node shuts down.
+func (n *Node) runDiscovery() {
+	interval := n.config.Discovery.Interval
+	if interval == 0 {
+		interval = defaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.RLock()
+		known := make(map[string]bool, len(n.Peers))
+		for _, address := range n.Peers {
+			known[address] = true
+		}
+		n.mutex.RUnlock()
+		for _, address := range n.joinAddresses() {
+			if !known[address] {
+				n.joinDiscovered(address)
+			}
+		}
+	}
+}
+
+// joinDiscovered joins the cluster of the node at address, unless it is
+// connected to it already under another address.
+func (n *Node) joinDiscovered(address string) {
+	conn, hello, err := n.handshake(address)
+	if err != nil {
+		n.logger.Debug("discovered member unavailable", "addr", address, "err", err)
+		return
+	}
+	conn.Close()
+	n.mutex.RLock()
+	_, connected := n.conn[hello.From]
+	n.mutex.RUnlock()
+	if connected {
+		return
+	}
+
+	members, err := n.Join(address)
+	if members == nil {
+		n.peerLogger(hello.From, "").Warn("failed to join discovered member", "addr", address, "err", err)
+		return
+	}
+	if err != nil {
+		n.logger.Warn("joined with unreachable members", "err", err)
+	}
+	n.peerLogger(hello.From, "").Info("joined discovered member", "addr", address, "members", len(members))
+}
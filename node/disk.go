@@ -0,0 +1,615 @@
+package node
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	dataFileName = "data.log"
+
+	// recordHeaderSize is the size of a data log record before its key:
+	// CRC-32, key length, value length, timestamp time and node, expiry and
+	// flags.
+	recordHeaderSize = 4 + 4 + 4 + 8 + 8 + 8 + 1
+	flagsOffset      = recordHeaderSize - 1
+
+	// maxRecordSize bounds a single record so a corrupt length cannot make
+	// the scan allocate unbounded memory.
+	maxRecordSize = 256 << 20
+
+	flagDeleted   = 1
+	flagEncrypted = 2
+	// flagVersioned marks values packed with their version and siblings;
+	// see packVersions.
+	flagVersioned = 4
+
+	// compactMinGarbage is how many bytes of overwritten records the data
+	// log must hold before it is worth compacting.
+	compactMinGarbage = 4 << 20
+	compactInterval   = time.Minute
+)
+
+// diskRef locates an entry's record in the data log. Only keys and these
+// refs are kept in memory, so the data can be larger than RAM.
+type diskRef struct {
+	offset  int64
+	size    int
+	ts      Timestamp
+	expires int64
+	deleted bool
+	// stale is set for values that need re-encrypting with the active key.
+	stale bool
+}
+
+// entry returns the entry ref points to, without its value.
+func (ref diskRef) entry() Entry {
+	return Entry{Deleted: ref.deleted, Timestamp: ref.ts, Expires: ref.expires}
+}
+
+// diskEngine stores entries in an append-only data log, with an in-memory
+// index from each key to its latest record, in the style of Bitcask, and the
+// keys in order. Every write is appended, and with the always fsync policy
+// synced, before it returns, so the log needs no WAL in front of it.
+// Overwritten records are garbage until compaction rewrites the log with
+// only the latest record of each key.
+type diskEngine struct {
+	dir     string
+	file    *os.File
+	sync    syncer
+	size    int64
+	used    int64
+	index   map[string]diskRef
+	keys    *orderedKeys
+	clock   uint64
+	keyring *Keyring
+	logger  *slog.Logger
+	// resets counts truncations of the log, which end a compaction.
+	resets int
+}
+
+// dataLogExists reports whether dir holds a data log.
+func dataLogExists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, dataFileName))
+	return err == nil
+}
+
+// openDiskEngine opens (or creates) the data log in dir and indexes it,
+// synced as the fsync policy says and encrypting values with keyring if it
+// is not nil. A torn or corrupt record ends the log: it and anything after
+// it, left by a crash in the middle of a write, are truncated away. A value
+// keyring cannot decrypt fails the open.
+func openDiskEngine(dir, fsync string, keyring *Keyring, logger *slog.Logger) (*diskEngine, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, dataFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	d := &diskEngine{dir: dir, file: file, sync: syncer{policy: fsync}, index: make(map[string]diskRef), keys: newOrderedKeys(), keyring: keyring, logger: logger}
+	if err := d.scan(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// scan rebuilds the index from the data log.
+func (d *diskEngine) scan() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(d.file, 0, info.Size()))
+
+	var offset int64
+	for {
+		key, e, flags, size, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.logger.Warn("truncating damaged data log", "offset", offset, "dropped_bytes", info.Size()-offset, "err", err)
+			if err := d.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		encrypted := flags&flagEncrypted != 0
+		if encrypted {
+			if _, err := d.keyring.keyFor(key, []byte(e.Value)); err != nil {
+				return err
+			}
+		}
+		if _, ok := d.index[key]; !ok {
+			d.keys.add(key)
+		}
+		d.index[key] = diskRef{offset: offset, size: size, ts: e.Timestamp, expires: e.Expires, deleted: e.Deleted,
+			stale: e.Value != "" && !d.keyring.current([]byte(e.Value), encrypted)}
+		d.clock = max(d.clock, e.Timestamp.Time)
+		offset += int64(size)
+	}
+	d.size = offset
+	for _, ref := range d.index {
+		d.used += int64(ref.size)
+	}
+	return nil
+}
+
+// encode builds the record for e, with its value packed with its version
+// and siblings if it has any, and encrypted if the engine has a keyring.
+func (d *diskEngine) encode(key string, e Entry) []byte {
+	var flags byte
+	if len(e.Version) > 0 || len(e.Siblings) > 0 {
+		e.Value = packVersions(e)
+		flags |= flagVersioned
+	}
+	if d.keyring != nil && e.Value != "" {
+		e.Value = string(d.keyring.seal(key, []byte(e.Value)))
+		flags |= flagEncrypted
+	}
+	return encodeRecord(key, e, flags)
+}
+
+func encodeRecord(key string, e Entry, flags byte) []byte {
+	buf := make([]byte, recordHeaderSize+len(key)+len(e.Value))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(e.Value)))
+	binary.BigEndian.PutUint64(buf[12:], e.Timestamp.Time)
+	binary.BigEndian.PutUint64(buf[20:], uint64(e.Timestamp.Node))
+	binary.BigEndian.PutUint64(buf[28:], uint64(e.Expires))
+	buf[flagsOffset] = flags
+	if e.Deleted {
+		buf[flagsOffset] |= flagDeleted
+	}
+	copy(buf[recordHeaderSize:], key)
+	copy(buf[recordHeaderSize+len(key):], e.Value)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readRecord reads and verifies one record, returning io.EOF at a clean end
+// of the log.
+func readRecord(r io.Reader) (string, Entry, byte, int, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return "", Entry{}, 0, 0, io.EOF
+		}
+		return "", Entry{}, 0, 0, fmt.Errorf("torn record header: %v", err)
+	}
+	keyLen := binary.BigEndian.Uint32(header[4:])
+	valueLen := binary.BigEndian.Uint32(header[8:])
+	if uint64(keyLen)+uint64(valueLen) > maxRecordSize {
+		return "", Entry{}, 0, 0, fmt.Errorf("record of %d bytes exceeds the %d byte limit", uint64(keyLen)+uint64(valueLen), maxRecordSize)
+	}
+
+	record := make([]byte, recordHeaderSize+int(keyLen)+int(valueLen))
+	copy(record, header)
+	if _, err := io.ReadFull(r, record[recordHeaderSize:]); err != nil {
+		return "", Entry{}, 0, 0, fmt.Errorf("torn record: %v", err)
+	}
+	key, e, flags, err := decodeRecord(record)
+	return key, e, flags, len(record), err
+}
+
+// decodeRecord verifies and decodes a record and returns its flags. The
+// entry holds the value as it is stored, encrypted or packed if the flags
+// say so.
+func decodeRecord(record []byte) (string, Entry, byte, error) {
+	if len(record) < recordHeaderSize {
+		return "", Entry{}, 0, errors.New("short record")
+	}
+	if crc32.ChecksumIEEE(record[4:]) != binary.BigEndian.Uint32(record) {
+		return "", Entry{}, 0, errors.New("record checksum mismatch")
+	}
+	keyLen := int(binary.BigEndian.Uint32(record[4:]))
+	if recordHeaderSize+keyLen > len(record) {
+		return "", Entry{}, 0, errors.New("record key length out of range")
+	}
+	e := Entry{
+		Value:   string(record[recordHeaderSize+keyLen:]),
+		Deleted: record[flagsOffset]&flagDeleted != 0,
+		Timestamp: Timestamp{
+			Time: binary.BigEndian.Uint64(record[12:]),
+			Node: int(binary.BigEndian.Uint64(record[20:])),
+		},
+		Expires: int64(binary.BigEndian.Uint64(record[28:])),
+	}
+	return string(record[recordHeaderSize : recordHeaderSize+keyLen]), e, record[flagsOffset], nil
+}
+
+func (d *diskEngine) lookup(key string) (Entry, bool) {
+	ref, ok := d.index[key]
+	if !ok {
+		return Entry{}, false
+	}
+	e, err := d.read(ref)
+	if err != nil {
+		d.logger.Error("failed to read from data log", "key", key, "err", err)
+		return Entry{}, false
+	}
+	return e, true
+}
+
+func (d *diskEngine) read(ref diskRef) (Entry, error) {
+	return d.readFrom(d.file, ref)
+}
+
+// readFrom is read from file, the data log or the one it replaced.
+func (d *diskEngine) readFrom(file *os.File, ref diskRef) (Entry, error) {
+	record := make([]byte, ref.size)
+	if _, err := file.ReadAt(record, ref.offset); err != nil {
+		return Entry{}, err
+	}
+	key, e, flags, err := decodeRecord(record)
+	if err != nil {
+		return Entry{}, err
+	}
+	if flags&flagEncrypted != 0 {
+		value, err := d.keyring.open(key, []byte(e.Value))
+		if err != nil {
+			return Entry{}, err
+		}
+		e.Value = string(value)
+	}
+	if flags&flagVersioned != 0 {
+		if err := unpackVersions(&e); err != nil {
+			return Entry{}, fmt.Errorf("%q: %v", key, err)
+		}
+	}
+	return e, nil
+}
+
+func (d *diskEngine) meta(key string) (Entry, bool) {
+	ref, ok := d.index[key]
+	return ref.entry(), ok
+}
+
+func (d *diskEngine) put(key string, e Entry) error {
+	if err := d.sync.check(); err != nil {
+		return fmt.Errorf("append to data log: %v", err)
+	}
+	record := d.encode(key, e)
+	if _, err := d.file.Write(record); err != nil {
+		// Drop any partial record so later appends stay where the index
+		// expects them
+		d.file.Truncate(d.size)
+		return fmt.Errorf("append to data log: %v", err)
+	}
+	if err := d.sync.wrote(d.file); err != nil {
+		// The record may not have reached the disk, so the write fails
+		// and the record goes, as if the append had failed
+		d.file.Truncate(d.size)
+		return fmt.Errorf("sync data log: %v", err)
+	}
+
+	if old, ok := d.index[key]; ok {
+		d.used -= int64(old.size)
+	} else {
+		d.keys.add(key)
+	}
+	d.index[key] = diskRef{offset: d.size, size: len(record), ts: e.Timestamp, expires: e.Expires, deleted: e.Deleted}
+	d.size += int64(len(record))
+	d.used += int64(len(record))
+	return nil
+}
+
+func (d *diskEngine) each(fn func(key string, e Entry)) {
+	for key, ref := range d.index {
+		e, err := d.read(ref)
+		if err != nil {
+			d.logger.Error("failed to read from data log", "key", key, "err", err)
+			continue
+		}
+		fn(key, e)
+	}
+}
+
+func (d *diskEngine) eachMeta(fn func(key string, e Entry)) {
+	for key, ref := range d.index {
+		fn(key, ref.entry())
+	}
+}
+
+func (d *diskEngine) ascend(start, end string, fn func(key string, e Entry) bool) {
+	d.keys.ascend(start, func(key string) bool {
+		if !inRange(key, end) {
+			return false
+		}
+		e, err := d.read(d.index[key])
+		if err != nil {
+			d.logger.Error("failed to read from data log", "key", key, "err", err)
+			return true
+		}
+		return fn(key, e)
+	})
+}
+
+func (d *diskEngine) reset() error {
+	if err := d.file.Truncate(0); err != nil {
+		return fmt.Errorf("truncate data log: %v", err)
+	}
+	d.index = make(map[string]diskRef)
+	d.keys = newOrderedKeys()
+	d.size, d.used = 0, 0
+	d.resets++
+	return nil
+}
+
+func (d *diskEngine) close() error {
+	if err := d.sync.flush(d.file); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// garbage returns how many bytes of the log hold overwritten records.
+func (d *diskEngine) garbage() int64 {
+	return d.size - d.used
+}
+
+// stale returns how many values need re-encrypting with the active key.
+func (d *diskEngine) stale() int {
+	count := 0
+	for _, ref := range d.index {
+		if ref.stale {
+			count++
+		}
+	}
+	return count
+}
+
+// compaction rewrites the data log with only the latest record of each key,
+// tombstones included, in three steps so the store is locked only briefly:
+// beginCompaction takes a copy of the index under the store's lock, copy
+// writes the records it points to into a new log without the lock, and
+// finish, under the lock again, appends the records written meanwhile and
+// swaps the new log in atomically. Values not encrypted with the active key
+// are re-encrypted on the way.
+type compaction struct {
+	d       *diskEngine
+	file    *os.File
+	refs    map[string]diskRef
+	size    int64
+	resets  int
+	tmpPath string
+	tmp     *os.File
+	// index and offset locate the copied records in tmp.
+	index       map[string]diskRef
+	offset      int64
+	reencrypted int
+}
+
+// beginCompaction starts a compaction of the log as it is now. The store's
+// lock must be held.
+func (d *diskEngine) beginCompaction() *compaction {
+	return &compaction{d: d, file: d.file, refs: maps.Clone(d.index), size: d.size, resets: d.resets,
+		tmpPath: filepath.Join(d.dir, dataFileName) + ".compact"}
+}
+
+// copy writes the records of the copied index into a new log. It needs no
+// lock: the log is only appended to meanwhile, and reads it at offsets the
+// appends do not touch.
+func (c *compaction) copy() error {
+	tmp, err := os.OpenFile(c.tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	c.tmp = tmp
+
+	w := bufio.NewWriter(tmp)
+	c.index = make(map[string]diskRef, len(c.refs))
+	for key, ref := range c.refs {
+		record := make([]byte, ref.size)
+		if _, err := c.file.ReadAt(record, ref.offset); err != nil {
+			return fmt.Errorf("read %q: %v", key, err)
+		}
+		if ref.stale {
+			e, err := c.d.readFrom(c.file, ref)
+			if err != nil {
+				return fmt.Errorf("read %q: %v", key, err)
+			}
+			record = c.d.encode(key, e)
+			ref.size, ref.stale = len(record), false
+			c.reencrypted++
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		ref.offset = c.offset
+		c.index[key] = ref
+		c.offset += int64(ref.size)
+	}
+	return w.Flush()
+}
+
+// finish appends the records written since the compaction began to the new
+// log, syncs it and swaps it in, and returns how many values were
+// re-encrypted. The store's lock must be held.
+func (c *compaction) finish() (int, error) {
+	d := c.d
+	if d.resets != c.resets || d.file != c.file {
+		return 0, errors.New("the data log was reset during compaction")
+	}
+
+	// Appends since the copy began lie past c.size in the order they were
+	// made, so they go after the copied records as they are
+	tail := d.size - c.size
+	if _, err := io.Copy(c.tmp, io.NewSectionReader(d.file, c.size, tail)); err != nil {
+		return 0, err
+	}
+	index := make(map[string]diskRef, len(d.index))
+	var used int64
+	for key, ref := range d.index {
+		if ref.offset >= c.size {
+			ref.offset += c.offset - c.size
+		} else {
+			ref = c.index[key]
+		}
+		index[key] = ref
+		used += int64(ref.size)
+	}
+	if err := c.tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := c.tmp.Close(); err != nil {
+		return 0, err
+	}
+	c.tmp = nil
+
+	path := filepath.Join(d.dir, dataFileName)
+	if err := os.Rename(c.tmpPath, path); err != nil {
+		return 0, err
+	}
+	if dir, err := os.Open(d.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	d.file.Close()
+	d.file = file
+	d.sync.synced()
+	d.index = index
+	d.size, d.used = c.offset+tail, used
+	return c.reencrypted, nil
+}
+
+// close removes what is left of the new log after a failed compaction.
+func (c *compaction) close() {
+	if c.tmp != nil {
+		c.tmp.Close()
+	}
+	os.Remove(c.tmpPath)
+}
+
+// useDisk switches the store to the disk engine d, whose entries replace
+// the store's.
+func (s *Store) useDisk(d *diskEngine) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.engine = d
+	s.clock = max(s.clock, d.clock)
+}
+
+// Compact rewrites the store's data log without overwritten records and
+// returns its size before and after. It fails for stores kept in memory.
+// Reads and writes go on while the records are copied; see compaction.
+func (s *Store) Compact() (before, after int64, err error) {
+	before, after, _, err = s.compact(false)
+	return before, after, err
+}
+
+// compact compacts the store's data log, if it has one, unless onlyStale is
+// set and no value needs re-encrypting, and returns its size before and
+// after and how many values were re-encrypted.
+func (s *Store) compact(onlyStale bool) (before, after int64, reencrypted int, err error) {
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+
+	s.mutex.RLock()
+	d, ok := s.engine.(*diskEngine)
+	if !ok {
+		s.mutex.RUnlock()
+		if onlyStale {
+			return 0, 0, 0, nil
+		}
+		return 0, 0, 0, errors.New("the store is kept in memory; start the node with --storage=disk")
+	}
+	if onlyStale && d.stale() == 0 {
+		s.mutex.RUnlock()
+		return d.size, d.size, 0, nil
+	}
+	c := d.beginCompaction()
+	s.mutex.RUnlock()
+	defer c.close()
+
+	before = c.size
+	if err := c.copy(); err != nil {
+		return before, before, 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reencrypted, err = c.finish()
+	return before, d.size, reencrypted, err
+}
+
+// Flush syncs the writes to the store's data log that the fsync policy
+// left unsynced, if it has one.
+func (s *Store) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, ok := s.engine.(*diskEngine)
+	if !ok {
+		return nil
+	}
+	return d.sync.flush(d.file)
+}
+
+// reencrypt re-encrypts the values in the data log that are not encrypted
+// with the active key, if the store has one, by compacting it, and returns
+// how many there were.
+func (s *Store) reencrypt() (int, error) {
+	_, _, count, err := s.compact(true)
+	return count, err
+}
+
+// compactable reports whether the store's data log holds enough garbage to
+// be worth compacting: at least compactMinGarbage bytes, and more than its
+// live records.
+func (s *Store) compactable() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	d, ok := s.engine.(*diskEngine)
+	return ok && d.garbage() >= compactMinGarbage && d.garbage() > d.used
+}
+
+// runCompaction compacts the data log in the background whenever it holds
+// mostly overwritten records.
+func (n *Node) runCompaction() {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !n.store.compactable() {
+			continue
+		}
+		before, after, err := n.store.Compact()
+		if err != nil {
+			n.logger.Error("data log compaction failed", "err", err)
+			continue
+		}
+		n.logger.Info("compacted data log", "before_bytes", before, "after_bytes", after)
+	}
+}
+
+// Compact rewrites the node's data log without overwritten records; see
+// Store.Compact.
+func (n *Node) Compact() (before, after int64, err error) {
+	return n.store.Compact()
+}
@@ -0,0 +1,199 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// diskStore returns a store kept in a data log in a directory of its own.
+func diskStore(t *testing.T) (*Store, *diskEngine) {
+	t.Helper()
+	d, err := openDiskEngine(t.TempDir(), FsyncAlways, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.close() })
+	s := NewStore(1)
+	s.useDisk(d)
+	return s, d
+}
+
+func TestCompactionKeepsWritesMadeDuringCopy(t *testing.T) {
+	s, d := diskStore(t)
+	want := make(map[string]string)
+	for i := range 200 {
+		key := fmt.Sprintf("key%03d", i)
+		if _, err := s.Set(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "old"
+	}
+	// Garbage for the compaction to drop
+	for i := range 100 {
+		if _, err := s.Set(fmt.Sprintf("key%03d", i), "older"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Set(fmt.Sprintf("key%03d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.mutex.RLock()
+	c := d.beginCompaction()
+	s.mutex.RUnlock()
+	defer c.close()
+
+	// Overwrites, new keys and deletes land in the tail of the log while
+	// the records are copied
+	copied := make(chan error, 1)
+	go func() { copied <- c.copy() }()
+	for i := range 50 {
+		key := fmt.Sprintf("key%03d", i*4)
+		if _, err := s.Set(key, "new"); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "new"
+		if _, err := s.Set(fmt.Sprintf("added%03d", i), "new"); err != nil {
+			t.Fatal(err)
+		}
+		want[fmt.Sprintf("added%03d", i)] = "new"
+	}
+	if err := <-copied; err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key001", "added003"} {
+		if _, _, err := s.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+
+	s.mutex.Lock()
+	before := d.size
+	_, err := c.finish()
+	s.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.size >= before {
+		t.Errorf("data log grew from %d to %d bytes", before, d.size)
+	}
+
+	check := func(s *Store, when string) {
+		t.Helper()
+		for key, value := range want {
+			if got, ok := s.Get(key); !ok || got != value {
+				t.Errorf("%s: get %s = %q, %v; want %q", when, key, got, ok, value)
+			}
+		}
+		for _, key := range []string{"key001", "added003"} {
+			if _, ok := s.Get(key); ok {
+				t.Errorf("%s: deleted key %s is back", when, key)
+			}
+			if e, ok := s.Lookup(key); !ok || !e.Deleted {
+				t.Errorf("%s: tombstone of %s lost", when, key)
+			}
+		}
+	}
+	check(s, "after compaction")
+
+	// The index after the swap must match what a restart reads back
+	reopened, err := openDiskEngine(d.dir, FsyncAlways, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	restarted := NewStore(1)
+	restarted.useDisk(reopened)
+	check(restarted, "after reopening")
+}
+
+func TestCompactionFailsIfLogResetMeanwhile(t *testing.T) {
+	s, d := diskStore(t)
+	if _, err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.RLock()
+	c := d.beginCompaction()
+	s.mutex.RUnlock()
+	defer c.close()
+	if err := c.copy(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mutex.Lock()
+	if err := d.reset(); err != nil {
+		s.mutex.Unlock()
+		t.Fatal(err)
+	}
+	if err := d.put("b", Entry{Value: "2", Timestamp: s.tick()}); err != nil {
+		s.mutex.Unlock()
+		t.Fatal(err)
+	}
+	_, err := c.finish()
+	s.mutex.Unlock()
+	if err == nil {
+		t.Fatal("compaction of a reset log succeeded")
+	}
+
+	// The log it would have replaced is still in use
+	if _, ok := s.Get("a"); ok {
+		t.Error("key a survived the reset")
+	}
+	if value, ok := s.Get("b"); !ok || value != "2" {
+		t.Errorf("get b = %q, %v after the failed compaction", value, ok)
+	}
+}
+
+func TestFailedWritesLeaveKeysAsTheyWere(t *testing.T) {
+	s, d := diskStore(t)
+	if _, err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	d.sync.err = errors.New("input/output error")
+
+	if _, err := s.Set("a", "2"); err == nil {
+		t.Error("set succeeded on a failed data log")
+	}
+	if _, ok, err := s.Delete("a"); err == nil || ok {
+		t.Errorf("delete = %v, %v on a failed data log, want an error", ok, err)
+	}
+	if applied, err := s.Merge("b", Entry{Value: "3", Timestamp: Timestamp{Time: 1 << 40, Node: 2}}); err == nil || applied {
+		t.Errorf("merge = %v, %v on a failed data log, want an error", applied, err)
+	}
+	if _, err := s.Update("c", func(Entry, bool, Timestamp) (string, error) { return "4", nil }); err == nil {
+		t.Error("update succeeded on a failed data log")
+	}
+
+	if value, ok := s.Get("a"); !ok || value != "1" {
+		t.Errorf("get a = %q, %v; want the value before the failed writes", value, ok)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := s.Lookup(key); ok {
+			t.Errorf("key %s was stored by a failed write", key)
+		}
+	}
+}
+
+func TestFailedWALAppendStoresNothing(t *testing.T) {
+	s, _ := diskStore(t)
+	wal, err := OpenWAL(t.TempDir(), FsyncAlways, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	s.wal = wal
+	if _, err := s.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	wal.sync.err = errors.New("input/output error")
+	if _, err := s.Set("a", "2"); err == nil {
+		t.Error("set succeeded without its WAL entry")
+	}
+	if value, ok := s.Get("a"); !ok || value != "1" {
+		t.Errorf("get a = %q, %v; want the value before the failed write", value, ok)
+	}
+}
@@ -0,0 +1,184 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A task that fails, because its handler returned an error, the target
+// turned it away, or it could not be delivered within the retry limit, is
+// kept in the dead-letter queue of the node that sent it, where it can be
+// inspected and sent again. A node with a data directory saves its queue to
+// dlq.json, so dead letters survive restarts.
+
+const (
+	// maxDeadLetters bounds the dead-letter queue; the oldest letters are
+	// dropped to make room.
+	maxDeadLetters = 1000
+
+	dlqFile = "dlq.json"
+)
+
+var errNoDeadLetter = errors.New("no dead letter")
+
+// DeadLetter is a failed task.
+type DeadLetter struct {
+	// ID is the id of the task that failed.
+	ID       string    `json:"id"`
+	Target   int       `json:"target"`
+	TaskType string    `json:"task_type,omitempty"`
+	Content  string    `json:"content"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+	// Retries is how many times the task was sent again from the queue
+	// before this failure.
+	Retries int `json:"retries,omitempty"`
+}
+
+// DeadLetters is a node's dead-letter queue.
+type DeadLetters struct {
+	mutex   sync.Mutex
+	letters []DeadLetter
+	// retries counts the retries of tasks sent from the queue, by the id of
+	// the task sent
+	retries map[string]int
+	path    string
+}
+
+func NewDeadLetters() *DeadLetters {
+	return &DeadLetters{retries: make(map[string]int)}
+}
+
+// load reads the queue saved in dir, if any, and saves it there from now
+// on.
+func (d *DeadLetters) load(dir string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.path = filepath.Join(dir, dlqFile)
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &d.letters); err != nil {
+		return fmt.Errorf("invalid %s: %v", d.path, err)
+	}
+	return nil
+}
+
+// save writes the queue to its file, if it has one. The caller must hold
+// the mutex.
+func (d *DeadLetters) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(d.letters, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// add queues a failed task.
+func (d *DeadLetters) add(letter DeadLetter) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	letter.Retries = d.retries[letter.ID]
+	delete(d.retries, letter.ID)
+	d.letters = append(d.letters, letter)
+	if len(d.letters) > maxDeadLetters {
+		d.letters = d.letters[len(d.letters)-maxDeadLetters:]
+	}
+	return d.save()
+}
+
+// take removes the letter for task id from the queue.
+func (d *DeadLetters) take(id string) (DeadLetter, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, letter := range d.letters {
+		if letter.ID == id {
+			d.letters = append(d.letters[:i], d.letters[i+1:]...)
+			return letter, d.save()
+		}
+	}
+	return DeadLetter{}, fmt.Errorf("%w %s", errNoDeadLetter, id)
+}
+
+// retried records that letter was sent again as task id.
+func (d *DeadLetters) retried(letter DeadLetter, id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.retries[id] = letter.Retries + 1
+}
+
+// forget drops the retry count of task id, which succeeded.
+func (d *DeadLetters) forget(id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.retries, id)
+}
+
+// List returns the queued letters, oldest first.
+func (d *DeadLetters) List() []DeadLetter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]DeadLetter(nil), d.letters...)
+}
+
+func (d *DeadLetters) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.letters)
+}
+
+// deadLetter queues task, which failed with reason.
+func (n *Node) deadLetter(task TaskRecord, reason string) {
+	letter := DeadLetter{
+		ID:       task.ID,
+		Target:   task.Target,
+		TaskType: task.TaskType,
+		Content:  task.Content,
+		Error:    reason,
+		FailedAt: time.Now(),
+	}
+	n.logger.Warn("task moved to the dead-letter queue", "task", task.ID, "target", task.Target, "err", reason)
+	if err := n.deadLetters.add(letter); err != nil {
+		n.logger.Error("failed to save the dead-letter queue", "err", err)
+	}
+}
+
+// DeadLetters returns the tasks this node sent that failed, oldest first.
+func (n *Node) DeadLetters() []DeadLetter {
+	return n.deadLetters.List()
+}
+
+// RetryDeadLetter takes the failed task id out of the dead-letter queue and
+// sends it again to the node it was sent to, as a new task. It returns the
+// new task's id. If it fails again it returns to the queue under that id.
+func (n *Node) RetryDeadLetter(id string) (string, error) {
+	letter, err := n.deadLetters.take(id)
+	if err != nil {
+		return "", err
+	}
+	taskID := newTaskID()
+	n.deadLetters.retried(letter, taskID)
+	return taskID, n.sendTask(taskID, letter.Target, letter.TaskType, letter.Content, TaskOptions{})
+}
@@ -0,0 +1,198 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Draining takes a node out of service before a planned shutdown, such as
+// a rolling upgrade, without losing data or work. A draining node refuses
+// new tasks and leaves the ring, so its peers stop sending it writes and
+// tasks; it copies its keys to the replicas that take over its share of
+// the ring, steps down if it leads, and waits for the tasks it already
+// accepted. Once Drain returns a report that is Safe, the node can be shut
+// down. A drained node keeps serving requests by forwarding them, and
+// rejoins the ring when it restarts.
+
+var errQueueDraining = errors.New("node is draining")
+
+// DrainReport is the outcome of draining a node.
+type DrainReport struct {
+	// Keys is how many keys the node held; Migrated how many of them were
+	// acknowledged by every available new replica, and Failed how many
+	// were not.
+	Keys     int `json:"keys"`
+	Migrated int `json:"migrated"`
+	Failed   int `json:"failed"`
+	// Unfinished is how many accepted tasks were still queued or running
+	// when Drain stopped waiting for them.
+	Unfinished int `json:"unfinished"`
+	// Hints is how many writes the node still holds for replicas that are
+	// down, which are lost if it shuts down.
+	Hints int `json:"hints"`
+	// Safe reports whether the node can shut down without losing keys or
+	// tasks.
+	Safe bool `json:"safe"`
+}
+
+// Draining reports whether the node has been drained.
+func (n *Node) Draining() bool {
+	return n.draining.Load()
+}
+
+// Drain takes the node out of service so it can be shut down safely; see
+// DrainReport. Draining again repeats the migration, which is harmless.
+func (n *Node) Drain() (DrainReport, error) {
+	if !ownsKeys(n.config.Role) {
+		return DrainReport{}, fmt.Errorf("only members can be drained, this node is a %s", n.config.Role)
+	}
+	if len(n.ring.Nodes()) <= 1 && !n.Draining() {
+		return DrainReport{}, errors.New("no other member to take over this node's keys")
+	}
+
+	n.logger.Info("draining")
+	n.draining.Store(true)
+	n.tasks.Drain()
+	n.ring.Remove(n.ID)
+	n.sendToPeers(CapDrain, Message{Type: "draining", From: n.ID})
+
+	n.mutex.Lock()
+	if n.election.state == Leader {
+		n.logger.Info("stepping down as leader to drain", "term", n.election.term)
+		n.stepDown(n.election.term)
+		n.setLeader(-1)
+	}
+	n.mutex.Unlock()
+
+	report := n.migrateKeys()
+	n.logger.Info("keys migrated", "keys", report.Keys, "migrated", report.Migrated, "failed", report.Failed)
+
+	deadline := time.Now().Add(drainTimeout)
+	for n.tasks.Busy() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-n.done:
+			return report, errors.New("node is shutting down")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	report.Unfinished = n.tasks.Busy()
+	report.Hints = n.hints.Len()
+	report.Safe = report.Failed == 0 && report.Unfinished == 0 && report.Hints == 0
+	n.logger.Info("drained", "safe", report.Safe, "unfinished_tasks", report.Unfinished, "hints", report.Hints)
+	return report, nil
+}
+
+// migrateKeys copies every entry this node holds, tombstones included, to
+// the key's replicas now that the node is off the ring.
+func (n *Node) migrateKeys() DrainReport {
+	entries := n.store.Matching(func(string) bool { return true })
+	report := DrainReport{Keys: len(entries)}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	// Keys are copied in batches, waiting for the acks of each, small
+	// enough that neither the copies nor the acks overflow a peer's
+	// outbound queue
+	size := max(n.config.OutboxSize/2, 1)
+	for start := 0; start < len(keys); start += size {
+		batch := keys[start:min(start+size, len(keys))]
+		migrated := n.migrateBatch(batch, entries)
+		report.Migrated += migrated
+		report.Failed += len(batch) - migrated
+	}
+	return report
+}
+
+// migrateBatch sends the entries of keys to their replicas and returns how
+// many keys every available replica acknowledged.
+func (n *Node) migrateBatch(keys []string, entries map[string]Entry) int {
+	targets := make(map[string][]int, len(keys))
+	for _, key := range keys {
+		for _, id := range n.replicas(key) {
+			if id != n.ID && n.available(id) {
+				targets[key] = append(targets[key], id)
+			}
+		}
+	}
+	return n.copyEntries(keys, entries, targets)
+}
+
+// copyEntries sends the entries of keys to the nodes in targets and returns
+// how many of the keys with targets every target acknowledged.
+func (n *Node) copyEntries(keys []string, entries map[string]Entry, targets map[string][]int) int {
+	requestID := newTaskID()
+	sent := 0
+	for _, key := range keys {
+		sent += len(targets[key])
+	}
+	acks := n.expect(requestID, sent)
+	defer n.cancelExpect(requestID)
+
+	// Sends wait for room in the peer's queue rather than drop, as a batch
+	// fills it at once
+	failed := make(map[string]bool)
+	for _, key := range keys {
+		write := replicateMessage(key, entries[key])
+		write.From = n.ID
+		write.RequestID = requestID
+		for _, id := range targets[key] {
+			err := n.send(id, write, replicationTimeout)
+			if err != nil {
+				failed[key] = true
+				sent--
+			}
+		}
+	}
+
+	acked := make(map[string]int, len(keys))
+	timeout := time.After(replicationTimeout)
+	for received := 0; received < sent; received++ {
+		select {
+		case ack := <-acks:
+			acked[ack.Key]++
+		case <-timeout:
+			received = sent
+		}
+	}
+	copied := 0
+	for _, key := range keys {
+		if len(targets[key]) > 0 && !failed[key] && acked[key] >= len(targets[key]) {
+			copied++
+		}
+	}
+	return copied
+}
+
+// announceDraining tells a newly connected peer that this node is
+// draining.
+func (n *Node) announceDraining(peer int) {
+	if n.Draining() && n.PeerSupports(peer, CapDrain) {
+		n.sendMessage(peer, Message{Type: "draining", From: n.ID})
+	}
+}
+
+// handleDraining takes a draining peer off the ring and out of task
+// scheduling. A draining leader steps down, so its followers elect another
+// right away instead of waiting out an election timeout.
+func (n *Node) handleDraining(msg Message) {
+	n.mutex.Lock()
+	if info, ok := n.peerInfo[msg.From]; ok {
+		info.draining = true
+		n.peerInfo[msg.From] = info
+	}
+	n.mutex.Unlock()
+	n.ring.Remove(msg.From)
+	n.peerLogger(msg.From, msg.Type).Info("peer is draining")
+	n.leaderSuspected(msg.From)
+}
+
+// peerDraining reports whether peer id announced it is draining.
+func (n *Node) peerDraining(id int) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.peerInfo[id].draining
+}
@@ -0,0 +1,515 @@
+package node
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+const defaultHeartbeatInterval = time.Second * 5
+
+// election holds the Raft-style term/vote state of a node. It is guarded by
+// Node.mutex.
+type election struct {
+	state         string
+	term          int
+	votedFor      int
+	votes         map[int]bool
+	leaderID      int
+	lastHeartbeat time.Time
+
+	// leaseHolder is the leader this node last heard from, or the
+	// candidate it last voted for, at leaseGranted. Until a lease has
+	// passed since, it may count this node towards its quorum. A node
+	// starts out holding it itself, since before a restart it may have
+	// acknowledged a leader it no longer knows of.
+	leaseHolder  int
+	leaseGranted time.Time
+
+	// unsaved is set when the term or vote changed since they were last
+	// recorded in the WAL.
+	unsaved bool
+
+	// While leading, acks records when each follower last acknowledged a
+	// heartbeat of this term, and leaderSince when the node took the lead.
+	// campaigned is when the node last stood for election: the votes it
+	// won are acknowledgements from then.
+	acks        map[int]time.Time
+	leaderSince time.Time
+	campaigned  time.Time
+}
+
+func newElection(isMaster bool, id int) election {
+	e := election{
+		state:         Follower,
+		votedFor:      -1,
+		leaderID:      -1,
+		lastHeartbeat: time.Now(),
+		leaseHolder:   id,
+		leaseGranted:  time.Now(),
+	}
+	// A node started with is_master=true bootstraps the first term as leader
+	// so existing single-master setups keep working.
+	if isMaster {
+		e.state = Leader
+		e.term = 1
+		e.votedFor = id
+		e.leaderID = id
+		e.acks = make(map[int]time.Time)
+		e.leaderSince = time.Now()
+	}
+	return e
+}
+
+// leaseDuration is how long a follower's heartbeat ack counts towards the
+// leader's quorum, from when the leader sent the heartbeat. It is shorter
+// than the minimum election timeout, so a leader cut off from the majority
+// steps down before the rest of the cluster can elect a replacement, and a
+// follower turns other candidates away for as long after the heartbeat
+// arrived.
+func (n *Node) leaseDuration() time.Duration {
+	return n.heartbeatInterval() * 2
+}
+
+// hasQuorum reports whether a majority of the voting nodes, counting this
+// one, acknowledged the leader within the lease. Observers and clients
+// follow the leader too, but their acks do not count. The caller must hold
+// n.mutex.
+func (n *Node) hasQuorum() bool {
+	if n.election.state != Leader {
+		return false
+	}
+	acked := 1
+	for id, at := range n.election.acks {
+		if _, known := n.Peers[id]; known && votes(n.roleOf(id)) && time.Since(at) < n.leaseDuration() {
+			acked++
+		}
+	}
+	return acked > n.voters()/2
+}
+
+// HasLease reports whether this node leads with the acknowledgement of a
+// majority of the cluster.
+func (n *Node) HasLease() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.hasQuorum()
+}
+
+// checkLease makes a leader that has not heard from a majority for a full
+// lease step down, so a partitioned or duplicate master stops acting as one.
+func (n *Node) checkLease() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.election.state != Leader || time.Since(n.election.leaderSince) < n.leaseDuration() {
+		return
+	}
+	if !n.hasQuorum() {
+		n.logger.Warn("lost quorum, stepping down", "term", n.election.term)
+		n.stepDown(n.election.term)
+		n.setLeader(-1)
+	}
+}
+
+// welcomePeer gives a node that just joined a lease's time to acknowledge
+// the leader before it counts against the quorum. The caller must hold
+// n.mutex.
+func (n *Node) welcomePeer(id int) {
+	if n.election.state != Leader {
+		return
+	}
+	if _, ok := n.election.acks[id]; !ok {
+		n.election.acks[id] = time.Now()
+	}
+}
+
+// handleHeartbeat acknowledges a heartbeat from the leader. A heartbeat of
+// an older term comes from a master that was replaced while it was away;
+// it is answered with the current term, which makes it step down.
+func (n *Node) handleHeartbeat(msg Message) {
+	if n.observeLeader(msg) {
+		n.peerLogger(msg.From, msg.Type).Debug("heartbeat received from master")
+		if err := n.persistElection(); err != nil {
+			n.logger.Error("failed to record term, not acknowledging heartbeat", "term", msg.Term, "err", err)
+			return
+		}
+		n.sendBeat(msg.From, Message{Type: "heartbeat_ack", From: n.ID, Term: msg.Term, SentAt: msg.SentAt})
+		return
+	}
+	if _, term, _ := n.electionStatus(); msg.Term < term {
+		n.sendBeat(msg.From, Message{Type: "heartbeat_ack", From: n.ID, Term: term})
+	}
+}
+
+// observeTerm catches up with a newer term a peer announced in its hello.
+// A master that returns after the cluster elected a replacement learns it
+// is stale this way, and steps down before sending a single heartbeat.
+func (n *Node) observeTerm(hello Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if hello.Term > n.election.term {
+		n.stepDown(hello.Term)
+	}
+}
+
+// leaderSuspected reacts to the failure detector suspecting peer id. If id
+// is the leader, this node stops following it and, if it may lead, stands
+// for election within a heartbeat interval rather than waiting out a full
+// election timeout. A dead master is thus replaced within the suspect
+// timeout, a detector check and a heartbeat interval, plus a vote round.
+func (n *Node) leaderSuspected(id int) {
+	n.mutex.Lock()
+	if n.election.state != Follower || n.election.leaderID != id {
+		n.mutex.Unlock()
+		return
+	}
+	n.setLeader(-1)
+	term := n.election.term
+	n.mutex.Unlock()
+
+	n.peerLogger(id, "").Warn("leader suspected, starting failover", "term", term)
+	if n.config.Role != RoleMember {
+		return
+	}
+
+	// Spread the candidates out so they rarely split the vote
+	delay := time.Duration(rand.Int63n(int64(n.heartbeatInterval())))
+	time.AfterFunc(delay, func() {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		n.mutex.RLock()
+		leaderless := n.election.state == Follower && n.election.leaderID < 0 && n.election.term == term
+		n.mutex.RUnlock()
+		if leaderless {
+			n.startElection()
+		}
+	})
+}
+
+// handleHeartbeatAck renews the lease with a follower's acknowledgement.
+func (n *Node) handleHeartbeatAck(msg Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if msg.Term > n.election.term {
+		n.stepDown(msg.Term)
+		return
+	}
+	if n.election.state == Leader && msg.Term == n.election.term {
+		// Peers that do not echo the send time renew the lease from now
+		at := time.Now()
+		if msg.SentAt != 0 {
+			at = time.Unix(0, msg.SentAt)
+		}
+		if at.After(n.election.acks[msg.From]) {
+			n.election.acks[msg.From] = at
+		}
+	}
+}
+
+// randomElectionTimeout picks a timeout between 2.4 and 4 heartbeat
+// intervals (12s-20s with the default 5s interval) so followers rarely time
+// out together.
+func (n *Node) randomElectionTimeout() time.Duration {
+	interval := n.heartbeatInterval()
+	min := interval * 12 / 5
+	spread := interval*4 - min
+	return min + time.Duration(rand.Int63n(int64(spread)))
+}
+
+// runElectionTimer starts a new election whenever a follower or candidate
+// goes a full election timeout without hearing from a leader. It checks five
+// times per heartbeat interval, fine enough for the randomized timeouts to
+// keep candidates apart at any interval. Only members stand for election.
+func (n *Node) runElectionTimer() {
+	if n.config.Role != RoleMember {
+		return
+	}
+	timeout := n.randomElectionTimeout()
+	ticker := time.NewTicker(n.heartbeatInterval() / 5)
+	defer ticker.Stop()
+	changed := n.timingChanged()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-changed:
+			changed = n.timingChanged()
+			ticker.Reset(n.heartbeatInterval() / 5)
+			timeout = n.randomElectionTimeout()
+			continue
+		case <-ticker.C:
+		}
+
+		n.mutex.RLock()
+		state := n.election.state
+		elapsed := time.Since(n.election.lastHeartbeat)
+		hasPeers := len(n.Peers) > 0
+		n.mutex.RUnlock()
+
+		if state == Leader || !hasPeers || elapsed < timeout || n.Draining() {
+			continue
+		}
+
+		n.startElection()
+		timeout = n.randomElectionTimeout()
+	}
+}
+
+func (n *Node) startElection() {
+	logIndex, logTerm := n.linear.Last()
+	n.mutex.Lock()
+	n.election.state = Candidate
+	n.election.term++
+	n.election.votedFor = n.ID
+	n.election.votes = map[int]bool{n.ID: true}
+	n.setLeader(-1)
+	n.election.lastHeartbeat = time.Now()
+	n.election.campaigned = n.election.lastHeartbeat
+	n.election.unsaved = true
+	n.IsMaster = false
+	term := n.election.term
+	peers := make([]int, 0, len(n.Peers))
+	for id := range n.Peers {
+		if votes(n.roleOf(id)) {
+			peers = append(peers, id)
+		}
+	}
+	n.mutex.Unlock()
+
+	if err := n.persistElection(); err != nil {
+		n.logger.Error("failed to record term, not standing for election", "term", term, "err", err)
+		return
+	}
+
+	n.logger.Info("election timeout, starting election", "term", term)
+
+	for _, id := range peers {
+		n.sendMessage(id, Message{
+			Type:     "request_vote",
+			From:     n.ID,
+			Term:     term,
+			LogIndex: logIndex,
+			LogTerm:  logTerm,
+		})
+	}
+}
+
+// stepDown moves the node back to follower for a newer term, which is
+// recorded by the next persistElection. The caller must hold n.mutex.
+func (n *Node) stepDown(term int) {
+	if n.election.state == Leader && term > n.election.term {
+		n.logger.Info("stepping down as leader, newer term seen", "term", term)
+	}
+	if term > n.election.term {
+		n.election.term = term
+		n.election.votedFor = -1
+		n.setLeader(-1)
+		n.election.unsaved = true
+	}
+	n.election.state = Follower
+	n.election.votes = nil
+	n.election.acks = nil
+	n.IsMaster = false
+}
+
+// handleRequestVote grants a candidate this node's vote for its term, if
+// the node has not voted for another. In linearizable mode, the candidate's
+// log must also be at least as up to date as this node's, and the vote is
+// recorded before it is sent.
+//
+// While the lease of another leader may be live, whether it is this node
+// or one it heard from or voted for within the lease, the candidate is
+// turned away without its term being taken up, so it cannot be elected
+// while that leader still serves reads.
+func (n *Node) handleRequestVote(msg Message) {
+	upToDate := !n.config.Linearizable || n.linear.upToDate(msg.LogIndex, msg.LogTerm)
+	n.mutex.Lock()
+	if n.leaseLive(msg.From) {
+		term := n.election.term
+		n.mutex.Unlock()
+		n.peerLogger(msg.From, msg.Type).Debug("refusing vote while a lease is live", "term", msg.Term)
+		n.sendMessage(msg.From, Message{Type: "vote", From: n.ID, Term: term})
+		return
+	}
+	if msg.Term > n.election.term {
+		n.stepDown(msg.Term)
+	}
+	granted := votes(n.config.Role) && upToDate && msg.Term == n.election.term &&
+		(n.election.votedFor == -1 || n.election.votedFor == msg.From)
+	if granted {
+		n.election.votedFor = msg.From
+		n.election.unsaved = true
+		n.election.lastHeartbeat = time.Now()
+		n.election.leaseHolder = msg.From
+		n.election.leaseGranted = n.election.lastHeartbeat
+	}
+	term := n.election.term
+	n.mutex.Unlock()
+
+	// A vote that is not on disk is not sent: the node keeps it, so it
+	// votes for no one else this term, but the candidate does not count it
+	if err := n.persistElection(); err != nil && granted {
+		n.logger.Error("failed to record vote, refusing it", "term", term, "err", err)
+		granted = false
+	}
+
+	n.sendMessage(msg.From, Message{
+		Type:        "vote",
+		From:        n.ID,
+		Term:        term,
+		VoteGranted: granted,
+	})
+}
+
+func (n *Node) handleVote(msg Message) {
+	n.mutex.Lock()
+	if msg.Term > n.election.term {
+		n.stepDown(msg.Term)
+		n.mutex.Unlock()
+		return
+	}
+	if n.election.state != Candidate || msg.Term != n.election.term || !msg.VoteGranted {
+		n.mutex.Unlock()
+		return
+	}
+
+	n.election.votes[msg.From] = true
+	won := len(n.election.votes) > n.voters()/2
+	if won {
+		// The votes that elected us are the first acknowledgements, of
+		// the request_vote sent when the node stood for election
+		n.election.state = Leader
+		n.setLeader(n.ID)
+		n.election.leaderSince = time.Now()
+		n.election.acks = make(map[int]time.Time, len(n.election.votes))
+		for id := range n.election.votes {
+			if id != n.ID {
+				n.election.acks[id] = n.election.campaigned
+			}
+		}
+		n.IsMaster = true
+	}
+	term := n.election.term
+	n.mutex.Unlock()
+
+	if won {
+		n.logger.Info("elected leader", "term", term)
+		n.broadcastHeartbeat()
+	}
+}
+
+// observeLeader records a heartbeat from the leader of msg.Term, stepping
+// down if it carries a newer term. It reports false for stale heartbeats and
+// for a second leader of the current term, which two nodes started as master
+// produce: a follower sticks with the leader it already acknowledged, and a
+// leader holding a lease keeps it.
+func (n *Node) observeLeader(msg Message) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if msg.Term < n.election.term {
+		return false
+	}
+	if msg.Term == n.election.term {
+		switch n.election.state {
+		case Follower:
+			if n.election.leaderID >= 0 && n.election.leaderID != msg.From {
+				return false
+			}
+		case Leader:
+			if n.hasQuorum() {
+				n.peerLogger(msg.From, msg.Type).Warn("ignoring heartbeat from a rival leader", "term", msg.Term)
+				return false
+			}
+		}
+	}
+	if msg.Term > n.election.term || n.election.state != Follower {
+		n.stepDown(msg.Term)
+	}
+	if n.election.leaderID != msg.From {
+		n.peerLogger(msg.From, msg.Type).Info("new leader", "term", msg.Term)
+	}
+	n.setLeader(msg.From)
+	n.election.lastHeartbeat = time.Now()
+	n.election.leaseHolder = msg.From
+	n.election.leaseGranted = n.election.lastHeartbeat
+	return true
+}
+
+// leaseLive reports whether a leader other than candidate may hold a lease
+// this node counts towards: this node leading with a quorum, or a node it
+// acknowledged as leader, or voted for, within the lease. The caller must
+// hold n.mutex.
+func (n *Node) leaseLive(candidate int) bool {
+	if n.election.state == Leader {
+		return n.hasQuorum()
+	}
+	return n.election.leaseHolder != candidate && time.Since(n.election.leaseGranted) < n.leaseDuration()
+}
+
+// persistElection records the term and vote in the WAL in linearizable
+// mode, if they changed since last recorded, so a node that restarts
+// neither votes twice in a term nor forgets one it saw. It runs without
+// n.mutex held, before the node sends anything that relies on them;
+// electionSave keeps a slower call from recording an older state over a
+// newer one.
+func (n *Node) persistElection() error {
+	if !n.config.Linearizable || n.wal == nil {
+		return nil
+	}
+	n.electionSave.Lock()
+	defer n.electionSave.Unlock()
+
+	n.mutex.Lock()
+	if !n.election.unsaved {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.election.unsaved = false
+	term, vote := n.election.term, n.election.votedFor
+	n.mutex.Unlock()
+
+	if err := n.wal.Append(WALEntry{Op: walElection, Term: term, VotedFor: &vote}); err != nil {
+		n.mutex.Lock()
+		n.election.unsaved = true
+		n.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// restoreElection takes up the term and vote replayed from the WAL. A
+// node started as master that had moved on to a later term rejoins as a
+// follower of it.
+func (n *Node) restoreElection(entry WALEntry) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if entry.Term < n.election.term || entry.VotedFor == nil {
+		return
+	}
+	if entry.Term > n.election.term {
+		n.stepDown(entry.Term)
+	}
+	n.election.votedFor = *entry.VotedFor
+	n.election.unsaved = false
+}
+
+func (n *Node) electionStatus() (state string, term, leaderID int) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.election.state, n.election.term, n.election.leaderID
+}
@@ -0,0 +1,54 @@
+package node_test
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMasterLeadsFirstTerm(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	ctx := testContext(t, 10*time.Second)
+
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader != 1 {
+		t.Errorf("leader = %d, want node 1, started as master", leader)
+	}
+	if status := c.Node(1).Status(); status.Term != 1 || !status.IsMaster {
+		t.Errorf("node 1 status: term %d, master %v; want term 1 as master", status.Term, status.IsMaster)
+	}
+}
+
+func TestFailoverElectsNewLeader(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+
+	if _, err := c.Leader(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(t, c, 2).Set(ctx, "survivor", "yes"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Stop(1)
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		t.Fatalf("no leader after node 1 stopped: %v", err)
+	}
+	if leader == 1 {
+		t.Fatal("stopped node 1 is still leader")
+	}
+	status := c.Node(leader).Status()
+	if status.Term <= 1 || !status.Lease {
+		t.Errorf("new leader %d: term %d, lease %v; want a later term with a lease", leader, status.Term, status.Lease)
+	}
+
+	for _, id := range []int{2, 3} {
+		value, found, err := connect(t, c, id).Get(ctx, "survivor")
+		if err != nil || !found || value != "yes" {
+			t.Errorf("node %d: get survivor = %q, %v, %v after failover", id, value, found, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package node
+
+// engine holds the entries of a Store. The store's lock is held around
+// every call, shared for reads and exclusive for writes, so engines need no
+// locking of their own.
+type engine interface {
+	// lookup returns the entry for key, value included.
+	lookup(key string) (Entry, bool)
+	// meta returns the entry for key without its value, which for some
+	// engines is much cheaper.
+	meta(key string) (Entry, bool)
+	// put stores e under key, failing if it cannot be stored.
+	put(key string, e Entry) error
+	// each calls fn for every entry, tombstones included.
+	each(fn func(key string, e Entry))
+	// eachMeta is each without values.
+	eachMeta(fn func(key string, e Entry))
+	// ascend calls fn for the entries of the keys from start up to but not
+	// including end, or to the last key if end is "", in key order and
+	// tombstones included, until fn returns false.
+	ascend(start, end string, fn func(key string, e Entry) bool)
+	reset() error
+	close() error
+}
+
+// memoryEngine keeps every entry in a map, and the keys in order.
+type memoryEngine struct {
+	entries map[string]Entry
+	keys    *orderedKeys
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{entries: make(map[string]Entry), keys: newOrderedKeys()}
+}
+
+func (m *memoryEngine) lookup(key string) (Entry, bool) {
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+func (m *memoryEngine) meta(key string) (Entry, bool) {
+	return m.lookup(key)
+}
+
+func (m *memoryEngine) put(key string, e Entry) error {
+	if _, ok := m.entries[key]; !ok {
+		m.keys.add(key)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *memoryEngine) each(fn func(key string, e Entry)) {
+	for k, e := range m.entries {
+		fn(k, e)
+	}
+}
+
+func (m *memoryEngine) eachMeta(fn func(key string, e Entry)) {
+	m.each(fn)
+}
+
+func (m *memoryEngine) ascend(start, end string, fn func(key string, e Entry) bool) {
+	m.keys.ascend(start, func(key string) bool {
+		return inRange(key, end) && fn(key, m.entries[key])
+	})
+}
+
+func (m *memoryEngine) reset() error {
+	clear(m.entries)
+	m.keys = newOrderedKeys()
+	return nil
+}
+
+func (m *memoryEngine) close() error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// Membership event types.
+const (
+	// EventJoin is published when a node becomes a member of this node's
+	// view of the cluster.
+	EventJoin = "join"
+	// EventLeave is published when a node leaves the cluster or is removed.
+	EventLeave = "leave"
+	// EventSuspect is published when the failure detector suspects a node,
+	// and again if it declares it dead; Health says which.
+	EventSuspect = "suspect"
+	// EventRecover is published when a suspected or dead node is heard from
+	// again.
+	EventRecover = "recover"
+	// EventMasterChanged is published when the leader this node follows
+	// changes, with Node -1 while none is known, e.g. during an election.
+	EventMasterChanged = "master_changed"
+)
+
+// eventQueueSize bounds the events waiting to be delivered to subscribers.
+const eventQueueSize = 256
+
+// Event is a change to the cluster's topology as this node sees it.
+type Event struct {
+	Type   string    `json:"type"`
+	Node   int       `json:"node"`
+	Term   int       `json:"term,omitempty"`
+	Health string    `json:"health,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Events delivers membership events to subscribers, in the order they were
+// published, from a goroutine of its own. Publishing never blocks, so
+// events can be published with n.mutex held, and subscribers are free to
+// call back into the node.
+type Events struct {
+	queue       chan Event
+	mutex       sync.RWMutex
+	subscribers map[int]func(Event)
+	next        int
+}
+
+func NewEvents() *Events {
+	return &Events{
+		queue:       make(chan Event, eventQueueSize),
+		subscribers: make(map[int]func(Event)),
+	}
+}
+
+// publish queues e for delivery. It reports false if the queue is full and
+// e was dropped.
+func (e *Events) publish(event Event) bool {
+	select {
+	case e.queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// subscribe adds fn and returns a function that removes it.
+func (e *Events) subscribe(fn func(Event)) (cancel func()) {
+	e.mutex.Lock()
+	id := e.next
+	e.next++
+	e.subscribers[id] = fn
+	e.mutex.Unlock()
+
+	return func() {
+		e.mutex.Lock()
+		delete(e.subscribers, id)
+		e.mutex.Unlock()
+	}
+}
+
+// run delivers queued events until done is closed.
+func (e *Events) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-e.queue:
+			e.mutex.RLock()
+			subscribers := make([]func(Event), 0, len(e.subscribers))
+			for _, fn := range e.subscribers {
+				subscribers = append(subscribers, fn)
+			}
+			e.mutex.RUnlock()
+
+			for _, fn := range subscribers {
+				fn(event)
+			}
+		}
+	}
+}
+
+// Subscribe calls fn with every membership event until the returned cancel
+// function is called. Events are delivered one at a time in the order they
+// happened; a subscriber that blocks holds up the others, and events
+// published while the queue is full are dropped.
+func (n *Node) Subscribe(fn func(Event)) (cancel func()) {
+	return n.events.subscribe(fn)
+}
+
+// publish stamps event with the current time and queues it for the
+// subscribers.
+func (n *Node) publish(event Event) {
+	event.Time = time.Now()
+	if !n.events.publish(event) {
+		n.logger.Warn("event queue full, dropping event", "event", event.Type, "peer", event.Node)
+	}
+}
+
+// setLeader records id as the leader this node follows, -1 for none, and
+// publishes the change. The caller must hold n.mutex.
+func (n *Node) setLeader(id int) {
+	if n.election.leaderID == id {
+		return
+	}
+	n.election.leaderID = id
+	n.publish(Event{Type: EventMasterChanged, Node: id, Term: n.election.term})
+}
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ExecAll runs a task on every node at once, for diagnostics such as the
+// built-in disk task: each node gets it as a batch of one, so the result
+// comes back in the reply rather than as a separate result message. Nodes
+// that are down, cannot run batches or do not answer within the timeout
+// fail rather than hold up the others.
+
+// ExecResult is the outcome of a task ExecAll ran on one node.
+type ExecResult struct {
+	Node     int           `json:"node"`
+	TaskID   string        `json:"task_id,omitempty"`
+	Result   string        `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ExecAll runs a task on this node and every known peer concurrently and
+// returns each one's outcome, ordered by node id, once all of them
+// answered or timeout passed.
+func (n *Node) ExecAll(taskType, content string, timeout time.Duration) ([]ExecResult, error) {
+	if taskType == "" {
+		return nil, fmt.Errorf("no task type")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout %v", timeout)
+	}
+	n.mutex.RLock()
+	targets := make([]int, 0, len(n.Peers)+1)
+	targets = append(targets, n.ID)
+	for id := range n.Peers {
+		targets = append(targets, id)
+	}
+	n.mutex.RUnlock()
+	slices.Sort(targets)
+
+	tasks := []BatchTask{{Type: taskType, Content: content}}
+	results := make([]ExecResult, len(targets))
+	var wg sync.WaitGroup
+	for i, id := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			result := ExecResult{Node: id}
+			summary, err := n.SendBatch(id, tasks, timeout)
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case len(summary.Results) != 1:
+				result.Error = fmt.Sprintf("node answered with %d results", len(summary.Results))
+			default:
+				result.TaskID = summary.Results[0].TaskID
+				result.Result = summary.Results[0].Result
+				result.Error = summary.Results[0].Error
+			}
+			result.Duration = time.Since(start)
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// diskHandler reports how much the node's data directory holds.
+func (n *Node) diskHandler(string) (string, error) {
+	dir := n.config.DataDir
+	if dir == "" {
+		return "no data directory", nil
+	}
+	var size int64
+	files := 0
+	err := filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		files++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d bytes in %d files under %s", size, files, dir), nil
+}
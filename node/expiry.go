@@ -0,0 +1,58 @@
+package node
+
+import "time"
+
+// expiryInterval is how often expired keys are swept.
+const expiryInterval = time.Second
+
+// runExpiry deletes expired keys this node coordinates. Reads already treat
+// an expired key as missing on every replica; the sweep turns it into a
+// tombstone and replicates that, so replicas agree the key is gone even
+// after it is rewritten elsewhere or synced by anti-entropy. In
+// linearizable mode the leader deletes them through the log instead.
+func (n *Node) runExpiry() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if n.config.Linearizable {
+			n.expireLog(now)
+			continue
+		}
+		for _, key := range n.store.Expired(now) {
+			if n.coordinator(key) == n.ID {
+				n.expire(key, now)
+			}
+		}
+	}
+}
+
+// expire deletes key if it is still expired and replicates the delete to
+// the key's replicas and the observers.
+func (n *Node) expire(key string, now time.Time) {
+	e, ok, err := n.store.Expire(key, now)
+	if err != nil {
+		n.logger.Error("failed to expire key", "key", key, "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	n.logger.Debug("key expired", "key", key)
+	n.publishChange(key, e)
+
+	for _, id := range append(n.replicas(key), n.observers()...) {
+		if id == n.ID {
+			continue
+		}
+		write := replicateMessage(key, e)
+		write.From = n.ID
+		n.sendMessage(id, write)
+	}
+}
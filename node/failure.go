@@ -0,0 +1,219 @@
+package node
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PeerAlive   = "alive"
+	PeerSuspect = "suspect"
+	PeerDead    = "dead"
+)
+
+// FailureDetector tracks when each peer was last heard from and classifies it
+// as alive, suspected or dead. Any message from a peer counts as a sign of
+// life; followers send "alive" messages so the leader can watch them too.
+// Change the timeouts of a detector in use with SetTimeouts.
+type FailureDetector struct {
+	SuspectTimeout time.Duration
+	DeadTimeout    time.Duration
+
+	lastSeen map[int]time.Time
+	status   map[int]string
+	mutex    sync.Mutex
+}
+
+func NewFailureDetector(suspectTimeout, deadTimeout time.Duration) *FailureDetector {
+	return &FailureDetector{
+		SuspectTimeout: suspectTimeout,
+		DeadTimeout:    deadTimeout,
+		lastSeen:       make(map[int]time.Time),
+		status:         make(map[int]string),
+	}
+}
+
+// SetTimeouts changes how long a peer goes unheard before it is suspected
+// or declared dead. Peers are reclassified at the next check.
+func (fd *FailureDetector) SetTimeouts(suspect, dead time.Duration) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	fd.SuspectTimeout, fd.DeadTimeout = suspect, dead
+}
+
+// Timeouts returns the suspect and dead timeouts.
+func (fd *FailureDetector) Timeouts() (suspect, dead time.Duration) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.SuspectTimeout, fd.DeadTimeout
+}
+
+// Observe records that the peer is alive. It reports true if the peer was
+// previously suspected or dead.
+func (fd *FailureDetector) Observe(id int) bool {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	recovered := fd.status[id] == PeerSuspect || fd.status[id] == PeerDead
+	fd.lastSeen[id] = time.Now()
+	fd.status[id] = PeerAlive
+	return recovered
+}
+
+// MarkDead records a peer as dead without waiting for its timeout, e.g. when
+// another node reports it down. It reports whether the status changed.
+func (fd *FailureDetector) MarkDead(id int) bool {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	if fd.status[id] == PeerDead {
+		return false
+	}
+	fd.status[id] = PeerDead
+	return true
+}
+
+// Forget stops tracking a peer that left the cluster.
+func (fd *FailureDetector) Forget(id int) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	delete(fd.lastSeen, id)
+	delete(fd.status, id)
+}
+
+// check re-evaluates every peer in ids and returns the ones whose status
+// changed to suspect or dead, keyed by new status.
+func (fd *FailureDetector) check(ids []int) map[string][]int {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	changed := make(map[string][]int)
+	now := time.Now()
+	for _, id := range ids {
+		seen, ok := fd.lastSeen[id]
+		if !ok {
+			// Start the clock when the peer is first checked
+			fd.lastSeen[id] = now
+			fd.status[id] = PeerAlive
+			continue
+		}
+
+		status := PeerAlive
+		switch elapsed := now.Sub(seen); {
+		case elapsed >= fd.DeadTimeout:
+			status = PeerDead
+		case elapsed >= fd.SuspectTimeout:
+			status = PeerSuspect
+		}
+		if status != fd.status[id] && status != PeerAlive {
+			changed[status] = append(changed[status], id)
+		}
+		fd.status[id] = status
+	}
+	return changed
+}
+
+// Status returns the status of every tracked peer and how long ago it was
+// last heard from.
+func (fd *FailureDetector) Status() map[int]PeerHealth {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	health := make(map[int]PeerHealth, len(fd.status))
+	for id, status := range fd.status {
+		health[id] = PeerHealth{Status: status, LastSeen: fd.lastSeen[id]}
+	}
+	return health
+}
+
+type PeerHealth struct {
+	Status   string
+	LastSeen time.Time
+}
+
+// runFailureDetector checks every peer once a second, or once a heartbeat
+// interval if that is shorter, so failures are noticed within a fixed
+// bound of their timeouts.
+func (n *Node) runFailureDetector() {
+	ticker := time.NewTicker(min(time.Second, n.heartbeatInterval()))
+	defer ticker.Stop()
+	changed := n.timingChanged()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-changed:
+			changed = n.timingChanged()
+			ticker.Reset(min(time.Second, n.heartbeatInterval()))
+			continue
+		case <-ticker.C:
+		}
+
+		n.mutex.RLock()
+		ids := make([]int, 0, len(n.Peers))
+		for id := range n.Peers {
+			ids = append(ids, id)
+		}
+		n.mutex.RUnlock()
+
+		statuses := n.detector.check(ids)
+		suspectTimeout, deadTimeout := n.detector.Timeouts()
+		for range statuses[PeerSuspect] {
+			n.metrics.HeartbeatMissed()
+		}
+		for range statuses[PeerDead] {
+			n.metrics.HeartbeatMissed()
+		}
+		for _, id := range statuses[PeerSuspect] {
+			n.peerLogger(id, "").Warn("peer suspected", "silent_for", suspectTimeout)
+			n.publish(Event{Type: EventSuspect, Node: id, Health: PeerSuspect})
+			n.leaderSuspected(id)
+		}
+		for _, id := range statuses[PeerDead] {
+			n.peerLogger(id, "").Error("peer down", "silent_for", deadTimeout)
+			n.publish(Event{Type: EventSuspect, Node: id, Health: PeerDead})
+			n.announceNodeDown(id)
+			n.leaderSuspected(id)
+		}
+	}
+}
+
+// announceNodeDown tells every other peer that id has been declared dead.
+func (n *Node) announceNodeDown(id int) {
+	n.mutex.RLock()
+	peers := make([]int, 0, len(n.Peers))
+	for peerID := range n.Peers {
+		if peerID != id {
+			peers = append(peers, peerID)
+		}
+	}
+	n.mutex.RUnlock()
+
+	for _, peerID := range peers {
+		n.sendMessage(peerID, Message{
+			Type:    "node_down",
+			Content: strconv.Itoa(id),
+			From:    n.ID,
+		})
+	}
+}
+
+func (n *Node) handleNodeDown(msg Message) {
+	id, err := strconv.Atoi(msg.Content)
+	if err != nil || id == n.ID {
+		return
+	}
+	if n.detector.MarkDead(id) {
+		n.peerLogger(msg.From, msg.Type).Warn("peer reported down", "down", id)
+		n.publish(Event{Type: EventSuspect, Node: id, Health: PeerDead})
+	}
+}
+
+// Health returns the failure detector's view of every peer.
+func (n *Node) Health() map[int]PeerHealth {
+	return n.detector.Status()
+}
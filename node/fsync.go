@@ -0,0 +1,112 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// The fsync policy trades the latency of writes to the WAL and data log for
+// how much of them a power loss or OS crash can take. With always, the
+// default, every write is synced to disk before it is acknowledged, so none
+// is lost. With group, writes are acknowledged once the OS has them and
+// synced together every fsync_interval, losing at most that much. Under
+// either, once a sync of a file has failed every later write to it fails,
+// until the node restarts and replays what reached the disk or the file is
+// rewritten. With none, writes are never synced explicitly and the OS
+// writes them back when it sees fit. A crash of the node alone loses
+// nothing under any policy, as the OS already holds every acknowledged
+// write.
+
+// Fsync policies.
+const (
+	FsyncAlways = "always"
+	FsyncGroup  = "group"
+	FsyncNone   = "none"
+)
+
+// defaultFsyncInterval is how often writes are synced under the group
+// policy.
+const defaultFsyncInterval = 10 * time.Millisecond
+
+// syncer syncs a log file after writes as the fsync policy says. Its owner
+// serializes calls to it.
+type syncer struct {
+	policy string
+	// dirty is set when a write has not been synced under the group
+	// policy.
+	dirty bool
+	// err is why a sync of the file failed. It stays until the file is
+	// rewritten whole: Linux may drop the pages that failed to write back
+	// and clear the error, so a later sync that succeeds proves nothing
+	// about the writes before it.
+	err error
+}
+
+// check fails once a sync of the file has failed, so nothing more is
+// written to it and acknowledged.
+func (s *syncer) check() error {
+	if s.err != nil {
+		return fmt.Errorf("earlier writes failed to sync: %v", s.err)
+	}
+	return nil
+}
+
+// wrote records a write to file, syncing it under the always policy.
+func (s *syncer) wrote(file *os.File) error {
+	switch s.policy {
+	case FsyncAlways:
+		if err := file.Sync(); err != nil {
+			s.err = err
+			return err
+		}
+	case FsyncGroup:
+		s.dirty = true
+	}
+	return nil
+}
+
+// flush syncs file if a write to it has not been synced. Once a sync has
+// failed, flush fails without trying again.
+func (s *syncer) flush(file *os.File) error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		s.err = err
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// synced records that every write to the file is on disk because it was
+// rewritten to a new file and synced whole, the only way past a failed
+// sync short of restarting the node.
+func (s *syncer) synced() {
+	s.dirty, s.err = false, nil
+}
+
+// runFsync syncs the WAL and data log every fsync_interval under the group
+// policy.
+func (n *Node) runFsync() {
+	ticker := time.NewTicker(n.config.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := n.wal.Flush(); err != nil {
+			n.logger.Error("failed to sync WAL", "err", err)
+		}
+		if err := n.store.Flush(); err != nil {
+			n.logger.Error("failed to sync data log", "err", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailedSyncIsPermanent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	broken, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.Close()
+
+	s := syncer{policy: FsyncGroup}
+	if err := s.wrote(broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(broken); err == nil {
+		t.Fatal("sync of a closed file succeeded")
+	}
+
+	// A sync that works proves nothing about the writes before it
+	file, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := s.flush(file); err == nil {
+		t.Error("flush succeeded after a failed sync")
+	}
+	if err := s.check(); err == nil {
+		t.Error("check passed after a failed sync")
+	}
+	s.synced()
+	if err := s.check(); err != nil {
+		t.Errorf("check after the file was rewritten: %v", err)
+	}
+}
+
+func TestWALAppendFailsAfterFailedSync(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, FsyncGroup, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if err := wal.Append(WALEntry{Op: walSet, Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal.sync.err = errors.New("input/output error")
+	if err := wal.Append(WALEntry{Op: walSet, Key: "b", Value: "2"}); err == nil {
+		t.Fatal("append succeeded after a failed sync")
+	}
+	after, err := os.Stat(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Errorf("WAL grew from %d to %d bytes on a failed append", before.Size(), after.Size())
+	}
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// The gateway bridges browsers to the cluster over WebSocket, at /ws on the
+// admin API, so a web UI needs no proxy of its own. A browser speaks the
+// client protocol (see the client package) as JSON text frames: it sends
+// requests such as get, set, task and watch with a request_id, and gets the
+// replies and watch events back on the same socket. An events request also
+// streams the cluster's membership events. The gateway is off until a
+// gateway_token is configured, which browsers pass in the token query
+// parameter, as they cannot set headers on a WebSocket, or in an
+// Authorization: Bearer header. The user query parameter names the client
+// for the ACL, and a request's namespace field picks the namespace of its
+// key (see namespace.go).
+
+// handleGateway upgrades an authenticated request to a WebSocket and serves
+// it as a client connection.
+func (n *Node) handleGateway(w http.ResponseWriter, r *http.Request) {
+	if n.config.GatewayToken == "" {
+		writeError(w, http.StatusNotFound, "gateway disabled: set a gateway_token")
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(n.config.GatewayToken)) != 1 {
+		n.logger.Warn("rejected gateway connection with a bad token", "remote", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "invalid gateway token")
+		return
+	}
+	conn, err := transport.UpgradeWebSocket(w, r, n.config.MaxMessageSize)
+	if err != nil {
+		n.logger.Debug("gateway handshake failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	n.logger.Info("gateway client connected", "remote", r.RemoteAddr, "user", user)
+	n.serveGateway(conn, user)
+	n.logger.Info("gateway client disconnected", "remote", r.RemoteAddr, "user", user)
+}
+
+// serveGateway serves the requests of a browser until its connection
+// closes. Every message is treated as a client request from user, whatever
+// it claims to be.
+func (n *Node) serveGateway(conn transport.Conn, user string) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	limiter := n.newLimiter()
+	defer func() {
+		cancel()
+		n.endClientWatches(conn)
+		conn.Close()
+	}()
+
+	for {
+		msg, err := conn.Recv()
+		if err != nil {
+			n.logRecvError(err)
+			return
+		}
+		msg.Client = true
+		msg.User = user
+		if n.admit(limiter, conn, msg) {
+			n.dispatch(ctx, conn, msg)
+		}
+	}
+}
+
+// clientEvents starts pushing membership events to a client as event
+// messages carrying the event in Content, until it sends an unwatch with
+// the request's id or disconnects.
+func (n *Node) clientEvents(conn transport.Conn, msg Message) Message {
+	key := clientWatchKey{conn: conn, requestID: msg.RequestID}
+	cancel := n.Subscribe(func(event Event) {
+		data, _ := json.Marshal(event)
+		if err := conn.Send(Message{Type: "event", From: n.ID, Content: string(data), RequestID: msg.RequestID, Client: true}); err != nil {
+			n.endClientWatch(key)
+		}
+	})
+
+	n.clientWatchMutex.Lock()
+	n.clientWatches[key] = cancel
+	n.clientWatchMutex.Unlock()
+
+	return Message{Type: "events"}
+}
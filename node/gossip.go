@@ -0,0 +1,89 @@
+package node
+
+import (
+	"math/rand"
+	"time"
+)
+
+const gossipInterval = time.Second * 3
+
+// runGossip periodically sends this node's membership view to one random
+// peer. Receivers connect to any member they have not seen yet, so joining a
+// single existing node eventually makes the newcomer known cluster-wide.
+func (n *Node) runGossip() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.RLock()
+		ids := make([]int, 0, len(n.conn))
+		for id := range n.conn {
+			ids = append(ids, id)
+		}
+		n.mutex.RUnlock()
+
+		if len(ids) == 0 {
+			continue
+		}
+		n.gossipTo(ids[rand.Intn(len(ids))])
+	}
+}
+
+// membership returns the connected peers plus this node itself.
+func (n *Node) membership() map[int]string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	members := map[int]string{n.ID: n.Address}
+	for id := range n.conn {
+		members[id] = n.Peers[id]
+	}
+	return members
+}
+
+func (n *Node) gossipTo(id int) {
+	n.sendMessage(id, Message{
+		Type:  "gossip",
+		From:  n.ID,
+		Peers: n.membership(),
+	})
+}
+
+func (n *Node) handleGossip(msg Message) {
+	for id, address := range msg.Peers {
+		if id == n.ID || address == "" || n.bans.Banned(id) {
+			continue
+		}
+
+		n.mutex.Lock()
+		_, known := n.Peers[id]
+		discovering := n.discovering[id]
+		if !known && !discovering {
+			n.discovering[id] = true
+		}
+		n.mutex.Unlock()
+
+		if known || discovering {
+			continue
+		}
+
+		go func(id int, address string) {
+			defer func() {
+				n.mutex.Lock()
+				delete(n.discovering, id)
+				n.mutex.Unlock()
+			}()
+
+			if err := n.Connect(id, address); err != nil {
+				n.peerLogger(id, "gossip").Warn("failed to connect to gossiped peer", "addr", address, "err", err)
+				return
+			}
+			n.peerLogger(id, "gossip").Info("discovered peer", "addr", address, "via", msg.From)
+		}(id, address)
+	}
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Groups names sets of nodes that tasks can be multicast to.
+type Groups struct {
+	members map[string][]int
+	mutex   sync.RWMutex
+}
+
+func NewGroups() *Groups {
+	return &Groups{members: make(map[string][]int)}
+}
+
+// Set defines group name as members, replacing any previous definition.
+func (g *Groups) Set(name string, members []int) {
+	ids := append([]int(nil), members...)
+	sort.Ints(ids)
+
+	g.mutex.Lock()
+	g.members[name] = ids
+	g.mutex.Unlock()
+}
+
+// Delete removes group name and reports whether it existed.
+func (g *Groups) Delete(name string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	_, ok := g.members[name]
+	delete(g.members, name)
+	return ok
+}
+
+func (g *Groups) Get(name string) ([]int, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	members, ok := g.members[name]
+	return members, ok
+}
+
+// All returns a copy of every group.
+func (g *Groups) All() map[string][]int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	all := make(map[string][]int, len(g.members))
+	for name, members := range g.members {
+		all[name] = append([]int(nil), members...)
+	}
+	return all
+}
+
+// Groups returns the node's multicast groups.
+func (n *Node) Groups() *Groups {
+	return n.groups
+}
+
+// Broadcast sends a task to every connected peer and returns the task id
+// sent to each, along with the errors of the sends that failed.
+func (n *Node) Broadcast(taskType, content string) (map[int]string, error) {
+	n.mutex.RLock()
+	targets := make([]int, 0, len(n.conn))
+	for id := range n.conn {
+		targets = append(targets, id)
+	}
+	n.mutex.RUnlock()
+
+	return n.sendTasks(targets, taskType, content)
+}
+
+// Multicast sends a task to every member of group other than this node and
+// returns the task id sent to each, along with the errors of the sends that
+// failed.
+func (n *Node) Multicast(group, taskType, content string) (map[int]string, error) {
+	members, ok := n.groups.Get(group)
+	if !ok {
+		return nil, fmt.Errorf("unknown group %q", group)
+	}
+
+	targets := make([]int, 0, len(members))
+	for _, id := range members {
+		if id != n.ID {
+			targets = append(targets, id)
+		}
+	}
+	return n.sendTasks(targets, taskType, content)
+}
+
+// sendTasks sends a task to each target, returning the ids of the tasks
+// that were sent and the errors of those that were not.
+func (n *Node) sendTasks(targets []int, taskType, content string) (map[int]string, error) {
+	ids := make(map[int]string, len(targets))
+	var errs []error
+	for _, id := range targets {
+		taskID, err := n.SendTask(id, taskType, content)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ids[id] = taskID
+	}
+	return ids, errors.Join(errs...)
+}
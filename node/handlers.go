@@ -0,0 +1,178 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTaskType is used for tasks sent without an explicit type.
+const DefaultTaskType = "echo"
+
+// TaskHandler processes the content of a task and returns its result. A
+// returned error is reported back to the submitter in the result message.
+type TaskHandler func(content string) (string, error)
+
+// Progress reports how far a running task has come, as a percentage, with
+// optional partial output. Each call sends a progress message to the node
+// that submitted the task.
+type Progress func(percent int, partial string)
+
+// ProgressHandler is a TaskHandler for long-running tasks: it may call
+// progress any number of times before returning its result.
+type ProgressHandler func(content string, progress Progress) (string, error)
+
+// ContextHandler is a ProgressHandler that can be cancelled: ctx ends when
+// the submitter stops waiting for the result, its timeout passes, or the
+// node shuts down without waiting any longer, and the handler should then
+// give up and return.
+type ContextHandler func(ctx context.Context, content string, progress Progress) (string, error)
+
+// HandlerRegistry maps task types to the handlers that process them.
+type HandlerRegistry struct {
+	handlers map[string]ContextHandler
+	mutex    sync.RWMutex
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	r := &HandlerRegistry{handlers: make(map[string]ContextHandler)}
+	r.RegisterContext(DefaultTaskType, echoHandler)
+	r.Register("ping", func(string) (string, error) { return "pong", nil })
+	r.Register("wordcount", wordCountHandler)
+	r.RegisterContext("sleep", sleepHandler)
+	return r
+}
+
+// Register installs handler for taskType, replacing any existing one.
+func (r *HandlerRegistry) Register(taskType string, handler TaskHandler) {
+	r.RegisterContext(taskType, func(_ context.Context, content string, _ Progress) (string, error) {
+		return handler(content)
+	})
+}
+
+// RegisterProgress installs a handler that reports progress for taskType,
+// replacing any existing one.
+func (r *HandlerRegistry) RegisterProgress(taskType string, handler ProgressHandler) {
+	r.RegisterContext(taskType, func(_ context.Context, content string, progress Progress) (string, error) {
+		return handler(content, progress)
+	})
+}
+
+// RegisterContext installs a handler that can be cancelled for taskType,
+// replacing any existing one.
+func (r *HandlerRegistry) RegisterContext(taskType string, handler ContextHandler) {
+	r.mutex.Lock()
+	r.handlers[taskType] = handler
+	r.mutex.Unlock()
+}
+
+func (r *HandlerRegistry) Lookup(taskType string) (ContextHandler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	handler, ok := r.handlers[taskType]
+	return handler, ok
+}
+
+// Types returns the registered task types in sorted order.
+func (r *HandlerRegistry) Types() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	types := make([]string, 0, len(r.handlers))
+	for t := range r.handlers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// RegisterHandler lets embedders add their own task types.
+func (n *Node) RegisterHandler(taskType string, handler TaskHandler) {
+	n.handlers.Register(taskType, handler)
+}
+
+// RegisterProgressHandler adds a task type whose handler reports progress
+// back to the submitter while it runs.
+func (n *Node) RegisterProgressHandler(taskType string, handler ProgressHandler) {
+	n.handlers.RegisterProgress(taskType, handler)
+}
+
+// RegisterContextHandler adds a task type whose handler is cancelled when
+// its result is no longer waited for; see ContextHandler.
+func (n *Node) RegisterContextHandler(taskType string, handler ContextHandler) {
+	n.handlers.RegisterContext(taskType, handler)
+}
+
+// TaskTypes returns the task types this node can run, sorted.
+func (n *Node) TaskTypes() []string {
+	return n.handlers.Types()
+}
+
+// runHandler calls the handler for taskType, turning panics into errors so a
+// faulty handler cannot take down a worker.
+func (n *Node) runHandler(ctx context.Context, taskType, content string, progress Progress) (result string, err error) {
+	if taskType == "" {
+		taskType = DefaultTaskType
+	}
+	handler, ok := n.handlers.Lookup(taskType)
+	if !ok {
+		return "", fmt.Errorf("unknown task type %q", taskType)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler %q panicked: %v", taskType, r)
+		}
+	}()
+	return handler(ctx, content, progress)
+}
+
+// echoHandler is the original simulated task: wait a second, then echo the
+// content back.
+func echoHandler(ctx context.Context, content string, _ Progress) (string, error) {
+	if err := sleepContext(ctx, time.Second); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Processed: %s", content), nil
+}
+
+// sleepContext waits for d or until ctx ends, returning ctx's error then.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleepHandler waits for the duration in content, 5s if it is empty,
+// reporting progress every tenth of it.
+func sleepHandler(ctx context.Context, content string, progress Progress) (string, error) {
+	d := 5 * time.Second
+	if content = strings.TrimSpace(content); content != "" {
+		var err error
+		if d, err = time.ParseDuration(content); err != nil || d < 0 {
+			return "", fmt.Errorf("invalid duration %q", content)
+		}
+	}
+	for step := 1; step <= 10; step++ {
+		if err := sleepContext(ctx, d/10); err != nil {
+			return "", err
+		}
+		if step < 10 {
+			progress(step*10, fmt.Sprintf("%v left", d-d*time.Duration(step)/10))
+		}
+	}
+	return fmt.Sprintf("slept %v", d), nil
+}
+
+func wordCountHandler(content string) (string, error) {
+	return fmt.Sprintf("%d", len(strings.Fields(content))), nil
+}
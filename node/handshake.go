@@ -0,0 +1,189 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// handshakeTimeout bounds how long a dialer waits for the peer's hello.
+const handshakeTimeout = 5 * time.Second
+
+// hello introduces this node: its id, the address it listens on, its role,
+// the protocol version and capabilities it speaks, its election term and the
+// compression it offers.
+func (n *Node) hello() Message {
+	_, term, _ := n.electionStatus()
+	msg := Message{
+		Type:         "hello",
+		From:         n.ID,
+		Content:      n.Address,
+		Role:         n.config.Role,
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		Term:         term,
+	}
+	if n.udp != nil {
+		msg.Capabilities = append(slices.Clone(msg.Capabilities), CapUDP)
+	}
+	if n.config.Linearizable {
+		msg.Capabilities = append(slices.Clone(msg.Capabilities), CapLog)
+	}
+	if n.config.Compression == transport.CompressionGzip {
+		msg.Compression = transport.CompressionGzip
+	}
+	return msg
+}
+
+// negotiated wraps conn to compress what it sends if both hellos asked for
+// compression.
+func (n *Node) negotiated(conn transport.Conn, peer Message) transport.Conn {
+	if n.config.Compression != transport.CompressionGzip || peer.Compression != transport.CompressionGzip {
+		return conn
+	}
+	return transport.NewCompressConn(conn, n.config.CompressThreshold)
+}
+
+// dial connects to the node id at address and exchanges hellos, so a
+// connection is only used once the node listening there has proven to be id.
+func (n *Node) dial(id int, address string) (*outbox, error) {
+	conn, reply, err := n.handshake(address)
+	if err != nil {
+		return nil, err
+	}
+	if reply.From != id {
+		conn.Close()
+		return nil, fmt.Errorf("node at %s is node %d, not node %d", address, reply.From, id)
+	}
+	return n.openOutbox(id, n.negotiated(conn, reply)), nil
+}
+
+// handshake connects to whatever node listens at address and exchanges
+// hellos, returning the connection and the node's hello.
+func (n *Node) handshake(address string) (transport.Conn, Message, error) {
+	conn, err := n.Transport.Dial(address)
+	if err != nil {
+		return nil, Message{}, err
+	}
+	if err := conn.Send(n.hello()); err != nil {
+		conn.Close()
+		return nil, Message{}, err
+	}
+
+	timer := time.AfterFunc(handshakeTimeout, func() { conn.Close() })
+	reply, err := conn.Recv()
+	if !timer.Stop() {
+		return nil, Message{}, fmt.Errorf("no hello from %s within %v", address, handshakeTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("handshake with %s: %v", address, err)
+	}
+	if reply.Type != "hello" {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("handshake with %s: expected hello, got %q", address, reply.Type)
+	}
+	if reply.Error != "" {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("node at %s refused the connection: %s", address, reply.Error)
+	}
+	if reply.From == n.ID {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("node at %s has our id %d", address, n.ID)
+	}
+	if err := checkVersion(reply); err != nil {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("node at %s: %w", address, err)
+	}
+	if n.bans.Banned(reply.From) {
+		conn.Close()
+		return nil, Message{}, fmt.Errorf("node at %s: node %d is %w", address, reply.From, errBanned)
+	}
+	n.learnPeer(reply.From, reply)
+	n.observeTerm(reply)
+	return conn, reply, nil
+}
+
+// acceptHello answers the hello that opens an accepted connection. Unless
+// we already have a connection to the peer, this one is registered for
+// sending to it and returned. It reports false if the hello is rejected.
+func (n *Node) acceptHello(conn transport.Conn, msg Message) (*outbox, bool) {
+	logger := n.peerLogger(msg.From, msg.Type)
+	if msg.From == n.ID {
+		logger.Warn("rejected connection from a node with our id", "addr", msg.Content)
+		return nil, false
+	}
+	if err := checkVersion(msg); err != nil {
+		// Tell the dialer why before hanging up, so it fails with a clear
+		// error instead of a closed connection
+		logger.Warn("rejected connection from an incompatible node", "addr", msg.Content, "version", helloVersion(msg))
+		reply := n.hello()
+		reply.Error = err.Error()
+		conn.Send(reply)
+		return nil, false
+	}
+	if n.bans.Banned(msg.From) {
+		logger.Warn("rejected connection from a banned node", "addr", msg.Content)
+		reply := n.hello()
+		reply.Error = fmt.Sprintf("node %d is %v", msg.From, errBanned)
+		conn.Send(reply)
+		return nil, false
+	}
+	reply := n.hello()
+	if msg.Compression != transport.CompressionGzip {
+		reply.Compression = ""
+	}
+	if err := conn.Send(reply); err != nil {
+		return nil, false
+	}
+	n.learnPeer(msg.From, msg)
+	n.observeTerm(msg)
+
+	n.mutex.Lock()
+	if msg.Content != "" {
+		if _, known := n.Peers[msg.From]; !known {
+			n.publish(Event{Type: EventJoin, Node: msg.From})
+		}
+		n.Peers[msg.From] = msg.Content
+		n.peersChanged()
+	}
+	n.welcomePeer(msg.From)
+	var registered *outbox
+	if _, connected := n.conn[msg.From]; !connected {
+		registered = n.openOutbox(msg.From, n.negotiated(conn, msg))
+		n.conn[msg.From] = registered
+	}
+	n.mutex.Unlock()
+	n.joinRing(msg.From)
+	if registered != nil {
+		go n.announceWatches(msg.From)
+		go n.announceIndexes(msg.From)
+		go n.announceDraining(msg.From)
+		go n.announceACL(msg.From)
+		go n.announceClusterConfig(msg.From)
+		go n.announceLocks(msg.From)
+		go n.announceBans(msg.From)
+	}
+
+	logger.Info("peer connected", "addr", msg.Content, "role", n.PeerRole(msg.From), "version", helloVersion(msg))
+	return registered, true
+}
+
+// logRecvError reports a connection closed because a peer failed to
+// authenticate or sent a malformed or oversized message. Other read errors
+// are a peer going away and not logged.
+func (n *Node) logRecvError(err error) {
+	switch {
+	case errors.Is(err, transport.ErrUnauthenticated):
+		n.logger.Warn("rejected unauthenticated peer", "err", err)
+	case errors.Is(err, transport.ErrTooLarge):
+		n.metrics.MessageRejected("too_large")
+		n.logger.Warn("closed connection sending an oversized message", "err", err)
+	case errors.Is(err, transport.ErrMalformed):
+		n.metrics.MessageRejected("malformed")
+		n.logger.Warn("closed connection sending a malformed message", "err", err)
+	}
+}
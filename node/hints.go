@@ -0,0 +1,200 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// Hinted handoff keeps writes flowing while a replica is down. When the
+// coordinator of a write finds one of the key's replicas unavailable, it
+// sends the write as a hint to a fallback: the first available node past
+// the key's replicas on the ring. The fallback holds the hint, without
+// applying it, and acknowledges it in the replica's place, so the write
+// still reaches its quorum. Once the replica is available again, whoever
+// holds the hint hands the write over and drops it.
+//
+// With no node to fall back on, e.g. when every node replicates every key,
+// the coordinator keeps the hint itself; it then does not count towards the
+// quorum. Hints live in memory: if the node holding them restarts before
+// the replica recovers, anti-entropy repairs the replica instead.
+
+const (
+	// handoffInterval is how often a node tries to deliver its hints.
+	handoffInterval = time.Second
+	// maxHints bounds the hints a node holds for any one replica. Only the
+	// newest write to each key is kept, so this is a number of keys.
+	maxHints = 10000
+)
+
+// hints holds writes for replicas that were down, by replica then key.
+type hints struct {
+	mutex   sync.Mutex
+	entries map[int]map[string]Entry
+}
+
+func newHints() *hints {
+	return &hints{entries: make(map[int]map[string]Entry)}
+}
+
+// add keeps e as a hint for node id, unless a newer write to key is
+// already held. It reports false if id has maxHints hints already.
+func (h *hints) add(id int, key string, e Entry) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	held := h.entries[id]
+	if held == nil {
+		held = make(map[string]Entry)
+		h.entries[id] = held
+	}
+	if old, ok := held[key]; ok {
+		held[key] = mergeEntries(old, e)
+		return true
+	}
+	if len(held) >= maxHints {
+		return false
+	}
+	held[key] = e
+	return true
+}
+
+// remove drops the hint for key held for id, if it is still the write
+// made at ts.
+func (h *hints) remove(id int, key string, ts Timestamp) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if e, ok := h.entries[id][key]; ok && e.Timestamp == ts {
+		delete(h.entries[id], key)
+		if len(h.entries[id]) == 0 {
+			delete(h.entries, id)
+		}
+	}
+}
+
+// targets returns a copy of the hints held for each node.
+func (h *hints) targets() map[int]map[string]Entry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	targets := make(map[int]map[string]Entry, len(h.entries))
+	for id, held := range h.entries {
+		copied := make(map[string]Entry, len(held))
+		for key, e := range held {
+			copied[key] = e
+		}
+		targets[id] = copied
+	}
+	return targets
+}
+
+// Len returns the number of hints held.
+func (h *hints) Len() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	total := 0
+	for _, held := range h.entries {
+		total += len(held)
+	}
+	return total
+}
+
+// fallback returns the node to hold hints for the replicas of key: the
+// first available node after them on the ring, other than this one, that
+// supports hints. It returns -1 if there is none.
+func (n *Node) fallback(key string, replicas []int) int {
+	skip := make(map[int]bool, len(replicas))
+	for _, id := range replicas {
+		skip[id] = true
+	}
+	for _, id := range n.ring.Replicas(key, len(n.ring.Nodes())) {
+		if !skip[id] && id != n.ID && n.available(id) && n.PeerSupports(id, CapHints) {
+			return id
+		}
+	}
+	return -1
+}
+
+// handOff stores write, which replica id is down for, as a hint: on a
+// fallback node if there is one, which acknowledges it under requestID, or
+// else on this node. It reports whether an ack will follow.
+func (n *Node) handOff(span *span, id int, write Message, replicas []int) bool {
+	logger := n.peerLogger(id, "hint")
+	if fallback := n.fallback(write.Key, replicas); fallback >= 0 {
+		hint := write
+		hint.Type = "hint"
+		hint.Target = &id
+		if err := n.sendMessage(fallback, span.stamp(hint)); err == nil {
+			logger.Debug("replica down, handing write off", "key", write.Key, "fallback", fallback)
+			return true
+		}
+	}
+	if !n.hints.add(id, write.Key, hintEntry(write)) {
+		logger.Warn("too many hints for replica, dropping write", "key", write.Key)
+		return false
+	}
+	logger.Debug("replica down, keeping hint", "key", write.Key)
+	return false
+}
+
+// hintEntry returns the entry a replicate or hint message writes.
+func hintEntry(msg Message) Entry {
+	e := Entry{Value: msg.Value, Deleted: msg.Content == "del", Expires: msg.Expires, Version: msg.Context, Siblings: msg.Siblings}
+	if msg.Timestamp != nil {
+		e.Timestamp = *msg.Timestamp
+	}
+	return e
+}
+
+// handleHint holds a write a coordinator handed off for a replica that is
+// down, and acknowledges it in the replica's place.
+func (n *Node) handleHint(msg Message) {
+	if msg.Target == nil || msg.Timestamp == nil || (msg.Content != "set" && msg.Content != "del") {
+		return
+	}
+	if !n.hints.add(*msg.Target, msg.Key, hintEntry(msg)) {
+		n.peerLogger(*msg.Target, "hint").Warn("too many hints for replica, refusing write", "key", msg.Key)
+		return
+	}
+	n.sendMessage(msg.From, Message{
+		Type:      "replicate_ack",
+		From:      n.ID,
+		Key:       msg.Key,
+		RequestID: msg.RequestID,
+		TraceID:   msg.TraceID,
+	})
+}
+
+// runHandoff delivers hints to their replicas once they are available
+// again, every handoffInterval.
+func (n *Node) runHandoff() {
+	ticker := time.NewTicker(handoffInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		for id, held := range n.hints.targets() {
+			if !n.available(id) {
+				continue
+			}
+			delivered := 0
+			for key, e := range held {
+				_, err := n.Call(id, replicateMessage(key, e), replicationTimeout)
+				if err != nil {
+					n.peerLogger(id, "hint").Warn("failed to hand off hint", "key", key, "err", err)
+					break
+				}
+				n.hints.remove(id, key, e.Timestamp)
+				delivered++
+			}
+			if delivered > 0 {
+				n.peerLogger(id, "hint").Info("handed off hinted writes", "count", delivered)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package node
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A few keys often draw most of the traffic, and as every request for a key
+// goes to its coordinator, one hot key can overload its node while the
+// others idle. Each node estimates how often every key it serves or routes
+// is accessed with a count-min sketch, which needs a fixed amount of memory
+// however many keys there are and never underestimates, and tracks the
+// hottest hotKeyCandidates keys alongside it. Counts halve every
+// hotKeyWindow, so a key cools down once its traffic stops. hotkeys shows
+// the hottest keys and their estimated rate.
+//
+// With hot_key_cache set, a node caches the values of keys read at
+// hot_key_threshold or more per second that clients get through it but
+// another node coordinates, for that long, and answers reads at consistency
+// one from the cache instead of the coordinator. A write through the node
+// drops its cached value; writes through other nodes are seen once it
+// expires.
+
+const (
+	// sketchDepth and sketchWidth size the count-min sketch: an estimate
+	// is off by at most 2/sketchWidth of the accesses counted, with
+	// probability 1-2^-sketchDepth.
+	sketchDepth = 4
+	sketchWidth = 2048
+	// hotKeyWindow is how often counts halve.
+	hotKeyWindow = 10 * time.Second
+	// hotKeyCandidates is how many of the hottest keys are tracked.
+	hotKeyCandidates = 64
+	// hotKeyCount is how many of them are shown and exported as metrics.
+	hotKeyCount = 10
+	// defaultHotKeyThreshold is the rate, in accesses per second, at which
+	// a key is hot.
+	defaultHotKeyThreshold = 100
+)
+
+// HotKey is a frequently accessed key.
+type HotKey struct {
+	Key string `json:"key"`
+	// Rate is the estimated accesses per second.
+	Rate float64 `json:"rate"`
+	// Cached is set if its value is cached on this node.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// hotKeyEntry is a cached value of a hot key.
+type hotKeyEntry struct {
+	reply   Message
+	expires time.Time
+}
+
+// HotKeys counts key accesses and caches the values of hot keys.
+type HotKeys struct {
+	mutex      sync.Mutex
+	sketch     [sketchDepth][sketchWidth]uint32
+	candidates map[string]uint32
+	cache      map[string]hotKeyEntry
+	decayed    time.Time
+}
+
+func NewHotKeys() *HotKeys {
+	return &HotKeys{
+		candidates: make(map[string]uint32),
+		cache:      make(map[string]hotKeyEntry),
+		decayed:    time.Now(),
+	}
+}
+
+// sketchSlots returns the counter of key in each row of the sketch.
+func sketchSlots(key string) [sketchDepth]int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	var slots [sketchDepth]int
+	for i := range slots {
+		slots[i] = int((h1 + uint32(i)*h2) % sketchWidth)
+	}
+	return slots
+}
+
+// record counts an access to key.
+func (h *HotKeys) record(key string, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.decay(now)
+	estimate := ^uint32(0)
+	for row, slot := range sketchSlots(key) {
+		if h.sketch[row][slot] < ^uint32(0) {
+			h.sketch[row][slot]++
+		}
+		estimate = min(estimate, h.sketch[row][slot])
+	}
+
+	if _, ok := h.candidates[key]; ok || len(h.candidates) < hotKeyCandidates {
+		h.candidates[key] = estimate
+		return
+	}
+	coldest, lowest := "", estimate
+	for k, count := range h.candidates {
+		if count < lowest {
+			coldest, lowest = k, count
+		}
+	}
+	if coldest != "" {
+		delete(h.candidates, coldest)
+		delete(h.cache, coldest)
+		h.candidates[key] = estimate
+	}
+}
+
+// decay halves every count once per hotKeyWindow, and drops expired
+// cached values. The caller holds the mutex.
+func (h *HotKeys) decay(now time.Time) {
+	for now.Sub(h.decayed) >= hotKeyWindow {
+		h.decayed = h.decayed.Add(hotKeyWindow)
+		for row := range h.sketch {
+			for slot := range h.sketch[row] {
+				h.sketch[row][slot] /= 2
+			}
+		}
+		for key, count := range h.candidates {
+			if count /= 2; count == 0 {
+				delete(h.candidates, key)
+			} else {
+				h.candidates[key] = count
+			}
+		}
+		// A node that stopped counting catches up in one go
+		if now.Sub(h.decayed) >= 32*hotKeyWindow {
+			h.decayed = now
+		}
+	}
+	for key, entry := range h.cache {
+		if !now.Before(entry.expires) {
+			delete(h.cache, key)
+		}
+	}
+}
+
+// hotKeyRate converts a decayed count to accesses per second: a key accessed at
+// a steady rate r counts r*hotKeyWindow*(1 + 1/2 + 1/4 + ...).
+func hotKeyRate(count uint32) float64 {
+	return float64(count) / (2 * hotKeyWindow.Seconds())
+}
+
+// hot reports whether key is accessed at threshold per second or more.
+func (h *HotKeys) hot(key string, threshold float64) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	count, ok := h.candidates[key]
+	return ok && hotKeyRate(count) >= threshold
+}
+
+// cached returns the cached reply to a get of key.
+func (h *HotKeys) cached(key string, now time.Time) (Message, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	entry, ok := h.cache[key]
+	if !ok || !now.Before(entry.expires) {
+		return Message{}, false
+	}
+	return entry.reply, true
+}
+
+// store caches reply, to a get of key, until expires.
+func (h *HotKeys) store(key string, reply Message, expires time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.candidates[key]; ok {
+		h.cache[key] = hotKeyEntry{reply: reply, expires: expires}
+	}
+}
+
+// invalidate drops the cached value of key.
+func (h *HotKeys) invalidate(key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.cache, key)
+}
+
+// Top returns the count hottest keys, hottest first.
+func (h *HotKeys) Top(count int) []HotKey {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	h.decay(now)
+	keys := make([]HotKey, 0, len(h.candidates))
+	for key, n := range h.candidates {
+		_, cached := h.cache[key]
+		keys = append(keys, HotKey{Key: key, Rate: hotKeyRate(n), Cached: cached})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate > keys[j].Rate
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// HotKeys returns the count hottest keys this node served or routed,
+// hottest first.
+func (n *Node) HotKeys(count int) []HotKey {
+	return n.hotKeys.Top(count)
+}
+
+// touchKey counts an access to key.
+func (n *Node) touchKey(key string) {
+	if key != "" {
+		n.hotKeys.record(key, time.Now())
+	}
+}
+
+// cachedGet answers a get of msg.Key coordinated by another node from the
+// hot key cache, if the key's value is cached.
+func (n *Node) cachedGet(msg Message) (Message, bool) {
+	if n.config.HotKeyCache <= 0 || n.linearizes(msg) || msg.Tx != "" || (msg.Consistency != "" && msg.Consistency != ConsistencyOne) {
+		return Message{}, false
+	}
+	reply, ok := n.hotKeys.cached(msg.Key, time.Now())
+	if ok {
+		n.metrics.HotKeyCacheHit()
+	}
+	return reply, ok
+}
+
+// cacheGet caches the coordinator's reply to a get of msg.Key, if the key
+// is hot.
+func (n *Node) cacheGet(msg Message, reply Message) {
+	if n.config.HotKeyCache <= 0 || reply.Error != "" || len(reply.Siblings) > 0 ||
+		(msg.Consistency != "" && msg.Consistency != ConsistencyOne) {
+		return
+	}
+	if !n.hotKeys.hot(msg.Key, n.config.HotKeyThreshold) {
+		return
+	}
+	reply.RequestID, reply.TraceID, reply.SpanID = "", "", ""
+	n.hotKeys.store(msg.Key, reply, time.Now().Add(n.config.HotKeyCache))
+}
+
+func (n *Node) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	count := hotKeyCount
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if count, err = strconv.Atoi(s); err != nil || count < 1 {
+			writeError(w, http.StatusBadRequest, "n must be a positive number")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, n.HotKeys(count))
+}
+
+// hotKeyRates returns the rate of the hottest keys by key, for metrics.
+func (n *Node) hotKeyRates() map[string]float64 {
+	rates := make(map[string]float64)
+	for _, key := range n.HotKeys(hotKeyCount) {
+		rates[key.Key] = key.Rate
+	}
+	return rates
+}
@@ -0,0 +1,96 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Layout of the ids made by an IDGenerator, from the most significant bit:
+// one unused sign bit, 41 bits of milliseconds since idEpoch, 10 bits of
+// node id and 12 bits of sequence.
+const (
+	idNodeBits = 10
+	idSeqBits  = 12
+
+	// MaxIDNode is the largest node id that fits in a generated id.
+	MaxIDNode = 1<<idNodeBits - 1
+	maxIDSeq  = 1<<idSeqBits - 1
+)
+
+// idEpoch is the time generated ids count from; 41 bits of milliseconds
+// last until 2093.
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// IDGenerator makes snowflake-style ids: unique across the cluster because
+// each carries the generating node's id, and roughly ordered by time
+// because the timestamp comes first. No coordination between nodes is
+// needed.
+//
+// A node never issues the same id twice while it runs, even if its clock
+// steps back or it issues more than 4096 ids in a millisecond: it keeps
+// counting from the last timestamp it used, running ahead of the clock
+// until the clock catches up.
+type IDGenerator struct {
+	mutex sync.Mutex
+	node  int64
+	last  int64
+	seq   int64
+}
+
+// NewIDGenerator returns a generator for node, which must not exceed
+// MaxIDNode.
+func NewIDGenerator(node int) *IDGenerator {
+	return &IDGenerator{node: int64(node) & MaxIDNode}
+}
+
+// Next returns a new id.
+func (g *IDGenerator) Next() int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Since(idEpoch).Milliseconds()
+	switch {
+	case now > g.last:
+		g.last = now
+		g.seq = 0
+	case g.seq < maxIDSeq:
+		g.seq++
+	default:
+		g.last++
+		g.seq = 0
+	}
+	return g.last<<(idNodeBits+idSeqBits) | g.node<<idSeqBits | g.seq
+}
+
+// ParseID splits an id made by an IDGenerator into the time it was made,
+// the node that made it and its sequence number within the millisecond.
+func ParseID(id int64) (at time.Time, node, seq int) {
+	ms := id >> (idNodeBits + idSeqBits)
+	return idEpoch.Add(time.Duration(ms) * time.Millisecond),
+		int(id >> idSeqBits & MaxIDNode),
+		int(id & maxIDSeq)
+}
+
+// NextID returns a new cluster-wide unique id (see IDGenerator).
+func (n *Node) NextID() int64 {
+	return n.ids.Next()
+}
+
+// RemoteID asks peer targetID for a new id from its generator.
+func (n *Node) RemoteID(targetID int, timeout time.Duration) (int64, error) {
+	if !n.PeerSupports(targetID, CapIDs) {
+		return 0, fmt.Errorf("node %d does not support next_id", targetID)
+	}
+	reply, err := n.Call(targetID, Message{Type: "next_id"}, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(reply.Content, 10, 64)
+}
+
+// handleNextID answers a next_id request with a new id in Content.
+func (n *Node) handleNextID(msg Message) {
+	n.Reply(msg, Message{Type: "id", Content: strconv.FormatInt(n.NextID(), 10)})
+}
@@ -0,0 +1,407 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A secondary index maps the values of a JSON field inside the values of a
+// collection, the keys starting with "<collection>:", to the keys holding
+// them. Index entries are ordinary keys, _idx/<collection>.<field>/<field
+// value>/<key>, placed on the ring by everything but the trailing key (see
+// placement), so all the keys with one field value are listed on a single
+// partition and a lookup asks only that partition's coordinator.
+//
+// The coordinator of a write adds the entry for the key's new field value.
+// Entries for old values are not removed on writes; a lookup reads every key
+// its entries point to, drops those whose field no longer has the value,
+// and deletes their stale entries.
+//
+// Index definitions are shared with every node, like watches: each node
+// sends its definitions to peers when they connect and whenever they
+// change, and keeps them in indexes.json if it has a data directory. When
+// a node learns of a new index it adds entries for the keys it coordinates.
+
+const (
+	indexKeyPrefix = "_idx/"
+	indexesFile    = "indexes.json"
+)
+
+// Index is a secondary index on Field of the JSON values in Collection. A
+// dropped index is kept, with Dropped set, so the drop wins over older
+// copies of the definition.
+type Index struct {
+	Collection string    `json:"collection"`
+	Field      string    `json:"field"`
+	Updated    time.Time `json:"updated"`
+	Dropped    bool      `json:"dropped,omitempty"`
+}
+
+// Name returns the index's name, <collection>.<field>.
+func (idx Index) Name() string {
+	return idx.Collection + "." + idx.Field
+}
+
+// covers reports whether key is in the index's collection.
+func (idx Index) covers(key string) bool {
+	return strings.HasPrefix(key, idx.Collection+":")
+}
+
+// entryPrefix returns the prefix of the index entries for field value.
+func (idx Index) entryPrefix(value string) string {
+	return indexKeyPrefix + idx.Name() + "/" + url.PathEscape(value) + "/"
+}
+
+// placement returns the part of key its place on the ring is computed from:
+// the key itself, except for index entries, which are placed by their
+// index and field value.
+func placement(key string) string {
+	if !strings.HasPrefix(key, indexKeyPrefix) {
+		return key
+	}
+	rest := key[len(indexKeyPrefix):]
+	name, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return key
+	}
+	value, _, ok := strings.Cut(rest, "/")
+	if !ok {
+		return key
+	}
+	return indexKeyPrefix + name + "/" + value + "/"
+}
+
+// fieldValue returns the value of the dotted field path in the JSON object
+// value, as text, and whether it has one. Objects, arrays and nulls are not
+// indexed.
+func fieldValue(value, path string) (string, bool) {
+	var doc any
+	if json.Unmarshal([]byte(value), &doc) != nil {
+		return "", false
+	}
+	for _, name := range strings.Split(path, ".") {
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if doc, ok = object[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+	return "", false
+}
+
+// Indexes is a node's copy of the cluster's index definitions.
+type Indexes struct {
+	mutex   sync.Mutex
+	entries map[string]Index
+	path    string
+}
+
+func NewIndexes() *Indexes {
+	return &Indexes{entries: make(map[string]Index)}
+}
+
+// load reads the definitions saved in dir, if any, and saves them there
+// from now on.
+func (x *Indexes) load(dir string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.path = filepath.Join(dir, indexesFile)
+	data, err := os.ReadFile(x.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []Index
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse %s: %v", x.path, err)
+	}
+	for _, idx := range list {
+		x.entries[idx.Name()] = idx
+	}
+	return nil
+}
+
+// all returns every definition, dropped ones included, sorted by name. The
+// caller must hold x.mutex.
+func (x *Indexes) all() []Index {
+	list := make([]Index, 0, len(x.entries))
+	for _, idx := range x.entries {
+		list = append(list, idx)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// List returns the indexes in use, sorted by name.
+func (x *Indexes) List() []Index {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var list []Index
+	for _, idx := range x.all() {
+		if !idx.Dropped {
+			list = append(list, idx)
+		}
+	}
+	return list
+}
+
+// get returns the index named name, if it is in use.
+func (x *Indexes) get(name string) (Index, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	idx, ok := x.entries[name]
+	return idx, ok && !idx.Dropped
+}
+
+// covering returns the indexes in use on key's collection.
+func (x *Indexes) covering(key string) []Index {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var list []Index
+	for _, idx := range x.entries {
+		if !idx.Dropped && idx.covers(key) {
+			list = append(list, idx)
+		}
+	}
+	return list
+}
+
+// merge adds the definitions in list that are newer than this node's and
+// saves them, returning the ones that changed.
+func (x *Indexes) merge(list []Index) ([]Index, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var changed []Index
+	for _, idx := range list {
+		if old, ok := x.entries[idx.Name()]; ok && !old.Updated.Before(idx.Updated) {
+			continue
+		}
+		x.entries[idx.Name()] = idx
+		changed = append(changed, idx)
+	}
+	if len(changed) == 0 || x.path == "" {
+		return changed, nil
+	}
+	data, err := json.MarshalIndent(x.all(), "", "  ")
+	if err != nil {
+		return changed, err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return changed, err
+	}
+	return changed, os.Rename(tmp, x.path)
+}
+
+// marshal returns every definition encoded for an index_sync.
+func (x *Indexes) marshal() string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	data, _ := json.Marshal(x.all())
+	return string(data)
+}
+
+// Indexes returns the secondary indexes in use, sorted by name.
+func (n *Node) Indexes() []Index {
+	return n.indexes.List()
+}
+
+// CreateIndex indexes field, a dotted path into JSON values, for the keys
+// of collection ("<collection>:..."), across the cluster.
+func (n *Node) CreateIndex(collection, field string) (Index, error) {
+	idx := Index{Collection: collection, Field: field, Updated: time.Now()}
+	if collection == "" || strings.ContainsAny(collection, "/:") || strings.HasPrefix(collection, "_") {
+		return idx, fmt.Errorf("invalid collection %q", collection)
+	}
+	if field == "" || strings.Contains(field, "/") {
+		return idx, fmt.Errorf("invalid field %q", field)
+	}
+	if _, ok := n.indexes.get(idx.Name()); ok {
+		return idx, fmt.Errorf("index %s already exists", idx.Name())
+	}
+	return idx, n.defineIndexes([]Index{idx})
+}
+
+// DropIndex stops maintaining the index named name and deletes its entries.
+func (n *Node) DropIndex(name string) error {
+	idx, ok := n.indexes.get(name)
+	if !ok {
+		return fmt.Errorf("no index %s", name)
+	}
+	idx.Dropped = true
+	idx.Updated = time.Now()
+	return n.defineIndexes([]Index{idx})
+}
+
+// defineIndexes applies index definitions made here or learned from a
+// peer, passing any change on to every peer.
+func (n *Node) defineIndexes(list []Index) error {
+	changed, err := n.indexes.merge(list)
+	if err != nil {
+		n.logger.Error("failed to save indexes", "err", err)
+	}
+	if len(changed) == 0 {
+		return err
+	}
+	for _, idx := range changed {
+		n.logger.Info("index changed", "index", idx.Name(), "dropped", idx.Dropped)
+		go n.rebuildIndex(idx)
+	}
+	n.sendToPeers(CapIndex, Message{Type: "index_sync", From: n.ID, Content: n.indexes.marshal()})
+	return err
+}
+
+// announceIndexes tells a newly connected peer which indexes exist.
+func (n *Node) announceIndexes(peer int) {
+	if !n.PeerSupports(peer, CapIndex) || len(n.indexes.List()) == 0 {
+		return
+	}
+	n.sendMessage(peer, Message{Type: "index_sync", From: n.ID, Content: n.indexes.marshal()})
+}
+
+func (n *Node) handleIndexSync(msg Message) {
+	var list []Index
+	if err := json.Unmarshal([]byte(msg.Content), &list); err != nil {
+		n.peerLogger(msg.From, msg.Type).Warn("invalid index definitions", "err", err)
+		return
+	}
+	n.defineIndexes(list)
+}
+
+// rebuildIndex adds the entries of a new index for the keys this node
+// coordinates, or deletes those of a dropped one.
+func (n *Node) rebuildIndex(idx Index) {
+	var entries map[string]Entry
+	if idx.Dropped {
+		prefix := indexKeyPrefix + idx.Name() + "/"
+		entries = n.store.Matching(func(key string) bool { return strings.HasPrefix(key, prefix) })
+	} else {
+		entries = n.store.Matching(idx.covers)
+	}
+
+	count := 0
+	for key, e := range entries {
+		if e.Deleted || n.coordinator(key) != n.ID {
+			continue
+		}
+		if idx.Dropped {
+			_, err := n.kvCall(Message{Type: "del", Key: key})
+			if err != nil {
+				n.logger.Warn("failed to delete index entry", "index", idx.Name(), "key", key, "err", err)
+				continue
+			}
+		} else if !n.indexKey(idx, key, e.Value) {
+			continue
+		}
+		count++
+	}
+	n.logger.Info("index rebuilt", "index", idx.Name(), "dropped", idx.Dropped, "entries", count)
+}
+
+// indexChange adds the index entries for a write this node coordinated.
+func (n *Node) indexChange(key string, e Entry) {
+	if e.Deleted || strings.HasPrefix(key, indexKeyPrefix) {
+		return
+	}
+	for _, idx := range n.indexes.covering(key) {
+		go n.indexKey(idx, key, e.Value)
+	}
+}
+
+// indexKey writes the entry of idx for key holding value, if the value has
+// the indexed field. It reports whether an entry was written.
+func (n *Node) indexKey(idx Index, key, value string) bool {
+	field, ok := fieldValue(value, idx.Field)
+	if !ok {
+		return false
+	}
+	entry := idx.entryPrefix(field) + key
+	if _, err := n.kvCall(Message{Type: "set", Key: entry, Value: key}); err != nil {
+		n.logger.Warn("failed to write index entry", "index", idx.Name(), "key", key, "err", err)
+		return false
+	}
+	return true
+}
+
+// LookupIndex returns the keys whose indexed field in the index named name
+// has value, with their values, sorted by key. Only the partition holding
+// the index entries for value is asked for them; the keys themselves are
+// then read from their coordinators.
+func (n *Node) LookupIndex(name, value string) ([]QueryRow, error) {
+	idx, ok := n.indexes.get(name)
+	if !ok {
+		return nil, fmt.Errorf("no index %s", name)
+	}
+	prefix := idx.entryPrefix(value)
+
+	var entries map[string]Entry
+	target := n.coordinator(prefix)
+	if target < 0 || target == n.ID {
+		entries = n.store.Matching(func(key string) bool { return strings.HasPrefix(key, prefix) })
+	} else {
+		q := Query{Select: "*", Conditions: []Condition{{Field: "prefix", Op: "=", Value: prefix}}}
+		reply, err := n.Call(target, Message{Type: "query", Content: q.String()}, queryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		entries = reply.Entries
+	}
+
+	var (
+		rows  []QueryRow
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+	)
+	for entry, e := range entries {
+		if e.Deleted {
+			continue
+		}
+		wg.Add(1)
+		go func(entry, key string) {
+			defer wg.Done()
+			reply, err := n.kvCall(Message{Type: "get", Key: key})
+			if err != nil {
+				n.logger.Warn("failed to read indexed key", "index", name, "key", key, "err", err)
+				return
+			}
+			if field, ok := fieldValue(reply.Value, idx.Field); !reply.Found || !ok || field != value {
+				// The key was deleted or its field changed since
+				if _, err := n.kvCall(Message{Type: "del", Key: entry}); err != nil {
+					n.logger.Debug("failed to delete stale index entry", "key", entry, "err", err)
+				}
+				return
+			}
+			mutex.Lock()
+			rows = append(rows, QueryRow{Key: key, Value: reply.Value})
+			mutex.Unlock()
+		}(entry, e.Value)
+	}
+	wg.Wait()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	return rows, nil
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// joinTimeout bounds how long a joining node waits for the seed's view of
+// the cluster.
+const joinTimeout = 5 * time.Second
+
+// Join adds this node to the cluster the node at seed belongs to, knowing
+// nothing but its address: it connects to the seed, asks it for the
+// membership list and ring layout, and connects to every member, which
+// announces this node to each of them. It returns the members it is
+// connected to afterwards. Members that could not be reached are reported
+// in the error, but still leave the node joined to the rest.
+func (n *Node) Join(seed string) ([]int, error) {
+	conn, hello, err := n.handshake(seed)
+	if err != nil {
+		return nil, err
+	}
+	seedID := hello.From
+	if !n.PeerSupports(seedID, CapJoin) {
+		conn.Close()
+		return nil, fmt.Errorf("node %d at %s does not support joining through it", seedID, seed)
+	}
+	n.register(seedID, seed, n.openOutbox(seedID, n.negotiated(conn, hello)))
+
+	requestID := newTaskID()
+	reply := n.expect(requestID, 1)
+	defer n.cancelExpect(requestID)
+
+	if err := n.sendMessage(seedID, Message{Type: "join", From: n.ID, RequestID: requestID}); err != nil {
+		return nil, err
+	}
+
+	var view Message
+	select {
+	case view = <-reply:
+	case <-time.After(joinTimeout):
+		return nil, fmt.Errorf("no membership from node %d within %v", seedID, joinTimeout)
+	case <-n.done:
+		return nil, errors.New("node is shutting down")
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		errs     []error
+	)
+	for id, address := range view.Peers {
+		if id == n.ID || id == seedID || address == "" {
+			continue
+		}
+		n.mutex.RLock()
+		_, connected := n.conn[id]
+		n.mutex.RUnlock()
+		if connected {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.Connect(id, address); err != nil {
+				errMutex.Lock()
+				errs = append(errs, fmt.Errorf("node %d at %s: %v", id, address, err))
+				errMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Nodes on the seed's ring that we could not reach stay off ours, so no
+	// keys are routed to them from here until they are discovered
+	for _, id := range view.Ring {
+		if _, ok := view.Peers[id]; !ok && id != n.ID {
+			errs = append(errs, fmt.Errorf("node %d is on the ring of node %d but has no address", id, seedID))
+		}
+	}
+
+	members := n.ring.Nodes()
+	n.logger.Info("joined cluster", "seed", seedID, "members", len(members))
+	return members, errors.Join(errs...)
+}
+
+// handleJoin answers a joining node with this node's members and ring.
+func (n *Node) handleJoin(msg Message) {
+	n.peerLogger(msg.From, msg.Type).Info("node joining")
+	n.sendMessage(msg.From, Message{
+		Type:      "join_reply",
+		From:      n.ID,
+		RequestID: msg.RequestID,
+		Peers:     n.membership(),
+		Ring:      n.ring.Nodes(),
+	})
+}
+
+// bootstrap joins through the first reachable address in the config's join
+// list, or among the members discovery finds. Addresses of this node itself
+// are skipped, so every node can share the same list; if none is reachable
+// the node starts a cluster of its own.
+func (n *Node) bootstrap() {
+	for _, address := range n.joinAddresses() {
+		members, err := n.Join(address)
+		if members == nil {
+			n.logger.Debug("bootstrap address unavailable", "addr", address, "err", err)
+			continue
+		}
+		if err != nil {
+			n.logger.Warn("joined with unreachable members", "err", err)
+		}
+		return
+	}
+	n.logger.Info("no bootstrap address reachable, starting a new cluster")
+}
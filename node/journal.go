@@ -0,0 +1,211 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With a data directory, the tasks a node accepts from peers are journaled
+// in the WAL before they are queued, and marked finished once their result
+// is sent. A task accepted but not finished when the node crashed, or was
+// killed, is found in the journal on restart: once its submitter is
+// connected again, the task is re-run, or with interrupted_tasks set to
+// fail, reported to the submitter as failed, so it is never silently lost
+// although its ack was sent long ago. Handlers cannot resume halfway, so a
+// re-run task starts over; tasks that must not run twice should fail
+// instead. Client tasks are not journaled, as the client that waited for
+// them is gone.
+
+const (
+	// InterruptedRerun re-runs the tasks a crash interrupted.
+	InterruptedRerun = "rerun"
+	// InterruptedFail reports the tasks a crash interrupted as failed.
+	InterruptedFail = "fail"
+
+	// resumeWait bounds how long an interrupted task waits for its
+	// submitter to connect after a restart before it is handled anyway.
+	resumeWait = 30 * time.Second
+)
+
+// journaledTask is a task the journal has accepted and not finished.
+type journaledTask struct {
+	msg      Message
+	accepted time.Time
+}
+
+// TaskJournal tracks the tasks this node accepted from peers and has not
+// finished, in the WAL if it has one.
+type TaskJournal struct {
+	mutex      sync.Mutex
+	unfinished map[string]journaledTask
+	wal        *WAL
+}
+
+func NewTaskJournal() *TaskJournal {
+	return &TaskJournal{unfinished: make(map[string]journaledTask)}
+}
+
+// accept journals task msg before it is queued.
+func (j *TaskJournal) accept(msg Message) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.wal == nil {
+		return nil
+	}
+	j.unfinished[msg.TaskID] = journaledTask{msg: msg, accepted: time.Now()}
+	return j.wal.Append(WALEntry{
+		Op:             walTaskAccepted,
+		TaskID:         msg.TaskID,
+		From:           msg.From,
+		TaskType:       msg.TaskType,
+		Content:        msg.Content,
+		IdempotencyKey: msg.IdempotencyKey,
+		Priority:       msg.Priority,
+		Timeout:        msg.Timeout,
+	})
+}
+
+// finish marks task id finished, if the journal holds it.
+func (j *TaskJournal) finish(id string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if _, ok := j.unfinished[id]; !ok || j.wal == nil {
+		return nil
+	}
+	delete(j.unfinished, id)
+	return j.wal.Append(WALEntry{Op: walTaskFinished, TaskID: id})
+}
+
+// restore applies a journal entry replayed from the WAL.
+func (j *TaskJournal) restore(entry WALEntry) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	switch entry.Op {
+	case walTaskAccepted:
+		j.unfinished[entry.TaskID] = journaledTask{
+			msg: Message{
+				Type:           "task",
+				From:           entry.From,
+				TaskID:         entry.TaskID,
+				TaskType:       entry.TaskType,
+				Content:        entry.Content,
+				IdempotencyKey: entry.IdempotencyKey,
+				Priority:       entry.Priority,
+				Timeout:        entry.Timeout,
+			},
+			accepted: entry.Time,
+		}
+	case walTaskFinished:
+		delete(j.unfinished, entry.TaskID)
+	}
+}
+
+// Unfinished returns the tasks accepted and not finished, oldest first.
+func (j *TaskJournal) Unfinished() []Message {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	tasks := make([]journaledTask, 0, len(j.unfinished))
+	for _, task := range j.unfinished {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, k int) bool { return tasks[i].accepted.Before(tasks[k].accepted) })
+	msgs := make([]Message, len(tasks))
+	for i, task := range tasks {
+		msgs[i] = task.msg
+	}
+	return msgs
+}
+
+// acceptTask journals a task from a peer, logging a failure to write it.
+func (n *Node) acceptTask(msg Message) {
+	if err := n.journal.accept(msg); err != nil {
+		n.logger.Error("failed to journal task", "task", msg.TaskID, "err", err)
+	}
+}
+
+// finishTask marks a journaled task finished.
+func (n *Node) finishTask(id string) {
+	if err := n.journal.finish(id); err != nil {
+		n.logger.Error("failed to journal finished task", "task", id, "err", err)
+	}
+}
+
+// resumeInterrupted handles the tasks a crash interrupted, each once its
+// submitter is connected again or resumeWait has passed.
+func (n *Node) resumeInterrupted() {
+	// Tasks parked in a handoff wait for its outcome
+	parked := n.steals.parkedTasks()
+	handedOff := make(map[string]Message)
+	bySubmitter := make(map[int][]Message)
+	for _, msg := range n.journal.Unfinished() {
+		if parked[msg.TaskID] {
+			handedOff[msg.TaskID] = msg
+			continue
+		}
+		bySubmitter[msg.From] = append(bySubmitter[msg.From], msg)
+	}
+	n.resumeHandoffs(handedOff)
+	if len(bySubmitter) == 0 {
+		return
+	}
+	n.logger.Warn("found tasks interrupted by a restart", "tasks", len(n.journal.Unfinished()), "policy", n.config.InterruptedTasks)
+	for submitter, msgs := range bySubmitter {
+		go func() {
+			n.awaitPeer(submitter, resumeWait)
+			for _, msg := range msgs {
+				n.resumeTask(msg)
+			}
+		}()
+	}
+}
+
+// awaitPeer waits until peer id is connected, at most timeout.
+func (n *Node) awaitPeer(id int, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !n.available(id) {
+		select {
+		case <-n.done:
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumeTask re-runs an interrupted task, or reports it failed.
+func (n *Node) resumeTask(msg Message) {
+	logger := n.peerLogger(msg.From, msg.Type).With("task", msg.TaskID, "task_type", msg.TaskType)
+	n.metrics.TaskInterrupted(n.config.InterruptedTasks)
+	if n.config.InterruptedTasks == InterruptedRerun {
+		if n.duplicateTask(msg) {
+			n.finishTask(msg.TaskID)
+			return
+		}
+		err := n.tasks.Enqueue(n.ctx, msg)
+		if err == nil {
+			logger.Info("re-running task interrupted by a restart")
+			return
+		}
+		n.dedup.reject(taskKey(msg))
+		logger.Warn("failed to re-run interrupted task", "err", err)
+	} else {
+		logger.Info("reporting task interrupted by a restart as failed")
+	}
+	n.sendReliable(msg.From, Message{
+		Type:   "result",
+		From:   n.ID,
+		TaskID: msg.TaskID,
+		Error:  fmt.Sprintf("interrupted by a restart of node %d", n.ID),
+	}, 0)
+	n.finishTask(msg.TaskID)
+}
@@ -0,0 +1,56 @@
+package node
+
+import "time"
+
+// A peer that loses power, or a NAT that forgets a flow, leaves a
+// half-open connection behind: nothing fails until a write outlasts TCP's
+// retransmissions, which takes minutes. Two things notice it sooner. TCP
+// keepalive (keepalive) probes idle connections and the kernel closes
+// those that stop answering. And since every node pings each peer each
+// pingInterval, a peer that has sent no pong for keepalive_timeout is
+// assumed gone even while writes are still queued, which TCP keepalive
+// does not catch: its connection is dropped and redialed, and the redial
+// fails until the peer is back.
+
+const (
+	defaultKeepAlive        = 2 * time.Second
+	defaultKeepAliveTimeout = 10 * time.Second
+)
+
+// ponged records a pong from peer id, as the connection to it carried the
+// ping.
+func (n *Node) ponged(id int) {
+	n.mutex.RLock()
+	conn := n.conn[id]
+	n.mutex.RUnlock()
+
+	if o, ok := conn.(*outbox); ok {
+		o.ponged.Store(time.Now().UnixNano())
+	}
+}
+
+// dropSilentPeers drops the connections to peers that were pinged but have
+// sent no pong for keepalive_timeout.
+func (n *Node) dropSilentPeers() {
+	if n.config.KeepAliveTimeout <= 0 {
+		return
+	}
+	n.mutex.RLock()
+	silent := make(map[int]*outbox)
+	for id, conn := range n.conn {
+		if o, ok := conn.(*outbox); ok && time.Since(time.Unix(0, o.ponged.Load())) > n.config.KeepAliveTimeout {
+			silent[id] = o
+		}
+	}
+	n.mutex.RUnlock()
+
+	for id, o := range silent {
+		// Pings only go to peers that answer them
+		if !n.PeerSupports(id, CapPing) {
+			continue
+		}
+		n.peerLogger(id, "").Warn("peer stopped answering pings, dropping connection", "timeout", n.config.KeepAliveTimeout)
+		n.metrics.ConnectionDead()
+		n.dropConnection(id, o)
+	}
+}
@@ -0,0 +1,169 @@
+package node
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// With encryption_keys set, or the DBS_ENCRYPTION_KEYS environment variable
+// when it is not, the values a node writes to its data directory, in the
+// data log and the WAL, are encrypted with AES-GCM, bound to their key so a
+// value cannot be moved to another key unnoticed. Keys, timestamps and task
+// contents are not encrypted.
+//
+// Each encryption key is 16, 24 or 32 random bytes in base64, e.g. from
+// openssl rand -base64 32. The first key of the keyring encrypts new values;
+// the others only decrypt. To rotate, put a new key first and restart the
+// node: it re-encrypts everything written under the older keys, or in the
+// clear before encryption was turned on, in the background, after which the
+// older keys can be dropped. A node refuses to start with data it has no key
+// for.
+
+const encryptionKeysEnv = "DBS_ENCRYPTION_KEYS"
+
+// sealedHeaderSize is the size of the key id and nonce in front of an
+// encrypted value.
+const sealedHeaderSize = 4 + 12
+
+// reencryptDelay is how long a starting node waits before re-encrypting data
+// written under older keys, so it is not slowed down while joining.
+const reencryptDelay = 5 * time.Second
+
+// encryptionKeys returns the keyring the config names, from the
+// environment if the config names none.
+func (c Config) encryptionKeys() []string {
+	if len(c.EncryptionKeys) > 0 {
+		return c.EncryptionKeys
+	}
+	var keys []string
+	for _, key := range strings.Split(os.Getenv(encryptionKeysEnv), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+type keyringKey struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+// Keyring encrypts values with its first key and decrypts them with any of
+// its keys. A nil Keyring encrypts nothing.
+type Keyring struct {
+	keys []keyringKey
+}
+
+// ParseKeyring builds a keyring from base64 keys, the active one first. It
+// returns nil for no keys.
+func ParseKeyring(keys []string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	k := &Keyring{}
+	for i, encoded := range keys {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: invalid base64: %v", i+1, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: must be 16, 24 or 32 bytes, not %d", i+1, len(raw))
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		id := binary.BigEndian.Uint32(sum[:])
+		for _, other := range k.keys {
+			if other.id == id {
+				return nil, fmt.Errorf("encryption key %d is listed twice", i+1)
+			}
+		}
+		k.keys = append(k.keys, keyringKey{id: id, aead: aead})
+	}
+	return k, nil
+}
+
+// seal encrypts the value stored under key with the active key.
+func (k *Keyring) seal(key string, value []byte) []byte {
+	active := k.keys[0]
+	sealed := make([]byte, sealedHeaderSize, sealedHeaderSize+len(value)+active.aead.Overhead())
+	binary.BigEndian.PutUint32(sealed, active.id)
+	rand.Read(sealed[4:sealedHeaderSize])
+	return active.aead.Seal(sealed, sealed[4:sealedHeaderSize], value, []byte(key))
+}
+
+// open decrypts a value seal encrypted under key.
+func (k *Keyring) open(key string, sealed []byte) ([]byte, error) {
+	aead, err := k.keyFor(key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	value, err := aead.Open(nil, sealed[4:sealedHeaderSize], sealed[sealedHeaderSize:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %q: %v", key, err)
+	}
+	return value, nil
+}
+
+// keyFor returns the key of the keyring the value under key was sealed
+// with, or why it cannot be decrypted.
+func (k *Keyring) keyFor(key string, sealed []byte) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%q is encrypted, but no encryption keys are set (encryption_keys or %s)", key, encryptionKeysEnv)
+	}
+	if len(sealed) < sealedHeaderSize {
+		return nil, fmt.Errorf("encrypted value of %q is truncated", key)
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	for _, candidate := range k.keys {
+		if candidate.id == id {
+			return candidate.aead, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is encrypted with key %08x, which is not in the keyring", key, id)
+}
+
+// current reports whether a value needs no re-encryption: it is sealed
+// with the active key, or in the clear without a keyring.
+func (k *Keyring) current(sealed []byte, encrypted bool) bool {
+	if k == nil {
+		return !encrypted
+	}
+	return encrypted && len(sealed) >= 4 && binary.BigEndian.Uint32(sealed) == k.keys[0].id
+}
+
+// runReencryption re-encrypts the data log and WAL entries not encrypted
+// with the active key, once, shortly after the node starts.
+func (n *Node) runReencryption() {
+	select {
+	case <-n.done:
+		return
+	case <-time.After(reencryptDelay):
+	}
+
+	if count, err := n.store.reencrypt(); err != nil {
+		n.logger.Error("failed to re-encrypt data log", "err", err)
+	} else if count > 0 {
+		n.logger.Info("re-encrypted data log", "values", count)
+	}
+	if n.wal == nil {
+		return
+	}
+	if count, err := n.wal.reencrypt(); err != nil {
+		n.logger.Error("failed to re-encrypt WAL", "err", err)
+	} else if count > 0 {
+		n.logger.Info("re-encrypted WAL", "entries", count)
+	}
+}
@@ -0,0 +1,484 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// Timestamp and Entry version the values in a Store.
+type (
+	Timestamp = transport.Timestamp
+	Entry     = transport.Entry
+)
+
+// Store is the key-value store embedded in every node. Entries live in
+// memory unless the node stores them on disk (see StorageDisk). When a WAL is
+// attached, every mutation is logged before it is applied.
+//
+// Every write is stamped with the store's Lamport clock, and a write only
+// replaces an entry with an older timestamp, so replicas that see the same
+// writes in any order end up with the same value: the last writer wins.
+// Deletes leave tombstones behind for the same reason.
+type Store struct {
+	engine engine
+	node   int
+	clock  uint64
+	mutex  sync.RWMutex
+	// compacting serializes compactions of the data log.
+	compacting sync.Mutex
+	wal        *WAL
+	// siblings makes local writes versioned; see ConflictsSiblings.
+	siblings bool
+}
+
+// NewStore returns an empty in-memory store whose writes are stamped with
+// node's id.
+func NewStore(node int) *Store {
+	return &Store{
+		engine: newMemoryEngine(),
+		node:   node,
+	}
+}
+
+func (s *Store) Get(key string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	e, ok := s.engine.lookup(key)
+	if !ok || e.Deleted || e.Expired(time.Now()) {
+		return "", false
+	}
+	return e.Value, true
+}
+
+// Lookup returns the entry stored under key as it is, tombstone or expired
+// value included, and whether there is one.
+func (s *Store) Lookup(key string) (Entry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.engine.lookup(key)
+}
+
+// Set writes value under key as a new write and returns its timestamp.
+func (s *Store) Set(key, value string) (Timestamp, error) {
+	return s.SetExpiring(key, value, 0)
+}
+
+// SetExpiring writes value under key as a new write that expires at
+// expires, in Unix milliseconds, or never if it is zero, and returns its
+// timestamp.
+func (s *Store) SetExpiring(key, value string, expires int64) (Timestamp, error) {
+	e, err := s.Write(key, Entry{Value: value, Expires: expires}, nil)
+	return e.Timestamp, err
+}
+
+// Write stores e's value, or a delete if it is deleted, under key as a new
+// write and returns the entry the key holds afterwards. When the store keeps
+// siblings the write is versioned to supersede the versions context covers,
+// or every version if it is empty. A write that could not be logged or
+// stored fails, and the key keeps what it held.
+func (s *Store) Write(key string, e Entry, context transport.VectorClock) (Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(key, e, context)
+}
+
+// write is Write with s.mutex held.
+func (s *Store) write(key string, e Entry, context transport.VectorClock) (Entry, error) {
+	e.Timestamp = s.tick()
+	if s.siblings {
+		old, found := s.engine.lookup(key)
+		e.Version = nextVersion(s.node, old, found, context)
+		if found {
+			e = mergeEntries(old, e)
+		}
+	}
+	if err := s.put(key, e); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// Delete removes key as a new write and reports its timestamp and whether
+// the key was present.
+func (s *Store) Delete(key string) (Timestamp, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, ok := s.engine.meta(key)
+	e, err := s.write(key, Entry{Deleted: true}, nil)
+	if err != nil {
+		return Timestamp{}, false, err
+	}
+	return e.Timestamp, ok && !old.Deleted && !old.Expired(time.Now()), nil
+}
+
+// Expire deletes key, as a new write, if it has expired by now, and returns
+// the entry the key holds afterwards. It reports false, changing nothing, if
+// the key is absent, deleted or was rewritten and has not expired.
+func (s *Store) Expire(key string, now time.Time) (Entry, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, ok := s.engine.meta(key)
+	if !ok || old.Deleted || !old.Expired(now) {
+		return Entry{}, false, nil
+	}
+	e, err := s.write(key, Entry{Deleted: true}, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+// Expired returns the keys that have expired by now but are not deleted
+// yet.
+func (s *Store) Expired(now time.Time) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []string
+	s.engine.eachMeta(func(k string, e Entry) {
+		if !e.Deleted && e.Expired(now) {
+			keys = append(keys, k)
+		}
+	})
+	return keys
+}
+
+// Merge applies a write made elsewhere if it is newer than what the store
+// holds for key, and reports whether it was applied. Either way the clock
+// moves past the write's time. A versioned write is merged with the
+// versions held instead (see mergeEntries), and applied if it holds one
+// they lack, and so is the state of a replicated data type (see crdt.go).
+// A write that could not be logged or stored fails, unapplied.
+func (s *Store) Merge(key string, e Entry) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observe(e.Timestamp)
+	if old, ok := s.engine.lookup(key); ok && (isCRDT(e) || isCRDT(old)) {
+		if !supersedes(e, old) {
+			return false, nil
+		}
+		return s.putMerged(key, mergeEntries(old, e))
+	}
+	if len(e.Version) == 0 && len(e.Siblings) == 0 {
+		if old, ok := s.engine.meta(key); ok && !old.Timestamp.Less(e.Timestamp) {
+			return false, nil
+		}
+		return s.putMerged(key, e)
+	}
+
+	for _, sibling := range e.Siblings {
+		s.observe(sibling.Timestamp)
+	}
+	if old, ok := s.engine.lookup(key); ok {
+		if !supersedes(e, old) {
+			return false, nil
+		}
+		e = mergeEntries(old, e)
+	}
+	return s.putMerged(key, e)
+}
+
+// putMerged is put for Merge, which reports whether the write was applied.
+func (s *Store) putMerged(key string, e Entry) (bool, error) {
+	if err := s.put(key, e); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Update writes the value update computes from the entry key holds, as a
+// new write stamped ts, and returns the entry written. Nothing is written
+// if update fails.
+func (s *Store) Update(key string, update func(old Entry, found bool, ts Timestamp) (string, error)) (Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, found := s.engine.lookup(key)
+	ts := s.tick()
+	value, err := update(old, found, ts)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Value: value, Timestamp: ts}
+	if err := s.put(key, e); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// Stamp advances the Lamport clock and returns the timestamp of a write
+// made elsewhere than the store, e.g. one appended to the linearizable log.
+func (s *Store) Stamp() Timestamp {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.tick()
+}
+
+// Observe moves the clock past ts, the timestamp of a write the store will
+// be given later.
+func (s *Store) Observe(ts Timestamp) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observe(ts)
+}
+
+// tick advances the Lamport clock for a local write. The caller must hold
+// s.mutex.
+func (s *Store) tick() Timestamp {
+	s.clock++
+	return Timestamp{Time: s.clock, Node: s.node}
+}
+
+// observe moves the clock past ts. The caller must hold s.mutex.
+func (s *Store) observe(ts Timestamp) {
+	if ts.Time > s.clock {
+		s.clock = ts.Time
+	}
+}
+
+// put logs and stores e, storing nothing if it cannot be logged. The caller
+// must hold s.mutex.
+func (s *Store) put(key string, e Entry) error {
+	op := walSet
+	if e.Deleted {
+		op = walDelete
+	}
+	ts := e.Timestamp
+	entry := WALEntry{Op: op, Key: key, Value: e.Value, Timestamp: &ts, Expires: e.Expires}
+	if len(e.Version) > 0 || len(e.Siblings) > 0 {
+		entry.Value, entry.Versioned = packVersions(e), true
+	}
+	if err := s.log(entry); err != nil {
+		return err
+	}
+	return s.engine.put(key, e)
+}
+
+// Copy returns a copy of every key and value, leaving out expired keys.
+func (s *Store) Copy() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	data := make(map[string]string)
+	s.engine.each(func(k string, e Entry) {
+		if !e.Deleted && !e.Expired(now) {
+			data[k] = e.Value
+		}
+	})
+	return data
+}
+
+// Entries returns a copy of every entry, tombstones included.
+func (s *Store) Entries() map[string]Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make(map[string]Entry)
+	s.engine.each(func(k string, e Entry) {
+		entries[k] = e
+	})
+	return entries
+}
+
+// Matching returns a copy of every entry whose key satisfies match,
+// tombstones included.
+func (s *Store) Matching(match func(key string) bool) map[string]Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make(map[string]Entry)
+	s.engine.each(func(k string, e Entry) {
+		if match(k) {
+			entries[k] = e
+		}
+	})
+	return entries
+}
+
+// Scan returns a copy of the entries, tombstones included, of the first
+// limit keys satisfying match from start up to but not including end, or to
+// the last key if end is "", and whether more such keys follow.
+func (s *Store) Scan(start, end string, limit int, match func(key string) bool) (map[string]Entry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make(map[string]Entry)
+	more := false
+	s.engine.ascend(start, end, func(k string, e Entry) bool {
+		if !match(k) {
+			return true
+		}
+		if len(entries) == limit {
+			more = true
+			return false
+		}
+		entries[k] = e
+		return true
+	})
+	return entries, more
+}
+
+// Replace swaps the store's contents for data, as new writes, logging the
+// change so it survives a restart. It stops at the first write that fails.
+func (s *Store) Replace(data map[string]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.log(WALEntry{Op: walClear}); err != nil {
+		return err
+	}
+	if err := s.engine.reset(); err != nil {
+		return err
+	}
+	for k, v := range data {
+		if err := s.put(k, Entry{Value: v, Timestamp: s.tick()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// log appends entry to the WAL, if any. The caller must hold s.mutex so log
+// order matches the order mutations are applied.
+func (s *Store) log(entry WALEntry) error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.Append(entry); err != nil {
+		return fmt.Errorf("write WAL entry: %v", err)
+	}
+	return nil
+}
+
+// clear empties the store without logging, for WAL replay.
+func (s *Store) clear() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.engine.reset()
+}
+
+// apply stores e without logging, for WAL replay. Entries are replayed in
+// the order they were applied, so no timestamps are compared.
+func (s *Store) apply(key string, e Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observe(e.Timestamp)
+	return s.engine.put(key, e)
+}
+
+// Len returns the number of keys, not counting tombstones or expired keys.
+func (s *Store) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	count := 0
+	s.engine.eachMeta(func(_ string, e Entry) {
+		if !e.Deleted && !e.Expired(now) {
+			count++
+		}
+	})
+	return count
+}
+
+// CountBy counts the live keys of each group, as group returns it for a
+// key.
+func (s *Store) CountBy(group func(key string) string) map[string]int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := time.Now()
+	counts := make(map[string]int)
+	s.engine.eachMeta(func(k string, e Entry) {
+		if !e.Deleted && !e.Expired(now) {
+			counts[group(k)]++
+		}
+	})
+	return counts
+}
+
+// Close releases the store's engine.
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.engine.close()
+}
+
+// handleKV serves a get/set/del request received from a peer and builds the
+// kv_result reply.
+func (n *Node) handleKV(msg Message) Message {
+	reply := Message{
+		Type:      "kv_result",
+		From:      n.ID,
+		Key:       msg.Key,
+		RequestID: msg.RequestID,
+	}
+
+	switch msg.Type {
+	case "get":
+		e, ok := n.store.Lookup(msg.Key)
+		if ok && !e.Deleted && !e.Expired(time.Now()) {
+			reply.Value, reply.Found = e.Value, true
+		}
+		if ok && len(e.Version) > 0 {
+			reply.Context, reply.Siblings = entryContext(e), e.Siblings
+		}
+		reply.Content = versionsContent(keyVersions(reply))
+	case "set":
+		expires := transport.ExpiresAt(msg.TTL)
+		e, err := n.store.Write(msg.Key, Entry{Value: msg.Value, Expires: expires}, msg.Context)
+		if err != nil {
+			reply.Error = fmt.Sprintf("set %s: %v", msg.Key, err)
+			break
+		}
+		n.publishChange(msg.Key, e)
+		reply.Timestamp = &e.Timestamp
+		reply.Expires = expires
+		reply.Context, reply.Siblings = e.Version, e.Siblings
+		reply.Found = true
+		reply.Content = fmt.Sprintf("set %s", msg.Key)
+	case "del":
+		old, found := n.store.Lookup(msg.Key)
+		found = found && !old.Deleted && !old.Expired(time.Now())
+		e, err := n.store.Write(msg.Key, Entry{Deleted: true}, msg.Context)
+		if err != nil {
+			reply.Error = fmt.Sprintf("del %s: %v", msg.Key, err)
+			break
+		}
+		n.publishChange(msg.Key, e)
+		reply.Timestamp = &e.Timestamp
+		reply.Context, reply.Siblings = e.Version, e.Siblings
+		reply.Found = found
+		reply.Content = fmt.Sprintf("deleted %s: %v", msg.Key, reply.Found)
+	case "update":
+		e, err := n.store.Update(msg.Key, func(old Entry, found bool, ts Timestamp) (string, error) {
+			return updateCRDT(n.ID, old, found, ts, msg.Content, msg.Value)
+		})
+		if err != nil {
+			reply.Error = fmt.Sprintf("%s %s: %v", msg.Content, msg.Key, err)
+			break
+		}
+		n.publishChange(msg.Key, e)
+		state, _ := parseCRDT(e.Value)
+		reply.Timestamp = &e.Timestamp
+		reply.Value, reply.Found = e.Value, true
+		reply.Content = crdtValue(msg.Key, state).String()
+	}
+
+	return reply
+}
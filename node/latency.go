@@ -0,0 +1,109 @@
+package node
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every node pings the peers it is connected to and times their pongs,
+// keeping a smoothed round-trip time per peer. list shows it, metrics
+// export it as dbs_peer_rtt_seconds, and the scheduler counts it against a
+// peer, so of two equally busy workers the nearer one gets the task.
+
+const (
+	pingInterval = 2 * time.Second
+	// rttSmoothing is the weight of a new sample in the smoothed RTT, as
+	// in TCP's estimator.
+	rttSmoothing = 0.125
+	// rttWeight converts a peer's RTT into queue utilisation when
+	// scheduling: a millisecond counts like 1% of a full queue.
+	rttWeight = 10.0
+)
+
+// LatencyTable keeps the smoothed round-trip time to each peer.
+type LatencyTable struct {
+	rtts  map[int]time.Duration
+	mutex sync.Mutex
+}
+
+func NewLatencyTable() *LatencyTable {
+	return &LatencyTable{rtts: make(map[int]time.Duration)}
+}
+
+// Record folds a round-trip time measured to peer id into its average.
+func (t *LatencyTable) Record(id int, rtt time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if old, ok := t.rtts[id]; ok {
+		rtt = old + time.Duration(rttSmoothing*float64(rtt-old))
+	}
+	t.rtts[id] = rtt
+}
+
+func (t *LatencyTable) Forget(id int) {
+	t.mutex.Lock()
+	delete(t.rtts, id)
+	t.mutex.Unlock()
+}
+
+func (t *LatencyTable) Get(id int) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rtt, ok := t.rtts[id]
+	return rtt, ok
+}
+
+// All returns the round-trip time to every peer measured so far.
+func (t *LatencyTable) All() map[int]time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rtts := make(map[int]time.Duration, len(t.rtts))
+	for id, rtt := range t.rtts {
+		rtts[id] = rtt
+	}
+	return rtts
+}
+
+// PeerLatency returns the smoothed round-trip time to peer id, and whether
+// it has been measured.
+func (n *Node) PeerLatency(id int) (time.Duration, bool) {
+	return n.latencies.Get(id)
+}
+
+// runPinger pings every connected peer each pingInterval. A ping carries
+// the time it was sent, which the pong echoes back. Peers whose pongs have
+// stopped are dropped; see keepalive.go.
+func (n *Node) runPinger() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+		n.sendToPeers(CapPing, Message{Type: "ping", From: n.ID, Content: sent})
+		n.dropSilentPeers()
+	}
+}
+
+func (n *Node) handlePing(msg Message) {
+	n.sendMessage(msg.From, Message{Type: "pong", From: n.ID, Content: msg.Content})
+}
+
+func (n *Node) handlePong(msg Message) {
+	n.ponged(msg.From)
+	sent, err := strconv.ParseInt(msg.Content, 10, 64)
+	if err != nil {
+		return
+	}
+	if rtt := time.Since(time.Unix(0, sent)); rtt >= 0 {
+		n.latencies.Record(msg.From, rtt)
+	}
+}
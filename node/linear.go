@@ -0,0 +1,974 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// In linearizable mode (linearizable: true, on every node) keys are not
+// spread over the ring: every get, set and del is served by the elected
+// leader. The leader appends each write to a log replicated Raft style, and
+// acknowledges it once a majority of the voting nodes hold it, when it is
+// committed and applied. Followers apply entries once the leader reports
+// them committed, so every node holding data ends up with every key. The
+// leader serves reads from its own copy while it holds its lease and once
+// it applied an entry of its own term, so a read sees every write
+// acknowledged before it began. A node only votes for a candidate whose log
+// is at least as up to date as its own, so a new leader holds every write
+// acknowledged before it.
+//
+// The log is kept in memory, the last logRetain entries of it; a follower
+// further behind is sent the leader's keys instead. With a data dir, the
+// term, vote and log are recorded in the WAL before the node acts on them:
+// a vote is recorded before it is sent, and entries before they are
+// acknowledged or, on the leader, counted towards a majority. A node that
+// restarts thus keeps every entry it acknowledged, and never votes twice
+// in a term. While a leader's lease may be live, the nodes counting
+// towards it turn other candidates away; see handleRequestVote.
+// Replicated data types, transactions and blobs keep their own paths, and
+// are not linearizable. Expired keys are deleted by the leader through the
+// log.
+
+const (
+	// logInterval is how often the leader sends followers what they lack,
+	// or the commit index if nothing.
+	logInterval = 100 * time.Millisecond
+	// logAppendTimeout bounds how long the leader waits for a follower to
+	// take a log_append or log_snapshot.
+	logAppendTimeout = 2 * time.Second
+	// logAppendBatch is the most entries sent in one log_append.
+	logAppendBatch = 500
+	// logWriteTimeout bounds how long a write waits to be committed, and a
+	// read for a new leader to catch up.
+	logWriteTimeout = 5 * time.Second
+	// logRetain is how many applied entries the log keeps at least for
+	// followers catching up.
+	logRetain = 10000
+	// logSnapshotBatch is how many keys each log_snapshot carries.
+	logSnapshotBatch = 1000
+)
+
+// errLeadLost is returned for a write whose leader stopped leading before
+// it was committed.
+var errLeadLost = errors.New("leadership lost before the write was committed; it may or may not take effect")
+
+// logEntry is a write in the log. The entry a new leader appends to commit
+// the entries of earlier terms has no key.
+type logEntry struct {
+	Index uint64 `json:"index"`
+	Term  int    `json:"term"`
+	Key   string `json:"key,omitempty"`
+	Entry Entry  `json:"entry"`
+	// IfTimestamp, if set, makes the write apply only if the key still
+	// holds the write stamped with it, as for the delete of an expired key.
+	IfTimestamp *Timestamp `json:"if_timestamp,omitempty"`
+}
+
+// logAppend is the content of a log_append: the entries following
+// PrevIndex, which the follower must hold with PrevTerm, and the leader's
+// commit index.
+type logAppend struct {
+	PrevIndex uint64     `json:"prev_index"`
+	PrevTerm  int        `json:"prev_term"`
+	Entries   []logEntry `json:"entries,omitempty"`
+	Commit    uint64     `json:"commit"`
+}
+
+// logAppendResult is the content of a follower's reply to a log_append.
+// Match is the last index its log matches the leader's at if it took the
+// entries, or where to resume from if not.
+type logAppendResult struct {
+	Success bool   `json:"success"`
+	Match   uint64 `json:"match"`
+}
+
+// logSnapshot is the content of a log_snapshot, whose Entries are a batch
+// of the leader's keys as of Index, of Term. The last batch has Last set.
+type logSnapshot struct {
+	Index uint64 `json:"index"`
+	Term  int    `json:"term"`
+	Last  bool   `json:"last,omitempty"`
+}
+
+// logResult is the outcome of a write appended to the log: whether the key
+// held a value before it was applied, or why it was not committed.
+type logResult struct {
+	found bool
+	err   error
+}
+
+// LogStatus describes a node's copy of the log.
+type LogStatus struct {
+	Last    uint64 `json:"last"`
+	Term    int    `json:"term"`
+	Commit  uint64 `json:"commit"`
+	Applied uint64 `json:"applied"`
+}
+
+// LinearLog is the replicated log of linearizable mode.
+type LinearLog struct {
+	mutex sync.Mutex
+	// base and baseTerm are the index and term of the last entry trimmed
+	// from the log.
+	base     uint64
+	baseTerm int
+	entries  []logEntry
+	commit   uint64
+	applied  uint64
+	// wal, in linearizable mode with a data dir, records the log.
+	wal *WAL
+
+	// While leading, term is the term this node leads the log in. next
+	// and match are the index of the next entry to send each follower and
+	// of the last one it is known to hold, and kicks wake its replicator.
+	// waiters are the writes waiting to be committed, by index. caughtUp
+	// is closed once an entry of term is applied, and stop when the node
+	// stops leading.
+	term     int
+	next     map[int]uint64
+	match    map[int]uint64
+	kicks    map[int]chan struct{}
+	waiters  map[uint64]chan logResult
+	caughtUp chan struct{}
+	stop     chan struct{}
+}
+
+func NewLinearLog() *LinearLog {
+	return &LinearLog{}
+}
+
+// last returns the index and term of the last entry. The caller must hold
+// l.mutex.
+func (l *LinearLog) last() (uint64, int) {
+	if len(l.entries) == 0 {
+		return l.base, l.baseTerm
+	}
+	e := l.entries[len(l.entries)-1]
+	return e.Index, e.Term
+}
+
+// termAt returns the term of the entry at index, if the log has it. The
+// caller must hold l.mutex.
+func (l *LinearLog) termAt(index uint64) (int, bool) {
+	if index == l.base {
+		return l.baseTerm, true
+	}
+	if index < l.base || index > l.base+uint64(len(l.entries)) {
+		return 0, false
+	}
+	return l.entries[index-l.base-1].Term, true
+}
+
+// from returns up to logAppendBatch entries from index, which is past the
+// base, on. The caller must hold l.mutex.
+func (l *LinearLog) from(index uint64) []logEntry {
+	start := int(index - l.base - 1)
+	end := min(len(l.entries), start+logAppendBatch)
+	if start >= end {
+		return nil
+	}
+	return slices.Clone(l.entries[start:end])
+}
+
+// trim drops the oldest applied entries once the log holds twice
+// logRetain. The caller must hold l.mutex.
+func (l *LinearLog) trim() error {
+	if len(l.entries) < 2*logRetain {
+		return nil
+	}
+	drop := min(len(l.entries)-logRetain, int(l.applied-l.base))
+	if drop <= 0 {
+		return nil
+	}
+	base := l.entries[drop-1]
+	if err := l.recordBase(base.Index, base.Term); err != nil {
+		return err
+	}
+	l.base, l.baseTerm = base.Index, base.Term
+	l.entries = slices.Clone(l.entries[drop:])
+	return nil
+}
+
+// record logs entries in the WAL before they are added to the log, each
+// replacing the entry at its index and those after it. The caller must
+// hold l.mutex.
+func (l *LinearLog) record(entries []logEntry) error {
+	if l.wal == nil || len(entries) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return l.wal.Append(WALEntry{Op: walLogEntries, Value: string(value)})
+}
+
+// recordBase logs in the WAL that the log starts after index, of term, as
+// it does once trimmed or installed from a snapshot. The caller must hold
+// l.mutex.
+func (l *LinearLog) recordBase(index uint64, term int) error {
+	if l.wal == nil {
+		return nil
+	}
+	value, err := json.Marshal(logSnapshot{Index: index, Term: term})
+	if err != nil {
+		return err
+	}
+	return l.wal.Append(WALEntry{Op: walLogBase, Value: string(value)})
+}
+
+// restore replays a change to the log recorded in the WAL. Entries up to
+// the base were applied to the store before they were trimmed, so they
+// count as applied again.
+func (l *LinearLog) restore(entry WALEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch entry.Op {
+	case walLogEntries:
+		var entries []logEntry
+		if err := json.Unmarshal([]byte(entry.Value), &entries); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Index <= l.base {
+				continue
+			}
+			if last, _ := l.last(); e.Index > last+1 {
+				return fmt.Errorf("log entry %d does not follow entry %d", e.Index, last)
+			}
+			l.entries = append(l.entries[:e.Index-l.base-1], e)
+		}
+	case walLogBase:
+		var base logSnapshot
+		if err := json.Unmarshal([]byte(entry.Value), &base); err != nil {
+			return err
+		}
+		l.install(base.Index, base.Term)
+	}
+	return nil
+}
+
+// appendEntries takes the entries of a log_append from the leader,
+// replacing any of its own they conflict with, and calls observe with the
+// timestamp of each. The entries it takes are recorded first; if that
+// fails, it takes none and returns the error. The caller must hold
+// l.mutex.
+func (l *LinearLog) appendEntries(req logAppend, observe func(Timestamp)) (logAppendResult, error) {
+	// Entries up to the base were committed, so they match the leader's
+	if req.PrevIndex >= l.base {
+		if term, ok := l.termAt(req.PrevIndex); !ok || term != req.PrevTerm {
+			last, _ := l.last()
+			return logAppendResult{Match: min(last, req.PrevIndex-1)}, nil
+		}
+	}
+	// From the first entry the log lacks or conflicts with on, every
+	// entry replaces the log's
+	for i, e := range req.Entries {
+		if e.Index <= l.base {
+			continue
+		}
+		if term, ok := l.termAt(e.Index); ok && term == e.Term {
+			continue
+		}
+		taken := req.Entries[i:]
+		if err := l.record(taken); err != nil {
+			return logAppendResult{}, err
+		}
+		l.entries = l.entries[:e.Index-l.base-1]
+		for _, e := range taken {
+			observe(e.Entry.Timestamp)
+			l.entries = append(l.entries, e)
+		}
+		break
+	}
+	return logAppendResult{Success: true, Match: req.PrevIndex + uint64(len(req.Entries))}, nil
+}
+
+// install makes the log start after index, of term, whose writes the node
+// took from a snapshot. The caller must hold l.mutex.
+func (l *LinearLog) install(index uint64, term int) {
+	if index <= l.base {
+		return
+	}
+	if t, ok := l.termAt(index); ok && t == term {
+		l.entries = slices.Clone(l.entries[index-l.base:])
+	} else {
+		l.entries = nil
+	}
+	l.base, l.baseTerm = index, term
+	l.commit = max(l.commit, index)
+	l.applied = max(l.applied, index)
+}
+
+// lead starts leading the log in term, appending the empty entry that
+// commits the entries of earlier terms. The caller must hold l.mutex.
+func (l *LinearLog) lead(term int) error {
+	index, _ := l.last()
+	e := logEntry{Index: index + 1, Term: term}
+	if err := l.record([]logEntry{e}); err != nil {
+		return err
+	}
+	l.abdicate()
+	l.term = term
+	l.next = make(map[int]uint64)
+	l.match = make(map[int]uint64)
+	l.kicks = make(map[int]chan struct{})
+	l.waiters = make(map[uint64]chan logResult)
+	l.caughtUp = make(chan struct{})
+	l.stop = make(chan struct{})
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// abdicate stops leading, failing the writes waiting to be committed. The
+// caller must hold l.mutex.
+func (l *LinearLog) abdicate() {
+	if l.term == 0 {
+		return
+	}
+	for index, waiter := range l.waiters {
+		waiter <- logResult{err: errLeadLost}
+		delete(l.waiters, index)
+	}
+	close(l.stop)
+	select {
+	case <-l.caughtUp:
+	default:
+		close(l.caughtUp)
+	}
+	l.term = 0
+	l.next, l.match, l.kicks, l.waiters = nil, nil, nil, nil
+}
+
+// resign stops leading the log, if the node did.
+func (l *LinearLog) resign() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.abdicate()
+}
+
+// Last returns the index and term of the last entry of the log.
+func (l *LinearLog) Last() (uint64, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.last()
+}
+
+// upToDate reports whether a log ending with an entry at index, of term,
+// is at least as up to date as this one.
+func (l *LinearLog) upToDate(index uint64, term int) bool {
+	last, lastTerm := l.Last()
+	return term > lastTerm || (term == lastTerm && index >= last)
+}
+
+// Status describes the log.
+func (l *LinearLog) Status() LogStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	last, term := l.last()
+	return LogStatus{Last: last, Term: term, Commit: l.commit, Applied: l.applied}
+}
+
+// LogStatus describes this node's copy of the log, or returns nil if it
+// does not run in linearizable mode.
+func (n *Node) LogStatus() *LogStatus {
+	if !n.config.Linearizable {
+		return nil
+	}
+	status := n.linear.Status()
+	return &status
+}
+
+// linearizes reports whether msg is served through the log.
+func (n *Node) linearizes(msg Message) bool {
+	return n.config.Linearizable && msg.Tx == "" && (msg.Type == "get" || msg.Type == "set" || msg.Type == "del")
+}
+
+// leadLog returns the term this node leads in, taking the lead of the log
+// if it was just elected.
+func (n *Node) leadLog() (int, error) {
+	state, term, leader := n.electionStatus()
+	if state != Leader {
+		if leader < 0 {
+			return 0, errors.New("no leader elected")
+		}
+		return 0, fmt.Errorf("node %d is not the leader; node %d is", n.ID, leader)
+	}
+
+	l := n.linear
+	l.mutex.Lock()
+	started := l.term != term
+	if started {
+		if err := l.lead(term); err != nil {
+			l.mutex.Unlock()
+			n.logger.Error("failed to record the log, not leading it", "term", term, "err", err)
+			return 0, fmt.Errorf("node %d failed to record the log: %v", n.ID, err)
+		}
+	}
+	l.mutex.Unlock()
+
+	if started {
+		n.logger.Info("leading the log", "term", term)
+		n.advanceCommit(term)
+		n.kickReplicators(term)
+	}
+	return term, nil
+}
+
+// logPeers returns the peers keeping a copy of the log: those that hold
+// data or vote, and announced linearizable mode.
+func (n *Node) logPeers() []int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var ids []int
+	for id := range n.Peers {
+		role := n.roleOf(id)
+		info, ok := n.peerInfo[id]
+		if (holdsData(role) || votes(role)) && ok && slices.Contains(info.capabilities, CapLog) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// kickReplicators wakes the replicator of every peer keeping a copy of the
+// log, starting one for peers without.
+func (n *Node) kickReplicators(term int) {
+	peers := n.logPeers()
+
+	l := n.linear
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.term != term {
+		return
+	}
+	for _, id := range peers {
+		kick, ok := l.kicks[id]
+		if !ok {
+			kick = make(chan struct{}, 1)
+			l.kicks[id] = kick
+			last, _ := l.last()
+			l.next[id] = last + 1
+			go n.replicateLog(id, term, kick, l.stop)
+		}
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicateLog sends peer id what it lacks of the log each time it is
+// kicked, until this node stops leading in term.
+func (n *Node) replicateLog(id, term int, kick, stop chan struct{}) {
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-stop:
+			return
+		case <-kick:
+		}
+		for n.appendTo(id, term) {
+		}
+	}
+}
+
+// appendTo sends peer id the next entries it lacks, or a snapshot if they
+// were trimmed, along with the commit index. It reports whether the peer
+// still lacks entries.
+func (n *Node) appendTo(id, term int) bool {
+	l := n.linear
+	l.mutex.Lock()
+	if l.term != term {
+		l.mutex.Unlock()
+		return false
+	}
+	next := l.next[id]
+	if next <= l.base {
+		l.mutex.Unlock()
+		return n.sendLogSnapshot(id, term)
+	}
+	prevTerm, _ := l.termAt(next - 1)
+	req := logAppend{PrevIndex: next - 1, PrevTerm: prevTerm, Entries: l.from(next), Commit: l.commit}
+	l.mutex.Unlock()
+
+	content, err := json.Marshal(req)
+	if err != nil {
+		n.logger.Error("failed to encode log entries", "err", err)
+		return false
+	}
+	reply, err := n.Call(id, Message{Type: "log_append", Term: term, Content: string(content)}, logAppendTimeout)
+	if reply.Term > term {
+		n.loseLead(reply.Term)
+		return false
+	}
+	if err != nil {
+		n.peerLogger(id, "log_append").Debug("log append failed", "err", err)
+		return false
+	}
+	var result logAppendResult
+	if err := json.Unmarshal([]byte(reply.Content), &result); err != nil {
+		n.peerLogger(id, "log_append").Warn("malformed log append result", "err", err)
+		return false
+	}
+
+	l.mutex.Lock()
+	if l.term != term {
+		l.mutex.Unlock()
+		return false
+	}
+	if result.Success {
+		l.match[id] = max(l.match[id], result.Match)
+		l.next[id] = result.Match + 1
+	} else {
+		l.next[id] = max(1, min(next-1, result.Match+1))
+	}
+	last, _ := l.last()
+	more := l.next[id] <= last
+	l.mutex.Unlock()
+
+	if result.Success {
+		n.advanceCommit(term)
+	}
+	return more
+}
+
+// sendLogSnapshot sends peer id every key this node holds, for a follower
+// too far behind to catch up from the log. It reports whether the peer
+// took them.
+func (n *Node) sendLogSnapshot(id, term int) bool {
+	l := n.linear
+	l.mutex.Lock()
+	index := l.applied
+	indexTerm, _ := l.termAt(index)
+	entries := n.store.Entries()
+	l.mutex.Unlock()
+
+	batch := make(map[string]Entry)
+	send := func(last bool) error {
+		content, err := json.Marshal(logSnapshot{Index: index, Term: indexTerm, Last: last})
+		if err != nil {
+			return err
+		}
+		_, err = n.Call(id, Message{Type: "log_snapshot", Term: term, Entries: batch, Content: string(content)}, logAppendTimeout)
+		batch = make(map[string]Entry)
+		return err
+	}
+	for key, e := range entries {
+		batch[key] = e
+		if len(batch) < logSnapshotBatch {
+			continue
+		}
+		if err := send(false); err != nil {
+			n.peerLogger(id, "log_snapshot").Warn("failed to send log snapshot", "err", err)
+			return false
+		}
+	}
+	if err := send(true); err != nil {
+		n.peerLogger(id, "log_snapshot").Warn("failed to send log snapshot", "err", err)
+		return false
+	}
+	n.peerLogger(id, "log_snapshot").Info("sent log snapshot", "index", index, "keys", len(entries))
+
+	l.mutex.Lock()
+	if l.term == term {
+		l.match[id] = max(l.match[id], index)
+		l.next[id] = index + 1
+	}
+	last, _ := l.last()
+	more := l.term == term && index < last
+	l.mutex.Unlock()
+
+	n.advanceCommit(term)
+	return more
+}
+
+// loseLead steps down for a newer term a follower reported.
+func (n *Node) loseLead(term int) {
+	n.mutex.Lock()
+	if term > n.election.term {
+		n.stepDown(term)
+	}
+	n.mutex.Unlock()
+
+	n.linear.resign()
+}
+
+// advanceCommit commits the entries a majority of the voting nodes hold,
+// once an entry of term is among them, and applies them.
+func (n *Node) advanceCommit(term int) {
+	n.mutex.RLock()
+	voters := n.voters()
+	self := votes(n.config.Role)
+	voting := make(map[int]bool)
+	for id := range n.Peers {
+		voting[id] = votes(n.roleOf(id))
+	}
+	n.mutex.RUnlock()
+
+	l := n.linear
+	l.mutex.Lock()
+	if l.term != term {
+		l.mutex.Unlock()
+		return
+	}
+	commit := l.commit
+	last, _ := l.last()
+	for index := last; index > l.commit; index-- {
+		// Terms only grow along the log
+		if t, _ := l.termAt(index); t != term {
+			break
+		}
+		held := 0
+		if self {
+			held++
+		}
+		for id, match := range l.match {
+			if voting[id] && match >= index {
+				held++
+			}
+		}
+		if held > voters/2 {
+			l.commit = index
+			break
+		}
+	}
+	advanced := l.commit > commit
+	changes := n.applyLog()
+	l.mutex.Unlock()
+
+	n.publishLog(changes)
+	if advanced {
+		n.kickReplicators(term)
+	}
+}
+
+// logChange is a write applied from the log, for watchers.
+type logChange struct {
+	key   string
+	entry Entry
+}
+
+// applyLog applies the committed entries not applied yet, answering the
+// writes waiting for them, and returns the writes that changed the store.
+// The caller must hold n.linear.mutex.
+func (n *Node) applyLog() []logChange {
+	l := n.linear
+	var changes []logChange
+	for l.applied < l.commit {
+		l.applied++
+		e := l.entries[l.applied-l.base-1]
+		found, written := n.applyLogEntry(e)
+		if written {
+			changes = append(changes, logChange{key: e.Key, entry: e.Entry})
+		}
+		if waiter, ok := l.waiters[e.Index]; ok {
+			waiter <- logResult{found: found}
+			delete(l.waiters, e.Index)
+		}
+		if l.term != 0 && e.Term == l.term {
+			select {
+			case <-l.caughtUp:
+			default:
+				close(l.caughtUp)
+			}
+		}
+	}
+	if err := l.trim(); err != nil {
+		n.logger.Warn("failed to record trimming the log", "err", err)
+	}
+	return changes
+}
+
+// applyLogEntry applies a committed entry to the store of a node holding
+// data. It reports whether the key held a live value before, and whether
+// the entry was written.
+func (n *Node) applyLogEntry(e logEntry) (found, written bool) {
+	if e.Key == "" {
+		return false, false
+	}
+	old, ok := n.store.Lookup(e.Key)
+	found = ok && !old.Deleted && !old.Expired(time.Now())
+	if !holdsData(n.config.Role) {
+		return found, false
+	}
+	if e.IfTimestamp != nil && (!ok || old.Timestamp != *e.IfTimestamp) {
+		return found, false
+	}
+	written, err := n.store.Merge(e.Key, e.Entry)
+	if err != nil {
+		n.logger.Error("failed to apply log entry", "key", e.Key, "err", err)
+	}
+	return found, written
+}
+
+// publishLog tells watchers about writes applied from the log.
+func (n *Node) publishLog(changes []logChange) {
+	for _, change := range changes {
+		n.publishChange(change.key, change.entry)
+	}
+}
+
+// appendWrite appends a write of key to the log as the leader of term and
+// waits until it is committed and applied. It returns the entry written and
+// whether the key held a value before.
+func (n *Node) appendWrite(term int, key string, e Entry, ifTimestamp *Timestamp) (Entry, bool, error) {
+	l := n.linear
+	l.mutex.Lock()
+	if l.term != term {
+		l.mutex.Unlock()
+		return e, false, errLeadLost
+	}
+	e.Timestamp = n.store.Stamp()
+	index, _ := l.last()
+	index++
+	entry := logEntry{Index: index, Term: term, Key: key, Entry: e, IfTimestamp: ifTimestamp}
+	if err := l.record([]logEntry{entry}); err != nil {
+		l.mutex.Unlock()
+		return e, false, fmt.Errorf("failed to record the write: %v", err)
+	}
+	l.entries = append(l.entries, entry)
+	done := make(chan logResult, 1)
+	l.waiters[index] = done
+	l.mutex.Unlock()
+
+	n.advanceCommit(term)
+	n.kickReplicators(term)
+
+	timeout := time.NewTimer(logWriteTimeout)
+	defer timeout.Stop()
+	select {
+	case result := <-done:
+		return e, result.found, result.err
+	case <-timeout.C:
+		l.mutex.Lock()
+		delete(l.waiters, index)
+		l.mutex.Unlock()
+		return e, false, fmt.Errorf("write not committed within %v; it may or may not take effect", logWriteTimeout)
+	case <-n.done:
+		return e, false, errors.New("node is shutting down")
+	}
+}
+
+// awaitReadable waits until the leader of term may serve reads from its
+// own copy: once it applied an entry of term, and so every write committed
+// before, and while it holds its lease, so no other node leads.
+func (n *Node) awaitReadable(term int) error {
+	l := n.linear
+	l.mutex.Lock()
+	caughtUp, leading := l.caughtUp, l.term == term
+	l.mutex.Unlock()
+	if !leading {
+		return errLeadLost
+	}
+
+	select {
+	case <-caughtUp:
+	case <-time.After(logWriteTimeout):
+		return fmt.Errorf("leader did not catch up with the log within %v", logWriteTimeout)
+	case <-n.done:
+		return errors.New("node is shutting down")
+	}
+	l.mutex.Lock()
+	leading = l.term == term
+	l.mutex.Unlock()
+	if !leading || !n.HasLease() {
+		return fmt.Errorf("node %d lost its lease", n.ID)
+	}
+	return nil
+}
+
+// linearKV serves a get, set or del through the log, on the leader.
+func (n *Node) linearKV(msg Message) Message {
+	reply := Message{Type: "kv_result", From: n.ID, Key: msg.Key, RequestID: msg.RequestID}
+	term, err := n.leadLog()
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	switch msg.Type {
+	case "get":
+		if err := n.awaitReadable(term); err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+		return n.handleKV(msg)
+	case "set":
+		expires := transport.ExpiresAt(msg.TTL)
+		e, _, err := n.appendWrite(term, msg.Key, Entry{Value: msg.Value, Expires: expires}, nil)
+		if err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+		reply.Timestamp = &e.Timestamp
+		reply.Expires = expires
+		reply.Found = true
+		reply.Content = fmt.Sprintf("set %s", msg.Key)
+	case "del":
+		e, found, err := n.appendWrite(term, msg.Key, Entry{Deleted: true}, nil)
+		if err != nil {
+			reply.Error = err.Error()
+			return reply
+		}
+		reply.Timestamp = &e.Timestamp
+		reply.Found = found
+		reply.Content = fmt.Sprintf("deleted %s: %v", msg.Key, found)
+	}
+	return reply
+}
+
+// refuseLog answers a log_append or log_snapshot from a node this one does
+// not follow, with its term, which makes a stale leader step down.
+func (n *Node) refuseLog(msg Message) {
+	_, term, leader := n.electionStatus()
+	n.Reply(msg, Message{
+		Type:  msg.Type + "_result",
+		From:  n.ID,
+		Term:  term,
+		Error: fmt.Sprintf("node %d follows node %d in term %d", n.ID, leader, term),
+	})
+}
+
+// handleLogAppend takes the entries the leader sent, and applies those it
+// reports committed.
+func (n *Node) handleLogAppend(msg Message) {
+	if !n.observeLeader(msg) {
+		n.refuseLog(msg)
+		return
+	}
+	if err := n.persistElection(); err != nil {
+		n.Reply(msg, Message{Type: "log_append_result", From: n.ID, Term: msg.Term, Error: "failed to record term: " + err.Error()})
+		return
+	}
+	var req logAppend
+	if err := json.Unmarshal([]byte(msg.Content), &req); err != nil {
+		n.Reply(msg, Message{Type: "log_append_result", From: n.ID, Term: msg.Term, Error: "malformed log append: " + err.Error()})
+		return
+	}
+
+	l := n.linear
+	l.mutex.Lock()
+	l.abdicate()
+	result, err := l.appendEntries(req, n.store.Observe)
+	if err != nil {
+		l.mutex.Unlock()
+		n.logger.Error("failed to record log entries", "err", err)
+		n.Reply(msg, Message{Type: "log_append_result", From: n.ID, Term: msg.Term, Error: "failed to record log entries: " + err.Error()})
+		return
+	}
+	var changes []logChange
+	if result.Success {
+		l.commit = max(l.commit, min(req.Commit, result.Match))
+		changes = n.applyLog()
+	}
+	l.mutex.Unlock()
+	n.publishLog(changes)
+
+	content, _ := json.Marshal(result)
+	n.Reply(msg, Message{Type: "log_append_result", From: n.ID, Term: msg.Term, Content: string(content)})
+}
+
+// handleLogSnapshot takes a batch of the leader's keys, and once it has
+// them all, starts its log where they leave off.
+func (n *Node) handleLogSnapshot(msg Message) {
+	if !n.observeLeader(msg) {
+		n.refuseLog(msg)
+		return
+	}
+	if err := n.persistElection(); err != nil {
+		n.Reply(msg, Message{Type: "log_snapshot_result", From: n.ID, Term: msg.Term, Error: "failed to record term: " + err.Error()})
+		return
+	}
+	var snapshot logSnapshot
+	if err := json.Unmarshal([]byte(msg.Content), &snapshot); err != nil {
+		n.Reply(msg, Message{Type: "log_snapshot_result", From: n.ID, Term: msg.Term, Error: "malformed log snapshot: " + err.Error()})
+		return
+	}
+
+	l := n.linear
+	l.mutex.Lock()
+	l.abdicate()
+	for key, e := range msg.Entries {
+		if holdsData(n.config.Role) {
+			if _, err := n.store.Merge(key, e); err != nil {
+				n.logger.Error("failed to install log snapshot entry", "key", key, "err", err)
+			}
+		} else {
+			n.store.Observe(e.Timestamp)
+		}
+	}
+	if snapshot.Last {
+		if err := l.recordBase(snapshot.Index, snapshot.Term); err != nil {
+			l.mutex.Unlock()
+			n.logger.Error("failed to record log snapshot", "err", err)
+			n.Reply(msg, Message{Type: "log_snapshot_result", From: n.ID, Term: msg.Term, Error: "failed to record log snapshot: " + err.Error()})
+			return
+		}
+		l.install(snapshot.Index, snapshot.Term)
+		n.logger.Info("installed log snapshot", "index", snapshot.Index, "from", msg.From)
+	}
+	l.mutex.Unlock()
+
+	n.Reply(msg, Message{Type: "log_snapshot_result", From: n.ID, Term: msg.Term})
+}
+
+// expireLog deletes expired keys through the log, on the leader. Each
+// delete only applies if the key was not rewritten since.
+func (n *Node) expireLog(now time.Time) {
+	if state, _, _ := n.electionStatus(); state != Leader {
+		return
+	}
+	term, err := n.leadLog()
+	if err != nil {
+		return
+	}
+	for _, key := range n.store.Expired(now) {
+		e, ok := n.store.Lookup(key)
+		if !ok || e.Deleted {
+			continue
+		}
+		ts := e.Timestamp
+		if _, _, err := n.appendWrite(term, key, Entry{Deleted: true}, &ts); err != nil {
+			n.logger.Warn("failed to expire key", "key", key, "err", err)
+			return
+		}
+		n.logger.Debug("key expired", "key", key)
+	}
+}
+
+// runLog keeps the log replicated while this node leads: it takes the lead
+// of the log once elected, and wakes every follower's replicator each
+// logInterval, which sends it what it lacks or the commit index.
+func (n *Node) runLog() {
+	ticker := time.NewTicker(logInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		if state, _, _ := n.electionStatus(); state != Leader {
+			n.linear.resign()
+			continue
+		}
+		if term, err := n.leadLog(); err == nil {
+			n.kickReplicators(term)
+		}
+	}
+}
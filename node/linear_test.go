@@ -0,0 +1,92 @@
+package node_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/client"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+func TestLinearizableLogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	configs := make(map[int]node.Config)
+	c := newCluster(t, 3, func(cfg *node.Config) {
+		cfg.Linearizable = true
+		cfg.DataDir = filepath.Join(dir, fmt.Sprint(cfg.NodeID))
+		configs[cfg.NodeID] = *cfg
+	})
+	ctx := testContext(t, 20*time.Second)
+
+	if _, err := c.Leader(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cl := connect(t, c, 1)
+	for i := range 10 {
+		if err := cl.Set(ctx, fmt.Sprintf("key-%d", i), "v"); err != nil {
+			t.Fatalf("set key-%d: %v", i, err)
+		}
+	}
+	// A write is acknowledged once a majority holds it; wait for node 3
+	want := *c.Node(1).LogStatus()
+	err := c.Until(ctx, func() bool {
+		return c.Node(3).LogStatus().Last == want.Last
+	})
+	if err != nil {
+		t.Fatalf("node 3 did not catch up with the log: %v", err)
+	}
+	term := c.Node(3).Status().Term
+
+	c.Stop(3)
+	restarted, err := node.NewNode(configs[3])
+	if err != nil {
+		t.Fatalf("restart node 3: %v", err)
+	}
+	defer restarted.Shutdown()
+
+	got := *restarted.LogStatus()
+	if got.Last != want.Last || got.Term != want.Term {
+		t.Errorf("restarted log ends at %d of term %d, want %d of term %d", got.Last, got.Term, want.Last, want.Term)
+	}
+	if status := restarted.Status(); status.Term != term {
+		t.Errorf("restarted in term %d, want %d", status.Term, term)
+	}
+}
+
+func TestLinearizableFailoverKeepsAcknowledgedWrites(t *testing.T) {
+	c := newCluster(t, 3, func(cfg *node.Config) {
+		cfg.Linearizable = true
+	})
+	ctx := testContext(t, 30*time.Second)
+
+	if _, err := c.Leader(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cl := connect(t, c, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cl.Set(ctx, key, key+"!"); err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+
+	c.Stop(1)
+	if _, err := c.Leader(ctx); err != nil {
+		t.Fatalf("no leader after node 1 stopped: %v", err)
+	}
+	// Reads go through the new leader once it applied an entry of its term
+	err := c.Until(ctx, func() bool {
+		value, found, err := cl.Get(ctx, "c")
+		return err == nil && found && value == "c!"
+	})
+	if err != nil {
+		t.Fatalf("write acknowledged before failover not readable: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		value, found, err := connect(t, c, 2).GetConsistency(ctx, key, client.One)
+		if err != nil || !found || value != key+"!" {
+			t.Errorf("get %s = %q, %v, %v after failover", key, value, found, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package node
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// NodeLoad is the last load a node reported, as seen by this node.
+type NodeLoad struct {
+	ID         int       `json:"id"`
+	Health     string    `json:"health"`
+	ReportedAt time.Time `json:"reported_at"`
+	transport.Load
+}
+
+// LoadTable keeps the most recent load reported by each peer.
+type LoadTable struct {
+	loads map[int]NodeLoad
+	mutex sync.Mutex
+}
+
+func NewLoadTable() *LoadTable {
+	return &LoadTable{loads: make(map[int]NodeLoad)}
+}
+
+func (t *LoadTable) Record(id int, load transport.Load) {
+	t.mutex.Lock()
+	t.loads[id] = NodeLoad{ID: id, ReportedAt: time.Now(), Load: load}
+	t.mutex.Unlock()
+}
+
+func (t *LoadTable) Forget(id int) {
+	t.mutex.Lock()
+	delete(t.loads, id)
+	t.mutex.Unlock()
+}
+
+func (t *LoadTable) Get(id int) (NodeLoad, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	load, ok := t.loads[id]
+	return load, ok
+}
+
+// currentLoad samples this node's load for its heartbeats.
+func (n *Node) currentLoad() transport.Load {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return transport.Load{
+		QueueDepth:    n.tasks.Depth(),
+		QueueCapacity: n.tasks.Capacity(),
+		IdleWorkers:   n.tasks.Idle(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapBytes:     mem.HeapAlloc,
+	}
+}
+
+// ClusterLoad returns the load of this node and the last load reported by
+// every peer, ordered by node id. Every node sends its load with its
+// heartbeats, so the leader's view covers the whole cluster.
+func (n *Node) ClusterLoad() []NodeLoad {
+	loads := []NodeLoad{{
+		ID:         n.ID,
+		Health:     "self",
+		ReportedAt: time.Now(),
+		Load:       n.currentLoad(),
+	}}
+
+	for id, h := range n.detector.Status() {
+		load, _ := n.loads.Get(id)
+		load.ID = id
+		load.Health = h.Status
+		loads = append(loads, load)
+	}
+
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].ID < loads[j].ID
+	})
+	return loads
+}
@@ -0,0 +1,323 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Locks are named leases granted by the leader, for mutual exclusion and
+// leader election among applications. A lock is held until its holder
+// releases it or its time to live runs out, and holders renew it to keep
+// it. Each grant carries a fencing token, larger than every token granted
+// before it, which the holder passes along to what the lock guards, so a
+// write from a holder whose lease ran out while it was paused can be told
+// apart from one by the next holder and rejected.
+//
+// Requests made on other nodes are forwarded to the leader, which only
+// grants while it holds a majority's lease. It shares the lock table with
+// every peer when it changes, so a new leader after a failover knows the
+// leases that are still running; tokens start with the leader's term, so
+// they keep growing across failovers. Lease expiry is measured by the
+// leader's clock.
+
+// lockTimeout bounds a lock request forwarded to the leader.
+const lockTimeout = 2 * time.Second
+
+var (
+	errLockHeld = errors.New("lock held")
+	errNoLock   = errors.New("lock not held")
+)
+
+// Lease is a lock granted to Owner until Expires, with the fencing token
+// Token.
+type Lease struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Locks is a node's copy of the cluster's lock table.
+type Locks struct {
+	mutex  sync.Mutex
+	leases map[string]Lease
+	// term and seq number the tokens granted: the seq-th grant in term
+	// gets term<<32 | seq.
+	term int
+	seq  uint64
+}
+
+func NewLocks() *Locks {
+	return &Locks{leases: make(map[string]Lease)}
+}
+
+// locksState is what the leader sends its peers.
+type locksState struct {
+	Term   int     `json:"term"`
+	Seq    uint64  `json:"seq"`
+	Leases []Lease `json:"leases"`
+}
+
+// List returns the leases that have not run out, sorted by name.
+func (l *Locks) List() []Lease {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.running(time.Now())
+}
+
+// running returns the leases that have not run out by now, sorted by name.
+// The caller must hold l.mutex.
+func (l *Locks) running(now time.Time) []Lease {
+	leases := make([]Lease, 0, len(l.leases))
+	for _, lease := range l.leases {
+		if lease.Expires.After(now) {
+			leases = append(leases, lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+	return leases
+}
+
+// marshal returns the lock table encoded for a lock_sync.
+func (l *Locks) marshal() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	data, _ := json.Marshal(locksState{Term: l.term, Seq: l.seq, Leases: l.running(time.Now())})
+	return string(data)
+}
+
+// replace adopts the lock table of the leader of state.Term, unless it is
+// from an older term than the last one seen.
+func (l *Locks) replace(state locksState) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if state.Term < l.term {
+		return false
+	}
+	l.term, l.seq = state.Term, state.Seq
+	l.leases = make(map[string]Lease, len(state.Leases))
+	for _, lease := range state.Leases {
+		l.leases[lease.Name] = lease
+	}
+	return true
+}
+
+// acquire grants lock name to owner for ttl as the leader of term. An owner
+// acquiring a lock it holds renews it and keeps its token.
+func (l *Locks) acquire(term int, name, owner string, ttl time.Duration) (Lease, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if lease, ok := l.leases[name]; ok && lease.Expires.After(now) {
+		if lease.Owner != owner {
+			return lease, fmt.Errorf("%w: %s is held by %s until %s", errLockHeld, name, lease.Owner, lease.Expires.Format(time.RFC3339))
+		}
+		lease.Expires = now.Add(ttl)
+		l.leases[name] = lease
+		return lease, nil
+	}
+
+	if term != l.term {
+		l.term, l.seq = term, 0
+	}
+	l.seq++
+	lease := Lease{Name: name, Owner: owner, Token: uint64(term)<<32 | l.seq, Expires: now.Add(ttl)}
+	l.leases[name] = lease
+	return lease, nil
+}
+
+// renew extends the lease of lock name granted with token by ttl from now.
+func (l *Locks) renew(name string, token uint64, ttl time.Duration) (Lease, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	lease, ok := l.leases[name]
+	if !ok || lease.Token != token || !lease.Expires.After(now) {
+		return Lease{}, fmt.Errorf("%w: %s with token %d", errNoLock, name, token)
+	}
+	lease.Expires = now.Add(ttl)
+	l.leases[name] = lease
+	return lease, nil
+}
+
+// release frees lock name if it is still held with token.
+func (l *Locks) release(name string, token uint64) (Lease, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	lease, ok := l.leases[name]
+	if !ok || lease.Token != token || !lease.Expires.After(time.Now()) {
+		return Lease{}, fmt.Errorf("%w: %s with token %d", errNoLock, name, token)
+	}
+	delete(l.leases, name)
+	return lease, nil
+}
+
+// Locks returns the locks held in the cluster as this node knows them,
+// sorted by name.
+func (n *Node) Locks() []Lease {
+	return n.locks.List()
+}
+
+// AcquireLock takes lock name for this node for ttl. It fails at once if
+// another holder has it; acquiring a lock this node holds renews it.
+func (n *Node) AcquireLock(name string, ttl time.Duration) (Lease, error) {
+	return n.lockRequest(Message{Type: "lock", Key: name, Value: peerSubject(n.ID), TTL: ttl})
+}
+
+// RenewLock extends lease by ttl from now, if it is still held.
+func (n *Node) RenewLock(lease Lease, ttl time.Duration) (Lease, error) {
+	return n.lockRequest(Message{Type: "lock_renew", Key: lease.Name, Content: strconv.FormatUint(lease.Token, 10), TTL: ttl})
+}
+
+// ReleaseLock frees the lock of lease, if it is still held.
+func (n *Node) ReleaseLock(lease Lease) error {
+	_, err := n.lockRequest(Message{Type: "unlock", Key: lease.Name, Content: strconv.FormatUint(lease.Token, 10)})
+	return err
+}
+
+// lockRequest applies a lock, lock_renew or unlock on this node if it
+// leads, or else on the leader, and returns the lease it concerns.
+func (n *Node) lockRequest(msg Message) (Lease, error) {
+	if msg.Key == "" {
+		return Lease{}, errors.New("a lock needs a name")
+	}
+	if msg.Type != "unlock" && msg.TTL <= 0 {
+		return Lease{}, fmt.Errorf("invalid lease time %v", msg.TTL)
+	}
+
+	n.mutex.RLock()
+	leader, leading := n.election.leaderID, n.election.state == Leader
+	n.mutex.RUnlock()
+
+	var reply Message
+	switch {
+	case leading:
+		if reply = n.applyLock(msg); reply.Error != "" {
+			return Lease{}, errors.New(reply.Error)
+		}
+	case leader < 0:
+		return Lease{}, errors.New("no known leader to lock with")
+	case !n.PeerSupports(leader, CapLocks):
+		return Lease{}, fmt.Errorf("leader %d does not support locks", leader)
+	default:
+		var err error
+		if reply, err = n.Call(leader, msg, lockTimeout); err != nil {
+			return Lease{}, err
+		}
+	}
+	var lease Lease
+	if err := json.Unmarshal([]byte(reply.Content), &lease); err != nil {
+		return Lease{}, fmt.Errorf("invalid lease: %v", err)
+	}
+	return lease, nil
+}
+
+// applyLock applies a lock request as the leader, shares the lock table
+// with the peers, and builds the reply.
+func (n *Node) applyLock(msg Message) Message {
+	reply := Message{Type: "lock_result", Key: msg.Key}
+	n.mutex.RLock()
+	term, lease := n.election.term, n.hasQuorum()
+	n.mutex.RUnlock()
+	if !lease {
+		reply.Error = fmt.Sprintf("node %d leads without a quorum and cannot grant locks", n.ID)
+		return reply
+	}
+
+	var (
+		granted Lease
+		err     error
+	)
+	switch msg.Type {
+	case "lock":
+		granted, err = n.locks.acquire(term, msg.Key, msg.Value, msg.TTL)
+	case "lock_renew", "unlock":
+		token, parseErr := strconv.ParseUint(msg.Content, 10, 64)
+		switch {
+		case parseErr != nil:
+			err = fmt.Errorf("invalid token %q", msg.Content)
+		case msg.Type == "lock_renew":
+			granted, err = n.locks.renew(msg.Key, token, msg.TTL)
+		default:
+			granted, err = n.locks.release(msg.Key, token)
+		}
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	n.logger.Debug("lock changed", "op", msg.Type, "lock", granted.Name, "owner", granted.Owner, "token", granted.Token)
+	n.syncLocks()
+	data, _ := json.Marshal(granted)
+	reply.Content = string(data)
+	return reply
+}
+
+// syncLocks sends this node's lock table to every peer.
+func (n *Node) syncLocks() {
+	n.sendToPeers(CapLocks, Message{Type: "lock_sync", From: n.ID, Content: n.locks.marshal()})
+}
+
+// announceLocks sends a newly connected peer the lock table, if this node
+// leads.
+func (n *Node) announceLocks(peer int) {
+	n.mutex.RLock()
+	leading := n.election.state == Leader
+	n.mutex.RUnlock()
+
+	if !leading || len(n.locks.List()) == 0 || !n.PeerSupports(peer, CapLocks) {
+		return
+	}
+	n.sendMessage(peer, Message{Type: "lock_sync", From: n.ID, Content: n.locks.marshal()})
+}
+
+// handleLockMessage serves a lock request forwarded to this node as the
+// leader, or takes over the leader's lock table.
+func (n *Node) handleLockMessage(msg Message) {
+	switch msg.Type {
+	case "lock", "lock_renew", "unlock":
+		n.mutex.RLock()
+		leading := n.election.state == Leader
+		n.mutex.RUnlock()
+		if !leading {
+			n.Reply(msg, Message{Type: "lock_result", Error: fmt.Sprintf("node %d is not the leader", n.ID)})
+			return
+		}
+		n.Reply(msg, n.applyLock(msg))
+
+	case "lock_sync":
+		var state locksState
+		if err := json.Unmarshal([]byte(msg.Content), &state); err != nil {
+			n.peerLogger(msg.From, msg.Type).Warn("invalid lock table", "err", err)
+			return
+		}
+		n.locks.replace(state)
+	}
+}
+
+// clientLock serves a client's lock request, forwarding it to the leader if
+// need be.
+func (n *Node) clientLock(msg Message) Message {
+	owner := msg.Value
+	if owner == "" {
+		owner = clientSubject(msg.User)
+	}
+	lease, err := n.lockRequest(Message{Type: msg.Type, Key: msg.Key, Value: owner, Content: msg.Content, TTL: msg.TTL})
+	if err != nil {
+		return Message{Type: "lock_result", Key: msg.Key, Error: err.Error()}
+	}
+	data, _ := json.Marshal(lease)
+	return Message{Type: "lock_result", Key: msg.Key, Content: string(data)}
+}
@@ -0,0 +1,53 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var slogLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogger builds the node's structured logger from cfg. Logs go to stderr
+// unless a log writer or a log file is configured, which keeps them out of
+// the CLI. The returned closer releases the log file, if any.
+func newLogger(cfg Config) (*slog.Logger, io.Closer, error) {
+	var out io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	switch {
+	case cfg.LogOutput != nil:
+		out = cfg.LogOutput
+	case cfg.LogFile != "":
+		file, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open log file: %v", err)
+		}
+		out = file
+		closer = file
+	}
+
+	opts := &slog.HandlerOptions{Level: slogLevels[cfg.LogLevel]}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+
+	return slog.New(handler).With("node", cfg.NodeID), closer, nil
+}
+
+// peerLogger returns the node logger tagged with a peer and, if given, a
+// message type.
+func (n *Node) peerLogger(peer int, msgType string) *slog.Logger {
+	if msgType == "" {
+		return n.logger.With("peer", peer)
+	}
+	return n.logger.With("peer", peer, "type", msgType)
+}
@@ -0,0 +1,93 @@
+package node
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// merkleLeaves is the number of key buckets hashed into a Merkle tree's
+// leaves. It must be a power of two.
+const merkleLeaves = 64
+
+// MerkleTree summarises keys and values as a binary hash tree over a fixed
+// number of key buckets, stored in heap order with the root first. Replicas
+// holding the same data build identical trees, and comparing two trees
+// top-down finds the buckets that differ without exchanging any keys.
+type MerkleTree []uint64
+
+func merkleBucket(key string) int {
+	return int(hashKey(key) % merkleLeaves)
+}
+
+func BuildMerkleTree(data map[string]Entry) MerkleTree {
+	buckets := make([][]string, merkleLeaves)
+	for key := range data {
+		b := merkleBucket(key)
+		buckets[b] = append(buckets[b], key)
+	}
+
+	tree := make(MerkleTree, 2*merkleLeaves-1)
+	for i, keys := range buckets {
+		sort.Strings(keys)
+		h := fnv.New64a()
+		for _, key := range keys {
+			e := data[key]
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(e.Value))
+			h.Write([]byte{0})
+			var version [17]byte
+			binary.BigEndian.PutUint64(version[:8], e.Timestamp.Time)
+			binary.BigEndian.PutUint64(version[8:16], uint64(e.Timestamp.Node))
+			if e.Deleted {
+				version[16] = 1
+			}
+			h.Write(version[:])
+			// Siblings are identified by their timestamps
+			for _, s := range e.Siblings {
+				binary.BigEndian.PutUint64(version[:8], s.Timestamp.Time)
+				binary.BigEndian.PutUint64(version[8:16], uint64(s.Timestamp.Node))
+				h.Write(version[:16])
+			}
+		}
+		tree[merkleLeaves-1+i] = h.Sum64()
+	}
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		var buf [16]byte
+		binary.BigEndian.PutUint64(buf[:8], tree[2*i+1])
+		binary.BigEndian.PutUint64(buf[8:], tree[2*i+2])
+		h := fnv.New64a()
+		h.Write(buf[:])
+		tree[i] = h.Sum64()
+	}
+	return tree
+}
+
+// Diff returns the buckets whose contents differ between t and other,
+// descending only into subtrees whose hashes do not match.
+func (t MerkleTree) Diff(other MerkleTree) []int {
+	if len(other) != len(t) {
+		all := make([]int, merkleLeaves)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	var buckets []int
+	var walk func(i int)
+	walk = func(i int) {
+		if t[i] == other[i] {
+			return
+		}
+		if i >= merkleLeaves-1 {
+			buckets = append(buckets, i-(merkleLeaves-1))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return buckets
+}
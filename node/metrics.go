@@ -0,0 +1,370 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// taskLatencyBuckets are the upper bounds, in seconds, of the task
+// processing latency histogram.
+var taskLatencyBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects node counters and exposes them in the Prometheus text
+// format.
+type Metrics struct {
+	sent            map[string]uint64
+	received        map[string]uint64
+	dropped         map[string]uint64
+	throttled       map[string]uint64
+	denied          map[string]uint64
+	deferred        map[string]uint64
+	unknown         map[string]uint64
+	rejected        map[string]uint64
+	interrupted     map[string]uint64
+	shortCircuited  map[string]uint64
+	invalid         map[string]uint64
+	namespaces      map[string]uint64
+	heartbeatMisses uint64
+	heartbeatsLost  uint64
+	keysRepaired    uint64
+	deduplicated    uint64
+	stolen          uint64
+	circuitsOpened  uint64
+	deadConns       uint64
+	hotKeyHits      uint64
+	taskLatency     *Histogram
+	mutex           sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sent:           make(map[string]uint64),
+		received:       make(map[string]uint64),
+		dropped:        make(map[string]uint64),
+		throttled:      make(map[string]uint64),
+		denied:         make(map[string]uint64),
+		deferred:       make(map[string]uint64),
+		unknown:        make(map[string]uint64),
+		rejected:       make(map[string]uint64),
+		interrupted:    make(map[string]uint64),
+		shortCircuited: make(map[string]uint64),
+		invalid:        make(map[string]uint64),
+		namespaces:     make(map[string]uint64),
+		taskLatency:    NewHistogram(taskLatencyBuckets),
+	}
+}
+
+func (m *Metrics) MessageSent(msgType string) {
+	m.mutex.Lock()
+	m.sent[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageReceived(msgType string) {
+	m.mutex.Lock()
+	m.received[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageDropped(msgType string) {
+	m.mutex.Lock()
+	m.dropped[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageThrottled(msgType string) {
+	m.mutex.Lock()
+	m.throttled[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageDenied(msgType string) {
+	m.mutex.Lock()
+	m.denied[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageDeferred(msgType string) {
+	m.mutex.Lock()
+	m.deferred[msgType]++
+	m.mutex.Unlock()
+}
+
+// MessageRejected counts a connection closed for a message that was
+// malformed or too large.
+func (m *Metrics) MessageRejected(reason string) {
+	m.mutex.Lock()
+	m.rejected[reason]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) MessageUnknown(msgType string) {
+	m.mutex.Lock()
+	m.unknown[msgType]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) HeartbeatMissed() {
+	m.mutex.Lock()
+	m.heartbeatMisses++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) HeartbeatsLost(count uint64) {
+	m.mutex.Lock()
+	m.heartbeatsLost += count
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) KeysRepaired(count int) {
+	m.mutex.Lock()
+	m.keysRepaired += uint64(count)
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) TaskDeduplicated() {
+	m.mutex.Lock()
+	m.deduplicated++
+	m.mutex.Unlock()
+}
+
+// MessageShortCircuited counts a message not sent because the peer's
+// circuit breaker is open.
+func (m *Metrics) MessageShortCircuited(msgType string) {
+	m.mutex.Lock()
+	m.shortCircuited[msgType]++
+	m.mutex.Unlock()
+}
+
+// CircuitOpened counts a peer's circuit breaker opening.
+func (m *Metrics) CircuitOpened() {
+	m.mutex.Lock()
+	m.circuitsOpened++
+	m.mutex.Unlock()
+}
+
+// ConnectionDead counts a peer connection dropped for answering no pings.
+func (m *Metrics) ConnectionDead() {
+	m.mutex.Lock()
+	m.deadConns++
+	m.mutex.Unlock()
+}
+
+// HotKeyCacheHit counts a read of a hot key answered from the cache.
+func (m *Metrics) HotKeyCacheHit() {
+	m.mutex.Lock()
+	m.hotKeyHits++
+	m.mutex.Unlock()
+}
+
+// TasksStolen counts queued tasks handed over to an idle node.
+func (m *Metrics) TasksStolen(count int) {
+	m.mutex.Lock()
+	m.stolen += uint64(count)
+	m.mutex.Unlock()
+}
+
+// PayloadInvalid counts a task rejected because its content did not match
+// its type's schema.
+func (m *Metrics) PayloadInvalid(taskType string) {
+	m.mutex.Lock()
+	m.invalid[taskType]++
+	m.mutex.Unlock()
+}
+
+// NamespaceRequest counts a client request made in namespace.
+func (m *Metrics) NamespaceRequest(namespace string) {
+	m.mutex.Lock()
+	m.namespaces[namespace]++
+	m.mutex.Unlock()
+}
+
+// TaskInterrupted counts a task a crash interrupted, by how it was
+// handled on restart.
+func (m *Metrics) TaskInterrupted(policy string) {
+	m.mutex.Lock()
+	m.interrupted[policy]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) TaskProcessed(d time.Duration) {
+	m.taskLatency.Observe(d.Seconds())
+}
+
+// MetricTotals are running totals since the node started.
+type MetricTotals struct {
+	Sent      uint64 `json:"messages_sent"`
+	Received  uint64 `json:"messages_received"`
+	Dropped   uint64 `json:"messages_dropped"`
+	Processed uint64 `json:"tasks_processed"`
+}
+
+// Totals sums the message counters over all types and counts the tasks
+// processed.
+func (m *Metrics) Totals() MetricTotals {
+	m.mutex.Lock()
+	var totals MetricTotals
+	for _, count := range m.sent {
+		totals.Sent += count
+	}
+	for _, count := range m.received {
+		totals.Received += count
+	}
+	for _, count := range m.dropped {
+		totals.Dropped += count
+	}
+	m.mutex.Unlock()
+
+	m.taskLatency.mutex.Lock()
+	totals.Processed = m.taskLatency.count
+	m.taskLatency.mutex.Unlock()
+	return totals
+}
+
+// Histogram is a cumulative Prometheus-style histogram.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	mutex  sync.Mutex
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func writeCounterVec(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+func writeGaugeVec(w io.Writer, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", name, label, k, values[k])
+	}
+}
+
+// WriteMetrics writes all node metrics in the Prometheus text format.
+func (n *Node) WriteMetrics(w io.Writer) {
+	m := n.metrics
+
+	m.mutex.Lock()
+	writeCounterVec(w, "dbs_messages_sent_total", "Messages sent to peers by type.", "type", m.sent)
+	writeCounterVec(w, "dbs_messages_received_total", "Messages received from peers by type.", "type", m.received)
+	writeCounterVec(w, "dbs_messages_dropped_total", "Messages dropped because a peer's outbound queue was full.", "type", m.dropped)
+	writeCounterVec(w, "dbs_messages_throttled_total", "Inbound messages rejected by the per-connection rate limit by type.", "type", m.throttled)
+	writeCounterVec(w, "dbs_messages_denied_total", "Inbound messages rejected by the access control list by type.", "type", m.denied)
+	writeCounterVec(w, "dbs_messages_deferred_total", "Messages a peer throttled, to be resent later, by type.", "type", m.deferred)
+	writeCounterVec(w, "dbs_messages_unknown_total", "Messages of a type this node does not handle, ignored, by type.", "type", m.unknown)
+	writeCounterVec(w, "dbs_messages_rejected_total", "Connections closed for a message that was malformed or over max_message_size, by reason.", "reason", m.rejected)
+	fmt.Fprintf(w, "# HELP dbs_heartbeat_misses_total Peers marked suspect or dead after missing heartbeats.\n")
+	fmt.Fprintf(w, "# TYPE dbs_heartbeat_misses_total counter\ndbs_heartbeat_misses_total %d\n", m.heartbeatMisses)
+	fmt.Fprintf(w, "# HELP dbs_heartbeats_lost_total Heartbeats sent over UDP that never arrived, by gaps in their sequence numbers.\n")
+	fmt.Fprintf(w, "# TYPE dbs_heartbeats_lost_total counter\ndbs_heartbeats_lost_total %d\n", m.heartbeatsLost)
+	fmt.Fprintf(w, "# HELP dbs_keys_repaired_total Keys repaired by anti-entropy.\n")
+	fmt.Fprintf(w, "# TYPE dbs_keys_repaired_total counter\ndbs_keys_repaired_total %d\n", m.keysRepaired)
+	fmt.Fprintf(w, "# HELP dbs_tasks_deduplicated_total Tasks not run again because their idempotency key was seen before.\n")
+	fmt.Fprintf(w, "# TYPE dbs_tasks_deduplicated_total counter\ndbs_tasks_deduplicated_total %d\n", m.deduplicated)
+	fmt.Fprintf(w, "# HELP dbs_circuits_opened_total Circuit breakers opened on slow peers.\n")
+	fmt.Fprintf(w, "# TYPE dbs_circuits_opened_total counter\ndbs_circuits_opened_total %d\n", m.circuitsOpened)
+	fmt.Fprintf(w, "# HELP dbs_dead_connections_total Peer connections dropped for answering no pings.\n")
+	fmt.Fprintf(w, "# TYPE dbs_dead_connections_total counter\ndbs_dead_connections_total %d\n", m.deadConns)
+	writeCounterVec(w, "dbs_messages_short_circuited_total", "Messages not sent because the peer's circuit breaker was open, by type.", "type", m.shortCircuited)
+	fmt.Fprintf(w, "# HELP dbs_hot_key_cache_hits_total Reads of hot keys coordinated elsewhere answered from this node's cache.\n")
+	fmt.Fprintf(w, "# TYPE dbs_hot_key_cache_hits_total counter\ndbs_hot_key_cache_hits_total %d\n", m.hotKeyHits)
+	fmt.Fprintf(w, "# HELP dbs_tasks_stolen_total Queued tasks handed over to an idle node by work stealing.\n")
+	fmt.Fprintf(w, "# TYPE dbs_tasks_stolen_total counter\ndbs_tasks_stolen_total %d\n", m.stolen)
+	writeCounterVec(w, "dbs_tasks_invalid_total", "Tasks rejected because their content did not match the task type's schema, by task type.", "task_type", m.invalid)
+	writeCounterVec(w, "dbs_namespace_requests_total", "Client requests served, by namespace.", "namespace", m.namespaces)
+	writeCounterVec(w, "dbs_tasks_interrupted_total", "Journaled tasks found unfinished after a restart, by whether they were rerun or failed.", "policy", m.interrupted)
+	m.mutex.Unlock()
+
+	n.mutex.RLock()
+	connections := len(n.conn)
+	n.mutex.RUnlock()
+
+	writeGauge(w, "dbs_active_connections", "Open outbound peer connections.", float64(connections))
+	writeGauge(w, "dbs_outbound_queue_depth", "Messages queued for writing to peers.", float64(n.outboundQueued()))
+	writeGauge(w, "dbs_task_queue_depth", "Tasks waiting for a worker.", float64(n.tasks.Depth()))
+	writeGauge(w, "dbs_parked_tasks", "Queued tasks handed over to an idle node that has not answered yet.", float64(n.steals.Parked()))
+	writeGauge(w, "dbs_unacked_messages", "Reliable messages awaiting an ack.", float64(n.retransmit.Pending()))
+	writeGauge(w, "dbs_keys", "Keys held in the local store.", float64(n.store.Len()))
+	writeGauge(w, "dbs_hints_pending", "Writes held for replicas that are down.", float64(n.hints.Len()))
+	writeGauge(w, "dbs_dead_letters", "Failed tasks in the dead-letter queue.", float64(n.deadLetters.Len()))
+	writeGauge(w, "dbs_quarantined_hosts", "Hosts refused for sending malformed messages repeatedly.", float64(len(n.quarantine.Quarantined())))
+
+	rtts := make(map[string]float64)
+	for id, rtt := range n.latencies.All() {
+		rtts[strconv.Itoa(id)] = rtt.Seconds()
+	}
+	writeGaugeVec(w, "dbs_peer_rtt_seconds", "Smoothed round-trip time to each peer.", "peer", rtts)
+
+	if log := n.LogStatus(); log != nil {
+		writeGauge(w, "dbs_log_commit_index", "Index of the last committed entry of the linearizable log.", float64(log.Commit))
+	}
+	namespaceKeys := make(map[string]float64)
+	for namespace, count := range n.namespaceKeys() {
+		namespaceKeys[NamespaceLabel(namespace)] = float64(count)
+	}
+	writeGaugeVec(w, "dbs_namespace_keys", "Keys held in the local store, by namespace.", "namespace", namespaceKeys)
+	writeGaugeVec(w, "dbs_hot_key_accesses_per_second", "Estimated access rate of the hottest keys this node served or routed.", "key", n.hotKeyRates())
+
+	fmt.Fprintf(w, "# HELP dbs_task_processing_seconds Time spent processing tasks.\n# TYPE dbs_task_processing_seconds histogram\n")
+	m.taskLatency.write(w, "dbs_task_processing_seconds")
+}
+
+func (n *Node) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	n.WriteMetrics(w)
+}
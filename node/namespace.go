@@ -0,0 +1,274 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Namespaces let applications share the cluster without their keys
+// colliding. The keys of namespace app1 are stored as _ns/app1/<key>, so the
+// same key in two namespaces is two keys, each placed on the ring on its
+// own; the default namespace holds keys as they are. A client picks its
+// namespace with client.Client.Use, the shell with use, and the admin API
+// with the namespace parameter; gets, sets, deletes, replicated data types
+// and scans then name keys within it. Queries, indexes, watches and tasks
+// see the default namespace only.
+//
+// The stored forms of keys, and index entries, are internal: clients and
+// the admin API cannot name a key under _ns/ or _idx/ directly, and client
+// watches never see them, or a client of one namespace could reach around
+// its ACL rules into another.
+//
+// ACL rules can be limited to a namespace by writing the subject as
+// <subject>@<namespace>, and the none level denies a subject everything,
+// so client:app1@app1 write with client:app1 none confines a user to its
+// namespace. The cluster setting namespace.<name>.replication overrides
+// the replication option for the keys of a namespace.
+
+const (
+	// DefaultNamespace names the namespace keys are in unless a request
+	// picks another.
+	DefaultNamespace = "default"
+
+	namespaceKeyPrefix = "_ns/"
+	// maxNamespaceLength bounds the length of a namespace name.
+	maxNamespaceLength = 64
+
+	namespaceSettingPrefix = "namespace."
+	namespaceSettingSuffix = ".replication"
+)
+
+// ParseNamespace checks a namespace name, made of letters, digits, - and _,
+// and returns it in the form requests carry: "" for the default namespace.
+func ParseNamespace(name string) (string, error) {
+	if name == "" || name == DefaultNamespace {
+		return "", nil
+	}
+	if len(name) > maxNamespaceLength {
+		return "", fmt.Errorf("invalid namespace %q: longer than %d characters", name, maxNamespaceLength)
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("invalid namespace %q: expected letters, digits, - and _", name)
+		}
+	}
+	return name, nil
+}
+
+// NamespaceLabel returns the name a namespace is shown as, DefaultNamespace
+// for "".
+func NamespaceLabel(namespace string) string {
+	if namespace == "" {
+		return DefaultNamespace
+	}
+	return namespace
+}
+
+// NamespacedKey returns the key key of namespace is stored as.
+func NamespacedKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespaceKeyPrefix + namespace + "/" + key
+}
+
+// splitNamespace returns the namespace of a stored key and the key within
+// it.
+func splitNamespace(key string) (namespace, rest string) {
+	if !strings.HasPrefix(key, namespaceKeyPrefix) {
+		return "", key
+	}
+	namespace, rest, ok := strings.Cut(key[len(namespaceKeyPrefix):], "/")
+	if !ok {
+		return "", key
+	}
+	return namespace, rest
+}
+
+// internalKey reports whether key is one the node keeps for itself, a key
+// in a namespace or an index entry, which requests may not name directly.
+func internalKey(key string) bool {
+	return strings.HasPrefix(key, namespaceKeyPrefix) || strings.HasPrefix(key, indexKeyPrefix)
+}
+
+// checkRequestKey fails for keys requests may not name.
+func checkRequestKey(key string) error {
+	if internalKey(key) {
+		return fmt.Errorf("key %q is reserved: keys starting with %s or %s are internal", key, namespaceKeyPrefix, indexKeyPrefix)
+	}
+	return nil
+}
+
+// namespaceEnd returns the first stored key past every key of namespace.
+func namespaceEnd(namespace string) string {
+	return namespaceKeyPrefix + namespace + "0"
+}
+
+// namespaceSetting returns the namespace whose replication cluster setting
+// name is, if it is one.
+func namespaceSetting(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, namespaceSettingPrefix)
+	if !ok {
+		return "", false
+	}
+	namespace, ok := strings.CutSuffix(rest, namespaceSettingSuffix)
+	if !ok || namespace == "" {
+		return "", false
+	}
+	return namespace, true
+}
+
+// NamespaceReplicationSetting returns the name of the cluster setting
+// holding the replication of namespace.
+func NamespaceReplicationSetting(namespace string) string {
+	return namespaceSettingPrefix + namespace + namespaceSettingSuffix
+}
+
+// checkNamespaceSetting checks the value of a namespace's replication
+// setting.
+func checkNamespaceSetting(name, value string) error {
+	namespace, _ := namespaceSetting(name)
+	if _, err := ParseNamespace(namespace); err != nil {
+		return err
+	}
+	if replication, err := strconv.Atoi(value); err != nil || replication < 1 {
+		return fmt.Errorf("invalid %s %q: must be at least 1", name, value)
+	}
+	return nil
+}
+
+// applyNamespaceSettings takes the replication of every namespace from the
+// cluster settings values.
+func (n *Node) applyNamespaceSettings(values map[string]string) {
+	replication := make(map[string]int)
+	for name, value := range values {
+		namespace, ok := namespaceSetting(name)
+		if !ok {
+			continue
+		}
+		r, err := strconv.Atoi(value)
+		if err != nil || r < 1 {
+			n.logger.Warn("ignoring invalid namespace replication", "setting", name, "value", value)
+			continue
+		}
+		replication[namespace] = r
+	}
+	n.namespaceReplication.Store(&replication)
+}
+
+// ReplicationFor returns the number of replicas of key: its namespace's
+// replication if set, or the replication option.
+func (n *Node) ReplicationFor(key string) int {
+	if namespace, _ := splitNamespace(key); namespace != "" {
+		if r, ok := (*n.namespaceReplication.Load())[namespace]; ok {
+			return r
+		}
+	}
+	return n.replication()
+}
+
+// maxReplication returns the most replicas any key has.
+func (n *Node) maxReplication() int {
+	most := n.replication()
+	for _, r := range *n.namespaceReplication.Load() {
+		most = max(most, r)
+	}
+	return most
+}
+
+// replicas returns the members holding key.
+func (n *Node) replicas(key string) []int {
+	return n.ring.Replicas(key, n.ReplicationFor(key))
+}
+
+// NamespaceInfo describes a namespace.
+type NamespaceInfo struct {
+	Name string `json:"name"`
+	// Keys counts the namespace's live keys held on this node.
+	Keys int `json:"keys"`
+	// Replication is the number of replicas of the namespace's keys.
+	Replication int `json:"replication"`
+	// Configured is set if the cluster config sets the replication.
+	Configured bool `json:"configured,omitempty"`
+}
+
+// Namespaces lists the namespaces with keys on this node or a replication
+// setting, the default one first.
+func (n *Node) Namespaces() []NamespaceInfo {
+	keys := n.namespaceKeys()
+	replication := *n.namespaceReplication.Load()
+	names := []string{""}
+	for namespace := range keys {
+		if namespace != "" {
+			names = append(names, namespace)
+		}
+	}
+	for namespace := range replication {
+		if _, ok := keys[namespace]; !ok {
+			names = append(names, namespace)
+		}
+	}
+	slices.Sort(names[1:])
+
+	infos := make([]NamespaceInfo, 0, len(names))
+	for _, namespace := range names {
+		_, configured := replication[namespace]
+		infos = append(infos, NamespaceInfo{
+			Name:        NamespaceLabel(namespace),
+			Keys:        keys[namespace],
+			Replication: n.ReplicationFor(NamespacedKey(namespace, "")),
+			Configured:  configured,
+		})
+	}
+	return infos
+}
+
+// namespaceKeys counts the live keys of each namespace held on this node.
+func (n *Node) namespaceKeys() map[string]int {
+	return n.store.CountBy(func(key string) string {
+		namespace, _ := splitNamespace(key)
+		return namespace
+	})
+}
+
+// SetNamespaceReplication sets the replication of namespace's keys on every
+// node through the cluster config, or restores the replication option if
+// replication is 0.
+func (n *Node) SetNamespaceReplication(namespace string, replication int) error {
+	namespace, err := ParseNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		return errors.New("the default namespace uses the replication option")
+	}
+	name := NamespaceReplicationSetting(namespace)
+	if replication == 0 {
+		_, err = n.DeleteClusterConfig(name)
+	} else {
+		_, err = n.SetClusterConfig(name, strconv.Itoa(replication))
+	}
+	return err
+}
+
+func (n *Node) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Namespaces())
+}
+
+// requestKey returns the stored key of the {key} of an admin API request,
+// in the namespace its namespace parameter names.
+func requestKey(r *http.Request) (string, error) {
+	namespace, err := ParseNamespace(r.URL.Query().Get("namespace"))
+	if err != nil {
+		return "", err
+	}
+	key := r.PathValue("key")
+	if err := checkRequestKey(key); err != nil {
+		return "", err
+	}
+	return NamespacedKey(namespace, key), nil
+}
@@ -0,0 +1,89 @@
+package node_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientsCannotNameInternalKeys(t *testing.T) {
+	c := newCluster(t, 1, nil)
+	ctx := testContext(t, 10*time.Second)
+	cl := connect(t, c, 1)
+
+	for _, key := range []string{"_ns/tenant/secret", "_idx/color/red"} {
+		if err := cl.Set(ctx, key, "x"); err == nil {
+			t.Errorf("set %s succeeded", key)
+		}
+		if _, _, err := cl.Get(ctx, key); err == nil {
+			t.Errorf("get %s succeeded", key)
+		}
+		if _, err := cl.Del(ctx, key); err == nil {
+			t.Errorf("del %s succeeded", key)
+		}
+	}
+	if err := cl.Set(ctx, "user", "x"); err != nil {
+		t.Errorf("set user: %v", err)
+	}
+}
+
+func TestAdminRejectsInternalKeys(t *testing.T) {
+	c := newCluster(t, 1, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	c.Node(1).StartAdmin(addr)
+	base := "http://" + addr
+
+	do := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp *http.Response
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if resp, err = http.DefaultClient.Do(req); err == nil || time.Now().After(deadline) {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	query := func(q string) string {
+		return "/query?q=" + url.QueryEscape(q)
+	}
+
+	cases := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/tx", `{"ops": [{"op": "set", "key": "_ns/tenant/a", "value": "x"}]}`, http.StatusBadRequest},
+		{"POST", "/tx", `{"ops": [{"op": "set", "key": "a", "value": "x"}, {"op": "del", "key": "_idx/color/red"}]}`, http.StatusBadRequest},
+		{"GET", query(`select * where prefix = "_ns/tenant/"`), "", http.StatusBadRequest},
+		{"GET", query(`select key where key = "_idx/color/red"`), "", http.StatusBadRequest},
+		{"GET", "/scan?start=" + url.QueryEscape("_ns/tenant/"), "", http.StatusBadRequest},
+		{"GET", "/scan?start=a&end=" + url.QueryEscape("_idx/"), "", http.StatusBadRequest},
+
+		{"POST", "/tx", `{"ops": [{"op": "set", "key": "a", "value": "x"}]}`, http.StatusOK},
+		{"GET", query(`select * where prefix = "a"`), "", http.StatusOK},
+		{"GET", "/scan?start=a", "", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s %s", tc.method, tc.path), func(t *testing.T) {
+			if status := do(tc.method, tc.path, tc.body); status != tc.want {
+				t.Errorf("status = %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,976 @@
+// Package node implements a cluster member: membership, leader election,
+// task execution and the replicated key-value store. Embed it with NewNode,
+// Start, Send and OnMessage.
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// Message is the unit exchanged between nodes.
+type Message = transport.Message
+
+// MessageHandler is called with messages delivered to the application; see
+// Node.OnMessage.
+type MessageHandler func(Message)
+
+// Node is a member of the cluster. Create one with NewNode, run it with
+// Start and stop it with Shutdown.
+type Node struct {
+	ID        int
+	IsMaster  bool
+	Address   string
+	Peers     map[int]string
+	peerInfo  map[int]peerInfo
+	Transport transport.Transport
+	conn      map[int]transport.Conn
+	mutex     sync.RWMutex
+	store     *Store
+	election  election
+	timing    *timing
+	detector  *FailureDetector
+	tasks     *TaskQueue
+	tracker   *TaskTracker
+	journal   *TaskJournal
+	cuts      *Cuts
+	// cutGate is held shared while a send queues its message for a peer,
+	// and exclusively while a cluster snapshot records state; see mark.
+	cutGate     sync.RWMutex
+	steals      *Steals
+	breakers    *Breakers
+	schemas     *Schemas
+	hotKeys     *HotKeys
+	linear      *LinearLog
+	config      Config
+	wal         *WAL
+	ring        *Ring
+	metrics     *Metrics
+	retransmit  *Retransmitter
+	handlers    *HandlerRegistry
+	loads       *LoadTable
+	latencies   *LatencyTable
+	groups      *Groups
+	watches     *Watches
+	ids         *IDGenerator
+	recent      *RecentMessages
+	events      *Events
+	txLocks     *txLocks
+	hints       *hints
+	schedules   *Schedules
+	dedup       *Dedup
+	indexes     *Indexes
+	deadLetters *DeadLetters
+	acl         *ACL
+	bans        *BanList
+	// electionSave serializes recording the election state in the WAL,
+	// which happens without mutex held; see persistElection.
+	electionSave sync.Mutex
+	// clusterConfig is this node's copy of the cluster config; see
+	// clusterconfig.go.
+	clusterConfig *ClusterConfig
+	locks         *Locks
+	// peerBook signals runPeerBook to save the address book; savedPeers
+	// is the book as it was on startup. Both are only set with a data
+	// directory.
+	peerBook   chan struct{}
+	savedPeers map[int]string
+	// udp carries heartbeats with udp_heartbeats; sentBeat and lastBeat
+	// are the latest sequence numbers sent to and received from each peer.
+	udp       *transport.Datagrams
+	sentBeat  map[int]uint64
+	lastBeat  map[int]uint64
+	beatMutex sync.Mutex
+	chaos     *transport.Chaos
+	auth      *transport.Auth
+	logger    *slog.Logger
+	logCloser io.Closer
+	listener  io.Closer
+	// quarantine refuses hosts that keep sending malformed messages.
+	quarantine *transport.Quarantine
+	// bound is the address listener listens on.
+	bound string
+	// discovery finds members to join through; see discovery.go.
+	discovery Discovery
+
+	// draining is set once Drain is called; see drain.go.
+	draining atomic.Bool
+	// replicationFactor is the replication option; see tuning.go.
+	replicationFactor atomic.Int64
+	// namespaceReplication is the replication of the namespaces that set
+	// one; see namespace.go.
+	namespaceReplication atomic.Pointer[map[string]int]
+	// rebalance is the progress of the last rebalance; see rebalance.go.
+	rebalance      RebalanceStatus
+	rebalanceMutex sync.Mutex
+
+	reconnecting map[int]bool
+	discovering  map[int]bool
+	forwards     map[string]forward
+	forwardMutex sync.Mutex
+	waiters      map[string]chan Message
+	waitMutex    sync.Mutex
+	lossWatchers map[int]map[chan struct{}]bool
+	lossMutex    sync.Mutex
+
+	clientWatches    map[clientWatchKey]func()
+	clientWatchMutex sync.Mutex
+
+	inbound      map[transport.Conn]bool
+	onMessage    []MessageHandler
+	handlerMutex sync.RWMutex
+	clock        transport.VectorClock
+	clockMutex   sync.Mutex
+
+	// ctx is cancelled once shutdown has stopped waiting for in-flight
+	// tasks; the contexts of connections, requests and tasks derive from
+	// it.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan struct{}
+	stopped      chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewNode creates a node from a validated config, recovering its state from
+// the write-ahead log if a data directory is set. It fails if the TLS files
+// or the WAL cannot be loaded.
+func NewNode(cfg Config) (*Node, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		var err error
+		if tlsConfig, err = cfg.TLS.Load(); err != nil {
+			return nil, err
+		}
+	}
+
+	taskSchemas, err := loadSchemas(cfg.TaskSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	quarantine := transport.NewQuarantine()
+	tr := cfg.Network
+	if tr == nil {
+		var err error
+		tr, err = transport.New(cfg.Transport, transport.Options{
+			TLS:            tlsConfig,
+			Protocol:       cfg.Protocol,
+			Codec:          cfg.Codec,
+			MaxMessageSize: cfg.MaxMessageSize,
+			Quarantine:     quarantine,
+			KeepAlive:      cfg.KeepAlive,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger, logCloser, err := newLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := transport.NewAuth(tr, cfg.AuthToken)
+	chaos := transport.NewChaos(auth)
+	suspectTimeout := cfg.SuspectTimeout
+	if suspectTimeout == 0 {
+		suspectTimeout = cfg.HeartbeatInterval * 3
+	}
+	n := &Node{
+		ID:            cfg.NodeID,
+		IsMaster:      cfg.Master,
+		Peers:         make(map[int]string),
+		peerInfo:      make(map[int]peerInfo),
+		Transport:     transport.Chunked(chaos),
+		conn:          make(map[int]transport.Conn),
+		mutex:         sync.RWMutex{},
+		config:        cfg,
+		store:         NewStore(cfg.NodeID),
+		election:      newElection(cfg.Master, cfg.NodeID),
+		timing:        newTiming(cfg),
+		detector:      NewFailureDetector(suspectTimeout, suspectTimeout*2),
+		tasks:         NewTaskQueue(cfg.Workers, cfg.QueueSize),
+		tracker:       NewTaskTracker(),
+		journal:       NewTaskJournal(),
+		cuts:          NewCuts(),
+		steals:        NewSteals(),
+		breakers:      NewBreakers(),
+		schemas:       NewSchemas(),
+		hotKeys:       NewHotKeys(),
+		linear:        NewLinearLog(),
+		ring:          NewRing(),
+		metrics:       NewMetrics(),
+		retransmit:    NewRetransmitter(),
+		handlers:      NewHandlerRegistry(),
+		loads:         NewLoadTable(),
+		latencies:     NewLatencyTable(),
+		groups:        NewGroups(),
+		watches:       NewWatches(),
+		ids:           NewIDGenerator(cfg.NodeID),
+		recent:        NewRecentMessages(recentMessageCount),
+		events:        NewEvents(),
+		txLocks:       newTxLocks(),
+		hints:         newHints(),
+		schedules:     NewSchedules(),
+		dedup:         NewDedup(dedupCacheSize),
+		indexes:       NewIndexes(),
+		deadLetters:   NewDeadLetters(),
+		acl:           NewACL(),
+		quarantine:    quarantine,
+		bans:          NewBanList(),
+		clusterConfig: NewClusterConfig(),
+		locks:         NewLocks(),
+		chaos:         chaos,
+		auth:          auth,
+		logger:        logger,
+		logCloser:     logCloser,
+
+		reconnecting:  make(map[int]bool),
+		discovering:   make(map[int]bool),
+		forwards:      make(map[string]forward),
+		waiters:       make(map[string]chan Message),
+		lossWatchers:  make(map[int]map[chan struct{}]bool),
+		clientWatches: make(map[clientWatchKey]func()),
+		inbound:       make(map[transport.Conn]bool),
+		clock:         make(transport.VectorClock),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	for taskType, schema := range taskSchemas {
+		n.schemas.Set(taskType, schema)
+	}
+	n.handlers.Register("disk", n.diskHandler)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	if ownsKeys(cfg.Role) {
+		n.ring.Add(n.ID)
+	}
+
+	// Replay the WAL before attaching it so recovered entries are not
+	// logged twice
+	n.store.siblings = cfg.Conflicts == ConflictsSiblings
+	n.replicationFactor.Store(int64(cfg.Replication))
+	n.namespaceReplication.Store(&map[string]int{})
+	if cfg.DataDir != "" {
+		// The data log makes KV writes durable by itself. When it is first
+		// created, the keys logged in the WAL so far are migrated into it.
+		keyring, err := ParseKeyring(cfg.encryptionKeys())
+		if err != nil {
+			return nil, err
+		}
+		replayKV := true
+		if cfg.Storage == StorageDisk {
+			replayKV = !dataLogExists(cfg.DataDir)
+			disk, err := openDiskEngine(cfg.DataDir, cfg.Fsync, keyring, logger)
+			if err != nil {
+				return nil, fmt.Errorf("open data log in %s: %v", cfg.DataDir, err)
+			}
+			n.store.useDisk(disk)
+		}
+		if err := n.recover(cfg.DataDir, keyring, replayKV); err != nil {
+			return nil, fmt.Errorf("recover from %s: %v", cfg.DataDir, err)
+		}
+		wal, err := OpenWAL(cfg.DataDir, cfg.Fsync, keyring, logger)
+		if err != nil {
+			return nil, err
+		}
+		n.wal = wal
+		n.tracker.wal = wal
+		n.journal.wal = wal
+		n.steals.wal = wal
+		n.txLocks.wal = wal
+		if cfg.Linearizable {
+			n.linear.wal = wal
+		}
+		if cfg.Storage != StorageDisk {
+			n.store.wal = wal
+		}
+		if err := n.schedules.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := n.indexes.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := n.deadLetters.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := n.acl.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := n.bans.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		if err := n.clusterConfig.load(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		n.applyClusterOptions()
+		if n.savedPeers, err = loadPeerBook(cfg.DataDir); err != nil {
+			return nil, err
+		}
+		n.peerBook = make(chan struct{}, 1)
+	}
+
+	return n, nil
+}
+
+// Start listens for peers, connects to the configured seeds, joins through
+// the first reachable join address and starts the node's background work. It
+// returns once the node is running; use Wait to block until it is shut down.
+func (n *Node) Start() error {
+	return n.StartContext(context.Background())
+}
+
+// StartContext is Start for a node that shuts down when ctx ends.
+func (n *Node) StartContext(ctx context.Context) error {
+	// Heartbeats may arrive as soon as peers learn of us, so the UDP port
+	// is bound first. With port 0 the peer listener then takes the port
+	// picked for it, as peers send datagrams to the port they dial.
+	bind := n.config.Bind
+	if n.config.UDPHeartbeats {
+		if n.config.Network != nil {
+			n.logger.Warn("udp_heartbeats need a network transport; sending heartbeats over the peer connections")
+		} else {
+			udp, err := transport.ListenDatagrams(bind, n.auth, n.chaos)
+			if err != nil {
+				return fmt.Errorf("listen for heartbeats: %v", err)
+			}
+			n.udp = udp
+			n.lastBeat = make(map[int]uint64)
+			n.sentBeat = make(map[int]uint64)
+			bind = boundAddress(udp, bind)
+		}
+	}
+
+	listener, err := n.Transport.Listen(bind, n.handleConnection)
+	if err != nil {
+		if n.udp != nil {
+			n.udp.Close()
+		}
+		return err
+	}
+	n.listener = listener
+	n.bound = boundAddress(listener, bind)
+	if n.udp != nil {
+		go n.runDatagrams()
+	}
+
+	// Address is what peers learn about us through gossip
+	if n.Address == "" && n.config.Transport == TransportUnix && n.config.Network == nil {
+		// Peers may run in another directory
+		n.Address, _ = filepath.Abs(n.config.Bind)
+	}
+	if n.Address == "" && n.config.Advertise != "" {
+		n.Address = withBoundPort(n.config.Advertise, n.bound)
+	}
+	if n.Address == "" {
+		n.Address = advertiseAddress(n.bound)
+	}
+
+	n.logger.Info("node started", "bind", n.bound, "address", n.Address, "role", n.config.Role, "master", n.IsMaster, "fsync", n.config.Fsync)
+
+	n.tasks.Start(n.processTask)
+	go n.events.run(n.done)
+
+	// Heartbeats are only sent while this node is the elected leader
+	go n.sendHeartbeats()
+	go n.runElectionTimer()
+	go n.runFailureDetector()
+	go n.runGossip()
+	go n.runRetransmitter()
+	go n.runAntiEntropy()
+	go n.runExpiry()
+	go n.runHandoff()
+	go n.runRebalancer()
+	go n.runStealer()
+	go n.runPinger()
+	go n.runBreakers()
+	if n.config.DataDir != "" && len(n.config.encryptionKeys()) > 0 {
+		go n.runReencryption()
+	}
+	if n.config.DataDir != "" && n.config.Fsync == FsyncGroup {
+		go n.runFsync()
+	}
+	if n.config.Linearizable {
+		go n.runLog()
+	}
+	go n.runSchedules()
+	if n.config.Storage == StorageDisk {
+		go n.runCompaction()
+	}
+
+	for _, seed := range n.config.Seeds {
+		if err := n.Connect(seed.ID, seed.Address); err != nil {
+			n.peerLogger(seed.ID, "").Warn("failed to connect to seed", "addr", seed.Address, "err", err)
+		}
+	}
+	if n.peerBook != nil {
+		go n.runPeerBook()
+		for id, address := range n.savedPeers {
+			if id != n.ID {
+				go n.redialSaved(id, address)
+			}
+		}
+	}
+	n.discovery = n.config.discoverer(n.bound)
+	if len(n.config.Join) > 0 || n.discovery != nil {
+		n.bootstrap()
+	}
+	if n.discovery != nil {
+		go n.runDiscovery()
+	}
+	go n.resumeInterrupted()
+	n.resumeTransactions()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				n.Shutdown()
+			case <-n.done:
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Wait blocks until the node has shut down.
+func (n *Node) Wait() {
+	<-n.stopped
+}
+
+// Done returns a channel that is closed when the node starts shutting down.
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Context returns a context that is cancelled once the node, shutting
+// down, has stopped waiting for its in-flight tasks. Work an embedder does
+// on the node's behalf can derive from it.
+func (n *Node) Context() context.Context {
+	return n.ctx
+}
+
+// Config returns the config the node was created with, with the options
+// changed since by SetOption.
+func (n *Node) Config() Config {
+	cfg := n.config
+	n.timing.mutex.RLock()
+	cfg.HeartbeatInterval, cfg.SuspectTimeout = n.timing.interval, n.timing.suspect
+	n.timing.mutex.RUnlock()
+	cfg.Replication = n.replication()
+	return cfg
+}
+
+// Logger returns the node's structured logger.
+func (n *Node) Logger() *slog.Logger {
+	return n.logger
+}
+
+// Chaos returns the fault injector wrapped around the node's transport.
+func (n *Node) Chaos() *transport.Chaos {
+	return n.chaos
+}
+
+// Auth returns the message signer wrapped around the node's transport, for
+// rotating the shared token.
+func (n *Node) Auth() *transport.Auth {
+	return n.auth
+}
+
+// boundAddress returns the address listener, or a UDP socket, listens on,
+// which has the port picked for a bind address with port 0. It returns bind
+// for listeners that do not tell, such as in-memory ones.
+func boundAddress(listener any, bind string) string {
+	if l, ok := listener.(interface{ Addr() net.Addr }); ok {
+		if _, port, err := net.SplitHostPort(l.Addr().String()); err == nil {
+			if host, _, err := net.SplitHostPort(bind); err == nil {
+				return net.JoinHostPort(host, port)
+			}
+		}
+	}
+	return bind
+}
+
+// BindAddress returns the address the node listens on for peers, with the
+// port it picked if it was configured to bind port 0.
+func (n *Node) BindAddress() string {
+	return n.bound
+}
+
+// withBoundPort completes an advertise address given as a host alone with
+// the port of bound.
+func withBoundPort(advertise, bound string) string {
+	if _, _, err := net.SplitHostPort(advertise); err == nil {
+		return advertise
+	}
+	_, port, err := net.SplitHostPort(bound)
+	if err != nil {
+		return advertise
+	}
+	return net.JoinHostPort(advertise, port)
+}
+
+// advertiseAddress turns a bind address into one peers can dial, replacing
+// an empty or wildcard host with localhost.
+func advertiseAddress(bind string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return bind
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// handleConnection serves a connection accepted by the listener. Peers open
+// it with a hello, after which the connection is also used to send to them
+// unless another one already is. The requests served for it are cancelled
+// when it closes.
+func (n *Node) handleConnection(conn transport.Conn) {
+	n.mutex.Lock()
+	n.inbound[conn] = true
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	peerID := -1
+	var registered *outbox
+	limiter := n.newLimiter()
+	defer func() {
+		cancel()
+		n.mutex.Lock()
+		delete(n.inbound, conn)
+		n.mutex.Unlock()
+		n.endClientWatches(conn)
+		if registered != nil {
+			n.dropConnection(peerID, registered)
+		}
+		conn.Close()
+	}()
+
+	for {
+		msg, err := conn.Recv()
+		if err != nil {
+			n.logRecvError(err)
+			return
+		}
+
+		if msg.Type == "hello" && peerID < 0 {
+			var ok bool
+			if registered, ok = n.acceptHello(conn, msg); !ok {
+				return
+			}
+			peerID = msg.From
+			continue
+		}
+		if n.admit(limiter, conn, msg) {
+			n.dispatch(ctx, conn, msg)
+		}
+	}
+}
+
+// dispatch handles a message received on conn, whose context is ctx.
+func (n *Node) dispatch(ctx context.Context, conn transport.Conn, msg Message) {
+	n.metrics.MessageReceived(msg.Type)
+	if err := transport.Decompress(&msg); err != nil {
+		n.peerLogger(msg.From, msg.Type).Warn("dropping message", "err", err)
+		return
+	}
+	if msg.Client {
+		if n.permitted(conn, msg) {
+			go n.serveClient(ctx, conn, msg)
+		}
+		return
+	}
+	if n.bans.Banned(msg.From) {
+		return
+	}
+	n.recent.Record(msg)
+	n.observeClock(msg.Clock)
+	if n.detector.Observe(msg.From) {
+		n.peerLogger(msg.From, msg.Type).Info("peer recovered")
+		n.publish(Event{Type: EventRecover, Node: msg.From})
+	}
+
+	if msg.Seq != 0 && msg.Type != "ack" {
+		n.acknowledge(msg)
+	}
+	if !n.permitted(conn, msg) {
+		return
+	}
+	n.cuts.observe(msg)
+
+	switch msg.Type {
+	case "ack":
+		n.retransmit.ack(msg.From, msg.Seq)
+	case "throttled":
+		n.handleThrottled(msg)
+	case "alive":
+		n.recordLoad(msg)
+	case "heartbeat":
+		n.recordLoad(msg)
+		n.handleHeartbeat(msg)
+	case "heartbeat_ack":
+		n.handleHeartbeatAck(msg)
+	case "request_vote":
+		n.handleRequestVote(msg)
+	case "vote":
+		n.handleVote(msg)
+	case "leaving":
+		n.handleLeaving(msg)
+	case "gossip":
+		n.handleGossip(msg)
+	case "node_down":
+		n.handleNodeDown(msg)
+	case "task":
+		n.submitTask(msg)
+	case "batch":
+		go n.handleBatch(ctx, msg)
+	case "result":
+		n.handleResult(msg)
+	case "progress":
+		n.handleProgress(msg)
+	case "query":
+		go n.handleQuery(msg)
+	case "scan":
+		go n.handleScan(msg)
+	case "draining":
+		n.handleDraining(msg)
+	case "rebalance_status":
+		n.handleRebalanceStatus(msg)
+	case "acl":
+		n.handleACL(msg)
+	case "bans":
+		n.handleBans(msg)
+	case "ping":
+		n.handlePing(msg)
+	case "pong":
+		n.handlePong(msg)
+	case "preempt":
+		go n.handlePreempt(msg)
+	case "steal":
+		n.handleSteal(msg)
+	case "steal_handoff", "steal_abort":
+		n.handleHandoff(msg)
+	case "steal_result":
+		n.handleStealResult(msg)
+	case "export":
+		go n.handleExport(msg)
+	case "index_sync":
+		n.handleIndexSync(msg)
+	case "get", "set", "del", "update":
+		n.handleKVRequest(msg)
+	case "kv_result":
+		n.handleKVResult(msg)
+	case "replicate":
+		n.handleReplicate(msg)
+	case "replicate_ack":
+		n.deliver(msg)
+	case "schedule_add", "schedule_del", "schedule_sync":
+		n.handleScheduleMessage(msg)
+	case "cluster_config", "cluster_config_get", "cluster_config_set", "cluster_config_del":
+		n.handleClusterConfig(msg)
+	case "lock", "lock_renew", "unlock", "lock_sync":
+		n.handleLockMessage(msg)
+	case "hint":
+		n.handleHint(msg)
+	case "read":
+		n.handleRead(msg)
+	case "read_result":
+		n.deliver(msg)
+	case "sync_digest":
+		n.handleSyncDigest(msg)
+	case "sync_keys":
+		n.handleSyncKeys(msg)
+	case "sync_repair":
+		n.handleSyncRepair(msg)
+	case "watch", "unwatch", "watch_event":
+		n.handleWatch(msg)
+	case "join":
+		n.handleJoin(msg)
+	case "join_reply":
+		n.deliver(msg)
+	case "snapshot_mark":
+		n.handleMark(msg)
+	case "snapshot_state":
+		n.deliver(msg)
+	case "next_id":
+		n.handleNextID(msg)
+	case "tx_prepare", "tx_commit", "tx_abort", "tx_status":
+		n.handleTxMessage(msg)
+	case "log_append":
+		n.handleLogAppend(msg)
+	case "log_snapshot":
+		n.handleLogSnapshot(msg)
+	default:
+		// Replies to Call go to the caller, anything else to the handlers.
+		// A type nobody handles is from a newer build: ignore it, already
+		// acked if it was sent reliably.
+		if msg.RequestID != "" && n.deliver(msg) {
+			return
+		}
+		if !n.notify(msg) {
+			n.unsupported(msg)
+		}
+	}
+}
+
+// Connect dials the node id at address and adds it to the cluster.
+func (n *Node) Connect(id int, address string) error {
+	if n.bans.Banned(id) {
+		return fmt.Errorf("node %d is %w", id, errBanned)
+	}
+	conn, err := n.dial(id, address)
+	if err != nil {
+		return err
+	}
+	n.register(id, address, conn)
+	return nil
+}
+
+// register makes conn, a connection dialed to the node id at address, the
+// one used to send to it.
+func (n *Node) register(id int, address string, conn *outbox) {
+	n.mutex.Lock()
+	old, replaced := n.conn[id]
+	if _, known := n.Peers[id]; !known {
+		n.publish(Event{Type: EventJoin, Node: id})
+	}
+	n.Peers[id] = address
+	n.peersChanged()
+	n.welcomePeer(id)
+	n.conn[id] = conn
+	n.mutex.Unlock()
+	n.joinRing(id)
+
+	if replaced {
+		old.Close()
+	}
+	go n.watchConnection(id, conn)
+	go n.announceWatches(id)
+	go n.announceIndexes(id)
+	go n.announceDraining(id)
+	go n.announceACL(id)
+	go n.announceClusterConfig(id)
+	go n.announceLocks(id)
+	go n.announceBans(id)
+
+	// Introduce ourselves so the peer can connect back and learn our members
+	go n.gossipTo(id)
+}
+
+// Send sends msg to the peer targetID, stamped with this node's id. If the
+// peer's outbound queue is full it waits up to the config's send_timeout
+// for room. It returns ErrNotConnected or ErrQueueFull, wrapped, if msg was
+// not queued; nil means msg is queued for the peer's writer, not that it
+// has arrived.
+func (n *Node) Send(targetID int, msg Message) error {
+	msg.From = n.ID
+	return n.send(targetID, msg, n.config.SendTimeout)
+}
+
+// OnMessage registers handler to be called with every message delivered to
+// the application: task results, replies to KV requests this node issued,
+// and messages of any type the node does not handle itself. Handlers run on
+// the goroutine that received the message and must not block.
+func (n *Node) OnMessage(handler MessageHandler) {
+	n.handlerMutex.Lock()
+	n.onMessage = append(n.onMessage, handler)
+	n.handlerMutex.Unlock()
+}
+
+// notify passes msg to the OnMessage handlers. It reports whether there
+// were any.
+func (n *Node) notify(msg Message) bool {
+	n.handlerMutex.RLock()
+	handlers := n.onMessage
+	n.handlerMutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return len(handlers) > 0
+}
+
+// SendContext is Send, waiting for room in the peer's outbound queue until
+// ctx ends instead of for send_timeout.
+func (n *Node) SendContext(ctx context.Context, targetID int, msg Message) error {
+	msg.From = n.ID
+	return n.sendContext(ctx, targetID, msg)
+}
+
+// sendMessage sends msg to targetID without blocking. The node's own
+// protocol messages go through it, as most are sent from a connection's
+// read loop, which must never wait on another peer.
+func (n *Node) sendMessage(targetID int, msg Message) error {
+	return n.send(targetID, msg, 0)
+}
+
+// send sends msg to targetID, waiting up to wait for room in the peer's
+// outbound queue.
+func (n *Node) send(targetID int, msg Message, wait time.Duration) error {
+	if wait <= 0 {
+		return n.sendContext(noWait, targetID, msg)
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, wait)
+	defer cancel()
+	return n.sendContext(ctx, targetID, msg)
+}
+
+// sendContext sends msg to targetID, waiting for room in the peer's
+// outbound queue until ctx ends.
+func (n *Node) sendContext(ctx context.Context, targetID int, msg Message) error {
+	return n.enqueue(ctx, targetID, msg, false)
+}
+
+// enqueue is sendContext. It holds n.cutGate shared while msg goes on the
+// queue, unless gated says the caller holds it already, but not while it
+// waits for room, which would hold up a cluster snapshot behind a slow
+// peer.
+func (n *Node) enqueue(ctx context.Context, targetID int, msg Message, gated bool) error {
+	n.mutex.RLock()
+	conn, exists := n.conn[targetID]
+	n.mutex.RUnlock()
+
+	if !exists {
+		n.peerLogger(targetID, msg.Type).Warn("no connection to peer")
+		return fmt.Errorf("%w to node %d", ErrNotConnected, targetID)
+	}
+	if !breakerExempt[msg.Type] && n.breakers.open(targetID) {
+		n.metrics.MessageShortCircuited(msg.Type)
+		return fmt.Errorf("%w to node %d", ErrCircuitOpen, targetID)
+	}
+
+	msg.Clock = n.tickClock()
+	var err error
+	for {
+		if !gated {
+			n.cutGate.RLock()
+		}
+		err = conn.Send(msg)
+		if !gated {
+			n.cutGate.RUnlock()
+		}
+		o, ok := conn.(*outbox)
+		if err != ErrQueueFull || !ok {
+			break
+		}
+		if err = o.waitRoom(ctx); err != nil {
+			break
+		}
+	}
+	if err == ErrQueueFull {
+		n.metrics.MessageDropped(msg.Type)
+		n.peerLogger(targetID, msg.Type).Warn("outbound queue full, dropping message")
+		return fmt.Errorf("node %d: %w", targetID, err)
+	}
+	if err != nil {
+		n.peerLogger(targetID, msg.Type).Error("failed to send message", "err", err)
+		// Callers may hold n.mutex, so tear down asynchronously
+		go n.dropConnection(targetID, conn)
+		return err
+	}
+	n.metrics.MessageSent(msg.Type)
+	return nil
+}
+
+// tickClock records a send event on the node's vector clock and returns a
+// copy to stamp on the outgoing message.
+func (n *Node) tickClock() transport.VectorClock {
+	n.clockMutex.Lock()
+	defer n.clockMutex.Unlock()
+
+	n.clock.Tick(n.ID)
+	return n.clock.Copy()
+}
+
+// observeClock merges the clock of a received message into the node's own
+// and records the receive event.
+func (n *Node) observeClock(clock transport.VectorClock) {
+	n.clockMutex.Lock()
+	defer n.clockMutex.Unlock()
+
+	n.clock.Merge(clock)
+	n.clock.Tick(n.ID)
+}
+
+// Clock returns a copy of the node's vector clock. Compare it with the Clock
+// of a received message to tell causally ordered updates from concurrent
+// ones.
+func (n *Node) Clock() transport.VectorClock {
+	n.clockMutex.Lock()
+	defer n.clockMutex.Unlock()
+
+	return n.clock.Copy()
+}
+
+func (n *Node) sendHeartbeats() {
+	ticker := time.NewTicker(n.heartbeatInterval())
+	defer ticker.Stop()
+	changed := n.timingChanged()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-changed:
+			changed = n.timingChanged()
+			ticker.Reset(n.heartbeatInterval())
+		case <-ticker.C:
+			n.broadcastHeartbeat()
+			n.checkLease()
+		}
+	}
+}
+
+// broadcastHeartbeat sends a heartbeat to every peer. The peers and term
+// are read under n.mutex, but the sends happen after releasing it: each
+// only queues the heartbeat for the peer's writer, so a peer that is slow to
+// take it delays no one else's, and the writer gives up on a stalled
+// connection after write_timeout.
+func (n *Node) broadcastHeartbeat() {
+	load := n.currentLoad()
+
+	n.mutex.RLock()
+	// Followers still announce themselves so the failure detector on the
+	// leader can tell they are alive
+	msgType := "alive"
+	if n.election.state == Leader {
+		msgType = "heartbeat"
+	}
+	term := n.election.term
+	peers := make([]int, 0, len(n.Peers))
+	for id := range n.Peers {
+		peers = append(peers, id)
+	}
+	n.mutex.RUnlock()
+
+	var sentAt int64
+	if msgType == "heartbeat" {
+		sentAt = time.Now().UnixNano()
+	}
+	for _, id := range peers {
+		n.sendBeat(id, Message{
+			Type:   msgType,
+			From:   n.ID,
+			Term:   term,
+			Load:   &load,
+			SentAt: sentAt,
+		})
+	}
+}
+
+func (n *Node) recordLoad(msg Message) {
+	if msg.Load != nil {
+		n.loads.Record(msg.From, *msg.Load)
+	}
+}
@@ -0,0 +1,80 @@
+package node
+
+import "math/rand"
+
+const (
+	// skipMaxLevel bounds the height of the skip list, enough for 4^16
+	// keys to be found in logarithmic time.
+	skipMaxLevel = 16
+	// skipBranching is the inverse of the chance that a key reaching one
+	// level of the skip list reaches the next as well.
+	skipBranching = 4
+)
+
+// orderedKeys is a skip list of keys, kept by engines beside their entries
+// so keys can be iterated in order. Keys are only ever added, as deleted
+// keys keep a tombstone, until the engine is reset. Like the engines, it
+// relies on the store's lock.
+type orderedKeys struct {
+	head  *skipNode
+	level int
+}
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+func newOrderedKeys() *orderedKeys {
+	return &orderedKeys{head: &skipNode{next: make([]*skipNode, skipMaxLevel)}, level: 1}
+}
+
+// add inserts key, if it is not there yet.
+func (o *orderedKeys) add(key string) {
+	var update [skipMaxLevel]*skipNode
+	x := o.head
+	for i := o.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	if next := x.next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := 1
+	for level < skipMaxLevel && rand.Intn(skipBranching) == 0 {
+		level++
+	}
+	for i := o.level; i < level; i++ {
+		update[i] = o.head
+	}
+	o.level = max(o.level, level)
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := range level {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// ascend calls fn with every key from start on, in order, until it returns
+// false.
+func (o *orderedKeys) ascend(start string, fn func(key string) bool) {
+	x := o.head
+	for i := o.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < start {
+			x = x.next[i]
+		}
+	}
+	for x = x.next[0]; x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
+
+// inRange reports whether key is before end, where "" is past every key.
+func inRange(key, end string) bool {
+	return end == "" || key < end
+}
@@ -0,0 +1,305 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+const (
+	defaultOutboxSize = 256
+	// outboxFlushTimeout bounds how long closing an outbox waits for queued
+	// messages to be written.
+	outboxFlushTimeout = time.Second
+	// defaultWriteTimeout bounds how long writing one message to a peer may
+	// take before the connection is given up as stalled.
+	defaultWriteTimeout = 5 * time.Second
+	// defaultBatchSize bounds a batch of messages written to a peer with a
+	// single flush.
+	defaultBatchSize = 64
+)
+
+var (
+	// ErrQueueFull is returned by sends to a peer whose outbound queue
+	// stayed full: the peer has fallen too far behind to take more.
+	ErrQueueFull = errors.New("outbound queue full")
+	// ErrNotConnected is returned by sends to a node there is no
+	// connection to.
+	ErrNotConnected = errors.New("not connected")
+	// ErrCircuitOpen is returned by sends to a peer whose circuit breaker
+	// is open; see breaker.go.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	errOutboxClosed = errors.New("connection closed")
+	errWriteTimeout = errors.New("write timed out")
+)
+
+// outbox queues messages to one peer and writes them from a dedicated
+// goroutine, so a slow peer never blocks the sender and concurrent sends
+// cannot interleave on the connection. It wraps the peer's connection as a
+// transport.Conn.
+//
+// If the connection supports batching, the writer buffers up to batchSize
+// messages and flushes them with a single write, so a burst of messages
+// costs one syscall rather than one each. A batch is flushed as soon as the
+// queue runs dry, unless batchWindow is set: then it waits that long for
+// more, trading latency for fewer writes.
+type outbox struct {
+	conn        transport.Conn
+	queue       chan Message
+	timeout     time.Duration
+	batchSize   int
+	batchWindow time.Duration
+	onError     func(error)
+	mutex       sync.RWMutex
+	closed      bool
+	closing     chan struct{}
+	once        sync.Once
+	stopped     chan struct{}
+
+	// room is closed, and replaced, when the writer takes a message off
+	// the queue while senders wait for room.
+	roomMutex sync.Mutex
+	room      chan struct{}
+	waiting   atomic.Int32
+
+	// writing is when the write in progress started, in Unix nanoseconds,
+	// or 0; writeTotal and writes add up the writes since writeLatency
+	// was last called.
+	writing    atomic.Int64
+	writeTotal atomic.Int64
+	writes     atomic.Int64
+	// ponged is when the peer last answered a ping, or the connection was
+	// opened, in Unix nanoseconds; see keepalive.go.
+	ponged atomic.Int64
+}
+
+// newOutbox starts the writer for conn, sized and batching as config says.
+// onError is called, on its own goroutine, if a write fails or takes longer
+// than the config's write_timeout (unless 0); the outbox writes nothing
+// after that.
+func newOutbox(conn transport.Conn, config Config, onError func(error)) *outbox {
+	o := &outbox{
+		conn:        conn,
+		queue:       make(chan Message, config.OutboxSize),
+		timeout:     config.WriteTimeout,
+		batchSize:   config.BatchSize,
+		batchWindow: config.BatchWindow,
+		onError:     onError,
+		closing:     make(chan struct{}),
+		stopped:     make(chan struct{}),
+		room:        make(chan struct{}),
+	}
+	o.ponged.Store(time.Now().UnixNano())
+	go o.run()
+	return o
+}
+
+func (o *outbox) run() {
+	defer close(o.stopped)
+
+	// Connections have no write deadline, so a stalled write is cut short
+	// by closing the connection under it
+	var timer *time.Timer
+	if o.timeout > 0 {
+		timer = time.AfterFunc(o.timeout, func() { o.conn.Close() })
+		timer.Stop()
+	}
+	batcher, batching := o.conn.(transport.BatchConn)
+	batching = batching && o.batchSize > 1
+	for msg := range o.queue {
+		o.took()
+		if timer != nil {
+			timer.Reset(o.timeout)
+		}
+		var err error
+		start := time.Now()
+		o.writing.Store(start.UnixNano())
+		if batching {
+			err = o.writeBatch(batcher, msg)
+		} else {
+			err = o.conn.Send(msg)
+		}
+		o.writing.Store(0)
+		o.writeTotal.Add(int64(time.Since(start)))
+		o.writes.Add(1)
+		if timer != nil && !timer.Stop() {
+			err = errWriteTimeout
+		}
+		if err != nil {
+			go o.onError(err)
+			return
+		}
+	}
+}
+
+// writeBatch writes msg and the messages queued behind it, up to batchSize
+// of them, then flushes them all. If the queue runs dry it waits for more
+// until batchWindow has passed since msg was taken.
+func (o *outbox) writeBatch(conn transport.BatchConn, msg Message) error {
+	start := time.Now()
+	var window <-chan time.Time
+	for written := 1; ; written++ {
+		if err := conn.Write(msg); err != nil {
+			return err
+		}
+		if written == o.batchSize {
+			break
+		}
+
+		var more bool
+		select {
+		case msg, more = <-o.queue:
+		default:
+			if o.batchWindow <= 0 {
+				return conn.Flush()
+			}
+			if window == nil {
+				timer := time.NewTimer(o.batchWindow - time.Since(start))
+				defer timer.Stop()
+				window = timer.C
+			}
+			select {
+			case msg, more = <-o.queue:
+			case <-window:
+			}
+		}
+		if !more {
+			break
+		}
+		o.took()
+	}
+	return conn.Flush()
+}
+
+// Send queues msg without blocking. It fails with ErrQueueFull if the peer
+// has fallen too far behind.
+func (o *outbox) Send(msg Message) error {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	if o.closed {
+		return errOutboxClosed
+	}
+	select {
+	case o.queue <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// noWait is an ended context, for sends that must not wait for room.
+var noWait = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// waitRoom waits until the queue has room, failing with ErrQueueFull if ctx
+// ends first, or early if the outbox is closed meanwhile. Another sender
+// may take the room before the caller does.
+func (o *outbox) waitRoom(ctx context.Context) error {
+	o.waiting.Add(1)
+	defer o.waiting.Add(-1)
+
+	o.roomMutex.Lock()
+	room := o.room
+	o.roomMutex.Unlock()
+	if len(o.queue) < cap(o.queue) {
+		return nil
+	}
+	select {
+	case <-room:
+		return nil
+	case <-ctx.Done():
+		return ErrQueueFull
+	case <-o.closing:
+		return errOutboxClosed
+	}
+}
+
+// took wakes the senders waiting for room after the writer took a message
+// off the queue.
+func (o *outbox) took() {
+	if o.waiting.Load() == 0 {
+		return
+	}
+	o.roomMutex.Lock()
+	close(o.room)
+	o.room = make(chan struct{})
+	o.roomMutex.Unlock()
+}
+
+func (o *outbox) Recv() (Message, error) {
+	return o.conn.Recv()
+}
+
+// Close stops accepting messages, gives the writer up to outboxFlushTimeout
+// to write what is queued, and closes the connection.
+func (o *outbox) Close() error {
+	// Wake senders waiting for room
+	o.once.Do(func() { close(o.closing) })
+
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.queue)
+	o.mutex.Unlock()
+
+	select {
+	case <-o.stopped:
+	case <-time.After(outboxFlushTimeout):
+	}
+	return o.conn.Close()
+}
+
+// Len returns the number of messages waiting to be written.
+func (o *outbox) Len() int {
+	return len(o.queue)
+}
+
+// writeLatency returns how long writes took on average since it was last
+// called, or how long the write in progress has taken if that is longer.
+func (o *outbox) writeLatency() time.Duration {
+	var latency time.Duration
+	if writes := o.writes.Swap(0); writes > 0 {
+		latency = time.Duration(o.writeTotal.Swap(0) / writes)
+	}
+	if started := o.writing.Load(); started != 0 {
+		latency = max(latency, time.Since(time.Unix(0, started)))
+	}
+	return latency
+}
+
+// openOutbox wraps a freshly dialed connection to peer id in an outbox that
+// drops the connection when a write fails.
+func (n *Node) openOutbox(id int, conn transport.Conn) *outbox {
+	var o *outbox
+	o = newOutbox(conn, n.config, func(err error) {
+		n.peerLogger(id, "").Error("failed to write to peer", "err", err)
+		n.dropConnection(id, o)
+	})
+	return o
+}
+
+// outboundQueued returns the number of messages queued to all peers.
+func (n *Node) outboundQueued() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	total := 0
+	for _, conn := range n.conn {
+		if o, ok := conn.(*outbox); ok {
+			total += o.Len()
+		}
+	}
+	return total
+}
@@ -0,0 +1,61 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stalledConn takes no message until release is closed.
+type stalledConn struct {
+	release chan struct{}
+}
+
+func (c stalledConn) Send(Message) error {
+	<-c.release
+	return nil
+}
+
+func (c stalledConn) Recv() (Message, error) {
+	<-c.release
+	return Message{}, errOutboxClosed
+}
+
+func (c stalledConn) Close() error { return nil }
+
+func TestWaitRoomWakesWhenWriterTakesMessage(t *testing.T) {
+	conn := stalledConn{release: make(chan struct{})}
+	o := newOutbox(conn, Config{OutboxSize: 1}, func(error) {})
+	defer o.Close()
+
+	// The writer takes the first message and stalls on it; the second
+	// fills the queue
+	if err := o.Send(Message{Type: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	for o.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := o.Send(Message{Type: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Send(Message{Type: "third"}); err != ErrQueueFull {
+		t.Fatalf("send to a full queue = %v, want ErrQueueFull", err)
+	}
+	if err := o.waitRoom(noWait); err != ErrQueueFull {
+		t.Fatalf("waitRoom without waiting = %v, want ErrQueueFull", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	waited := make(chan error, 1)
+	go func() { waited <- o.waitRoom(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	close(conn.release)
+	if err := <-waited; err != nil {
+		t.Fatalf("waitRoom after the writer moved on = %v", err)
+	}
+	if err := o.Send(Message{Type: "third"}); err != nil {
+		t.Errorf("send once there is room = %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A node with a data directory keeps its address book, the Peers map, in
+// peers.json, rewritten whenever a peer joins, changes address or leaves.
+// On startup the node redials the peers it knew, so a restarted node
+// rejoins the cluster without connect commands. Peers that left gracefully
+// are no longer in the book.
+
+const (
+	peersFile = "peers.json"
+	// peerBookAttempts bounds how often a peer from the address book is
+	// dialed on startup before it is given up on; gossip reintroduces it
+	// if it comes back later.
+	peerBookAttempts = 8
+)
+
+// loadPeerBook reads the address book saved in dir, if any.
+func loadPeerBook(dir string) (map[int]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, peersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers map[int]string
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", peersFile, err)
+	}
+	return peers, nil
+}
+
+// savePeerBook writes the address book to the data directory atomically.
+func (n *Node) savePeerBook() error {
+	n.mutex.RLock()
+	data, err := json.MarshalIndent(n.Peers, "", "  ")
+	n.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(n.config.DataDir, peersFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// peersChanged asks for the address book to be saved. It never blocks, so
+// it may be called with n.mutex held.
+func (n *Node) peersChanged() {
+	select {
+	case n.peerBook <- struct{}{}:
+	default:
+	}
+}
+
+// runPeerBook saves the address book whenever it changes, until the node
+// shuts down.
+func (n *Node) runPeerBook() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.peerBook:
+		}
+		if err := n.savePeerBook(); err != nil {
+			n.logger.Error("failed to save address book", "err", err)
+		}
+	}
+}
+
+// redialSaved connects to a peer from the address book, retrying with
+// backoff up to peerBookAttempts times. It stops once the peer is
+// connected, or known under another address, by other means.
+func (n *Node) redialSaved(id int, address string) {
+	logger := n.peerLogger(id, "")
+	for attempt := 0; attempt < peerBookAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-n.done:
+				return
+			case <-time.After(backoff(attempt - 1)):
+			}
+		}
+
+		n.mutex.RLock()
+		current, known := n.Peers[id]
+		_, connected := n.conn[id]
+		n.mutex.RUnlock()
+		if connected || (known && current != address) {
+			return
+		}
+
+		err := n.Connect(id, address)
+		if err == nil {
+			logger.Info("reconnected to peer from address book", "addr", address)
+			return
+		}
+		if errors.Is(err, errBanned) {
+			return
+		}
+		logger.Debug("failed to dial peer from address book", "addr", address, "attempt", attempt+1, "err", err)
+	}
+	logger.Warn("giving up on peer from address book", "addr", address)
+}
@@ -0,0 +1,169 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tasks carry a priority, and each node's queue serves high priority tasks
+// first (see TaskQueue). Urgent work can still end up waiting for the
+// workers busy with a bulk job, so the leader can mark running low priority
+// tasks preemptible, letting high priority tasks take their workers. Marks
+// requested on other nodes are forwarded to the leader, which asks every
+// node for the task, since only the node running it knows where it runs.
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorities are the priority levels, highest first.
+var priorities = [...]string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority checks a task priority, case-insensitively, and returns it
+// in canonical form. The empty string means PriorityNormal.
+func ParsePriority(priority string) (string, error) {
+	level, err := priorityLevel(priority)
+	if err != nil {
+		return "", err
+	}
+	return priorities[level], nil
+}
+
+// priorityLevel returns the index of priority in priorities.
+func priorityLevel(priority string) (int, error) {
+	switch strings.ToLower(priority) {
+	case PriorityHigh:
+		return 0, nil
+	case "", PriorityNormal:
+		return 1, nil
+	case PriorityLow:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q: expected high, normal or low", priority)
+}
+
+// TaskOptions are the optional settings of a task sent with
+// SendTaskWithOptions.
+type TaskOptions struct {
+	// Key is the task's idempotency key; see SendIdempotentTask.
+	Key string
+	// Priority is PriorityHigh, PriorityNormal or PriorityLow; empty means
+	// normal.
+	Priority string
+	// Timeout, if not zero, bounds how long the task may run on the target,
+	// counted from when it is queued there: its handler's context is then
+	// cancelled (see ContextHandler).
+	Timeout time.Duration
+}
+
+// Preempt marks the running low priority task id preemptible, wherever it
+// runs, and returns the node running it. Only the leader marks tasks; on
+// other nodes the request is forwarded to it.
+func (n *Node) Preempt(id string) (int, error) {
+	n.mutex.RLock()
+	leader, leading := n.election.leaderID, n.election.state == Leader
+	n.mutex.RUnlock()
+
+	if leading {
+		return n.preemptAsLeader(id)
+	}
+	if leader < 0 {
+		return -1, errors.New("no known leader to preempt with")
+	}
+	if !n.PeerSupports(leader, CapPriority) {
+		return -1, fmt.Errorf("leader %d does not support preemption", leader)
+	}
+	reply, err := n.Call(leader, Message{Type: "preempt", TaskID: id}, clientTimeout)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(reply.Content)
+}
+
+// preemptAsLeader marks task id preemptible on the node running it, asking
+// every peer whether it does.
+func (n *Node) preemptAsLeader(id string) (int, error) {
+	err := n.tasks.Preempt(id)
+	if err == nil {
+		n.logger.Info("task marked preemptible", "task", id)
+		return n.ID, nil
+	}
+	if err != errNotRunning {
+		return -1, err
+	}
+
+	var (
+		mutex  sync.Mutex
+		runner = -1
+		failed error
+		wg     sync.WaitGroup
+	)
+	n.mutex.RLock()
+	peers := make([]int, 0, len(n.conn))
+	for id := range n.conn {
+		peers = append(peers, id)
+	}
+	n.mutex.RUnlock()
+
+	for _, peer := range peers {
+		if !n.PeerSupports(peer, CapPriority) {
+			continue
+		}
+		wg.Add(1)
+		go func(peer int) {
+			defer wg.Done()
+			reply, err := n.Call(peer, Message{Type: "preempt", TaskID: id}, clientTimeout)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				runner = peer
+			case reply.Error != errNotRunning.Error():
+				failed = err
+			}
+		}(peer)
+	}
+	wg.Wait()
+	if runner >= 0 {
+		return runner, nil
+	}
+	if failed != nil {
+		return -1, failed
+	}
+	return -1, fmt.Errorf("task %s is not running on any node", id)
+}
+
+// handlePreempt marks a task preemptible for the leader, or serves a
+// request forwarded to this node as the leader.
+func (n *Node) handlePreempt(msg Message) {
+	n.mutex.RLock()
+	leader, leading := n.election.leaderID, n.election.state == Leader
+	n.mutex.RUnlock()
+
+	// The reply's content is the id of the node running the task
+	reply := Message{Type: "preempt_result", TaskID: msg.TaskID}
+	switch {
+	case msg.From == leader:
+		if err := n.tasks.Preempt(msg.TaskID); err != nil {
+			reply.Error = err.Error()
+		} else {
+			n.peerLogger(msg.From, msg.Type).Info("task marked preemptible", "task", msg.TaskID)
+			reply.Content = strconv.Itoa(n.ID)
+		}
+	case leading:
+		runner, err := n.preemptAsLeader(msg.TaskID)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		reply.Content = strconv.Itoa(runner)
+	default:
+		reply.Error = fmt.Sprintf("node %d is not the leader", n.ID)
+	}
+	n.Reply(msg, reply)
+}
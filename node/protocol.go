@@ -0,0 +1,147 @@
+package node
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	// ProtocolVersion is the version of the node protocol this build
+	// speaks. It is raised when a change means older nodes can no longer
+	// follow the protocol, and MinProtocolVersion with it once builds that
+	// old must be refused.
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest protocol version this build
+	// interoperates with. Nodes that predate versioning announce none and
+	// count as version 1.
+	MinProtocolVersion = 1
+)
+
+// Capabilities are optional protocol features a node announces in its
+// hello. A node only sends a peer messages belonging to a feature the peer
+// announced, so builds with and without a feature can share a cluster.
+const (
+	CapWatch     = "watch"
+	CapJoin      = "join"
+	CapIDs       = "next_id"
+	CapTrace     = "trace"
+	CapTTL       = "ttl"
+	CapTx        = "tx"
+	CapRead      = "read"
+	CapHints     = "hints"
+	CapSchedule  = "schedule"
+	CapProgress  = "progress"
+	CapQuery     = "query"
+	CapIndex     = "index"
+	CapBulk      = "bulk"
+	CapPriority  = "priority"
+	CapDrain     = "drain"
+	CapRebalance = "rebalance"
+	CapACL       = "acl"
+	CapPing      = "ping"
+	// CapClusterConfig is the cluster config; see clusterconfig.go.
+	CapClusterConfig = "cluster_config"
+	CapLocks         = "locks"
+	CapCRDT          = "crdt"
+	CapBans          = "bans"
+	CapBatch         = "batch"
+	CapSnapshot      = "snapshot"
+	CapSteal         = "steal"
+	CapScan          = "scan"
+	// CapUDP is only announced by nodes running with udp_heartbeats.
+	CapUDP = "udp_heartbeats"
+	// CapLog is only announced by nodes running in linearizable mode; see
+	// linear.go.
+	CapLog = "log"
+)
+
+// capabilities are the features this build supports.
+var capabilities = []string{CapWatch, CapJoin, CapIDs, CapTrace, CapTTL, CapTx, CapRead, CapHints, CapSchedule, CapProgress, CapQuery, CapIndex, CapBulk, CapPriority, CapDrain, CapRebalance, CapACL, CapPing, CapClusterConfig, CapLocks, CapCRDT, CapBans, CapBatch, CapSnapshot, CapSteal, CapScan}
+
+// legacyCapabilities are assumed of a peer that announces none: builds from
+// before capabilities were negotiated, all of which had these features.
+var legacyCapabilities = []string{CapWatch, CapJoin, CapIDs, CapTrace, CapTTL}
+
+// peerInfo is what a peer announced about itself in its hello.
+type peerInfo struct {
+	role         string
+	version      int
+	capabilities []string
+	// draining is set once the peer announces it is draining.
+	draining bool
+}
+
+// helloVersion returns the protocol version a hello announces.
+func helloVersion(hello Message) int {
+	if hello.Version == 0 {
+		return 1
+	}
+	return hello.Version
+}
+
+// checkVersion fails if the node that sent hello speaks a protocol version
+// this build no longer interoperates with.
+func checkVersion(hello Message) error {
+	if v := helloVersion(hello); v < MinProtocolVersion {
+		return fmt.Errorf("node %d speaks protocol version %d, but version %d or later is required", hello.From, v, MinProtocolVersion)
+	}
+	return nil
+}
+
+// learnPeer records what a peer announced in its hello. Peers that predate
+// roles announce none and are members.
+func (n *Node) learnPeer(id int, hello Message) {
+	info := peerInfo{
+		role:         hello.Role,
+		version:      helloVersion(hello),
+		capabilities: hello.Capabilities,
+	}
+	if info.role == "" {
+		info.role = RoleMember
+	}
+	if info.capabilities == nil {
+		info.capabilities = legacyCapabilities
+	}
+
+	n.mutex.Lock()
+	n.peerInfo[id] = info
+	n.mutex.Unlock()
+}
+
+// PeerSupports reports whether peer id announced the capability. Peers
+// whose hello has not been seen are assumed to.
+func (n *Node) PeerSupports(id int, capability string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	info, ok := n.peerInfo[id]
+	return !ok || slices.Contains(info.capabilities, capability)
+}
+
+// PeerVersion returns the protocol version peer id announced, or 0 if its
+// hello has not been seen.
+func (n *Node) PeerVersion(id int) int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.peerInfo[id].version
+}
+
+// unsupported answers a message of a type this node does not handle and no
+// OnMessage handler took. It is ignored, but a sender waiting for a reply
+// gets an error at once instead of timing out.
+func (n *Node) unsupported(msg Message) {
+	n.metrics.MessageUnknown(msg.Type)
+	n.peerLogger(msg.From, msg.Type).Debug("ignoring message of unknown type")
+
+	// Never answer an answer, or two nodes could bounce them forever
+	if msg.RequestID == "" || msg.Type == "unsupported" {
+		return
+	}
+	n.sendMessage(msg.From, Message{
+		Type:      "unsupported",
+		From:      n.ID,
+		RequestID: msg.RequestID,
+		Error:     fmt.Sprintf("unsupported message type %q", msg.Type),
+	})
+}
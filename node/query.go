@@ -0,0 +1,445 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The node running a query sends it to every node on the ring, each of
+// which returns the entries it holds whose keys match. It merges the
+// replies keeping the newest entry of each key, and only then applies the
+// conditions on values, sorts and limits, so stale replicas and deleted
+// keys do not show up.
+
+// queryTimeout bounds how long a query waits for each node's entries.
+const queryTimeout = 5 * time.Second
+
+// Query is a parsed query, which selects keys and values from the whole
+// cluster with a small SQL-like language:
+//
+//	select <* | key | value | count(*)> [where <cond> [and <cond> ...]]
+//	    [order by <key | value> [asc | desc]] [limit <n>]
+//
+// where a condition compares key or value with a quoted string using =,
+// !=, <, <=, >, >= or contains, or is prefix = "<prefix>". Keywords are
+// case insensitive. Rows are ordered by key unless ordered otherwise.
+type Query struct {
+	// Select is "*", "key", "value" or "count".
+	Select     string
+	Conditions []Condition
+	OrderBy    string
+	Descending bool
+	// Limit is the most rows returned, 0 for no limit.
+	Limit int
+}
+
+// Condition is one comparison of a query's where clause.
+type Condition struct {
+	// Field is "key", "value" or "prefix".
+	Field string
+	// Op is =, !=, <, <=, >, >= or contains.
+	Op    string
+	Value string
+}
+
+// matches reports whether the field of c in key or value satisfies c.
+func (c Condition) matches(key, value string) bool {
+	field := key
+	switch c.Field {
+	case "prefix":
+		return strings.HasPrefix(key, c.Value)
+	case "value":
+		field = value
+	}
+	switch c.Op {
+	case "=":
+		return field == c.Value
+	case "!=":
+		return field != c.Value
+	case "<":
+		return field < c.Value
+	case "<=":
+		return field <= c.Value
+	case ">":
+		return field > c.Value
+	case ">=":
+		return field >= c.Value
+	case "contains":
+		return strings.Contains(field, c.Value)
+	}
+	return false
+}
+
+// matchesKey reports whether key satisfies every condition on keys. Index
+// entries and the keys of namespaces other than the default one only match
+// queries for them by prefix.
+func (q *Query) matchesKey(key string) bool {
+	for _, prefix := range []string{indexKeyPrefix, namespaceKeyPrefix} {
+		if strings.HasPrefix(key, prefix) && !q.selects(prefix) {
+			return false
+		}
+	}
+	for _, c := range q.Conditions {
+		if c.Field != "value" && !c.matches(key, "") {
+			return false
+		}
+	}
+	return true
+}
+
+// selects reports whether q selects keys under prefix by a prefix of their
+// own.
+func (q *Query) selects(prefix string) bool {
+	for _, c := range q.Conditions {
+		if c.Field == "prefix" && strings.HasPrefix(c.Value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequestKeys fails if a condition of q names internal keys, which
+// requests may not.
+func (q *Query) checkRequestKeys() error {
+	for _, c := range q.Conditions {
+		if c.Field == "value" {
+			continue
+		}
+		if err := checkRequestKey(c.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesValue reports whether value satisfies every condition on values.
+func (q *Query) matchesValue(value string) bool {
+	for _, c := range q.Conditions {
+		if c.Field == "value" && !c.matches("", value) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns q in the query language.
+func (q *Query) String() string {
+	var b strings.Builder
+	b.WriteString("select ")
+	if q.Select == "count" {
+		b.WriteString("count(*)")
+	} else {
+		b.WriteString(q.Select)
+	}
+	for i, c := range q.Conditions {
+		if i == 0 {
+			b.WriteString(" where ")
+		} else {
+			b.WriteString(" and ")
+		}
+		fmt.Fprintf(&b, "%s %s %q", c.Field, c.Op, c.Value)
+	}
+	if q.OrderBy != "" {
+		fmt.Fprintf(&b, " order by %s", q.OrderBy)
+		if q.Descending {
+			b.WriteString(" desc")
+		}
+	}
+	if q.Limit > 0 {
+		fmt.Fprintf(&b, " limit %d", q.Limit)
+	}
+	return b.String()
+}
+
+// queryTokens splits a query into words, operators and quoted strings.
+// Quoted strings keep their quotes so the parser can tell them apart.
+func queryTokens(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(text) && text[end] != c {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string at %q", text[i:])
+			}
+			tokens = append(tokens, text[i:end+1])
+			i = end + 1
+		case strings.ContainsRune("*,()", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			end := i + 1
+			if end < len(text) && text[end] == '=' {
+				end++
+			}
+			tokens = append(tokens, text[i:end])
+			i = end
+		default:
+			end := i
+			for end < len(text) && !unicode.IsSpace(rune(text[end])) && !strings.ContainsRune("*,()=!<>\"'", rune(text[end])) {
+				end++
+			}
+			tokens = append(tokens, text[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// unquote returns the string a quoted token stands for.
+func unquote(token string) (string, error) {
+	if len(token) < 2 || (token[0] != '"' && token[0] != '\'') {
+		return "", fmt.Errorf("expected a quoted string, got %q", token)
+	}
+	if token[0] == '\'' {
+		token = `"` + strings.ReplaceAll(token[1:len(token)-1], `"`, `\"`) + `"`
+	}
+	s, err := strconv.Unquote(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", token)
+	}
+	return s, nil
+}
+
+// ParseQuery parses a query; see Query for the language.
+func ParseQuery(text string) (*Query, error) {
+	tokens, err := queryTokens(text)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	peek := func() string {
+		if pos < len(tokens) {
+			return strings.ToLower(tokens[pos])
+		}
+		return ""
+	}
+	next := func() string {
+		token := ""
+		if pos < len(tokens) {
+			token = tokens[pos]
+			pos++
+		}
+		return token
+	}
+	expect := func(words ...string) error {
+		for _, word := range words {
+			if got := next(); strings.ToLower(got) != word {
+				if got == "" {
+					return fmt.Errorf("expected %q at the end of the query", word)
+				}
+				return fmt.Errorf("expected %q, got %q", word, got)
+			}
+		}
+		return nil
+	}
+
+	q := &Query{}
+	if err := expect("select"); err != nil {
+		return nil, err
+	}
+	switch field := strings.ToLower(next()); field {
+	case "*", "key", "value":
+		q.Select = field
+	case "count":
+		if err := expect("(", "*", ")"); err != nil {
+			return nil, err
+		}
+		q.Select = "count"
+	default:
+		return nil, fmt.Errorf("expected *, key, value or count(*) after select, got %q", field)
+	}
+
+	if peek() == "where" {
+		next()
+		for {
+			var c Condition
+			switch c.Field = strings.ToLower(next()); c.Field {
+			case "key", "value", "prefix":
+			default:
+				return nil, fmt.Errorf("expected key, value or prefix in a condition, got %q", c.Field)
+			}
+			switch c.Op = strings.ToLower(next()); c.Op {
+			case "=", "!=", "<", "<=", ">", ">=", "contains":
+			default:
+				return nil, fmt.Errorf("expected an operator after %s, got %q", c.Field, c.Op)
+			}
+			if c.Field == "prefix" && c.Op != "=" {
+				return nil, errors.New("prefix only supports =")
+			}
+			if c.Value, err = unquote(next()); err != nil {
+				return nil, err
+			}
+			q.Conditions = append(q.Conditions, c)
+			if peek() != "and" {
+				break
+			}
+			next()
+		}
+	}
+
+	if peek() == "order" {
+		next()
+		if err := expect("by"); err != nil {
+			return nil, err
+		}
+		switch q.OrderBy = strings.ToLower(next()); q.OrderBy {
+		case "key", "value":
+		default:
+			return nil, fmt.Errorf("can only order by key or value, not %q", q.OrderBy)
+		}
+		switch peek() {
+		case "desc":
+			q.Descending = true
+			next()
+		case "asc":
+			next()
+		}
+	}
+
+	if peek() == "limit" {
+		next()
+		limit, err := strconv.Atoi(next())
+		if err != nil || limit <= 0 {
+			return nil, errors.New("limit must be a positive number")
+		}
+		q.Limit = limit
+	}
+	if pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q", tokens[pos])
+	}
+	return q, nil
+}
+
+// QueryRow is a key and its value in a query result.
+type QueryRow struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// QueryResult is the outcome of a query.
+type QueryResult struct {
+	// Rows are the matching keys, sorted and limited as asked; empty for
+	// count(*).
+	Rows []QueryRow `json:"rows,omitempty"`
+	// Count is how many keys matched, before the limit.
+	Count int `json:"count"`
+	// Missing lists the nodes that did not answer. Their keys are only in
+	// the result if another replica holds them.
+	Missing []int `json:"missing,omitempty"`
+}
+
+// Query runs a query over the keys of the whole cluster; see Query for the
+// language. Nodes that do not answer within queryTimeout are listed in the
+// result's Missing rather than failing the query.
+func (n *Node) Query(text string) (QueryResult, error) {
+	q, err := ParseQuery(text)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	var (
+		mutex   sync.Mutex
+		merged  = make(map[string]Entry)
+		missing []int
+		wg      sync.WaitGroup
+	)
+	merge := func(entries map[string]Entry) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for key, e := range entries {
+			if old, ok := merged[key]; !ok || old.Timestamp.Less(e.Timestamp) {
+				merged[key] = e
+			}
+		}
+	}
+
+	for _, id := range n.ring.Nodes() {
+		if id == n.ID {
+			merge(n.queryLocal(q))
+			continue
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var err error
+			var reply Message
+			if !n.PeerSupports(id, CapQuery) {
+				err = errors.New("peer does not support queries")
+			} else {
+				reply, err = n.Call(id, Message{Type: "query", Content: q.String()}, queryTimeout)
+			}
+			if err != nil {
+				n.peerLogger(id, "query").Warn("node left out of query", "err", err)
+				mutex.Lock()
+				missing = append(missing, id)
+				mutex.Unlock()
+				return
+			}
+			merge(reply.Entries)
+		}(id)
+	}
+	wg.Wait()
+	sort.Ints(missing)
+
+	now := time.Now()
+	result := QueryResult{Missing: missing}
+	for key, e := range merged {
+		if e.Deleted || e.Expired(now) || !q.matchesValue(e.Value) {
+			continue
+		}
+		result.Rows = append(result.Rows, QueryRow{Key: key, Value: e.Value})
+	}
+	result.Count = len(result.Rows)
+	if q.Select == "count" {
+		result.Rows = nil
+		return result, nil
+	}
+
+	sort.Slice(result.Rows, func(i, j int) bool {
+		a, b := result.Rows[i], result.Rows[j]
+		if q.Descending {
+			a, b = b, a
+		}
+		if q.OrderBy == "value" && a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Key < b.Key
+	})
+	if q.Limit > 0 && len(result.Rows) > q.Limit {
+		result.Rows = result.Rows[:q.Limit]
+	}
+	return result, nil
+}
+
+// queryLocal returns the entries this node holds whose keys match q,
+// tombstones included so the merge can tell deleted keys from missing ones.
+func (n *Node) queryLocal(q *Query) map[string]Entry {
+	return n.store.Matching(q.matchesKey)
+}
+
+// handleQuery returns this node's entries matching a query to the node
+// running it.
+func (n *Node) handleQuery(msg Message) {
+	q, err := ParseQuery(msg.Content)
+	if err != nil {
+		n.Reply(msg, Message{Type: "query_result", Error: err.Error()})
+		return
+	}
+	n.Reply(msg, Message{Type: "query_result", Entries: n.queryLocal(q)})
+}
@@ -0,0 +1,105 @@
+package node
+
+import (
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// throttledError is the error carried by replies to requests rejected by
+// the rate limit.
+const throttledError = "throttled"
+
+// TokenBucket admits events at a steady rate with bursts of up to burst
+// events. It is not safe for concurrent use: each connection's read loop
+// owns its own bucket. A nil bucket admits everything.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket refilling at rate tokens per second.
+// A burst below one is raised to one, so the rate is always reachable.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := float64(max(burst, 1))
+	return &TokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// Allow takes a token if one is available.
+func (b *TokenBucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// newLimiter returns the rate limiter for a new connection, or nil if
+// inbound messages are not rate limited.
+func (n *Node) newLimiter() *TokenBucket {
+	if n.config.RateLimit <= 0 {
+		return nil
+	}
+	burst := n.config.RateBurst
+	if burst == 0 {
+		burst = int(n.config.RateLimit)
+	}
+	return NewTokenBucket(n.config.RateLimit, burst)
+}
+
+// rateLimited reports whether msg makes work for the node and counts
+// against the rate limit. Heartbeats, votes, acks and the other control
+// messages never do, so a throttled peer is not mistaken for a dead one.
+func rateLimited(msg Message) bool {
+	if msg.Client {
+		return true
+	}
+	switch msg.Type {
+	case "task", "batch", "get", "set", "del", "update":
+		return true
+	}
+	return false
+}
+
+// admit checks msg, received on conn, against the connection's limiter. A
+// rejected message is answered with a throttled response instead of being
+// handled: reliably sent tasks are left unacknowledged, so the sender defers
+// and resends them, while other tasks and KV and client requests fail with
+// the throttled error.
+func (n *Node) admit(limiter *TokenBucket, conn transport.Conn, msg Message) bool {
+	if !rateLimited(msg) || limiter.Allow() {
+		return true
+	}
+	n.metrics.MessageThrottled(msg.Type)
+	n.peerLogger(msg.From, msg.Type).Debug("rate limit exceeded, throttling message")
+
+	switch {
+	case msg.Client:
+		conn.Send(Message{Type: msg.Type, From: n.ID, RequestID: msg.RequestID, Error: throttledError, Client: true})
+	case msg.Type == "task" && msg.Seq != 0:
+		n.sendMessage(msg.From, Message{Type: "throttled", From: n.ID, TaskID: msg.TaskID, Seq: msg.Seq})
+	case msg.Type == "task":
+		// Not sent reliably, so it would never be resent
+		n.sendMessage(msg.From, Message{Type: "result", From: n.ID, TaskID: msg.TaskID, RequestID: msg.RequestID, Error: throttledError})
+	case msg.Type == "batch":
+		n.sendMessage(msg.From, Message{Type: "batch_result", From: n.ID, RequestID: msg.RequestID, Error: throttledError})
+	default:
+		n.sendMessage(msg.From, Message{Type: "kv_result", From: n.ID, Key: msg.Key, RequestID: msg.RequestID, Error: throttledError})
+	}
+	return false
+}
+
+// handleThrottled notes that a peer deferred a task this node sent; the
+// retransmitter resends it once the ack is overdue.
+func (n *Node) handleThrottled(msg Message) {
+	n.metrics.MessageDeferred("task")
+	n.peerLogger(msg.From, msg.Type).Debug("task deferred by peer rate limit", "task", msg.TaskID, "seq", msg.Seq)
+}
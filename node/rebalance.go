@@ -0,0 +1,225 @@
+package node
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+)
+
+// When members join or leave the ring, the replicas of some keys change.
+// Each member compares the ring with the one it last balanced and copies the
+// keys whose replica set gained a node to that node, so the new replicas
+// hold the keys they now serve. Only the first old replica still on the ring
+// copies a key, so each key is sent once per new replica, and keys whose
+// replicas did not change are not sent at all. Copies are sent in batches at
+// no more than rebalance_rate keys a second, so a rebalance does not crowd
+// out client traffic. Nodes that no longer replicate a key keep their copy;
+// it is no longer read. A member that leaves without draining takes the
+// keys only it held with it.
+
+const (
+	defaultRebalanceRate = 1000
+	// rebalanceDelay is how long the ring must stay unchanged before it is
+	// rebalanced, so the nodes of a starting cluster, or a node and the
+	// peers it introduces, are balanced in one pass.
+	rebalanceDelay = 2 * time.Second
+)
+
+// RebalanceStatus is the progress of a node's last rebalance.
+type RebalanceStatus struct {
+	Running bool `json:"running"`
+	// Joined and Left are the members that joined and left the ring since
+	// the rebalance before.
+	Joined []int `json:"joined,omitempty"`
+	Left   []int `json:"left,omitempty"`
+	// Keys is how many keys this node has to copy to new replicas; Copied
+	// how many of them every available new replica acknowledged so far, and
+	// Failed how many were not.
+	Keys     int       `json:"keys"`
+	Copied   int       `json:"copied"`
+	Failed   int       `json:"failed"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// RebalanceStatus returns the progress of this node's last rebalance.
+func (n *Node) RebalanceStatus() RebalanceStatus {
+	n.rebalanceMutex.Lock()
+	defer n.rebalanceMutex.Unlock()
+
+	return n.rebalance
+}
+
+// ClusterRebalanceStatus returns the progress of the last rebalance of
+// every reachable member, by node id.
+func (n *Node) ClusterRebalanceStatus() map[int]RebalanceStatus {
+	statuses := make(map[int]RebalanceStatus)
+	if ownsKeys(n.config.Role) {
+		statuses[n.ID] = n.RebalanceStatus()
+	}
+	for _, id := range n.ring.Nodes() {
+		if id == n.ID || !n.available(id) || !n.PeerSupports(id, CapRebalance) {
+			continue
+		}
+		reply, err := n.Call(id, Message{Type: "rebalance_status"}, clientTimeout)
+		if err != nil {
+			continue
+		}
+		var status RebalanceStatus
+		if json.Unmarshal([]byte(reply.Content), &status) == nil {
+			statuses[id] = status
+		}
+	}
+	return statuses
+}
+
+func (n *Node) handleRebalanceStatus(msg Message) {
+	data, _ := json.Marshal(n.RebalanceStatus())
+	n.Reply(msg, Message{Type: "rebalance_status_result", Content: string(data)})
+}
+
+// runRebalancer rebalances the ring once it settles after a change. The
+// first ring to settle is only recorded: a starting node has nothing to hand
+// over to peers it just met.
+func (n *Node) runRebalancer() {
+	if !ownsKeys(n.config.Role) {
+		return
+	}
+	ticker := time.NewTicker(rebalanceDelay / 4)
+	defer ticker.Stop()
+
+	var balanced []int
+	current, changed := n.ring.Nodes(), time.Now()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		nodes := n.ring.Nodes()
+		if !slices.Equal(nodes, current) {
+			current, changed = nodes, time.Now()
+			continue
+		}
+		if time.Since(changed) < rebalanceDelay || n.Draining() {
+			continue
+		}
+		if balanced != nil && !slices.Equal(current, balanced) {
+			n.rebalanceRing(balanced, current)
+		}
+		balanced = current
+	}
+}
+
+// rebalanceRing copies the keys this node holds to the replicas they gained
+// when the ring's members changed from before to after.
+func (n *Node) rebalanceRing(before, after []int) {
+	old := NewRing()
+	for _, id := range before {
+		old.Add(id)
+	}
+
+	entries := n.store.Matching(func(string) bool { return true })
+	targets := make(map[string][]int)
+	var keys []string
+	for key := range entries {
+		previous := old.Replicas(key, n.ReplicationFor(key))
+		if n.rebalanceSource(previous, after) != n.ID {
+			continue
+		}
+		for _, id := range n.replicas(key) {
+			if id != n.ID && !slices.Contains(previous, id) {
+				targets[key] = append(targets[key], id)
+			}
+		}
+		if len(targets[key]) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	status := RebalanceStatus{
+		Running: true,
+		Joined:  missing(after, before),
+		Left:    missing(before, after),
+		Keys:    len(keys),
+		Started: time.Now(),
+	}
+	n.setRebalanceStatus(status)
+	if len(keys) > 0 {
+		n.logger.Info("rebalancing", "joined", status.Joined, "left", status.Left, "keys", status.Keys)
+	}
+
+	// Batches are small enough for a peer's outbound queue (see
+	// migrateKeys) and, when throttled, for a second's worth of keys, and
+	// each waits until the rate allows it
+	rate := n.config.RebalanceRate
+	size := max(n.config.OutboxSize/2, 1)
+	if rate > 0 {
+		size = max(min(size, int(rate)), 1)
+	}
+	for start := 0; start < len(keys); start += size {
+		if rate > 0 {
+			due := status.Started.Add(time.Duration(float64(start) / rate * float64(time.Second)))
+			select {
+			case <-n.done:
+				return
+			case <-time.After(time.Until(due)):
+			}
+		}
+		batch := keys[start:min(start+size, len(keys))]
+		reachable := make(map[string][]int, len(batch))
+		for _, key := range batch {
+			for _, id := range targets[key] {
+				if n.available(id) {
+					reachable[key] = append(reachable[key], id)
+				}
+			}
+		}
+		copied := n.copyEntries(batch, entries, reachable)
+		status.Copied += copied
+		status.Failed += len(batch) - copied
+		n.setRebalanceStatus(status)
+	}
+
+	status.Running = false
+	status.Finished = time.Now()
+	n.setRebalanceStatus(status)
+	if len(keys) == 0 {
+		return
+	}
+	n.logger.Info("rebalanced", "keys", status.Keys, "copied", status.Copied, "failed", status.Failed,
+		"took", status.Finished.Sub(status.Started).Round(time.Millisecond))
+}
+
+// rebalanceSource returns the node that copies a key with the previous
+// replicas to its new ones: the first of them still on the ring (after) and
+// available, or -1 if none is.
+func (n *Node) rebalanceSource(previous, after []int) int {
+	for _, id := range previous {
+		if slices.Contains(after, id) && n.available(id) {
+			return id
+		}
+	}
+	return -1
+}
+
+func (n *Node) setRebalanceStatus(status RebalanceStatus) {
+	n.rebalanceMutex.Lock()
+	defer n.rebalanceMutex.Unlock()
+
+	n.rebalance = status
+}
+
+// missing returns the ids in a that are not in b.
+func missing(a, b []int) []int {
+	var ids []int
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,129 @@
+package node
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+const (
+	reconnectBaseDelay = time.Millisecond * 500
+	reconnectMaxDelay  = time.Second * 30
+)
+
+// backoff returns the delay before the given reconnect attempt: exponential
+// growth capped at reconnectMaxDelay, with up to 50% random jitter so peers
+// that lost the same node don't redial it in lockstep.
+func backoff(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = reconnectBaseDelay << uint(attempt)
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// watchConnection serves what the peer sends on a connection we dialed
+// until it breaks, then hands it to the reconnection manager.
+func (n *Node) watchConnection(id int, conn transport.Conn) {
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+	limiter := n.newLimiter()
+	for {
+		msg, err := conn.Recv()
+		if err != nil {
+			n.logRecvError(err)
+			break
+		}
+		if n.admit(limiter, conn, msg) {
+			n.dispatch(ctx, conn, msg)
+		}
+	}
+	n.dropConnection(id, conn)
+}
+
+// dropConnection removes a broken connection from the conn map and starts
+// reconnecting to the peer if it is still known. It is a no-op if conn has
+// already been replaced.
+func (n *Node) dropConnection(id int, conn transport.Conn) {
+	select {
+	case <-n.done:
+		// Shutdown closes every connection on purpose
+		return
+	default:
+	}
+
+	n.mutex.Lock()
+	if current, ok := n.conn[id]; !ok || current != conn {
+		n.mutex.Unlock()
+		return
+	}
+	delete(n.conn, id)
+
+	address, known := n.Peers[id]
+	start := known && !n.reconnecting[id]
+	if start {
+		n.reconnecting[id] = true
+	}
+	n.mutex.Unlock()
+	conn.Close()
+	n.peerLost(id)
+
+	if start {
+		n.peerLogger(id, "").Warn("lost connection, reconnecting")
+		go n.reconnect(id, address)
+	}
+}
+
+func (n *Node) reconnect(id int, address string) {
+	defer func() {
+		n.mutex.Lock()
+		delete(n.reconnecting, id)
+		n.mutex.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-n.done:
+			return
+		case <-time.After(backoff(attempt)):
+		}
+
+		n.mutex.RLock()
+		current, known := n.Peers[id]
+		_, connected := n.conn[id]
+		n.mutex.RUnlock()
+
+		// The peer was removed or re-added under a different address, or
+		// someone ran connect manually while we were waiting.
+		if !known || current != address || connected {
+			return
+		}
+
+		conn, err := n.dial(id, address)
+		if err != nil {
+			n.peerLogger(id, "").Warn("reconnect failed", "attempt", attempt+1, "err", err)
+			continue
+		}
+
+		n.mutex.Lock()
+		n.conn[id] = conn
+		n.mutex.Unlock()
+		go n.watchConnection(id, conn)
+		go n.announceWatches(id)
+		go n.announceIndexes(id)
+		go n.announceDraining(id)
+		go n.announceACL(id)
+		go n.announceClusterConfig(id)
+		go n.announceLocks(id)
+		go n.announceBans(id)
+
+		n.peerLogger(id, "").Info("reconnected")
+		return
+	}
+}
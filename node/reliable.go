@@ -0,0 +1,152 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAckTimeout = time.Second * 2
+	defaultRetryLimit = 5
+)
+
+// pendingMessage is a reliable message waiting to be acknowledged.
+type pendingMessage struct {
+	target   int
+	msg      Message
+	attempts int
+	sentAt   time.Time
+}
+
+// Retransmitter gives messages at-least-once delivery. Every reliable
+// message carries a per-peer sequence number and is resent until the peer
+// acknowledges that number or the retry limit is reached.
+type Retransmitter struct {
+	nextSeq map[int]uint64
+	pending map[int]map[uint64]*pendingMessage
+	mutex   sync.Mutex
+}
+
+func NewRetransmitter() *Retransmitter {
+	return &Retransmitter{
+		nextSeq: make(map[int]uint64),
+		pending: make(map[int]map[uint64]*pendingMessage),
+	}
+}
+
+// track assigns the next sequence number for target to msg and queues it
+// for retransmission.
+func (r *Retransmitter) track(target int, msg Message) Message {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextSeq[target]++
+	msg.Seq = r.nextSeq[target]
+
+	if r.pending[target] == nil {
+		r.pending[target] = make(map[uint64]*pendingMessage)
+	}
+	r.pending[target][msg.Seq] = &pendingMessage{
+		target:   target,
+		msg:      msg,
+		attempts: 1,
+		sentAt:   time.Now(),
+	}
+	return msg
+}
+
+// ack stops retrying message seq to peer from, once it has been
+// acknowledged or is abandoned.
+func (r *Retransmitter) ack(from int, seq uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.pending[from], seq)
+}
+
+// due returns messages whose ack is overdue and are still within the retry
+// limit, bumping their attempt count, and removes and returns the ones that
+// have exhausted it.
+func (r *Retransmitter) due(timeout time.Duration, limit int) (retry, expired []pendingMessage) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for _, byPeer := range r.pending {
+		for seq, p := range byPeer {
+			if now.Sub(p.sentAt) < timeout {
+				continue
+			}
+			if p.attempts > limit {
+				expired = append(expired, *p)
+				delete(byPeer, seq)
+				continue
+			}
+			p.attempts++
+			p.sentAt = now
+			retry = append(retry, *p)
+		}
+	}
+	return retry, expired
+}
+
+// Pending returns how many messages are awaiting an ack.
+func (r *Retransmitter) Pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	count := 0
+	for _, byPeer := range r.pending {
+		count += len(byPeer)
+	}
+	return count
+}
+
+// sendReliable sends msg to targetID with at-least-once delivery, waiting
+// up to wait for room in the peer's queue. It returns the sent message,
+// carrying its sequence number, and the error of the first attempt; the
+// message is retried even if that failed, unless the caller forgets it.
+func (n *Node) sendReliable(targetID int, msg Message, wait time.Duration) (Message, error) {
+	msg = n.retransmit.track(targetID, msg)
+	return msg, n.send(targetID, msg, wait)
+}
+
+// runRetransmitter resends unacknowledged messages and gives up on them
+// after the configured number of retries.
+func (n *Node) runRetransmitter() {
+	ticker := time.NewTicker(n.config.AckTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		retry, expired := n.retransmit.due(n.config.AckTimeout, n.config.RetryLimit)
+		for _, p := range retry {
+			n.peerLogger(p.target, p.msg.Type).Debug("retransmitting", "seq", p.msg.Seq, "attempt", p.attempts)
+			n.sendMessage(p.target, p.msg)
+		}
+		for _, p := range expired {
+			n.peerLogger(p.target, p.msg.Type).Warn("giving up on message", "seq", p.msg.Seq, "attempts", p.attempts)
+			if p.msg.Type == "task" {
+				reason := fmt.Sprintf("delivery failed after %d attempts", p.attempts)
+				if n.completeTask(p.msg.TaskID, p.target, reason, true) {
+					// Report it like a failed result from the target
+					n.notify(Message{Type: "result", From: p.target, TaskID: p.msg.TaskID, Error: reason})
+				}
+			}
+		}
+	}
+}
+
+// acknowledge confirms receipt of a reliable message.
+func (n *Node) acknowledge(msg Message) {
+	n.sendMessage(msg.From, Message{
+		Type: "ack",
+		From: n.ID,
+		Seq:  msg.Seq,
+	})
+}
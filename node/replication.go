@@ -0,0 +1,256 @@
+package node
+
+import (
+	"fmt"
+	"time"
+)
+
+const replicationTimeout = time.Second * 2
+
+// Replicas returns up to count distinct nodes responsible for key, walking
+// clockwise from the key's position. The first is the key's owner.
+func (r *Ring) Replicas(key string, count int) []int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.points) == 0 {
+		return nil
+	}
+	if count > len(r.nodes) {
+		count = len(r.nodes)
+	}
+
+	replicas := make([]int, 0, count)
+	seen := make(map[int]bool)
+	start := r.search(hashKey(placement(key)))
+	for i := 0; len(replicas) < count && i < len(r.points); i++ {
+		id := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[id] {
+			seen[id] = true
+			replicas = append(replicas, id)
+		}
+	}
+	return replicas
+}
+
+// available reports whether id can currently take requests: it is this node,
+// or a connected peer the failure detector has not declared dead and whose
+// circuit breaker is not open.
+func (n *Node) available(id int) bool {
+	if id == n.ID {
+		return true
+	}
+
+	n.mutex.RLock()
+	_, connected := n.conn[id]
+	n.mutex.RUnlock()
+
+	return connected && n.detector.Status()[id].Status != PeerDead && !n.breakers.open(id)
+}
+
+// coordinator returns the first available replica of key, which serves reads
+// and coordinates writes for it. It returns -1 if no replica is reachable.
+func (n *Node) coordinator(key string) int {
+	for _, id := range n.replicas(key) {
+		if n.available(id) {
+			return id
+		}
+	}
+	return -1
+}
+
+// serveKV handles a get/set/del this node coordinates. Gets are served at
+// the consistency level they ask for (see consistentRead). Writes are applied
+// locally, then replicated synchronously: the reply is only a success once a
+// majority of the key's replicas have acknowledged it. Observers are sent
+// the write without waiting for them.
+func (n *Node) serveKV(msg Message) (reply Message) {
+	span := n.startSpan("kv."+msg.Type, msg)
+	defer func() {
+		reply = span.stamp(reply)
+		span.end("key", msg.Key, "error", reply.Error)
+	}()
+
+	n.touchKey(msg.Key)
+	if reason := n.refuseKV(msg); reason != "" {
+		return Message{Type: "kv_result", From: n.ID, Key: msg.Key, RequestID: msg.RequestID, Error: reason}
+	}
+	if owner := n.txLocks.owner(msg.Key); owner != "" && owner != msg.Tx && msg.Type != "get" {
+		return Message{Type: "kv_result", From: n.ID, Key: msg.Key, RequestID: msg.RequestID,
+			Error: fmt.Sprintf("key %s is locked by transaction %s", msg.Key, owner)}
+	}
+	if n.linearizes(msg) {
+		return n.linearKV(msg)
+	}
+	if msg.Type == "get" && msg.Consistency != "" && msg.Consistency != ConsistencyOne {
+		return n.consistentRead(span, msg)
+	}
+	reply = n.handleKV(msg)
+	if msg.Type == "get" || reply.Error != "" {
+		return reply
+	}
+	n.replicateToObservers(span, msg, reply)
+
+	var peers []int
+	replicas := n.replicas(msg.Key)
+	for _, id := range replicas {
+		if id != n.ID {
+			peers = append(peers, id)
+		}
+	}
+	if len(peers) == 0 {
+		return reply
+	}
+
+	requestID := newTaskID()
+	acks := n.expect(requestID, len(peers))
+	defer n.cancelExpect(requestID)
+
+	// The coordinator's own write counts towards the quorum, and so does a
+	// hint a fallback holds for a replica that is down
+	quorum := (len(peers)+1)/2 + 1
+	acked := 1
+	expected := 1
+	for _, id := range peers {
+		write := replicateMessage(msg.Key, writtenEntry(msg, reply))
+		write.From = n.ID
+		write.RequestID = requestID
+		if !n.available(id) {
+			if n.handOff(span, id, write, replicas) {
+				expected++
+			}
+			continue
+		}
+		n.sendMessage(id, span.stamp(write))
+		expected++
+	}
+	if expected < quorum {
+		reply.Error = fmt.Sprintf("replication quorum not reached: %d/%d replicas reachable", expected, quorum)
+		return reply
+	}
+
+	timeout := time.After(replicationTimeout)
+	for acked < quorum {
+		select {
+		case <-acks:
+			acked++
+		case <-timeout:
+			reply.Error = fmt.Sprintf("replication quorum not reached: %d/%d acks", acked, quorum)
+			return reply
+		}
+	}
+	return reply
+}
+
+// replicateToObservers sends a write this node coordinated to every
+// observer. Observers do not count towards the quorum, so their acks are
+// not waited for.
+func (n *Node) replicateToObservers(span *span, msg, reply Message) {
+	for _, id := range n.observers() {
+		write := replicateMessage(msg.Key, writtenEntry(msg, reply))
+		write.From = n.ID
+		n.sendMessage(id, span.stamp(write))
+	}
+}
+
+// writtenEntry returns the entry a set, del or update this node coordinated
+// wrote, from the request and its reply.
+func writtenEntry(msg, reply Message) Entry {
+	value := msg.Value
+	if msg.Type == "update" {
+		value = reply.Value
+	}
+	e := Entry{Value: value, Deleted: msg.Type == "del", Expires: reply.Expires, Version: reply.Context, Siblings: reply.Siblings}
+	if reply.Timestamp != nil {
+		e.Timestamp = *reply.Timestamp
+	}
+	return e
+}
+
+// replicateMessage returns the replicate message that writes e under key on
+// another node, with its version and siblings if it has any.
+func replicateMessage(key string, e Entry) Message {
+	op := "set"
+	if e.Deleted {
+		op = "del"
+	}
+	ts := e.Timestamp
+	return Message{
+		Type:      "replicate",
+		Content:   op,
+		Key:       key,
+		Value:     e.Value,
+		Timestamp: &ts,
+		Expires:   e.Expires,
+		Context:   e.Version,
+		Siblings:  e.Siblings,
+	}
+}
+
+// handleReplicate applies a write from the key's coordinator. The write
+// keeps the coordinator's timestamp, so a replica that already holds a newer
+// write for the key ignores it but still acknowledges.
+func (n *Node) handleReplicate(msg Message) {
+	if msg.Content != "set" && msg.Content != "del" {
+		return
+	}
+	span := n.startSpan("kv.replicate", msg)
+	defer span.end("key", msg.Key, "coordinator", msg.From)
+
+	var err error
+	switch {
+	case msg.Timestamp != nil:
+		_, err = n.store.Merge(msg.Key, hintEntry(msg))
+	case msg.Content == "set":
+		_, err = n.store.Set(msg.Key, msg.Value)
+	default:
+		_, _, err = n.store.Delete(msg.Key)
+	}
+	if err != nil {
+		// Unacknowledged, the write does not count towards the quorum
+		n.peerLogger(msg.From, "replicate").Error("failed to store replicated write", "key", msg.Key, "err", err)
+		return
+	}
+
+	n.sendMessage(msg.From, span.stamp(Message{
+		Type:      "replicate_ack",
+		From:      n.ID,
+		Key:       msg.Key,
+		RequestID: msg.RequestID,
+	}))
+}
+
+// expect registers interest in replies carrying requestID. Up to buffer
+// replies are queued on the returned channel.
+func (n *Node) expect(requestID string, buffer int) chan Message {
+	ch := make(chan Message, buffer)
+
+	n.waitMutex.Lock()
+	n.waiters[requestID] = ch
+	n.waitMutex.Unlock()
+
+	return ch
+}
+
+func (n *Node) cancelExpect(requestID string) {
+	n.waitMutex.Lock()
+	delete(n.waiters, requestID)
+	n.waitMutex.Unlock()
+}
+
+// deliver hands msg to whoever is waiting for its RequestID. It reports false
+// if nobody is; replies beyond the waiter's buffer are dropped.
+func (n *Node) deliver(msg Message) bool {
+	n.waitMutex.Lock()
+	ch, ok := n.waiters[msg.RequestID]
+	n.waitMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package node_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/client"
+)
+
+func TestReplicationCopiesEveryKey(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+	writer := connect(t, c, 1)
+
+	const keys = 20
+	for i := range keys {
+		if err := writer.Set(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("set key-%d: %v", i, err)
+		}
+	}
+
+	err := c.Until(ctx, func() bool {
+		for id := 1; id <= c.Size(); id++ {
+			if c.Node(id).Status().Keys != keys {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		for id := 1; id <= c.Size(); id++ {
+			t.Logf("node %d holds %d keys", id, c.Node(id).Status().Keys)
+		}
+		t.Fatalf("keys not replicated to every node: %v", err)
+	}
+
+	for id := 1; id <= c.Size(); id++ {
+		reader := connect(t, c, id)
+		for i := range keys {
+			key := fmt.Sprintf("key-%d", i)
+			value, found, err := reader.GetConsistency(ctx, key, client.All)
+			if err != nil || !found || value != fmt.Sprintf("value-%d", i) {
+				t.Errorf("node %d: get %s = %q, %v, %v", id, key, value, found, err)
+			}
+		}
+	}
+}
+
+func TestOverwriteReachesEveryReplica(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+
+	if err := connect(t, c, 1).Set(ctx, "color", "red"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(t, c, 2).Set(ctx, "color", "blue"); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= c.Size(); id++ {
+		value, found, err := connect(t, c, id).GetConsistency(ctx, "color", client.All)
+		if err != nil || !found || value != "blue" {
+			t.Errorf("node %d: get color = %q, %v, %v; want blue", id, value, found, err)
+		}
+	}
+}
+
+func TestDeleteRemovesKeyFromEveryReplica(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+	cl := connect(t, c, 1)
+
+	if err := cl.Set(ctx, "doomed", "x"); err != nil {
+		t.Fatal(err)
+	}
+	found, err := cl.Del(ctx, "doomed")
+	if err != nil || !found {
+		t.Fatalf("del doomed = %v, %v; want true", found, err)
+	}
+
+	for id := 1; id <= c.Size(); id++ {
+		value, found, err := connect(t, c, id).GetConsistency(ctx, "doomed", client.All)
+		if err != nil || found {
+			t.Errorf("node %d: get doomed = %q, %v, %v after delete", id, value, found, err)
+		}
+	}
+
+	found, err = cl.Del(ctx, "doomed")
+	if err != nil || found {
+		t.Errorf("second del doomed = %v, %v; want false", found, err)
+	}
+	found, err = cl.Del(ctx, "never-written")
+	if err != nil || found {
+		t.Errorf("del never-written = %v, %v; want false", found, err)
+	}
+}
+
+func TestSetAfterDeleteRevivesKey(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+	cl := connect(t, c, 2)
+
+	if err := cl.Set(ctx, "phoenix", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Del(ctx, "phoenix"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Set(ctx, "phoenix", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, found, err := connect(t, c, 3).GetConsistency(ctx, "phoenix", client.All)
+	if err != nil || !found || value != "2" {
+		t.Errorf("get phoenix = %q, %v, %v; want 2", value, found, err)
+	}
+}
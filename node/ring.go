@@ -0,0 +1,264 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// virtualNodes is how many points each node gets on the ring. More points
+// spread keys more evenly between nodes.
+const virtualNodes = 64
+
+// Ring is a consistent hash ring mapping keys to the node that owns them.
+type Ring struct {
+	points []uint32
+	owners map[uint32]int
+	nodes  map[int]bool
+	mutex  sync.RWMutex
+}
+
+func NewRing() *Ring {
+	return &Ring{
+		owners: make(map[uint32]int),
+		nodes:  make(map[int]bool),
+	}
+}
+
+// hashKey maps a key onto the ring. FNV alone clusters short, similar keys
+// ("a", "b", ...), so its output is run through a finalizer to spread it.
+func hashKey(key string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+// Add places a node on the ring. Adding a node twice is a no-op.
+func (r *Ring) Add(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.nodes[id] {
+		return
+	}
+	r.nodes[id] = true
+	for i := 0; i < virtualNodes; i++ {
+		point := hashKey(fmt.Sprintf("node-%d#%d", id, i))
+		r.owners[point] = id
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) Remove(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.nodes[id] {
+		return
+	}
+	delete(r.nodes, id)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == id {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Owner returns the node owning key: the first point clockwise from the
+// key's hash. It returns -1 if the ring is empty.
+func (r *Ring) Owner(key string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.points) == 0 {
+		return -1
+	}
+	return r.owners[r.points[r.search(hashKey(placement(key)))]]
+}
+
+// search returns the index of the first point at or after hash, wrapping
+// around the ring. The caller must hold r.mutex.
+func (r *Ring) search(hash uint32) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Nodes returns the ids of all nodes on the ring in ascending order.
+func (r *Ring) Nodes() []int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ids := make([]int, 0, len(r.nodes))
+	for id := range r.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Shares returns the fraction of the hash space owned by each node.
+func (r *Ring) Shares() map[int]float64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	shares := make(map[int]float64)
+	if len(r.points) == 0 {
+		return shares
+	}
+	for i, point := range r.points {
+		prev := r.points[(i+len(r.points)-1)%len(r.points)]
+		// uint32 subtraction wraps, which is exactly the arc length
+		shares[r.owners[point]] += float64(point-prev) / (1 << 32)
+	}
+	return shares
+}
+
+// forward is a KV request this node proxied to the key's owner, waiting for
+// the reply to relay back.
+type forward struct {
+	origin    int
+	requestID string
+	span      *span
+}
+
+// kvTarget returns the node that serves msg: the key's coordinator, or this
+// node if it is the coordinator, no replica is reachable, or it is an
+// observer answering a read at consistency one from its own copy. In
+// linearizable mode, gets, sets and dels are served by the leader instead.
+func (n *Node) kvTarget(msg Message) int {
+	if n.linearizes(msg) {
+		if _, _, leader := n.electionStatus(); leader >= 0 {
+			return leader
+		}
+		return n.ID
+	}
+	if n.config.Role == RoleObserver && msg.Type == "get" && (msg.Consistency == "" || msg.Consistency == ConsistencyOne) {
+		return n.ID
+	}
+	if coordinator := n.coordinator(msg.Key); coordinator >= 0 {
+		return coordinator
+	}
+	return n.ID
+}
+
+// routeKV sends a get/set/del for msg.Key to the node coordinating the key.
+// It reports false if this node should serve it locally (see kvTarget).
+func (n *Node) routeKV(msg Message) bool {
+	target := n.kvTarget(msg)
+	if target == n.ID {
+		return false
+	}
+
+	n.touchKey(msg.Key)
+	n.sendMessage(target, msg)
+	return true
+}
+
+// kvCall serves a get, set or del for msg.Key on the key's coordinator and
+// waits for its reply, for requests the node makes on its own behalf.
+func (n *Node) kvCall(msg Message) (Message, error) {
+	msg.From = n.ID
+	msg.Forwarded = true
+	target := n.kvTarget(msg)
+	if target == n.ID {
+		reply := n.serveKV(msg)
+		if reply.Error != "" {
+			return reply, errors.New(reply.Error)
+		}
+		return reply, nil
+	}
+	return n.Call(target, msg, clientTimeout)
+}
+
+// KV serves a get, set or del for msg.Key. If another node coordinates the
+// key, the request is forwarded to it and KV returns that node's id without
+// a reply; the reply is delivered to the OnMessage handlers as a kv_result.
+// Otherwise KV serves the request and returns the reply and this node's id.
+func (n *Node) KV(msg Message) (Message, int) {
+	msg.From = n.ID
+	if msg.TraceID == "" {
+		msg.TraceID = newTraceID()
+	}
+	target := n.kvTarget(msg)
+	if target == n.ID {
+		return n.serveKV(msg), n.ID
+	}
+	n.touchKey(msg.Key)
+	n.sendMessage(target, msg)
+	return Message{}, target
+}
+
+// handleKVRequest serves a get/set/del from a peer, proxying it to the key's
+// coordinator if that is another node. Forwarded requests are always served
+// locally so nodes with different ring views cannot bounce them forever.
+func (n *Node) handleKVRequest(msg Message) {
+	// Serving may block waiting for replica acks, which must not stall the
+	// connection's read loop
+	serve := func() {
+		n.sendMessage(msg.From, n.serveKV(msg))
+	}
+
+	if msg.Forwarded {
+		go serve()
+		return
+	}
+
+	requestID := newTaskID()
+	span := n.startSpan("kv.forward", msg)
+	proxied := span.stamp(msg)
+	proxied.From = n.ID
+	proxied.RequestID = requestID
+	proxied.Forwarded = true
+
+	n.forwardMutex.Lock()
+	n.forwards[requestID] = forward{origin: msg.From, requestID: msg.RequestID, span: span}
+	n.forwardMutex.Unlock()
+
+	if !n.routeKV(proxied) {
+		n.forwardMutex.Lock()
+		delete(n.forwards, requestID)
+		n.forwardMutex.Unlock()
+
+		go serve()
+	}
+}
+
+func (n *Node) handleKVResult(msg Message) {
+	n.forwardMutex.Lock()
+	fwd, ok := n.forwards[msg.RequestID]
+	delete(n.forwards, msg.RequestID)
+	n.forwardMutex.Unlock()
+
+	if !ok {
+		if !n.deliver(msg) {
+			n.notify(msg)
+		}
+		return
+	}
+
+	fwd.span.end("key", msg.Key, "coordinator", msg.From, "error", msg.Error)
+	msg.From = n.ID
+	msg.RequestID = fwd.requestID
+	n.sendMessage(fwd.origin, msg)
+}
+
+// Ring returns the node's view of the hash ring.
+func (n *Node) Ring() *Ring {
+	return n.ring
+}
@@ -0,0 +1,140 @@
+package node
+
+import "fmt"
+
+// Node roles. Every node announces its role in its hello, so peers know
+// what to expect of it before sending it anything else.
+const (
+	// RoleMember is a full member: it owns keys on the ring, runs tasks and
+	// votes in and stands for leader elections.
+	RoleMember = "member"
+	// RoleObserver receives every write but owns no keys: it answers reads
+	// from its own copy and forwards writes to their coordinators. It does
+	// not vote, so observers can be added without slowing elections.
+	RoleObserver = "observer"
+	// RoleArbiter votes in elections, breaking ties between members, but
+	// holds no data, runs no scheduled tasks and never leads.
+	RoleArbiter = "arbiter"
+	// RoleClient holds no data and takes no part in elections; it only
+	// routes requests into the cluster.
+	RoleClient = "client"
+)
+
+// validRole reports whether role is one of the node roles.
+func validRole(role string) bool {
+	switch role {
+	case RoleMember, RoleObserver, RoleArbiter, RoleClient:
+		return true
+	}
+	return false
+}
+
+// ownsKeys reports whether nodes of role are on the ring, coordinating the
+// writes to their keys and taking scheduled tasks.
+func ownsKeys(role string) bool {
+	return role == RoleMember
+}
+
+// holdsData reports whether nodes of role keep a copy of the keys.
+func holdsData(role string) bool {
+	return role == RoleMember || role == RoleObserver
+}
+
+// votes reports whether nodes of role count towards election and lease
+// majorities.
+func votes(role string) bool {
+	return role == RoleMember || role == RoleArbiter
+}
+
+// Role returns the role this node was configured with.
+func (n *Node) Role() string {
+	return n.config.Role
+}
+
+// roleOf returns the role of peer id, assuming a member until its hello is
+// seen. The caller must hold n.mutex.
+func (n *Node) roleOf(id int) string {
+	if id == n.ID {
+		return n.config.Role
+	}
+	if info, ok := n.peerInfo[id]; ok {
+		return info.role
+	}
+	return RoleMember
+}
+
+// PeerRole returns the role of peer id.
+func (n *Node) PeerRole(id int) string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.roleOf(id)
+}
+
+// joinRing puts peer id on the ring if its role owns keys and it is not
+// draining.
+func (n *Node) joinRing(id int) {
+	if ownsKeys(n.PeerRole(id)) && !n.peerDraining(id) {
+		n.ring.Add(id)
+	}
+}
+
+// voters returns how many known nodes, this one included if it votes, make
+// up the electorate. The caller must hold n.mutex.
+func (n *Node) voters() int {
+	count := 0
+	if votes(n.config.Role) {
+		count++
+	}
+	for id := range n.Peers {
+		if votes(n.roleOf(id)) {
+			count++
+		}
+	}
+	return count
+}
+
+// observers returns the connected peers that are observers.
+func (n *Node) observers() []int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	var ids []int
+	for id := range n.conn {
+		if n.roleOf(id) == RoleObserver {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// replicates reports whether node id keeps a copy of key: observers keep
+// every key, members the keys they are replicas of.
+func (n *Node) replicates(id int, key string) bool {
+	switch n.PeerRole(id) {
+	case RoleObserver:
+		return true
+	case RoleMember:
+		for _, replica := range n.replicas(key) {
+			if replica == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refuseKV returns the error for a KV request this node cannot serve
+// because of its role, or "" if it can: observers only serve reads, and
+// arbiters and clients hold no data at all.
+func (n *Node) refuseKV(msg Message) string {
+	switch {
+	case ownsKeys(n.config.Role):
+		return ""
+	case holdsData(n.config.Role) && msg.Type == "get":
+		return ""
+	case holdsData(n.config.Role):
+		return fmt.Sprintf("node %d (%s) does not serve writes", n.ID, n.config.Role)
+	}
+	return fmt.Sprintf("node %d (%s) holds no data", n.ID, n.config.Role)
+}
@@ -0,0 +1,249 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A range scan returns the keys from a start key up to an end key, in order,
+// with their values. Stores keep their keys ordered (see orderedKeys), so
+// each node reads just the range. The node running the scan asks every
+// node on the ring for a page of the entries it holds in the range,
+// tombstones included, and merges the pages keeping the newest entry of each
+// key. A node that had more keys than fit in its page sent the merge
+// everything up to the last key of its page, but nothing past it, so only
+// keys up to the smallest such key are final. The scan takes those, then
+// asks every node for its next page from just past that key, until it has
+// the rows asked for or no node has keys left in the range.
+
+const (
+	// scanPageSize is the most entries a node sends in one page.
+	scanPageSize = 1000
+	// scanTimeout bounds how long a scan waits for each node's page.
+	scanTimeout = 5 * time.Second
+	// defaultScanLimit is how many keys a scan returns unless asked for
+	// another number.
+	defaultScanLimit = 100
+)
+
+// ScanResult is the outcome of a range scan.
+type ScanResult struct {
+	// Rows are the live keys in the range and their values, in key order.
+	Rows []QueryRow `json:"rows"`
+	// More is set if the limit cut the scan short. It continues from just
+	// after the last row's key, its key followed by a zero byte.
+	More bool `json:"more,omitempty"`
+	// Missing lists the nodes that did not answer. Their keys are only in
+	// the result if another replica holds them.
+	Missing []int `json:"missing,omitempty"`
+}
+
+// scanRequest is the content of a scan message.
+type scanRequest struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+	Limit int    `json:"limit"`
+}
+
+// scanPage is the content of a node's reply to a scan, whose entries are in
+// the reply's Entries. More is set if the node holds keys in the range past
+// them.
+type scanPage struct {
+	More bool `json:"more,omitempty"`
+}
+
+// Scan returns the live keys from start up to but not including end, or to
+// the last key if end is "", in key order with their values, at most limit
+// of them, or all if limit is 0. Nodes that do not answer within
+// scanTimeout are listed in the result's Missing rather than failing the
+// scan.
+func (n *Node) Scan(start, end string, limit int) (ScanResult, error) {
+	if end != "" && end <= start {
+		return ScanResult{}, fmt.Errorf("end %q must come after start %q", end, start)
+	}
+	if limit < 0 {
+		return ScanResult{}, errors.New("limit must not be negative")
+	}
+
+	result := ScanResult{Rows: []QueryRow{}}
+	missing := make(map[int]bool)
+	page := scanPageSize
+	if limit > 0 {
+		page = min(page, limit)
+	}
+	now := time.Now()
+	for {
+		merged, bound, bounded := n.scanPages(scanRequest{Start: start, End: end, Limit: page}, missing)
+		keys := slices.Sorted(maps.Keys(merged))
+		for i, key := range keys {
+			if bounded && key > bound {
+				break
+			}
+			e := merged[key]
+			if e.Deleted || e.Expired(now) {
+				continue
+			}
+			result.Rows = append(result.Rows, QueryRow{Key: key, Value: e.Value})
+			if len(result.Rows) == limit {
+				result.More = bounded || i < len(keys)-1
+				result.Missing = slices.Sorted(maps.Keys(missing))
+				return result, nil
+			}
+		}
+		if !bounded {
+			break
+		}
+		start = bound + "\x00"
+	}
+	result.Missing = slices.Sorted(maps.Keys(missing))
+	return result, nil
+}
+
+// ScanNamespace is Scan over the keys of namespace, "" for the default one,
+// naming them within it.
+func (n *Node) ScanNamespace(namespace, start, end string, limit int) (ScanResult, error) {
+	if namespace == "" {
+		return n.Scan(start, end, limit)
+	}
+	if end != "" && end <= start {
+		return ScanResult{}, fmt.Errorf("end %q must come after start %q", end, start)
+	}
+	stored := namespaceEnd(namespace)
+	if end != "" {
+		stored = NamespacedKey(namespace, end)
+	}
+	result, err := n.Scan(NamespacedKey(namespace, start), stored, limit)
+	for i, row := range result.Rows {
+		_, result.Rows[i].Key = splitNamespace(row.Key)
+	}
+	return result, err
+}
+
+// scanPages asks every node on the ring for its page of req, and returns
+// the pages merged. If a node has keys past its page, the merge is only
+// complete up to bound, the smallest last key of such a page, and bounded
+// is set. Nodes that do not answer are added to missing.
+func (n *Node) scanPages(req scanRequest, missing map[int]bool) (merged map[string]Entry, bound string, bounded bool) {
+	var (
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+	)
+	merged = make(map[string]Entry)
+	merge := func(entries map[string]Entry, more bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		last := ""
+		for key, e := range entries {
+			last = max(last, key)
+			if old, ok := merged[key]; !ok || old.Timestamp.Less(e.Timestamp) {
+				merged[key] = e
+			}
+		}
+		if more && (!bounded || last < bound) {
+			bound, bounded = last, true
+		}
+	}
+
+	content, err := json.Marshal(req)
+	if err != nil {
+		n.logger.Error("failed to encode scan", "err", err)
+		return merged, "", false
+	}
+	for _, id := range n.ring.Nodes() {
+		if id == n.ID {
+			merge(n.scanLocal(req))
+			continue
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var reply Message
+			var err error
+			if !n.PeerSupports(id, CapScan) {
+				err = errors.New("peer does not support scans")
+			} else {
+				reply, err = n.Call(id, Message{Type: "scan", Content: string(content)}, scanTimeout)
+			}
+			var page scanPage
+			if err == nil {
+				err = json.Unmarshal([]byte(reply.Content), &page)
+			}
+			if err != nil {
+				n.peerLogger(id, "scan").Warn("node left out of scan", "err", err)
+				mutex.Lock()
+				missing[id] = true
+				mutex.Unlock()
+				return
+			}
+			merge(reply.Entries, page.More)
+		}(id)
+	}
+	wg.Wait()
+	return merged, bound, bounded
+}
+
+// scanLocal returns this node's page of req, tombstones included so the
+// merge can tell deleted keys from missing ones, and whether it holds keys
+// in the range past it. Index entries and the keys of namespaces other than
+// the default one are left out unless the range starts among them.
+func (n *Node) scanLocal(req scanRequest) (map[string]Entry, bool) {
+	indexes := strings.HasPrefix(req.Start, indexKeyPrefix)
+	namespaces := strings.HasPrefix(req.Start, namespaceKeyPrefix)
+	return n.store.Scan(req.Start, req.End, req.Limit, func(key string) bool {
+		return (indexes || !strings.HasPrefix(key, indexKeyPrefix)) &&
+			(namespaces || !strings.HasPrefix(key, namespaceKeyPrefix))
+	})
+}
+
+// handleScan returns this node's page of a scan to the node running it.
+func (n *Node) handleScan(msg Message) {
+	var req scanRequest
+	if err := json.Unmarshal([]byte(msg.Content), &req); err != nil {
+		n.Reply(msg, Message{Type: "scan_result", Error: "malformed scan: " + err.Error()})
+		return
+	}
+	if req.Limit < 1 || req.Limit > scanPageSize {
+		req.Limit = scanPageSize
+	}
+	entries, more := n.scanLocal(req)
+	content, _ := json.Marshal(scanPage{More: more})
+	n.Reply(msg, Message{Type: "scan_result", Entries: entries, Content: string(content)})
+}
+
+// handleScanRequest serves GET /scan?start=&end=&limit=&namespace=.
+func (n *Node) handleScanRequest(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	namespace, err := ParseNamespace(params.Get("namespace"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, key := range []string{params.Get("start"), params.Get("end")} {
+		if err := checkRequestKey(key); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	limit := defaultScanLimit
+	if s := params.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a number, 0 for no limit")
+			return
+		}
+	}
+	result, err := n.ScanNamespace(namespace, params.Get("start"), params.Get("end"), limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"errors"
+	"math"
+)
+
+var errNoWorkers = errors.New("no live workers to schedule on")
+
+// Submit sends a task to the least-loaded live peer and returns the task id
+// and the chosen node. Load comes from the stats peers piggyback on their
+// heartbeats; the leader hears from every node, so it schedules with a
+// complete view.
+func (n *Node) Submit(taskType, content string) (string, int, error) {
+	target, ok := n.leastLoaded()
+	if !ok {
+		return "", -1, errNoWorkers
+	}
+	id, err := n.SendTask(target, taskType, content)
+	return id, target, err
+}
+
+// leastLoaded picks the live member with the lowest queue utilisation;
+// observers, arbiters, clients and draining members are never scheduled on.
+// Tasks this node sent since the peer's last report count towards its
+// queue, so a burst of submissions is spread out instead of all going to the
+// node that looked idle at the last heartbeat. A peer's round-trip time adds
+// to its score (see rttWeight), so equally busy workers nearby are
+// preferred.
+func (n *Node) leastLoaded() (int, bool) {
+	pending := n.tracker.PendingByTarget()
+
+	best, bestScore := -1, math.Inf(1)
+	for id, h := range n.detector.Status() {
+		if h.Status != PeerAlive || !n.available(id) || !ownsKeys(n.PeerRole(id)) || n.peerDraining(id) {
+			continue
+		}
+
+		score := float64(pending[id])
+		if load, ok := n.loads.Get(id); ok && load.QueueCapacity > 0 {
+			score = float64(load.QueueDepth+pending[id]) / float64(load.QueueCapacity)
+		}
+		if rtt, ok := n.latencies.Get(id); ok {
+			score += rtt.Seconds() * rttWeight
+		}
+		if score < bestScore || (score == bestScore && id < best) {
+			best, bestScore = id, score
+		}
+	}
+	return best, best >= 0
+}
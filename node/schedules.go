@@ -0,0 +1,407 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduled tasks are run by the master. Every node keeps a copy of the
+// schedules, and of when each runs next, so whichever node leads after a
+// failover takes them over: the leader sends its copy to every peer when it
+// changes and every scheduleSyncInterval. Schedules added on another node
+// are forwarded to the leader. A node with a data directory saves its copy
+// to schedules.json, so schedules survive restarts.
+//
+// A schedule fires at least once per due time: a new leader whose copy
+// predates its predecessor's last run runs that task again.
+
+const (
+	// scheduleInterval is how often the leader looks for due schedules.
+	scheduleInterval = time.Second
+	// scheduleSyncInterval is how often the leader sends its schedules to
+	// every peer even if they did not change, for nodes that joined since.
+	scheduleSyncInterval = 10 * time.Second
+	// scheduleTimeout bounds a schedule change forwarded to the leader.
+	scheduleTimeout = 2 * time.Second
+
+	schedulesFile = "schedules.json"
+)
+
+// AnyNode as a schedule's target runs the task on the least loaded node
+// (see Submit).
+const AnyNode = -1
+
+// Schedule is a task the master sends at a given time: once, at every
+// interval Every, or whenever Cron matches.
+type Schedule struct {
+	ID       string        `json:"id"`
+	Target   int           `json:"target"`
+	TaskType string        `json:"task_type"`
+	Content  string        `json:"content,omitempty"`
+	Next     time.Time     `json:"next"`
+	Every    time.Duration `json:"every,omitempty"`
+	Cron     string        `json:"cron,omitempty"`
+	Runs     int           `json:"runs,omitempty"`
+}
+
+// advance moves s past now, returning false if it does not run again.
+func (s *Schedule) advance(now time.Time) bool {
+	switch {
+	case s.Every > 0:
+		for !s.Next.After(now) {
+			s.Next = s.Next.Add(s.Every)
+		}
+		return true
+	case s.Cron != "":
+		c, err := ParseCron(s.Cron)
+		if err != nil {
+			return false
+		}
+		s.Next = c.Next(now)
+		return !s.Next.IsZero()
+	}
+	return false
+}
+
+// Schedules is a node's copy of the cluster's schedules.
+type Schedules struct {
+	mutex   sync.Mutex
+	entries map[string]Schedule
+	term    int
+	path    string
+}
+
+func NewSchedules() *Schedules {
+	return &Schedules{entries: make(map[string]Schedule)}
+}
+
+// schedulesState is what is saved to schedules.json and sent to peers.
+type schedulesState struct {
+	Term      int        `json:"term"`
+	Schedules []Schedule `json:"schedules"`
+}
+
+// load reads the schedules saved in dir, if any, and saves them there from
+// now on.
+func (s *Schedules) load(dir string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.path = filepath.Join(dir, schedulesFile)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state schedulesState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parse %s: %v", s.path, err)
+	}
+	s.term = state.Term
+	for _, sched := range state.Schedules {
+		s.entries[sched.ID] = sched
+	}
+	return nil
+}
+
+// state returns the schedules sorted by when they run next. The caller must
+// hold s.mutex.
+func (s *Schedules) state() schedulesState {
+	state := schedulesState{Term: s.term, Schedules: make([]Schedule, 0, len(s.entries))}
+	for _, sched := range s.entries {
+		state.Schedules = append(state.Schedules, sched)
+	}
+	sort.Slice(state.Schedules, func(i, j int) bool {
+		return state.Schedules[i].Next.Before(state.Schedules[j].Next)
+	})
+	return state
+}
+
+// save writes the schedules to disk, if the node has a data directory. The
+// caller must hold s.mutex.
+func (s *Schedules) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// List returns the schedules sorted by when they run next.
+func (s *Schedules) List() []Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state().Schedules
+}
+
+// update applies fn to the schedules as the leader of term and saves them.
+func (s *Schedules) update(term int, fn func(map[string]Schedule)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fn(s.entries)
+	s.term = max(s.term, term)
+	return s.save()
+}
+
+// replace swaps the schedules for those of the leader of term, unless they
+// come from an older term than the last copy, and saves them.
+func (s *Schedules) replace(state schedulesState) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state.Term < s.term {
+		return false, nil
+	}
+	s.term = state.Term
+	s.entries = make(map[string]Schedule, len(state.Schedules))
+	for _, sched := range state.Schedules {
+		s.entries[sched.ID] = sched
+	}
+	return true, s.save()
+}
+
+// marshal returns the schedules encoded for a schedule_sync.
+func (s *Schedules) marshal() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, _ := json.Marshal(s.state())
+	return string(data)
+}
+
+// Schedules returns the cluster's schedules as this node knows them, sorted
+// by when they run next.
+func (n *Node) Schedules() []Schedule {
+	return n.schedules.List()
+}
+
+// AddSchedule schedules a task and returns the schedule as stored, with its
+// ID and next run filled in. A schedule with Every or Cron set recurs; one
+// with neither runs once at Next. If this node does not lead, the schedule
+// is forwarded to the leader.
+func (n *Node) AddSchedule(s Schedule) (Schedule, error) {
+	if s.TaskType == "" {
+		s.TaskType = DefaultTaskType
+	}
+	if s.Every < 0 {
+		return s, fmt.Errorf("invalid interval %v", s.Every)
+	}
+	if s.Cron != "" {
+		c, err := ParseCron(s.Cron)
+		if err != nil {
+			return s, err
+		}
+		s.Cron = c.String()
+		if s.Next.IsZero() {
+			if s.Next = c.Next(time.Now()); s.Next.IsZero() {
+				return s, fmt.Errorf("cron spec %q never matches", s.Cron)
+			}
+		}
+	}
+	if s.Next.IsZero() {
+		if s.Every == 0 {
+			return s, errors.New("a one-off schedule needs a time to run at")
+		}
+		s.Next = time.Now().Add(s.Every)
+	}
+	if s.ID == "" {
+		s.ID = newTaskID()[:8]
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	reply, err := n.scheduleRequest(Message{Type: "schedule_add", Content: string(data)})
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal([]byte(reply.Content), &s)
+}
+
+// RemoveSchedule cancels schedule id. If this node does not lead, the
+// request is forwarded to the leader.
+func (n *Node) RemoveSchedule(id string) error {
+	_, err := n.scheduleRequest(Message{Type: "schedule_del", Content: id})
+	return err
+}
+
+// scheduleRequest applies a schedule_add or schedule_del on this node if it
+// leads, or else on the leader.
+func (n *Node) scheduleRequest(msg Message) (Message, error) {
+	n.mutex.RLock()
+	leader, leading, term := n.election.leaderID, n.election.state == Leader, n.election.term
+	n.mutex.RUnlock()
+
+	if leading {
+		reply := n.applySchedule(msg, term)
+		if reply.Error != "" {
+			return reply, errors.New(reply.Error)
+		}
+		return reply, nil
+	}
+	if leader < 0 {
+		return Message{}, errors.New("no known leader to schedule with")
+	}
+	if !n.PeerSupports(leader, CapSchedule) {
+		return Message{}, fmt.Errorf("leader %d does not support schedules", leader)
+	}
+	return n.Call(leader, msg, scheduleTimeout)
+}
+
+// applySchedule applies a schedule change as the leader of term, shares
+// the result with the peers, and builds the reply.
+func (n *Node) applySchedule(msg Message, term int) Message {
+	reply := Message{Type: "schedule_result", Content: msg.Content}
+	var err error
+	switch msg.Type {
+	case "schedule_add":
+		var s Schedule
+		if err = json.Unmarshal([]byte(msg.Content), &s); err != nil {
+			reply.Error = fmt.Sprintf("invalid schedule: %v", err)
+			return reply
+		}
+		err = n.schedules.update(term, func(entries map[string]Schedule) {
+			entries[s.ID] = s
+		})
+	case "schedule_del":
+		found := false
+		err = n.schedules.update(term, func(entries map[string]Schedule) {
+			_, found = entries[msg.Content]
+			delete(entries, msg.Content)
+		})
+		if !found {
+			reply.Error = fmt.Sprintf("no schedule %s", msg.Content)
+			return reply
+		}
+	}
+	if err != nil {
+		n.logger.Error("failed to save schedules", "err", err)
+	}
+	n.syncSchedules()
+	return reply
+}
+
+// syncSchedules sends this node's schedules to every peer.
+func (n *Node) syncSchedules() {
+	n.sendToPeers(CapSchedule, Message{Type: "schedule_sync", From: n.ID, Content: n.schedules.marshal()})
+}
+
+// handleScheduleMessage serves a schedule change forwarded to this node as
+// the leader, or takes over the leader's schedules.
+func (n *Node) handleScheduleMessage(msg Message) {
+	switch msg.Type {
+	case "schedule_add", "schedule_del":
+		n.mutex.RLock()
+		leading, term := n.election.state == Leader, n.election.term
+		n.mutex.RUnlock()
+		if !leading {
+			n.Reply(msg, Message{Type: "schedule_result", Error: fmt.Sprintf("node %d is not the leader", n.ID)})
+			return
+		}
+		n.Reply(msg, n.applySchedule(msg, term))
+
+	case "schedule_sync":
+		var state schedulesState
+		if err := json.Unmarshal([]byte(msg.Content), &state); err != nil {
+			n.peerLogger(msg.From, msg.Type).Warn("invalid schedules", "err", err)
+			return
+		}
+		if _, err := n.schedules.replace(state); err != nil {
+			n.logger.Error("failed to save schedules", "err", err)
+		}
+	}
+}
+
+// runSchedules sends the tasks of due schedules while this node leads with
+// a lease, and shares its schedules with the peers every
+// scheduleSyncInterval.
+func (n *Node) runSchedules() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	lastSync := time.Now()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		if !n.HasLease() {
+			continue
+		}
+
+		n.mutex.RLock()
+		term := n.election.term
+		n.mutex.RUnlock()
+
+		now := time.Now()
+		var due []Schedule
+		for _, s := range n.schedules.List() {
+			if !s.Next.After(now) {
+				due = append(due, s)
+			}
+		}
+		for _, s := range due {
+			n.runSchedule(s)
+		}
+		if len(due) > 0 {
+			err := n.schedules.update(term, func(entries map[string]Schedule) {
+				for _, s := range due {
+					// Removed while it ran
+					if _, ok := entries[s.ID]; !ok {
+						continue
+					}
+					s.Runs++
+					if s.advance(now) {
+						entries[s.ID] = s
+					} else {
+						delete(entries, s.ID)
+					}
+				}
+			})
+			if err != nil {
+				n.logger.Error("failed to save schedules", "err", err)
+			}
+		}
+		if len(due) > 0 || time.Since(lastSync) >= scheduleSyncInterval {
+			n.syncSchedules()
+			lastSync = time.Now()
+		}
+	}
+}
+
+// runSchedule sends the task of schedule s.
+func (n *Node) runSchedule(s Schedule) {
+	var (
+		id     string
+		target = s.Target
+		err    error
+	)
+	if target == AnyNode {
+		id, target, err = n.Submit(s.TaskType, s.Content)
+	} else {
+		id, err = n.SendTask(target, s.TaskType, s.Content)
+	}
+	if err != nil {
+		n.logger.Warn("failed to run scheduled task", "schedule", s.ID, "target", target, "err", err)
+		return
+	}
+	n.logger.Info("ran scheduled task", "schedule", s.ID, "task", id, "target", target)
+}
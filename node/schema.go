@@ -0,0 +1,490 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A task type can have a JSON Schema its payloads must match. A node
+// checks the content of every task it receives, from peers and clients
+// alike, against the schema of its type before queueing it, and answers a
+// task that does not match with a failed result instead of running it: the
+// error sums up what is wrong, and the content lists each violation with
+// the JSON pointer of the value at fault, so a handler never sees a
+// payload of unexpected shape. Schemas are set per node, in task_schemas
+// or with Node.RegisterSchema, like the handlers they guard.
+//
+// The keywords supported are type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum and exclusiveMaximum; others
+// are ignored.
+
+// maxViolations bounds the violations reported for one payload.
+const maxViolations = 20
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	types       []string
+	enum        []any
+	hasConst    bool
+	constant    any
+	properties  map[string]*Schema
+	required    []string
+	additional  *Schema
+	closed      bool
+	items       *Schema
+	minItems    *int
+	maxItems    *int
+	minLength   *int
+	maxLength   *int
+	pattern     *regexp.Regexp
+	minimum     *float64
+	maximum     *float64
+	exclusive   [2]*float64
+	source      json.RawMessage
+	description string
+}
+
+// schemaDocument is a schema as written.
+type schemaDocument struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []json.RawMessage          `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              string                     `json:"pattern"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	ExclusiveMinimum     *float64                   `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                   `json:"exclusiveMaximum"`
+	Description          string                     `json:"description"`
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// ParseSchema compiles a JSON Schema.
+func ParseSchema(data []byte) (*Schema, error) {
+	return parseSchema(data, "")
+}
+
+func parseSchema(data []byte, path string) (*Schema, error) {
+	fail := func(format string, args ...any) error {
+		where := path
+		if where == "" {
+			where = "/"
+		}
+		return fmt.Errorf("schema %s: %s", where, fmt.Sprintf(format, args...))
+	}
+
+	var doc schemaDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fail("%v", err)
+	}
+	s := &Schema{
+		required:    doc.Required,
+		minItems:    doc.MinItems,
+		maxItems:    doc.MaxItems,
+		minLength:   doc.MinLength,
+		maxLength:   doc.MaxLength,
+		minimum:     doc.Minimum,
+		maximum:     doc.Maximum,
+		exclusive:   [2]*float64{doc.ExclusiveMinimum, doc.ExclusiveMaximum},
+		source:      append(json.RawMessage(nil), data...),
+		description: doc.Description,
+	}
+
+	if len(doc.Type) > 0 {
+		var one string
+		if json.Unmarshal(doc.Type, &one) == nil {
+			s.types = []string{one}
+		} else if err := json.Unmarshal(doc.Type, &s.types); err != nil {
+			return nil, fail("type must be a string or a list of strings")
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return nil, fail("unknown type %q", t)
+			}
+		}
+	}
+	for _, raw := range doc.Enum {
+		value, err := decodeJSONValue(raw)
+		if err != nil {
+			return nil, fail("enum: %v", err)
+		}
+		s.enum = append(s.enum, value)
+	}
+	if doc.Enum != nil && len(s.enum) == 0 {
+		return nil, fail("enum must not be empty")
+	}
+	if len(doc.Const) > 0 {
+		value, err := decodeJSONValue(doc.Const)
+		if err != nil {
+			return nil, fail("const: %v", err)
+		}
+		s.hasConst, s.constant = true, value
+	}
+	if len(doc.Properties) > 0 {
+		s.properties = make(map[string]*Schema, len(doc.Properties))
+		for name, raw := range doc.Properties {
+			sub, err := parseSchema(raw, path+"/properties/"+escapePointer(name))
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = sub
+		}
+	}
+	if len(doc.AdditionalProperties) > 0 {
+		var allowed bool
+		if json.Unmarshal(doc.AdditionalProperties, &allowed) == nil {
+			s.closed = !allowed
+		} else {
+			sub, err := parseSchema(doc.AdditionalProperties, path+"/additionalProperties")
+			if err != nil {
+				return nil, err
+			}
+			s.additional = sub
+		}
+	}
+	if len(doc.Items) > 0 {
+		sub, err := parseSchema(doc.Items, path+"/items")
+		if err != nil {
+			return nil, err
+		}
+		s.items = sub
+	}
+	if doc.Pattern != "" {
+		pattern, err := regexp.Compile(doc.Pattern)
+		if err != nil {
+			return nil, fail("pattern: %v", err)
+		}
+		s.pattern = pattern
+	}
+	return s, nil
+}
+
+// MarshalJSON returns the schema as it was written.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return s.source, nil
+}
+
+// SchemaViolation is a way a payload fails its schema: Path is the JSON
+// pointer of the value at fault, empty for the payload itself.
+type SchemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v SchemaViolation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// Validate checks a JSON document against the schema, returning up to
+// maxViolations violations.
+func (s *Schema) Validate(content string) []SchemaViolation {
+	value, err := decodeJSONValue([]byte(content))
+	if err != nil {
+		return []SchemaViolation{{Message: "not valid JSON: " + err.Error()}}
+	}
+	var violations []SchemaViolation
+	s.validate(value, "", &violations)
+	return violations
+}
+
+func (s *Schema) validate(value any, path string, violations *[]SchemaViolation) {
+	report := func(format string, args ...any) {
+		if len(*violations) < maxViolations {
+			*violations = append(*violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if len(s.types) > 0 && !matchesType(value, s.types) {
+		report("expected %s, got %s", strings.Join(s.types, " or "), jsonType(value))
+		return
+	}
+	if s.enum != nil && !containsValue(s.enum, value) {
+		report("must be one of %s", describeValues(s.enum))
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, value) {
+		report("must be %s", describeValues([]any{s.constant}))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + escapePointer(name)
+			if sub, ok := s.properties[name]; ok {
+				sub.validate(v[name], child, violations)
+			} else if s.closed {
+				report("property %q is not allowed", name)
+			} else if s.additional != nil {
+				s.additional.validate(v[name], child, violations)
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			report("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			report("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.validate(item, path+"/"+strconv.Itoa(i), violations)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			report("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			report("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			report("must match %q", s.pattern)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			report("must be at least %g", *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			report("must be at most %g", *s.maximum)
+		}
+		if s.exclusive[0] != nil && v <= *s.exclusive[0] {
+			report("must be greater than %g", *s.exclusive[0])
+		}
+		if s.exclusive[1] != nil && v >= *s.exclusive[1] {
+			report("must be less than %g", *s.exclusive[1])
+		}
+	}
+}
+
+// decodeJSONValue decodes a single JSON value, numbers as float64.
+func decodeJSONValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the value")
+	}
+	return value, nil
+}
+
+// jsonType returns the JSON type of a decoded value.
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// matchesType reports whether value has one of types; integers are
+// numbers too.
+func matchesType(value any, types []string) bool {
+	actual := jsonType(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(values []any, value any) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeValues writes values as JSON, for messages.
+func describeValues(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		data, _ := json.Marshal(v)
+		parts[i] = string(data)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// escapePointer escapes a property name for a JSON pointer.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// PayloadError is the rejection of a task whose content does not match
+// its type's schema.
+type PayloadError struct {
+	TaskType   string            `json:"task_type"`
+	Violations []SchemaViolation `json:"violations"`
+}
+
+func (e *PayloadError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.String()
+	}
+	return fmt.Sprintf("invalid payload for task type %q: %s", e.TaskType, strings.Join(parts, "; "))
+}
+
+// Schemas are the payload schemas of task types.
+type Schemas struct {
+	mutex   sync.RWMutex
+	schemas map[string]*Schema
+}
+
+func NewSchemas() *Schemas {
+	return &Schemas{schemas: make(map[string]*Schema)}
+}
+
+// Set makes schema the one of taskType, or removes taskType's if schema is
+// nil.
+func (s *Schemas) Set(taskType string, schema *Schema) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if schema == nil {
+		delete(s.schemas, taskType)
+		return
+	}
+	s.schemas[taskType] = schema
+}
+
+// Get returns the schema of taskType.
+func (s *Schemas) Get(taskType string) (*Schema, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schema, ok := s.schemas[taskType]
+	return schema, ok
+}
+
+// All returns the schemas by task type.
+func (s *Schemas) All() map[string]*Schema {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	all := make(map[string]*Schema, len(s.schemas))
+	for t, schema := range s.schemas {
+		all[t] = schema
+	}
+	return all
+}
+
+// loadSchemas compiles the schema files in paths, by task type.
+func loadSchemas(paths map[string]string) (map[string]*Schema, error) {
+	schemas := make(map[string]*Schema, len(paths))
+	for taskType, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("schema of task type %s: %v", taskType, err)
+		}
+		schema, err := ParseSchema(data)
+		if err != nil {
+			return nil, fmt.Errorf("schema of task type %s in %s: %v", taskType, path, err)
+		}
+		schemas[taskType] = schema
+	}
+	return schemas, nil
+}
+
+// RegisterSchema makes payloads of taskType have to match the JSON Schema
+// in schema, replacing any schema it had.
+func (n *Node) RegisterSchema(taskType string, schema []byte) error {
+	compiled, err := ParseSchema(schema)
+	if err != nil {
+		return err
+	}
+	n.schemas.Set(canonicalTaskType(taskType), compiled)
+	return nil
+}
+
+// RemoveSchema lets payloads of taskType through unchecked.
+func (n *Node) RemoveSchema(taskType string) {
+	n.schemas.Set(canonicalTaskType(taskType), nil)
+}
+
+// TaskSchemas returns the payload schemas, by task type.
+func (n *Node) TaskSchemas() map[string]*Schema {
+	return n.schemas.All()
+}
+
+// canonicalTaskType returns the task type a task of taskType runs as.
+func canonicalTaskType(taskType string) string {
+	if taskType == "" {
+		return DefaultTaskType
+	}
+	return taskType
+}
+
+// checkPayload checks the content of task msg against its type's schema,
+// if it has one.
+func (n *Node) checkPayload(msg Message) *PayloadError {
+	taskType := canonicalTaskType(msg.TaskType)
+	schema, ok := n.schemas.Get(taskType)
+	if !ok {
+		return nil
+	}
+	violations := schema.Validate(msg.Content)
+	if len(violations) == 0 {
+		return nil
+	}
+	n.metrics.PayloadInvalid(taskType)
+	return &PayloadError{TaskType: taskType, Violations: violations}
+}
+
+// invalidPayload returns the result rejecting a task for err: its error,
+// with err as JSON in the content.
+func invalidPayload(err *PayloadError) Message {
+	data, _ := json.Marshal(err)
+	return Message{Type: "result", Content: string(data), Error: err.Error()}
+}
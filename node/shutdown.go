@@ -0,0 +1,110 @@
+package node
+
+import (
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// drainTimeout bounds how long shutdown waits for in-flight tasks.
+const drainTimeout = time.Second * 30
+
+// Shutdown stops the node gracefully: it stops accepting connections and
+// tasks, tells peers it is leaving, waits for in-flight tasks, then closes
+// every connection and flushes the WAL and logs. It is safe to call more
+// than once; later calls wait for the first to finish.
+func (n *Node) Shutdown() {
+	n.shutdownOnce.Do(func() {
+		n.logger.Info("shutting down")
+		close(n.done)
+
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		if n.udp != nil {
+			n.udp.Close()
+		}
+		n.tasks.Close()
+
+		n.mutex.RLock()
+		peers := make([]int, 0, len(n.conn))
+		for id := range n.conn {
+			peers = append(peers, id)
+		}
+		n.mutex.RUnlock()
+
+		for _, id := range peers {
+			n.sendMessage(id, Message{Type: "leaving", From: n.ID})
+		}
+
+		if !n.tasks.Wait(drainTimeout) {
+			n.logger.Warn("timed out waiting for in-flight tasks", "timeout", drainTimeout)
+		}
+		// Handlers still running, requests waiting for replies and
+		// connections being served give up
+		n.cancel()
+
+		// Closing an outbox waits for it to flush, so do it outside the lock
+		n.mutex.Lock()
+		conns := make([]transport.Conn, 0, len(n.conn)+len(n.inbound))
+		for id, conn := range n.conn {
+			conns = append(conns, conn)
+			delete(n.conn, id)
+		}
+		for conn := range n.inbound {
+			conns = append(conns, conn)
+		}
+		n.mutex.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		if n.wal != nil {
+			if err := n.wal.Close(); err != nil {
+				n.logger.Error("failed to close WAL", "err", err)
+			}
+		}
+		if err := n.store.Close(); err != nil {
+			n.logger.Error("failed to close store", "err", err)
+		}
+
+		n.logger.Info("shutdown complete")
+		n.logCloser.Close()
+		close(n.stopped)
+	})
+	<-n.stopped
+}
+
+// handleLeaving forgets a peer that announced a graceful shutdown, so it is
+// neither reconnected to nor reported as failed.
+func (n *Node) handleLeaving(msg Message) {
+	n.removePeer(msg.From)
+	n.peerLogger(msg.From, msg.Type).Info("peer left the cluster")
+}
+
+// removePeer drops a peer from membership, the ring and failure detection.
+func (n *Node) removePeer(id int) {
+	n.mutex.Lock()
+	conn, connected := n.conn[id]
+	_, known := n.Peers[id]
+	delete(n.conn, id)
+	delete(n.Peers, id)
+	delete(n.peerInfo, id)
+	n.peersChanged()
+	n.mutex.Unlock()
+
+	if known {
+		n.publish(Event{Type: EventLeave, Node: id})
+	}
+	if connected {
+		conn.Close()
+	}
+	n.peerLost(id)
+	n.steals.peerRemoved(id)
+	n.ring.Remove(id)
+	n.detector.Forget(id)
+	n.loads.Forget(id)
+	n.latencies.Forget(id)
+	n.watches.Forget(id)
+}
@@ -0,0 +1,274 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// With conflicts set to siblings, writes are versioned with version vectors
+// instead of only ordered by timestamp, so writes made concurrently, e.g.
+// through different coordinators while the cluster was partitioned, or
+// based on a stale read, are all kept instead of the last one silently
+// winning. A write is identified by its timestamp, and its version records
+// the writes to the key it supersedes: for each node, the latest timestamp
+// of that node's writes it had seen. That is the context the writer read,
+// or for a write without one everything the coordinator holds, so the write
+// supersedes what it saw and nothing else, even of writes the same
+// coordinator made meanwhile (dotted version vectors). Replicas merge the
+// versions they are sent and keep every version no other supersedes: the
+// newest is the key's value and the others its siblings.
+// Reads return them all with their context; an application resolves them,
+// with whatever merge policy suits it, by writing the value it chose with
+// that context (see Node.Resolve and Node.ResolveWith). The nodes of a
+// cluster should agree on the setting.
+
+const (
+	// ConflictsLWW resolves concurrent writes by timestamp: the last writer
+	// wins.
+	ConflictsLWW = "lww"
+	// ConflictsSiblings keeps concurrent writes as siblings.
+	ConflictsSiblings = "siblings"
+)
+
+// versionsOf returns the versions e holds: e itself and its siblings, each
+// without siblings of its own.
+func versionsOf(e Entry) []Entry {
+	versions := make([]Entry, 0, 1+len(e.Siblings))
+	for _, v := range append([]Entry{e}, e.Siblings...) {
+		v.Siblings = nil
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// mergeEntries merges two entries for the same key. Entries without
+// versions are ordered by timestamp, the last writer winning. Otherwise
+// every version that no other supersedes survives, and a version without a
+// vector is superseded by any with one.
+func mergeEntries(a, b Entry) Entry {
+	if isCRDT(a) || isCRDT(b) {
+		return mergeCRDT(a, b)
+	}
+	if len(a.Version) == 0 && len(b.Version) == 0 && len(a.Siblings) == 0 && len(b.Siblings) == 0 {
+		if a.Timestamp.Less(b.Timestamp) {
+			return b
+		}
+		return a
+	}
+
+	candidates := append(versionsOf(a), versionsOf(b)...)
+	var kept []Entry
+	for i, v := range candidates {
+		superseded := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			if (v.Timestamp == other.Timestamp && j < i) ||
+				(len(v.Version) == 0 && len(other.Version) > 0) ||
+				(v.Timestamp != other.Timestamp && covers(other.Version, v.Timestamp)) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			kept = append(kept, v)
+		}
+	}
+	return joinVersions(kept)
+}
+
+// joinVersions builds the entry holding versions, at least one: the newest
+// by timestamp, with the others as its siblings, oldest first.
+func joinVersions(versions []Entry) Entry {
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Timestamp.Less(versions[j].Timestamp) })
+	e := versions[len(versions)-1]
+	if len(versions) > 1 {
+		e.Siblings = versions[:len(versions)-1]
+	}
+	return e
+}
+
+// covers reports whether a version records the write made at ts.
+func covers(version transport.VectorClock, ts Timestamp) bool {
+	seen, ok := version[ts.Node]
+	return ok && seen >= ts.Time
+}
+
+// versionTimestamps returns the timestamps of the versions e holds, which
+// identify them, in order.
+func versionTimestamps(e Entry) []Timestamp {
+	stamps := []Timestamp{e.Timestamp}
+	for _, s := range e.Siblings {
+		stamps = append(stamps, s.Timestamp)
+	}
+	slices.SortFunc(stamps, func(a, b Timestamp) int {
+		if a.Less(b) {
+			return -1
+		}
+		if b.Less(a) {
+			return 1
+		}
+		return 0
+	})
+	return stamps
+}
+
+// supersedes reports whether e holds a write other lacks, so a replica
+// holding other should be sent e.
+func supersedes(e, other Entry) bool {
+	if isCRDT(e) || isCRDT(other) {
+		merged := mergeEntries(other, e)
+		return merged.Timestamp != other.Timestamp || merged.Value != other.Value || merged.Deleted != other.Deleted
+	}
+	if len(e.Version) == 0 && len(other.Version) == 0 && len(e.Siblings) == 0 && len(other.Siblings) == 0 {
+		return other.Timestamp.Less(e.Timestamp)
+	}
+	return !slices.Equal(versionTimestamps(mergeEntries(other, e)), versionTimestamps(other))
+}
+
+// entryContext returns the version vector that records every version e
+// holds, which a write superseding them all is made with.
+func entryContext(e Entry) transport.VectorClock {
+	context := make(transport.VectorClock)
+	for _, v := range versionsOf(e) {
+		context.Merge(v.Version)
+		context.Merge(transport.VectorClock{v.Timestamp.Node: v.Timestamp.Time})
+	}
+	return context
+}
+
+// nextVersion returns the version of a write coordinated by node that
+// supersedes context, or everything in old if context is empty. It always
+// has an entry for node, so it is never empty.
+func nextVersion(node int, old Entry, found bool, context transport.VectorClock) transport.VectorClock {
+	if len(context) == 0 && found {
+		context = entryContext(old)
+	}
+	version := context.Copy()
+	if _, ok := version[node]; !ok {
+		version[node] = 0
+	}
+	return version
+}
+
+// versionedValue is how an entry with a version is kept in the data log and
+// the WAL: its value packed with its version and siblings.
+type versionedValue struct {
+	Value    string                `json:"value"`
+	Version  transport.VectorClock `json:"version"`
+	Siblings []Entry               `json:"siblings,omitempty"`
+}
+
+// packVersions returns e's value packed with its version and siblings.
+func packVersions(e Entry) string {
+	data, _ := json.Marshal(versionedValue{Value: e.Value, Version: e.Version, Siblings: e.Siblings})
+	return string(data)
+}
+
+// unpackVersions restores the value, version and siblings packVersions
+// packed into e's value.
+func unpackVersions(e *Entry) error {
+	var v versionedValue
+	if err := json.Unmarshal([]byte(e.Value), &v); err != nil {
+		return fmt.Errorf("invalid versioned value: %v", err)
+	}
+	e.Value, e.Version, e.Siblings = v.Value, v.Version, v.Siblings
+	return nil
+}
+
+// KeyVersions are the values a key holds: one, or several written
+// concurrently, and the context a write resolving them passes back.
+type KeyVersions struct {
+	Key string `json:"key"`
+	// Values are the values of the versions that are not deletes, newest
+	// first.
+	Values []string `json:"values"`
+	// Deleted is set when one of the versions is a delete.
+	Deleted bool                  `json:"deleted,omitempty"`
+	Context transport.VectorClock `json:"context,omitempty"`
+}
+
+// Conflicted reports whether the key holds more than one version.
+func (v KeyVersions) Conflicted() bool {
+	return len(v.Values) > 1 || (v.Deleted && len(v.Values) > 0)
+}
+
+// keyVersions lists the versions of a kv_result reply to a get.
+func keyVersions(reply Message) KeyVersions {
+	versions := KeyVersions{Key: reply.Key, Context: reply.Context}
+	// Without siblings, a key that is not found holds no version worth
+	// resolving; with them, its newest version is a delete
+	if reply.Found {
+		versions.Values = append(versions.Values, reply.Value)
+	} else if len(reply.Siblings) > 0 {
+		versions.Deleted = true
+	}
+	for i := len(reply.Siblings) - 1; i >= 0; i-- {
+		if s := reply.Siblings[i]; s.Deleted {
+			versions.Deleted = true
+		} else {
+			versions.Values = append(versions.Values, s.Value)
+		}
+	}
+	return versions
+}
+
+// versionsContent describes the versions of a key for a get's reply.
+func versionsContent(v KeyVersions) string {
+	if !v.Conflicted() {
+		if len(v.Values) == 0 {
+			return fmt.Sprintf("%s not found", v.Key)
+		}
+		return fmt.Sprintf("%s = %s", v.Key, v.Values[0])
+	}
+	values := make([]string, 0, len(v.Values)+1)
+	for _, value := range v.Values {
+		values = append(values, strconv.Quote(value))
+	}
+	if v.Deleted {
+		values = append(values, "(deleted)")
+	}
+	return fmt.Sprintf("%s has %d conflicting versions: %s", v.Key, len(values), strings.Join(values, ", "))
+}
+
+// GetVersions reads every version of key through its coordinator.
+func (n *Node) GetVersions(key string) (KeyVersions, error) {
+	reply, err := n.kvCall(Message{Type: "get", Key: key})
+	if err != nil {
+		return KeyVersions{}, err
+	}
+	return keyVersions(reply), nil
+}
+
+// Resolve replaces the versions of key read with context by value; versions
+// written since are kept as siblings. On a cluster not keeping siblings it
+// is a plain set.
+func (n *Node) Resolve(key, value string, context transport.VectorClock) error {
+	_, err := n.kvCall(Message{Type: "set", Key: key, Value: value, Context: context})
+	return err
+}
+
+// ResolveWith reads the versions of key and, if there are several, replaces
+// them by the value merge picks or builds from their values, newest first.
+// It returns the key's value afterwards.
+func (n *Node) ResolveWith(key string, merge func(values []string) string) (string, error) {
+	versions, err := n.GetVersions(key)
+	if err != nil {
+		return "", err
+	}
+	if !versions.Conflicted() {
+		if len(versions.Values) == 0 {
+			return "", nil
+		}
+		return versions.Values[0], nil
+	}
+	value := merge(versions.Values)
+	return value, n.Resolve(key, value, versions.Context)
+}
@@ -0,0 +1,102 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is a point-in-time copy of a node's state that can be written to
+// disk and restored on the same or another machine.
+type Snapshot struct {
+	NodeID  int               `json:"node_id"`
+	TakenAt time.Time         `json:"taken_at"`
+	Data    map[string]string `json:"data"`
+	Peers   map[int]string    `json:"peers"`
+	Tasks   []TaskRecord      `json:"tasks"`
+}
+
+// Snapshot captures the node's KV data, peers and tracked tasks.
+func (n *Node) Snapshot() Snapshot {
+	n.mutex.RLock()
+	peers := make(map[int]string, len(n.Peers))
+	for id, addr := range n.Peers {
+		peers[id] = addr
+	}
+	n.mutex.RUnlock()
+
+	return Snapshot{
+		NodeID:  n.ID,
+		TakenAt: time.Now(),
+		Data:    n.store.Copy(),
+		Peers:   peers,
+		Tasks:   n.tracker.List(),
+	}
+}
+
+// WriteSnapshot saves a snapshot to path atomically: it is written to a
+// temporary file first and renamed into place.
+func (n *Node) WriteSnapshot(path string) (Snapshot, error) {
+	snap := n.Snapshot()
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return snap, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return snap, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return snap, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return snap, err
+	}
+	if err := tmp.Close(); err != nil {
+		return snap, err
+	}
+	return snap, os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot replaces the node's KV data and task history with the
+// snapshot at path and reconnects to its peers.
+func (n *Node) RestoreSnapshot(path string) (Snapshot, error) {
+	var snap Snapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("parse snapshot: %v", err)
+	}
+
+	if err := n.store.Replace(snap.Data); err != nil {
+		return snap, err
+	}
+	for _, task := range snap.Tasks {
+		n.tracker.load(task)
+	}
+
+	for id, addr := range snap.Peers {
+		if id == n.ID {
+			continue
+		}
+		n.mutex.RLock()
+		_, connected := n.conn[id]
+		n.mutex.RUnlock()
+		if connected {
+			continue
+		}
+		if err := n.Connect(id, addr); err != nil {
+			n.peerLogger(id, "").Warn("failed to reconnect to snapshot peer", "addr", addr, "err", err)
+		}
+	}
+	return snap, nil
+}
@@ -0,0 +1,610 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Work stealing evens out the task queues of the cluster. The leader
+// compares the loads nodes report with their heartbeats, and when a node's
+// queue is steal_threshold tasks deep while another node has idle workers
+// and nothing queued, it asks the busy node to hand queued tasks over to
+// the idle one, at most one per idle worker and half the queue. Only queued
+// tasks from peers move: running tasks stay where they are, and a client
+// task's result goes back over the connection it came on.
+//
+// A stolen task must still run exactly once. The busy node takes the tasks
+// out of its queue, so its own workers cannot run them, and sends them in
+// one handoff; the idle node answers with the tasks it queued, and the rest
+// are put back. If the answer is lost, the busy node aborts the handoff:
+// the idle node answers again if it took the handoff, or refuses it should
+// it still arrive, so both agree on which tasks moved. Until the idle node
+// answers, the tasks stay parked, out of the queue, however long that
+// takes, unless the idle node is removed from the cluster or banned: then
+// no answer will come, and the tasks go to the dead-letter queue, since
+// they may or may not have run there. With a data directory both sides
+// record handoffs in the WAL, so a restart resolves a parked handoff first
+// and the idle node still knows its answer. The thief sends a task's result to the submitter, and to the
+// node it stole the task from, which answers copies of the task with it.
+
+const (
+	// stealInterval is how often the leader looks for queues to even out.
+	stealInterval = time.Second
+	// stealTimeout bounds a handoff and each attempt to abort one.
+	stealTimeout = 5 * time.Second
+	// stealRetryInterval is how often an abort is retried until the thief
+	// answers it.
+	stealRetryInterval = time.Second
+	// handoffRetention is how long a node remembers the handoffs it got,
+	// to answer aborts.
+	handoffRetention = 24 * time.Hour
+)
+
+// errThiefRemoved is returned by abortHandoff when the thief was removed
+// from the cluster or banned before it answered.
+var errThiefRemoved = errors.New("thief removed before answering")
+
+// stealOrder asks a busy node to hand Count queued tasks to node Thief. A
+// steal message carries a list of them.
+type stealOrder struct {
+	Thief int `json:"thief"`
+	Count int `json:"count"`
+}
+
+// taskHandoff is the content of a steal_handoff: queued tasks moving to
+// the node it is sent to. A steal_abort carries one without tasks.
+type taskHandoff struct {
+	ID    string    `json:"id"`
+	Tasks []Message `json:"tasks,omitempty"`
+}
+
+// handoffRecord is the outcome of a handoff a node got: the ids of the
+// tasks it queued, none if the handoff was aborted first.
+type handoffRecord struct {
+	accepted []string
+	at       time.Time
+}
+
+// parkedHandoff is a handoff this node sent and has not learned the
+// outcome of. removed is closed, and gone set, when the thief is removed
+// from the cluster.
+type parkedHandoff struct {
+	thief   int
+	tasks   []string
+	removed chan struct{}
+	gone    bool
+}
+
+// Steals tracks the work stealing a node takes part in.
+type Steals struct {
+	mutex sync.Mutex
+	wal   *WAL
+	// handoffs are the handoffs this node got, by id.
+	handoffs map[string]handoffRecord
+	// parked are the handoffs this node sent and has no answer to, those
+	// a restart interrupted included.
+	parked map[string]*parkedHandoff
+	// stolen maps the tasks this node stole to the node they came from.
+	stolen map[string]int
+	// handingOff is set while this node hands tasks over, one handoff at
+	// a time.
+	handingOff bool
+	// moved is when the leader last moved tasks from or to each node, so it
+	// waits for a newer load report before it moves more.
+	moved map[int]time.Time
+}
+
+func NewSteals() *Steals {
+	return &Steals{
+		handoffs: make(map[string]handoffRecord),
+		parked:   make(map[string]*parkedHandoff),
+		stolen:   make(map[string]int),
+		moved:    make(map[int]time.Time),
+	}
+}
+
+// runStealer evens out the task queues while this node leads.
+func (n *Node) runStealer() {
+	ticker := time.NewTicker(stealInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.RLock()
+		leading := n.election.state == Leader
+		n.mutex.RUnlock()
+		if leading && n.config.StealThreshold > 0 {
+			n.balanceQueues()
+		}
+	}
+}
+
+// balanceQueues shares the idle nodes out among the busy ones, deepest
+// queue first, and moves tasks between them.
+func (n *Node) balanceQueues() {
+	var busy, idle []NodeLoad
+	for _, load := range n.ClusterLoad() {
+		if !n.canSteal(load) {
+			continue
+		}
+		switch {
+		case load.QueueDepth >= n.config.StealThreshold:
+			busy = append(busy, load)
+		case load.QueueDepth == 0 && load.IdleWorkers > 0:
+			idle = append(idle, load)
+		}
+	}
+	sort.Slice(busy, func(i, j int) bool { return busy[i].QueueDepth > busy[j].QueueDepth })
+	sort.Slice(idle, func(i, j int) bool { return idle[i].IdleWorkers > idle[j].IdleWorkers })
+
+	for _, victim := range busy {
+		var orders []stealOrder
+		for budget := victim.QueueDepth / 2; budget > 0 && len(idle) > 0; idle = idle[1:] {
+			count := min(idle[0].IdleWorkers, budget)
+			orders = append(orders, stealOrder{Thief: idle[0].ID, Count: count})
+			budget -= count
+		}
+		if len(orders) > 0 {
+			n.orderSteal(victim.ID, orders)
+		}
+	}
+}
+
+// canSteal reports whether tasks may move from or to the node whose load
+// is load: a live member, not draining, whose load was reported since
+// tasks last moved from or to it.
+func (n *Node) canSteal(load NodeLoad) bool {
+	if load.ID == n.ID {
+		return ownsKeys(n.config.Role) && !n.Draining()
+	}
+	n.steals.mutex.Lock()
+	moved := n.steals.moved[load.ID]
+	n.steals.mutex.Unlock()
+
+	return load.Health == PeerAlive && load.ReportedAt.After(moved) && n.available(load.ID) &&
+		ownsKeys(n.PeerRole(load.ID)) && !n.peerDraining(load.ID) && n.PeerSupports(load.ID, CapSteal)
+}
+
+// orderSteal asks node victim to hand its queued tasks over as orders say.
+func (n *Node) orderSteal(victim int, orders []stealOrder) {
+	n.steals.mutex.Lock()
+	now := time.Now()
+	n.steals.moved[victim] = now
+	for _, order := range orders {
+		n.steals.moved[order.Thief] = now
+		n.logger.Info("moving queued tasks to an idle node", "from", victim, "to", order.Thief, "tasks", order.Count)
+	}
+	n.steals.mutex.Unlock()
+
+	if victim == n.ID {
+		go n.handOverTasks(orders)
+		return
+	}
+	content, _ := json.Marshal(orders)
+	if err := n.sendMessage(victim, Message{Type: "steal", From: n.ID, Content: string(content)}); err != nil {
+		n.peerLogger(victim, "steal").Warn("failed to move queued tasks", "err", err)
+	}
+}
+
+// handleSteal hands queued tasks over as the leader asked.
+func (n *Node) handleSteal(msg Message) {
+	n.mutex.RLock()
+	leader := n.election.leaderID
+	n.mutex.RUnlock()
+
+	logger := n.peerLogger(msg.From, msg.Type)
+	if msg.From != leader {
+		logger.Warn("ignoring steal from a node that is not the leader")
+		return
+	}
+	var orders []stealOrder
+	if err := json.Unmarshal([]byte(msg.Content), &orders); err != nil {
+		logger.Warn("invalid steal", "err", err)
+		return
+	}
+	go n.handOverTasks(orders)
+}
+
+// handOverTasks hands queued tasks over to the nodes orders name, one
+// handoff at a time.
+func (n *Node) handOverTasks(orders []stealOrder) {
+	n.steals.mutex.Lock()
+	if n.steals.handingOff {
+		n.steals.mutex.Unlock()
+		return
+	}
+	n.steals.handingOff = true
+	n.steals.mutex.Unlock()
+	defer func() {
+		n.steals.mutex.Lock()
+		n.steals.handingOff = false
+		n.steals.mutex.Unlock()
+	}()
+
+	for _, order := range orders {
+		if order.Thief != n.ID && order.Count > 0 {
+			n.handOverTo(order.Thief, order.Count)
+		}
+	}
+}
+
+// handOverTo moves up to count queued tasks to node thief, putting back
+// those it does not take.
+func (n *Node) handOverTo(thief, count int) {
+	tasks := n.tasks.Steal(count, thief)
+	if len(tasks) == 0 {
+		return
+	}
+	h := taskHandoff{ID: newTaskID(), Tasks: make([]Message, len(tasks))}
+	for i, task := range tasks {
+		msg := task.msg
+		// The thief counts the timeout from when it queues the task
+		if msg.Timeout > 0 {
+			msg.Timeout = max(msg.Timeout-time.Since(task.queued), time.Nanosecond)
+		}
+		h.Tasks[i] = msg
+	}
+
+	logger := n.peerLogger(thief, "steal_handoff").With("handoff", h.ID)
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.msg.TaskID
+	}
+	if err := n.steals.record(WALEntry{Op: walHandoffSent, Handoff: h.ID, Target: thief, Content: marshalIDs(ids)}); err != nil {
+		logger.Warn("failed to record handoff, keeping the tasks", "err", err)
+		n.tasks.Requeue(tasks)
+		return
+	}
+	n.steals.park(h.ID, thief, ids)
+	accepted, err := n.sendHandoff(thief, "steal_handoff", h)
+	if err != nil {
+		logger.Warn("handoff failed, aborting it", "err", err)
+		accepted, err = n.abortHandoff(thief, h.ID)
+		if err == errThiefRemoved {
+			n.abandonHandoff(h.ID, thief, h.Tasks)
+			return
+		}
+		if err != nil {
+			// Only shutting down ends the retries otherwise; the WAL, if
+			// any, has the handoff resolved after a restart
+			logger.Warn("shutting down with tasks parked in a handoff", "tasks", len(tasks))
+			return
+		}
+	}
+
+	moved := make(map[string]bool, len(accepted))
+	for _, id := range accepted {
+		moved[id] = true
+	}
+	var kept []queuedTask
+	for _, task := range tasks {
+		if moved[task.msg.TaskID] {
+			n.finishTask(task.msg.TaskID)
+		} else {
+			kept = append(kept, task)
+		}
+	}
+	n.tasks.Requeue(kept)
+	n.steals.unpark(h.ID)
+	n.resolvedHandoff(h.ID)
+	n.metrics.TasksStolen(len(tasks) - len(kept))
+	logger.Info("handed queued tasks over", "moved", len(tasks)-len(kept), "kept", len(kept))
+}
+
+// abandonHandoff gives up handoff id to thief, which was removed before it
+// answered: tasks, which may or may not have run there, go to the
+// dead-letter queue, and their submitters learn they failed.
+func (n *Node) abandonHandoff(id string, thief int, tasks []Message) {
+	reason := fmt.Sprintf("handed over to node %d, which was removed before it answered; the task may have run there", thief)
+	n.peerLogger(thief, "steal_abort").Warn("thief removed, moving parked tasks to the dead-letter queue", "handoff", id, "tasks", len(tasks))
+	for _, msg := range tasks {
+		n.deadLetter(TaskRecord{ID: msg.TaskID, Target: thief, TaskType: msg.TaskType, Content: msg.Content}, reason)
+		n.sendReliable(msg.From, Message{
+			Type:   "result",
+			From:   n.ID,
+			TaskID: msg.TaskID,
+			Error:  reason,
+		}, 0)
+		n.finishTask(msg.TaskID)
+	}
+	n.steals.unpark(id)
+	n.resolvedHandoff(id)
+}
+
+// resolvedHandoff records that the outcome of handoff id is settled.
+func (n *Node) resolvedHandoff(id string) {
+	if err := n.steals.record(WALEntry{Op: walHandoffDone, Handoff: id}); err != nil {
+		n.logger.Error("failed to record resolved handoff", "handoff", id, "err", err)
+	}
+}
+
+// record appends entry to the WAL, if any.
+func (s *Steals) record(entry WALEntry) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Append(entry)
+}
+
+// restore applies a handoff entry replayed from the WAL.
+func (s *Steals) restore(entry WALEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ids []string
+	if entry.Content != "" {
+		if err := json.Unmarshal([]byte(entry.Content), &ids); err != nil {
+			return err
+		}
+	}
+	switch entry.Op {
+	case walHandoffSent:
+		s.parked[entry.Handoff] = &parkedHandoff{thief: entry.Target, tasks: ids, removed: make(chan struct{})}
+	case walHandoffDone:
+		delete(s.parked, entry.Handoff)
+	case walHandoffTaken:
+		if time.Since(entry.Time) <= handoffRetention {
+			s.handoffs[entry.Handoff] = handoffRecord{accepted: ids, at: entry.Time}
+		}
+	}
+	return nil
+}
+
+// park records that handoff id moved tasks to thief, which has not
+// answered yet.
+func (s *Steals) park(id string, thief int, tasks []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.parked[id] = &parkedHandoff{thief: thief, tasks: tasks, removed: make(chan struct{})}
+}
+
+// unpark forgets handoff id, whose outcome is settled.
+func (s *Steals) unpark(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.parked, id)
+}
+
+// peerRemoved wakes the aborts of the handoffs to node id, which was
+// removed from the cluster.
+func (s *Steals) peerRemoved(id int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, h := range s.parked {
+		if h.thief == id && !h.gone {
+			h.gone = true
+			close(h.removed)
+		}
+	}
+}
+
+// Parked returns how many tasks are parked in handoffs awaiting an answer.
+func (s *Steals) Parked() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for _, h := range s.parked {
+		count += len(h.tasks)
+	}
+	return count
+}
+
+// parkedTasks returns the tasks in the handoffs a restart interrupted.
+func (s *Steals) parkedTasks() map[string]bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tasks := make(map[string]bool)
+	for _, h := range s.parked {
+		for _, id := range h.tasks {
+			tasks[id] = true
+		}
+	}
+	return tasks
+}
+
+// resumeHandoffs resolves the handoffs a restart interrupted: the tasks the
+// thief took are finished here, and the rest are resumed like any task the
+// restart interrupted. unfinished are those tasks, by id.
+func (n *Node) resumeHandoffs(unfinished map[string]Message) {
+	n.steals.mutex.Lock()
+	parked := maps.Clone(n.steals.parked)
+	n.steals.mutex.Unlock()
+
+	for id, h := range parked {
+		go func() {
+			logger := n.peerLogger(h.thief, "steal_abort").With("handoff", id)
+			logger.Warn("resolving a handoff interrupted by a restart", "tasks", len(h.tasks))
+			accepted, err := n.abortHandoff(h.thief, id)
+			if err == errThiefRemoved {
+				var tasks []Message
+				for _, task := range h.tasks {
+					if msg, ok := unfinished[task]; ok {
+						tasks = append(tasks, msg)
+					}
+				}
+				n.abandonHandoff(id, h.thief, tasks)
+				return
+			}
+			if err != nil {
+				return
+			}
+			moved := make(map[string]bool, len(accepted))
+			for _, task := range accepted {
+				moved[task] = true
+			}
+			for _, task := range h.tasks {
+				msg, ok := unfinished[task]
+				switch {
+				case moved[task]:
+					n.finishTask(task)
+				case ok:
+					n.resumeTask(msg)
+				}
+			}
+			n.steals.unpark(id)
+			n.resolvedHandoff(id)
+		}()
+	}
+}
+
+// marshalIDs encodes task ids for the WAL.
+func marshalIDs(ids []string) string {
+	data, _ := json.Marshal(ids)
+	return string(data)
+}
+
+// sendHandoff sends a steal_handoff or steal_abort to thief and returns the
+// ids of the tasks it queued.
+func (n *Node) sendHandoff(thief int, msgType string, h taskHandoff) ([]string, error) {
+	content, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := n.Call(thief, Message{Type: msgType, Content: string(content)}, stealTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var accepted []string
+	if err := json.Unmarshal([]byte(reply.Content), &accepted); err != nil {
+		return nil, fmt.Errorf("invalid handoff result from node %d: %v", thief, err)
+	}
+	return accepted, nil
+}
+
+// abortHandoff aborts handoff id to thief, retrying until thief answers,
+// and returns the ids of the tasks thief queued before the abort. It fails
+// with errThiefRemoved once thief is removed from the cluster or banned,
+// and gives up when the node shuts down.
+func (n *Node) abortHandoff(thief int, id string) ([]string, error) {
+	n.steals.mutex.Lock()
+	var removed <-chan struct{}
+	if h, ok := n.steals.parked[id]; ok {
+		removed = h.removed
+	}
+	n.steals.mutex.Unlock()
+
+	for {
+		if n.bans.Banned(thief) {
+			return nil, errThiefRemoved
+		}
+		accepted, err := n.sendHandoff(thief, "steal_abort", taskHandoff{ID: id})
+		if err == nil {
+			return accepted, nil
+		}
+		select {
+		case <-n.done:
+			return nil, err
+		case <-removed:
+			return nil, errThiefRemoved
+		case <-time.After(stealRetryInterval):
+		}
+	}
+}
+
+// handleHandoff queues the tasks of a handoff, or aborts one, and answers
+// with the ids of the tasks queued. A handoff or abort seen before gets the
+// same answer, so an aborted handoff arriving late queues nothing.
+func (n *Node) handleHandoff(msg Message) {
+	var h taskHandoff
+	if err := json.Unmarshal([]byte(msg.Content), &h); err != nil || h.ID == "" {
+		n.Reply(msg, Message{Type: "steal_handoff_result", Error: fmt.Sprintf("invalid handoff: %v", err)})
+		return
+	}
+
+	n.steals.mutex.Lock()
+	for id, record := range n.steals.handoffs {
+		if time.Since(record.at) > handoffRetention {
+			delete(n.steals.handoffs, id)
+		}
+	}
+	record, seen := n.steals.handoffs[h.ID]
+	if !seen {
+		record = handoffRecord{accepted: []string{}, at: time.Now()}
+		if msg.Type == "steal_handoff" {
+			record.accepted = n.queueStolen(msg.From, h.Tasks)
+		}
+		n.steals.handoffs[h.ID] = record
+		if err := n.steals.record(WALEntry{Op: walHandoffTaken, Handoff: h.ID, Content: marshalIDs(record.accepted)}); err != nil {
+			n.peerLogger(msg.From, msg.Type).Error("failed to record handoff", "handoff", h.ID, "err", err)
+		}
+	}
+	n.steals.mutex.Unlock()
+
+	if msg.Type == "steal_handoff" && !seen {
+		n.peerLogger(msg.From, msg.Type).Info("took queued tasks from a busy node", "handoff", h.ID, "tasks", len(h.Tasks), "queued", len(record.accepted))
+	}
+	content, _ := json.Marshal(record.accepted)
+	n.Reply(msg, Message{Type: "steal_handoff_result", Content: string(content)})
+}
+
+// queueStolen queues the tasks stolen from node victim and returns the ids
+// of those it queued, or already has. The caller must hold the steals
+// mutex.
+func (n *Node) queueStolen(victim int, tasks []Message) []string {
+	accepted := []string{}
+	for _, msg := range tasks {
+		if n.duplicateTask(msg) {
+			accepted = append(accepted, msg.TaskID)
+			continue
+		}
+		n.acceptTask(msg)
+		n.steals.stolen[msg.TaskID] = victim
+		if err := n.tasks.Enqueue(n.ctx, msg); err != nil {
+			delete(n.steals.stolen, msg.TaskID)
+			n.dedup.reject(taskKey(msg))
+			n.finishTask(msg.TaskID)
+			continue
+		}
+		accepted = append(accepted, msg.TaskID)
+	}
+	return accepted
+}
+
+// returnStolen sends the result of task msg, if this node stole it, to the
+// node it was stolen from.
+func (n *Node) returnStolen(msg Message, result Message) {
+	n.steals.mutex.Lock()
+	victim, ok := n.steals.stolen[msg.TaskID]
+	delete(n.steals.stolen, msg.TaskID)
+	n.steals.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	n.sendMessage(victim, Message{
+		Type:           "steal_result",
+		From:           n.ID,
+		TaskID:         msg.TaskID,
+		TaskType:       msg.TaskType,
+		IdempotencyKey: msg.IdempotencyKey,
+		Content:        result.Content,
+		Error:          result.Error,
+	})
+}
+
+// handleStealResult records the result of a task a peer stole from this
+// node, for copies of the task that arrive here.
+func (n *Node) handleStealResult(msg Message) {
+	n.dedup.finish(taskKey(msg), Message{
+		Type:     "result",
+		From:     msg.From,
+		TaskID:   msg.TaskID,
+		TaskType: msg.TaskType,
+		Content:  msg.Content,
+		Error:    msg.Error,
+	})
+}
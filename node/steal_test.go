@@ -0,0 +1,30 @@
+package node
+
+import "testing"
+
+func TestRemovedThiefReleasesParkedHandoffs(t *testing.T) {
+	s := NewSteals()
+	s.park("h1", 2, []string{"a", "b"})
+	s.park("h2", 3, []string{"c"})
+	if parked := s.Parked(); parked != 3 {
+		t.Fatalf("parked = %d, want 3", parked)
+	}
+
+	s.peerRemoved(2)
+	s.peerRemoved(2)
+	select {
+	case <-s.parked["h1"].removed:
+	default:
+		t.Error("handoff to the removed node not released")
+	}
+	select {
+	case <-s.parked["h2"].removed:
+		t.Error("handoff to another node released")
+	default:
+	}
+
+	s.unpark("h1")
+	if parked := s.Parked(); parked != 1 {
+		t.Errorf("parked after unpark = %d, want 1", parked)
+	}
+}
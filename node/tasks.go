@@ -0,0 +1,414 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull   = errors.New("task queue full")
+	errQueueClosed = errors.New("node is shutting down")
+	errNotRunning  = errors.New("task is not running")
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 64
+)
+
+// TaskQueue is a bounded queue of task messages drained by a fixed pool of
+// workers. Enqueue never blocks: when the queue is full the task is rejected
+// so the sender sees backpressure instead of stalling the connection.
+//
+// Tasks wait in one queue per priority, and workers take high priority
+// tasks before normal ones and normal before low. A running low priority
+// task can be marked preemptible: it keeps running, as handlers cannot be
+// interrupted, but gives up its worker to a high priority task that would
+// otherwise wait, which then runs alongside it.
+type TaskQueue struct {
+	queues  [len(priorities)][]queuedTask
+	depth   int
+	size    int
+	workers int
+	// idle is how many workers are waiting for a task.
+	idle    int
+	running map[string]*runningTask
+	process func(ctx context.Context, msg Message, queued time.Time)
+	wg      sync.WaitGroup
+	closed  bool
+	// draining refuses new tasks while the queued ones still run.
+	draining bool
+	mutex    sync.Mutex
+	ready    *sync.Cond
+}
+
+func NewTaskQueue(workers, size int) *TaskQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+	q := &TaskQueue{
+		size:    size,
+		workers: workers,
+		running: make(map[string]*runningTask),
+	}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// queuedTask is a task waiting for a worker, when it was queued and the
+// context its handler runs with.
+type queuedTask struct {
+	ctx    context.Context
+	msg    Message
+	queued time.Time
+}
+
+// runningTask is a task a worker is running.
+type runningTask struct {
+	priority    string
+	preemptible bool
+	// lent is set once a high priority task took the task's worker.
+	lent bool
+}
+
+// Start launches the worker pool, calling process for each queued task with
+// its context and the time it was queued.
+func (q *TaskQueue) Start(process func(ctx context.Context, msg Message, queued time.Time)) {
+	q.mutex.Lock()
+	q.process = process
+	q.mutex.Unlock()
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				task, ok := q.next()
+				if !ok {
+					return
+				}
+				q.run(task)
+			}
+		}()
+	}
+}
+
+// next waits for a task and takes the one of highest priority. It returns
+// false once the queue is closed and empty.
+func (q *TaskQueue) next() (queuedTask, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.depth == 0 && !q.closed {
+		q.idle++
+		q.ready.Wait()
+		q.idle--
+	}
+	if q.depth == 0 {
+		return queuedTask{}, false
+	}
+	return q.pop(), true
+}
+
+// pop removes the queued task of highest priority. The caller must hold
+// the mutex and make sure there is one.
+func (q *TaskQueue) pop() queuedTask {
+	for i, tasks := range q.queues {
+		if len(tasks) > 0 {
+			task := tasks[0]
+			q.queues[i] = tasks[1:]
+			q.depth--
+			task.msg.Priority = priorities[i]
+			q.running[task.msg.TaskID] = &runningTask{priority: priorities[i]}
+			return task
+		}
+	}
+	panic("pop from an empty task queue")
+}
+
+// run processes task and forgets it once it is done.
+func (q *TaskQueue) run(task queuedTask) {
+	q.process(task.ctx, task.msg, task.queued)
+	q.mutex.Lock()
+	delete(q.running, task.msg.TaskID)
+	q.mutex.Unlock()
+}
+
+// lend runs queued high priority tasks on the workers of preemptible tasks
+// while no worker is idle. The caller must hold the mutex.
+func (q *TaskQueue) lend() {
+	for q.idle == 0 && len(q.queues[0]) > 0 && !q.closed {
+		var lender *runningTask
+		for _, r := range q.running {
+			if r.preemptible && !r.lent {
+				lender = r
+				break
+			}
+		}
+		if lender == nil {
+			return
+		}
+		lender.lent = true
+		task := q.pop()
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.run(task)
+		}()
+	}
+}
+
+// Enqueue adds a task at its priority, to be run with ctx, failing if the
+// queue is full or closed.
+func (q *TaskQueue) Enqueue(ctx context.Context, msg Message) error {
+	level, err := priorityLevel(msg.Priority)
+	if err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.draining {
+		return errQueueDraining
+	}
+	if q.depth >= q.size {
+		return errQueueFull
+	}
+	q.queues[level] = append(q.queues[level], queuedTask{ctx: ctx, msg: msg, queued: time.Now()})
+	q.depth++
+	q.ready.Signal()
+	q.lend()
+	return nil
+}
+
+// Steal takes up to max queued tasks from peers out of the queue for node
+// thief to run, the lowest priority and newest first: the ones that would
+// wait longest here. Client tasks are never taken, nor the tasks thief
+// sent, whose results it could not send itself.
+func (q *TaskQueue) Steal(max, thief int) []queuedTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var stolen []queuedTask
+	for level := len(q.queues) - 1; level >= 0 && len(stolen) < max; level-- {
+		tasks := q.queues[level]
+		for i := len(tasks) - 1; i >= 0 && len(stolen) < max; i-- {
+			if tasks[i].msg.Client || tasks[i].msg.From == thief {
+				continue
+			}
+			task := tasks[i]
+			task.msg.Priority = priorities[level]
+			stolen = append(stolen, task)
+			tasks = append(tasks[:i], tasks[i+1:]...)
+			q.depth--
+		}
+		q.queues[level] = tasks
+	}
+	return stolen
+}
+
+// Requeue puts tasks taken by Steal back at the head of their queues, in
+// their order, even if the queue has filled up since.
+func (q *TaskQueue) Requeue(tasks []queuedTask) {
+	if len(tasks) == 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := len(tasks) - 1; i >= 0; i-- {
+		level, _ := priorityLevel(tasks[i].msg.Priority)
+		q.queues[level] = append([]queuedTask{tasks[i]}, q.queues[level]...)
+		q.depth++
+	}
+	q.ready.Broadcast()
+	q.lend()
+}
+
+// Preempt marks the running low priority task id as preemptible.
+func (q *TaskQueue) Preempt(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r, ok := q.running[id]
+	switch {
+	case !ok:
+		return errNotRunning
+	case r.priority != PriorityLow:
+		return fmt.Errorf("task %s has %s priority; only low priority tasks can be preempted", id, r.priority)
+	}
+	r.preemptible = true
+	q.lend()
+	return nil
+}
+
+// Drain stops accepting tasks. Unlike Close, it leaves the workers running,
+// so the queued tasks still run.
+func (q *TaskQueue) Drain() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.draining = true
+}
+
+// Busy returns how many tasks are queued or running.
+func (q *TaskQueue) Busy() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.depth + len(q.running)
+}
+
+// Close stops accepting tasks. Workers finish whatever is already queued.
+func (q *TaskQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+// Wait blocks until every worker has exited after Close, or timeout passes.
+// It reports whether the workers finished.
+func (q *TaskQueue) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (q *TaskQueue) Depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.depth
+}
+
+// Idle returns how many workers are waiting for a task.
+func (q *TaskQueue) Idle() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.idle
+}
+
+func (q *TaskQueue) Capacity() int {
+	return q.size
+}
+
+func (n *Node) submitTask(msg Message) {
+	if err := n.checkPayload(msg); err != nil {
+		n.rejectTask(msg, invalidPayload(err))
+		return
+	}
+	if n.duplicateTask(msg) {
+		return
+	}
+	n.acceptTask(msg)
+	err := n.tasks.Enqueue(n.ctx, msg)
+	if err == nil {
+		return
+	}
+	n.dedup.reject(taskKey(msg))
+	defer n.finishTask(msg.TaskID)
+
+	reason := err.Error()
+	if err == errQueueFull {
+		reason = fmt.Sprintf("task queue full (%d tasks)", n.tasks.Capacity())
+	}
+	n.rejectTask(msg, Message{Type: "result", Error: reason})
+}
+
+// rejectTask answers task msg with result, a failed result, without
+// running it.
+func (n *Node) rejectTask(msg Message, result Message) {
+	n.peerLogger(msg.From, msg.Type).Warn("rejecting task", "task", msg.TaskID, "reason", result.Error)
+	span := n.startSpan("task.run", msg)
+	result.From = n.ID
+	result.TaskID = msg.TaskID
+	result.RequestID = msg.RequestID
+	n.sendMessage(msg.From, span.stamp(result))
+	span.end("task", msg.TaskID, "error", result.Error)
+}
+
+// taskProgress returns the Progress a handler running task msg reports
+// through: it sends progress messages to the submitter, if it supports them.
+// Client tasks get only their result.
+func (n *Node) taskProgress(msg Message) Progress {
+	if msg.Client || !n.PeerSupports(msg.From, CapProgress) {
+		return func(int, string) {}
+	}
+	return func(percent int, partial string) {
+		n.sendMessage(msg.From, Message{
+			Type:     "progress",
+			From:     n.ID,
+			TaskID:   msg.TaskID,
+			TaskType: msg.TaskType,
+			Progress: min(max(percent, 0), 100),
+			Content:  partial,
+			TraceID:  msg.TraceID,
+		})
+	}
+}
+
+// processTask runs task msg's handler with ctx, ended once the task's
+// timeout has passed since it was queued, and sends back the result. A task
+// whose context ended while it was queued is not run.
+func (n *Node) processTask(ctx context.Context, msg Message, queued time.Time) {
+	n.peerLogger(msg.From, msg.Type).Info("processing task", "task", msg.TaskID, "task_type", msg.TaskType, "content", msg.Content)
+	span := n.startSpanAt("task.run", msg, queued)
+	if msg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, queued.Add(msg.Timeout))
+		defer cancel()
+	}
+	start := time.Now()
+	var (
+		result string
+		err    error
+	)
+	if err = ctx.Err(); err != nil {
+		err = fmt.Errorf("task not run: %w", err)
+	} else {
+		result, err = n.runHandler(ctx, msg.TaskType, msg.Content, n.taskProgress(msg))
+	}
+	n.metrics.TaskProcessed(time.Since(start))
+
+	reply := span.stamp(Message{
+		Type:      "result",
+		Content:   result,
+		From:      n.ID,
+		TaskID:    msg.TaskID,
+		TaskType:  msg.TaskType,
+		RequestID: msg.RequestID,
+	})
+	if err != nil {
+		n.peerLogger(msg.From, msg.Type).Warn("task failed", "task", msg.TaskID, "err", err)
+		reply.Error = err.Error()
+	}
+	span.end("task", msg.TaskID, "task_type", msg.TaskType, "queued", start.Sub(queued), "error", reply.Error)
+	if key := taskKey(msg); key != "" {
+		n.dedup.finish(key, reply)
+	}
+	if msg.Client {
+		n.deliver(reply)
+		return
+	}
+	n.sendReliable(msg.From, reply, 0)
+	n.finishTask(msg.TaskID)
+	n.returnStolen(msg, reply)
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig points at the PEM files used for mutual TLS between nodes. Every
+// node presents its certificate both when accepting and when dialing, and
+// only peers whose certificate is signed by CA are accepted.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != "" || c.CA != ""
+}
+
+func (c TLSConfig) validate() error {
+	if c.Cert == "" || c.Key == "" || c.CA == "" {
+		return fmt.Errorf("tls requires cert, key and ca together")
+	}
+	return nil
+}
+
+// Load builds a tls.Config requiring and verifying peer certificates in both
+// directions.
+func (c TLSConfig) Load() (*tls.Config, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(c.CA)
+	if err != nil {
+		return nil, fmt.Errorf("read tls ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", c.CA)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// A trace follows one request as it hops between nodes: the task a node
+// sends, the node that runs it and the result coming back, or a KV request,
+// the node forwarding it, its coordinator and the replicas. Every message
+// sent on behalf of a request carries the trace id and the id of the span
+// that sent it, and each node logs a "span" entry for its step with the
+// time it took, so grepping the logs of every node for a trace id shows
+// where the request's latency was added.
+//
+// Spans are logged at debug level, or at info level with the trace config
+// option.
+
+// span is one step of a traced request on this node.
+type span struct {
+	node   *Node
+	name   string
+	trace  string
+	id     string
+	parent string
+	start  time.Time
+}
+
+func newTraceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func newSpanID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// startSpan begins a span named name for handling msg, as a child of the
+// span that sent it. A message that is not part of a trace starts a new
+// one.
+func (n *Node) startSpan(name string, msg Message) *span {
+	return n.startSpanAt(name, msg, time.Now())
+}
+
+// startSpanAt is startSpan for a step that began at start, e.g. when a task
+// was queued.
+func (n *Node) startSpanAt(name string, msg Message, start time.Time) *span {
+	trace := msg.TraceID
+	if trace == "" {
+		trace = newTraceID()
+	}
+	return &span{node: n, name: name, trace: trace, id: newSpanID(), parent: msg.SpanID, start: start}
+}
+
+// stamp returns msg as sent from within the span: the receiver's spans
+// become its children.
+func (s *span) stamp(msg Message) Message {
+	msg.TraceID = s.trace
+	msg.SpanID = s.id
+	return msg
+}
+
+// end logs the span with its duration and any further attributes given as
+// key-value pairs. Pairs with an empty string value are left out.
+func (s *span) end(attrs ...any) {
+	level := slog.LevelDebug
+	if s.node.config.Trace {
+		level = slog.LevelInfo
+	}
+	if !s.node.logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	args := []any{"trace", s.trace, "span", s.id, "name", s.name}
+	if s.parent != "" {
+		args = append(args, "parent", s.parent)
+	}
+	args = append(args, "duration", time.Since(s.start))
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if v, ok := attrs[i+1].(string); !ok || v != "" {
+			args = append(args, attrs[i], attrs[i+1])
+		}
+	}
+	s.node.logger.Log(context.Background(), level, "span", args...)
+}
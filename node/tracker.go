@@ -0,0 +1,344 @@
+package node
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxCompletedTasks = 100
+
+const (
+	TaskPending   = "pending"
+	TaskCompleted = "completed"
+	TaskFailed    = "failed"
+)
+
+// TaskRecord is the sender-side view of a task sent to another node.
+type TaskRecord struct {
+	ID          string    `json:"id"`
+	Target      int       `json:"target"`
+	TaskType    string    `json:"task_type,omitempty"`
+	Content     string    `json:"content"`
+	Status      string    `json:"status"`
+	Result      string    `json:"result,omitempty"`
+	SentAt      time.Time `json:"sent_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	TraceID     string    `json:"trace_id,omitempty"`
+	// Progress and Partial are the last progress the task's handler
+	// reported while it ran, in percent, and the partial output with it.
+	Progress int    `json:"progress,omitempty"`
+	Partial  string `json:"partial,omitempty"`
+
+	// span covers the task from sending to its result.
+	span *span
+}
+
+func (t TaskRecord) Latency() time.Duration {
+	if t.CompletedAt.IsZero() {
+		return time.Since(t.SentAt)
+	}
+	return t.CompletedAt.Sub(t.SentAt)
+}
+
+// TaskTracker correlates results with the tasks this node sent. Completed
+// tasks are kept for inspection, up to maxCompletedTasks.
+type TaskTracker struct {
+	tasks     map[string]*TaskRecord
+	completed []string
+	mutex     sync.Mutex
+	wal       *WAL
+}
+
+func NewTaskTracker() *TaskTracker {
+	return &TaskTracker{
+		tasks: make(map[string]*TaskRecord),
+	}
+}
+
+// newTaskID returns a random RFC 4122 version 4 UUID.
+func newTaskID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (t *TaskTracker) Add(id string, target int, taskType, content string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.log(WALEntry{Op: walTask, TaskID: id, Target: target, TaskType: taskType, Content: content})
+	t.tasks[id] = &TaskRecord{
+		ID:       id,
+		Target:   target,
+		TaskType: taskType,
+		Content:  content,
+		Status:   TaskPending,
+		SentAt:   time.Now(),
+	}
+}
+
+// trace records the span covering task id until its result arrives.
+func (t *TaskTracker) trace(id string, s *span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if task, ok := t.tasks[id]; ok {
+		task.TraceID = s.trace
+		task.span = s
+	}
+}
+
+// log appends entry to the WAL, if any. The caller must hold t.mutex.
+func (t *TaskTracker) log(entry WALEntry) {
+	if t.wal == nil {
+		return
+	}
+	if err := t.wal.Append(entry); err != nil {
+		t.wal.logger.Error("failed to write WAL entry", "task", entry.TaskID, "err", err)
+	}
+}
+
+// load adds a task record from a snapshot, logging it as a submission and,
+// if it had finished, a completion.
+func (t *TaskTracker) load(task TaskRecord) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.tasks[task.ID]; ok {
+		return
+	}
+	t.log(WALEntry{Op: walTask, TaskID: task.ID, Target: task.Target, TaskType: task.TaskType, Content: task.Content})
+	record := task
+	record.Status = TaskPending
+	t.tasks[task.ID] = &record
+	if task.Status != TaskPending {
+		t.log(WALEntry{Op: walTaskDone, TaskID: task.ID, Result: task.Result, Failed: task.Status == TaskFailed})
+		t.finish(&record, task.Result, task.Status == TaskFailed, task.CompletedAt)
+	}
+}
+
+// restore applies a task entry replayed from the WAL.
+func (t *TaskTracker) restore(entry WALEntry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch entry.Op {
+	case walTask:
+		t.tasks[entry.TaskID] = &TaskRecord{
+			ID:       entry.TaskID,
+			Target:   entry.Target,
+			TaskType: entry.TaskType,
+			Content:  entry.Content,
+			Status:   TaskPending,
+			SentAt:   entry.Time,
+		}
+	case walTaskDone:
+		task, ok := t.tasks[entry.TaskID]
+		if !ok {
+			return
+		}
+		t.finish(task, entry.Result, entry.Failed, entry.Time)
+	}
+}
+
+// finish marks task completed and trims old completed tasks. The caller must
+// hold t.mutex.
+func (t *TaskTracker) finish(task *TaskRecord, result string, failed bool, at time.Time) {
+	task.Status = TaskCompleted
+	if failed {
+		task.Status = TaskFailed
+	}
+	task.Result = result
+	task.CompletedAt = at
+
+	t.completed = append(t.completed, task.ID)
+	if len(t.completed) > maxCompletedTasks {
+		delete(t.tasks, t.completed[0])
+		t.completed = t.completed[1:]
+	}
+}
+
+// Complete records the result for a pending task and returns the updated
+// record, or false if the task is unknown or already completed.
+func (t *TaskTracker) Complete(id, result string, failed bool) (TaskRecord, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	task, ok := t.tasks[id]
+	if !ok || task.Status != TaskPending {
+		return TaskRecord{}, false
+	}
+
+	t.log(WALEntry{Op: walTaskDone, TaskID: id, Result: result, Failed: failed})
+	t.finish(task, result, failed, time.Now())
+	return *task, true
+}
+
+// Progress records the progress reported for a pending task. It reports
+// false if the task is unknown or already completed.
+func (t *TaskTracker) Progress(id string, percent int, partial string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	task, ok := t.tasks[id]
+	if !ok || task.Status != TaskPending {
+		return false
+	}
+	task.Progress = percent
+	task.Partial = partial
+	return true
+}
+
+// Get returns a copy of the task with the given id.
+func (t *TaskTracker) Get(id string) (TaskRecord, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	task, ok := t.tasks[id]
+	if !ok {
+		return TaskRecord{}, false
+	}
+	return *task, true
+}
+
+// PendingByTarget counts the pending tasks sent to each node.
+func (t *TaskTracker) PendingByTarget() map[int]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counts := make(map[int]int)
+	for _, task := range t.tasks {
+		if task.Status == TaskPending {
+			counts[task.Target]++
+		}
+	}
+	return counts
+}
+
+// List returns all tracked tasks, oldest first.
+func (t *TaskTracker) List() []TaskRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]TaskRecord, 0, len(t.tasks))
+	for _, task := range t.tasks {
+		list = append(list, *task)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SentAt.Before(list[j].SentAt)
+	})
+	return list
+}
+
+// SendTask sends content as a task of taskType to targetID and starts
+// tracking it. It returns the generated task ID; the result is delivered to
+// the OnMessage handlers. If the task cannot be queued for the peer (see
+// Send), the error is returned as well and the task is recorded as failed
+// instead of being retried.
+func (n *Node) SendTask(targetID int, taskType, content string) (string, error) {
+	return n.SendIdempotentTask(targetID, "", taskType, content)
+}
+
+// SendIdempotentTask is SendTask with an idempotency key: if the target has
+// already run a task with the same key, e.g. one sent before a timeout, it
+// does not run this one but answers with that task's result. An empty key
+// only guards against retransmissions, as SendTask does.
+func (n *Node) SendIdempotentTask(targetID int, key, taskType, content string) (string, error) {
+	return n.SendTaskWithOptions(targetID, taskType, content, TaskOptions{Key: key})
+}
+
+// SendTaskWithOptions is SendTask with an idempotency key, a priority and a
+// timeout.
+func (n *Node) SendTaskWithOptions(targetID int, taskType, content string, opts TaskOptions) (string, error) {
+	if _, err := ParsePriority(opts.Priority); err != nil {
+		return "", err
+	}
+	id := newTaskID()
+	return id, n.sendTask(id, targetID, taskType, content, opts)
+}
+
+// sendTask sends and tracks task id; see SendTaskWithOptions.
+func (n *Node) sendTask(id string, targetID int, taskType, content string, opts TaskOptions) error {
+	priority, err := ParsePriority(opts.Priority)
+	if err != nil {
+		return err
+	}
+	span := n.startSpan("task.send", Message{})
+	n.tracker.Add(id, targetID, taskType, content)
+	n.tracker.trace(id, span)
+	sent, err := n.sendReliable(targetID, span.stamp(Message{
+		Type:           "task",
+		Content:        content,
+		From:           n.ID,
+		TaskID:         id,
+		TaskType:       taskType,
+		IdempotencyKey: opts.Key,
+		Priority:       priority,
+		Timeout:        opts.Timeout,
+	}), n.config.SendTimeout)
+	if err != nil {
+		// The caller learns the task was not sent, so it is not retried
+		// behind their back
+		n.retransmit.ack(targetID, sent.Seq)
+		n.completeTask(id, targetID, fmt.Sprintf("not sent: %v", err), true)
+		return err
+	}
+	return nil
+}
+
+// completeTask records the outcome of task id sent to target and ends its
+// span. A failed task goes to the dead-letter queue. It reports false if
+// the task is not pending.
+func (n *Node) completeTask(id string, target int, result string, failed bool) bool {
+	task, ok := n.tracker.Complete(id, result, failed)
+	if !ok {
+		return false
+	}
+	if task.span != nil {
+		errText := ""
+		if failed {
+			errText = result
+		}
+		task.span.end("task", id, "target", target, "error", errText)
+	}
+	if failed {
+		n.deadLetter(task, result)
+	} else {
+		n.deadLetters.forget(id)
+	}
+	return true
+}
+
+func (n *Node) handleResult(msg Message) {
+	result := msg.Content
+	if msg.Error != "" {
+		result = msg.Error
+	}
+	n.completeTask(msg.TaskID, msg.From, result, msg.Error != "")
+	if msg.RequestID == "" || !n.deliver(msg) {
+		n.notify(msg)
+	}
+}
+
+// handleProgress records progress reported for a task this node sent and
+// passes it on to the OnMessage handlers.
+func (n *Node) handleProgress(msg Message) {
+	if n.tracker.Progress(msg.TaskID, msg.Progress, msg.Content) {
+		n.notify(msg)
+	}
+}
+
+// Tasks returns the tasks this node has sent, oldest first.
+func (n *Node) Tasks() []TaskRecord {
+	return n.tracker.List()
+}
+
+// Task returns the tracked task with the given id.
+func (n *Node) Task(id string) (TaskRecord, bool) {
+	return n.tracker.Get(id)
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options that can be changed while the node runs, with SetOption.
+const (
+	// OptionHeartbeatInterval is how often heartbeats are sent. Election
+	// timeouts and the leader's lease scale with it.
+	OptionHeartbeatInterval = "heartbeat.interval"
+	// OptionSuspectTimeout is how long a silent peer goes before it is
+	// suspected; it is declared dead after twice as long. "0" makes it
+	// follow the heartbeat interval, at three intervals.
+	OptionSuspectTimeout = "heartbeat.suspect_timeout"
+	// OptionReplication is the number of replicas of each key. Keys written
+	// before a change reach their new replicas through anti-entropy.
+	OptionReplication = "replication"
+)
+
+// timing holds the heartbeat settings, which start out as configured and
+// can be changed at runtime. The loops that depend on them wait on changed,
+// which is closed and replaced on every change, to pick up new values.
+type timing struct {
+	mutex    sync.RWMutex
+	interval time.Duration
+	// suspect is the configured suspect timeout, 0 to derive it from
+	// interval.
+	suspect time.Duration
+	changed chan struct{}
+}
+
+func newTiming(cfg Config) *timing {
+	return &timing{interval: cfg.HeartbeatInterval, suspect: cfg.SuspectTimeout, changed: make(chan struct{})}
+}
+
+// suspectTimeout returns the effective suspect timeout. The caller must
+// hold t.mutex.
+func (t *timing) suspectTimeout() time.Duration {
+	if t.suspect == 0 {
+		return t.interval * 3
+	}
+	return t.suspect
+}
+
+// heartbeatInterval returns the current heartbeat interval.
+func (n *Node) heartbeatInterval() time.Duration {
+	n.timing.mutex.RLock()
+	defer n.timing.mutex.RUnlock()
+
+	return n.timing.interval
+}
+
+// timingChanged returns a channel that is closed the next time the
+// heartbeat settings change.
+func (n *Node) timingChanged() <-chan struct{} {
+	n.timing.mutex.RLock()
+	defer n.timing.mutex.RUnlock()
+
+	return n.timing.changed
+}
+
+// replication returns the current number of replicas of each key.
+func (n *Node) replication() int {
+	return int(n.replicationFactor.Load())
+}
+
+// Options returns the current value of every option SetOption accepts.
+func (n *Node) Options() map[string]string {
+	n.timing.mutex.RLock()
+	defer n.timing.mutex.RUnlock()
+
+	return map[string]string{
+		OptionHeartbeatInterval: n.timing.interval.String(),
+		OptionSuspectTimeout:    n.timing.suspectTimeout().String(),
+		OptionReplication:       strconv.Itoa(n.replication()),
+	}
+}
+
+// OptionNames returns the names of the options SetOption accepts, sorted.
+func OptionNames() []string {
+	names := []string{OptionHeartbeatInterval, OptionSuspectTimeout, OptionReplication}
+	sort.Strings(names)
+	return names
+}
+
+// isOption reports whether name is an option SetOption accepts.
+func isOption(name string) bool {
+	return name == OptionHeartbeatInterval || name == OptionSuspectTimeout || name == OptionReplication
+}
+
+// setOption parses value into the field of c that option name sets.
+func (c *Config) setOption(name, value string) error {
+	switch name {
+	case OptionHeartbeatInterval, OptionSuspectTimeout:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		if name == OptionHeartbeatInterval {
+			c.HeartbeatInterval = d
+		} else {
+			c.SuspectTimeout = d
+		}
+	case OptionReplication:
+		replication, err := strconv.Atoi(value)
+		if err != nil || replication < 1 {
+			return fmt.Errorf("invalid %s %q: must be at least 1", name, value)
+		}
+		c.Replication = replication
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// configuredOption returns the value of option name this node was started
+// with.
+func (n *Node) configuredOption(name string) string {
+	switch name {
+	case OptionHeartbeatInterval:
+		return n.config.HeartbeatInterval.String()
+	case OptionSuspectTimeout:
+		return n.config.SuspectTimeout.String()
+	case OptionReplication:
+		return strconv.Itoa(n.config.Replication)
+	}
+	return ""
+}
+
+// SetOption changes a runtime option of this node, e.g. heartbeat.interval
+// to 2s. The heartbeat, election and failure detector loops pick the new
+// value up at once; no restart is needed. Options set here apply to this
+// node only; set them in the cluster config (see SetClusterConfig) to
+// change them on every node.
+func (n *Node) SetOption(name, value string) error {
+	n.timing.mutex.Lock()
+	cfg := Config{HeartbeatInterval: n.timing.interval, SuspectTimeout: n.timing.suspect, Replication: n.replication()}
+	if err := cfg.setOption(name, value); err != nil {
+		n.timing.mutex.Unlock()
+		return err
+	}
+	if err := cfg.validateTiming(); err != nil {
+		n.timing.mutex.Unlock()
+		return err
+	}
+	n.replicationFactor.Store(int64(cfg.Replication))
+	if name == OptionReplication {
+		n.timing.mutex.Unlock()
+		n.logger.Info("option changed", "option", name, "value", value)
+		return nil
+	}
+	n.timing.interval, n.timing.suspect = cfg.HeartbeatInterval, cfg.SuspectTimeout
+	suspectTimeout := n.timing.suspectTimeout()
+	close(n.timing.changed)
+	n.timing.changed = make(chan struct{})
+	n.timing.mutex.Unlock()
+
+	n.detector.SetTimeouts(suspectTimeout, suspectTimeout*2)
+	n.logger.Info("option changed", "option", name, "value", value)
+	return nil
+}
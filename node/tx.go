@@ -0,0 +1,586 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// A transaction writes several keys atomically, even when different nodes
+// coordinate them, with two-phase commit driven by the node it was
+// submitted to:
+//
+//  1. The coordinator sends each node coordinating some of the keys a
+//     tx_prepare with its share of the writes. The node locks those keys,
+//     refusing if another transaction holds any of them, and votes.
+//  2. If every node voted yes, the coordinator records its decision and
+//     sends tx_commit, and each node applies its writes, replicating them
+//     like any other, and unlocks the keys. The coordinator resends
+//     tx_commit until every node has acknowledged it. Otherwise, or if a
+//     vote does not arrive within txTimeout, it sends tx_abort and the
+//     nodes unlock the keys without writing.
+//
+// While a key is locked, plain writes to it fail; reads see the value from
+// before the transaction. A node that voted yes cannot abort by itself, as
+// the coordinator may have decided to commit: once it has waited
+// txLockTimeout for the decision, it asks the coordinator with tx_status,
+// and keeps the keys locked, asking again, until it learns the decision.
+// The coordinator answers abort for a transaction it neither runs nor holds
+// a commit decision for. With a data directory, decisions and prepared
+// writes are recorded in the WAL, so neither side loses them in a restart.
+
+const (
+	// txTimeout bounds each phase of a transaction on the coordinator, and
+	// is how often an unacknowledged commit is resent.
+	txTimeout = 2 * time.Second
+	// txLockTimeout is how long a prepared transaction waits for the
+	// coordinator's decision before asking for it, and how often it asks
+	// again. It is well beyond txTimeout, so a coordinator that decided to
+	// commit usually gets its commit there first.
+	txLockTimeout = 5 * txTimeout
+)
+
+// Decisions on a transaction, as tx_status reports them.
+const (
+	txCommit  = "commit"
+	txAbort   = "abort"
+	txPending = "pending"
+)
+
+// TxOp is one write of a transaction: a set or del of Key.
+type TxOp struct {
+	Op    string        `json:"op"`
+	Key   string        `json:"key"`
+	Value string        `json:"value,omitempty"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+}
+
+// ErrTxAborted is returned by Transaction when the transaction was rolled
+// back and none of its writes were applied.
+var ErrTxAborted = errors.New("transaction aborted")
+
+// preparedTx is a transaction this node voted to commit, holding the locks
+// on its keys until the coordinator's decision arrives.
+type preparedTx struct {
+	coordinator int
+	writes      map[string]Entry
+	expiry      *time.Timer
+	// committing is set while the writes are being applied.
+	committing bool
+}
+
+// txLocks tracks the keys locked by prepared transactions, and the
+// transactions this node coordinates: those still deciding, and those
+// decided to commit until every participant has acknowledged the commit.
+type txLocks struct {
+	mutex      sync.Mutex
+	owners     map[string]string
+	prepared   map[string]*preparedTx
+	deciding   map[string]bool
+	committing map[string]map[int]map[string]Entry
+	wal        *WAL
+}
+
+func newTxLocks() *txLocks {
+	return &txLocks{
+		owners:     make(map[string]string),
+		prepared:   make(map[string]*preparedTx),
+		deciding:   make(map[string]bool),
+		committing: make(map[string]map[int]map[string]Entry),
+	}
+}
+
+// lock takes the locks on keys for tx, all or none, and records them in
+// the WAL. It fails naming a key another transaction holds.
+func (l *txLocks) lock(tx string, p *preparedTx) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.prepared[tx]; ok {
+		return fmt.Errorf("transaction %s is already prepared", tx)
+	}
+	for key := range p.writes {
+		if owner, locked := l.owners[key]; locked {
+			return fmt.Errorf("key %s is locked by transaction %s", key, owner)
+		}
+	}
+	if l.wal != nil {
+		writes, err := json.Marshal(p.writes)
+		if err != nil {
+			return err
+		}
+		if err := l.wal.Append(WALEntry{Op: walTxPrepared, Tx: tx, From: p.coordinator, Value: string(writes)}); err != nil {
+			return fmt.Errorf("record prepared transaction: %v", err)
+		}
+	}
+	for key := range p.writes {
+		l.owners[key] = tx
+	}
+	l.prepared[tx] = p
+	return nil
+}
+
+// release drops tx's locks and returns it, or nil if it is not prepared.
+func (l *txLocks) release(tx string) *preparedTx {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	p, ok := l.prepared[tx]
+	if !ok {
+		return nil
+	}
+	for key := range p.writes {
+		delete(l.owners, key)
+	}
+	delete(l.prepared, tx)
+	if p.expiry != nil {
+		p.expiry.Stop()
+	}
+	if l.wal != nil {
+		if err := l.wal.Append(WALEntry{Op: walTxResolved, Tx: tx}); err != nil {
+			l.wal.logger.Error("failed to record resolved transaction", "tx", tx, "err", err)
+		}
+	}
+	return p
+}
+
+// claim returns prepared transaction tx for committing, or nil if it is
+// not prepared. It fails while tx is being committed already.
+func (l *txLocks) claim(tx string) (*preparedTx, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	p := l.prepared[tx]
+	if p == nil {
+		return nil, nil
+	}
+	if p.committing {
+		return nil, fmt.Errorf("transaction %s is being committed", tx)
+	}
+	p.committing = true
+	return p, nil
+}
+
+// unclaim returns tx to waiting for its commit, after applying it failed.
+func (l *txLocks) unclaim(tx string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if p := l.prepared[tx]; p != nil {
+		p.committing = false
+	}
+}
+
+// expire sets the timer of prepared transaction tx, restored from the WAL,
+// or stops it if tx is no longer prepared.
+func (l *txLocks) expire(tx string, expiry *time.Timer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if p := l.prepared[tx]; p != nil {
+		p.expiry = expiry
+		return
+	}
+	expiry.Stop()
+}
+
+// get returns prepared transaction tx, or nil.
+func (l *txLocks) get(tx string) *preparedTx {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.prepared[tx]
+}
+
+// owner returns the transaction holding key, or "".
+func (l *txLocks) owner(key string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.owners[key]
+}
+
+// begin records that this node is deciding tx.
+func (l *txLocks) begin(tx string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.deciding[tx] = true
+}
+
+// decide records the decision on tx: commit with shares, or abort if
+// shares is nil. A commit is recorded in the WAL before it is sent, and
+// fails if it cannot be.
+func (l *txLocks) decide(tx string, shares map[int]map[string]Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.deciding, tx)
+	if shares == nil {
+		return nil
+	}
+	if l.wal != nil {
+		data, err := json.Marshal(shares)
+		if err != nil {
+			return err
+		}
+		if err := l.wal.Append(WALEntry{Op: walTxCommit, Tx: tx, Value: string(data)}); err != nil {
+			return fmt.Errorf("record commit decision: %v", err)
+		}
+	}
+	l.committing[tx] = shares
+	return nil
+}
+
+// committed forgets the commit decision on tx once every participant has
+// acknowledged it.
+func (l *txLocks) committed(tx string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.committing, tx)
+	if l.wal != nil {
+		if err := l.wal.Append(WALEntry{Op: walTxDone, Tx: tx}); err != nil {
+			l.wal.logger.Error("failed to record committed transaction", "tx", tx, "err", err)
+		}
+	}
+}
+
+// decision returns the decision on tx, a transaction this node coordinates.
+func (l *txLocks) decision(tx string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case l.deciding[tx]:
+		return txPending
+	case l.committing[tx] != nil:
+		return txCommit
+	}
+	return txAbort
+}
+
+// restore applies a transaction entry replayed from the WAL.
+func (l *txLocks) restore(entry WALEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch entry.Op {
+	case walTxPrepared:
+		p := &preparedTx{coordinator: entry.From}
+		if err := json.Unmarshal([]byte(entry.Value), &p.writes); err != nil {
+			return err
+		}
+		for key := range p.writes {
+			l.owners[key] = entry.Tx
+		}
+		l.prepared[entry.Tx] = p
+	case walTxResolved:
+		if p := l.prepared[entry.Tx]; p != nil {
+			for key := range p.writes {
+				delete(l.owners, key)
+			}
+			delete(l.prepared, entry.Tx)
+		}
+	case walTxCommit:
+		var shares map[int]map[string]Entry
+		if err := json.Unmarshal([]byte(entry.Value), &shares); err != nil {
+			return err
+		}
+		l.committing[entry.Tx] = shares
+	case walTxDone:
+		delete(l.committing, entry.Tx)
+	}
+	return nil
+}
+
+// unresolved returns the prepared transactions and the commit decisions
+// not yet acknowledged, as restored from the WAL.
+func (l *txLocks) unresolved() (map[string]*preparedTx, map[string]map[int]map[string]Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return maps.Clone(l.prepared), maps.Clone(l.committing)
+}
+
+// Transaction applies ops atomically: either every write is applied, or
+// none is and the returned error wraps ErrTxAborted. Several ops on one key
+// collapse into the last. Any other error means a node did not acknowledge
+// the commit in time, so some writes may not have been applied yet; the
+// commit is resent until they are.
+func (n *Node) Transaction(ops []TxOp) error {
+	if reason := n.refuseKV(Message{Type: "set"}); reason != "" {
+		return errors.New(reason)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	writes := make(map[string]Entry, len(ops))
+	for _, op := range ops {
+		switch op.Op {
+		case "set":
+			writes[op.Key] = Entry{Value: op.Value, Expires: transport.ExpiresAt(op.TTL)}
+		case "del":
+			writes[op.Key] = Entry{Deleted: true}
+		default:
+			return fmt.Errorf("unsupported transaction op %q", op.Op)
+		}
+	}
+
+	// Each node prepares the writes to the keys it coordinates
+	shares := make(map[int]map[string]Entry)
+	for key, e := range writes {
+		coordinator := n.coordinator(key)
+		if coordinator < 0 {
+			return fmt.Errorf("%w: no replica of %s is reachable", ErrTxAborted, key)
+		}
+		if coordinator != n.ID && !n.PeerSupports(coordinator, CapTx) {
+			return fmt.Errorf("%w: node %d does not support transactions", ErrTxAborted, coordinator)
+		}
+		if shares[coordinator] == nil {
+			shares[coordinator] = make(map[string]Entry)
+		}
+		shares[coordinator][key] = e
+	}
+
+	tx := newTaskID()
+	span := n.startSpan("tx", Message{})
+	defer span.end("tx", tx)
+
+	n.txLocks.begin(tx)
+	err := n.txPhase(span, tx, "tx_prepare", shares)
+	if err == nil {
+		err = n.txLocks.decide(tx, shares)
+	} else {
+		n.txLocks.decide(tx, nil)
+	}
+	if err != nil {
+		n.txPhase(span, tx, "tx_abort", shares)
+		return fmt.Errorf("%w: %v", ErrTxAborted, err)
+	}
+	if err := n.txPhase(span, tx, "tx_commit", shares); err != nil {
+		go n.retryCommit(tx, shares)
+		return err
+	}
+	n.txLocks.committed(tx)
+	return nil
+}
+
+// retryCommit resends tx_commit for tx every txTimeout until every
+// participant has acknowledged it.
+func (n *Node) retryCommit(tx string, shares map[int]map[string]Entry) {
+	ticker := time.NewTicker(txTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		span := n.startSpan("tx.retry", Message{})
+		err := n.txPhase(span, tx, "tx_commit", shares)
+		span.end("tx", tx)
+		if err == nil {
+			n.txLocks.committed(tx)
+			return
+		}
+		n.logger.Warn("transaction commit not acknowledged, resending", "tx", tx, "err", err)
+	}
+}
+
+// txPhase sends msgType for tx to every participant, each with its share of
+// the writes, and waits for them all to answer. This node takes part
+// directly. Aborts are not waited for: a participant that misses one asks
+// for the decision once its locks time out.
+func (n *Node) txPhase(span *span, tx, msgType string, shares map[int]map[string]Entry) error {
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		errs     []error
+	)
+	for id, writes := range shares {
+		msg := span.stamp(Message{Type: msgType, From: n.ID, Tx: tx, Entries: writes})
+		if id != n.ID && msgType == "tx_abort" {
+			n.sendMessage(id, msg)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if id == n.ID {
+				if err = n.handleTx(msg); err != nil {
+					err = fmt.Errorf("node %d: %w", n.ID, err)
+				}
+			} else {
+				_, err = n.Call(id, msg, txTimeout)
+			}
+			if err != nil {
+				errMutex.Lock()
+				errs = append(errs, err)
+				errMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// handleTxMessage answers a transaction message from the coordinator, or a
+// participant's tx_status. Commits replicate their writes, which blocks, so
+// they do not run on the connection's read loop.
+func (n *Node) handleTxMessage(msg Message) {
+	if msg.Type == "tx_status" {
+		n.Reply(msg, Message{Type: "tx_result", Content: n.txLocks.decision(msg.Tx)})
+		return
+	}
+	answer := func() {
+		if err := n.handleTx(msg); err != nil {
+			n.Reply(msg, Message{Type: "tx_result", Error: err.Error()})
+			return
+		}
+		if msg.Type != "tx_abort" {
+			n.Reply(msg, Message{Type: "tx_result"})
+		}
+	}
+	if msg.Type == "tx_commit" {
+		go answer()
+		return
+	}
+	answer()
+}
+
+// handleTx prepares, commits or aborts this node's share of a transaction.
+func (n *Node) handleTx(msg Message) error {
+	switch msg.Type {
+	case "tx_prepare":
+		if reason := n.refuseKV(Message{Type: "set"}); reason != "" {
+			return errors.New(reason)
+		}
+		p := &preparedTx{coordinator: msg.From, writes: msg.Entries}
+		p.expiry = n.awaitDecision(msg.Tx, p)
+		if err := n.txLocks.lock(msg.Tx, p); err != nil {
+			p.expiry.Stop()
+			return err
+		}
+		return nil
+
+	case "tx_commit":
+		return n.commitTx(msg)
+
+	case "tx_abort":
+		n.txLocks.release(msg.Tx)
+		return nil
+	}
+	return fmt.Errorf("unknown transaction message %q", msg.Type)
+}
+
+// commitTx applies this node's share of committed transaction msg.Tx and
+// unlocks its keys. A transaction not prepared here was committed already,
+// as only a commit decision is resent. If a write fails the keys stay
+// locked, for the coordinator to resend the commit.
+func (n *Node) commitTx(msg Message) error {
+	p, err := n.txLocks.claim(msg.Tx)
+	if err != nil || p == nil {
+		return err
+	}
+
+	span := n.startSpan("tx.commit", msg)
+	defer span.end("tx", msg.Tx)
+
+	// Keys are written in order so concurrent replicas see the same
+	// sequence
+	keys := make([]string, 0, len(p.writes))
+	for key := range p.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var failed []string
+	for _, key := range keys {
+		e := p.writes[key]
+		write := span.stamp(Message{Type: "set", From: n.ID, Key: key, Value: e.Value, Tx: msg.Tx})
+		if e.Deleted {
+			write.Type = "del"
+		}
+		if e.Expires != 0 {
+			write.TTL = max(time.Until(time.UnixMilli(e.Expires)), time.Millisecond)
+		}
+		if reply := n.serveKV(write); reply.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", key, reply.Error))
+		}
+	}
+	if len(failed) > 0 {
+		n.txLocks.unclaim(msg.Tx)
+		return errors.New(strings.Join(failed, "; "))
+	}
+	n.txLocks.release(msg.Tx)
+	return nil
+}
+
+// awaitDecision returns the timer that asks the coordinator of prepared
+// transaction tx for its decision if it has not arrived within
+// txLockTimeout, and again every txLockTimeout until it is known.
+func (n *Node) awaitDecision(tx string, p *preparedTx) *time.Timer {
+	return time.AfterFunc(txLockTimeout, func() {
+		if n.txLocks.get(tx) != p {
+			return
+		}
+		logger := n.peerLogger(p.coordinator, "tx_status").With("tx", tx)
+		decision, err := n.txDecision(p.coordinator, tx)
+		switch {
+		case err != nil:
+			logger.Warn("cannot reach the coordinator of a prepared transaction, keeping its locks", "err", err)
+		case decision == txCommit:
+			logger.Info("committing transaction whose commit was missed")
+			if err := n.commitTx(Message{Type: "tx_commit", From: p.coordinator, Tx: tx}); err != nil {
+				logger.Warn("failed to commit transaction, keeping its locks", "err", err)
+			}
+		case decision == txAbort:
+			logger.Warn("aborting transaction whose abort was missed")
+			n.txLocks.release(tx)
+			return
+		}
+		if n.txLocks.get(tx) == p {
+			p.expiry.Reset(txLockTimeout)
+		}
+	})
+}
+
+// txDecision asks coordinator for its decision on tx.
+func (n *Node) txDecision(coordinator int, tx string) (string, error) {
+	if coordinator == n.ID {
+		return n.txLocks.decision(tx), nil
+	}
+	reply, err := n.Call(coordinator, Message{Type: "tx_status", From: n.ID, Tx: tx}, txTimeout)
+	if err != nil {
+		return "", err
+	}
+	return reply.Content, nil
+}
+
+// resumeTransactions picks up the transactions a restart interrupted, as
+// restored from the WAL: prepared ones wait for their decision again, and
+// commits not acknowledged by every participant are resent.
+func (n *Node) resumeTransactions() {
+	prepared, committing := n.txLocks.unresolved()
+	if len(prepared) > 0 || len(committing) > 0 {
+		n.logger.Warn("found transactions interrupted by a restart", "prepared", len(prepared), "committing", len(committing))
+	}
+	for tx, p := range prepared {
+		n.txLocks.expire(tx, n.awaitDecision(tx, p))
+	}
+	for tx, shares := range committing {
+		go n.retryCommit(tx, shares)
+	}
+}
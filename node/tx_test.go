@@ -0,0 +1,135 @@
+package node_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/client"
+	"github.com/mrinalxdev/dbs-pt-1/node"
+)
+
+func TestTransactionAppliesEveryWrite(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+
+	if err := connect(t, c, 1).Set(ctx, "stale", "x"); err != nil {
+		t.Fatal(err)
+	}
+	// Enough keys that several nodes coordinate some of them
+	ops := []node.TxOp{{Op: "del", Key: "stale"}}
+	for i := range 10 {
+		ops = append(ops, node.TxOp{Op: "set", Key: fmt.Sprintf("tx-%d", i), Value: strconv.Itoa(i)})
+	}
+	if err := c.Node(2).Transaction(ops); err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+
+	for id := 1; id <= c.Size(); id++ {
+		cl := connect(t, c, id)
+		for i := range 10 {
+			key := fmt.Sprintf("tx-%d", i)
+			value, found, err := cl.GetConsistency(ctx, key, client.All)
+			if err != nil || !found || value != strconv.Itoa(i) {
+				t.Errorf("node %d: get %s = %q, %v, %v", id, key, value, found, err)
+			}
+		}
+		if value, found, err := cl.GetConsistency(ctx, "stale", client.All); err != nil || found {
+			t.Errorf("node %d: get stale = %q, %v, %v after the transaction deleted it", id, value, found, err)
+		}
+	}
+}
+
+func TestConcurrentTransactionsAreAtomic(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 30*time.Second)
+
+	// Conflicting transactions abort rather than wait, so each writer
+	// retries until its own commits
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value := strconv.Itoa(i)
+			ops := []node.TxOp{
+				{Op: "set", Key: "left", Value: value},
+				{Op: "set", Key: "right", Value: value},
+			}
+			for {
+				err := c.Node(1 + i%c.Size()).Transaction(ops)
+				if err == nil {
+					return
+				}
+				if !errors.Is(err, node.ErrTxAborted) {
+					t.Errorf("transaction %d: %v", i, err)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					t.Errorf("transaction %d never committed", i)
+					return
+				case <-time.After(time.Duration(rand.Int64N(int64(20 * time.Millisecond)))):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cl := connect(t, c, 3)
+	left, _, err := cl.GetConsistency(ctx, "left", client.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, _, err := cl.GetConsistency(ctx, "right", client.All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != right {
+		t.Errorf("left = %q but right = %q: a transaction was applied partly", left, right)
+	}
+}
+
+func TestAbortedTransactionWritesNothing(t *testing.T) {
+	c := newCluster(t, 3, replicated(3))
+	ctx := testContext(t, 20*time.Second)
+
+	// A key locked by a transaction that is preparing makes the other
+	// fail; retrying the loser until one aborts shows its writes vanish
+	for attempt := 0; attempt < 50; attempt++ {
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ops := []node.TxOp{
+					{Op: "set", Key: "shared", Value: "x"},
+					{Op: "set", Key: fmt.Sprintf("own-%d-%d", attempt, i), Value: "y"},
+				}
+				errs[i] = c.Node(1 + i).Transaction(ops)
+			}()
+		}
+		wg.Wait()
+
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, node.ErrTxAborted) {
+				t.Fatalf("transaction: %v", err)
+			}
+			key := fmt.Sprintf("own-%d-%d", attempt, i)
+			if value, found, err := connect(t, c, 3).GetConsistency(ctx, key, client.All); err != nil || found {
+				t.Fatalf("get %s = %q, %v, %v; an aborted transaction wrote it", key, value, found, err)
+			}
+			return
+		}
+	}
+	t.Skip("no transaction conflicted")
+}
@@ -0,0 +1,112 @@
+package node
+
+import (
+	"slices"
+	"time"
+)
+
+// With udp_heartbeats, heartbeats and their acks travel as UDP datagrams
+// on the bind port instead of over the peer connections, so a connection
+// busy with a large transfer cannot hold up the signals the failure
+// detector and the leader's lease depend on. Only peers that announced
+// CapUDP in their hello are sent datagrams; the others, and any peer a
+// datagram cannot be sent to, get heartbeats over the connection as before.
+//
+// Every datagram carries a sequence number, counted per peer from when the
+// sender first beat it so it keeps growing across restarts. Datagrams that
+// arrive after a later one from the same peer are stale and dropped, and
+// gaps in the sequence are counted as lost heartbeats.
+
+// udpTypes are the message types accepted as datagrams.
+var udpTypes = []string{"heartbeat", "heartbeat_ack", "alive"}
+
+// hasCapability reports whether peer id announced capability in its hello.
+// Unlike PeerSupports, peers whose hello has not been seen have none.
+func (n *Node) hasCapability(id int, capability string) bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	info, ok := n.peerInfo[id]
+	return ok && slices.Contains(info.capabilities, capability)
+}
+
+// sendBeat sends a heartbeat, heartbeat ack or alive message to peer id as
+// a datagram if both sides use UDP heartbeats, or else over the peer's
+// connection.
+func (n *Node) sendBeat(id int, msg Message) {
+	if n.udp != nil && n.hasCapability(id, CapUDP) {
+		n.mutex.RLock()
+		address, known := n.Peers[id]
+		n.mutex.RUnlock()
+
+		if known {
+			msg.Beat = n.nextBeat(id)
+			err := n.udp.Send(id, address, msg)
+			if err == nil {
+				n.metrics.MessageSent(msg.Type)
+				return
+			}
+			n.peerLogger(id, msg.Type).Debug("failed to send datagram, using the connection", "err", err)
+			msg.Beat = 0
+		}
+	}
+	n.sendMessage(id, msg)
+}
+
+// runDatagrams dispatches the heartbeats received as datagrams until the
+// node shuts down.
+func (n *Node) runDatagrams() {
+	for {
+		msg, err := n.udp.Recv()
+		if err != nil {
+			select {
+			case <-n.done:
+			default:
+				n.logger.Error("stopped receiving datagrams", "err", err)
+			}
+			return
+		}
+		if msg.Client || !slices.Contains(udpTypes, msg.Type) || !n.freshBeat(msg) {
+			continue
+		}
+		n.dispatch(n.ctx, nil, msg)
+	}
+}
+
+// freshBeat reports whether msg is the latest datagram from a known peer,
+// counting the heartbeats lost in between.
+func (n *Node) freshBeat(msg Message) bool {
+	n.mutex.RLock()
+	_, known := n.Peers[msg.From]
+	n.mutex.RUnlock()
+	if !known || msg.Beat == 0 {
+		return false
+	}
+
+	n.beatMutex.Lock()
+	defer n.beatMutex.Unlock()
+
+	last := n.lastBeat[msg.From]
+	if msg.Beat <= last {
+		return false
+	}
+	if last != 0 && msg.Beat-last > 1 {
+		n.metrics.HeartbeatsLost(msg.Beat - last - 1)
+	}
+	n.lastBeat[msg.From] = msg.Beat
+	return true
+}
+
+// nextBeat returns the sequence number of the next datagram to peer id.
+// Each peer has its own sequence, so gaps in it are losses.
+func (n *Node) nextBeat(id int) uint64 {
+	n.beatMutex.Lock()
+	defer n.beatMutex.Unlock()
+
+	seq, ok := n.sentBeat[id]
+	if !ok {
+		seq = uint64(time.Now().UnixNano())
+	}
+	n.sentBeat[id] = seq + 1
+	return seq + 1
+}
@@ -0,0 +1,376 @@
+package node
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const walFileName = "wal.log"
+
+// maxWALEntrySize bounds a single replayed entry so a corrupt file cannot
+// exhaust memory.
+const maxWALEntrySize = 16 << 20
+
+// WALEntry is one record in the write-ahead log.
+type WALEntry struct {
+	Op       string    `json:"op"`
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	TaskID   string    `json:"task_id,omitempty"`
+	Target   int       `json:"target,omitempty"`
+	TaskType string    `json:"task_type,omitempty"`
+	Content  string    `json:"content,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Failed   bool      `json:"failed,omitempty"`
+
+	// From, IdempotencyKey, Priority and Timeout are those of a task
+	// accepted from a peer; see TaskJournal.
+	From           int           `json:"from,omitempty"`
+	IdempotencyKey string        `json:"idempotency_key,omitempty"`
+	Priority       string        `json:"priority,omitempty"`
+	Timeout        time.Duration `json:"timeout,omitempty"`
+
+	// Handoff is the id of a task handoff sent, to Target, or taken, with
+	// the ids of its tasks in Content; see steal.go.
+	Handoff string `json:"handoff,omitempty"`
+	// Tx is the transaction of a prepared transaction or commit decision,
+	// whose writes are in Value; see tx.go.
+	Tx string `json:"tx,omitempty"`
+	// Term and VotedFor are the election state of a node in linearizable
+	// mode; see election.go. Entries of its log are in Value.
+	Term     int  `json:"term,omitempty"`
+	VotedFor *int `json:"voted_for,omitempty"`
+
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+	Expires   int64      `json:"expires,omitempty"`
+	// Versioned is set when Value is packed with its version and
+	// siblings (see packVersions), and Encrypted when it is encrypted, and
+	// base64-encoded.
+	Versioned bool `json:"versioned,omitempty"`
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+const (
+	walSet      = "set"
+	walDelete   = "del"
+	walClear    = "clear"
+	walTask     = "task"
+	walTaskDone = "task_done"
+
+	walTaskAccepted = "task_accepted"
+	walTaskFinished = "task_finished"
+
+	walHandoffSent  = "handoff_sent"
+	walHandoffDone  = "handoff_done"
+	walHandoffTaken = "handoff_taken"
+
+	walTxPrepared = "tx_prepared"
+	walTxResolved = "tx_resolved"
+	walTxCommit   = "tx_commit"
+	walTxDone     = "tx_done"
+
+	walElection   = "election"
+	walLogEntries = "log_entries"
+	walLogBase    = "log_base"
+)
+
+// WAL is an append-only log of JSON entries. With the always fsync policy,
+// every append is synced to disk before it returns, so an acknowledged
+// mutation survives a crash; see fsync.go for the others.
+type WAL struct {
+	file    *os.File
+	path    string
+	mutex   sync.Mutex
+	sync    syncer
+	keyring *Keyring
+	logger  *slog.Logger
+}
+
+// OpenWAL opens (or creates) the log in dir, synced as the fsync policy
+// says and encrypting the values of entries with keyring if it is not nil.
+// Write failures reported by the store and task tracker go to logger.
+func OpenWAL(dir, fsync string, keyring *Keyring, logger *slog.Logger) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, walFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{file: file, path: path, sync: syncer{policy: fsync}, keyring: keyring, logger: logger}, nil
+}
+
+func (w *WAL) Append(entry WALEntry) error {
+	entry.Time = time.Now()
+	w.seal(&entry)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.sync.check(); err != nil {
+		return err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(data); err != nil {
+		// Drop any partial entry so it does not run into the next one
+		w.file.Truncate(info.Size())
+		return err
+	}
+	if err := w.sync.wrote(w.file); err != nil {
+		// The entry may not have reached the disk, so the append fails
+		// and the entry goes, as if the write had failed
+		w.file.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+// Flush syncs the appends the fsync policy left unsynced.
+func (w *WAL) Flush() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.sync.flush(w.file)
+}
+
+// seal encrypts the value of entry if the log has a keyring.
+func (w *WAL) seal(entry *WALEntry) {
+	if w.keyring == nil || entry.Value == "" {
+		return
+	}
+	entry.Value = base64.StdEncoding.EncodeToString(w.keyring.seal(entry.Key, []byte(entry.Value)))
+	entry.Encrypted = true
+}
+
+// openEntry decrypts the value of entry if it is encrypted.
+func openEntry(entry *WALEntry, keyring *Keyring) error {
+	if !entry.Encrypted {
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(entry.Value)
+	if err != nil {
+		return fmt.Errorf("encrypted value of %q: %v", entry.Key, err)
+	}
+	value, err := keyring.open(entry.Key, sealed)
+	if err != nil {
+		return err
+	}
+	entry.Value, entry.Encrypted = string(value), false
+	return nil
+}
+
+// reencrypt rewrites the log with every value encrypted with the active key
+// of its keyring, if any is not, and returns how many entries it
+// re-encrypted. Appends wait until it is done. Lines that do not parse, like
+// a torn final entry, are kept as they are.
+func (w *WAL) reencrypt() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	file, err := os.Open(w.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	tmpPath := w.path + ".rewrite"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxWALEntrySize)
+	out := bufio.NewWriter(tmp)
+	count := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry WALEntry
+		if json.Unmarshal(line, &entry) == nil && entry.Value != "" {
+			sealed, _ := base64.StdEncoding.DecodeString(entry.Value)
+			if !w.keyring.current(sealed, entry.Encrypted) {
+				if err := openEntry(&entry, w.keyring); err != nil {
+					tmp.Close()
+					return 0, err
+				}
+				w.seal(&entry)
+				if line, err = json.Marshal(entry); err != nil {
+					tmp.Close()
+					return 0, err
+				}
+				count++
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if count == 0 {
+		tmp.Close()
+		return 0, nil
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		return 0, err
+	}
+	if dir, err := os.Open(filepath.Dir(w.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	appended, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	// The rewrite was synced, unsynced appends and all
+	w.file.Close()
+	w.file = appended
+	w.sync.synced()
+	return count, nil
+}
+
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.sync.flush(w.file); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// ReplayWAL calls apply for every entry in the log in dir, in order, with
+// encrypted values decrypted with keyring. A missing log is not an error. A
+// torn final entry, left by a crash in the middle of a write, is skipped;
+// corruption anywhere else is reported, as is a value keyring cannot
+// decrypt.
+func ReplayWAL(dir string, keyring *Keyring, logger *slog.Logger, apply func(WALEntry)) (int, error) {
+	file, err := os.Open(filepath.Join(dir, walFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxWALEntrySize)
+
+	count := 0
+	var pending error
+	for scanner.Scan() {
+		if pending != nil {
+			return count, pending
+		}
+
+		var entry WALEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			pending = fmt.Errorf("wal entry %d: %v", count+1, err)
+			continue
+		}
+		if err := openEntry(&entry, keyring); err != nil {
+			return count, fmt.Errorf("wal entry %d: %v", count+1, err)
+		}
+		apply(entry)
+		count++
+	}
+	if pending != nil {
+		logger.Warn("ignoring torn final WAL entry", "err", pending)
+	}
+	return count, scanner.Err()
+}
+
+// recover replays the WAL into the node's task tracker and, unless replayKV
+// is false because the store keeps its own data log, into its store.
+func (n *Node) recover(dir string, keyring *Keyring, replayKV bool) error {
+	count, err := ReplayWAL(dir, keyring, n.logger, func(entry WALEntry) {
+		switch entry.Op {
+		case walSet, walDelete:
+			if !replayKV {
+				return
+			}
+			e := Entry{Value: entry.Value, Deleted: entry.Op == walDelete, Expires: entry.Expires}
+			if entry.Timestamp != nil {
+				e.Timestamp = *entry.Timestamp
+			}
+			if entry.Versioned {
+				if err := unpackVersions(&e); err != nil {
+					n.logger.Warn("skipping WAL entry", "key", entry.Key, "err", err)
+					return
+				}
+			}
+			if err := n.store.apply(entry.Key, e); err != nil {
+				n.logger.Warn("skipping WAL entry", "key", entry.Key, "err", err)
+			}
+		case walClear:
+			if !replayKV {
+				return
+			}
+			if err := n.store.clear(); err != nil {
+				n.logger.Warn("skipping WAL entry", "op", entry.Op, "err", err)
+			}
+		case walTask:
+			n.tracker.restore(entry)
+		case walTaskDone:
+			n.tracker.restore(entry)
+		case walTaskAccepted, walTaskFinished:
+			n.journal.restore(entry)
+		case walHandoffSent, walHandoffDone, walHandoffTaken:
+			if err := n.steals.restore(entry); err != nil {
+				n.logger.Warn("skipping WAL entry", "op", entry.Op, "handoff", entry.Handoff, "err", err)
+			}
+		case walTxPrepared, walTxResolved, walTxCommit, walTxDone:
+			if err := n.txLocks.restore(entry); err != nil {
+				n.logger.Warn("skipping WAL entry", "op", entry.Op, "tx", entry.Tx, "err", err)
+			}
+		case walElection:
+			n.restoreElection(entry)
+		case walLogEntries, walLogBase:
+			if err := n.linear.restore(entry); err != nil {
+				n.logger.Warn("skipping WAL entry", "op", entry.Op, "err", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		n.logger.Info("recovered from WAL", "entries", count, "dir", dir)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package node
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport"
+)
+
+// KeyChange describes a write to a watched key.
+type KeyChange struct {
+	Key       string
+	Value     string
+	Deleted   bool
+	Timestamp Timestamp
+	// Node is the node that applied the write as the key's coordinator.
+	Node int
+}
+
+// WatchMatches reports whether key is covered by pattern: a pattern ending
+// in * matches every key starting with the rest of it, anything else only
+// that exact key.
+func WatchMatches(pattern, key string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(key, prefix)
+	}
+	return pattern == key
+}
+
+type localWatch struct {
+	pattern string
+	fn      func(KeyChange)
+}
+
+// Watches tracks who is interested in key changes: watchers on this node
+// and the patterns each peer has subscribed to.
+//
+// A node subscribes to a pattern by sending "watch" to every peer, and
+// every node that coordinates a write pushes a "watch_event" to the peers
+// subscribed to a matching pattern, so changes made anywhere reach the
+// watchers without any polling.
+type Watches struct {
+	mutex  sync.RWMutex
+	nextID int
+	local  map[int]localWatch
+	remote map[int]map[string]bool
+}
+
+func NewWatches() *Watches {
+	return &Watches{
+		local:  make(map[int]localWatch),
+		remote: make(map[int]map[string]bool),
+	}
+}
+
+// patterns returns the distinct patterns watched on this node.
+func (w *Watches) patterns() []string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, lw := range w.local {
+		if !seen[lw.pattern] {
+			seen[lw.pattern] = true
+			patterns = append(patterns, lw.pattern)
+		}
+	}
+	return patterns
+}
+
+// add registers fn and reports whether pattern is newly watched here.
+func (w *Watches) add(pattern string, fn func(KeyChange)) (id int, first bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	first = true
+	for _, lw := range w.local {
+		if lw.pattern == pattern {
+			first = false
+		}
+	}
+	w.nextID++
+	w.local[w.nextID] = localWatch{pattern: pattern, fn: fn}
+	return w.nextID, first
+}
+
+// remove unregisters watcher id and reports whether its pattern is no
+// longer watched here.
+func (w *Watches) remove(id int) (pattern string, last bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lw, ok := w.local[id]
+	if !ok {
+		return "", false
+	}
+	delete(w.local, id)
+	for _, other := range w.local {
+		if other.pattern == lw.pattern {
+			return lw.pattern, false
+		}
+	}
+	return lw.pattern, true
+}
+
+// notifyLocal calls every local watcher whose pattern matches the change.
+func (w *Watches) notifyLocal(change KeyChange) {
+	w.mutex.RLock()
+	var fns []func(KeyChange)
+	for _, lw := range w.local {
+		if WatchMatches(lw.pattern, change.Key) {
+			fns = append(fns, lw.fn)
+		}
+	}
+	w.mutex.RUnlock()
+
+	for _, fn := range fns {
+		fn(change)
+	}
+}
+
+// subscribers returns the peers subscribed to a pattern matching key.
+func (w *Watches) subscribers(key string) []int {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	var peers []int
+	for peer, patterns := range w.remote {
+		for pattern := range patterns {
+			if WatchMatches(pattern, key) {
+				peers = append(peers, peer)
+				break
+			}
+		}
+	}
+	return peers
+}
+
+func (w *Watches) subscribe(peer int, pattern string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.remote[peer] == nil {
+		w.remote[peer] = make(map[string]bool)
+	}
+	w.remote[peer][pattern] = true
+}
+
+func (w *Watches) unsubscribe(peer int, pattern string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.remote[peer], pattern)
+	if len(w.remote[peer]) == 0 {
+		delete(w.remote, peer)
+	}
+}
+
+// Forget drops every subscription of peer.
+func (w *Watches) Forget(peer int) {
+	w.mutex.Lock()
+	delete(w.remote, peer)
+	w.mutex.Unlock()
+}
+
+// Watch calls fn for every change to a key matching pattern (see
+// WatchMatches) made anywhere in the cluster, until the returned cancel
+// function is called. fn must not block for long: it runs on the goroutine
+// that applied or received the change.
+func (n *Node) Watch(pattern string, fn func(KeyChange)) (cancel func()) {
+	id, first := n.watches.add(pattern, fn)
+	if first {
+		n.sendToPeers(CapWatch, Message{Type: "watch", From: n.ID, Key: pattern})
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if pattern, last := n.watches.remove(id); last {
+				n.sendToPeers(CapWatch, Message{Type: "unwatch", From: n.ID, Key: pattern})
+			}
+		})
+	}
+}
+
+// sendToPeers sends msg to every connected peer that supports capability.
+func (n *Node) sendToPeers(capability string, msg Message) {
+	n.mutex.RLock()
+	ids := make([]int, 0, len(n.conn))
+	for id := range n.conn {
+		ids = append(ids, id)
+	}
+	n.mutex.RUnlock()
+
+	for _, id := range ids {
+		if n.PeerSupports(id, capability) {
+			n.sendMessage(id, msg)
+		}
+	}
+}
+
+// announceWatches tells a newly connected peer what this node watches.
+func (n *Node) announceWatches(peer int) {
+	if !n.PeerSupports(peer, CapWatch) {
+		return
+	}
+	for _, pattern := range n.watches.patterns() {
+		n.sendMessage(peer, Message{Type: "watch", From: n.ID, Key: pattern})
+	}
+}
+
+// publishChange reports a write this node coordinated to local watchers and
+// to every subscribed peer, and indexes it.
+func (n *Node) publishChange(key string, e Entry) {
+	n.indexChange(key, e)
+	change := KeyChange{Key: key, Value: e.Value, Deleted: e.Deleted, Timestamp: e.Timestamp, Node: n.ID}
+	n.watches.notifyLocal(change)
+
+	subscribers := n.watches.subscribers(key)
+	if len(subscribers) == 0 {
+		return
+	}
+	msg := Message{Type: "watch_event", From: n.ID, Key: key, Value: e.Value, Content: "set", Timestamp: &e.Timestamp}
+	if e.Deleted {
+		msg.Content = "del"
+		msg.Value = ""
+	}
+	for _, peer := range subscribers {
+		n.sendMessage(peer, msg)
+	}
+}
+
+func (n *Node) handleWatch(msg Message) {
+	switch msg.Type {
+	case "watch":
+		n.watches.subscribe(msg.From, msg.Key)
+	case "unwatch":
+		n.watches.unsubscribe(msg.From, msg.Key)
+	case "watch_event":
+		change := KeyChange{Key: msg.Key, Value: msg.Value, Deleted: msg.Content == "del", Node: msg.From}
+		if msg.Timestamp != nil {
+			change.Timestamp = *msg.Timestamp
+		}
+		n.watches.notifyLocal(change)
+	}
+}
+
+// clientWatchKey identifies a watch made by a client: request ids are only
+// unique per connection.
+type clientWatchKey struct {
+	conn      transport.Conn
+	requestID string
+}
+
+// clientWatch starts pushing changes matching msg.Key to a client as
+// watch_event messages tagged with the request id. The watch ends when the
+// client sends unwatch naming the request id in Content, or a push fails.
+func (n *Node) clientWatch(conn transport.Conn, msg Message) Message {
+	key := clientWatchKey{conn: conn, requestID: msg.RequestID}
+
+	cancel := n.Watch(msg.Key, func(change KeyChange) {
+		if internalKey(change.Key) {
+			return
+		}
+		event := Message{
+			Type:      "watch_event",
+			From:      n.ID,
+			Key:       change.Key,
+			Value:     change.Value,
+			Content:   "set",
+			RequestID: msg.RequestID,
+			Timestamp: &change.Timestamp,
+			Client:    true,
+		}
+		if change.Deleted {
+			event.Content = "del"
+		}
+		if err := conn.Send(event); err != nil {
+			n.endClientWatch(key)
+		}
+	})
+
+	n.clientWatchMutex.Lock()
+	n.clientWatches[key] = cancel
+	n.clientWatchMutex.Unlock()
+
+	return Message{Type: "watch", Key: msg.Key}
+}
+
+func (n *Node) endClientWatch(key clientWatchKey) {
+	n.clientWatchMutex.Lock()
+	cancel, ok := n.clientWatches[key]
+	delete(n.clientWatches, key)
+	n.clientWatchMutex.Unlock()
+
+	if ok {
+		// This may run inside a watcher; keep the unwatch broadcast off the
+		// notifying goroutine
+		go cancel()
+	}
+}
+
+// endClientWatches ends every watch made over conn, once it has closed.
+func (n *Node) endClientWatches(conn transport.Conn) {
+	n.clientWatchMutex.Lock()
+	var keys []clientWatchKey
+	for key := range n.clientWatches {
+		if key.conn == conn {
+			keys = append(keys, key)
+		}
+	}
+	n.clientWatchMutex.Unlock()
+
+	for _, key := range keys {
+		n.endClientWatch(key)
+	}
+}
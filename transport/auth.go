@@ -0,0 +1,189 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrUnauthenticated is returned by Recv on an Auth connection when a
+// message is not signed with an accepted token.
+var ErrUnauthenticated = errors.New("message not signed with an accepted token")
+
+// Auth wraps a Transport and signs every message with an HMAC-SHA256 of its
+// contents keyed by a shared token, rejecting connections whose messages do
+// not carry a valid signature. Without any token it passes messages through
+// untouched.
+//
+// Tokens can be rotated while the cluster runs: Accept a new token on every
+// node, Rotate to it on every node, then Retire the old one.
+type Auth struct {
+	Transport
+
+	mutex    sync.RWMutex
+	current  []byte
+	accepted map[string][]byte
+}
+
+// NewAuth wraps t, signing with token. An empty token disables
+// authentication until one is rotated in.
+func NewAuth(t Transport, token string) *Auth {
+	a := &Auth{Transport: t, accepted: make(map[string][]byte)}
+	if token != "" {
+		a.Rotate(token)
+	}
+	return a
+}
+
+// Accept makes messages signed with token valid, without signing with it.
+func (a *Auth) Accept(token string) {
+	a.mutex.Lock()
+	a.accepted[Fingerprint(token)] = []byte(token)
+	a.mutex.Unlock()
+}
+
+// Rotate signs messages with token from now on. Tokens accepted before,
+// including the previous signing token, stay accepted until Retire.
+func (a *Auth) Rotate(token string) {
+	a.mutex.Lock()
+	a.current = []byte(token)
+	a.accepted[Fingerprint(token)] = a.current
+	a.mutex.Unlock()
+}
+
+// Retire stops accepting every token but the one messages are signed with.
+func (a *Auth) Retire() {
+	a.mutex.Lock()
+	a.accepted = make(map[string][]byte)
+	if a.current != nil {
+		a.accepted[Fingerprint(string(a.current))] = a.current
+	}
+	a.mutex.Unlock()
+}
+
+// Tokens returns the fingerprints of the signing token, empty if there is
+// none, and of every accepted token.
+func (a *Auth) Tokens() (current string, accepted []string) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.current != nil {
+		current = Fingerprint(string(a.current))
+	}
+	for fp := range a.accepted {
+		accepted = append(accepted, fp)
+	}
+	return current, accepted
+}
+
+// Fingerprint identifies token without revealing it.
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (a *Auth) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	return a.Transport.Listen(address, func(conn Conn) {
+		handle(&authConn{Conn: conn, auth: a})
+	})
+}
+
+func (a *Auth) Dial(address string) (Conn, error) {
+	conn, err := a.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &authConn{Conn: conn, auth: a}, nil
+}
+
+// mac computes the signature of msg, ignoring any MAC it already carries.
+// JSON encodes maps in key order, so sender and receiver agree on the bytes.
+func mac(key []byte, msg Message) ([]byte, error) {
+	msg.MAC = nil
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func (a *Auth) sign(msg *Message) error {
+	a.mutex.RLock()
+	key := a.current
+	a.mutex.RUnlock()
+
+	if key == nil {
+		return nil
+	}
+	sum, err := mac(key, *msg)
+	if err != nil {
+		return err
+	}
+	msg.MAC = sum
+	return nil
+}
+
+func (a *Auth) verify(msg Message) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if len(a.accepted) == 0 {
+		return nil
+	}
+	if len(msg.MAC) == 0 {
+		return ErrUnauthenticated
+	}
+	for _, key := range a.accepted {
+		sum, err := mac(key, msg)
+		if err != nil {
+			return err
+		}
+		if hmac.Equal(sum, msg.MAC) {
+			return nil
+		}
+	}
+	return ErrUnauthenticated
+}
+
+type authConn struct {
+	Conn
+	auth *Auth
+}
+
+func (c *authConn) Send(msg Message) error {
+	if err := c.auth.sign(&msg); err != nil {
+		return err
+	}
+	return c.Conn.Send(msg)
+}
+
+func (c *authConn) Write(msg Message) error {
+	if err := c.auth.sign(&msg); err != nil {
+		return err
+	}
+	return writeBatched(c.Conn, msg)
+}
+
+func (c *authConn) Flush() error {
+	return flushBatched(c.Conn)
+}
+
+// Recv fails with ErrUnauthenticated on the first message that is not
+// properly signed; callers are expected to close the connection.
+func (c *authConn) Recv() (Message, error) {
+	msg, err := c.Conn.Recv()
+	if err != nil {
+		return msg, err
+	}
+	if err := c.auth.verify(msg); err != nil {
+		return Message{}, err
+	}
+	msg.MAC = nil
+	return msg, nil
+}
@@ -0,0 +1,30 @@
+package transport
+
+// BatchConn is implemented by connections that can batch sends, so a
+// sender with many messages queued pays one write syscall for all of them
+// instead of one each. Write encodes msg into the connection's write
+// buffer, which only goes out once it fills or Flush is called; Send still
+// sends at once, after anything buffered. Messages are never reordered.
+type BatchConn interface {
+	Conn
+	Write(msg Message) error
+	Flush() error
+}
+
+// writeBatched buffers msg on conn if it supports batching, and sends it
+// at once otherwise. Wrapping connections use it so they batch exactly
+// when the connection they wrap does.
+func writeBatched(conn Conn, msg Message) error {
+	if b, ok := conn.(BatchConn); ok {
+		return b.Write(msg)
+	}
+	return conn.Send(msg)
+}
+
+// flushBatched flushes conn if it supports batching.
+func flushBatched(conn Conn) error {
+	if b, ok := conn.(BatchConn); ok {
+		return b.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults describes the faults a Chaos transport injects.
+type Faults struct {
+	// Drop is the fraction of sent messages that are silently lost.
+	Drop float64
+	// Delay is added before every message is sent.
+	Delay time.Duration
+	// Partitioned lists the nodes whose messages are lost in both
+	// directions.
+	Partitioned []int
+}
+
+func (f Faults) String() string {
+	if f.Drop == 0 && f.Delay == 0 && len(f.Partitioned) == 0 {
+		return "no faults"
+	}
+	return fmt.Sprintf("drop %g%%, delay %v, partitioned from %v", f.Drop*100, f.Delay, f.Partitioned)
+}
+
+// Chaos wraps a Transport and injects faults into its connections, for
+// exercising failure handling without external tools. Faults can be changed
+// at any time and apply to connections that are already open. A connection
+// learns which node is on the other end from the first peer message it
+// receives, so partitions take effect once the handshake is done.
+type Chaos struct {
+	Transport
+
+	mutex     sync.RWMutex
+	drop      float64
+	delay     time.Duration
+	partition map[int]bool
+}
+
+// NewChaos wraps t with no faults enabled.
+func NewChaos(t Transport) *Chaos {
+	return &Chaos{Transport: t, partition: make(map[int]bool)}
+}
+
+// SetDrop makes a fraction rate, between 0 and 1, of sent messages get lost.
+func (c *Chaos) SetDrop(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("drop rate %g is not between 0 and 1", rate)
+	}
+	c.mutex.Lock()
+	c.drop = rate
+	c.mutex.Unlock()
+	return nil
+}
+
+// SetDelay adds d of latency to every sent message.
+func (c *Chaos) SetDelay(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative delay %v", d)
+	}
+	c.mutex.Lock()
+	c.delay = d
+	c.mutex.Unlock()
+	return nil
+}
+
+// Partition cuts this node off from ids, replacing any previous partition.
+// Calling it with no ids heals the partition.
+func (c *Chaos) Partition(ids ...int) {
+	partition := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		partition[id] = true
+	}
+	c.mutex.Lock()
+	c.partition = partition
+	c.mutex.Unlock()
+}
+
+// Reset turns every fault off.
+func (c *Chaos) Reset() {
+	c.mutex.Lock()
+	c.drop = 0
+	c.delay = 0
+	c.partition = make(map[int]bool)
+	c.mutex.Unlock()
+}
+
+// Faults returns the faults currently injected.
+func (c *Chaos) Faults() Faults {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	f := Faults{Drop: c.drop, Delay: c.delay}
+	for id := range c.partition {
+		f.Partitioned = append(f.Partitioned, id)
+	}
+	sort.Ints(f.Partitioned)
+	return f
+}
+
+func (c *Chaos) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	return c.Transport.Listen(address, func(conn Conn) {
+		handle(c.wrap(conn))
+	})
+}
+
+func (c *Chaos) Dial(address string) (Conn, error) {
+	conn, err := c.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(conn), nil
+}
+
+func (c *Chaos) wrap(conn Conn) Conn {
+	cc := &chaosConn{Conn: conn, chaos: c}
+	cc.peer.Store(-1)
+	return cc
+}
+
+func (c *Chaos) partitioned(id int64) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return id >= 0 && c.partition[int(id)]
+}
+
+// outgoing decides the fate of a message to peer: whether it is lost and
+// how long to hold it first.
+func (c *Chaos) outgoing(peer int64) (lost bool, delay time.Duration) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if peer >= 0 && c.partition[int(peer)] {
+		return true, 0
+	}
+	return c.drop > 0 && rand.Float64() < c.drop, c.delay
+}
+
+type chaosConn struct {
+	Conn
+	chaos *Chaos
+	peer  atomic.Int64
+}
+
+func (cc *chaosConn) Send(msg Message) error {
+	lost, delay := cc.chaos.outgoing(cc.peer.Load())
+	if lost {
+		return nil
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return cc.Conn.Send(msg)
+}
+
+func (cc *chaosConn) Write(msg Message) error {
+	lost, delay := cc.chaos.outgoing(cc.peer.Load())
+	if lost {
+		return nil
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return writeBatched(cc.Conn, msg)
+}
+
+func (cc *chaosConn) Flush() error {
+	return flushBatched(cc.Conn)
+}
+
+func (cc *chaosConn) Recv() (Message, error) {
+	for {
+		msg, err := cc.Conn.Recv()
+		if err != nil || msg.Client {
+			return msg, err
+		}
+		cc.peer.CompareAndSwap(-1, int64(msg.From))
+		if !cc.chaos.partitioned(int64(msg.From)) {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package transport
+
+// VectorClock counts the events each node has seen, keyed by node id. It
+// lets a receiver tell whether two updates are causally ordered or
+// concurrent.
+type VectorClock map[int]uint64
+
+// Ordering is the causal relationship between two vector clocks.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	default:
+		return "concurrent"
+	}
+}
+
+// Copy returns an independent copy of v.
+func (v VectorClock) Copy() VectorClock {
+	c := make(VectorClock, len(v))
+	for id, count := range v {
+		c[id] = count
+	}
+	return c
+}
+
+// Tick records a local event on node id.
+func (v VectorClock) Tick(id int) {
+	v[id]++
+}
+
+// Merge raises every entry of v to at least the one in other.
+func (v VectorClock) Merge(other VectorClock) {
+	for id, count := range other {
+		if count > v[id] {
+			v[id] = count
+		}
+	}
+}
+
+// Compare reports whether v happened before, after, or concurrently with
+// other. Missing entries count as zero.
+func (v VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for id, count := range v {
+		if count > other[id] {
+			greater = true
+		} else if count < other[id] {
+			less = true
+		}
+	}
+	for id, count := range other {
+		if _, ok := v[id]; !ok && count > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
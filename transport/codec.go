@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A codec serializes the messages of binary framed connections (see
+// ProtocolBinary). The dialer names its codec in the framing handshake and
+// the listener answers with the same handshake to accept it, or refuses,
+// in which case the dialer falls back to JSON, so nodes preferring
+// different codecs still talk. JSON is the easiest to read on the wire;
+// msgpack is smaller and faster to encode and decode. Other codecs, e.g.
+// protobuf, can be added with RegisterCodec under an id both sides agree
+// on.
+
+// Codecs shipped with the transport.
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+)
+
+// Codec encodes messages as frame payloads and decodes them back.
+// Implementations must be safe for concurrent use.
+type Codec interface {
+	// Name identifies the codec in configs, e.g. "json".
+	Name() string
+	// Append appends the encoding of msg to buf and returns the result.
+	Append(buf []byte, msg Message) ([]byte, error)
+	// Unmarshal decodes a payload Append encoded into msg, which is zero.
+	// Payloads that do not decode fail with an error wrapping
+	// ErrMalformed.
+	Unmarshal(data []byte, msg *Message) error
+}
+
+// JSONCodec encodes messages as JSON, as the line protocol does. It is the
+// codec of binary frames from nodes that do not negotiate one.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return CodecJSON }
+
+func (JSONCodec) Append(buf []byte, msg Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return buf, err
+	}
+	return append(buf, data...), nil
+}
+
+func (JSONCodec) Unmarshal(data []byte, msg *Message) error {
+	return decodeError(json.Unmarshal(data, msg))
+}
+
+// codecJSONID is the handshake id of JSONCodec. It is the protocol id
+// binary framing used before codecs were negotiated, so older nodes
+// understand it.
+const codecJSONID = protocolBinaryID
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[byte]Codec{codecJSONID: JSONCodec{}, 2: MsgpackCodec{}}
+)
+
+// RegisterCodec makes codec available under id, which the framing
+// handshake carries. Ids 1 to 15 are reserved for the transport's own
+// codecs.
+func RegisterCodec(id byte, codec Codec) error {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+
+	if id < 16 {
+		return fmt.Errorf("codec id %d is reserved", id)
+	}
+	for taken, c := range codecs {
+		if taken == id || c.Name() == codec.Name() {
+			return fmt.Errorf("codec %s (id %d) is already registered", c.Name(), taken)
+		}
+	}
+	codecs[id] = codec
+	return nil
+}
+
+// lookupCodec returns the codec named name, JSON if name is "", and its id.
+func lookupCodec(name string) (Codec, byte, bool) {
+	if name == "" {
+		name = CodecJSON
+	}
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	for id, codec := range codecs {
+		if codec.Name() == name {
+			return codec, id, true
+		}
+	}
+	return nil, 0, false
+}
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (Codec, bool) {
+	codec, _, ok := lookupCodec(name)
+	return codec, ok
+}
+
+// codecByID returns the codec registered under id.
+func codecByID(id byte) (Codec, bool) {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	codec, ok := codecs[id]
+	return codec, ok
+}
+
+// ValidCodec reports whether a codec is registered under name. "" is JSON.
+func ValidCodec(name string) bool {
+	_, _, ok := lookupCodec(name)
+	return ok
+}
+
+// CodecNames returns the names of the registered codecs, sorted.
+func CodecNames() []string {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sampleMessage sets fields of every kind a codec has to carry.
+func sampleMessage() Message {
+	target := 3
+	return Message{
+		Type:      "replicate",
+		Content:   "payload with \"quotes\" and ünïcode",
+		From:      2,
+		Key:       "user:42",
+		Value:     "v",
+		Found:     true,
+		Term:      7,
+		Peers:     map[int]string{1: "127.0.0.1:8000", 3: "/run/dbs/node3.sock"},
+		RequestID: "r-1",
+		Seq:       1 << 40,
+		Clock:     VectorClock{1: 4, 2: 9},
+		Hashes:    []uint64{0, 1 << 63},
+		Ring:      []int{1, 2, 3},
+		Entries: map[string]Entry{
+			"user:42": {Value: "v", Timestamp: Timestamp{Time: 5, Node: 2}, Expires: 1700000000000, Version: VectorClock{2: 5}},
+			"gone":    {Deleted: true, Timestamp: Timestamp{Time: 6, Node: 1}},
+		},
+		Load:      &Load{QueueDepth: 3, QueueCapacity: 100, HeapBytes: 1 << 40},
+		Timestamp: &Timestamp{Time: 5, Node: 2},
+		TTL:       90 * time.Second,
+		Expires:   -1,
+		Target:    &target,
+		Siblings:  []Entry{{Value: "w", Timestamp: Timestamp{Time: 4, Node: 3}}},
+		LogIndex:  12,
+		SentAt:    time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano(),
+		Checksum:  0xdeadbeef,
+		Data:      []byte{0, 1, 254, 255},
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	want := sampleMessage()
+	for _, name := range CodecNames() {
+		t.Run(name, func(t *testing.T) {
+			codec, ok := LookupCodec(name)
+			if !ok {
+				t.Fatalf("codec %s not found", name)
+			}
+			data, err := codec.Append(nil, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Message
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip changed the message:\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecsRejectMalformed(t *testing.T) {
+	for _, name := range CodecNames() {
+		t.Run(name, func(t *testing.T) {
+			codec, _ := LookupCodec(name)
+			data, err := codec.Append(nil, sampleMessage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Message
+			if err := codec.Unmarshal(data[:len(data)/2], &got); !errors.Is(err, ErrMalformed) {
+				t.Errorf("truncated payload: err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestNegotiatedConnectionsRoundTrip(t *testing.T) {
+	cases := []struct{ protocol, codec string }{
+		{ProtocolJSON, CodecJSON},
+		{ProtocolBinary, CodecJSON},
+		{ProtocolBinary, CodecMsgpack},
+	}
+	want := sampleMessage()
+	for _, tc := range cases {
+		t.Run(tc.protocol+"/"+tc.codec, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			accepted := make(chan Conn, 1)
+			go func() {
+				conn, err := negotiateAccept(server, 0)
+				if err != nil {
+					t.Error(err)
+					server.Close()
+				}
+				accepted <- conn
+			}()
+			dialed, err := negotiateDial(client, tc.protocol, tc.codec, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The line protocol is only told apart by the first message
+			go func() {
+				if err := dialed.Send(want); err != nil {
+					t.Error(err)
+				}
+			}()
+			peer := <-accepted
+			if peer == nil {
+				t.FailNow()
+			}
+			got, err := peer.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("dialed to accepted changed the message:\n got %+v\nwant %+v", got, want)
+			}
+
+			go func() {
+				if err := peer.Send(want); err != nil {
+					t.Error(err)
+				}
+			}()
+			if got, err = dialed.Recv(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("accepted to dialed changed the message:\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Compression algorithms for message content. Nodes agree on one per
+// connection; CompressionNone turns compression off.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// DefaultCompressThreshold is the smallest Content, in bytes, worth
+// compressing.
+const DefaultCompressThreshold = 4096
+
+// ValidCompression reports whether algorithm is supported.
+func ValidCompression(algorithm string) bool {
+	return algorithm == "" || algorithm == CompressionNone || algorithm == CompressionGzip
+}
+
+// Compress moves msg.Content into msg.Compressed as gzip, unless that would
+// not make it smaller. JSON, the line protocol's encoding and the default
+// codec, sends Compressed base64 encoded, a third larger than the gzip
+// output, so that is the size compared.
+func Compress(msg *Message) error {
+	return compress(msg, true)
+}
+
+// compress is Compress, comparing the base64 encoded size only if
+// base64Encoded is set.
+func compress(msg *Message, base64Encoded bool) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(w, msg.Content); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	size := buf.Len()
+	if base64Encoded {
+		size = base64.StdEncoding.EncodedLen(size)
+	}
+	if size >= len(msg.Content) {
+		return nil
+	}
+	msg.Compressed = buf.Bytes()
+	msg.Content = ""
+	return nil
+}
+
+// Decompress restores msg.Content from msg.Compressed. Messages that are
+// not compressed are left alone.
+func Decompress(msg *Message) error {
+	if len(msg.Compressed) == 0 {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.Compressed))
+	if err != nil {
+		return fmt.Errorf("decompress: %v", err)
+	}
+	content, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return fmt.Errorf("decompress: %v", err)
+	}
+	if len(content) > MaxFrameSize {
+		return fmt.Errorf("decompress: content exceeds %d bytes", MaxFrameSize)
+	}
+	msg.Content = string(content)
+	msg.Compressed = nil
+	return nil
+}
+
+// compressConn compresses the Content of outgoing messages of at least
+// threshold bytes. Receivers undo it with Decompress.
+type compressConn struct {
+	Conn
+	threshold int
+	// base64Encoded is set unless conn is known to send bytes as they are
+	base64Encoded bool
+}
+
+// NewCompressConn wraps conn so that message contents of threshold bytes or
+// more are sent gzip compressed. Only use it once the peer has agreed to
+// compression.
+func NewCompressConn(conn Conn, threshold int) Conn {
+	return &compressConn{Conn: conn, threshold: threshold, base64Encoded: !rawBytes(conn)}
+}
+
+// rawBytes reports whether conn is a binary framed connection whose codec
+// encodes bytes as they are, unlike JSON.
+func rawBytes(conn Conn) bool {
+	framed, ok := conn.(interface{ Codec() string })
+	return ok && framed.Codec() != CodecJSON
+}
+
+func (c *compressConn) Send(msg Message) error {
+	if len(msg.Content) >= c.threshold {
+		if err := compress(&msg, c.base64Encoded); err != nil {
+			return err
+		}
+	}
+	return c.Conn.Send(msg)
+}
+
+func (c *compressConn) Write(msg Message) error {
+	if len(msg.Content) >= c.threshold {
+		if err := compress(&msg, c.base64Encoded); err != nil {
+			return err
+		}
+	}
+	return writeBatched(c.Conn, msg)
+}
+
+func (c *compressConn) Flush() error {
+	return flushBatched(c.Conn)
+}
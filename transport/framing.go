@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Wire protocols for TCP connections.
+const (
+	// ProtocolJSON sends one JSON object per line. It needs no handshake
+	// and is what nodes without protocol negotiation speak.
+	ProtocolJSON = "json"
+	// ProtocolBinary sends each message as a 4-byte big-endian length
+	// followed by the message encoded with the connection's codec (see
+	// Codec), so the reader always knows how much to expect and never
+	// scans for delimiters.
+	ProtocolBinary = "binary"
+)
+
+// MaxFrameSize bounds the length of a binary frame, so a corrupt or hostile
+// length prefix cannot make the reader allocate unbounded memory.
+const MaxFrameSize = 16 << 20
+
+// handshake is sent by a dialer that wants a protocol other than JSON: the
+// magic bytes, a version and the id of the codec its frames are encoded
+// with. The listener echoes it back to accept.
+var handshakeMagic = []byte("DBS")
+
+const (
+	handshakeVersion = 1
+	protocolBinaryID = 1
+)
+
+func validProtocol(protocol string) bool {
+	return protocol == "" || protocol == ProtocolJSON || protocol == ProtocolBinary
+}
+
+// errCodecRefused fails the negotiation of a codec the listener does not
+// know.
+var errCodecRefused = errors.New("peer refused the codec")
+
+// dialNegotiated opens a connection with dial and negotiates protocol and
+// codec on it. If the peer refuses the codec, it dials again with JSON.
+func dialNegotiated(dial func() (net.Conn, error), protocol, codec string, limit int) (Conn, error) {
+	for {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		c, err := negotiateDial(conn, protocol, codec, limit)
+		if errors.Is(err, errCodecRefused) && codec != CodecJSON {
+			slog.Warn("peer refused codec, falling back to json", "remote", conn.RemoteAddr().String(), "codec", codec)
+			conn.Close()
+			codec = CodecJSON
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// negotiateDial runs the client side of protocol negotiation on conn.
+func negotiateDial(conn net.Conn, protocol, codec string, limit int) (Conn, error) {
+	if protocol != ProtocolBinary {
+		return newJSONConn(conn, conn, limit), nil
+	}
+	c, id, ok := lookupCodec(codec)
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	hello := append(append([]byte(nil), handshakeMagic...), handshakeVersion, id)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("protocol negotiation: %v", err)
+	}
+	if !bytes.Equal(reply, hello) {
+		return nil, fmt.Errorf("protocol negotiation: %w %s", errCodecRefused, c.Name())
+	}
+	return newFramedConn(conn, bufio.NewReader(conn), c, limit), nil
+}
+
+// negotiateAccept runs the server side of protocol negotiation on conn. A
+// connection that starts with a JSON object is served as JSON lines, so
+// peers that do not negotiate keep working.
+func negotiateAccept(conn net.Conn, limit int) (Conn, error) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != handshakeMagic[0] {
+		return newJSONConn(conn, reader, limit), nil
+	}
+
+	hello := make([]byte, len(handshakeMagic)+2)
+	if _, err := io.ReadFull(reader, hello); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hello[:len(handshakeMagic)], handshakeMagic) || hello[len(handshakeMagic)] != handshakeVersion {
+		return nil, fmt.Errorf("unsupported protocol handshake %q", hello)
+	}
+	codec, ok := codecByID(hello[len(handshakeMagic)+1])
+	if !ok {
+		// Refuse by answering with something other than the request
+		conn.Write(append(append([]byte(nil), handshakeMagic...), handshakeVersion, 0))
+		return nil, fmt.Errorf("unsupported codec id %d", hello[len(handshakeMagic)+1])
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	return newFramedConn(conn, reader, codec, limit), nil
+}
+
+// framedConn carries length-prefixed messages encoded with codec.
+type framedConn struct {
+	conn    net.Conn
+	reader  io.Reader
+	codec   Codec
+	limit   int
+	header  [4]byte
+	payload []byte
+	writer  *bufio.Writer
+	sendMu  sync.Mutex
+}
+
+func newFramedConn(conn net.Conn, reader io.Reader, codec Codec, limit int) *framedConn {
+	return &framedConn{conn: conn, reader: reader, codec: codec, limit: messageLimit(limit), writer: bufio.NewWriter(conn)}
+}
+
+// Codec returns the name of the codec the connection's frames are encoded
+// with.
+func (c *framedConn) Codec() string {
+	return c.codec.Name()
+}
+
+// frame encodes msg with codec as its length prefix and payload.
+func frame(codec Codec, msg Message) (header [4]byte, payload []byte, err error) {
+	payload, err = codec.Append(nil, msg)
+	if err != nil {
+		return header, nil, err
+	}
+	if len(payload) > MaxFrameSize {
+		return header, nil, fmt.Errorf("message of %d bytes exceeds the %d byte frame limit", len(payload), MaxFrameSize)
+	}
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	return header, payload, nil
+}
+
+func (c *framedConn) Send(msg Message) error {
+	header, payload, err := frame(c.codec, msg)
+	if err != nil {
+		return err
+	}
+
+	// The lock keeps concurrent senders from interleaving frames
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.writer.Buffered() > 0 {
+		c.writer.Write(header[:])
+		c.writer.Write(payload)
+		return c.writer.Flush()
+	}
+	// With nothing buffered, header and payload go out in a single writev
+	frame := net.Buffers{header[:], payload}
+	_, err = frame.WriteTo(c.conn)
+	return err
+}
+
+func (c *framedConn) Write(msg Message) error {
+	header, payload, err := frame(c.codec, msg)
+	if err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.writer.Write(header[:])
+	_, err = c.writer.Write(payload)
+	return err
+}
+
+func (c *framedConn) Flush() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return c.writer.Flush()
+}
+
+func (c *framedConn) Recv() (Message, error) {
+	var msg Message
+	if _, err := io.ReadFull(c.reader, c.header[:]); err != nil {
+		return msg, err
+	}
+	size := binary.BigEndian.Uint32(c.header[:])
+	if size > uint32(c.limit) {
+		return msg, fmt.Errorf("%w: frame of %d bytes exceeds the %d byte limit", ErrTooLarge, size, c.limit)
+	}
+
+	// Codecs copy what they keep, so the buffer is reused across frames
+	if cap(c.payload) < int(size) {
+		c.payload = make([]byte, size)
+	}
+	payload := c.payload[:size]
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return msg, err
+	}
+	if err := c.codec.Unmarshal(payload, &msg); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+func (c *framedConn) Close() error {
+	return c.conn.Close()
+}
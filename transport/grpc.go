@@ -0,0 +1,392 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mrinalxdev/dbs-pt-1/transport/nodepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// GRPC carries messages over a bidirectional gRPC stream, giving
+// HTTP/2 flow control and deadlines. The service, dbs.Node with a single
+// Stream method, is declared in proto/node.proto and generated into
+// transport/nodepb; each Message is converted to and from its protobuf
+// counterpart. Connections use TLS when it is set and receive messages of
+// up to MaxMessageSize bytes, MaxFrameSize if 0.
+type GRPC struct {
+	TLS            *tls.Config
+	MaxMessageSize int
+}
+
+func (t GRPC) credentials() credentials.TransportCredentials {
+	if t.TLS != nil {
+		return credentials.NewTLS(t.TLS)
+	}
+	return insecure.NewCredentials()
+}
+
+type grpcNodeServer struct {
+	nodepb.UnimplementedNodeServer
+	handle func(Conn)
+}
+
+func (s *grpcNodeServer) Stream(stream nodepb.Node_StreamServer) error {
+	conn := &grpcConn{stream: stream, done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		s.handle(conn)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-conn.done:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+type grpcListener struct {
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// Addr returns the address the server listens on.
+func (l grpcListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l grpcListener) Close() error {
+	l.server.Stop()
+	return nil
+}
+
+func (t GRPC) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(
+		grpc.Creds(t.credentials()),
+		grpc.MaxRecvMsgSize(messageLimit(t.MaxMessageSize)),
+	)
+	nodepb.RegisterNodeServer(server, &grpcNodeServer{handle: handle})
+	go server.Serve(listener)
+
+	return grpcListener{server: server, listener: listener}, nil
+}
+
+func (t GRPC) Dial(address string) (Conn, error) {
+	cc, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(t.credentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(messageLimit(t.MaxMessageSize))),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := nodepb.NewNodeClient(cc).Stream(ctx)
+	if err != nil {
+		cancel()
+		cc.Close()
+		return nil, err
+	}
+
+	return &grpcConn{
+		stream: stream,
+		done:   make(chan struct{}),
+		closeFn: func() error {
+			cancel()
+			return cc.Close()
+		},
+	}, nil
+}
+
+// msgStream is the part of nodepb.Node_StreamClient and
+// nodepb.Node_StreamServer that grpcConn needs.
+type msgStream interface {
+	Send(*nodepb.Message) error
+	Recv() (*nodepb.Message, error)
+}
+
+// grpcConn adapts either end of the Stream RPC to Conn.
+type grpcConn struct {
+	stream  msgStream
+	sendMu  sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+	closeFn func() error
+}
+
+func (c *grpcConn) Send(msg Message) error {
+	// gRPC streams do not allow concurrent SendMsg calls
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return c.stream.Send(toProto(msg))
+}
+
+func (c *grpcConn) Recv() (Message, error) {
+	pb, err := c.stream.Recv()
+	if err != nil {
+		return Message{}, err
+	}
+	return fromProto(pb), nil
+}
+
+func (c *grpcConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		if c.closeFn != nil {
+			err = c.closeFn()
+		}
+	})
+	return err
+}
+
+// toProto converts msg to the message the Stream RPC carries. Slices, maps
+// and byte fields are shared with msg, not copied.
+func toProto(msg Message) *nodepb.Message {
+	pb := &nodepb.Message{
+		Type:           msg.Type,
+		Content:        msg.Content,
+		From:           int64(msg.From),
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Found:          msg.Found,
+		Term:           int64(msg.Term),
+		VoteGranted:    msg.VoteGranted,
+		TaskId:         msg.TaskID,
+		Error:          msg.Error,
+		Peers:          convertKeys[int64](msg.Peers),
+		RequestId:      msg.RequestID,
+		Forwarded:      msg.Forwarded,
+		Seq:            msg.Seq,
+		TaskType:       msg.TaskType,
+		Clock:          convertKeys[int64](msg.Clock),
+		Hashes:         msg.Hashes,
+		Buckets:        convertInts[int64](msg.Buckets),
+		Client:         msg.Client,
+		Compression:    msg.Compression,
+		Compressed:     msg.Compressed,
+		Mac:            msg.MAC,
+		Stream:         msg.Stream,
+		Offset:         int64(msg.Offset),
+		Size:           int64(msg.Size),
+		Checksum:       msg.Checksum,
+		Data:           msg.Data,
+		Ring:           convertInts[int64](msg.Ring),
+		Ttl:            int64(msg.TTL),
+		Expires:        msg.Expires,
+		Role:           msg.Role,
+		TraceId:        msg.TraceID,
+		SpanId:         msg.SpanID,
+		Version:        int64(msg.Version),
+		Capabilities:   msg.Capabilities,
+		Tx:             msg.Tx,
+		Consistency:    msg.Consistency,
+		Progress:       int32(msg.Progress),
+		Beat:           msg.Beat,
+		IdempotencyKey: msg.IdempotencyKey,
+		Priority:       msg.Priority,
+		User:           msg.User,
+		Context:        convertKeys[int64](msg.Context),
+		Siblings:       entriesToProto(msg.Siblings),
+		LogIndex:       msg.LogIndex,
+		LogTerm:        int64(msg.LogTerm),
+		SentAt:         msg.SentAt,
+		Namespace:      msg.Namespace,
+		Timeout:        int64(msg.Timeout),
+	}
+	if msg.Entries != nil {
+		pb.Entries = make(map[string]*nodepb.Entry, len(msg.Entries))
+		for key, e := range msg.Entries {
+			pb.Entries[key] = entryToProto(e)
+		}
+	}
+	if msg.Load != nil {
+		pb.Load = &nodepb.Load{
+			QueueDepth:    int64(msg.Load.QueueDepth),
+			QueueCapacity: int64(msg.Load.QueueCapacity),
+			IdleWorkers:   int64(msg.Load.IdleWorkers),
+			Goroutines:    int64(msg.Load.Goroutines),
+			HeapBytes:     msg.Load.HeapBytes,
+		}
+	}
+	if msg.Timestamp != nil {
+		pb.Timestamp = timestampToProto(*msg.Timestamp)
+	}
+	if msg.Target != nil {
+		target := int32(*msg.Target)
+		pb.Target = &target
+	}
+	return pb
+}
+
+// fromProto converts a message received on the Stream RPC back, sharing
+// its slices, maps and byte fields.
+func fromProto(pb *nodepb.Message) Message {
+	msg := Message{
+		Type:           pb.Type,
+		Content:        pb.Content,
+		From:           int(pb.From),
+		Key:            pb.Key,
+		Value:          pb.Value,
+		Found:          pb.Found,
+		Term:           int(pb.Term),
+		VoteGranted:    pb.VoteGranted,
+		TaskID:         pb.TaskId,
+		Error:          pb.Error,
+		Peers:          convertKeys[int](pb.Peers),
+		RequestID:      pb.RequestId,
+		Forwarded:      pb.Forwarded,
+		Seq:            pb.Seq,
+		TaskType:       pb.TaskType,
+		Clock:          convertKeys[int](pb.Clock),
+		Hashes:         pb.Hashes,
+		Buckets:        convertInts[int](pb.Buckets),
+		Client:         pb.Client,
+		Compression:    pb.Compression,
+		Compressed:     pb.Compressed,
+		MAC:            pb.Mac,
+		Stream:         pb.Stream,
+		Offset:         int(pb.Offset),
+		Size:           int(pb.Size),
+		Checksum:       pb.Checksum,
+		Data:           pb.Data,
+		Ring:           convertInts[int](pb.Ring),
+		TTL:            time.Duration(pb.Ttl),
+		Expires:        pb.Expires,
+		Role:           pb.Role,
+		TraceID:        pb.TraceId,
+		SpanID:         pb.SpanId,
+		Version:        int(pb.Version),
+		Capabilities:   pb.Capabilities,
+		Tx:             pb.Tx,
+		Consistency:    pb.Consistency,
+		Progress:       int(pb.Progress),
+		Beat:           pb.Beat,
+		IdempotencyKey: pb.IdempotencyKey,
+		Priority:       pb.Priority,
+		User:           pb.User,
+		Context:        convertKeys[int](pb.Context),
+		Siblings:       entriesFromProto(pb.Siblings),
+		LogIndex:       pb.LogIndex,
+		LogTerm:        int(pb.LogTerm),
+		SentAt:         pb.SentAt,
+		Namespace:      pb.Namespace,
+		Timeout:        time.Duration(pb.Timeout),
+	}
+	if pb.Entries != nil {
+		msg.Entries = make(map[string]Entry, len(pb.Entries))
+		for key, e := range pb.Entries {
+			msg.Entries[key] = entryFromProto(e)
+		}
+	}
+	if pb.Load != nil {
+		msg.Load = &Load{
+			QueueDepth:    int(pb.Load.QueueDepth),
+			QueueCapacity: int(pb.Load.QueueCapacity),
+			IdleWorkers:   int(pb.Load.IdleWorkers),
+			Goroutines:    int(pb.Load.Goroutines),
+			HeapBytes:     pb.Load.HeapBytes,
+		}
+	}
+	if pb.Timestamp != nil {
+		ts := timestampFromProto(pb.Timestamp)
+		msg.Timestamp = &ts
+	}
+	if pb.Target != nil {
+		target := int(*pb.Target)
+		msg.Target = &target
+	}
+	return msg
+}
+
+func entryToProto(e Entry) *nodepb.Entry {
+	return &nodepb.Entry{
+		Value:     e.Value,
+		Deleted:   e.Deleted,
+		Timestamp: timestampToProto(e.Timestamp),
+		Expires:   e.Expires,
+		Version:   convertKeys[int64](e.Version),
+		Siblings:  entriesToProto(e.Siblings),
+	}
+}
+
+func entryFromProto(pb *nodepb.Entry) Entry {
+	return Entry{
+		Value:     pb.GetValue(),
+		Deleted:   pb.GetDeleted(),
+		Timestamp: timestampFromProto(pb.GetTimestamp()),
+		Expires:   pb.GetExpires(),
+		Version:   convertKeys[int](pb.GetVersion()),
+		Siblings:  entriesFromProto(pb.GetSiblings()),
+	}
+}
+
+func entriesToProto(entries []Entry) []*nodepb.Entry {
+	if entries == nil {
+		return nil
+	}
+	pb := make([]*nodepb.Entry, len(entries))
+	for i, e := range entries {
+		pb[i] = entryToProto(e)
+	}
+	return pb
+}
+
+func entriesFromProto(pb []*nodepb.Entry) []Entry {
+	if pb == nil {
+		return nil
+	}
+	entries := make([]Entry, len(pb))
+	for i, e := range pb {
+		entries[i] = entryFromProto(e)
+	}
+	return entries
+}
+
+func timestampToProto(ts Timestamp) *nodepb.Timestamp {
+	return &nodepb.Timestamp{Time: ts.Time, Node: int64(ts.Node)}
+}
+
+func timestampFromProto(pb *nodepb.Timestamp) Timestamp {
+	return Timestamp{Time: pb.GetTime(), Node: int(pb.GetNode())}
+}
+
+// convertKeys copies a map keyed by node id, e.g. a VectorClock, to one
+// with another integer key type.
+func convertKeys[To, From int | int64, V any, M ~map[From]V](m M) map[To]V {
+	if m == nil {
+		return nil
+	}
+	converted := make(map[To]V, len(m))
+	for k, v := range m {
+		converted[To(k)] = v
+	}
+	return converted
+}
+
+// convertInts copies a slice of integers, e.g. node ids, to one of another
+// integer type.
+func convertInts[To, From int | int64](s []From) []To {
+	if s == nil {
+		return nil
+	}
+	converted := make([]To, len(s))
+	for i, v := range s {
+		converted[i] = To(v)
+	}
+	return converted
+}
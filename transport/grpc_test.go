@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+)
+
+// fullMessage is sampleMessage with every other field set too, so a field
+// added to Message but not to the protobuf mapping fails the round trip.
+func fullMessage(t *testing.T) Message {
+	msg := sampleMessage()
+	v := reflect.ValueOf(&msg).Elem()
+	for i := range v.NumField() {
+		field := v.Field(i)
+		if !field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(v.Type().Field(i).Name)
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			field.SetInt(int64(i + 1))
+		case reflect.Uint32, reflect.Uint64:
+			field.SetUint(uint64(i + 1))
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		case reflect.Map:
+			field.Set(reflect.MakeMap(field.Type()))
+			field.SetMapIndex(reflect.Zero(field.Type().Key()), reflect.Zero(field.Type().Elem()))
+		default:
+			t.Fatalf("fullMessage does not set %s fields like %s", field.Kind(), v.Type().Field(i).Name)
+		}
+	}
+	msg.Load.IdleWorkers = 4
+	msg.Entries["user:42"] = Entry{Value: "v", Timestamp: Timestamp{Time: 5, Node: 2}, Siblings: msg.Siblings}
+	return msg
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	// The server echoes one message; the stream ends when it returns
+	listener, err := GRPC{}.Listen("127.0.0.1:0", func(conn Conn) {
+		msg, err := conn.Recv()
+		if err == nil {
+			err = conn.Send(msg)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := GRPC{}.Dial(listener.(grpcListener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := fullMessage(t)
+	if err := conn.Send(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := conn.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip changed the message:\n got %+v\nwant %+v", got, want)
+	}
+}
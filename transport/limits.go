@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// A connection's messages are bounded in size, MaxFrameSize unless the
+// transport sets a smaller MaxMessageSize, so a peer cannot make the reader
+// allocate unbounded memory, whether by a huge length prefix or by a JSON
+// line that never ends. Recv reports a message over the limit as
+// ErrTooLarge and one it cannot decode as ErrMalformed; either way the
+// stream cannot be trusted any further and the connection is closed.
+
+var (
+	// ErrTooLarge is returned by Recv for a message over the size limit.
+	ErrTooLarge = errors.New("message too large")
+	// ErrMalformed is returned by Recv for a message that is not valid
+	// JSON, or not a valid message.
+	ErrMalformed = errors.New("malformed message")
+)
+
+// messageLimit returns the size limit of a connection configured with
+// limit, where 0 means the default.
+func messageLimit(limit int) int {
+	if limit <= 0 || limit > MaxFrameSize {
+		return MaxFrameSize
+	}
+	return limit
+}
+
+// limitedReader fails reads once more than limit bytes were read since it
+// was last reset. A JSON decoder reads ahead, so a message may be charged
+// for part of the next one; the limit is still never exceeded by more than
+// that.
+type limitedReader struct {
+	reader io.Reader
+	limit  int
+	left   int
+}
+
+func newLimitedReader(reader io.Reader, limit int) *limitedReader {
+	limit = messageLimit(limit)
+	return &limitedReader{reader: reader, limit: limit, left: limit}
+}
+
+func (l *limitedReader) reset() {
+	l.left = l.limit
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, fmt.Errorf("%w: over %d bytes", ErrTooLarge, l.limit)
+	}
+	if len(p) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= n
+	return n, err
+}
+
+// decodeError classifies an error decoding a message: JSON that does not
+// parse, or does not fit a Message, is ErrMalformed.
+func decodeError(err error) error {
+	var syntax *json.SyntaxError
+	var mismatch *json.UnmarshalTypeError
+	if errors.As(err, &syntax) || errors.As(err, &mismatch) {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return err
+}
+
+// Quarantine defaults.
+const (
+	DefaultQuarantineStrikes  = 3
+	DefaultQuarantineWindow   = time.Minute
+	DefaultQuarantineDuration = 5 * time.Minute
+)
+
+// Quarantine refuses connections from a host whose connections sent
+// malformed or oversized messages Strikes times within Window, for
+// Duration, so a broken or hostile client cannot keep the listener busy
+// decoding garbage by reconnecting. Loopback hosts are never quarantined,
+// as every node of a cluster on one host shares them.
+type Quarantine struct {
+	Strikes  int
+	Window   time.Duration
+	Duration time.Duration
+
+	mutex sync.Mutex
+	hosts map[string]*quarantined
+}
+
+type quarantined struct {
+	strikes []time.Time
+	until   time.Time
+}
+
+// NewQuarantine returns a quarantine with the default thresholds.
+func NewQuarantine() *Quarantine {
+	return &Quarantine{
+		Strikes:  DefaultQuarantineStrikes,
+		Window:   DefaultQuarantineWindow,
+		Duration: DefaultQuarantineDuration,
+		hosts:    make(map[string]*quarantined),
+	}
+}
+
+// Refuses reports whether host is quarantined.
+func (q *Quarantine) Refuses(host string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	h, ok := q.hosts[host]
+	if !ok {
+		return false
+	}
+	if now := time.Now(); !h.until.After(now) {
+		if len(h.strikes) == 0 || now.Sub(h.strikes[len(h.strikes)-1]) > q.Window {
+			delete(q.hosts, host)
+		}
+		return false
+	}
+	return true
+}
+
+// strike records a bad message from host and reports whether that put it
+// in quarantine.
+func (q *Quarantine) strike(host string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	if q.hosts == nil {
+		q.hosts = make(map[string]*quarantined)
+	}
+	now := time.Now()
+	h, ok := q.hosts[host]
+	if !ok {
+		h = &quarantined{}
+		q.hosts[host] = h
+	}
+	recent := h.strikes[:0]
+	for _, at := range h.strikes {
+		if now.Sub(at) <= q.Window {
+			recent = append(recent, at)
+		}
+	}
+	h.strikes = append(recent, now)
+	if len(h.strikes) < q.Strikes {
+		return false
+	}
+	h.strikes = nil
+	h.until = now.Add(q.Duration)
+	return true
+}
+
+// Quarantined returns the hosts refused now and until when.
+func (q *Quarantine) Quarantined() map[string]time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	hosts := make(map[string]time.Time)
+	now := time.Now()
+	for host, h := range q.hosts {
+		if h.until.After(now) {
+			hosts[host] = h.until
+		}
+	}
+	return hosts
+}
+
+// remoteHost returns the host conn was accepted from, without the port.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// guardedConn strikes the host an accepted connection came from for every
+// malformed or oversized message it receives.
+type guardedConn struct {
+	Conn
+	host       string
+	quarantine *Quarantine
+}
+
+func (c *guardedConn) Recv() (Message, error) {
+	msg, err := c.Conn.Recv()
+	if err != nil && (errors.Is(err, ErrMalformed) || errors.Is(err, ErrTooLarge)) {
+		if c.quarantine.strike(c.host) {
+			slog.Warn("quarantined host sending malformed messages", "remote", c.host, "for", c.quarantine.Duration, "err", err)
+		}
+		err = fmt.Errorf("from %s: %w", c.host, err)
+	}
+	return msg, err
+}
+
+func (c *guardedConn) Write(msg Message) error {
+	return writeBatched(c.Conn, msg)
+}
+
+func (c *guardedConn) Flush() error {
+	return flushBatched(c.Conn)
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Memory connects nodes living in the same process over net.Pipe, so a
+// cluster can run without opening any ports. Addresses are arbitrary names
+// that are only meaningful within one Memory.
+type Memory struct {
+	mutex     sync.RWMutex
+	listeners map[string]func(Conn)
+}
+
+// NewMemory returns an empty in-process network.
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]func(Conn))}
+}
+
+func (m *Memory) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, taken := m.listeners[address]; taken {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+	m.listeners[address] = handle
+	return memListener{memory: m, address: address}, nil
+}
+
+func (m *Memory) Dial(address string) (Conn, error) {
+	m.mutex.RLock()
+	handle, ok := m.listeners[address]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+
+	client, server := net.Pipe()
+	go handle(newJSONConn(server, bufio.NewReader(server), 0))
+	return newJSONConn(client, bufio.NewReader(client), 0), nil
+}
+
+type memListener struct {
+	memory  *Memory
+	address string
+}
+
+// Close stops accepting connections. Like closing a TCP listener, it leaves
+// established connections open.
+func (l memListener) Close() error {
+	l.memory.mutex.Lock()
+	delete(l.memory.listeners, l.address)
+	l.memory.mutex.Unlock()
+	return nil
+}
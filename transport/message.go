@@ -0,0 +1,144 @@
+package transport
+
+import "time"
+
+// Message is the unit exchanged between nodes. Only the fields relevant to
+// a message's Type are set.
+type Message struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	From    int    `json:"from"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Found   bool   `json:"found,omitempty"`
+	Term    int    `json:"term,omitempty"`
+	TaskID  string `json:"task_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	VoteGranted  bool             `json:"vote_granted,omitempty"`
+	Peers        map[int]string   `json:"peers,omitempty"`
+	RequestID    string           `json:"request_id,omitempty"`
+	Forwarded    bool             `json:"forwarded,omitempty"`
+	Seq          uint64           `json:"seq,omitempty"`
+	TaskType     string           `json:"task_type,omitempty"`
+	Clock        VectorClock      `json:"clock,omitempty"`
+	Hashes       []uint64         `json:"hashes,omitempty"`
+	Buckets      []int            `json:"buckets,omitempty"`
+	Ring         []int            `json:"ring,omitempty"`
+	Entries      map[string]Entry `json:"entries,omitempty"`
+	Client       bool             `json:"client,omitempty"`
+	Load         *Load            `json:"load,omitempty"`
+	Compression  string           `json:"compression,omitempty"`
+	Compressed   []byte           `json:"compressed,omitempty"`
+	MAC          []byte           `json:"mac,omitempty"`
+	Timestamp    *Timestamp       `json:"timestamp,omitempty"`
+	TTL          time.Duration    `json:"ttl,omitempty"`
+	Expires      int64            `json:"expires,omitempty"`
+	Role         string           `json:"role,omitempty"`
+	TraceID      string           `json:"trace_id,omitempty"`
+	SpanID       string           `json:"span_id,omitempty"`
+	Version      int              `json:"version,omitempty"`
+	Capabilities []string         `json:"capabilities,omitempty"`
+	Tx           string           `json:"tx,omitempty"`
+	Consistency  string           `json:"consistency,omitempty"`
+	Target       *int             `json:"target,omitempty"`
+	Progress     int              `json:"progress,omitempty"`
+	Beat         uint64           `json:"beat,omitempty"`
+
+	// LogIndex and LogTerm are the index and term of the last entry of a
+	// candidate's log, sent with its request_vote in linearizable mode; see
+	// node.LinearLog.
+	LogIndex uint64 `json:"log_index,omitempty"`
+	LogTerm  int    `json:"log_term,omitempty"`
+	// SentAt is when the leader sent a heartbeat, in Unix nanoseconds,
+	// echoed in the heartbeat_ack so the lease it renews runs from then.
+	SentAt int64 `json:"sent_at,omitempty"`
+
+	// A task's idempotency key identifies it across retries; see
+	// node.Dedup.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Priority is a task's priority: high, normal or low. Empty means
+	// normal.
+	Priority string `json:"priority,omitempty"`
+	// User names the client making a client request, for access control;
+	// see node.ACL.
+	User string `json:"user,omitempty"`
+	// Namespace is the namespace the keys of a client request are in,
+	// empty for the default one; see node.NamespacedKey.
+	Namespace string `json:"namespace,omitempty"`
+	// Timeout, if not zero, is how long the sender of a request waits for
+	// its outcome from when it sends it. The node serving the request
+	// cancels the work done on its behalf, e.g. a task's handler, once it
+	// has passed.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Context is the version vector of a key's values: returned by a get,
+	// passed back by a set that supersedes them, and carried by replicated
+	// writes. Siblings are the values of a key written concurrently with
+	// the one in Value. Both are only set by nodes keeping siblings; see
+	// node.ConflictsSiblings.
+	Context  VectorClock `json:"context,omitempty"`
+	Siblings []Entry     `json:"siblings,omitempty"`
+
+	// Streamed messages are split into chunks; see Chunked.
+	Stream   string `json:"stream,omitempty"`
+	Offset   int    `json:"offset,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Checksum uint32 `json:"checksum,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// Timestamp is a Lamport timestamp. The id of the node that issued it
+// breaks ties between equal times, so timestamps are totally ordered.
+type Timestamp struct {
+	Time uint64 `json:"time"`
+	Node int    `json:"node"`
+}
+
+// Less reports whether t orders before other.
+func (t Timestamp) Less(other Timestamp) bool {
+	if t.Time != other.Time {
+		return t.Time < other.Time
+	}
+	return t.Node < other.Node
+}
+
+// Entry is a versioned key-value entry. A deleted entry is kept as a
+// tombstone so the delete can win over older writes.
+type Entry struct {
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Timestamp Timestamp `json:"timestamp"`
+	// Expires, if not zero, is when the entry expires, in Unix
+	// milliseconds.
+	Expires int64 `json:"expires,omitempty"`
+	// Version is the version vector the entry was written with: for each
+	// node, the latest timestamp of its writes to the key the entry
+	// supersedes. Siblings are the entries written concurrently with it,
+	// each with its own version. Entries without a version are ordered by
+	// Timestamp alone.
+	Version  VectorClock `json:"version,omitempty"`
+	Siblings []Entry     `json:"siblings,omitempty"`
+}
+
+// ExpiresAt converts a time to live into the Expires of an entry written
+// now. A ttl of zero never expires.
+func ExpiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixMilli()
+}
+
+// Expired reports whether e has expired by now.
+func (e Entry) Expired(now time.Time) bool {
+	return e.Expires != 0 && now.UnixMilli() >= e.Expires
+}
+
+// Load is a node's resource usage, piggybacked on heartbeats.
+type Load struct {
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	IdleWorkers   int    `json:"idle_workers"`
+	Goroutines    int    `json:"goroutines"`
+	HeapBytes     uint64 `json:"heap_bytes"`
+}
@@ -0,0 +1,600 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// MsgpackCodec encodes messages as MessagePack (see msgpack.org). Structs
+// are maps from their JSON field names to their values, leaving out the
+// fields JSON leaves out, so any msgpack library can read the frames. It
+// covers what messages are made of: strings, byte slices, booleans,
+// integers, floats, and slices, maps, structs and pointers of them.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string { return CodecMsgpack }
+
+func (MsgpackCodec) Append(buf []byte, msg Message) ([]byte, error) {
+	return appendMsgpack(buf, reflect.ValueOf(msg))
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, msg *Message) error {
+	d := msgpackDecoder{data: data}
+	err := d.decode(reflect.ValueOf(msg).Elem(), 0)
+	if err == nil && d.pos != len(data) {
+		err = fmt.Errorf("%d bytes after the message", len(data)-d.pos)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: msgpack: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+// maxMsgpackDepth bounds how deeply decoded values nest, so a hostile
+// payload cannot exhaust the stack.
+const maxMsgpackDepth = 64
+
+var errMsgpackTruncated = errors.New("truncated")
+
+// msgpackField is a struct field as msgpack encodes it.
+type msgpackField struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+// msgpackStruct lists the encoded fields of a struct type, and finds them
+// by name.
+type msgpackStruct struct {
+	fields []msgpackField
+	byName map[string]int
+}
+
+// msgpackStructs caches the msgpackStruct of each struct type encoded or
+// decoded so far.
+var msgpackStructs sync.Map
+
+func msgpackStructOf(t reflect.Type) *msgpackStruct {
+	if info, ok := msgpackStructs.Load(t); ok {
+		return info.(*msgpackStruct)
+	}
+	info := &msgpackStruct{byName: make(map[string]int)}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		info.byName[name] = len(info.fields)
+		info.fields = append(info.fields, msgpackField{index: i, name: name, omitEmpty: strings.Contains(opts, "omitempty")})
+	}
+	actual, _ := msgpackStructs.LoadOrStore(t, info)
+	return actual.(*msgpackStruct)
+}
+
+// isEmptyValue reports whether JSON's omitempty leaves v out.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+func appendMsgpack(buf []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(buf, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xca), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(buf, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendMsgpackBytes(buf, v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		buf = appendMsgpackHeader(buf, v.Len(), 0x90, 0xdc)
+		for i := range v.Len() {
+			var err error
+			if buf, err = appendMsgpack(buf, v.Index(i)); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = appendMsgpackHeader(buf, v.Len(), 0x80, 0xde)
+		iter := v.MapRange()
+		for iter.Next() {
+			var err error
+			if buf, err = appendMsgpack(buf, iter.Key()); err != nil {
+				return buf, err
+			}
+			if buf, err = appendMsgpack(buf, iter.Value()); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return appendMsgpack(buf, v.Elem())
+	case reflect.Struct:
+		info := msgpackStructOf(v.Type())
+		count := 0
+		for _, f := range info.fields {
+			if !f.omitEmpty || !isEmptyValue(v.Field(f.index)) {
+				count++
+			}
+		}
+		buf = appendMsgpackHeader(buf, count, 0x80, 0xde)
+		for _, f := range info.fields {
+			field := v.Field(f.index)
+			if f.omitEmpty && isEmptyValue(field) {
+				continue
+			}
+			buf = appendMsgpackString(buf, f.name)
+			var err error
+			if buf, err = appendMsgpack(buf, field); err != nil {
+				return buf, err
+			}
+		}
+		return buf, nil
+	}
+	return buf, fmt.Errorf("msgpack: cannot encode %s", v.Type())
+}
+
+func appendMsgpackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+}
+
+func appendMsgpackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u < 0x80:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return append(buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), u)
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+func appendMsgpackBytes(buf, b []byte) []byte {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xc5), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xc6), uint32(n))
+	}
+	return append(buf, b...)
+}
+
+// appendMsgpackHeader appends the header of an array or map of n elements:
+// fix, the fixarray or fixmap prefix, for fewer than 16, and otherwise
+// wide, the 16-bit form, followed by the 32-bit one.
+func appendMsgpackHeader(buf []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, wide), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, wide+1), uint32(n))
+}
+
+// msgpackDecoder reads msgpack values from data, starting at pos.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+// take returns the next n bytes, which alias data.
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// integer reads an integer of any width, returned as the bits of an int64
+// if negative and of a uint64 otherwise.
+func (d *msgpackDecoder) integer() (bits uint64, negative bool, err error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case b < 0x80:
+		return uint64(b), false, nil
+	case b >= 0xe0:
+		return uint64(int64(int8(b))), true, nil
+	case b >= 0xcc && b <= 0xcf:
+		bits, err = d.uint(1 << (b - 0xcc))
+		return bits, false, err
+	case b >= 0xd0 && b <= 0xd3:
+		size := 1 << (b - 0xd0)
+		if bits, err = d.uint(size); err != nil {
+			return 0, false, err
+		}
+		// Sign-extend from size bytes
+		shift := 64 - 8*size
+		i := int64(bits<<shift) >> shift
+		return uint64(i), i < 0, nil
+	}
+	return 0, false, fmt.Errorf("expected an integer, got 0x%02x", b)
+}
+
+// raw reads a str or bin value and returns its bytes, which alias data.
+func (d *msgpackDecoder) raw() ([]byte, error) {
+	b, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	var n uint64
+	switch {
+	case b&0xe0 == 0xa0:
+		n = uint64(b & 0x1f)
+	case b == 0xd9 || b == 0xc4:
+		n, err = d.uint(1)
+	case b == 0xda || b == 0xc5:
+		n, err = d.uint(2)
+	case b == 0xdb || b == 0xc6:
+		n, err = d.uint(4)
+	default:
+		return nil, fmt.Errorf("expected a string, got 0x%02x", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.take(int(n))
+}
+
+// length reads the header of an array, if array is set, or of a map, and
+// returns its number of elements, checked against the bytes left.
+func (d *msgpackDecoder) length(array bool) (int, error) {
+	b, err := d.next()
+	if err != nil {
+		return 0, err
+	}
+	fix, wide, what := byte(0x80), byte(0xde), "a map"
+	if array {
+		fix, wide, what = 0x90, 0xdc, "an array"
+	}
+	var n uint64
+	switch {
+	case b&0xf0 == fix:
+		n = uint64(b & 0x0f)
+	case b == wide:
+		n, err = d.uint(2)
+	case b == wide+1:
+		n, err = d.uint(4)
+	default:
+		return 0, fmt.Errorf("expected %s, got 0x%02x", what, b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Every element takes at least a byte
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errMsgpackTruncated
+	}
+	return int(n), nil
+}
+
+// decode reads a value into v, which must be settable.
+func (d *msgpackDecoder) decode(v reflect.Value, depth int) error {
+	if depth > maxMsgpackDepth {
+		return errors.New("values nested too deeply")
+	}
+	if d.pos >= len(d.data) {
+		return errMsgpackTruncated
+	}
+	if d.data[d.pos] == 0xc0 {
+		d.pos++
+		v.SetZero()
+		return nil
+	}
+
+	t := v.Type()
+	switch v.Kind() {
+	case reflect.Bool:
+		b, _ := d.next()
+		if b != 0xc2 && b != 0xc3 {
+			return fmt.Errorf("expected a boolean, got 0x%02x", b)
+		}
+		v.SetBool(b == 0xc3)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits, negative, err := d.integer()
+		if err != nil {
+			return err
+		}
+		i := int64(bits)
+		if !negative && bits > math.MaxInt64 || v.OverflowInt(i) {
+			return fmt.Errorf("%d overflows %s", bits, t)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		bits, negative, err := d.integer()
+		if err != nil {
+			return err
+		}
+		if negative || v.OverflowUint(bits) {
+			return fmt.Errorf("%d overflows %s", int64(bits), t)
+		}
+		v.SetUint(bits)
+	case reflect.Float32, reflect.Float64:
+		switch d.data[d.pos] {
+		case 0xca:
+			d.pos++
+			bits, err := d.uint(4)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(float64(math.Float32frombits(uint32(bits))))
+		case 0xcb:
+			d.pos++
+			bits, err := d.uint(8)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(math.Float64frombits(bits))
+		default:
+			bits, negative, err := d.integer()
+			if err != nil {
+				return err
+			}
+			if negative {
+				v.SetFloat(float64(int64(bits)))
+			} else {
+				v.SetFloat(float64(bits))
+			}
+		}
+	case reflect.String:
+		b, err := d.raw()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			b, err := d.raw()
+			if err != nil {
+				return err
+			}
+			// The payload is reused once decoded, so the bytes are copied
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		n, err := d.length(true)
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		for i := range n {
+			if err := d.decode(s.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		n, err := d.length(true)
+		if err != nil {
+			return err
+		}
+		if n != v.Len() {
+			return fmt.Errorf("expected %d elements for %s, got %d", v.Len(), t, n)
+		}
+		for i := range n {
+			if err := d.decode(v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.length(false)
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(t, n)
+		key, elem := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+		for range n {
+			key.SetZero()
+			if err := d.decode(key, depth+1); err != nil {
+				return err
+			}
+			elem.SetZero()
+			if err := d.decode(elem, depth+1); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.decode(v.Elem(), depth+1)
+	case reflect.Struct:
+		n, err := d.length(false)
+		if err != nil {
+			return err
+		}
+		info := msgpackStructOf(t)
+		for range n {
+			name, err := d.raw()
+			if err != nil {
+				return err
+			}
+			i, ok := info.byName[string(name)]
+			if !ok {
+				// A field of a newer build
+				if err := d.skip(depth + 1); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(info.fields[i].index), depth+1); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("cannot decode into %s", t)
+	}
+	return nil
+}
+
+// skip reads past a value of any type.
+func (d *msgpackDecoder) skip(depth int) error {
+	if depth > maxMsgpackDepth {
+		return errors.New("values nested too deeply")
+	}
+	b, err := d.next()
+	if err != nil {
+		return err
+	}
+	var size, elements uint64
+	switch {
+	case b < 0x80 || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		return nil
+	case b&0xe0 == 0xa0:
+		size = uint64(b & 0x1f)
+	case b&0xf0 == 0x90:
+		elements = uint64(b & 0x0f)
+	case b&0xf0 == 0x80:
+		elements = 2 * uint64(b&0x0f)
+	case b == 0xcc || b == 0xd0:
+		size = 1
+	case b == 0xcd || b == 0xd1:
+		size = 2
+	case b == 0xce || b == 0xd2 || b == 0xca:
+		size = 4
+	case b == 0xcf || b == 0xd3 || b == 0xcb:
+		size = 8
+	case b == 0xd9 || b == 0xc4:
+		size, err = d.uint(1)
+	case b == 0xda || b == 0xc5:
+		size, err = d.uint(2)
+	case b == 0xdb || b == 0xc6:
+		size, err = d.uint(4)
+	case b == 0xdc:
+		elements, err = d.uint(2)
+	case b == 0xdd:
+		elements, err = d.uint(4)
+	case b == 0xde:
+		elements, err = d.uint(2)
+		elements *= 2
+	case b == 0xdf:
+		elements, err = d.uint(4)
+		elements *= 2
+	case b >= 0xd4 && b <= 0xd8:
+		// fixext: a type byte and 1 to 16 bytes of data
+		size = 1 + 1<<(b-0xd4)
+	case b >= 0xc7 && b <= 0xc9:
+		// ext: a length, a type byte and the data
+		size, err = d.uint(1 << (b - 0xc7))
+		size++
+	default:
+		return fmt.Errorf("unknown type 0x%02x", b)
+	}
+	if err != nil {
+		return err
+	}
+	if size > uint64(len(d.data)-d.pos) || elements > uint64(len(d.data)-d.pos) {
+		return errMsgpackTruncated
+	}
+	d.pos += int(size)
+	for range elements {
+		if err := d.skip(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,915 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: proto/node.proto
+
+package nodepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Message struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Type        string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Content     string                 `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	From        int64                  `protobuf:"varint,3,opt,name=from,proto3" json:"from,omitempty"`
+	Key         string                 `protobuf:"bytes,4,opt,name=key,proto3" json:"key,omitempty"`
+	Value       string                 `protobuf:"bytes,5,opt,name=value,proto3" json:"value,omitempty"`
+	Found       bool                   `protobuf:"varint,6,opt,name=found,proto3" json:"found,omitempty"`
+	Term        int64                  `protobuf:"varint,7,opt,name=term,proto3" json:"term,omitempty"`
+	VoteGranted bool                   `protobuf:"varint,8,opt,name=vote_granted,json=voteGranted,proto3" json:"vote_granted,omitempty"`
+	TaskId      string                 `protobuf:"bytes,9,opt,name=task_id,json=taskId,proto3" json:"task_id,omitempty"`
+	Error       string                 `protobuf:"bytes,10,opt,name=error,proto3" json:"error,omitempty"`
+	Peers       map[int64]string       `protobuf:"bytes,11,rep,name=peers,proto3" json:"peers,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	RequestId   string                 `protobuf:"bytes,12,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Forwarded   bool                   `protobuf:"varint,13,opt,name=forwarded,proto3" json:"forwarded,omitempty"`
+	Seq         uint64                 `protobuf:"varint,14,opt,name=seq,proto3" json:"seq,omitempty"`
+	TaskType    string                 `protobuf:"bytes,15,opt,name=task_type,json=taskType,proto3" json:"task_type,omitempty"`
+	Clock       map[int64]uint64       `protobuf:"bytes,16,rep,name=clock,proto3" json:"clock,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Hashes      []uint64               `protobuf:"varint,17,rep,packed,name=hashes,proto3" json:"hashes,omitempty"`
+	Buckets     []int64                `protobuf:"varint,18,rep,packed,name=buckets,proto3" json:"buckets,omitempty"`
+	Entries     map[string]*Entry      `protobuf:"bytes,19,rep,name=entries,proto3" json:"entries,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Client      bool                   `protobuf:"varint,20,opt,name=client,proto3" json:"client,omitempty"`
+	Load        *Load                  `protobuf:"bytes,21,opt,name=load,proto3" json:"load,omitempty"`
+	// Offered or accepted compression algorithm, only set on hello messages.
+	Compression string `protobuf:"bytes,22,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Gzip compressed content, replacing content on large messages.
+	Compressed []byte `protobuf:"bytes,23,opt,name=compressed,proto3" json:"compressed,omitempty"`
+	// HMAC-SHA256 of the message under the shared auth token.
+	Mac []byte `protobuf:"bytes,24,opt,name=mac,proto3" json:"mac,omitempty"`
+	// Lamport timestamp of a write, set on replicate messages, KV replies and
+	// watch_event messages.
+	Timestamp *Timestamp `protobuf:"bytes,25,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// Chunked streaming of large messages: stream_start carries the stream id,
+	// size and checksum of the encoded message, stream_chunk a slice of it at
+	// offset with its own checksum, and stream_end closes the stream.
+	Stream   string `protobuf:"bytes,26,opt,name=stream,proto3" json:"stream,omitempty"`
+	Offset   int64  `protobuf:"varint,27,opt,name=offset,proto3" json:"offset,omitempty"`
+	Size     int64  `protobuf:"varint,28,opt,name=size,proto3" json:"size,omitempty"`
+	Checksum uint32 `protobuf:"varint,29,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	Data     []byte `protobuf:"bytes,30,opt,name=data,proto3" json:"data,omitempty"`
+	// Node ids on the seed's hash ring, sent to a joining node.
+	Ring []int64 `protobuf:"varint,31,rep,packed,name=ring,proto3" json:"ring,omitempty"`
+	// Time to live in nanoseconds requested by a set, and the resulting
+	// expiry in Unix milliseconds carried by replicas and KV replies.
+	Ttl     int64 `protobuf:"varint,32,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Expires int64 `protobuf:"varint,33,opt,name=expires,proto3" json:"expires,omitempty"`
+	// Role of the node, only set on hello messages.
+	Role string `protobuf:"bytes,34,opt,name=role,proto3" json:"role,omitempty"`
+	// Trace the message belongs to and the span on the sender it was sent
+	// from, the parent of the receiver's span.
+	TraceId string `protobuf:"bytes,35,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	SpanId  string `protobuf:"bytes,36,opt,name=span_id,json=spanId,proto3" json:"span_id,omitempty"`
+	// Protocol version and optional features the node speaks, only set on
+	// hello messages. A hello without a version is from a version 1 node.
+	Version      int64    `protobuf:"varint,37,opt,name=version,proto3" json:"version,omitempty"`
+	Capabilities []string `protobuf:"bytes,38,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	// Transaction a tx_prepare, tx_commit or tx_abort is for, and that a
+	// committing transaction's writes belong to. The writes a node prepares
+	// travel in entries.
+	Tx string `protobuf:"bytes,39,opt,name=tx,proto3" json:"tx,omitempty"`
+	// Consistency level a get is served at: "one" (the default), "quorum"
+	// or "all" of the key's replicas.
+	Consistency string `protobuf:"bytes,40,opt,name=consistency,proto3" json:"consistency,omitempty"`
+	// Replica a hint holds a write for, while it is down.
+	Target *int32 `protobuf:"varint,41,opt,name=target,proto3,oneof" json:"target,omitempty"`
+	// Percentage of a task done, in a progress message; its partial output
+	// travels in content.
+	Progress int32 `protobuf:"varint,42,opt,name=progress,proto3" json:"progress,omitempty"`
+	// Sequence number of a heartbeat sent over UDP, so reordered and
+	// duplicated datagrams can be told apart.
+	Beat uint64 `protobuf:"varint,43,opt,name=beat,proto3" json:"beat,omitempty"`
+	// Key identifying a task across retries: a node runs a task whose key it
+	// has seen only once and answers copies with the first result.
+	IdempotencyKey string `protobuf:"bytes,44,opt,name=idempotency_key,json=idempotencyKey,proto3" json:"idempotency_key,omitempty"`
+	// Priority of a task: "high", "normal" or "low"; empty means normal.
+	Priority string `protobuf:"bytes,45,opt,name=priority,proto3" json:"priority,omitempty"`
+	// Name of the client making a client request, checked against the
+	// node's access control list.
+	User string `protobuf:"bytes,46,opt,name=user,proto3" json:"user,omitempty"`
+	// Version vector of a key's values, returned by gets, passed back by sets
+	// that supersede them and carried by replicated writes, and the values
+	// written concurrently with value, on clusters keeping siblings.
+	Context  map[int64]uint64 `protobuf:"bytes,47,rep,name=context,proto3" json:"context,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Siblings []*Entry         `protobuf:"bytes,48,rep,name=siblings,proto3" json:"siblings,omitempty"`
+	// Index and term of the last entry of a candidate's log, sent with its
+	// request_vote in linearizable mode.
+	LogIndex uint64 `protobuf:"varint,49,opt,name=log_index,json=logIndex,proto3" json:"log_index,omitempty"`
+	LogTerm  int64  `protobuf:"varint,50,opt,name=log_term,json=logTerm,proto3" json:"log_term,omitempty"`
+	// When the leader sent a heartbeat, in Unix nanoseconds, echoed in the
+	// heartbeat_ack.
+	SentAt int64 `protobuf:"varint,51,opt,name=sent_at,json=sentAt,proto3" json:"sent_at,omitempty"`
+	// Namespace the keys of a client request are in, empty for the default
+	// one.
+	Namespace string `protobuf:"bytes,52,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	// How long the sender of a request waits for its outcome, in
+	// nanoseconds; zero for no limit.
+	Timeout       int64 `protobuf:"varint,53,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_proto_node_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_node_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_proto_node_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Message) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Message) GetContent() string {
+	if x != nil {
+		return x.Content
+	}
+	return ""
+}
+
+func (x *Message) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *Message) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Message) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *Message) GetFound() bool {
+	if x != nil {
+		return x.Found
+	}
+	return false
+}
+
+func (x *Message) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *Message) GetVoteGranted() bool {
+	if x != nil {
+		return x.VoteGranted
+	}
+	return false
+}
+
+func (x *Message) GetTaskId() string {
+	if x != nil {
+		return x.TaskId
+	}
+	return ""
+}
+
+func (x *Message) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Message) GetPeers() map[int64]string {
+	if x != nil {
+		return x.Peers
+	}
+	return nil
+}
+
+func (x *Message) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Message) GetForwarded() bool {
+	if x != nil {
+		return x.Forwarded
+	}
+	return false
+}
+
+func (x *Message) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Message) GetTaskType() string {
+	if x != nil {
+		return x.TaskType
+	}
+	return ""
+}
+
+func (x *Message) GetClock() map[int64]uint64 {
+	if x != nil {
+		return x.Clock
+	}
+	return nil
+}
+
+func (x *Message) GetHashes() []uint64 {
+	if x != nil {
+		return x.Hashes
+	}
+	return nil
+}
+
+func (x *Message) GetBuckets() []int64 {
+	if x != nil {
+		return x.Buckets
+	}
+	return nil
+}
+
+func (x *Message) GetEntries() map[string]*Entry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+func (x *Message) GetClient() bool {
+	if x != nil {
+		return x.Client
+	}
+	return false
+}
+
+func (x *Message) GetLoad() *Load {
+	if x != nil {
+		return x.Load
+	}
+	return nil
+}
+
+func (x *Message) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+func (x *Message) GetCompressed() []byte {
+	if x != nil {
+		return x.Compressed
+	}
+	return nil
+}
+
+func (x *Message) GetMac() []byte {
+	if x != nil {
+		return x.Mac
+	}
+	return nil
+}
+
+func (x *Message) GetTimestamp() *Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Message) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *Message) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Message) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Message) GetChecksum() uint32 {
+	if x != nil {
+		return x.Checksum
+	}
+	return 0
+}
+
+func (x *Message) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Message) GetRing() []int64 {
+	if x != nil {
+		return x.Ring
+	}
+	return nil
+}
+
+func (x *Message) GetTtl() int64 {
+	if x != nil {
+		return x.Ttl
+	}
+	return 0
+}
+
+func (x *Message) GetExpires() int64 {
+	if x != nil {
+		return x.Expires
+	}
+	return 0
+}
+
+func (x *Message) GetRole() string {
+	if x != nil {
+		return x.Role
+	}
+	return ""
+}
+
+func (x *Message) GetTraceId() string {
+	if x != nil {
+		return x.TraceId
+	}
+	return ""
+}
+
+func (x *Message) GetSpanId() string {
+	if x != nil {
+		return x.SpanId
+	}
+	return ""
+}
+
+func (x *Message) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Message) GetCapabilities() []string {
+	if x != nil {
+		return x.Capabilities
+	}
+	return nil
+}
+
+func (x *Message) GetTx() string {
+	if x != nil {
+		return x.Tx
+	}
+	return ""
+}
+
+func (x *Message) GetConsistency() string {
+	if x != nil {
+		return x.Consistency
+	}
+	return ""
+}
+
+func (x *Message) GetTarget() int32 {
+	if x != nil && x.Target != nil {
+		return *x.Target
+	}
+	return 0
+}
+
+func (x *Message) GetProgress() int32 {
+	if x != nil {
+		return x.Progress
+	}
+	return 0
+}
+
+func (x *Message) GetBeat() uint64 {
+	if x != nil {
+		return x.Beat
+	}
+	return 0
+}
+
+func (x *Message) GetIdempotencyKey() string {
+	if x != nil {
+		return x.IdempotencyKey
+	}
+	return ""
+}
+
+func (x *Message) GetPriority() string {
+	if x != nil {
+		return x.Priority
+	}
+	return ""
+}
+
+func (x *Message) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *Message) GetContext() map[int64]uint64 {
+	if x != nil {
+		return x.Context
+	}
+	return nil
+}
+
+func (x *Message) GetSiblings() []*Entry {
+	if x != nil {
+		return x.Siblings
+	}
+	return nil
+}
+
+func (x *Message) GetLogIndex() uint64 {
+	if x != nil {
+		return x.LogIndex
+	}
+	return 0
+}
+
+func (x *Message) GetLogTerm() int64 {
+	if x != nil {
+		return x.LogTerm
+	}
+	return 0
+}
+
+func (x *Message) GetSentAt() int64 {
+	if x != nil {
+		return x.SentAt
+	}
+	return 0
+}
+
+func (x *Message) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *Message) GetTimeout() int64 {
+	if x != nil {
+		return x.Timeout
+	}
+	return 0
+}
+
+type Timestamp struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          uint64                 `protobuf:"varint,1,opt,name=time,proto3" json:"time,omitempty"`
+	Node          int64                  `protobuf:"varint,2,opt,name=node,proto3" json:"node,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Timestamp) Reset() {
+	*x = Timestamp{}
+	mi := &file_proto_node_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Timestamp) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Timestamp) ProtoMessage() {}
+
+func (x *Timestamp) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_node_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Timestamp.ProtoReflect.Descriptor instead.
+func (*Timestamp) Descriptor() ([]byte, []int) {
+	return file_proto_node_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Timestamp) GetTime() uint64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *Timestamp) GetNode() int64 {
+	if x != nil {
+		return x.Node
+	}
+	return 0
+}
+
+type Entry struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Value     string                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Deleted   bool                   `protobuf:"varint,2,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	Timestamp *Timestamp             `protobuf:"bytes,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Expires   int64                  `protobuf:"varint,4,opt,name=expires,proto3" json:"expires,omitempty"`
+	// Version vector of the entry and the entries written concurrently with
+	// it, on clusters keeping siblings.
+	Version       map[int64]uint64 `protobuf:"bytes,5,rep,name=version,proto3" json:"version,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Siblings      []*Entry         `protobuf:"bytes,6,rep,name=siblings,proto3" json:"siblings,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Entry) Reset() {
+	*x = Entry{}
+	mi := &file_proto_node_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Entry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Entry) ProtoMessage() {}
+
+func (x *Entry) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_node_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Entry.ProtoReflect.Descriptor instead.
+func (*Entry) Descriptor() ([]byte, []int) {
+	return file_proto_node_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Entry) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
+func (x *Entry) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+func (x *Entry) GetTimestamp() *Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Entry) GetExpires() int64 {
+	if x != nil {
+		return x.Expires
+	}
+	return 0
+}
+
+func (x *Entry) GetVersion() map[int64]uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return nil
+}
+
+func (x *Entry) GetSiblings() []*Entry {
+	if x != nil {
+		return x.Siblings
+	}
+	return nil
+}
+
+type Load struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	QueueDepth    int64                  `protobuf:"varint,1,opt,name=queue_depth,json=queueDepth,proto3" json:"queue_depth,omitempty"`
+	QueueCapacity int64                  `protobuf:"varint,2,opt,name=queue_capacity,json=queueCapacity,proto3" json:"queue_capacity,omitempty"`
+	Goroutines    int64                  `protobuf:"varint,3,opt,name=goroutines,proto3" json:"goroutines,omitempty"`
+	HeapBytes     uint64                 `protobuf:"varint,4,opt,name=heap_bytes,json=heapBytes,proto3" json:"heap_bytes,omitempty"`
+	IdleWorkers   int64                  `protobuf:"varint,5,opt,name=idle_workers,json=idleWorkers,proto3" json:"idle_workers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Load) Reset() {
+	*x = Load{}
+	mi := &file_proto_node_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Load) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Load) ProtoMessage() {}
+
+func (x *Load) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_node_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Load.ProtoReflect.Descriptor instead.
+func (*Load) Descriptor() ([]byte, []int) {
+	return file_proto_node_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Load) GetQueueDepth() int64 {
+	if x != nil {
+		return x.QueueDepth
+	}
+	return 0
+}
+
+func (x *Load) GetQueueCapacity() int64 {
+	if x != nil {
+		return x.QueueCapacity
+	}
+	return 0
+}
+
+func (x *Load) GetGoroutines() int64 {
+	if x != nil {
+		return x.Goroutines
+	}
+	return 0
+}
+
+func (x *Load) GetHeapBytes() uint64 {
+	if x != nil {
+		return x.HeapBytes
+	}
+	return 0
+}
+
+func (x *Load) GetIdleWorkers() int64 {
+	if x != nil {
+		return x.IdleWorkers
+	}
+	return 0
+}
+
+var File_proto_node_proto protoreflect.FileDescriptor
+
+const file_proto_node_proto_rawDesc = "" +
+	"\n" +
+	"\x10proto/node.proto\x12\x03dbs\"\xd4\r\n" +
+	"\aMessage\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x18\n" +
+	"\acontent\x18\x02 \x01(\tR\acontent\x12\x12\n" +
+	"\x04from\x18\x03 \x01(\x03R\x04from\x12\x10\n" +
+	"\x03key\x18\x04 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x05 \x01(\tR\x05value\x12\x14\n" +
+	"\x05found\x18\x06 \x01(\bR\x05found\x12\x12\n" +
+	"\x04term\x18\a \x01(\x03R\x04term\x12!\n" +
+	"\fvote_granted\x18\b \x01(\bR\vvoteGranted\x12\x17\n" +
+	"\atask_id\x18\t \x01(\tR\x06taskId\x12\x14\n" +
+	"\x05error\x18\n" +
+	" \x01(\tR\x05error\x12-\n" +
+	"\x05peers\x18\v \x03(\v2\x17.dbs.Message.PeersEntryR\x05peers\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\f \x01(\tR\trequestId\x12\x1c\n" +
+	"\tforwarded\x18\r \x01(\bR\tforwarded\x12\x10\n" +
+	"\x03seq\x18\x0e \x01(\x04R\x03seq\x12\x1b\n" +
+	"\ttask_type\x18\x0f \x01(\tR\btaskType\x12-\n" +
+	"\x05clock\x18\x10 \x03(\v2\x17.dbs.Message.ClockEntryR\x05clock\x12\x16\n" +
+	"\x06hashes\x18\x11 \x03(\x04R\x06hashes\x12\x18\n" +
+	"\abuckets\x18\x12 \x03(\x03R\abuckets\x123\n" +
+	"\aentries\x18\x13 \x03(\v2\x19.dbs.Message.EntriesEntryR\aentries\x12\x16\n" +
+	"\x06client\x18\x14 \x01(\bR\x06client\x12\x1d\n" +
+	"\x04load\x18\x15 \x01(\v2\t.dbs.LoadR\x04load\x12 \n" +
+	"\vcompression\x18\x16 \x01(\tR\vcompression\x12\x1e\n" +
+	"\n" +
+	"compressed\x18\x17 \x01(\fR\n" +
+	"compressed\x12\x10\n" +
+	"\x03mac\x18\x18 \x01(\fR\x03mac\x12,\n" +
+	"\ttimestamp\x18\x19 \x01(\v2\x0e.dbs.TimestampR\ttimestamp\x12\x16\n" +
+	"\x06stream\x18\x1a \x01(\tR\x06stream\x12\x16\n" +
+	"\x06offset\x18\x1b \x01(\x03R\x06offset\x12\x12\n" +
+	"\x04size\x18\x1c \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x1d \x01(\rR\bchecksum\x12\x12\n" +
+	"\x04data\x18\x1e \x01(\fR\x04data\x12\x12\n" +
+	"\x04ring\x18\x1f \x03(\x03R\x04ring\x12\x10\n" +
+	"\x03ttl\x18  \x01(\x03R\x03ttl\x12\x18\n" +
+	"\aexpires\x18! \x01(\x03R\aexpires\x12\x12\n" +
+	"\x04role\x18\" \x01(\tR\x04role\x12\x19\n" +
+	"\btrace_id\x18# \x01(\tR\atraceId\x12\x17\n" +
+	"\aspan_id\x18$ \x01(\tR\x06spanId\x12\x18\n" +
+	"\aversion\x18% \x01(\x03R\aversion\x12\"\n" +
+	"\fcapabilities\x18& \x03(\tR\fcapabilities\x12\x0e\n" +
+	"\x02tx\x18' \x01(\tR\x02tx\x12 \n" +
+	"\vconsistency\x18( \x01(\tR\vconsistency\x12\x1b\n" +
+	"\x06target\x18) \x01(\x05H\x00R\x06target\x88\x01\x01\x12\x1a\n" +
+	"\bprogress\x18* \x01(\x05R\bprogress\x12\x12\n" +
+	"\x04beat\x18+ \x01(\x04R\x04beat\x12'\n" +
+	"\x0fidempotency_key\x18, \x01(\tR\x0eidempotencyKey\x12\x1a\n" +
+	"\bpriority\x18- \x01(\tR\bpriority\x12\x12\n" +
+	"\x04user\x18. \x01(\tR\x04user\x123\n" +
+	"\acontext\x18/ \x03(\v2\x19.dbs.Message.ContextEntryR\acontext\x12&\n" +
+	"\bsiblings\x180 \x03(\v2\n" +
+	".dbs.EntryR\bsiblings\x12\x1b\n" +
+	"\tlog_index\x181 \x01(\x04R\blogIndex\x12\x19\n" +
+	"\blog_term\x182 \x01(\x03R\alogTerm\x12\x17\n" +
+	"\asent_at\x183 \x01(\x03R\x06sentAt\x12\x1c\n" +
+	"\tnamespace\x184 \x01(\tR\tnamespace\x12\x18\n" +
+	"\atimeout\x185 \x01(\x03R\atimeout\x1a8\n" +
+	"\n" +
+	"PeersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a8\n" +
+	"\n" +
+	"ClockEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\x1aF\n" +
+	"\fEntriesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12 \n" +
+	"\x05value\x18\x02 \x01(\v2\n" +
+	".dbs.EntryR\x05value:\x028\x01\x1a:\n" +
+	"\fContextEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01B\t\n" +
+	"\a_target\"3\n" +
+	"\tTimestamp\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\x04R\x04time\x12\x12\n" +
+	"\x04node\x18\x02 \x01(\x03R\x04node\"\x96\x02\n" +
+	"\x05Entry\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\tR\x05value\x12\x18\n" +
+	"\adeleted\x18\x02 \x01(\bR\adeleted\x12,\n" +
+	"\ttimestamp\x18\x03 \x01(\v2\x0e.dbs.TimestampR\ttimestamp\x12\x18\n" +
+	"\aexpires\x18\x04 \x01(\x03R\aexpires\x121\n" +
+	"\aversion\x18\x05 \x03(\v2\x17.dbs.Entry.VersionEntryR\aversion\x12&\n" +
+	"\bsiblings\x18\x06 \x03(\v2\n" +
+	".dbs.EntryR\bsiblings\x1a:\n" +
+	"\fVersionEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x04R\x05value:\x028\x01\"\xb0\x01\n" +
+	"\x04Load\x12\x1f\n" +
+	"\vqueue_depth\x18\x01 \x01(\x03R\n" +
+	"queueDepth\x12%\n" +
+	"\x0equeue_capacity\x18\x02 \x01(\x03R\rqueueCapacity\x12\x1e\n" +
+	"\n" +
+	"goroutines\x18\x03 \x01(\x03R\n" +
+	"goroutines\x12\x1d\n" +
+	"\n" +
+	"heap_bytes\x18\x04 \x01(\x04R\theapBytes\x12!\n" +
+	"\fidle_workers\x18\x05 \x01(\x03R\vidleWorkers20\n" +
+	"\x04Node\x12(\n" +
+	"\x06Stream\x12\f.dbs.Message\x1a\f.dbs.Message(\x010\x01B1Z/github.com/mrinalxdev/dbs-pt-1/transport/nodepbb\x06proto3"
+
+var (
+	file_proto_node_proto_rawDescOnce sync.Once
+	file_proto_node_proto_rawDescData []byte
+)
+
+func file_proto_node_proto_rawDescGZIP() []byte {
+	file_proto_node_proto_rawDescOnce.Do(func() {
+		file_proto_node_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_node_proto_rawDesc), len(file_proto_node_proto_rawDesc)))
+	})
+	return file_proto_node_proto_rawDescData
+}
+
+var file_proto_node_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_proto_node_proto_goTypes = []any{
+	(*Message)(nil),   // 0: dbs.Message
+	(*Timestamp)(nil), // 1: dbs.Timestamp
+	(*Entry)(nil),     // 2: dbs.Entry
+	(*Load)(nil),      // 3: dbs.Load
+	nil,               // 4: dbs.Message.PeersEntry
+	nil,               // 5: dbs.Message.ClockEntry
+	nil,               // 6: dbs.Message.EntriesEntry
+	nil,               // 7: dbs.Message.ContextEntry
+	nil,               // 8: dbs.Entry.VersionEntry
+}
+var file_proto_node_proto_depIdxs = []int32{
+	4,  // 0: dbs.Message.peers:type_name -> dbs.Message.PeersEntry
+	5,  // 1: dbs.Message.clock:type_name -> dbs.Message.ClockEntry
+	6,  // 2: dbs.Message.entries:type_name -> dbs.Message.EntriesEntry
+	3,  // 3: dbs.Message.load:type_name -> dbs.Load
+	1,  // 4: dbs.Message.timestamp:type_name -> dbs.Timestamp
+	7,  // 5: dbs.Message.context:type_name -> dbs.Message.ContextEntry
+	2,  // 6: dbs.Message.siblings:type_name -> dbs.Entry
+	1,  // 7: dbs.Entry.timestamp:type_name -> dbs.Timestamp
+	8,  // 8: dbs.Entry.version:type_name -> dbs.Entry.VersionEntry
+	2,  // 9: dbs.Entry.siblings:type_name -> dbs.Entry
+	2,  // 10: dbs.Message.EntriesEntry.value:type_name -> dbs.Entry
+	0,  // 11: dbs.Node.Stream:input_type -> dbs.Message
+	0,  // 12: dbs.Node.Stream:output_type -> dbs.Message
+	12, // [12:13] is the sub-list for method output_type
+	11, // [11:12] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
+}
+
+func init() { file_proto_node_proto_init() }
+func file_proto_node_proto_init() {
+	if File_proto_node_proto != nil {
+		return
+	}
+	file_proto_node_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_node_proto_rawDesc), len(file_proto_node_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_node_proto_goTypes,
+		DependencyIndexes: file_proto_node_proto_depIdxs,
+		MessageInfos:      file_proto_node_proto_msgTypes,
+	}.Build()
+	File_proto_node_proto = out.File
+	file_proto_node_proto_goTypes = nil
+	file_proto_node_proto_depIdxs = nil
+}
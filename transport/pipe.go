@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var errPipeUnsupported = errors.New("named pipes are only supported on Windows; use the unix transport")
+
+// Pipe sends messages over Windows named pipes, for nodes and clients on
+// the same host: addresses are pipe names such as \\.\pipe\dbs-node1. Like
+// Unix, it skips the TCP stack and opens no network port, and pipes refuse
+// clients on other hosts. It fails on other systems. Dialed connections
+// use Protocol and Codec; accepted ones use whatever the dialer negotiates.
+// Connections receive messages of up to MaxMessageSize bytes, MaxFrameSize
+// if 0.
+type Pipe struct {
+	Protocol       string
+	Codec          string
+	MaxMessageSize int
+}
+
+func (p Pipe) Listen(name string, handle func(Conn)) (io.Closer, error) {
+	listener, err := listenPipe(name)
+	if err != nil {
+		return nil, err
+	}
+	go serve(listener, handle, p.MaxMessageSize, nil)
+	return listener, nil
+}
+
+func (p Pipe) Dial(name string) (Conn, error) {
+	return dialNegotiated(func() (net.Conn, error) {
+		return dialPipe(name)
+	}, p.Protocol, p.Codec, p.MaxMessageSize)
+}
+
+// pipeAddr is the address of either end of a named pipe: its name.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
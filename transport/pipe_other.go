@@ -0,0 +1,16 @@
+//go:build !windows
+
+package transport
+
+import "net"
+
+// pipeSupported reports whether this system has named pipes.
+const pipeSupported = false
+
+func listenPipe(string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+func dialPipe(string) (net.Conn, error) {
+	return nil, errPipeUnsupported
+}
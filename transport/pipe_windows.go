@@ -0,0 +1,350 @@
+//go:build windows
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// pipeSupported reports whether this system has named pipes.
+const pipeSupported = true
+
+const (
+	// pipeBufferSize is the size of each pipe instance's buffers, and of
+	// the buffers each connection reads and writes through.
+	pipeBufferSize = 64 << 10
+	// pipeBusyTimeout bounds how long a dial waits for the listener to
+	// create an instance of the pipe when every one is taken.
+	pipeBusyTimeout = 5 * time.Second
+)
+
+// pipeHandle is a pipe handle opened for overlapped I/O. Closing it sets
+// closing, which makes I/O still pending cancel itself, and waits for that
+// before the handle is closed, so no I/O is ever issued on a closed handle
+// that Windows may have reused.
+type pipeHandle struct {
+	handle  windows.Handle
+	closing windows.Handle
+	mutex   sync.RWMutex
+	closed  atomic.Bool
+}
+
+func newPipeHandle(handle windows.Handle) (*pipeHandle, error) {
+	closing, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return &pipeHandle{handle: handle, closing: closing}, nil
+}
+
+// pipeOp is the state of one kind of overlapped I/O on a pipe, of which
+// one runs at a time. The kernel writes to o and buf until the I/O
+// completes, so both are allocated on the heap, where they do not move.
+type pipeOp struct {
+	o   windows.Overlapped
+	buf []byte
+}
+
+func newPipeOp(size int) (*pipeOp, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeOp{o: windows.Overlapped{HEvent: event}, buf: make([]byte, size)}, nil
+}
+
+func (op *pipeOp) close() {
+	windows.CloseHandle(op.o.HEvent)
+}
+
+// do issues call with op on the handle and waits until the I/O completes,
+// or is cancelled because the handle was closed, returning the number of
+// bytes transferred.
+func (p *pipeHandle) do(op *pipeOp, call func(windows.Handle, *windows.Overlapped) error) (uint32, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	op.o = windows.Overlapped{HEvent: op.o.HEvent}
+	if err := windows.ResetEvent(op.o.HEvent); err != nil {
+		return 0, err
+	}
+	if err := call(p.handle, &op.o); err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+	signaled, err := windows.WaitForMultipleObjects([]windows.Handle{op.o.HEvent, p.closing}, false, windows.INFINITE)
+	if err != nil || signaled != windows.WAIT_OBJECT_0 {
+		windows.CancelIoEx(p.handle, &op.o)
+	}
+	var done uint32
+	err = windows.GetOverlappedResult(p.handle, &op.o, &done, true)
+	if err == windows.ERROR_OPERATION_ABORTED && p.closed.Load() {
+		err = net.ErrClosed
+	}
+	return done, err
+}
+
+// disconnect drops the client of a listener's instance, which then waits
+// for another.
+func (p *pipeHandle) disconnect() error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed.Load() {
+		return net.ErrClosed
+	}
+	return windows.DisconnectNamedPipe(p.handle)
+}
+
+func (p *pipeHandle) close() error {
+	if p.closed.Swap(true) {
+		return net.ErrClosed
+	}
+	windows.SetEvent(p.closing)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	windows.CloseHandle(p.closing)
+	return windows.CloseHandle(p.handle)
+}
+
+// pipeConn is a connected end of a named pipe.
+type pipeConn struct {
+	pipe       *pipeHandle
+	name       pipeAddr
+	read       *pipeOp
+	write      *pipeOp
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+}
+
+func newPipeConn(pipe *pipeHandle, name pipeAddr) (*pipeConn, error) {
+	read, err := newPipeOp(pipeBufferSize)
+	if err != nil {
+		pipe.close()
+		return nil, err
+	}
+	write, err := newPipeOp(pipeBufferSize)
+	if err != nil {
+		read.close()
+		pipe.close()
+		return nil, err
+	}
+	return &pipeConn{pipe: pipe, name: name, read: read, write: write}, nil
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	buf := c.read.buf[:min(len(b), len(c.read.buf))]
+	n, err := c.pipe.do(c.read, func(h windows.Handle, o *windows.Overlapped) error {
+		return windows.ReadFile(h, buf, nil, o)
+	})
+	copy(b, buf[:n])
+	switch {
+	case err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return int(n), io.EOF
+	case err != nil:
+		return int(n), &net.OpError{Op: "read", Net: "pipe", Addr: c.name, Err: err}
+	}
+	return int(n), nil
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		chunk := c.write.buf[:copy(c.write.buf, b[written:])]
+		n, err := c.pipe.do(c.write, func(h windows.Handle, o *windows.Overlapped) error {
+			return windows.WriteFile(h, chunk, nil, o)
+		})
+		written += int(n)
+		if err != nil {
+			return written, &net.OpError{Op: "write", Net: "pipe", Addr: c.name, Err: err}
+		}
+	}
+	return written, nil
+}
+
+func (c *pipeConn) Close() error {
+	err := c.pipe.close()
+	if err == nil {
+		c.read.close()
+		c.write.close()
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.name }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.name }
+
+// Pipes have no deadlines; connections that stall are closed instead.
+func (c *pipeConn) SetDeadline(time.Time) error      { return errors.ErrUnsupported }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return errors.ErrUnsupported }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return errors.ErrUnsupported }
+
+// pipeListener accepts connections on a named pipe. Each client connects
+// to an instance of the pipe of its own; next is the one waiting for the
+// next client, created as soon as the last one is taken so dialers find
+// the pipe.
+type pipeListener struct {
+	name    pipeAddr
+	connect *pipeOp
+	mutex   sync.Mutex
+	next    *pipeHandle
+	closed  bool
+}
+
+func listenPipe(name string) (net.Listener, error) {
+	next, err := createPipe(name, true)
+	if err != nil {
+		return nil, err
+	}
+	connect, err := newPipeOp(0)
+	if err != nil {
+		next.close()
+		return nil, err
+	}
+	return &pipeListener{name: pipeAddr(name), connect: connect, next: next}, nil
+}
+
+// createPipe creates an instance of the pipe name. The first instance
+// fails, rather than share the name, if another listener has it.
+func createPipe(name string, first bool) (*pipeHandle, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	handle, err := windows.CreateNamedPipe(path, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, nil)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(name), Err: err}
+	}
+	return newPipeHandle(handle)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	if l.next == nil {
+		next, err := createPipe(string(l.name), false)
+		if err != nil {
+			l.mutex.Unlock()
+			return nil, err
+		}
+		l.next = next
+	}
+	instance := l.next
+	l.mutex.Unlock()
+
+	for {
+		_, err := instance.do(l.connect, func(h windows.Handle, o *windows.Overlapped) error {
+			return windows.ConnectNamedPipe(h, o)
+		})
+		if err == windows.ERROR_NO_DATA {
+			// The client already went away
+			if err = instance.disconnect(); err == nil {
+				continue
+			}
+		}
+		// ERROR_PIPE_CONNECTED means the client connected before
+		// ConnectNamedPipe was called
+		if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+			if errors.Is(err, net.ErrClosed) {
+				return nil, net.ErrClosed
+			}
+			return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.name, Err: err}
+		}
+		break
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	// If this fails, the next Accept tries again and reports why
+	l.next, _ = createPipe(string(l.name), false)
+	conn, err := newPipeConn(instance, l.name)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return net.ErrClosed
+	}
+	l.closed = true
+	next := l.next
+	l.next = nil
+	l.mutex.Unlock()
+
+	// Closing the instance waits for a pending Accept to give it up
+	if next != nil {
+		next.close()
+	}
+	l.connect.close()
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.name
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(pipeBusyTimeout)
+	for {
+		// SECURITY_IDENTIFICATION keeps the listener from acting as the
+		// dialing user
+		handle, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			pipe, err := newPipeHandle(handle)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := newPipeConn(pipe, pipeAddr(name))
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+		// Every instance is taken until the listener creates the next
+		if err != windows.ERROR_PIPE_BUSY || time.Now().After(deadline) {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(name), Err: err}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
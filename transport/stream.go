@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// ChunkSize is the largest payload sent in a single message. Messages with
+// more content are streamed in chunks of this size.
+const ChunkSize = 1 << 20
+
+// MaxStreamSize bounds the encoded size of a streamed message, so a peer
+// cannot make the receiver buffer unbounded memory.
+const MaxStreamSize = 256 << 20
+
+// Chunked wraps t so that large messages are streamed as a stream_start, a
+// run of stream_chunk messages carrying consecutive slices of the encoded
+// message at their offsets, and a stream_end. Every chunk and the whole
+// message carry CRC-32 checksums; the receiver reassembles and verifies the
+// message and delivers it as if it had been sent in one piece. A stream that
+// arrives incomplete or corrupt is discarded, leaving retries to the
+// sender's delivery guarantees.
+func Chunked(t Transport) Transport {
+	return chunkTransport{t}
+}
+
+type chunkTransport struct {
+	Transport
+}
+
+func (t chunkTransport) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	return t.Transport.Listen(address, func(conn Conn) {
+		handle(NewChunkConn(conn))
+	})
+}
+
+func (t chunkTransport) Dial(address string) (Conn, error) {
+	conn, err := t.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkConn(conn), nil
+}
+
+// NewChunkConn wraps a single connection in the streaming of Chunked, for
+// clients that dial nodes directly.
+func NewChunkConn(conn Conn) Conn {
+	return &chunkConn{Conn: conn, streams: make(map[string]*stream)}
+}
+
+type chunkConn struct {
+	Conn
+	next atomic.Uint64
+	// streams is only touched by Recv, which has a single caller
+	streams map[string]*stream
+}
+
+// stream is a message being reassembled.
+type stream struct {
+	size     int
+	checksum uint32
+	data     []byte
+}
+
+// payloadSize estimates how much of msg is payload, without encoding it.
+func payloadSize(msg Message) int {
+	return len(msg.Content) + len(msg.Value) + len(msg.Compressed)
+}
+
+func (c *chunkConn) Send(msg Message) error {
+	if payloadSize(msg) <= ChunkSize {
+		return c.Conn.Send(msg)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxStreamSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte stream limit", len(data), MaxStreamSize)
+	}
+
+	id := strconv.FormatUint(c.next.Add(1), 10)
+	header := Message{From: msg.From, Client: msg.Client, Stream: id}
+
+	start := header
+	start.Type = "stream_start"
+	start.Size = len(data)
+	start.Checksum = crc32.ChecksumIEEE(data)
+	if err := c.Conn.Send(start); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += ChunkSize {
+		piece := data[offset:min(offset+ChunkSize, len(data))]
+		chunk := header
+		chunk.Type = "stream_chunk"
+		chunk.Offset = offset
+		chunk.Data = piece
+		chunk.Checksum = crc32.ChecksumIEEE(piece)
+		if err := c.Conn.Send(chunk); err != nil {
+			return err
+		}
+	}
+	end := header
+	end.Type = "stream_end"
+	return c.Conn.Send(end)
+}
+
+// Write buffers msg unless it has to be streamed, which Send does at once.
+func (c *chunkConn) Write(msg Message) error {
+	if payloadSize(msg) <= ChunkSize {
+		return writeBatched(c.Conn, msg)
+	}
+	return c.Send(msg)
+}
+
+func (c *chunkConn) Flush() error {
+	return flushBatched(c.Conn)
+}
+
+func (c *chunkConn) Recv() (Message, error) {
+	for {
+		msg, err := c.Conn.Recv()
+		if err != nil {
+			return msg, err
+		}
+
+		switch msg.Type {
+		case "stream_start":
+			if msg.Size < 0 || msg.Size > MaxStreamSize {
+				continue
+			}
+			c.streams[msg.Stream] = &stream{
+				size:     msg.Size,
+				checksum: msg.Checksum,
+				data:     make([]byte, 0, msg.Size),
+			}
+
+		case "stream_chunk":
+			s, ok := c.streams[msg.Stream]
+			if !ok {
+				continue
+			}
+			if msg.Offset != len(s.data) || len(s.data)+len(msg.Data) > s.size ||
+				crc32.ChecksumIEEE(msg.Data) != msg.Checksum {
+				delete(c.streams, msg.Stream)
+				continue
+			}
+			s.data = append(s.data, msg.Data...)
+
+		case "stream_end":
+			s, ok := c.streams[msg.Stream]
+			delete(c.streams, msg.Stream)
+			if !ok || len(s.data) != s.size || crc32.ChecksumIEEE(s.data) != s.checksum {
+				continue
+			}
+			var whole Message
+			if err := json.Unmarshal(s.data, &whole); err != nil {
+				continue
+			}
+			return whole, nil
+
+		default:
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package transport defines the messages nodes exchange and the
+// connections they are carried over.
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is a bidirectional message stream to a single peer.
+type Conn interface {
+	Send(msg Message) error
+	Recv() (Message, error)
+	Close() error
+}
+
+// Transport creates the connections nodes talk over. Listen serves inbound
+// connections by calling handle for each one until the returned Closer is
+// closed.
+type Transport interface {
+	Listen(address string, handle func(Conn)) (io.Closer, error)
+	Dial(address string) (Conn, error)
+}
+
+// Options configures the transport returned by New.
+type Options struct {
+	// TLS secures every connection when it is not nil.
+	TLS *tls.Config
+	// Protocol is the wire protocol TCP connections are dialed with:
+	// ProtocolJSON (the default) or ProtocolBinary. Listeners accept both.
+	Protocol string
+	// Codec encodes the frames of dialed binary connections, CodecJSON if
+	// empty. Other codecs need ProtocolBinary.
+	Codec string
+	// MaxMessageSize bounds the messages connections receive, MaxFrameSize
+	// if 0.
+	MaxMessageSize int
+	// Quarantine, if set, refuses TCP connections from hosts that keep
+	// sending malformed messages.
+	Quarantine *Quarantine
+	// KeepAlive is how long a TCP connection may idle before it is probed,
+	// and how often it is probed after that; see TCP.
+	KeepAlive time.Duration
+}
+
+// New returns the transport registered under name.
+func New(name string, opts Options) (Transport, error) {
+	if !validProtocol(opts.Protocol) {
+		return nil, fmt.Errorf("unknown protocol %q", opts.Protocol)
+	}
+	if !ValidCodec(opts.Codec) {
+		return nil, fmt.Errorf("unknown codec %q: expected one of %v", opts.Codec, CodecNames())
+	}
+	if opts.Codec != "" && opts.Codec != CodecJSON && opts.Protocol != ProtocolBinary {
+		return nil, fmt.Errorf("the %s codec needs the %s protocol", opts.Codec, ProtocolBinary)
+	}
+
+	switch name {
+	case "", "tcp":
+		return TCP{TLS: opts.TLS, Protocol: opts.Protocol, Codec: opts.Codec, MaxMessageSize: opts.MaxMessageSize, Quarantine: opts.Quarantine, KeepAlive: opts.KeepAlive}, nil
+	case "grpc":
+		return GRPC{TLS: opts.TLS, MaxMessageSize: opts.MaxMessageSize}, nil
+	case "unix":
+		if opts.TLS != nil {
+			return nil, errors.New("the unix transport does not use TLS")
+		}
+		return Unix{Protocol: opts.Protocol, Codec: opts.Codec, MaxMessageSize: opts.MaxMessageSize}, nil
+	case "pipe":
+		if !pipeSupported {
+			return nil, errPipeUnsupported
+		}
+		if opts.TLS != nil {
+			return nil, errors.New("the pipe transport does not use TLS")
+		}
+		return Pipe{Protocol: opts.Protocol, Codec: opts.Codec, MaxMessageSize: opts.MaxMessageSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// TCP sends messages over TCP, wrapped in TLS when TLS is set. Dialed
+// connections use Protocol and, if it is binary, Codec; accepted ones use
+// whatever the dialer negotiates. Connections receive messages of up to
+// MaxMessageSize bytes, MaxFrameSize if 0, and with a Quarantine, hosts
+// whose connections keep sending malformed ones are refused for a while.
+//
+// Both ends enable TCP keepalive: a connection idle for KeepAlive is probed
+// every KeepAlive, and closed by the kernel once keepAliveProbes probes go
+// unanswered, so a peer that lost power or a NAT that forgot the flow
+// fails its Recv within seconds. If KeepAlive is 0 the Go defaults apply.
+type TCP struct {
+	TLS            *tls.Config
+	Protocol       string
+	Codec          string
+	MaxMessageSize int
+	Quarantine     *Quarantine
+	KeepAlive      time.Duration
+}
+
+// keepAliveProbes is how many keepalive probes may go unanswered before a
+// TCP connection is given up.
+const keepAliveProbes = 3
+
+// keepAlive returns the keepalive settings of t's connections.
+func (t TCP) keepAlive() net.KeepAliveConfig {
+	if t.KeepAlive <= 0 {
+		return net.KeepAliveConfig{}
+	}
+	return net.KeepAliveConfig{Enable: true, Idle: t.KeepAlive, Interval: t.KeepAlive, Count: keepAliveProbes}
+}
+
+func (t TCP) Listen(address string, handle func(Conn)) (io.Closer, error) {
+	config := net.ListenConfig{KeepAliveConfig: t.keepAlive()}
+	listener, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLS != nil {
+		listener = tls.NewListener(listener, t.TLS)
+	}
+	go serve(listener, handle, t.MaxMessageSize, t.Quarantine)
+	return listener, nil
+}
+
+// serve accepts connections on listener, negotiating the protocol of each
+// and handing it to handle, until listener is closed. Connections receive
+// messages of up to limit bytes; those from hosts quarantine refuses are
+// closed at once.
+func serve(listener net.Listener, handle func(Conn), limit int, quarantine *Quarantine) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("failed to accept connection", "err", err)
+			continue
+		}
+		host := remoteHost(conn)
+		if quarantine != nil && quarantine.Refuses(host) {
+			slog.Debug("refused connection from quarantined host", "remote", host)
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			// Handshake eagerly so unverified peers are rejected up front
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := tlsConn.Handshake(); err != nil {
+					slog.Warn("rejected TLS connection", "remote", conn.RemoteAddr().String(), "err", err)
+					conn.Close()
+					return
+				}
+			}
+			c, err := negotiateAccept(conn, limit)
+			if err != nil {
+				slog.Warn("rejected connection", "remote", conn.RemoteAddr().String(), "err", err)
+				conn.Close()
+				return
+			}
+			if quarantine != nil {
+				c = &guardedConn{Conn: c, host: host, quarantine: quarantine}
+			}
+			handle(c)
+		}()
+	}
+}
+
+func (t TCP) Dial(address string) (Conn, error) {
+	dialer := &net.Dialer{KeepAliveConfig: t.keepAlive()}
+	return dialNegotiated(func() (net.Conn, error) {
+		if t.TLS != nil {
+			return tls.DialWithDialer(dialer, "tcp", address, t.TLS)
+		}
+		return dialer.Dial("tcp", address)
+	}, t.Protocol, t.Codec, t.MaxMessageSize)
+}
+
+type jsonConn struct {
+	conn    net.Conn
+	limit   *limitedReader
+	decoder *json.Decoder
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	sendMu  sync.Mutex
+}
+
+func newJSONConn(conn net.Conn, reader io.Reader, limit int) *jsonConn {
+	writer := bufio.NewWriter(conn)
+	limited := newLimitedReader(reader, limit)
+	return &jsonConn{
+		conn:    conn,
+		limit:   limited,
+		decoder: json.NewDecoder(limited),
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}
+}
+
+func (c *jsonConn) Send(msg Message) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if err := c.encoder.Encode(msg); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *jsonConn) Write(msg Message) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return c.encoder.Encode(msg)
+}
+
+func (c *jsonConn) Flush() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return c.writer.Flush()
+}
+
+func (c *jsonConn) Recv() (Message, error) {
+	var msg Message
+	c.limit.reset()
+	if err := c.decoder.Decode(&msg); err != nil {
+		return msg, decodeError(err)
+	}
+	return msg, nil
+}
+
+func (c *jsonConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxDatagram bounds the size of a message sent as a datagram. Larger ones
+// belong on a stream connection.
+const maxDatagram = 8 << 10
+
+// ErrDatagramTooLarge is returned by Datagrams.Send for messages that do
+// not fit in maxDatagram bytes.
+var ErrDatagramTooLarge = errors.New("message too large for a datagram")
+
+// Datagrams sends and receives single messages over UDP, for small, time
+// sensitive traffic such as heartbeats that must not queue up behind bulk
+// transfers on a stream connection. Delivery is unreliable: datagrams may
+// be lost, duplicated or reordered.
+//
+// Messages are signed and verified with auth's tokens, and chaos's faults
+// apply, as on stream connections. Datagrams are not encrypted.
+type Datagrams struct {
+	conn  *net.UDPConn
+	auth  *Auth
+	chaos *Chaos
+
+	mutex sync.Mutex
+	addrs map[string]*net.UDPAddr
+}
+
+// ListenDatagrams listens for datagrams on the UDP port of address. auth
+// and chaos may be nil.
+func ListenDatagrams(address string, auth *Auth, chaos *Chaos) (*Datagrams, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Datagrams{conn: conn, auth: auth, chaos: chaos, addrs: make(map[string]*net.UDPAddr)}, nil
+}
+
+// resolve returns the UDP address of address, caching lookups.
+func (d *Datagrams) resolve(address string) (*net.UDPAddr, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if addr, ok := d.addrs[address]; ok {
+		return addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	d.addrs[address] = addr
+	return addr, nil
+}
+
+// Send sends msg to node peer listening at address. A message chaos drops
+// counts as sent.
+func (d *Datagrams) Send(peer int, address string, msg Message) error {
+	if d.chaos != nil {
+		lost, delay := d.chaos.outgoing(int64(peer))
+		if lost {
+			return nil
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	if d.auth != nil {
+		if err := d.auth.sign(&msg); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxDatagram {
+		return ErrDatagramTooLarge
+	}
+	addr, err := d.resolve(address)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// Recv returns the next valid message received. Datagrams that do not
+// decode, are not signed with an accepted token, or come from a node this
+// one is partitioned from are skipped.
+func (d *Datagrams) Recv() (Message, error) {
+	buf := make([]byte, maxDatagram)
+	for {
+		size, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return Message{}, err
+		}
+		var msg Message
+		if json.Unmarshal(buf[:size], &msg) != nil {
+			continue
+		}
+		if d.auth != nil && d.auth.verify(msg) != nil {
+			continue
+		}
+		if d.chaos != nil && d.chaos.partitioned(int64(msg.From)) {
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Addr returns the local address datagrams are received on.
+func (d *Datagrams) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// Close stops receiving; a blocked Recv returns an error.
+func (d *Datagrams) Close() error {
+	return d.conn.Close()
+}
@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// Unix sends messages over Unix domain sockets, for nodes and clients on the
+// same host: addresses are socket file paths. It skips the TCP stack and
+// opens no network port. Windows 10 and later support Unix sockets too;
+// Pipe uses named pipes instead. Dialed connections use Protocol and Codec;
+// accepted ones use whatever the dialer negotiates. Connections receive
+// messages of up to MaxMessageSize bytes, MaxFrameSize if 0.
+type Unix struct {
+	Protocol       string
+	Codec          string
+	MaxMessageSize int
+}
+
+func (u Unix) Listen(path string, handle func(Conn)) (io.Closer, error) {
+	removeStaleSocket(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is removed when the listener is closed
+	go serve(listener, handle, u.MaxMessageSize, nil)
+	return listener, nil
+}
+
+func (u Unix) Dial(path string) (Conn, error) {
+	return dialNegotiated(func() (net.Conn, error) {
+		return net.Dial("unix", path)
+	}, u.Protocol, u.Codec, u.MaxMessageSize)
+}
+
+// removeStaleSocket removes the socket file a crashed process left at path,
+// which would keep it from being listened on again. A socket something
+// still accepts connections on is left alone, so Listen fails.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
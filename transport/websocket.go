@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket connections (RFC 6455) let browsers talk to a node, which
+// cannot open raw TCP connections. Every message is a JSON object in a text
+// frame. Only the server side is implemented: UpgradeWebSocket turns an
+// HTTP request into a Conn.
+
+// websocketGUID is appended to the client's key to compute the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketWriteTimeout bounds writing a frame, so a browser that stopped
+// reading cannot block the node.
+const websocketWriteTimeout = 10 * time.Second
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// wsConn is the server side of a WebSocket connection.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	limit  int
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+// UpgradeWebSocket completes the WebSocket handshake of r and returns the
+// connection, whose messages are limited to limit bytes (MaxFrameSize if
+// 0). On failure it has already answered r with an error.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request, limit int) (Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "websocket handshake needs GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method not GET")
+	case !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader, limit: messageLimit(limit)}, nil
+}
+
+// headerHasToken reports whether the comma separated header name lists
+// token, case-insensitively.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *wsConn) Send(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(opText, data)
+}
+
+// Recv returns the next data message, answering pings on the way. A close
+// frame ends the connection with io.EOF.
+func (c *wsConn) Recv() (Message, error) {
+	var payload []byte
+	for {
+		fin, opcode, data, err := c.readFrame(c.limit - len(payload))
+		if err != nil {
+			return Message{}, err
+		}
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, data); err != nil {
+				return Message{}, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// Close answers it
+			return Message{}, io.EOF
+		case opText, opBinary:
+			if payload != nil {
+				return Message{}, fmt.Errorf("%w: websocket data frame inside a fragmented message", ErrMalformed)
+			}
+			payload = data
+		case opContinuation:
+			if payload == nil {
+				return Message{}, fmt.Errorf("%w: websocket continuation without a message", ErrMalformed)
+			}
+			payload = append(payload, data...)
+		default:
+			return Message{}, fmt.Errorf("%w: websocket opcode %#x", ErrMalformed, opcode)
+		}
+		if !fin {
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return Message{}, decodeError(err)
+		}
+		return msg, nil
+	}
+}
+
+// readFrame reads a frame of at most limit payload bytes, unmasking it.
+func (c *wsConn) readFrame(limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: websocket extension bits set", ErrMalformed)
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("%w: unmasked websocket frame from a client", ErrMalformed)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (length > 125 || !fin) {
+		return false, 0, nil, fmt.Errorf("%w: invalid websocket control frame", ErrMalformed)
+	}
+	if opcode < opClose && length > uint64(max(limit, 0)) {
+		return false, 0, nil, fmt.Errorf("%w: websocket message over %d bytes", ErrTooLarge, c.limit)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes payload as a single unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame, if it can, and closes the connection.
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.writeFrame(opClose, nil)
+		err = c.conn.Close()
+	})
+	return err
+}